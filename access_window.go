@@ -0,0 +1,205 @@
+package oauth2proxy
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// accessWindow limits when sessions may be used for paths matching regex: on
+// some days of the week, between some times of day and until some date, in
+// the window's timezone. Windows with a group or email selector only apply to
+// the users it selects.
+type accessWindow struct {
+	raw      string
+	regex    *regexp.Regexp
+	days     [7]bool
+	hasDays  bool
+	start    time.Duration
+	end      time.Duration
+	hasHours bool
+	until    time.Time
+	group    string
+	email    *regexp.Regexp
+	location *time.Location
+}
+
+// parseAccessWindow parses an access window of the form <regex>=<schedule>.
+// The last "=" separates them, as regexes may contain one. The schedule is
+// made of space separated days (Mon-Fri or Sat,Sun), hours (08:00-18:00),
+// an expiry date (until:2021-12-31) and a group:<name> or email:<wildcard>
+// selector, all optional but at least one of the days, hours or expiry.
+func parseAccessWindow(s string, loc *time.Location) (*accessWindow, error) {
+	i := strings.LastIndex(s, "=")
+	if i < 0 || strings.TrimSpace(s[i+1:]) == "" {
+		return nil, fmt.Errorf("access_window (%s) must be of the form <regex>=<schedule>", s)
+	}
+	regex, err := regexp.Compile(s[:i])
+	if err != nil {
+		return nil, fmt.Errorf("error compiling access_window regex=%q %s", s[:i], err)
+	}
+	w := &accessWindow{raw: s, regex: regex, location: loc}
+	for _, token := range strings.Fields(s[i+1:]) {
+		lower := strings.ToLower(token)
+		switch {
+		case strings.HasPrefix(lower, "until:"):
+			date, err := time.ParseInLocation("2006-01-02", token[len("until:"):], loc)
+			if err != nil {
+				return nil, fmt.Errorf("access_window (%s) has an invalid expiry date %q", s, token)
+			}
+			// the expiry date is the last day of access
+			w.until = date.AddDate(0, 0, 1)
+		case strings.HasPrefix(lower, "group:") && len(token) > len("group:"):
+			w.group = token[len("group:"):]
+		case strings.HasPrefix(lower, "email:") && len(token) > len("email:"):
+			w.email = wildcardPattern(lower[len("email:"):])
+		case strings.Contains(token, ":"):
+			if w.start, w.end, err = parseHours(token); err != nil {
+				return nil, fmt.Errorf("access_window (%s) has invalid hours %q: %v", s, token, err)
+			}
+			w.hasHours = true
+		default:
+			if err := parseDays(lower, &w.days); err != nil {
+				return nil, fmt.Errorf("access_window (%s) has invalid days %q: %v", s, token, err)
+			}
+			w.hasDays = true
+		}
+	}
+	if !w.hasDays && !w.hasHours && w.until.IsZero() {
+		return nil, fmt.Errorf("access_window (%s) must give days, hours or an expiry date", s)
+	}
+	return w, nil
+}
+
+// parseDays sets the days of a list of days and ranges of days, eg.
+// Mon-Fri,Sun. Ranges may wrap around the end of the week, eg. Fri-Mon.
+func parseDays(s string, days *[7]bool) error {
+	for _, part := range strings.Split(s, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+		first, ok := weekdays[bounds[0]]
+		if !ok {
+			return fmt.Errorf("unknown day %q", bounds[0])
+		}
+		last := first
+		if len(bounds) == 2 {
+			if last, ok = weekdays[bounds[1]]; !ok {
+				return fmt.Errorf("unknown day %q", bounds[1])
+			}
+		}
+		for d := first; ; d = (d + 1) % 7 {
+			days[d] = true
+			if d == last {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// parseHours parses a range of times of day, eg. 08:00-18:00. The end is
+// exclusive and may be 24:00, and ranges ending before they start wrap past
+// midnight, eg. 22:00-06:00.
+func parseHours(s string) (time.Duration, time.Duration, error) {
+	bounds := strings.SplitN(s, "-", 2)
+	if len(bounds) != 2 {
+		return 0, 0, fmt.Errorf("must be of the form HH:MM-HH:MM")
+	}
+	start, err := parseTimeOfDay(bounds[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	end, err := parseTimeOfDay(bounds[1])
+	if err != nil {
+		return 0, 0, err
+	}
+	if start == end || start == 24*time.Hour {
+		return 0, 0, fmt.Errorf("must not be empty")
+	}
+	return start, end, nil
+}
+
+func parseTimeOfDay(s string) (time.Duration, error) {
+	if s == "24:00" {
+		return 24 * time.Hour, nil
+	}
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a time of day of the form HH:MM", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// String returns the window as it was configured, for the auth log
+func (w *accessWindow) String() string {
+	return w.raw
+}
+
+// selects checks whether the window applies to the session's user
+func (w *accessWindow) selects(session *sessionsapi.SessionState) bool {
+	if w.email != nil && !w.email.MatchString(strings.ToLower(session.Email)) {
+		return false
+	}
+	if w.group != "" {
+		for _, group := range session.Groups {
+			if group == w.group {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// allows checks whether the window is open at the time. The days and hours
+// are checked independently, so with hours wrapping past midnight the early
+// hours belong to the day they fall on rather than to the day before.
+func (w *accessWindow) allows(now time.Time) bool {
+	now = now.In(w.location)
+	if !w.until.IsZero() && !now.Before(w.until) {
+		return false
+	}
+	if w.hasDays && !w.days[now.Weekday()] {
+		return false
+	}
+	if w.hasHours {
+		t := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute + time.Duration(now.Second())*time.Second
+		if w.start < w.end {
+			return t >= w.start && t < w.end
+		}
+		return t >= w.start || t < w.end
+	}
+	return true
+}
+
+// closedAccessWindow returns the access window closed to the session for the
+// request, if any. The first window matching the path and selecting the user
+// applies.
+func (p *OAuthProxy) closedAccessWindow(req *http.Request, session *sessionsapi.SessionState) *accessWindow {
+	if len(p.accessWindows) == 0 {
+		return nil
+	}
+	path := p.policyPath(req)
+	for _, w := range p.accessWindows {
+		if w.regex.MatchString(path) && w.selects(session) {
+			if w.allows(p.now()) {
+				return nil
+			}
+			return w
+		}
+	}
+	return nil
+}
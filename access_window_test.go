@@ -0,0 +1,115 @@
+package oauth2proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/clock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseAccessWindow(t *testing.T) {
+	w, err := parseAccessWindow("^/admin/(a=b)?=Mon-Wed,Fri 08:00-18:00 until:2021-12-31 group:contractors", time.UTC)
+	require.NoError(t, err)
+	assert.Equal(t, "^/admin/(a=b)?", w.regex.String())
+	assert.Equal(t, [7]bool{false, true, true, true, false, true, false}, w.days)
+	assert.Equal(t, 8*time.Hour, w.start)
+	assert.Equal(t, 18*time.Hour, w.end)
+	assert.Equal(t, time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC), w.until)
+	assert.Equal(t, "contractors", w.group)
+
+	w, err = parseAccessWindow("^/=Fri-Mon", time.UTC)
+	require.NoError(t, err)
+	assert.Equal(t, [7]bool{true, true, false, false, false, true, true}, w.days)
+
+	for _, s := range []string{
+		"^/admin/",
+		"^/admin/=",
+		"(=Mon-Fri",
+		"^/=Mon-Someday",
+		"^/=08:00",
+		"^/=08:00-08:00",
+		"^/=08:00-25:00",
+		"^/=until:31/12/2021",
+		"^/=group:contractors",
+	} {
+		_, err := parseAccessWindow(s, time.UTC)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestAccessWindowAllows(t *testing.T) {
+	london, err := time.LoadLocation("Europe/London")
+	require.NoError(t, err)
+	workingHours, err := parseAccessWindow("^/=Mon-Fri 08:00-18:00", london)
+	require.NoError(t, err)
+	overnight, err := parseAccessWindow("^/=22:00-06:00", time.UTC)
+	require.NoError(t, err)
+	expiring, err := parseAccessWindow("^/=until:2020-06-30", time.UTC)
+	require.NoError(t, err)
+
+	tests := []struct {
+		window   *accessWindow
+		now      time.Time
+		expected bool
+	}{
+		// Monday 1st June 2020, during British Summer Time
+		{workingHours, time.Date(2020, 6, 1, 7, 0, 0, 0, time.UTC), true},
+		{workingHours, time.Date(2020, 6, 1, 6, 59, 0, 0, time.UTC), false},
+		{workingHours, time.Date(2020, 6, 1, 17, 0, 0, 0, time.UTC), false},
+		{workingHours, time.Date(2020, 6, 6, 12, 0, 0, 0, time.UTC), false},
+		{overnight, time.Date(2020, 6, 1, 23, 0, 0, 0, time.UTC), true},
+		{overnight, time.Date(2020, 6, 1, 5, 59, 0, 0, time.UTC), true},
+		{overnight, time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC), false},
+		{expiring, time.Date(2020, 6, 30, 23, 59, 0, 0, time.UTC), true},
+		{expiring, time.Date(2020, 7, 1, 0, 0, 0, 0, time.UTC), false},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, test.window.allows(test.now), "%s at %s", test.window, test.now)
+	}
+}
+
+func TestAccessWindowSelects(t *testing.T) {
+	w, err := parseAccessWindow("^/=Mon-Fri email:*@contractor.example.com group:contractors", time.UTC)
+	require.NoError(t, err)
+	assert.True(t, w.selects(&sessionsapi.SessionState{Email: "Jane@contractor.example.com", Groups: []string{"contractors"}}))
+	assert.False(t, w.selects(&sessionsapi.SessionState{Email: "jane@contractor.example.com"}))
+	assert.False(t, w.selects(&sessionsapi.SessionState{Email: "jane@example.com", Groups: []string{"contractors"}}))
+}
+
+func TestOutsideAccessWindow(t *testing.T) {
+	// Saturday
+	clock.Set(clock.NewMock(time.Date(2020, 6, 6, 12, 0, 0, 0, time.UTC)))
+	defer clock.Reset()
+
+	pcTest := NewProcessCookieTestWithDefaults()
+	contractors, err := parseAccessWindow("^/admin/=Mon-Fri group:contractors", time.UTC)
+	require.NoError(t, err)
+	pcTest.proxy.accessWindows = []*accessWindow{contractors}
+	require.NoError(t, pcTest.SaveSession(&sessionsapi.SessionState{Email: "jane@example.com", Groups: []string{"contractors"}, CreatedAt: clock.Now()}))
+	cookie, err := pcTest.req.Cookie(pcTest.opts.Cookie.Name)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("GET", "/admin/users", nil)
+	req.AddCookie(cookie)
+	rw := httptest.NewRecorder()
+	pcTest.proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+
+	tests := map[string]int{
+		"/":            http.StatusAccepted,
+		"/admin/users": http.StatusForbidden,
+	}
+	for uri, code := range tests {
+		req := httptest.NewRequest("GET", pcTest.opts.ProxyPrefix+"/auth", nil)
+		req.AddCookie(cookie)
+		req.Header.Set("X-Forwarded-Uri", uri)
+		rw := httptest.NewRecorder()
+		pcTest.proxy.ServeHTTP(rw, req)
+		assert.Equal(t, code, rw.Code, uri)
+	}
+}
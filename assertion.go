@@ -0,0 +1,275 @@
+package oauth2proxy
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	stded25519 "crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/logger"
+	"golang.org/x/crypto/ed25519"
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// assertionTTL is how long assertions are valid for. They're signed for each
+// request so only need to outlast the request, allowing for clock skew
+// between the proxy and upstreams.
+const assertionTTL = 5 * time.Minute
+
+// assertionKeysWellKnownPath is where the key set assertions are verified
+// with is also served, for upstreams that discover it from the issuer
+const assertionKeysWellKnownPath = "/.well-known/jwks.json"
+
+// assertionSigner signs assertions of the user's identity for upstreams, as
+// JWTs, so that upstreams can verify who the request is from rather than
+// trusting the X-Forwarded-* headers
+type assertionSigner struct {
+	signer   jose.Signer
+	header   string
+	issuer   string
+	audience string
+	// keys are served at the JWKS endpoints for upstreams to verify
+	// assertions with: the public key of the signing key, then the keys
+	// published ahead of or after being used to sign, to rotate keys
+	keys []jose.JSONWebKey
+}
+
+// assertionClaims are the claims of an assertion
+type assertionClaims struct {
+	jwt.Claims
+	Email             string   `json:"email,omitempty"`
+	PreferredUsername string   `json:"preferred_username,omitempty"`
+	Groups            []string `json:"groups,omitempty"`
+	Impersonator      string   `json:"impersonator,omitempty"`
+}
+
+// newAssertionSigner returns a signer for the private key in the PEM or JWK
+// file at keyFile, publishing the keys in verificationKeyFiles too
+func newAssertionSigner(keyFile string, verificationKeyFiles []string, header, issuer, audience string) (*assertionSigner, error) {
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading assertion_key_file: %v", err)
+	}
+	key, err := parseSigningKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("error loading assertion_key_file %s: %v", keyFile, err)
+	}
+
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.SignatureAlgorithm(key.Algorithm), Key: key},
+		(&jose.SignerOptions{}).WithType("JWT"),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error loading assertion_key_file %s: %v", keyFile, err)
+	}
+	keys := []jose.JSONWebKey{key.Public()}
+	for _, file := range verificationKeyFiles {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("error reading assertion_verification_key_file: %v", err)
+		}
+		verificationKey, err := parseVerificationKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("error loading assertion_verification_key_file %s: %v", file, err)
+		}
+		for _, k := range keys {
+			if k.KeyID == verificationKey.KeyID {
+				return nil, fmt.Errorf("assertion_verification_key_file %s has the key ID of another key (%s)", file, k.KeyID)
+			}
+		}
+		keys = append(keys, verificationKey)
+	}
+	return &assertionSigner{
+		signer:   signer,
+		header:   http.CanonicalHeaderKey(header),
+		issuer:   issuer,
+		audience: audience,
+		keys:     keys,
+	}, nil
+}
+
+// parseSigningKey parses an RSA, ECDSA P-256 or Ed25519 private key, PEM
+// encoded or as a JWK, choosing the algorithm to sign with from its type.
+// Keys without a key ID are identified by their thumbprint.
+func parseSigningKey(data []byte) (*jose.JSONWebKey, error) {
+	key := &jose.JSONWebKey{Use: "sig"}
+	if data = bytes.TrimSpace(data); bytes.HasPrefix(data, []byte("{")) {
+		if err := json.Unmarshal(data, key); err != nil {
+			return nil, fmt.Errorf("invalid JWK: %v", err)
+		}
+		if key.IsPublic() {
+			return nil, errors.New("the JWK must be a private key")
+		}
+	} else {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, errors.New("the key must be PEM encoded or a JWK")
+		}
+		var err error
+		switch block.Type {
+		case "RSA PRIVATE KEY":
+			key.Key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		case "EC PRIVATE KEY":
+			key.Key, err = x509.ParseECPrivateKey(block.Bytes)
+		case "PRIVATE KEY":
+			key.Key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		default:
+			err = fmt.Errorf("unsupported PEM block type %q", block.Type)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	switch k := key.Key.(type) {
+	case *rsa.PrivateKey:
+		key.Algorithm = string(jose.RS256)
+	case *ecdsa.PrivateKey:
+		if k.Curve != elliptic.P256() {
+			return nil, errors.New("ECDSA keys must use the P-256 curve")
+		}
+		key.Algorithm = string(jose.ES256)
+	case ed25519.PrivateKey:
+		key.Algorithm = string(jose.EdDSA)
+	case stded25519.PrivateKey:
+		// go-jose uses golang.org/x/crypto's Ed25519 keys while x509 parses
+		// the standard library's
+		key.Key = ed25519.PrivateKey(k)
+		key.Algorithm = string(jose.EdDSA)
+	default:
+		return nil, fmt.Errorf("unsupported key type %T: must be RSA, ECDSA P-256 or Ed25519", key.Key)
+	}
+
+	if key.KeyID == "" {
+		thumbprint, err := key.Thumbprint(crypto.SHA256)
+		if err != nil {
+			return nil, err
+		}
+		key.KeyID = base64.RawURLEncoding.EncodeToString(thumbprint)
+	}
+	return key, nil
+}
+
+// parseVerificationKey parses a public key, or the public key of a private
+// key, that assertions are verified with, PEM encoded or as a JWK. As for
+// signing keys, keys without a key ID are identified by their thumbprint.
+func parseVerificationKey(data []byte) (jose.JSONWebKey, error) {
+	data = bytes.TrimSpace(data)
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		if bytes.HasPrefix(data, []byte("{")) {
+			var key jose.JSONWebKey
+			if err := json.Unmarshal(data, &key); err != nil {
+				return jose.JSONWebKey{}, fmt.Errorf("invalid JWK: %v", err)
+			}
+			if key.IsPublic() {
+				return publicVerificationKey(key)
+			}
+		}
+		key, err := parseSigningKey(data)
+		if err != nil {
+			return jose.JSONWebKey{}, err
+		}
+		return key.Public(), nil
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return jose.JSONWebKey{}, err
+	}
+	return publicVerificationKey(jose.JSONWebKey{Key: pub})
+}
+
+// publicVerificationKey sets the algorithm, use and key ID of a public key
+func publicVerificationKey(key jose.JSONWebKey) (jose.JSONWebKey, error) {
+	switch k := key.Key.(type) {
+	case *rsa.PublicKey:
+		key.Algorithm = string(jose.RS256)
+	case *ecdsa.PublicKey:
+		if k.Curve != elliptic.P256() {
+			return jose.JSONWebKey{}, errors.New("ECDSA keys must use the P-256 curve")
+		}
+		key.Algorithm = string(jose.ES256)
+	case ed25519.PublicKey:
+		key.Algorithm = string(jose.EdDSA)
+	case stded25519.PublicKey:
+		key.Key = ed25519.PublicKey(k)
+		key.Algorithm = string(jose.EdDSA)
+	default:
+		return jose.JSONWebKey{}, fmt.Errorf("unsupported key type %T: must be RSA, ECDSA P-256 or Ed25519", key.Key)
+	}
+	key.Use = "sig"
+	if key.KeyID == "" {
+		thumbprint, err := key.Thumbprint(crypto.SHA256)
+		if err != nil {
+			return jose.JSONWebKey{}, err
+		}
+		key.KeyID = base64.RawURLEncoding.EncodeToString(thumbprint)
+	}
+	return key, nil
+}
+
+// sign returns an assertion of the session's identity
+func (s *assertionSigner) sign(session *sessionsapi.SessionState, now time.Time) (string, error) {
+	claims := assertionClaims{
+		Claims: jwt.Claims{
+			Issuer:    s.issuer,
+			Subject:   session.User,
+			IssuedAt:  jwt.NewNumericDate(now),
+			NotBefore: jwt.NewNumericDate(now),
+			Expiry:    jwt.NewNumericDate(now.Add(assertionTTL)),
+		},
+		Email:             session.Email,
+		PreferredUsername: session.PreferredUsername,
+		Groups:            session.Groups,
+		Impersonator:      session.Impersonator,
+	}
+	if s.audience != "" {
+		claims.Audience = jwt.Audience{s.audience}
+	}
+	return jwt.Signed(s.signer).Claims(claims).CompactSerialize()
+}
+
+// addAssertionHeader sets the signed assertion header on the upstream
+// request, and on the response too when X-Auth-Request headers are set
+func (p *OAuthProxy) addAssertionHeader(rw http.ResponseWriter, req *http.Request, session *sessionsapi.SessionState) {
+	if p.assertionSigner == nil {
+		return
+	}
+	header := p.assertionSigner.header
+	assertion, err := p.assertionSigner.sign(session, p.now())
+	if err != nil {
+		logger.Printf("Error signing assertion for %s: %v", session.Email, err)
+		req.Header.Del(header)
+		rw.Header().Del(header)
+		return
+	}
+	req.Header.Set(header, assertion)
+	if p.SetXAuthRequest {
+		rw.Header().Set(header, assertion)
+	}
+}
+
+// AssertionKeys serves the public keys assertions are signed with as a JSON
+// Web Key Set, for upstreams to verify them with
+func (p *OAuthProxy) AssertionKeys(rw http.ResponseWriter, req *http.Request) {
+	if p.assertionSigner == nil {
+		http.NotFound(rw, req)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "public, max-age=3600")
+	json.NewEncoder(rw).Encode(jose.JSONWebKeySet{Keys: p.assertionSigner.keys})
+}
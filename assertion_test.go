@@ -0,0 +1,215 @@
+package oauth2proxy
+
+import (
+	"crypto/ecdsa"
+	stded25519 "crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+func writeAssertionKey(t *testing.T, data []byte) string {
+	f, err := ioutil.TempFile("", "assertion-key")
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = f.Write(data)
+	require.NoError(t, err)
+	t.Cleanup(func() { os.Remove(f.Name()) })
+	return f.Name()
+}
+
+func TestParseSigningKey(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	ecDER, err := x509.MarshalECPrivateKey(ecKey)
+	require.NoError(t, err)
+	_, edKey, err := stded25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	edDER, err := x509.MarshalPKCS8PrivateKey(edKey)
+	require.NoError(t, err)
+	jwk, err := json.Marshal(jose.JSONWebKey{Key: ecKey, KeyID: "ec-1"})
+	require.NoError(t, err)
+
+	tests := map[string]struct {
+		data      []byte
+		algorithm jose.SignatureAlgorithm
+	}{
+		"rsa pem":     {pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}), jose.RS256},
+		"ecdsa pem":   {pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDER}), jose.ES256},
+		"ed25519 pem": {pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: edDER}), jose.EdDSA},
+		"ecdsa jwk":   {jwk, jose.ES256},
+	}
+	for name, test := range tests {
+		key, err := parseSigningKey(test.data)
+		require.NoError(t, err, name)
+		assert.Equal(t, string(test.algorithm), key.Algorithm, name)
+		assert.NotEmpty(t, key.KeyID, name)
+		assert.False(t, key.IsPublic(), name)
+	}
+
+	key, err := parseSigningKey(jwk)
+	require.NoError(t, err)
+	assert.Equal(t, "ec-1", key.KeyID)
+
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+	p384DER, err := x509.MarshalECPrivateKey(p384Key)
+	require.NoError(t, err)
+	publicJWK, err := json.Marshal(jose.JSONWebKey{Key: ecKey.Public()})
+	require.NoError(t, err)
+	for name, data := range map[string][]byte{
+		"p-384 key":  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: p384DER}),
+		"public jwk": publicJWK,
+		"not a key":  []byte("not a key"),
+	} {
+		_, err := parseSigningKey(data)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestAssertionHeader(t *testing.T) {
+	_, edKey, err := stded25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(edKey)
+	require.NoError(t, err)
+	keyFile := writeAssertionKey(t, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+
+	signer, err := newAssertionSigner(keyFile, nil, "x-forwarded-assertion", "oauth2-proxy", "https://app.example.com")
+	require.NoError(t, err)
+	p := &OAuthProxy{assertionSigner: signer, SetXAuthRequest: true, AssertionKeysPath: "/oauth2/jwks"}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	rw := httptest.NewRecorder()
+	p.addAssertionHeader(rw, req, &sessionsapi.SessionState{
+		User:   "jane",
+		Email:  "jane@example.com",
+		Groups: []string{"admins"},
+	})
+	assertion := req.Header.Get("X-Forwarded-Assertion")
+	require.NotEmpty(t, assertion)
+	assert.Equal(t, assertion, rw.Header().Get("X-Forwarded-Assertion"))
+
+	// Upstreams verify assertions with the key set served by the proxy
+	rw = httptest.NewRecorder()
+	p.AssertionKeys(rw, httptest.NewRequest("GET", "/oauth2/jwks", nil))
+	var keySet jose.JSONWebKeySet
+	require.NoError(t, json.Unmarshal(rw.Body.Bytes(), &keySet))
+	require.Len(t, keySet.Keys, 1)
+	assert.True(t, keySet.Keys[0].IsPublic())
+
+	token, err := jwt.ParseSigned(assertion)
+	require.NoError(t, err)
+	assert.Equal(t, string(jose.EdDSA), token.Headers[0].Algorithm)
+	assert.Equal(t, keySet.Keys[0].KeyID, token.Headers[0].KeyID)
+	var claims assertionClaims
+	require.NoError(t, token.Claims(&keySet.Keys[0], &claims))
+	assert.NoError(t, claims.Validate(jwt.Expected{
+		Issuer:   "oauth2-proxy",
+		Audience: jwt.Audience{"https://app.example.com"},
+		Time:     time.Now(),
+	}))
+	assert.Equal(t, "jane", claims.Subject)
+	assert.Equal(t, "jane@example.com", claims.Email)
+	assert.Equal(t, []string{"admins"}, claims.Groups)
+}
+
+func TestParseVerificationKey(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	ecDER, err := x509.MarshalECPrivateKey(ecKey)
+	require.NoError(t, err)
+	publicDER, err := x509.MarshalPKIXPublicKey(ecKey.Public())
+	require.NoError(t, err)
+	edPublic, _, err := stded25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	edDER, err := x509.MarshalPKIXPublicKey(edPublic)
+	require.NoError(t, err)
+	publicJWK, err := json.Marshal(jose.JSONWebKey{Key: ecKey.Public(), KeyID: "ec-1"})
+	require.NoError(t, err)
+
+	tests := map[string]struct {
+		data      []byte
+		algorithm jose.SignatureAlgorithm
+	}{
+		"ecdsa private pem": {pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecDER}), jose.ES256},
+		"ecdsa public pem":  {pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}), jose.ES256},
+		"ed25519 pem":       {pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: edDER}), jose.EdDSA},
+		"public jwk":        {publicJWK, jose.ES256},
+	}
+	for name, test := range tests {
+		key, err := parseVerificationKey(test.data)
+		require.NoError(t, err, name)
+		assert.Equal(t, string(test.algorithm), key.Algorithm, name)
+		assert.NotEmpty(t, key.KeyID, name)
+		assert.True(t, key.IsPublic(), name)
+	}
+
+	// the private and public keys are identified alike
+	private, err := parseVerificationKey(tests["ecdsa private pem"].data)
+	require.NoError(t, err)
+	public, err := parseVerificationKey(tests["ecdsa public pem"].data)
+	require.NoError(t, err)
+	assert.Equal(t, private.KeyID, public.KeyID)
+
+	_, err = parseVerificationKey([]byte("not a key"))
+	assert.Error(t, err)
+}
+
+func TestAssertionKeyRotation(t *testing.T) {
+	current, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	currentDER, err := x509.MarshalECPrivateKey(current)
+	require.NoError(t, err)
+	next, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	nextDER, err := x509.MarshalPKIXPublicKey(next.Public())
+	require.NoError(t, err)
+
+	opts := testOptions()
+	opts.AssertionKeyFile = writeAssertionKey(t, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: currentDER}))
+	opts.AssertionVerificationKeys = []string{
+		writeAssertionKey(t, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: nextDER})),
+	}
+	require.NoError(t, opts.Validate())
+	proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+	require.NoError(t, err)
+
+	for _, path := range []string{"/.well-known/jwks.json", opts.ProxyPrefix + "/jwks"} {
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, httptest.NewRequest("GET", path, nil))
+		var keySet jose.JSONWebKeySet
+		require.NoError(t, json.Unmarshal(rw.Body.Bytes(), &keySet), path)
+		require.Len(t, keySet.Keys, 2, path)
+		assert.Equal(t, proxy.assertionSigner.keys[0].KeyID, keySet.Keys[0].KeyID, path)
+		assert.Equal(t, proxy.assertionSigner.keys[1].KeyID, keySet.Keys[1].KeyID, path)
+	}
+
+	// assertions are signed with the current key
+	assertion, err := proxy.assertionSigner.sign(&sessionsapi.SessionState{User: "jane"}, time.Now())
+	require.NoError(t, err)
+	token, err := jwt.ParseSigned(assertion)
+	require.NoError(t, err)
+	assert.Equal(t, proxy.assertionSigner.keys[0].KeyID, token.Headers[0].KeyID)
+
+	// the same key can't be published twice
+	opts = testOptions()
+	opts.AssertionKeyFile = writeAssertionKey(t, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: currentDER}))
+	opts.AssertionVerificationKeys = []string{opts.AssertionKeyFile}
+	assert.Error(t, opts.Validate())
+}
@@ -0,0 +1,144 @@
+package oauth2proxy
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/encryption"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/logger"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+// validateAuthLogging checks the options of the dedicated auth log file and
+// its tamper evidence, keeping the keys they're used with
+func validateAuthLogging(o *Options, msgs []string) []string {
+	o.authLogHashKey, o.authLogCipher = nil, nil
+	if o.AuthLoggingFilename != "" && o.AuthLoggingTarget != "" {
+		msgs = append(msgs, "auth_logging_filename and auth_logging_target are mutually exclusive")
+	}
+	if o.AuthLoggingHashChain {
+		if o.AuthLoggingFilename == "" && o.AuthLoggingTarget == "" {
+			msgs = append(msgs, "auth_logging_hash_chain requires auth_logging_filename or auth_logging_target")
+		}
+		key := o.AuthLoggingHashKey
+		if key == "" {
+			key = o.Cookie.Secret
+		}
+		o.authLogHashKey = []byte(key)
+	}
+	if o.AuthLoggingEncryptionKey != "" {
+		if o.AuthLoggingFilename == "" {
+			msgs = append(msgs, "auth_logging_encryption_key requires auth_logging_filename")
+		}
+		aead, err := newAuthLogCipher(o.AuthLoggingEncryptionKey)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("auth_logging_encryption_key must be 16, 24, or 32 bytes to create an AES cipher, but is %d bytes", len(encryption.SecretBytes(o.AuthLoggingEncryptionKey))))
+		} else {
+			o.authLogCipher = aead
+		}
+	}
+	return msgs
+}
+
+func newAuthLogCipher(key string) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(encryption.SecretBytes(key))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// newAuthLogWriter returns where auth log lines are written: the auth log
+// file, or the auth logging target, chaining the records if configured.
+// Returns nil for the default logging output.
+func newAuthLogWriter(o *Options, msgs *[]string) io.Writer {
+	if o.AuthLoggingFilename == "" {
+		if !o.AuthLoggingHashChain || o.AuthLoggingTarget == "" {
+			return newLoggingTarget(o, o.AuthLoggingTarget, logger.FacilityAuthPriv, "auth", msgs)
+		}
+		w, err := logger.NewTargetWriter(o.AuthLoggingTarget, logger.FacilityAuthPriv)
+		if err != nil {
+			*msgs = append(*msgs, fmt.Sprintf("auth_logging_target: %v", err))
+			return nil
+		}
+		// a target can't be read back, so each start begins a new chain
+		return bufferAuthLog(o, logger.NewHashChainWriter(w, o.authLogHashKey, ""))
+	}
+
+	var w io.Writer
+	var rotator logger.Rotator
+	if o.authLogCipher != nil {
+		f, err := logger.NewEncryptedRotatingFile(o.AuthLoggingFilename, int64(o.LoggingMaxSize)*1024*1024,
+			time.Duration(o.LoggingMaxAge)*24*time.Hour, o.LoggingMaxBackups, o.LoggingLocalTime, o.authLogCipher)
+		if err != nil {
+			*msgs = append(*msgs, fmt.Sprintf("unable to write to auth log file: %v", err))
+			return nil
+		}
+		w, rotator = f, f
+	} else {
+		f := &lumberjack.Logger{
+			Filename:   o.AuthLoggingFilename,
+			MaxSize:    o.LoggingMaxSize, // megabytes
+			MaxAge:     o.LoggingMaxAge,  // days
+			MaxBackups: o.LoggingMaxBackups,
+			LocalTime:  o.LoggingLocalTime,
+			Compress:   o.LoggingCompress,
+		}
+		w, rotator = f, f
+	}
+	if o.LoggingRotateInterval > 0 {
+		logger.RotateEvery(rotator, o.LoggingRotateInterval)
+	}
+	logger.Printf("Writing auth logs to file: %s", o.AuthLoggingFilename)
+
+	if o.AuthLoggingHashChain {
+		// continue the chain of the records written before a restart
+		prev, err := logger.LastRecordHash(o.AuthLoggingFilename, o.authLogHashKey)
+		if err != nil {
+			*msgs = append(*msgs, fmt.Sprintf("unable to read auth log file: %v", err))
+			return nil
+		}
+		w = logger.NewHashChainWriter(w, o.authLogHashKey, prev)
+	}
+	return bufferAuthLog(o, w)
+}
+
+// bufferAuthLog writes the auth log asynchronously if configured. Lines are
+// dropped before they're chained, so that dropping them doesn't break the
+// chain.
+func bufferAuthLog(o *Options, w io.Writer) io.Writer {
+	if o.LoggingBufferSize > 0 {
+		return logger.NewAsyncWriter(w, o.LoggingBufferSize)
+	}
+	return w
+}
+
+// VerifyAuthLog checks the hash chain of the auth log files, given oldest
+// first, decrypting the rotated files that were encrypted. The records are
+// written to out if it isn't nil. The options must have been validated.
+func VerifyAuthLog(opts *Options, files []string, out io.Writer) (logger.ChainReport, error) {
+	var report logger.ChainReport
+	if !opts.AuthLoggingHashChain {
+		return report, errors.New("auth_logging_hash_chain is not enabled")
+	}
+	for _, name := range files {
+		b, err := logger.ReadAuditFile(name, opts.authLogCipher)
+		if err != nil {
+			return report, err
+		}
+		if err := logger.VerifyHashChain(bytes.NewReader(b), opts.authLogHashKey, &report); err != nil {
+			return report, fmt.Errorf("%s: %v", name, err)
+		}
+		if out != nil {
+			if _, err := out.Write(b); err != nil {
+				return report, err
+			}
+		}
+	}
+	return report, nil
+}
@@ -0,0 +1,88 @@
+package oauth2proxy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyAuthLog(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "auth.log")
+	o := testOptions()
+	o.AuthLoggingFilename = name
+	o.AuthLoggingHashChain = true
+	o.AuthLoggingEncryptionKey = "auth-log-key-32-bytes-long-here!"
+	require.NoError(t, o.Validate())
+	defer logger.SetAuthOutput(nil)
+
+	req := httptest.NewRequest("GET", "/oauth2/callback", nil)
+	logger.PrintAuthf("jane@example.com", req, logger.AuthSuccess, "Authenticated via OAuth2")
+	logger.PrintAuthf("john@example.com", req, logger.AuthFailure, "Invalid authentication via OAuth2")
+
+	var out bytes.Buffer
+	report, err := VerifyAuthLog(o, []string{name}, &out)
+	require.NoError(t, err)
+	assert.Equal(t, 2, report.Records)
+	assert.Contains(t, out.String(), "jane@example.com")
+
+	b, err := ioutil.ReadFile(name)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(name, []byte(strings.Replace(string(b), "jane@example.com", "john@example.com", 1)), 0600))
+	_, err = VerifyAuthLog(o, []string{name}, nil)
+	assert.Error(t, err)
+
+	o.AuthLoggingHashChain = false
+	_, err = VerifyAuthLog(o, []string{name}, nil)
+	assert.EqualError(t, err, "auth_logging_hash_chain is not enabled")
+}
+
+func TestAuthLoggingOptions(t *testing.T) {
+	tests := map[string]struct {
+		modify func(*Options)
+		msgs   []string
+	}{
+		"filename and target": {
+			modify: func(o *Options) {
+				o.AuthLoggingFilename = filepath.Join(t.TempDir(), "auth.log")
+				o.AuthLoggingTarget = "syslog"
+			},
+			msgs: []string{"auth_logging_filename and auth_logging_target are mutually exclusive"},
+		},
+		"hash chain without a log": {
+			modify: func(o *Options) {
+				o.AuthLoggingHashChain = true
+			},
+			msgs: []string{"auth_logging_hash_chain requires auth_logging_filename or auth_logging_target"},
+		},
+		"encryption without a file": {
+			modify: func(o *Options) {
+				o.AuthLoggingEncryptionKey = "auth-log-key-16!"
+			},
+			msgs: []string{"auth_logging_encryption_key requires auth_logging_filename"},
+		},
+		"invalid encryption key": {
+			modify: func(o *Options) {
+				o.AuthLoggingFilename = filepath.Join(t.TempDir(), "auth.log")
+				o.AuthLoggingEncryptionKey = "short-key!"
+			},
+			msgs: []string{"auth_logging_encryption_key must be 16, 24, or 32 bytes to create an AES cipher, but is 10 bytes"},
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			defer logger.SetAuthOutput(nil)
+			o := testOptions()
+			test.modify(o)
+			err := o.Validate()
+			assert.NotEqual(t, nil, err)
+			assert.Equal(t, errorMsg(test.msgs), err.Error())
+		})
+	}
+}
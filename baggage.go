@@ -0,0 +1,60 @@
+package oauth2proxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+)
+
+// baggageHeader is the W3C Baggage header OpenTelemetry propagates
+const baggageHeader = "Baggage"
+
+// userBaggageID pseudonymises the user with an HMAC of their subject, so that
+// traces can be grouped by user without exposing who the user is to tracing
+// backends. The HMAC is truncated as it only needs to tell users apart.
+func userBaggageID(key []byte, session *sessionsapi.SessionState) string {
+	subject := session.User
+	if subject == "" {
+		subject = session.Email
+	}
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(subject))
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// addBaggage adds the user's pseudonymous ID to the baggage passed upstream,
+// and to the response too when X-Auth-Request headers are set
+func (p *OAuthProxy) addBaggage(rw http.ResponseWriter, req *http.Request, session *sessionsapi.SessionState) {
+	if p.baggageUserKey == "" {
+		return
+	}
+	baggage := mergeBaggage(req.Header.Values(baggageHeader), p.baggageUserKey, userBaggageID(p.baggageHashKey, session))
+	req.Header.Set(baggageHeader, baggage)
+	if p.SetXAuthRequest {
+		rw.Header().Set(baggageHeader, baggage)
+	}
+}
+
+// mergeBaggage adds the key to the baggage of the request, replacing any
+// member with the same key so that clients can't claim to be another user
+func mergeBaggage(values []string, key, value string) string {
+	var members []string
+	for _, v := range values {
+		for _, member := range strings.Split(v, ",") {
+			member = strings.TrimSpace(member)
+			if member == "" {
+				continue
+			}
+			name := strings.SplitN(strings.SplitN(member, ";", 2)[0], "=", 2)[0]
+			if strings.TrimSpace(name) == key {
+				continue
+			}
+			members = append(members, member)
+		}
+	}
+	return strings.Join(append(members, key+"="+value), ",")
+}
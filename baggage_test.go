@@ -0,0 +1,40 @@
+package oauth2proxy
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMergeBaggage(t *testing.T) {
+	assert.Equal(t, "enduser.id=abc", mergeBaggage(nil, "enduser.id", "abc"))
+	assert.Equal(t, "tenant=acme;prop=1,k2=v2,enduser.id=abc",
+		mergeBaggage([]string{"tenant=acme;prop=1, enduser.id = forged", "k2=v2"}, "enduser.id", "abc"))
+}
+
+func TestAddBaggage(t *testing.T) {
+	p := &OAuthProxy{baggageUserKey: "enduser.id", baggageHashKey: []byte("secret"), SetXAuthRequest: true}
+	session := &sessionsapi.SessionState{User: "1234567890", Email: "jane@example.com"}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Baggage", "enduser.id=forged")
+	rw := httptest.NewRecorder()
+	p.addBaggage(rw, req, session)
+	baggage := req.Header.Get("Baggage")
+	assert.Equal(t, "enduser.id="+userBaggageID([]byte("secret"), session), baggage)
+	assert.Len(t, userBaggageID([]byte("secret"), session), 32)
+	assert.NotContains(t, baggage, "1234567890")
+	assert.Equal(t, baggage, rw.Header().Get("Baggage"))
+
+	// Users are told apart, and the ID depends on the key
+	other := &sessionsapi.SessionState{User: "0987654321"}
+	assert.NotEqual(t, userBaggageID([]byte("secret"), session), userBaggageID([]byte("secret"), other))
+	assert.NotEqual(t, userBaggageID([]byte("secret"), session), userBaggageID([]byte("other"), session))
+
+	p.baggageUserKey = ""
+	req = httptest.NewRequest("GET", "/", nil)
+	p.addBaggage(httptest.NewRecorder(), req, session)
+	assert.Empty(t, req.Header.Get("Baggage"))
+}
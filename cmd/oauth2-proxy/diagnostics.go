@@ -0,0 +1,25 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+
+	oauth2proxy "github.com/oauth2-proxy/oauth2-proxy"
+)
+
+// dumpDiagnosticsOnSignal dumps a diagnostics snapshot whenever the process
+// is sent SIGUSR1
+func dumpDiagnosticsOnSignal(opts *oauth2proxy.Options) {
+	usr1 := make(chan os.Signal, 1)
+	signal.Notify(usr1, syscall.SIGUSR1)
+	go func() {
+		for range usr1 {
+			oauth2proxy.DumpDiagnostics(context.Background(), opts)
+		}
+	}()
+}
@@ -0,0 +1,12 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import (
+	oauth2proxy "github.com/oauth2-proxy/oauth2-proxy"
+)
+
+// dumpDiagnosticsOnSignal does nothing on systems without SIGUSR1, where
+// snapshots are only served by the debug address
+func dumpDiagnosticsOnSignal(opts *oauth2proxy.Options) {}
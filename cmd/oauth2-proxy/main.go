@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	oauth2proxy "github.com/oauth2-proxy/oauth2-proxy"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/logger"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/providers"
+	"github.com/spf13/pflag"
+)
+
+func main() {
+	logger.SetFlags(logger.Lshortfile)
+	flagSet := oauth2proxy.NewFlagSet()
+
+	// Subcommands are given before any flags, eg "oauth2-proxy validate [flags]"
+	args := os.Args[1:]
+	var command string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+	switch command {
+	case "", "validate":
+	case "simulate":
+		flagSet.String("simulate-email", "", "the email of the user to evaluate the authorization rules for")
+		flagSet.String("simulate-path", "/", "the request path to evaluate the authorization rules for")
+		flagSet.String("simulate-method", "GET", "the request method to evaluate the authorization rules for")
+	case "export-sessions", "import-sessions":
+		flagSet.String("sessions-file", "-", "the file sessions are exported to or imported from, '-' for stdout or stdin")
+	case "gc-sessions":
+	case "verify-auth-log":
+		flagSet.Bool("auth-log-print", false, "print the records of the verified files, decrypted, to stdout")
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", command)
+		os.Exit(1)
+	}
+	flagSet.Parse(args)
+
+	if showVersion, _ := flagSet.GetBool("version"); showVersion {
+		fmt.Printf("oauth2-proxy %s (built with %s)\n", oauth2proxy.VERSION, runtime.Version())
+		fmt.Printf("providers: %s\n", strings.Join(providers.Names(), ", "))
+		fmt.Printf("session stores: %s\n", strings.Join(sessions.Types(), ", "))
+		return
+	}
+
+	config, _ := flagSet.GetString("config")
+	opts := oauth2proxy.NewOptions()
+	err := options.Load(config, flagSet, opts)
+	if err != nil {
+		logger.Printf("ERROR: Failed to load config: %v", err)
+		os.Exit(1)
+	}
+
+	switch command {
+	case "validate":
+		checks := oauth2proxy.CheckConfiguration(context.Background(), opts)
+		if !oauth2proxy.WriteConfigReport(os.Stdout, checks) {
+			os.Exit(1)
+		}
+		return
+	case "simulate":
+		simulate(flagSet, opts)
+		return
+	case "export-sessions", "import-sessions":
+		migrateSessions(command, flagSet, opts)
+		return
+	case "gc-sessions":
+		collectSessionGarbage(opts)
+		return
+	case "verify-auth-log":
+		verifyAuthLog(flagSet, opts)
+		return
+	}
+
+	handler, err := oauth2proxy.NewHandler(opts)
+	if err != nil {
+		logger.Printf("%s", err)
+		os.Exit(1)
+	}
+
+	rand.Seed(time.Now().UnixNano())
+	dumpDiagnosticsOnSignal(opts)
+
+	s := oauth2proxy.NewServer(opts, handler)
+	if runAsService(s) {
+		return
+	}
+	// Observe signals in background goroutine.
+	go func() {
+		sigint := make(chan os.Signal, 1)
+		signal.Notify(sigint, os.Interrupt, syscall.SIGTERM)
+		<-sigint
+		s.Stop() // notify having caught signal
+	}()
+	s.ListenAndServe()
+}
+
+// simulate reports whether the configured rules would allow the request
+// described by the simulate-* flags, exiting non-zero if it would be denied
+func simulate(flagSet *pflag.FlagSet, opts *oauth2proxy.Options) {
+	proxy, err := oauth2proxy.New(opts)
+	if err != nil {
+		logger.Printf("%s", err)
+		os.Exit(1)
+	}
+
+	email, _ := flagSet.GetString("simulate-email")
+	path, _ := flagSet.GetString("simulate-path")
+	method, _ := flagSet.GetString("simulate-method")
+	req, err := http.NewRequest(method, path, nil)
+	if err != nil {
+		logger.Printf("invalid simulate-path %q: %v", path, err)
+		os.Exit(1)
+	}
+
+	decision := proxy.SimulateAuthorization(req, email)
+	fmt.Println(decision)
+	if !decision.Allowed {
+		os.Exit(1)
+	}
+}
+
+// migrateSessions exports the sessions of the configured session store to
+// the sessions-file, or imports them from it, so that sessions can be moved
+// to another store without logging users out
+func migrateSessions(command string, flagSet *pflag.FlagSet, opts *oauth2proxy.Options) {
+	if err := opts.Validate(); err != nil {
+		logger.Printf("%s", err)
+		os.Exit(1)
+	}
+
+	path, _ := flagSet.GetString("sessions-file")
+	var n int
+	var err error
+	if command == "export-sessions" {
+		f := os.Stdout
+		if path != "-" {
+			if f, err = os.Create(path); err != nil {
+				logger.Printf("ERROR: %v", err)
+				os.Exit(1)
+			}
+			defer f.Close()
+		}
+		n, err = oauth2proxy.ExportSessions(context.Background(), opts, f)
+	} else {
+		f := os.Stdin
+		if path != "-" {
+			if f, err = os.Open(path); err != nil {
+				logger.Printf("ERROR: %v", err)
+				os.Exit(1)
+			}
+			defer f.Close()
+		}
+		n, err = oauth2proxy.ImportSessions(context.Background(), opts, f)
+	}
+	if err != nil {
+		logger.Printf("ERROR: %v", err)
+		os.Exit(1)
+	}
+	logger.Printf("%s: %d records", command, n)
+}
+
+// collectSessionGarbage removes the records of the configured session store
+// its backend won't remove by itself once, reporting what was found
+func collectSessionGarbage(opts *oauth2proxy.Options) {
+	if err := opts.Validate(); err != nil {
+		logger.Printf("%s", err)
+		os.Exit(1)
+	}
+
+	report, err := oauth2proxy.CollectSessionGarbage(context.Background(), opts)
+	if err != nil {
+		logger.Printf("ERROR: %v", err)
+		os.Exit(1)
+	}
+	logger.Printf("gc-sessions: %s", report)
+}
+
+// verifyAuthLog checks the hash chain of the auth log files given after the
+// flags, oldest first, exiting non-zero if it's broken
+func verifyAuthLog(flagSet *pflag.FlagSet, opts *oauth2proxy.Options) {
+	if err := opts.Validate(); err != nil {
+		logger.Printf("%s", err)
+		os.Exit(1)
+	}
+	files := flagSet.Args()
+	if len(files) == 0 {
+		logger.Printf("ERROR: no auth log files given, eg. oauth2-proxy verify-auth-log [flags] <file>...")
+		os.Exit(1)
+	}
+
+	var out io.Writer
+	if print, _ := flagSet.GetBool("auth-log-print"); print {
+		out = os.Stdout
+	}
+	report, err := oauth2proxy.VerifyAuthLog(opts, files, out)
+	if err != nil {
+		logger.Printf("ERROR: %v", err)
+		os.Exit(1)
+	}
+	logger.Printf("verify-auth-log: %s", report)
+}
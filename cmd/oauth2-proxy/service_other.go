@@ -0,0 +1,14 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	oauth2proxy "github.com/oauth2-proxy/oauth2-proxy"
+)
+
+// runAsService does nothing on systems other than Windows, where services
+// are ordinary processes stopped with signals
+func runAsService(s *oauth2proxy.Server) bool {
+	return false
+}
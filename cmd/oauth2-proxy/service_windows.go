@@ -0,0 +1,66 @@
+package main
+
+import (
+	oauth2proxy "github.com/oauth2-proxy/oauth2-proxy"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/logger"
+	"golang.org/x/sys/windows/svc"
+)
+
+// serviceName is the name the proxy runs as a service with. Windows
+// ignores it for services in their own process, as the proxy's are.
+const serviceName = "oauth2-proxy"
+
+// runAsService runs the server as a Windows service when the service
+// control manager started the proxy, reporting whether it did
+func runAsService(s *oauth2proxy.Server) bool {
+	interactive, err := svc.IsAnInteractiveSession()
+	if err != nil {
+		logger.Fatalf("FATAL: checking whether running as a service failed - %s", err)
+	}
+	if interactive {
+		return false
+	}
+	if err := svc.Run(serviceName, &service{server: s}); err != nil {
+		logger.Fatalf("FATAL: running as a service failed - %s", err)
+	}
+	return true
+}
+
+// service reports the lifecycle of the server to the service control
+// manager, and stops it gracefully when the service is stopped
+type service struct {
+	server *oauth2proxy.Server
+}
+
+func (h *service) Execute(_ []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	const accepts = svc.AcceptStop | svc.AcceptShutdown
+	status <- svc.Status{State: svc.StartPending}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.server.ListenAndServe()
+	}()
+
+	ready := h.server.Ready()
+	for {
+		select {
+		case <-ready:
+			status <- svc.Status{State: svc.Running, Accepts: accepts}
+			ready = nil
+		case <-done:
+			// the server stopped without being asked to
+			return false, 1
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				h.server.Stop()
+				<-done
+				return false, 0
+			}
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package oauth2proxy
+
+import (
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// defaultCompressContentTypes are the types of the responses compressed by
+// default: text, and the scripts and JSON that pages and APIs serve
+var defaultCompressContentTypes = []string{
+	"text/*",
+	"application/javascript",
+	"application/json",
+	"image/svg+xml",
+}
+
+// compression compresses responses with gzip for the clients accepting it:
+// those of the proxy itself, eg. sign in and error pages, and optionally
+// those of the upstreams that weren't already compressed by the upstream
+type compression struct {
+	minSize      int
+	contentTypes []string
+	upstreams    bool
+}
+
+// parseCompressContentTypes parses the types of the responses to compress,
+// each a media type or a type followed by /* to match all of its subtypes
+func parseCompressContentTypes(types []string) ([]string, error) {
+	parsed := make([]string, 0, len(types))
+	for _, t := range types {
+		t = strings.ToLower(strings.TrimSpace(t))
+		parts := strings.SplitN(t, "/", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[0] == "*" || parts[1] == "" {
+			return nil, fmt.Errorf("compress_content_type (%s) must be a media type, eg. text/html, or a type followed by /*, eg. text/*", t)
+		}
+		parsed = append(parsed, t)
+	}
+	return parsed, nil
+}
+
+// applies checks whether the response to the request may be compressed: the
+// client accepts gzip, and the response has a body that isn't a websocket
+func (c *compression) applies(req *http.Request) bool {
+	return req.Method != http.MethodHead && !isWebSocket(req) && acceptsGzip(req.Header.Get("Accept-Encoding"))
+}
+
+// acceptsGzip checks whether an Accept-Encoding header accepts gzip, either
+// by name or with *, and doesn't refuse it with a quality of 0
+func acceptsGzip(header string) bool {
+	gzipQuality, anyQuality := "", ""
+	for _, part := range strings.Split(header, ",") {
+		coding, quality := part, "1"
+		if i := strings.Index(part, ";"); i >= 0 {
+			coding = part[:i]
+			if params := strings.TrimSpace(part[i+1:]); strings.HasPrefix(params, "q=") {
+				quality = strings.TrimPrefix(params, "q=")
+			}
+		}
+		switch strings.ToLower(strings.TrimSpace(coding)) {
+		case "gzip", "x-gzip":
+			gzipQuality = quality
+		case "*":
+			anyQuality = quality
+		}
+	}
+	if gzipQuality == "" {
+		gzipQuality = anyQuality
+	}
+	q, err := strconv.ParseFloat(gzipQuality, 64)
+	return err == nil && q > 0
+}
+
+// compressible checks whether a response of the given status and headers
+// may be compressed, ignoring its size
+func (c *compression) compressible(status int, header http.Header) bool {
+	if status < http.StatusOK || status == http.StatusNoContent ||
+		status == http.StatusPartialContent || status == http.StatusNotModified {
+		return false
+	}
+	if header.Get("Content-Encoding") != "" || strings.Contains(header.Get("Cache-Control"), "no-transform") {
+		return false
+	}
+	if !c.upstreams && header.Get("GAP-Upstream-Address") != "" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	for _, t := range c.contentTypes {
+		if t == mediaType || (strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(t, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+// compressWriter compresses a response once it knows whether the response
+// should be, buffering its start until it reaches the size threshold, the
+// handler flushes it or the handler is done
+type compressWriter struct {
+	rw      http.ResponseWriter
+	c       *compression
+	status  int
+	buf     []byte
+	decided bool
+	gz      *gzip.Writer
+}
+
+func (c *compression) newWriter(rw http.ResponseWriter) *compressWriter {
+	return &compressWriter{rw: rw, c: c}
+}
+
+// Header returns the ResponseWriter's Header
+func (w *compressWriter) Header() http.Header {
+	return w.rw.Header()
+}
+
+// WriteHeader holds the status back until it's known whether the response
+// is compressed
+func (w *compressWriter) WriteHeader(status int) {
+	if w.decided {
+		w.rw.WriteHeader(status)
+		return
+	}
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+// Write buffers the response until it's large enough to be compressed
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if !w.decided {
+		w.buf = append(w.buf, b...)
+		if len(w.buf) < w.c.minSize {
+			return len(b), nil
+		}
+		if err := w.decide(false); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if w.gz != nil {
+		return w.gz.Write(b)
+	}
+	return w.rw.Write(b)
+}
+
+// decide compresses the response if it should be, and writes its status
+// and what has been buffered. The size of the response is known when the
+// handler is done.
+func (w *compressWriter) decide(done bool) error {
+	w.decided = true
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	header := w.rw.Header()
+	if _, ok := header["Content-Type"]; !ok && len(w.buf) > 0 {
+		// as net/http would, before the body is compressed
+		header.Set("Content-Type", http.DetectContentType(w.buf))
+	}
+
+	if w.c.compressible(w.status, header) {
+		size := len(w.buf)
+		if !done {
+			size = w.c.minSize
+			if n, err := strconv.Atoi(header.Get("Content-Length")); err == nil {
+				size = n
+			}
+		}
+		header.Add("Vary", "Accept-Encoding")
+		if size >= w.c.minSize {
+			header.Del("Content-Length")
+			header.Set("Content-Encoding", "gzip")
+			w.gz = gzip.NewWriter(w.rw)
+		}
+	}
+	w.rw.WriteHeader(w.status)
+
+	buf := w.buf
+	w.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if w.gz != nil {
+		_, err = w.gz.Write(buf)
+	} else {
+		_, err = w.rw.Write(buf)
+	}
+	return err
+}
+
+// Flush sends what has been written to the client, deciding whether the
+// response is compressed first if it hasn't been decided yet
+func (w *compressWriter) Flush() {
+	if !w.decided {
+		if w.status == 0 && len(w.buf) == 0 {
+			return
+		}
+		if err := w.decide(false); err != nil {
+			return
+		}
+	}
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	if f, ok := w.rw.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack supports websockets, which aren't compressed
+func (w *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hj, ok := w.rw.(http.Hijacker); ok {
+		return hj.Hijack()
+	}
+	return nil, nil, errors.New("http.Hijacker is not available on writer")
+}
+
+// Close writes the rest of the response once the handler is done with it
+func (w *compressWriter) Close() error {
+	if !w.decided {
+		if w.status == 0 && len(w.buf) == 0 {
+			// nothing was written, and net/http responds as usual
+			return nil
+		}
+		if err := w.decide(true); err != nil {
+			return err
+		}
+	}
+	if w.gz != nil {
+		return w.gz.Close()
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package oauth2proxy
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	for header, accepted := range map[string]bool{
+		"":                    false,
+		"gzip":                true,
+		"deflate, gzip;q=0.5": true,
+		"br, GZIP":            true,
+		"gzip;q=0":            false,
+		"*":                   true,
+		"gzip;q=0, *":         false,
+		"deflate, br":         false,
+	} {
+		assert.Equal(t, accepted, acceptsGzip(header), header)
+	}
+}
+
+func gunzip(t *testing.T, body string) string {
+	r, err := gzip.NewReader(strings.NewReader(body))
+	require.NoError(t, err)
+	b, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	return string(b)
+}
+
+func TestCompressWriter(t *testing.T) {
+	c := &compression{minSize: 16, contentTypes: []string{"text/*", "application/json"}}
+	large := strings.Repeat("compressible ", 10)
+
+	testCases := []struct {
+		name       string
+		header     http.Header
+		status     int
+		body       string
+		compressed bool
+	}{
+		{"large html", http.Header{"Content-Type": {"text/html; charset=utf-8"}}, http.StatusOK, large, true},
+		{"sniffed html", http.Header{}, http.StatusForbidden, "<html>" + large, true},
+		{"small", http.Header{"Content-Type": {"application/json"}}, http.StatusOK, `{}`, false},
+		{"other type", http.Header{"Content-Type": {"image/png"}}, http.StatusOK, large, false},
+		{"already encoded", http.Header{"Content-Type": {"text/plain"}, "Content-Encoding": {"br"}}, http.StatusOK, large, false},
+		{"no-transform", http.Header{"Content-Type": {"text/plain"}, "Cache-Control": {"no-transform"}}, http.StatusOK, large, false},
+		{"upstream", http.Header{"Content-Type": {"text/plain"}, "Gap-Upstream-Address": {"backend:8080"}}, http.StatusOK, large, false},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			w := c.newWriter(rec)
+			for k, v := range tc.header {
+				w.Header()[k] = v
+			}
+			w.WriteHeader(tc.status)
+			// written in parts, so that the start is buffered
+			w.Write([]byte(tc.body[:len(tc.body)/2]))
+			w.Write([]byte(tc.body[len(tc.body)/2:]))
+			require.NoError(t, w.Close())
+
+			assert.Equal(t, tc.status, rec.Code)
+			if tc.compressed {
+				assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+				assert.Equal(t, "Accept-Encoding", rec.Header().Get("Vary"))
+				assert.Equal(t, tc.body, gunzip(t, rec.Body.String()))
+			} else {
+				assert.Equal(t, tc.header.Get("Content-Encoding"), rec.Header().Get("Content-Encoding"))
+				assert.Equal(t, tc.body, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestCompressWriterFlush(t *testing.T) {
+	c := &compression{minSize: 1024, contentTypes: []string{"text/*"}}
+	rec := httptest.NewRecorder()
+	w := c.newWriter(rec)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Write([]byte("data: 1\n\n"))
+	// streamed responses are compressed before they reach the threshold
+	w.Flush()
+	assert.True(t, rec.Flushed)
+	assert.Equal(t, "gzip", rec.Header().Get("Content-Encoding"))
+	w.Write([]byte("data: 2\n\n"))
+	require.NoError(t, w.Close())
+	assert.Equal(t, "data: 1\n\ndata: 2\n\n", gunzip(t, rec.Body.String()))
+}
+
+func TestCompressedResponses(t *testing.T) {
+	opts := testOptions()
+	opts.CompressResponses = true
+	opts.CompressMinSize = 0
+	require.NoError(t, opts.Validate())
+	proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("GET", opts.ProxyPrefix+"/sign_in", nil)
+	req.Header.Set("Accept-Encoding", "gzip, deflate")
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "gzip", rw.Header().Get("Content-Encoding"))
+	assert.Contains(t, rw.Header().Get("Content-Type"), "text/html")
+	assert.Contains(t, gunzip(t, rw.Body.String()), "Sign in with")
+
+	// clients that don't accept gzip get the page as it is
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, httptest.NewRequest("GET", opts.ProxyPrefix+"/sign_in", nil))
+	assert.Equal(t, "", rw.Header().Get("Content-Encoding"))
+	assert.Contains(t, rw.Body.String(), "Sign in with")
+}
+
+func TestCompressionOptions(t *testing.T) {
+	o := testOptions()
+	o.CompressUpstreamResponses = true
+	o.CompressMinSize = -1
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		"compress_upstream_responses requires compress_responses"}), err.Error())
+	assert.Nil(t, o.compression)
+
+	o = testOptions()
+	o.CompressResponses = true
+	o.CompressMinSize = -1
+	o.CompressContentTypes = []string{"text/html", "*/*"}
+	err = o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		"compress_min_size (-1) must not be negative",
+		"compress_content_type (*/*) must be a media type, eg. text/html, or a type followed by /*, eg. text/*"}), err.Error())
+
+	o = testOptions()
+	o.CompressResponses = true
+	assert.NoError(t, o.Validate())
+	assert.Equal(t, 1024, o.compression.minSize)
+	assert.Equal(t, defaultCompressContentTypes, o.compression.contentTypes)
+}
@@ -0,0 +1,187 @@
+package oauth2proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/cookies"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/encryption"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/logger"
+)
+
+// cookieHandoffKey is the name the hand-off tokens are signed with
+const cookieHandoffKey = "_oauth2_proxy_handoff"
+
+// cookieHandoff is what a hand-off token carries from one cookie domain to
+// the next: the session to save there, the hosts still to visit and where
+// the chain ends
+type cookieHandoff struct {
+	Nonce    string   `json:"n"`
+	Session  string   `json:"s"`
+	Hosts    []string `json:"h"`
+	Redirect string   `json:"rd"`
+}
+
+// validateCookieHandoffHosts checks each hand-off host is under one of the
+// cookie domains
+func validateCookieHandoffHosts(o *Options, msgs []string) []string {
+	for _, host := range o.Cookie.HandoffHosts {
+		if host == "" || strings.ContainsAny(host, "/?#") {
+			msgs = append(msgs, fmt.Sprintf("cookie_handoff_host (%s) must be a host, eg. auth.example.org", host))
+			continue
+		}
+		if hostCookieDomain(host, o.Cookie.Domains) == "" {
+			msgs = append(msgs, fmt.Sprintf("cookie_handoff_host (%s) does not match any cookie_domain", host))
+		}
+	}
+	return msgs
+}
+
+// hostCookieDomain returns the cookie domain sessions are saved for on host
+func hostCookieDomain(host string, domains []string) string {
+	return cookies.GetCookieDomain(&http.Request{Host: host, Header: http.Header{}}, domains)
+}
+
+// handoffHosts returns a hand-off host for each cookie domain other than the
+// request's
+func (p *OAuthProxy) handoffHosts(req *http.Request) []string {
+	seen := map[string]bool{cookies.GetCookieDomain(req, p.CookieDomains): true}
+	var hosts []string
+	for _, host := range p.cookieHandoffHosts {
+		domain := hostCookieDomain(host, p.CookieDomains)
+		if !seen[domain] {
+			seen[domain] = true
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// cookieHandoffRedirect returns where to send users who have just signed in:
+// through the hand-off endpoint of each sibling cookie domain, so they're
+// signed in there too, and then on to redirect. If the chain can't be
+// started, users are sent straight to redirect, signed in on this domain
+// only.
+func (p *OAuthProxy) cookieHandoffRedirect(req *http.Request, session *sessionsapi.SessionState, redirect string) string {
+	hosts := p.handoffHosts(req)
+	if len(hosts) == 0 {
+		return redirect
+	}
+	if strings.HasPrefix(redirect, "/") && !strings.HasPrefix(redirect, "//") {
+		// the chain ends on another host
+		redirect = p.handoffURL(cookies.GetRequestHost(req), redirect)
+	}
+	encoded, err := session.EncodeSessionState(p.cookieCipher)
+	if err != nil {
+		logger.Printf("Error starting cookie hand-off: %v", err)
+		return redirect
+	}
+	next, err := p.nextCookieHandoff(req, &cookieHandoff{Session: encoded, Hosts: hosts, Redirect: redirect})
+	if err != nil {
+		logger.Printf("Error starting cookie hand-off: %v", err)
+		return redirect
+	}
+	return next
+}
+
+// nextCookieHandoff returns the URL of the hand-off endpoint of the next
+// host, with a single use token for it
+func (p *OAuthProxy) nextCookieHandoff(req *http.Request, h *cookieHandoff) (string, error) {
+	nonce, err := encryption.Nonce()
+	if err != nil {
+		return "", err
+	}
+	if err := p.oauthStates.SaveState(req.Context(), nonce, p.oauthStateTTL); err != nil {
+		return "", err
+	}
+	h.Nonce = nonce
+	b, err := json.Marshal(h)
+	if err != nil {
+		return "", err
+	}
+	token, err := p.encodeCSRFValue(cookieHandoffKey, string(b), p.now())
+	if err != nil {
+		return "", err
+	}
+	return p.handoffURL(h.Hosts[0], p.CookieHandoffPath+"?token="+url.QueryEscape(token)), nil
+}
+
+// handoffURL returns the absolute URL of path on host
+func (p *OAuthProxy) handoffURL(host string, path string) string {
+	scheme := httpScheme
+	if p.CookieSecure {
+		scheme = httpsScheme
+	}
+	return scheme + "://" + host + path
+}
+
+// decodeCookieHandoff checks the hand-off token was issued by the proxy for
+// the request's host within the OAuth state TTL, and hasn't been used
+// before
+func (p *OAuthProxy) decodeCookieHandoff(req *http.Request) (*cookieHandoff, error) {
+	value, _, ok := encryption.ValidateAt(&http.Cookie{Name: cookieHandoffKey, Value: req.FormValue("token")}, p.CookieSeed, p.oauthStateTTL, p.now())
+	if !ok {
+		return nil, errors.New("invalid or expired token")
+	}
+	if p.cookieCipher != nil {
+		var err error
+		if value, err = p.cookieCipher.Decrypt(value); err != nil {
+			return nil, fmt.Errorf("invalid token: %v", err)
+		}
+	}
+	h := &cookieHandoff{}
+	if err := json.Unmarshal([]byte(value), h); err != nil {
+		return nil, fmt.Errorf("invalid token: %v", err)
+	}
+	if len(h.Hosts) == 0 || !strings.EqualFold(h.Hosts[0], cookies.GetRequestHost(req)) {
+		return nil, errors.New("token issued for another host")
+	}
+	if err := p.oauthStates.RedeemState(req.Context(), h.Nonce); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// CookieHandoff saves the session handed off by another cookie domain for
+// this one, and passes users on to the next host in the chain or to where
+// they were going
+func (p *OAuthProxy) CookieHandoff(rw http.ResponseWriter, req *http.Request) {
+	h, err := p.decodeCookieHandoff(req)
+	if errors.Is(err, sessionsapi.ErrNotFound) {
+		logger.PrintAuthf("", req, logger.AuthFailure, "Invalid cookie hand-off: token already used, potential replay")
+		p.ErrorPage(rw, http.StatusForbidden, "Permission Denied", "Invalid sign in link")
+		return
+	} else if err != nil {
+		logger.PrintAuthf("", req, logger.AuthFailure, "Invalid cookie hand-off: %v", err)
+		p.ErrorPage(rw, http.StatusForbidden, "Permission Denied", "Invalid sign in link")
+		return
+	}
+	session, err := sessionsapi.DecodeSessionState(h.Session, p.cookieCipher)
+	if err != nil {
+		logger.Printf("Error decoding handed off session: %v", err)
+		p.ErrorPage(rw, http.StatusInternalServerError, "Internal Error", "Internal Error")
+		return
+	}
+	if err := p.SaveSession(rw, req, session); err != nil {
+		logger.Printf("Error saving handed off session: %v", err)
+		p.ErrorPage(rw, http.StatusInternalServerError, "Internal Error", "Internal Error")
+		return
+	}
+	logger.PrintAuthf(session.Email, req, logger.AuthSuccess, "Authenticated via cookie hand-off: %s", session)
+
+	redirect := h.Redirect
+	if h.Hosts = h.Hosts[1:]; len(h.Hosts) > 0 {
+		next, err := p.nextCookieHandoff(req, h)
+		if err != nil {
+			logger.Printf("Error continuing cookie hand-off: %v", err)
+		} else {
+			redirect = next
+		}
+	}
+	http.Redirect(rw, req, redirect, http.StatusFound)
+}
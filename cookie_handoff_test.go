@@ -0,0 +1,70 @@
+package oauth2proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCookieHandoff(t *testing.T) {
+	pcTest := NewProcessCookieTestWithOptionsModifiers(func(o *Options) {
+		o.Cookie.Domains = []string{".example.com", ".example.org", ".example.net"}
+		o.Cookie.HandoffHosts = []string{"auth.example.com", "auth.example.org", "www.example.org", "auth.example.net"}
+	})
+	session := &sessionsapi.SessionState{Email: "jane@example.com", CreatedAt: time.Now()}
+
+	req := httptest.NewRequest("GET", "https://app.example.com/oauth2/callback", nil)
+	redirect := pcTest.proxy.cookieHandoffRedirect(req, session, "/reports?q=1")
+	assert.True(t, strings.HasPrefix(redirect, "https://auth.example.org/oauth2/cookie_handoff?token="), redirect)
+
+	handoff := func(rawURL string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		pcTest.proxy.ServeHTTP(rw, httptest.NewRequest("GET", rawURL, nil))
+		return rw
+	}
+	rw := handoff(redirect)
+	require.Equal(t, http.StatusFound, rw.Code)
+	next := rw.Header().Get("Location")
+	assert.True(t, strings.HasPrefix(next, "https://auth.example.net/oauth2/cookie_handoff?token="), next)
+	cookies := rw.Result().Cookies()
+	require.Len(t, cookies, 1)
+	assert.Equal(t, "example.org", cookies[0].Domain)
+
+	// tokens can only be used once
+	assert.Equal(t, http.StatusForbidden, handoff(redirect).Code)
+	// and only on the host they were issued for
+	u, err := url.Parse(next)
+	require.NoError(t, err)
+	u.Host = "auth.example.org"
+	assert.Equal(t, http.StatusForbidden, handoff(u.String()).Code)
+
+	rw = handoff(next)
+	require.Equal(t, http.StatusFound, rw.Code)
+	assert.Equal(t, "https://app.example.com/reports?q=1", rw.Header().Get("Location"))
+	cookies = rw.Result().Cookies()
+	require.Len(t, cookies, 1)
+	assert.Equal(t, "example.net", cookies[0].Domain)
+
+	// without siblings, users go straight on
+	req = httptest.NewRequest("GET", "https://app.example.com/oauth2/callback", nil)
+	pcTest.proxy.cookieHandoffHosts = []string{"auth.example.com"}
+	assert.Equal(t, "/reports", pcTest.proxy.cookieHandoffRedirect(req, session, "/reports"))
+}
+
+func TestCookieHandoffOptions(t *testing.T) {
+	o := testOptions()
+	o.Cookie.Domains = []string{".example.com", ".example.org"}
+	o.Cookie.HandoffHosts = []string{"auth.example.org", "auth.example.net", "https://auth.example.com"}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		"cookie_handoff_host (auth.example.net) does not match any cookie_domain",
+		"cookie_handoff_host (https://auth.example.com) must be a host, eg. auth.example.org"}), err.Error())
+}
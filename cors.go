@@ -0,0 +1,101 @@
+package oauth2proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// corsPolicy decides which cross-origin requests browsers may make to the
+// proxy's own endpoints, such as from single page apps on other subdomains
+type corsPolicy struct {
+	origins     []string
+	credentials bool
+	headers     string
+	maxAge      string
+}
+
+// newCORSPolicy returns a policy allowing the origins, which are either
+// exact, such as https://app.example.com, match any subdomain, such as
+// https://*.example.com, or are * for any origin
+func newCORSPolicy(origins, headers []string, credentials bool, maxAge time.Duration) (*corsPolicy, error) {
+	for _, origin := range origins {
+		if origin == "*" {
+			if credentials {
+				return nil, fmt.Errorf("cors_allowed_origin (*) can't be used with cors_allow_credentials")
+			}
+			continue
+		}
+		u, err := url.Parse(strings.Replace(origin, "://*.", "://", 1))
+		if err != nil || (u.Scheme != httpScheme && u.Scheme != httpsScheme) || u.Host == "" || u.Path != "" || u.RawQuery != "" {
+			return nil, fmt.Errorf("cors_allowed_origin (%s) must be a scheme and host such as https://app.example.com or https://*.example.com", origin)
+		}
+	}
+	return &corsPolicy{
+		origins:     origins,
+		credentials: credentials,
+		headers:     strings.Join(headers, ", "),
+		maxAge:      strconv.Itoa(int(maxAge.Seconds())),
+	}, nil
+}
+
+// allowsOrigin reports whether the origin matches one of those allowed
+func (c *corsPolicy) allowsOrigin(origin string) bool {
+	for _, allowed := range c.origins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+		i := strings.Index(allowed, "://*.")
+		if i == -1 {
+			continue
+		}
+		prefix, suffix := allowed[:i+3], allowed[i+4:]
+		if strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) && len(origin) > len(prefix)+len(suffix) {
+			if subdomain := origin[len(prefix) : len(origin)-len(suffix)]; !strings.ContainsAny(subdomain, "/:@?#") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// handle sets the CORS headers of the response to a request from an allowed
+// origin, and answers preflight requests, reporting whether it has
+func (c *corsPolicy) handle(rw http.ResponseWriter, req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	preflight := req.Method == http.MethodOptions && req.Header.Get("Access-Control-Request-Method") != ""
+	rw.Header().Add("Vary", "Origin")
+	if origin == "" {
+		return false
+	}
+	if !c.allowsOrigin(origin) {
+		if preflight {
+			rw.WriteHeader(http.StatusForbidden)
+		}
+		return preflight
+	}
+
+	rw.Header().Set("Access-Control-Allow-Origin", origin)
+	if c.credentials {
+		rw.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+	if !preflight {
+		return false
+	}
+	rw.Header().Set("Access-Control-Allow-Methods", "GET, POST")
+	if c.headers != "" {
+		rw.Header().Set("Access-Control-Allow-Headers", c.headers)
+	}
+	rw.Header().Set("Access-Control-Max-Age", c.maxAge)
+	rw.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// isCORSPath reports whether the path is one of the endpoints CORS requests
+// are handled for
+func (p *OAuthProxy) isCORSPath(path string) bool {
+	return path == p.UserInfoPath || path == p.AuthOnlyPath || path == p.SignOutPath
+}
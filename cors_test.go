@@ -0,0 +1,75 @@
+package oauth2proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCORSAllowsOrigin(t *testing.T) {
+	policy, err := newCORSPolicy([]string{"https://app.example.com", "https://*.example.org"}, nil, true, time.Minute)
+	require.NoError(t, err)
+
+	tests := map[string]bool{
+		"https://app.example.com":       true,
+		"http://app.example.com":        false,
+		"https://app.example.com:8443":  false,
+		"https://evil.com":              false,
+		"https://a.b.example.org":       true,
+		"https://example.org":           false,
+		"https://evil.com/.example.org": false,
+		"https://evilexample.org":       false,
+	}
+	for origin, allowed := range tests {
+		assert.Equal(t, allowed, policy.allowsOrigin(origin), origin)
+	}
+
+	for _, origins := range [][]string{{"*"}, {"app.example.com"}, {"https://app.example.com/path"}} {
+		_, err := newCORSPolicy(origins, nil, true, time.Minute)
+		assert.Error(t, err, origins)
+	}
+}
+
+func TestCORSRequests(t *testing.T) {
+	pcTest := NewProcessCookieTestWithOptionsModifiers(func(opts *Options) {
+		opts.CORSAllowedOrigins = []string{"https://*.example.com"}
+		opts.CORSAllowCredentials = true
+	})
+
+	req := httptest.NewRequest("OPTIONS", "/oauth2/userinfo", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	rw := httptest.NewRecorder()
+	pcTest.proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusNoContent, rw.Code)
+	assert.Equal(t, "https://app.example.com", rw.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "true", rw.Header().Get("Access-Control-Allow-Credentials"))
+	assert.Equal(t, "Authorization, Content-Type, X-Requested-With", rw.Header().Get("Access-Control-Allow-Headers"))
+	assert.Equal(t, "600", rw.Header().Get("Access-Control-Max-Age"))
+
+	req.Header.Set("Origin", "https://evil.com")
+	rw = httptest.NewRecorder()
+	pcTest.proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+	assert.Empty(t, rw.Header().Get("Access-Control-Allow-Origin"))
+
+	// Requests are handled as usual, with the CORS headers set
+	req = httptest.NewRequest("GET", "/oauth2/auth", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	rw = httptest.NewRecorder()
+	pcTest.proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusUnauthorized, rw.Code)
+	assert.Equal(t, "https://app.example.com", rw.Header().Get("Access-Control-Allow-Origin"))
+	assert.Equal(t, "Origin", rw.Header().Get("Vary"))
+
+	// Other endpoints are left alone
+	req = httptest.NewRequest("GET", "/ping", nil)
+	req.Header.Set("Origin", "https://app.example.com")
+	rw = httptest.NewRecorder()
+	pcTest.proxy.ServeHTTP(rw, req)
+	assert.Empty(t, rw.Header().Get("Access-Control-Allow-Origin"))
+}
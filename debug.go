@@ -0,0 +1,22 @@
+package oauth2proxy
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+)
+
+// newDebugHandler returns a handler serving the pprof profiles under
+// /debug/pprof/, the expvar variables under /debug/vars and diagnostics
+// snapshots under /debug/diagnostics
+func newDebugHandler(opts *Options) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.Handle("/debug/diagnostics", newDiagnosticsHandler(opts))
+	return mux
+}
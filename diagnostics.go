@@ -0,0 +1,272 @@
+package oauth2proxy
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strings"
+	"time"
+
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/logger"
+)
+
+// diagnosticsTimeout bounds how long the checks of the session store and
+// provider made for a diagnostics snapshot may take
+const diagnosticsTimeout = 30 * time.Second
+
+// secretOptionName matches the names of the options whose values are
+// redacted from diagnostics snapshots
+var secretOptionName = regexp.MustCompile(`secret|password|key|token|credentials|signing`)
+
+// redacted replaces the values of secret options in diagnostics snapshots
+const redacted = "REDACTED"
+
+// Diagnostics is a snapshot of the state of the proxy, to help troubleshoot
+// a running instance
+type Diagnostics struct {
+	Time         time.Time                  `json:"time"`
+	Version      string                     `json:"version"`
+	Config       map[string]interface{}     `json:"config"`
+	SessionStore SessionStoreDiagnostics    `json:"session_store"`
+	Provider     ProviderDiagnostics        `json:"provider"`
+	Runtime      RuntimeDiagnostics         `json:"runtime"`
+	Counters     map[string]json.RawMessage `json:"counters"`
+}
+
+// SessionStoreDiagnostics reports the health of the session store. The
+// number of sessions is among the counters.
+type SessionStoreDiagnostics struct {
+	Type  string `json:"type"`
+	Error string `json:"error,omitempty"`
+}
+
+// ProviderDiagnostics reports the endpoints discovered for the provider and
+// whether they can be reached
+type ProviderDiagnostics struct {
+	Name        string            `json:"name"`
+	IssuerURL   string            `json:"issuer_url,omitempty"`
+	Discovery   bool              `json:"discovery"`
+	LoginURL    string            `json:"login_url,omitempty"`
+	RedeemURL   string            `json:"redeem_url,omitempty"`
+	ProfileURL  string            `json:"profile_url,omitempty"`
+	ValidateURL string            `json:"validate_url,omitempty"`
+	Checks      map[string]string `json:"checks"`
+}
+
+// RuntimeDiagnostics reports the goroutines and heap of the process
+type RuntimeDiagnostics struct {
+	GoVersion    string `json:"go_version"`
+	Goroutines   int    `json:"goroutines"`
+	HeapAlloc    uint64 `json:"heap_alloc"`
+	HeapInuse    uint64 `json:"heap_inuse"`
+	HeapObjects  uint64 `json:"heap_objects"`
+	NumGC        uint32 `json:"num_gc"`
+	PauseTotalNs uint64 `json:"pause_total_ns"`
+}
+
+// CollectDiagnostics takes a snapshot of the state of the proxy configured
+// by the validated options: its configuration with secrets redacted, the
+// health of the session store and provider, the runtime's statistics and
+// the counters published with expvar, eg. of errors.
+func CollectDiagnostics(ctx context.Context, opts *Options) *Diagnostics {
+	ctx, cancel := context.WithTimeout(ctx, diagnosticsTimeout)
+	defer cancel()
+
+	return &Diagnostics{
+		Time:         time.Now().UTC(),
+		Version:      VERSION,
+		Config:       redactedConfig(opts),
+		SessionStore: sessionStoreDiagnostics(ctx, opts),
+		Provider:     providerDiagnostics(ctx, opts),
+		Runtime:      runtimeDiagnostics(),
+		Counters:     expvarCounters(),
+	}
+}
+
+// WriteDiagnostics writes a diagnostics snapshot to w as JSON
+func WriteDiagnostics(ctx context.Context, opts *Options, w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(CollectDiagnostics(ctx, opts))
+}
+
+// DumpDiagnostics writes a diagnostics snapshot to the diagnostics file, or
+// logs it when there is none
+func DumpDiagnostics(ctx context.Context, opts *Options) {
+	d, err := json.Marshal(CollectDiagnostics(ctx, opts))
+	if err != nil {
+		logger.Printf("Error encoding diagnostics: %v", err)
+		return
+	}
+	if opts.DiagnosticsFile == "" {
+		logger.Printf("Diagnostics: %s", d)
+		return
+	}
+	// the snapshot reveals the configuration, even if not its secrets
+	if err := ioutil.WriteFile(opts.DiagnosticsFile, append(d, '\n'), 0600); err != nil {
+		logger.Printf("Error writing diagnostics to %s: %v", opts.DiagnosticsFile, err)
+		return
+	}
+	logger.Printf("Diagnostics written to %s", opts.DiagnosticsFile)
+}
+
+// newDiagnosticsHandler serves diagnostics snapshots
+func newDiagnosticsHandler(opts *Options) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", applicationJSON)
+		if err := WriteDiagnostics(req.Context(), opts, rw); err != nil {
+			logger.Printf("Error writing diagnostics: %v", err)
+		}
+	})
+}
+
+// redactedConfig returns the options by their config file names, with the
+// values of secret options, and the passwords of URLs, redacted
+func redactedConfig(opts *Options) map[string]interface{} {
+	config := map[string]interface{}{}
+	addConfig(config, reflect.ValueOf(opts).Elem())
+	return config
+}
+
+func addConfig(config map[string]interface{}, v reflect.Value) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := field.Tag.Get("cfg")
+		if tag == ",squash" && field.Type.Kind() == reflect.Struct {
+			addConfig(config, v.Field(i))
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if name == "" || name == "-" || field.PkgPath != "" {
+			continue
+		}
+		config[name] = redactedValue(name, v.Field(i).Interface())
+	}
+}
+
+func redactedValue(name string, value interface{}) interface{} {
+	switch value := value.(type) {
+	case string:
+		if value == "" {
+			return value
+		}
+		if secretOptionName.MatchString(name) {
+			return redacted
+		}
+		return redactURL(value)
+	case []string:
+		if len(value) == 0 {
+			return value
+		}
+		values := make([]string, len(value))
+		for i, s := range value {
+			if secretOptionName.MatchString(name) {
+				values[i] = redacted
+			} else {
+				values[i] = redactURL(s)
+			}
+		}
+		return values
+	case time.Duration:
+		return value.String()
+	}
+	return value
+}
+
+// redactURL redacts the password of values that are URLs, eg. of redis
+// connection URLs or upstreams
+func redactURL(s string) string {
+	if !strings.Contains(s, "://") {
+		return s
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.User == nil {
+		return s
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), redacted)
+	}
+	return u.String()
+}
+
+func sessionStoreDiagnostics(ctx context.Context, opts *Options) SessionStoreDiagnostics {
+	d := SessionStoreDiagnostics{Type: opts.Session.Type}
+	if pinger, ok := opts.sessionStore.(sessionsapi.Pinger); ok {
+		if err := pinger.Ping(ctx); err != nil {
+			d.Error = err.Error()
+		}
+	}
+	return d
+}
+
+func providerDiagnostics(ctx context.Context, opts *Options) ProviderDiagnostics {
+	d := ProviderDiagnostics{
+		IssuerURL: opts.OIDCIssuerURL,
+		Discovery: opts.OIDCIssuerURL != "" && !opts.SkipOIDCDiscovery,
+		Checks:    map[string]string{},
+	}
+	if opts.provider == nil {
+		return d
+	}
+	data := opts.provider.Data()
+	d.Name = data.ProviderName
+	d.LoginURL = urlString(data.LoginURL)
+	d.RedeemURL = urlString(data.RedeemURL)
+	d.ProfileURL = urlString(data.ProfileURL)
+	d.ValidateURL = urlString(data.ValidateURL)
+	for _, check := range checkProvider(ctx, opts) {
+		d.Checks[check.Name] = "ok"
+		if check.Err != nil {
+			d.Checks[check.Name] = check.Err.Error()
+		}
+	}
+	return d
+}
+
+func urlString(u *url.URL) string {
+	if u == nil {
+		return ""
+	}
+	return u.String()
+}
+
+func runtimeDiagnostics() RuntimeDiagnostics {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return RuntimeDiagnostics{
+		GoVersion:    runtime.Version(),
+		Goroutines:   runtime.NumGoroutine(),
+		HeapAlloc:    m.HeapAlloc,
+		HeapInuse:    m.HeapInuse,
+		HeapObjects:  m.HeapObjects,
+		NumGC:        m.NumGC,
+		PauseTotalNs: m.PauseTotalNs,
+	}
+}
+
+// expvarCounters returns the variables published with expvar, other than
+// the command line and memory statistics reported elsewhere
+func expvarCounters() map[string]json.RawMessage {
+	counters := map[string]json.RawMessage{}
+	expvar.Do(func(kv expvar.KeyValue) {
+		if kv.Key == "cmdline" || kv.Key == "memstats" {
+			return
+		}
+		if s := kv.Value.String(); json.Valid([]byte(s)) {
+			counters[kv.Key] = json.RawMessage(s)
+		} else {
+			counters[kv.Key] = json.RawMessage(fmt.Sprintf("%q", s))
+		}
+	})
+	return counters
+}
@@ -0,0 +1,149 @@
+package oauth2proxy
+
+import (
+	"bufio"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/logger"
+)
+
+// featureStrictSameSite sets SameSite=Strict on the session cookies of the
+// users it is enabled for, whatever the cookie_samesite
+const featureStrictSameSite = "strict_samesite"
+
+// knownFeatures are the behaviors that can be rolled out with feature flags
+var knownFeatures = map[string]bool{
+	featureStrictSameSite: true,
+}
+
+// featureFlags gate risky new behaviors, enabling each of them for a
+// percentage of users so that they can be rolled out gradually. The
+// percentages in the feature flags file take precedence over the options,
+// and are reloaded when it changes, so that a behavior can be rolled back
+// without a restart.
+type featureFlags struct {
+	flags       map[string]int
+	file        string
+	percentages atomic.Value // map[string]int
+}
+
+// parseFeatureFlag parses a feature flag of the form <name>=<percentage>
+func parseFeatureFlag(s string) (string, int, error) {
+	i := strings.Index(s, "=")
+	if i < 0 {
+		return "", 0, fmt.Errorf("feature_flag (%s) must be of the form <name>=<percentage>", s)
+	}
+	name := strings.TrimSpace(s[:i])
+	if !knownFeatures[name] {
+		return "", 0, fmt.Errorf("feature_flag (%s) must be one of %s", s, strings.Join(featureNames(), ", "))
+	}
+	percentage, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(s[i+1:]), "%"))
+	if err != nil || percentage < 0 || percentage > 100 {
+		return "", 0, fmt.Errorf("feature_flag (%s) must have a percentage from 0 to 100", s)
+	}
+	return name, percentage, nil
+}
+
+func featureNames() []string {
+	names := make([]string, 0, len(knownFeatures))
+	for name := range knownFeatures {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// newFeatureFlags returns the feature flags set by the options, and by the
+// feature flags file if any
+func newFeatureFlags(flags map[string]int, file string) (*featureFlags, error) {
+	f := &featureFlags{flags: flags, file: file}
+	if err := f.load(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *featureFlags) load() error {
+	percentages := make(map[string]int, len(f.flags))
+	for name, percentage := range f.flags {
+		percentages[name] = percentage
+	}
+	if f.file != "" {
+		file, err := os.Open(f.file)
+		if err != nil {
+			return fmt.Errorf("error opening feature_flags_file %s: %v", f.file, err)
+		}
+		defer file.Close()
+		scanner := bufio.NewScanner(file)
+		for n := 1; scanner.Scan(); n++ {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			name, percentage, err := parseFeatureFlag(line)
+			if err != nil {
+				return fmt.Errorf("feature_flags_file %s line %d: %v", f.file, n, err)
+			}
+			percentages[name] = percentage
+		}
+		if err := scanner.Err(); err != nil {
+			return fmt.Errorf("error reading feature_flags_file %s: %v", f.file, err)
+		}
+	}
+	f.percentages.Store(percentages)
+	return nil
+}
+
+// watch reloads the feature flags file whenever it changes, keeping the
+// percentages loaded before when it can't be loaded
+func (f *featureFlags) watch() {
+	WatchForUpdates(f.file, nil, func() {
+		if err := f.load(); err != nil {
+			logger.Printf("%v", err)
+			return
+		}
+		logger.Printf("reloaded feature flags: %v", f.percentages.Load())
+	})
+}
+
+// enabled checks whether the feature is enabled for the session's user. Each
+// user falls in a bucket from 0 to 99 by a hash of their email, or username,
+// and the feature's name, so that raising the percentage only adds users,
+// and different features are rolled out to different users first.
+func (f *featureFlags) enabled(feature string, session *sessionsapi.SessionState) bool {
+	if f == nil {
+		return false
+	}
+	percentage := f.percentages.Load().(map[string]int)[feature]
+	switch {
+	case percentage <= 0:
+		return false
+	case percentage >= 100:
+		return true
+	case session == nil:
+		return false
+	}
+	user := session.Email
+	if user == "" {
+		user = session.User
+	}
+	if user == "" {
+		return false
+	}
+	return featureBucket(feature, user) < percentage
+}
+
+func featureBucket(feature, user string) int {
+	h := fnv.New32a()
+	h.Write([]byte(feature))
+	h.Write([]byte{0})
+	h.Write([]byte(strings.ToLower(user)))
+	return int(h.Sum32() % 100)
+}
@@ -0,0 +1,103 @@
+package oauth2proxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseFeatureFlag(t *testing.T) {
+	name, percentage, err := parseFeatureFlag("strict_samesite=25%")
+	require.NoError(t, err)
+	assert.Equal(t, featureStrictSameSite, name)
+	assert.Equal(t, 25, percentage)
+
+	for _, s := range []string{"strict_samesite", "strict_samesite=101", "strict_samesite=some", "gcm_cipher=10"} {
+		_, _, err := parseFeatureFlag(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestFeatureFlagsEnabled(t *testing.T) {
+	var f *featureFlags
+	assert.False(t, f.enabled(featureStrictSameSite, &sessionsapi.SessionState{Email: "jane@example.com"}))
+
+	f, err := newFeatureFlags(map[string]int{featureStrictSameSite: 0}, "")
+	require.NoError(t, err)
+	users := make([]*sessionsapi.SessionState, 1000)
+	for i := range users {
+		users[i] = &sessionsapi.SessionState{Email: fmt.Sprintf("user%d@example.com", i)}
+	}
+
+	// raising the percentage only adds users
+	previous := map[int]bool{}
+	for _, percentage := range []int{0, 10, 50, 100} {
+		f.percentages.Store(map[string]int{featureStrictSameSite: percentage})
+		count := 0
+		for i, user := range users {
+			if f.enabled(featureStrictSameSite, user) {
+				count++
+				previous[i] = true
+			} else {
+				assert.False(t, previous[i], "user %d dropped at %d%%", i, percentage)
+			}
+		}
+		assert.InDelta(t, percentage*10, count, 50, "%d%%", percentage)
+	}
+	assert.True(t, f.enabled(featureStrictSameSite, nil))
+}
+
+func TestFeatureFlagsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "feature-flags")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "features")
+	require.NoError(t, ioutil.WriteFile(file, []byte("# rolled out to everyone\nstrict_samesite=100\n"), 0600))
+
+	o := testOptions()
+	o.FeatureFlags = []string{"strict_samesite=10"}
+	o.FeatureFlagsFile = file
+	require.NoError(t, o.Validate())
+	session := &sessionsapi.SessionState{Email: "jane@example.com"}
+	assert.True(t, o.featureFlags.enabled(featureStrictSameSite, session))
+
+	// a broken file keeps the percentages loaded before
+	require.NoError(t, ioutil.WriteFile(file, []byte("strict_samesite=all\n"), 0600))
+	assert.Error(t, o.featureFlags.load())
+	assert.True(t, o.featureFlags.enabled(featureStrictSameSite, session))
+
+	// rolling back
+	require.NoError(t, ioutil.WriteFile(file, []byte("strict_samesite=0\n"), 0600))
+	require.NoError(t, o.featureFlags.load())
+	assert.False(t, o.featureFlags.enabled(featureStrictSameSite, session))
+
+	o = testOptions()
+	o.FeatureFlags = []string{"gcm_cipher=10"}
+	err = o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		"feature_flag (gcm_cipher=10) must be one of strict_samesite"}), err.Error())
+}
+
+func TestStrictSameSiteFeature(t *testing.T) {
+	pcTest := NewProcessCookieTestWithDefaults()
+	f, err := newFeatureFlags(map[string]int{featureStrictSameSite: 100}, "")
+	require.NoError(t, err)
+	pcTest.proxy.featureFlags = f
+	require.NoError(t, pcTest.SaveSession(&sessionsapi.SessionState{Email: "jane@example.com"}))
+
+	var sameSite http.SameSite
+	for _, c := range pcTest.rw.Result().Cookies() {
+		if c.Name == pcTest.opts.Cookie.Name {
+			sameSite = c.SameSite
+		}
+	}
+	assert.Equal(t, http.SameSiteStrictMode, sameSite)
+}
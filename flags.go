@@ -0,0 +1,276 @@
+package oauth2proxy
+
+import (
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/logger"
+	"github.com/spf13/pflag"
+)
+
+// NewFlagSet creates a FlagSet defining every command line flag, and its
+// default value, supported by Options
+func NewFlagSet() *pflag.FlagSet {
+	flagSet := pflag.NewFlagSet("oauth2-proxy", pflag.ExitOnError)
+
+	flagSet.String("config", "", "path to config file")
+	flagSet.Bool("version", false, "print version string")
+
+	flagSet.String("http-address", "127.0.0.1:4180", "[http://]<addr>:<port> or unix://<path> to listen on for HTTP clients")
+	flagSet.String("https-address", ":443", "<addr>:<port> to listen on for HTTPS clients")
+	flagSet.String("debug-address", "", "<addr>:<port> on a loopback interface to serve pprof and expvar debug handlers on (disabled if empty)")
+	flagSet.String("diagnostics-file", "", "the file diagnostics snapshots are written to on SIGUSR1, which are logged if empty")
+	flagSet.Bool("reverse-proxy", false, "are we running behind a reverse proxy, controls whether headers like X-Real-Ip are accepted")
+	flagSet.String("real-client-ip-header", "X-Real-IP", "Header used to determine the real IP of the client (one of: X-Forwarded-For, X-Real-IP, or X-ProxyUser-IP)")
+	flagSet.Bool("force-https", false, "force HTTPS redirect for HTTP requests")
+	flagSet.String("tls-cert-file", "", "path to certificate file")
+	flagSet.String("tls-key-file", "", "path to private key file")
+	flagSet.String("tls-min-version", "TLS1.2", "the minimum TLS version clients may connect with: TLS1.2 or TLS1.3")
+	flagSet.StringSlice("tls-cipher-suite", []string{}, "restrict the TLS 1.2 cipher suites clients may use to these, by their IANA name (may be given multiple times)")
+	flagSet.StringSlice("tls-curve-preference", []string{}, "the elliptic curves used for key exchange, in order of preference: X25519, P256, P384 or P521 (may be given multiple times)")
+	flagSet.Bool("tls-ocsp-stapling", false, "staple OCSP responses fetched from the certificate's OCSP responder to TLS handshakes (the certificate file must include the issuer's certificate)")
+	flagSet.String("redirect-url", "", "the OAuth Redirect URL. ie: \"https://internalapp.yourcompany.com/oauth2/callback\"")
+	flagSet.Bool("set-xauthrequest", false, "set X-Auth-Request-User and X-Auth-Request-Email response headers (useful in Nginx auth_request mode)")
+	flagSet.StringSlice("upstream", []string{}, "the http url(s) of the upstream endpoint, file:// paths for static files or static://<status_code> for static response. Routing is based on the path")
+	flagSet.Bool("pass-basic-auth", true, "pass HTTP Basic Auth, X-Forwarded-User and X-Forwarded-Email information to upstream")
+	flagSet.Bool("set-basic-auth", false, "set HTTP Basic Auth information in response (useful in Nginx auth_request mode)")
+	flagSet.Bool("prefer-email-to-user", false, "Prefer to use the Email address as the Username when passing information to upstream. Will only use Username if Email is unavailable, eg. htaccess authentication. Used in conjunction with -pass-basic-auth and -pass-user-headers")
+	flagSet.Bool("pass-user-headers", true, "pass X-Forwarded-User and X-Forwarded-Email information to upstream")
+	flagSet.String("basic-auth-password", "", "the password to set when passing the HTTP Basic Auth header")
+	flagSet.Bool("pass-access-token", false, "pass OAuth access_token to upstream via X-Forwarded-Access-Token header")
+	flagSet.Bool("pass-host-header", true, "pass the request Host Header to upstream")
+	flagSet.Bool("pass-authorization-header", false, "pass the Authorization Header to upstream")
+	flagSet.Bool("set-authorization-header", false, "set Authorization response headers (useful in Nginx auth_request mode)")
+	flagSet.StringSlice("skip-auth-regex", []string{}, "bypass authentication for requests path's that match (may be given multiple times)")
+	flagSet.StringSlice("skip-auth-well-known", []string{"acme-challenge"}, "bypass authentication for the named /.well-known/ paths, eg. for ACME HTTP-01 challenges (may be given multiple times)")
+	flagSet.StringSlice("anonymous-regex", []string{}, "proxy unauthenticated requests for paths that match as the user \"anonymous\" instead of prompting them to sign in (may be given multiple times)")
+	flagSet.Bool("skip-provider-button", false, "will skip sign-in-page to directly reach the next step: oauth/start")
+	flagSet.Bool("skip-auth-preflight", false, "will skip authentication for OPTIONS requests")
+	flagSet.Bool("ssl-insecure-skip-verify", false, "skip validation of certificates presented when using HTTPS providers")
+	flagSet.Bool("ssl-upstream-insecure-skip-verify", false, "skip validation of certificates presented when using HTTPS upstreams")
+	flagSet.Duration("flush-interval", time.Duration(1)*time.Second, "period between response flushing when streaming responses")
+	flagSet.Int("upstream-header-size-limit", 0, "maximum size in bytes of the request headers sent upstream once the user's identity and tokens are added (0 for no limit)")
+	flagSet.String("upstream-header-size-policy", "reject", "what to do with requests over the upstream-header-size-limit: 'reject' with a 431 error or 'drop' the token headers added by the proxy until it fits")
+	flagSet.StringSlice("impersonation-admin", []string{}, "email, or group:<name>, of an administrator allowed to impersonate other users (may be given multiple times)")
+	flagSet.Duration("impersonation-duration", time.Hour, "how long an impersonation session lasts before the administrator has to sign in again")
+	flagSet.Bool("machine-tokens", false, "allow users to issue long lived tokens for systems to call upstreams without a browser (requires the redis session store)")
+	flagSet.Duration("machine-token-max-ttl", 90*24*time.Hour, "the longest lifetime a machine token may be issued with")
+	flagSet.Bool("session-tls-binding", false, "bind sessions to the TLS connection they were created on, rejecting session cookies replayed on other connections (requires tls-cert-file and tls-key-file)")
+	flagSet.String("webauthn-rp-id", "", "require users to verify their session with a WebAuthn credential (passkey) registered for this domain, the relying party ID")
+	flagSet.StringSlice("webauthn-origin", []string{}, "the origins of the proxy's pages where WebAuthn credentials are used (may be given multiple times; default https://<webauthn-rp-id>)")
+	flagSet.StringSlice("webauthn-route", []string{}, "only require WebAuthn verification for request paths matching this regex (may be given multiple times; default all paths)")
+	flagSet.StringSlice("step-up-route", []string{}, "require sessions used for request paths matching <regex> to be authenticated with <acr>, given as <regex>=<acr> (may be given multiple times)")
+	flagSet.StringSlice("step-up-acr-level", []string{}, "acr values from weakest to strongest, so that a stronger acr satisfies routes requiring a weaker one (may be given multiple times)")
+	flagSet.StringSlice("access-window", []string{}, "only allow sessions to be used for request paths matching <regex> within a schedule of days, hours and an expiry date, eg. ^/admin=Mon-Fri 08:00-18:00 until:2021-12-31, given as <regex>=<schedule> (may be given multiple times)")
+	flagSet.String("access-window-timezone", "UTC", "the timezone access windows are evaluated in, eg. Europe/London")
+	flagSet.StringSlice("interstitial", []string{}, "require users to accept the interstitial page <name>, eg. terms of use, once per session before request paths matching <regex> are proxied, given as <regex>=<name> (may be given multiple times)")
+	flagSet.StringSlice("header-template", []string{}, "set a header from a Go template over the session, given as <header>=<template>, eg. X-User=\"{{.Email | lower}}\" (may be given multiple times)")
+	flagSet.StringSlice("rewrite-redirect-upstream", []string{}, "rewrite the redirects and cookie domains this upstream issues for its own host to the host the client requested; the upstream as given to --upstream (may be given multiple times)")
+	flagSet.Int("user-max-concurrent-requests", 0, "the maximum number of requests each user may have in progress through the proxy at once (0 for no limit)")
+	flagSet.Int64("user-bandwidth-limit", 0, "the maximum number of bytes of request and response bodies each user may transfer through the proxy in each --user-bandwidth-window (0 for no limit)")
+	flagSet.Duration("user-bandwidth-window", time.Minute, "the window --user-bandwidth-limit applies to")
+	flagSet.String("user-limits-store", "memory", "where to count the per-user limits: 'memory', per instance of the proxy, or 'redis', shared by the instances (requires the redis session store)")
+	flagSet.Int("login-throttle-failures", 0, "the number of sign ins in a row a user may be refused after authenticating with the provider before they must wait --login-throttle-cooldown to sign in again (0 to disable)")
+	flagSet.Duration("login-throttle-cooldown", 5*time.Minute, "how long users must wait to sign in again after --login-throttle-failures")
+	flagSet.String("provider-lookup-cache", "memory", "where to cache provider userinfo and group lookups: 'memory' or 'redis' (requires the redis session store)")
+	flagSet.Duration("provider-lookup-cache-ttl", 0, "how long to cache provider userinfo and group lookups for (0 to disable caching)")
+	flagSet.Duration("jwks-refresh-interval", time.Hour, "how often to fetch the signing keys of the oidc and extra JWT issuers in the background, as well as at startup (0 to only fetch them at startup and when a token is signed by an unknown key)")
+	flagSet.String("assertion-key-file", "", "the PEM or JWK file of an RSA, ECDSA P-256 or Ed25519 private key to sign assertions of the user's identity passed to upstreams with")
+	flagSet.StringSlice("assertion-verification-key-file", []string{}, "the PEM or JWK file of a public or private key published with the assertion key for upstreams to verify assertions with but not used to sign, to rotate keys (may be given multiple times)")
+	flagSet.String("assertion-header", "X-Forwarded-Assertion", "the header signed assertions are passed to upstreams in")
+	flagSet.String("assertion-issuer", "oauth2-proxy", "the issuer (iss) of signed assertions")
+	flagSet.String("assertion-audience", "", "the audience (aud) of signed assertions, if any")
+	flagSet.String("previous-cookie-secret", "", "the cookie secret sessions were saved with before it was rotated; such sessions are loaded and saved again with --cookie-secret")
+	flagSet.String("previous-session-store-type", "", "the session store sessions were saved to before migrating to --session-store-type; such sessions are loaded and saved again to the current store")
+	flagSet.StringSlice("upstream-signing", []string{}, "sign the requests proxied to an upstream: upstream=hmac:algorithm:secret for a GAP-Signature, or upstream=sigv4:region:service for AWS Signature Version 4 (may be given multiple times)")
+	flagSet.String("upstream-aws-access-key-id", "", "the AWS access key ID to sign sigv4 upstream requests with (defaults to $AWS_ACCESS_KEY_ID)")
+	flagSet.String("upstream-aws-secret-access-key", "", "the AWS secret access key to sign sigv4 upstream requests with (defaults to $AWS_SECRET_ACCESS_KEY)")
+	flagSet.String("upstream-aws-session-token", "", "the AWS session token of temporary credentials to sign sigv4 upstream requests with (defaults to $AWS_SESSION_TOKEN)")
+	flagSet.Int64("upstream-sigv4-max-body-size", 10<<20, "the largest request body in bytes that is read into memory to be signed for a sigv4 upstream; larger requests are refused with a 413")
+	flagSet.String("baggage-user-key", "", "add a pseudonymous ID of the user, an HMAC of their subject, to the W3C baggage header passed upstream under this key, eg. enduser.id")
+	flagSet.String("baggage-hash-key", "", "the key of the HMAC identifying users in baggage (defaults to the cookie secret)")
+	flagSet.StringSlice("trace-header", defaultTraceHeaders, "a tracing or correlation header always passed upstream as the client sent it, never removed or replaced by the proxy (may be given multiple times)")
+	flagSet.StringSlice("cors-allowed-origin", []string{}, "allow cross-origin requests from this origin to the userinfo, auth and sign out endpoints, eg. https://app.example.com, https://*.example.com or * (may be given multiple times)")
+	flagSet.StringSlice("cors-allowed-header", []string{"Authorization", "Content-Type", "X-Requested-With"}, "the request headers cross-origin requests may send (may be given multiple times)")
+	flagSet.Bool("cors-allow-credentials", false, "allow cross-origin requests to send cookies, which requires the allowed origins to be listed")
+	flagSet.Duration("cors-max-age", 10*time.Minute, "how long browsers may cache the response to CORS preflight requests")
+	flagSet.StringSlice("webhook-url", []string{}, "send authentication events to this URL as signed JSON webhooks (may be given multiple times)")
+	flagSet.String("webhook-secret", "", "the secret webhooks are signed with in the X-OAuth2-Proxy-Signature header")
+	flagSet.StringSlice("webhook-event", []string{"sign_in", "sign_out", "refresh_failure"}, "the events to send webhooks for: sign_in, sign_out or refresh_failure (may be given multiple times)")
+	flagSet.Int("webhook-max-retries", 3, "the number of times a failed webhook is retried, with exponential backoff")
+	flagSet.Float64("upstream-breaker-error-rate", 0, "the fraction of failed requests to an upstream, eg. 0.5, that opens its circuit breaker, rejecting requests with a 502 page for a while (0 to disable)")
+	flagSet.Int("upstream-breaker-min-requests", 20, "the number of requests to an upstream in the window before its circuit breaker can open")
+	flagSet.Duration("upstream-breaker-window", 10*time.Second, "the window over which the error rate of an upstream is measured")
+	flagSet.Duration("upstream-breaker-open-duration", 30*time.Second, "how long a circuit breaker stays open before probe requests are sent to the upstream")
+	flagSet.Int("upstream-breaker-probes", 3, "the number of probe requests that must succeed for an open circuit breaker to close again")
+	flagSet.Int("upstream-retries", 0, "the number of times an idempotent request is retried when the upstream can't be reached or responds 502, 503 or 504")
+	flagSet.Float64("upstream-retry-budget", 0.2, "the maximum fraction of requests to an upstream that can be retries, so that retries don't overwhelm a failing upstream")
+	flagSet.Int("upstream-max-idle-conns", 100, "the maximum number of idle connections kept open to the upstreams in total (0 for no limit)")
+	flagSet.Int("upstream-max-idle-conns-per-host", 2, "the maximum number of idle connections kept open to each upstream host")
+	flagSet.Duration("upstream-idle-conn-timeout", 90*time.Second, "how long idle connections to the upstreams are kept open (0 for no limit)")
+	flagSet.Bool("upstream-disable-keep-alives", false, "open a new connection to the upstream for every request")
+	flagSet.StringSlice("upstream-transport", []string{}, "tune the connections to an upstream, overriding the --upstream-max-idle-conns, --upstream-max-idle-conns-per-host, --upstream-idle-conn-timeout and --upstream-disable-keep-alives settings: upstream=max-idle-conns-per-host:256 idle-conn-timeout:30s (may be given multiple times)")
+	flagSet.Duration("token-refresh-skew", 0, "refresh access tokens this long before they expire, eg. 1m, so that upstreams aren't passed a token that expires mid-request")
+	flagSet.Duration("request-deadline", 0, "the time each request may take to load and refresh its session and be served by the upstream, eg. 30s (0 for no deadline)")
+	flagSet.StringSlice("upstream-route", []string{}, "proxy requests under a path to the upstream given by a template over the session, eg. /api/=https://{{.Claims.tenant}}.api.internal (may be given multiple times)")
+	flagSet.StringSlice("upstream-shadow", []string{}, "duplicate a percentage of the authenticated requests under a path to a secondary upstream, discarding its responses, eg. /api/=10:http://canary.internal:8080 (may be given multiple times)")
+	flagSet.Int64("upstream-shadow-max-body-size", 1<<20, "the largest request body in bytes that is shadowed; requests with larger bodies aren't")
+	flagSet.StringSlice("upstream-file-index", []string{"index.html"}, "the files served for a directory of a file:// upstream, in order of preference (may be given multiple times)")
+	flagSet.Bool("upstream-file-directory-listing", true, "list the files of the directories of file:// upstreams without an index file; not found if disabled")
+	flagSet.StringSlice("upstream-file-content-type", []string{}, "the content type the files of file:// upstreams with an extension are served with, eg. .md=text/markdown (may be given multiple times)")
+	flagSet.Bool("upstream-file-content-sniffing", true, "detect the content type of the files of file:// upstreams with an unknown extension from their content; served as application/octet-stream if disabled")
+	flagSet.Bool("compress-responses", false, "compress the sign in, error and userinfo responses with gzip for clients that accept it")
+	flagSet.Bool("compress-upstream-responses", false, "also compress the responses of the upstreams that the upstream didn't compress (requires --compress-responses)")
+	flagSet.Int("compress-min-size", 1024, "the smallest response in bytes that is compressed")
+	flagSet.StringSlice("compress-content-type", defaultCompressContentTypes, "the content types of the responses that are compressed, eg. text/html or text/* (may be given multiple times)")
+	flagSet.String("provider-startup-check", "", "check at startup that the provider is reachable and accepts the client credentials: \"warn\" logs failures, \"fail\" exits on them")
+	flagSet.Duration("allowed-clock-skew", 0, "allowed clock skew between the proxy's instances and the provider when checking the expiry of sessions and signed cookies")
+	flagSet.Duration("oauth-state-ttl", 15*time.Minute, "how long users have to sign in at the provider before the OAuth state expires; each state can only be used once")
+	flagSet.StringSlice("redirect-host", []string{}, "hosts the redirect URL may take its host from the request for, so that users can sign in through any of them (may be given multiple times). Prefix a host with a . to allow its subdomains (eg .example.com)")
+	flagSet.String("missing-session-action", "sign_in", "what to do with requests whose session cookie refers to a session missing from the session store, once the stale cookie is cleared: show the sign in page (\"sign_in\") or redirect straight to the provider, back to the requested page (\"redirect\")")
+	flagSet.Duration("refresh-grace-period", time.Duration(0), "how long after their tokens expire sessions may still be used when refreshing them fails because the provider is unavailable; 0 to disable")
+	flagSet.String("maintenance-file", "", "serve a 503 maintenance page for proxied routes while this file exists; its contents, if any, are shown as the message")
+	flagSet.Bool("skip-jwt-bearer-tokens", false, "will skip requests that have verified JWT bearer tokens (default false)")
+	flagSet.StringSlice("extra-jwt-issuers", []string{}, "if skip-jwt-bearer-tokens is set, a list of extra JWT issuer=audience pairs (where the issuer URL has a .well-known/openid-configuration or a .well-known/jwks.json)")
+
+	flagSet.StringSlice("email-domain", []string{}, "authenticate emails with the specified domain (may be given multiple times). Use * to authenticate any email")
+	flagSet.StringSlice("whitelist-domain", []string{}, "allowed domains for redirection after authentication. Prefix domain with a . to allow subdomains (eg .example.com)")
+	flagSet.String("keycloak-group", "", "restrict login to members of this group.")
+	flagSet.String("azure-tenant", "common", "go to a tenant-specific or common (tenant-independent) endpoint.")
+	flagSet.String("bitbucket-team", "", "restrict logins to members of this team")
+	flagSet.String("bitbucket-repository", "", "restrict logins to user with access to this repository")
+	flagSet.String("github-org", "", "restrict logins to members of this organisation")
+	flagSet.String("github-team", "", "restrict logins to members of this team")
+	flagSet.String("github-repo", "", "restrict logins to collaborators of this repository")
+	flagSet.String("github-token", "", "the token to use when verifying repository collaborators (must have push access to the repository)")
+	flagSet.String("gitlab-group", "", "restrict logins to members of this group")
+	flagSet.StringSlice("google-group", []string{}, "restrict logins to members of this google group (may be given multiple times).")
+	flagSet.String("google-admin-email", "", "the google admin to impersonate for api calls")
+	flagSet.String("google-service-account-json", "", "the path to the service account json credentials")
+	flagSet.String("ldap-url", "", "the LDAP server to authenticate users against: ie: \"ldaps://ldap.example.com\"")
+	flagSet.String("ldap-bind-dn", "", "the DN of the service account used to search for users (searches anonymously if unset)")
+	flagSet.String("ldap-bind-password", "", "the password of the service account used to search for users")
+	flagSet.String("ldap-base-dn", "", "the DN under which to search for users")
+	flagSet.String("ldap-user-attribute", "uid", "the attribute matched against the username, eg. \"sAMAccountName\" for Active Directory")
+	flagSet.String("ldap-email-attribute", "mail", "the attribute holding a user's email address")
+	flagSet.String("ldap-group-attribute", "memberOf", "the attribute listing the groups a user is a member of")
+	flagSet.StringSlice("ldap-group", []string{}, "restrict logins to members of this LDAP group, given as a DN or CN (may be given multiple times)")
+	flagSet.Bool("ldap-insecure-plaintext", false, "don't start TLS on connections to ldap:// URLs, sending passwords in the clear")
+	flagSet.String("client-id", "", "the OAuth Client ID: ie: \"123456.apps.googleusercontent.com\"")
+	flagSet.String("client-secret", "", "the OAuth Client Secret")
+	flagSet.String("client-secret-file", "", "the file with OAuth Client Secret")
+	flagSet.String("authenticated-emails-file", "", "authenticate against emails via file (one per line)")
+	flagSet.StringSlice("feature-flag", []string{}, "enable a new behavior for a percentage of users, given as <name>=<percentage>, eg. strict_samesite=10 (may be given multiple times)")
+	flagSet.String("feature-flags-file", "", "a file of feature flags, one <name>=<percentage> per line, taking precedence over --feature-flag and reloaded when it changes")
+	flagSet.String("identity-map-file", "", "a file mapping the emails of users to the Unix user, uid and groups passed to legacy upstreams, one email:user:uid:group,group... per line")
+	flagSet.StringSlice("group-mapping", []string{}, "map a group the provider gives to the role name used in policies and upstream headers, in the form <group>=<role> (may be given multiple times)")
+	flagSet.Bool("group-mapping-drop-unmapped", false, "remove the groups that aren't mapped to a role by --group-mapping")
+	flagSet.String("htpasswd-file", "", "additionally authenticate against a htpasswd file. Entries must be created with \"htpasswd -s\" for SHA encryption or \"htpasswd -B\" for bcrypt encryption")
+	flagSet.Bool("display-htpasswd-form", true, "display username / password login form if an htpasswd file is provided")
+	flagSet.String("custom-templates-dir", "", "path to custom html templates")
+	flagSet.String("banner", "", "custom banner string. Use \"-\" to disable default banner.")
+	flagSet.String("footer", "", "custom footer string. Use \"-\" to disable default footer.")
+	flagSet.String("proxy-prefix", "/oauth2", "the url root path that this proxy should be nested under (e.g. /<oauth2>/sign_in)")
+	flagSet.String("ping-path", "/ping", "the ping endpoint that can be used for basic health checks")
+	flagSet.Bool("proxy-websockets", true, "enables WebSocket proxying")
+
+	flagSet.String("cookie-name", "_oauth2_proxy", "the name of the cookie that the oauth_proxy creates")
+	flagSet.String("cookie-secret", "", "the seed string for secure cookies (optionally base64 encoded)")
+	flagSet.StringSlice("cookie-domain", []string{}, "Optional cookie domains to force cookies to (ie: `.yourcompany.com`). The longest domain matching the request's host will be used (or the shortest cookie domain if there is no match).")
+	flagSet.String("cookie-path", "/", "an optional cookie path to force cookies to (ie: /poc/)*")
+	flagSet.Duration("cookie-expire", time.Duration(168)*time.Hour, "expire timeframe for cookie")
+	flagSet.Duration("cookie-refresh", time.Duration(0), "refresh the cookie after this duration; 0 to disable")
+	flagSet.Bool("cookie-secure", true, "set secure (HTTPS) cookie flag")
+	flagSet.Bool("cookie-httponly", true, "set HttpOnly cookie flag")
+	flagSet.String("cookie-samesite", "", "set SameSite cookie attribute (ie: \"lax\", \"strict\", \"none\", or \"\"). ")
+	flagSet.String("cookie-name-scope", "", "add a suffix unique to the request host or provider to the cookie name (ie: \"host\", \"provider\", or \"\")")
+	flagSet.StringSlice("cookie-host-name", []string{}, "override the cookie name for a host, in the form host=name (may be given multiple times)")
+	flagSet.StringSlice("cookie-handoff-host", []string{}, "a host the proxy is served at under another cookie domain, to also sign users in to after they sign in (may be given multiple times)")
+	flagSet.String("cookie-prefix", "", "add the __Secure- or __Host- prefix to cookie names (ie: \"secure\", \"host\", or \"\")")
+
+	flagSet.String("session-store-type", "cookie", "the session storage provider to use")
+	flagSet.Duration("session-idle-timeout", time.Duration(0), "invalidate sessions that haven't been used for this duration; 0 to disable")
+	flagSet.Bool("session-identity-only", false, "never save the provider's access, ID or refresh tokens in sessions, keeping only the user's identity, with any session store")
+	flagSet.Int("max-user-sessions", 0, "the maximum number of concurrent sessions each user may have with the redis session store; 0 for no limit")
+	flagSet.String("user-session-limit-action", "evict", "what to do when a sign in would exceed --max-user-sessions: evict the user's oldest session (\"evict\") or reject the sign in (\"reject\")")
+	flagSet.Duration("session-cache-ttl", time.Duration(0), "cache sessions loaded from the redis session store in memory for this duration, invalidated across instances with redis pub/sub; 0 to disable")
+	flagSet.Int("session-cache-size", 10000, "the most sessions to cache in memory with --session-cache-ttl")
+	flagSet.Duration("session-gc-interval", time.Duration(0), "collect the garbage of the redis session store this often, giving sessions held without an expiry one and removing stale entries of users' session indexes; 0 to disable")
+	flagSet.Bool("user-sessions-page", false, "serve a page at /oauth2/sessions on which users can list and revoke their sessions; requires the redis session store")
+	flagSet.String("redis-connection-url", "", "URL of redis server for redis session storage (eg: redis://HOST[:PORT])")
+	flagSet.Bool("redis-use-sentinel", false, "Connect to redis via sentinels. Must set --redis-sentinel-master-name and --redis-sentinel-connection-urls to use this feature")
+	flagSet.String("redis-sentinel-master-name", "", "Redis sentinel master name. Used in conjunction with --redis-use-sentinel")
+	flagSet.String("redis-ca-path", "", "Redis custom CA path")
+	flagSet.Bool("redis-insecure-skip-tls-verify", false, "Use insecure TLS connection to redis")
+	flagSet.StringSlice("redis-sentinel-connection-urls", []string{}, "List of Redis sentinel connection URLs (eg redis://HOST[:PORT]). Used in conjunction with --redis-use-sentinel")
+	flagSet.Bool("redis-use-cluster", false, "Connect to redis cluster. Must set --redis-cluster-connection-urls to use this feature")
+	flagSet.StringSlice("redis-cluster-connection-urls", []string{}, "List of Redis cluster connection URLs (eg redis://HOST[:PORT]). Used in conjunction with --redis-use-cluster")
+
+	flagSet.String("logging-filename", "", "File to log requests to, empty for stdout")
+	flagSet.Int("logging-max-size", 100, "Maximum size in megabytes of the log file before rotation")
+	flagSet.Int("logging-max-age", 7, "Maximum number of days to retain old log files")
+	flagSet.Int("logging-max-backups", 0, "Maximum number of old log files to retain; 0 to disable")
+	flagSet.Bool("logging-local-time", true, "If the time in log files and backup filenames are local or UTC time")
+	flagSet.Bool("logging-compress", false, "Should rotated log files be compressed using gzip")
+	flagSet.Duration("logging-rotate-interval", time.Duration(0), "Rotate the log file at this interval as well as when it reaches logging-max-size; 0 to disable")
+	flagSet.Int("logging-buffer-size", 0, "Number of log lines to buffer and write asynchronously; lines are dropped when the buffer is full. 0 writes synchronously")
+
+	flagSet.Bool("standard-logging", true, "Log standard runtime information")
+	flagSet.String("standard-logging-format", logger.DefaultStandardLoggingFormat, "Template for standard log lines")
+	flagSet.String("standard-logging-target", "", "Where to send standard log lines: syslog, syslog[+udp|+tcp|+unix]://<address> or journald; empty for the default logging output")
+
+	flagSet.Bool("request-logging", true, "Log HTTP requests")
+	flagSet.String("request-logging-format", logger.DefaultRequestLoggingFormat, "Template for HTTP request log lines")
+	flagSet.String("request-logging-target", "", "Where to send HTTP request log lines: syslog, syslog[+udp|+tcp|+unix]://<address> or journald; empty for the default logging output")
+	flagSet.Float64("request-logging-sample-rate", 1, "Fraction of requests with a status below 400 to log (eg. 0.01 for 1%); 4xx and 5xx responses are always logged")
+	flagSet.Bool("logging-mask-emails", false, "Mask the local part of email addresses logged as usernames, eg. j***@example.com")
+	flagSet.String("logging-user-privacy", "", "Obfuscate the users in request and auth logs: 'truncate' to keep their first character, eg. j***@example.com, or 'hash' to log a keyed hash of them; empty to log them as they are")
+	flagSet.String("logging-user-hash-key", "", "the key users and sessions are hashed with in logs (defaults to the cookie secret)")
+	flagSet.StringSlice("logging-redact-query-param", []string{}, "Remove query parameters whose names match this regex from request logs (may be given multiple times)")
+	flagSet.String("exclude-logging-paths", "", "Exclude logging requests to paths (eg: '/path1,/path2,/path3')")
+	flagSet.Bool("silence-ping-logging", false, "Disable logging of requests to ping endpoint")
+
+	flagSet.Bool("auth-logging", true, "Log authentication attempts")
+	flagSet.String("auth-logging-format", logger.DefaultAuthLoggingFormat, "Template for authentication log lines")
+	flagSet.String("auth-logging-target", "", "Where to send authentication log lines: syslog, syslog[+udp|+tcp|+unix]://<address> or journald; empty for the default logging output")
+	flagSet.String("auth-logging-filename", "", "File to write authentication log lines to, rotated with the logging-max-* and logging-rotate-interval settings; empty for the default logging output")
+	flagSet.Bool("auth-logging-hash-chain", false, "End each authentication log record with a keyed hash of the record before it, so that changes to the log can be detected with the verify-auth-log command")
+	flagSet.String("auth-logging-hash-key", "", "the key authentication log records are chained with (defaults to the cookie secret)")
+	flagSet.String("auth-logging-encryption-key", "", "AES key (16, 24 or 32 bytes, optionally base64 encoded) to encrypt rotated auth-logging-filename files with")
+	flagSet.String("geoip-country-db", "", "path to a MaxMind GeoIP2/GeoLite2 Country or City database used to add the client's country to auth logs")
+	flagSet.String("geoip-asn-db", "", "path to a MaxMind GeoIP2/GeoLite2 ASN database used to add the client's ASN to auth logs")
+
+	flagSet.String("provider", "google", "OAuth provider")
+	flagSet.String("provider-display-name", "", "Provider display name")
+	flagSet.String("oidc-issuer-url", "", "OpenID Connect issuer URL (ie: https://accounts.google.com). May contain {tenant} to serve many tenants, each with its own issuer")
+	flagSet.String("oidc-tenant-source", "host", "where the tenant of a templated oidc-issuer-url is taken from: the first label of the request 'host' or the 'tenant' query parameter when signing in ('query')")
+	flagSet.String("oidc-tenants-file", "", "JSON file of the tenants allowed with a templated oidc-issuer-url and their client credentials")
+	flagSet.Bool("insecure-oidc-allow-unverified-email", false, "Don't fail if an email address in an id_token is not verified")
+	flagSet.Bool("insecure-oidc-skip-issuer-verification", false, "Do not verify if issuer matches OIDC discovery URL")
+	flagSet.Bool("insecure-oidc-skip-audience-verification", false, "Do not verify that the ID token audience matches the client ID (or the audience of an extra JWT issuer)")
+	flagSet.Duration("oidc-allowed-clock-skew", time.Duration(0), "Allowed clock skew between the proxy and the issuer when checking the expiry of ID tokens")
+	flagSet.String("oidc-refresh-validation", "verify", "how ID tokens issued when refreshing sessions are validated: \"verify\" their signature, issuer, audience and expiry, or \"strict\" to also check they were issued for the same sign in as the session's")
+	flagSet.Bool("skip-oidc-discovery", false, "Skip OIDC discovery and use manually supplied Endpoints")
+	flagSet.String("oidc-jwks-url", "", "OpenID Connect JWKS URL (ie: https://www.googleapis.com/oauth2/v3/certs)")
+	flagSet.String("login-url", "", "Authentication endpoint")
+	flagSet.String("redeem-url", "", "Token redemption endpoint")
+	flagSet.StringSlice("redeem-client-header", []string{}, "a header of the client's request to pass to the provider when redeeming or refreshing tokens (may be given multiple times)")
+	flagSet.String("profile-url", "", "Profile access endpoint")
+	flagSet.String("resource", "", "The resource that is protected (Azure AD only)")
+	flagSet.String("validate-url", "", "Access token validation endpoint")
+	flagSet.String("scope", "", "OAuth scope specification")
+	flagSet.String("prompt", "", "OIDC prompt")
+	flagSet.String("approval-prompt", "force", "OAuth approval_prompt")
+
+	flagSet.String("signature-key", "", "GAP-Signature request signature key (algorithm:secretkey)")
+	flagSet.String("acr-values", "", "acr values string:  optional")
+	flagSet.String("login-hint", "", "the login_hint passed to the provider when the sign in request doesn't give one, eg. to preselect an account")
+	flagSet.String("domain-hint", "", "the domain_hint passed to the provider when the sign in request doesn't give one, eg. to go straight to a tenant's sign in")
+	flagSet.String("jwt-key", "", "private key in PEM format used to sign JWT, so that you can say something like -jwt-key=\"${OAUTH2_PROXY_JWT_KEY}\": required by login.gov")
+	flagSet.String("jwt-key-file", "", "path to the private key file in PEM format used to sign the JWT so that you can say something like -jwt-key-file=/etc/ssl/private/jwt_signing_key.pem: required by login.gov")
+	flagSet.String("pubjwk-url", "", "JWK pubkey access endpoint: required by login.gov")
+	flagSet.Bool("gcp-healthchecks", false, "Enable GCP/GKE healthcheck endpoints")
+
+	flagSet.String("user-id-claim", "email", "which claim contains the user ID")
+
+	return flagSet
+}
@@ -1,6 +1,6 @@
 module github.com/oauth2-proxy/oauth2-proxy
 
-go 1.14
+go 1.16
 
 require (
 	github.com/alicebob/miniredis/v2 v2.11.2
@@ -15,6 +15,7 @@ require (
 	github.com/mitchellh/mapstructure v1.1.2
 	github.com/onsi/ginkgo v1.12.0
 	github.com/onsi/gomega v1.9.0
+	github.com/oschwald/maxminddb-golang v1.6.0
 	github.com/pquerna/cachecontrol v0.0.0-20180517163645-1555304b9b35 // indirect
 	github.com/spf13/pflag v1.0.3
 	github.com/spf13/viper v1.6.3
@@ -23,6 +24,7 @@ require (
 	golang.org/x/crypto v0.0.0-20190308221718-c2843e01d9a2
 	golang.org/x/net v0.0.0-20190923162816-aa69164e4478
 	golang.org/x/oauth2 v0.0.0-20200107190931-bf48bf16ab8d
+	golang.org/x/sys v0.0.0-20191224085550-c709ea063b76
 	google.golang.org/api v0.20.0
 	gopkg.in/natefinch/lumberjack.v2 v2.0.0
 	gopkg.in/square/go-jose.v2 v2.4.1
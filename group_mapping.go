@@ -0,0 +1,75 @@
+package oauth2proxy
+
+import (
+	"fmt"
+	"strings"
+
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+)
+
+// groupMapping translates the group identifiers providers give, such as
+// Azure object IDs, Google group emails or GitHub team slugs, to the role
+// names used in policies and upstream headers
+type groupMapping struct {
+	// roles maps the lower cased provider groups to their roles
+	roles map[string][]string
+	// known are the role names, which are kept as they are so that mapping
+	// a session again, eg. after it's refreshed, changes nothing
+	known map[string]bool
+	// dropUnmapped removes the groups that aren't mapped to a role
+	dropUnmapped bool
+}
+
+// parseGroupMapping parses mappings of the form group=role. The group is
+// split from the role at the last "=", so that groups such as LDAP DNs can
+// be mapped, and matched ignoring case. Returns nil when nothing is mapped.
+func parseGroupMapping(mappings []string, dropUnmapped bool) (*groupMapping, error) {
+	if len(mappings) == 0 {
+		if dropUnmapped {
+			return nil, fmt.Errorf("group_mapping_drop_unmapped requires group_mapping")
+		}
+		return nil, nil
+	}
+	m := &groupMapping{roles: map[string][]string{}, known: map[string]bool{}, dropUnmapped: dropUnmapped}
+	for _, mapping := range mappings {
+		i := strings.LastIndex(mapping, "=")
+		if i < 1 || i == len(mapping)-1 {
+			return nil, fmt.Errorf("group_mapping (%s) must be of the form <group>=<role>", mapping)
+		}
+		group, role := strings.ToLower(mapping[:i]), mapping[i+1:]
+		m.roles[group] = append(m.roles[group], role)
+		m.known[role] = true
+	}
+	for role := range m.known {
+		if _, ok := m.roles[strings.ToLower(role)]; ok {
+			return nil, fmt.Errorf("group_mapping role %s must not also be mapped as a group", role)
+		}
+	}
+	return m, nil
+}
+
+// apply replaces the session's groups with the roles they're mapped to,
+// keeping the groups that aren't mapped unless they're dropped
+func (m *groupMapping) apply(session *sessionsapi.SessionState) {
+	if m == nil || session == nil || len(session.Groups) == 0 {
+		return
+	}
+	seen := map[string]bool{}
+	groups := make([]string, 0, len(session.Groups))
+	add := func(group string) {
+		if !seen[group] {
+			seen[group] = true
+			groups = append(groups, group)
+		}
+	}
+	for _, group := range session.Groups {
+		if roles, ok := m.roles[strings.ToLower(group)]; ok {
+			for _, role := range roles {
+				add(role)
+			}
+		} else if m.known[group] || !m.dropUnmapped {
+			add(group)
+		}
+	}
+	session.Groups = groups
+}
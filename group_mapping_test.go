@@ -0,0 +1,79 @@
+package oauth2proxy
+
+import (
+	"testing"
+
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGroupMapping(t *testing.T) {
+	m, err := parseGroupMapping([]string{
+		"0b9d5b1e-4d3c-4f4a-9c51-2a3b4c5d6e7f=admin",
+		"Admins@example.com=admin",
+		"acme:platform=engineering",
+		"acme:platform=oncall",
+		"cn=ops,ou=groups,dc=example,dc=com=oncall",
+	}, false)
+	require.NoError(t, err)
+
+	session := &sessionsapi.SessionState{Groups: []string{
+		"0B9D5B1E-4D3C-4F4A-9C51-2A3B4C5D6E7F",
+		"admins@example.com",
+		"acme:platform",
+		"CN=ops,OU=groups,DC=example,DC=com",
+		"acme:marketing",
+	}}
+	m.apply(session)
+	assert.Equal(t, []string{"admin", "engineering", "oncall", "acme:marketing"}, session.Groups)
+
+	m.dropUnmapped = true
+	m.apply(session)
+	assert.Equal(t, []string{"admin", "engineering", "oncall"}, session.Groups)
+
+	var none *groupMapping
+	session = &sessionsapi.SessionState{Groups: []string{"acme:platform"}}
+	none.apply(session)
+	assert.Equal(t, []string{"acme:platform"}, session.Groups)
+}
+
+func TestGroupMappingOptions(t *testing.T) {
+	o := testOptions()
+	o.GroupMappings = []string{"acme:platform=engineering"}
+	require.NoError(t, o.Validate())
+	assert.NotNil(t, o.groupMapping)
+
+	tests := map[string]struct {
+		mappings     []string
+		dropUnmapped bool
+		msg          string
+	}{
+		"invalid": {
+			mappings: []string{"acme:platform"},
+			msg:      "group_mapping (acme:platform) must be of the form <group>=<role>",
+		},
+		"no role": {
+			mappings: []string{"acme:platform="},
+			msg:      "group_mapping (acme:platform=) must be of the form <group>=<role>",
+		},
+		"role mapped as a group": {
+			mappings: []string{"acme:platform=engineering", "Engineering=staff"},
+			msg:      "group_mapping role engineering must not also be mapped as a group",
+		},
+		"drop without mappings": {
+			dropUnmapped: true,
+			msg:          "group_mapping_drop_unmapped requires group_mapping",
+		},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			o := testOptions()
+			o.GroupMappings = test.mappings
+			o.GroupMappingDropUnmapped = test.dropUnmapped
+			err := o.Validate()
+			assert.NotEqual(t, nil, err)
+			assert.Equal(t, errorMsg([]string{test.msg}), err.Error())
+		})
+	}
+}
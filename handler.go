@@ -0,0 +1,190 @@
+package oauth2proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/clock"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/logger"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/requests"
+	"github.com/oauth2-proxy/oauth2-proxy/providers"
+)
+
+// Option replaces a component of the OAuthProxy constructed by New, so that
+// embedders can share their own instances and tests can substitute fakes
+type Option func(*components)
+
+// components are the instances given as Options, or nil to use the ones
+// configured by the options
+type components struct {
+	sessionStore sessionsapi.SessionStore
+	provider     providers.Provider
+	httpClient   *http.Client
+	clock        clock.Clock
+}
+
+// WithSessionStore replaces the session store configured by the options
+func WithSessionStore(store sessionsapi.SessionStore) Option {
+	return func(c *components) {
+		c.sessionStore = store
+	}
+}
+
+// WithProvider replaces the provider configured by the options. The options
+// must still configure a valid provider.
+func WithProvider(provider providers.Provider) Option {
+	return func(c *components) {
+		c.provider = provider
+	}
+}
+
+// WithHTTPClient sets the client the proxy's requests to the provider are
+// sent with, when checking it at startup and while serving requests, rather
+// than http.DefaultClient
+func WithHTTPClient(client *http.Client) Option {
+	return func(c *components) {
+		c.httpClient = client
+	}
+}
+
+// WithClock sets the clock the proxy checks its own cookies, tokens, idle
+// sessions and access windows against, rather than the clock package's. The
+// session store and provider configured by the options still use the clock
+// package's, as does the expiry of the provider's tokens.
+func WithClock(clk clock.Clock) Option {
+	return func(c *components) {
+		c.clock = clk
+	}
+}
+
+// New validates the options given and constructs a fully configured
+// OAuthProxy from them. This allows the proxy to be embedded within another
+// Go HTTP server rather than being run as a separate binary.
+func New(opts *Options, options ...Option) (*OAuthProxy, error) {
+	var c components
+	for _, option := range options {
+		option(&c)
+	}
+
+	err := opts.Validate()
+	if err != nil {
+		return nil, err
+	}
+	if c.sessionStore != nil {
+		opts.sessionStore = c.sessionStore
+	}
+	if c.provider != nil {
+		opts.provider = c.provider
+	}
+	ctx := context.Background()
+	if c.httpClient != nil {
+		ctx = requests.WithHTTPClient(ctx, c.httpClient)
+	}
+	if err := checkProviderAtStartup(ctx, opts); err != nil {
+		return nil, err
+	}
+
+	validator, groupValidator := NewValidators(opts.EmailDomains, opts.AuthenticatedEmailsFile)
+	oauthproxy, err := NewOAuthProxy(opts, validator)
+	if err != nil {
+		return nil, err
+	}
+	oauthproxy.GroupValidator = groupValidator
+	oauthproxy.httpClient = c.httpClient
+	oauthproxy.clock = c.clock
+
+	if len(opts.Banner) >= 1 {
+		if opts.Banner == "-" {
+			oauthproxy.SignInMessage = ""
+		} else {
+			oauthproxy.SignInMessage = opts.Banner
+		}
+	} else if len(opts.EmailDomains) != 0 && opts.AuthenticatedEmailsFile == "" {
+		if len(opts.EmailDomains) > 1 {
+			oauthproxy.SignInMessage = fmt.Sprintf("Authenticate using one of the following domains: %v", strings.Join(opts.EmailDomains, ", "))
+		} else if opts.EmailDomains[0] != "*" {
+			oauthproxy.SignInMessage = fmt.Sprintf("Authenticate using %v", opts.EmailDomains[0])
+		}
+	}
+
+	if opts.HtpasswdFile != "" {
+		logger.Printf("using htpasswd file %s", opts.HtpasswdFile)
+		oauthproxy.HtpasswdFile, err = NewHtpasswdFromFile(opts.HtpasswdFile)
+		oauthproxy.DisplayHtpasswdForm = opts.DisplayHtpasswdForm
+		if err != nil {
+			return nil, fmt.Errorf("unable to open %s %s", opts.HtpasswdFile, err)
+		}
+	}
+
+	if opts.identityMap != nil {
+		logger.Printf("using identity map file %s", opts.IdentityMapFile)
+		opts.identityMap.watch()
+	}
+	if opts.featureFlags != nil && opts.FeatureFlagsFile != "" {
+		logger.Printf("using feature flags file %s", opts.FeatureFlagsFile)
+		opts.featureFlags.watch()
+	}
+
+	oauthproxy.handler = newHandlerChain(opts).Then(oauthproxy)
+	return oauthproxy, nil
+}
+
+// NewHandler validates the options given and returns the http.Handler
+// serving the proxy, including its logging and health check middlewares
+func NewHandler(opts *Options, options ...Option) (http.Handler, error) {
+	oauthproxy, err := New(opts, options...)
+	if err != nil {
+		return nil, err
+	}
+	return oauthproxy.Handler(), nil
+}
+
+// newHandlerChain creates the chain of middlewares that are run before a
+// request reaches the OAuthProxy
+func newHandlerChain(opts *Options) middleware.Chain {
+	chain := middleware.NewChain(func(h http.Handler) http.Handler {
+		return redirectToHTTPS(opts, h)
+	})
+	if opts.GCPHealthChecks {
+		chain = chain.Append(gcpHealthcheck)
+	}
+	return chain.Append(
+		middleware.NewScope(),
+		newRealClientIPMiddleware(opts.realClientIPParser),
+		newLoggingHandler(opts),
+	)
+}
+
+// Handler returns the http.Handler serving the proxy. When the OAuthProxy
+// was constructed with New, this includes the logging and health check
+// middlewares.
+func (p *OAuthProxy) Handler() http.Handler {
+	if p.handler == nil {
+		return p
+	}
+	return p.handler
+}
+
+// LoadSession loads the authenticated session of the user making the
+// request, refreshing it if required. ErrNeedsLogin is returned when the user
+// has no valid session. Set-Cookie headers may be set on the response as a
+// side-effect of calling this method.
+func (p *OAuthProxy) LoadSession(rw http.ResponseWriter, req *http.Request) (*sessionsapi.SessionState, error) {
+	return p.getAuthenticatedSession(rw, req)
+}
+
+// Authenticated wraps a handler so that it is only called for users with a
+// valid session, allowing custom routes to be protected by the proxy. Users
+// without a session are sent to the sign in flow. The session is available
+// to the handler through middleware.GetRequestScope.
+func (p *OAuthProxy) Authenticated(h http.Handler) http.Handler {
+	return middleware.NewChain(
+		middleware.NewScope(),
+		p.loadSession,
+		p.authorize,
+	).Then(h)
+}
@@ -0,0 +1,77 @@
+package oauth2proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/clock"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/requests"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// redirectTransport sends every request to the server at target
+type redirectTransport struct {
+	target *url.URL
+	sent   int
+}
+
+func (t *redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.sent++
+	req = req.Clone(req.Context())
+	req.URL.Scheme, req.URL.Host = t.target.Scheme, t.target.Host
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestNewWithComponents(t *testing.T) {
+	providerURL, _ := url.Parse("http://provider.example.com")
+	provider := NewTestProvider(providerURL, "jane@example.com")
+	mock := clock.NewMock(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+
+	p, err := New(testOptions(),
+		WithSessionStore(unavailableSessionStore{}),
+		WithProvider(provider),
+		WithClock(mock))
+	require.NoError(t, err)
+	assert.Equal(t, provider, p.provider)
+
+	rw := httptest.NewRecorder()
+	p.ServeHTTP(rw, httptest.NewRequest("GET", p.AuthOnlyPath, nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+
+	// the CSRF cookie set when signing in expires by the proxy's clock
+	rw = httptest.NewRecorder()
+	p.ServeHTTP(rw, httptest.NewRequest("GET", p.OAuthStartPath, nil))
+	require.Equal(t, http.StatusFound, rw.Code)
+	var csrf *http.Cookie
+	for _, c := range rw.Result().Cookies() {
+		if c.Name == p.CSRFCookieName {
+			csrf = c
+		}
+	}
+	require.NotNil(t, csrf)
+	assert.Equal(t, mock.Now().Add(p.CookieExpire).Unix(), csrf.Expires.Unix())
+}
+
+func TestNewWithHTTPClient(t *testing.T) {
+	server := newProviderCheckServer(t)
+	defer server.Close()
+	target, _ := url.Parse(server.URL)
+	transport := &redirectTransport{target: target}
+	client := &http.Client{Transport: transport}
+
+	// the provider is only reachable through the client
+	opts := testOptions()
+	opts.LoginURL = "http://provider.invalid/login"
+	opts.RedeemURL = "http://provider.invalid/token"
+	opts.ProviderStartupCheck = providerCheckFail
+	p, err := New(opts, WithHTTPClient(client))
+	require.NoError(t, err)
+	assert.Equal(t, 2, transport.sent)
+
+	req := p.withHTTPClient(httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, client, requests.HTTPClient(req.Context()))
+}
@@ -0,0 +1,141 @@
+package oauth2proxy
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/logger"
+)
+
+// headerTemplateFuncs are the functions available to header templates, in
+// addition to the text/template builtins
+var headerTemplateFuncs = template.FuncMap{
+	"lower": strings.ToLower,
+	"upper": strings.ToUpper,
+	"trim":  strings.TrimSpace,
+	"join": func(sep string, values interface{}) string {
+		switch values := values.(type) {
+		case []string:
+			return strings.Join(values, sep)
+		case []interface{}:
+			s := make([]string, 0, len(values))
+			for _, v := range values {
+				s = append(s, fmt.Sprint(v))
+			}
+			return strings.Join(s, sep)
+		case nil:
+			return ""
+		default:
+			return fmt.Sprint(values)
+		}
+	},
+}
+
+// headerTemplate sets a header from a template over the session
+type headerTemplate struct {
+	name     string
+	template *template.Template
+}
+
+// headerTemplateData is the data header templates are evaluated with
+type headerTemplateData struct {
+	User              string
+	Email             string
+	PreferredUsername string
+	Groups            []string
+	Impersonator      string
+	ACR               string
+	AMR               []string
+	// UnixUser, UnixUID and UnixGroups are the Unix identity the user is
+	// mapped to by the identity map file, if any
+	UnixUser   string
+	UnixUID    string
+	UnixGroups []string
+	// Claims are the claims of the session's ID token
+	Claims map[string]interface{}
+}
+
+// parseHeaderTemplate parses a header template of the form <name>=<template>
+func parseHeaderTemplate(s string) (*headerTemplate, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || strings.ContainsAny(parts[0], " \t\r\n:") {
+		return nil, fmt.Errorf("header_template (%s) must be of the form <header>=<template>", s)
+	}
+	name := http.CanonicalHeaderKey(parts[0])
+	t, err := template.New(name).Funcs(headerTemplateFuncs).Option("missingkey=zero").Parse(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("error parsing header_template %s: %v", name, err)
+	}
+	return &headerTemplate{name: name, template: t}, nil
+}
+
+// newHeaderTemplateData returns the data to evaluate header templates with
+// for the session. The ID token was verified when the session was created,
+// so its claims are only decoded.
+func newHeaderTemplateData(session *sessionsapi.SessionState) *headerTemplateData {
+	data := &headerTemplateData{
+		User:              session.User,
+		Email:             session.Email,
+		PreferredUsername: session.PreferredUsername,
+		Groups:            session.Groups,
+		Impersonator:      session.Impersonator,
+		ACR:               session.ACR,
+		AMR:               session.AMR,
+		Claims:            map[string]interface{}{},
+	}
+	if parts := strings.Split(session.IDToken, "."); len(parts) == 3 {
+		payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+		if err == nil {
+			err = json.Unmarshal(payload, &data.Claims)
+		}
+		if err != nil {
+			logger.Printf("Error decoding id_token claims for header templates: %v", err)
+		}
+	}
+	return data
+}
+
+// execute evaluates the template, returning "" when it fails. Missing claims
+// are rendered as empty strings, and line breaks are removed as they can't
+// be sent in headers.
+func (h *headerTemplate) execute(data *headerTemplateData) string {
+	var b strings.Builder
+	if err := h.template.Execute(&b, data); err != nil {
+		logger.Printf("Error evaluating header template %s: %v", h.name, err)
+		return ""
+	}
+	value := strings.ReplaceAll(b.String(), "<no value>", "")
+	return strings.TrimSpace(strings.NewReplacer("\r", "", "\n", "").Replace(value))
+}
+
+// addTemplatedHeaders sets the templated headers on the upstream request,
+// and on the response too when X-Auth-Request headers are set. Headers that
+// evaluate to "" are removed so that they can't be set by clients.
+func (p *OAuthProxy) addTemplatedHeaders(rw http.ResponseWriter, req *http.Request, session *sessionsapi.SessionState) {
+	if len(p.headerTemplates) == 0 {
+		return
+	}
+	data := newHeaderTemplateData(session)
+	if identity := p.identityMap.lookup(session); identity != nil {
+		data.UnixUser, data.UnixUID, data.UnixGroups = identity.user, identity.uid, identity.groups
+	}
+	for _, h := range p.headerTemplates {
+		value := h.execute(data)
+		if value == "" {
+			req.Header.Del(h.name)
+			if p.SetXAuthRequest {
+				rw.Header().Del(h.name)
+			}
+			continue
+		}
+		req.Header.Set(h.name, value)
+		if p.SetXAuthRequest {
+			rw.Header().Set(h.name, value)
+		}
+	}
+}
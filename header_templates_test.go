@@ -0,0 +1,67 @@
+package oauth2proxy
+
+import (
+	"encoding/base64"
+	"net/http/httptest"
+	"testing"
+
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseHeaderTemplate(t *testing.T) {
+	h, err := parseHeaderTemplate("x-user={{.Email | lower}}")
+	require.NoError(t, err)
+	assert.Equal(t, "X-User", h.name)
+
+	for _, s := range []string{"X-User", "={{.Email}}", "X User={{.Email}}", "X-User={{.Email"} {
+		_, err := parseHeaderTemplate(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestHeaderTemplates(t *testing.T) {
+	var templates []*headerTemplate
+	for _, s := range []string{
+		"X-User={{.Email | lower}}",
+		`X-Tenant={{index .Claims "tenant"}}`,
+		`X-Groups={{join "," .Groups}}`,
+		`X-Roles={{join " " .Claims.roles}}`,
+		`X-Missing={{.Claims.missing}}`,
+		`X-Broken={{.Email.Nope}}`,
+	} {
+		h, err := parseHeaderTemplate(s)
+		require.NoError(t, err)
+		templates = append(templates, h)
+	}
+	p := &OAuthProxy{headerTemplates: templates, SetXAuthRequest: true}
+
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"tenant": "acme", "roles": ["admin", "billing"]}`))
+	session := &sessionsapi.SessionState{
+		Email:   "Jane@Example.com",
+		Groups:  []string{"admins", "devs"},
+		IDToken: "e30." + payload + ".sig",
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Missing", "spoofed")
+	req.Header.Set("X-Broken", "spoofed")
+	rw := httptest.NewRecorder()
+	p.addTemplatedHeaders(rw, req, session)
+
+	assert.Equal(t, "jane@example.com", req.Header.Get("X-User"))
+	assert.Equal(t, "acme", req.Header.Get("X-Tenant"))
+	assert.Equal(t, "admins,devs", req.Header.Get("X-Groups"))
+	assert.Equal(t, "admin billing", req.Header.Get("X-Roles"))
+	assert.Empty(t, req.Header.Values("X-Missing"))
+	assert.Empty(t, req.Header.Values("X-Broken"))
+	assert.Equal(t, "jane@example.com", rw.Header().Get("X-User"))
+
+	// Sessions without an ID token have no claims
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Tenant", "spoofed")
+	p.addTemplatedHeaders(httptest.NewRecorder(), req, &sessionsapi.SessionState{Email: "jane@example.com"})
+	assert.Empty(t, req.Header.Values("X-Tenant"))
+	assert.Equal(t, "jane@example.com", req.Header.Get("X-User"))
+}
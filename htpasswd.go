@@ -1,4 +1,4 @@
-package main
+package oauth2proxy
 
 import (
 	"crypto/sha1"
@@ -7,6 +7,7 @@ import (
 	"io"
 	"os"
 
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/encryption"
 	"github.com/oauth2-proxy/oauth2-proxy/pkg/logger"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -59,7 +60,7 @@ func (h *HtpasswdFile) Validate(user string, password string) bool {
 		shaValue := realPassword[5:]
 		d := sha1.New()
 		d.Write([]byte(password))
-		return shaValue == base64.StdEncoding.EncodeToString(d.Sum(nil))
+		return encryption.SecureCompare(shaValue, base64.StdEncoding.EncodeToString(d.Sum(nil)))
 	}
 
 	bcryptPrefix := realPassword[:4]
@@ -1,12 +1,14 @@
-package main
+package oauth2proxy
 
 import (
 	"context"
 	"crypto/tls"
 	"errors"
+	"io"
 	"net"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/oauth2-proxy/oauth2-proxy/pkg/logger"
@@ -17,10 +19,55 @@ type Server struct {
 	Handler http.Handler
 	Opts    *Options
 	stop    chan struct{} // channel for waiting shutdown
+	ready   chan struct{} // closed once requests are being served
+	once    sync.Once
+
+	// activated are the sockets passed by systemd socket activation
+	activated map[string]net.Listener
+}
+
+// NewServer creates a Server serving the handler on the addresses configured
+// in the options
+func NewServer(opts *Options, handler http.Handler) *Server {
+	return &Server{
+		Handler: handler,
+		Opts:    opts,
+		stop:    make(chan struct{}, 1),
+		ready:   make(chan struct{}),
+	}
+}
+
+// Ready returns a channel that is closed once the server is serving requests
+func (s *Server) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// Stop notifies the server that it should shut down gracefully
+func (s *Server) Stop() {
+	s.stop <- struct{}{}
 }
 
 // ListenAndServe will serve traffic on HTTP or HTTPS depending on TLS options
 func (s *Server) ListenAndServe() {
+	activated, err := systemdListeners()
+	if err != nil {
+		logger.Fatalf("FATAL: %s", err)
+	}
+	s.activated = activated
+	// logs buffered by --logging-buffer-size are written before exiting
+	defer logger.Flush()
+	defer closeSessionStore(s.Opts)
+
+	if s.Opts.DebugAddress != "" {
+		debug := s.serveDebug()
+		defer debug.Close()
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	warmKeySets(s.Opts, done)
+	collectSessionGarbage(s.Opts, done)
+
 	if s.Opts.TLSKeyFile != "" || s.Opts.TLSCertFile != "" {
 		s.ServeHTTPS()
 	} else {
@@ -28,6 +75,16 @@ func (s *Server) ListenAndServe() {
 	}
 }
 
+// closeSessionStore stops the session store's background work, eg. watching
+// for the invalidations of cached sessions, once the server has shut down
+func closeSessionStore(opts *Options) {
+	if closer, ok := opts.sessionStore.(io.Closer); ok {
+		if err := closer.Close(); err != nil {
+			logger.Printf("Error closing session store: %v", err)
+		}
+	}
+}
+
 // Used with gcpHealthcheck()
 const userAgentHeader = "User-Agent"
 const googleHealthCheckUserAgent = "GoogleHC/1.0"
@@ -88,11 +145,11 @@ func (s *Server) ServeHTTP() {
 	slice := strings.SplitN(HTTPAddress, "//", 2)
 	listenAddr := slice[len(slice)-1]
 
-	listener, err := net.Listen(networkType, listenAddr)
+	listener, err := s.listen("http", networkType, listenAddr)
 	if err != nil {
 		logger.Fatalf("FATAL: listen (%s, %s) failed - %s", networkType, listenAddr, err)
 	}
-	logger.Printf("HTTP: listening on %s", listenAddr)
+	logger.Printf("HTTP: listening on %s", listener.Addr())
 	s.serve(listener)
 	logger.Printf("HTTP: closing %s", listener.Addr())
 }
@@ -102,7 +159,9 @@ func (s *Server) ServeHTTPS() {
 	addr := s.Opts.HTTPSAddress
 	config := &tls.Config{
 		MinVersion: tls.VersionTLS12,
-		MaxVersion: tls.VersionTLS12,
+	}
+	if s.Opts.tlsConfig != nil {
+		config = s.Opts.tlsConfig.Clone()
 	}
 	if config.NextProtos == nil {
 		config.NextProtos = []string{"http/1.1"}
@@ -114,18 +173,62 @@ func (s *Server) ServeHTTPS() {
 	if err != nil {
 		logger.Fatalf("FATAL: loading tls config (%s, %s) failed - %s", s.Opts.TLSCertFile, s.Opts.TLSKeyFile, err)
 	}
+	if s.Opts.TLSOCSPStapling {
+		done := make(chan struct{})
+		defer close(done)
+		if err := startOCSPStapling(config, done); err != nil {
+			logger.Fatalf("FATAL: stapling OCSP responses for %s failed - %s", s.Opts.TLSCertFile, err)
+		}
+	}
 
-	ln, err := net.Listen("tcp", addr)
+	ln, err := s.listen("https", "tcp", addr)
 	if err != nil {
 		logger.Fatalf("FATAL: listen (%s) failed - %s", addr, err)
 	}
 	logger.Printf("HTTPS: listening on %s", ln.Addr())
 
-	tlsListener := tls.NewListener(tcpKeepAliveListener{ln.(*net.TCPListener)}, config)
+	if tcp, ok := ln.(*net.TCPListener); ok {
+		ln = tcpKeepAliveListener{tcp}
+	}
+	tlsListener := tls.NewListener(ln, config)
 	s.serve(tlsListener)
 	logger.Printf("HTTPS: closing %s", tlsListener.Addr())
 }
 
+// listen returns the socket systemd passed for the listener with the given
+// name, or the only socket it passed whatever its name, or else listens on
+// the address
+func (s *Server) listen(name, network, addr string) (net.Listener, error) {
+	if ln, ok := s.activated[name]; ok {
+		return ln, nil
+	}
+	if len(s.activated) == 1 {
+		for _, ln := range s.activated {
+			return ln, nil
+		}
+	}
+	return net.Listen(network, addr)
+}
+
+// serveDebug starts serving the pprof and expvar handlers on the debug
+// address in the background
+func (s *Server) serveDebug() *http.Server {
+	ln, err := net.Listen("tcp", s.Opts.DebugAddress)
+	if err != nil {
+		logger.Fatalf("FATAL: listen (%s) failed - %s", s.Opts.DebugAddress, err)
+	}
+	logger.Printf("Debug: listening on %s", ln.Addr())
+
+	srv := &http.Server{Handler: newDebugHandler(s.Opts)}
+	go func() {
+		err := srv.Serve(ln)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Printf("ERROR: debug http.Serve() - %s", err)
+		}
+	}()
+	return srv
+}
+
 func (s *Server) serve(listener net.Listener) {
 	srv := &http.Server{Handler: s.Handler}
 
@@ -133,6 +236,9 @@ func (s *Server) serve(listener net.Listener) {
 	idleConnsClosed := make(chan struct{})
 	go func() {
 		<-s.stop // wait notification for stopping server
+		if err := systemdNotify("STOPPING=1"); err != nil {
+			logger.Printf("Error notifying systemd: %v", err)
+		}
 
 		// We received an interrupt signal, shut down.
 		if err := srv.Shutdown(context.Background()); err != nil {
@@ -142,6 +248,14 @@ func (s *Server) serve(listener net.Listener) {
 		close(idleConnsClosed)
 	}()
 
+	s.once.Do(func() {
+		if s.ready != nil {
+			close(s.ready)
+		}
+		if err := systemdNotify("READY=1"); err != nil {
+			logger.Printf("Error notifying systemd: %v", err)
+		}
+	})
 	err := srv.Serve(listener)
 	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		logger.Printf("ERROR: http.Serve() - %s", err)
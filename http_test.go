@@ -1,4 +1,4 @@
-package main
+package oauth2proxy
 
 import (
 	"net/http"
@@ -186,3 +186,23 @@ func TestGracefulShutdown(t *testing.T) {
 
 	assert.Len(t, stop, 0) // check if stop chan is empty
 }
+
+func TestDebugHandler(t *testing.T) {
+	h := newDebugHandler(testOptions())
+
+	rw := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/debug/vars", nil)
+	h.ServeHTTP(rw, r)
+	assert.Equal(t, 200, rw.Code)
+	assert.Contains(t, rw.Body.String(), "\"memstats\"")
+
+	rw = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "/debug/pprof/", nil)
+	h.ServeHTTP(rw, r)
+	assert.Equal(t, 200, rw.Code)
+
+	rw = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "/", nil)
+	h.ServeHTTP(rw, r)
+	assert.Equal(t, 404, rw.Code)
+}
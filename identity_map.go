@@ -0,0 +1,132 @@
+package oauth2proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/logger"
+)
+
+// unixIdentity is the legacy Unix identity a user is mapped to
+type unixIdentity struct {
+	user   string
+	uid    string
+	groups []string
+}
+
+// identityMap maps users to the Unix identities legacy upstreams expect,
+// from the identity map file
+type identityMap struct {
+	file       string
+	identities atomic.Value // map[string]*unixIdentity
+}
+
+// loadIdentityMap loads the identity map file. Each line maps the email of
+// a user to a Unix user, uid and groups, in the form
+// email:user:uid:group,group...; the uid and groups may be left empty.
+func loadIdentityMap(file string) (*identityMap, error) {
+	m := &identityMap{file: file}
+	if err := m.load(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *identityMap) load() error {
+	f, err := os.Open(m.file)
+	if err != nil {
+		return fmt.Errorf("error opening identity_map_file %s: %v", m.file, err)
+	}
+	defer f.Close()
+
+	identities := map[string]*unixIdentity{}
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ":")
+		if len(fields) < 2 || len(fields) > 4 || fields[0] == "" || fields[1] == "" {
+			return fmt.Errorf("identity_map_file %s line %d must be of the form email:user:uid:groups", m.file, n)
+		}
+		identity := &unixIdentity{user: fields[1]}
+		if len(fields) > 2 && fields[2] != "" {
+			if _, err := strconv.ParseUint(fields[2], 10, 32); err != nil {
+				return fmt.Errorf("identity_map_file %s line %d has an invalid uid (%s)", m.file, n, fields[2])
+			}
+			identity.uid = fields[2]
+		}
+		if len(fields) > 3 && fields[3] != "" {
+			identity.groups = strings.Split(fields[3], ",")
+		}
+		identities[strings.ToLower(fields[0])] = identity
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading identity_map_file %s: %v", m.file, err)
+	}
+	m.identities.Store(identities)
+	return nil
+}
+
+// watch reloads the identity map file whenever it changes, keeping the
+// mappings loaded before when it can't be loaded
+func (m *identityMap) watch() {
+	WatchForUpdates(m.file, nil, func() {
+		if err := m.load(); err != nil {
+			logger.Printf("%v", err)
+		}
+	})
+}
+
+// lookup returns the Unix identity the session's user is mapped to, by
+// their email or else their username, or nil if they aren't mapped
+func (m *identityMap) lookup(session *sessionsapi.SessionState) *unixIdentity {
+	if m == nil || session == nil {
+		return nil
+	}
+	identities := m.identities.Load().(map[string]*unixIdentity)
+	if session.Email != "" {
+		if identity, ok := identities[strings.ToLower(session.Email)]; ok {
+			return identity
+		}
+	}
+	return identities[strings.ToLower(session.User)]
+}
+
+// addIdentityHeaders sets the Unix identity the user is mapped to on the
+// upstream request, and on the response too when X-Auth-Request headers are
+// set. The headers are removed for users who aren't mapped, so that they
+// can't be set by clients.
+func (p *OAuthProxy) addIdentityHeaders(rw http.ResponseWriter, req *http.Request, session *sessionsapi.SessionState) {
+	if p.identityMap == nil {
+		return
+	}
+	identity := p.identityMap.lookup(session)
+	setIdentityHeaders(req.Header, "X-Forwarded-", identity)
+	if p.SetXAuthRequest {
+		setIdentityHeaders(rw.Header(), "X-Auth-Request-", identity)
+	}
+}
+
+func setIdentityHeaders(h http.Header, prefix string, identity *unixIdentity) {
+	h.Del(prefix + "Unix-User")
+	h.Del(prefix + "Unix-Uid")
+	h.Del(prefix + "Unix-Groups")
+	if identity == nil {
+		return
+	}
+	h.Set(prefix+"Unix-User", identity.user)
+	if identity.uid != "" {
+		h.Set(prefix+"Unix-Uid", identity.uid)
+	}
+	if len(identity.groups) > 0 {
+		h[prefix+"Unix-Groups"] = identity.groups
+	}
+}
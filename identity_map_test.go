@@ -0,0 +1,90 @@
+package oauth2proxy
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeIdentityMap(t *testing.T, contents string) string {
+	f, err := ioutil.TempFile("", "identity-map")
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = f.WriteString(contents)
+	require.NoError(t, err)
+	return f.Name()
+}
+
+func TestLoadIdentityMap(t *testing.T) {
+	file := writeIdentityMap(t, `# email:user:uid:groups
+jane@example.com:jdoe:1001:staff,wheel
+
+John@Example.com:jsmith
+svc-batch:batch::batch
+`)
+	defer os.Remove(file)
+
+	m, err := loadIdentityMap(file)
+	require.NoError(t, err)
+	assert.Equal(t, &unixIdentity{user: "jdoe", uid: "1001", groups: []string{"staff", "wheel"}},
+		m.lookup(&sessionsapi.SessionState{Email: "Jane@example.com"}))
+	assert.Equal(t, &unixIdentity{user: "jsmith"}, m.lookup(&sessionsapi.SessionState{User: "1234", Email: "john@example.com"}))
+	// users without an email are mapped by their username
+	assert.Equal(t, &unixIdentity{user: "batch", groups: []string{"batch"}}, m.lookup(&sessionsapi.SessionState{User: "svc-batch"}))
+	assert.Nil(t, m.lookup(&sessionsapi.SessionState{Email: "someone@example.com"}))
+
+	for contents, expected := range map[string]string{
+		"jane@example.com\n":              "line 1 must be of the form email:user:uid:groups",
+		"# ok\njane@example.com::1001\n":  "line 2 must be of the form email:user:uid:groups",
+		"jane@example.com:jdoe:jane\n":    "line 1 has an invalid uid (jane)",
+		"jane@example.com:jdoe:1:a:b:c\n": "line 1 must be of the form email:user:uid:groups",
+	} {
+		file := writeIdentityMap(t, contents)
+		_, err := loadIdentityMap(file)
+		os.Remove(file)
+		assert.EqualError(t, err, "identity_map_file "+file+" "+expected)
+	}
+}
+
+func TestIdentityHeaders(t *testing.T) {
+	file := writeIdentityMap(t, "jane@example.com:jdoe:1001:staff,wheel\n")
+	defer os.Remove(file)
+	m, err := loadIdentityMap(file)
+	require.NoError(t, err)
+	h, err := parseHeaderTemplate("X-Remote-User={{.UnixUser}}")
+	require.NoError(t, err)
+	p := &OAuthProxy{identityMap: m, SetXAuthRequest: true, headerTemplates: []*headerTemplate{h}}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	rw := httptest.NewRecorder()
+	p.addHeadersForProxying(rw, req, &sessionsapi.SessionState{Email: "jane@example.com"})
+	assert.Equal(t, "jdoe", req.Header.Get("X-Forwarded-Unix-User"))
+	assert.Equal(t, "1001", req.Header.Get("X-Forwarded-Unix-Uid"))
+	assert.Equal(t, []string{"staff", "wheel"}, req.Header.Values("X-Forwarded-Unix-Groups"))
+	assert.Equal(t, "jdoe", rw.Header().Get("X-Auth-Request-Unix-User"))
+	assert.Equal(t, "jdoe", req.Header.Get("X-Remote-User"))
+
+	// the headers of users who aren't mapped can't be spoofed
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Forwarded-Unix-User", "root")
+	req.Header.Set("X-Forwarded-Unix-Uid", "0")
+	rw = httptest.NewRecorder()
+	p.addHeadersForProxying(rw, req, &sessionsapi.SessionState{Email: "mallory@example.com"})
+	assert.Equal(t, "", req.Header.Get("X-Forwarded-Unix-User"))
+	assert.Equal(t, "", req.Header.Get("X-Forwarded-Unix-Uid"))
+	assert.Equal(t, "", req.Header.Get("X-Remote-User"))
+}
+
+func TestIdentityMapOptions(t *testing.T) {
+	o := testOptions()
+	o.IdentityMapFile = "/nonexistent/identity-map"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		"error opening identity_map_file /nonexistent/identity-map: open /nonexistent/identity-map: no such file or directory"}), err.Error())
+}
@@ -0,0 +1,127 @@
+package oauth2proxy
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/cookies"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/logger"
+)
+
+// Impersonate replaces an administrator's session with a session acting as
+// the user given by the "email" form value, so that they can troubleshoot
+// what the user sees. The new session is marked with the administrator's
+// email, which is sent upstream, and expires after the impersonation
+// duration. Signing out ends the impersonation.
+func (p *OAuthProxy) Impersonate(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !isSameOriginPost(req) {
+		logger.PrintfRequest(req, "Impersonation refused: request from another origin")
+		p.ErrorPage(rw, http.StatusForbidden, "Permission Denied", "The request did not come from this site")
+		return
+	}
+
+	session, err := p.getAuthenticatedSession(rw, req)
+	if errors.Is(err, sessionsapi.ErrBackendUnavailable) {
+		p.ErrorPage(rw, http.StatusServiceUnavailable, "Service Unavailable", "Service Unavailable")
+		return
+	} else if err != nil {
+		p.ErrorPage(rw, http.StatusUnauthorized, "Unauthorized", "You must be signed in to impersonate a user")
+		return
+	}
+
+	if session.IsImpersonated() {
+		p.ErrorPage(rw, http.StatusForbidden, "Permission Denied", "Sign out to end the current impersonation first")
+		return
+	}
+	if !p.isImpersonationAdmin(session.Email, session.Groups) {
+		logger.PrintAuthf(session.Email, req, logger.AuthFailure, "Impersonation denied: not an impersonation admin")
+		p.ErrorPage(rw, http.StatusForbidden, "Permission Denied", "You are not allowed to impersonate users")
+		return
+	}
+
+	redirect, err := p.GetRedirect(req)
+	if err != nil {
+		logger.Printf("Error obtaining redirect: %s", err.Error())
+		p.ErrorPage(rw, http.StatusInternalServerError, "Internal Error", err.Error())
+		return
+	}
+	email := strings.TrimSpace(req.PostForm.Get("email"))
+	if email == "" {
+		p.ErrorPage(rw, http.StatusBadRequest, "Bad Request", "The email of the user to impersonate is required")
+		return
+	}
+	if !p.Validator(email) {
+		logger.PrintAuthf(session.Email, req, logger.AuthFailure, "Impersonation of %s denied: not an authorized user", email)
+		p.ErrorPage(rw, http.StatusForbidden, "Permission Denied", "The user is not authorized to use this service")
+		return
+	}
+
+	now := p.now()
+	impersonated := &sessionsapi.SessionState{
+		Email:              email,
+		User:               email,
+		Impersonator:       session.Email,
+		ImpersonatorGroups: session.Groups,
+		WebAuthnVerified:   session.WebAuthnVerified,
+		CreatedAt:          now,
+		ExpiresOn:          now.Add(p.impersonationTTL),
+	}
+	if err := p.SaveSession(rw, req, impersonated); err != nil {
+		logger.PrintAuthf(session.Email, req, logger.AuthError, "Impersonation of %s failed: %s", email, err)
+		p.ErrorPage(rw, http.StatusInternalServerError, "Internal Error", "Internal Error")
+		return
+	}
+	logger.PrintAuthf(session.Email, req, logger.AuthSuccess, "Impersonating %s until %s", email, impersonated.ExpiresOn.Format(time.RFC3339))
+	http.Redirect(rw, req, redirect, http.StatusFound)
+}
+
+// isImpersonationAdmin checks whether the email, or one of the groups,
+// belongs to an administrator allowed to impersonate users. Groups are
+// given as "group:<name>" entries. Administrators must have an email to be
+// recorded as the impersonator.
+func (p *OAuthProxy) isImpersonationAdmin(email string, groups []string) bool {
+	if email == "" {
+		return false
+	}
+	for _, admin := range p.impersonationAdmins {
+		if group := strings.TrimPrefix(admin, "group:"); group != admin {
+			for _, g := range groups {
+				if g == group {
+					return true
+				}
+			}
+		} else if strings.EqualFold(admin, email) {
+			return true
+		}
+	}
+	return false
+}
+
+// isSameOriginPost checks that a POST came from a page on the proxy's own
+// host, by its Origin header, or its Referer when the browser leaves the
+// Origin out, so that other sites can't submit forms to it with the user's
+// cookies
+func isSameOriginPost(req *http.Request) bool {
+	source := req.Header.Get("Origin")
+	if source == "" {
+		source = req.Header.Get("Referer")
+	}
+	if source == "" {
+		return false
+	}
+	u, err := url.Parse(source)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, cookies.GetRequestHost(req))
+}
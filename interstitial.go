@@ -0,0 +1,190 @@
+package oauth2proxy
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/encryption"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/logger"
+)
+
+// interstitialTokenTTL is how long users have to accept an interstitial page
+// once it is shown
+const interstitialTokenTTL = time.Hour
+
+// interstitialName matches the names interstitials may have, which are kept
+// in sessions and name their templates
+var interstitialName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// interstitial is a page, eg. terms of use or a warning, that users must
+// accept once per session before requests for paths matching regex are
+// proxied
+type interstitial struct {
+	regex    *regexp.Regexp
+	name     string
+	template *template.Template // nil to use the built-in interstitial.html
+}
+
+// parseInterstitial parses an interstitial of the form <regex>=<name>. The
+// last "=" separates them, as regexes may contain one.
+func parseInterstitial(s string) (*interstitial, error) {
+	i := strings.LastIndex(s, "=")
+	if i < 0 {
+		return nil, fmt.Errorf("interstitial (%s) must be of the form <regex>=<name>", s)
+	}
+	name := strings.TrimSpace(s[i+1:])
+	if !interstitialName.MatchString(name) {
+		return nil, fmt.Errorf("interstitial (%s) must have a name of letters, digits, - and _", s)
+	}
+	regex, err := regexp.Compile(s[:i])
+	if err != nil {
+		return nil, fmt.Errorf("error compiling interstitial regex=%q %s", s[:i], err)
+	}
+	return &interstitial{regex: regex, name: name}, nil
+}
+
+// loadInterstitialTemplate loads the interstitial's page from the custom
+// templates directory, when it has an interstitial_<name>.html
+func loadInterstitialTemplate(dir string, name string) (*template.Template, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	file := "interstitial_" + name + ".html"
+	text, err := ioutil.ReadFile(path.Join(dir, file))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return template.New(file).Funcs(templateFuncs).Parse(string(text))
+}
+
+// pendingInterstitial returns the first interstitial covering the path that
+// the session hasn't accepted, or nil if there is none. The proxy's own
+// endpoints are never covered, so that users can always sign out.
+func (p *OAuthProxy) pendingInterstitial(path string, session *sessionsapi.SessionState) *interstitial {
+	if strings.HasPrefix(path, p.ProxyPrefix+"/") {
+		return nil
+	}
+	for _, i := range p.interstitials {
+		if i.regex.MatchString(path) && !session.HasAcknowledged(i.name) {
+			return i
+		}
+	}
+	return nil
+}
+
+// Interstitial serves the interstitial page pending for the page users are
+// on their way to, and records in their session that they accepted it
+func (p *OAuthProxy) Interstitial(rw http.ResponseWriter, req *http.Request) {
+	if len(p.interstitials) == 0 {
+		http.NotFound(rw, req)
+		return
+	}
+	if req.Method != http.MethodGet && req.Method != http.MethodPost {
+		http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	session, err := p.getAuthenticatedSession(rw, req)
+	if errors.Is(err, sessionsapi.ErrBackendUnavailable) {
+		http.Error(rw, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
+		p.SignInPage(rw, req, http.StatusForbidden)
+		return
+	}
+	redirect, err := p.GetRedirect(req)
+	if err != nil {
+		logger.Printf("Error obtaining redirect: %s", err.Error())
+		p.ErrorPage(rw, http.StatusInternalServerError, "Internal Error", err.Error())
+		return
+	}
+	u, err := url.Parse(redirect)
+	if err != nil {
+		p.ErrorPage(rw, http.StatusBadRequest, "Bad Request", "Invalid redirect")
+		return
+	}
+	pending := p.pendingInterstitial(u.Path, session)
+	if pending == nil {
+		http.Redirect(rw, req, redirect, http.StatusFound)
+		return
+	}
+
+	if req.Method == http.MethodGet {
+		p.interstitialPage(rw, session, pending, redirect)
+		return
+	}
+	if req.PostFormValue("interstitial") != pending.name || !p.validInterstitialToken(req.PostFormValue("token"), session, pending.name) {
+		http.Error(rw, "invalid or expired acknowledgment: reload the page and try again", http.StatusBadRequest)
+		return
+	}
+	session.Acknowledged = append(session.Acknowledged, pending.name)
+	if err := p.SaveSession(rw, req, session); err != nil {
+		logger.PrintAuthf(session.Email, req, logger.AuthError, "Save session error %s", err)
+		p.ErrorPage(rw, http.StatusInternalServerError, "Internal Error", "Internal Error")
+		return
+	}
+	logger.PrintAuthf(session.Email, req, logger.AuthSuccess, "Accepted interstitial %s", pending.name)
+	// any further interstitials for the page are shown when it is requested
+	http.Redirect(rw, req, redirect, http.StatusFound)
+}
+
+func (p *OAuthProxy) interstitialPage(rw http.ResponseWriter, session *sessionsapi.SessionState, i *interstitial, redirect string) {
+	t := struct {
+		Name        string
+		User        string
+		Email       string
+		Action      string
+		Redirect    string
+		Token       string
+		ProxyPrefix string
+	}{
+		Name:        i.name,
+		User:        session.User,
+		Email:       session.Email,
+		Action:      p.InterstitialPath,
+		Redirect:    redirect,
+		Token:       p.interstitialToken(session, i.name, p.now()),
+		ProxyPrefix: p.ProxyPrefix,
+	}
+	rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+	var err error
+	if i.template != nil {
+		err = i.template.Execute(rw, t)
+	} else {
+		err = p.templates.ExecuteTemplate(rw, "interstitial.html", t)
+	}
+	if err != nil {
+		logger.Printf("Error rendering interstitial template: %v", err)
+	}
+}
+
+// interstitialToken signs the acceptance of the named interstitial by the
+// session's user, so that it can only be accepted from the page
+func (p *OAuthProxy) interstitialToken(session *sessionsapi.SessionState, name string, now time.Time) string {
+	return encryption.SignedValue(p.CookieSeed, p.interstitialTokenKey(), interstitialTokenValue(session, name), now)
+}
+
+func (p *OAuthProxy) validInterstitialToken(token string, session *sessionsapi.SessionState, name string) bool {
+	value, _, ok := encryption.ValidateAt(&http.Cookie{Name: p.interstitialTokenKey(), Value: token}, p.CookieSeed, interstitialTokenTTL, p.now())
+	return ok && value == interstitialTokenValue(session, name)
+}
+
+func (p *OAuthProxy) interstitialTokenKey() string {
+	return p.CookieName + "_interstitial"
+}
+
+func interstitialTokenValue(session *sessionsapi.SessionState, name string) string {
+	return fmt.Sprintf("%s:%s:%s", name, session.User, session.Email)
+}
@@ -0,0 +1,118 @@
+package oauth2proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseInterstitial(t *testing.T) {
+	i, err := parseInterstitial("^/reports/(a=b)?=terms_of-use")
+	require.NoError(t, err)
+	assert.Equal(t, "^/reports/(a=b)?", i.regex.String())
+	assert.Equal(t, "terms_of-use", i.name)
+
+	for _, s := range []string{"^/reports/", "^/reports/=", "^/reports/=../terms", "(=terms"} {
+		_, err := parseInterstitial(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestInterstitialOptions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "interstitial")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "interstitial_terms.html"), []byte(`Terms for {{.Email | ToLower}}`), 0600))
+
+	o := testOptions()
+	o.CustomTemplatesDir = dir
+	o.Interstitials = []string{"^/reports/=terms", "^/exports/=terms", "^/=banner"}
+	require.NoError(t, o.Validate())
+	require.Len(t, o.interstitials, 3)
+	assert.NotNil(t, o.interstitials[0].template)
+	assert.Equal(t, o.interstitials[0].template, o.interstitials[1].template)
+	assert.Nil(t, o.interstitials[2].template)
+
+	o = testOptions()
+	o.Interstitials = []string{"^/reports/"}
+	err = o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		"interstitial (^/reports/) must be of the form <regex>=<name>"}), err.Error())
+}
+
+var interstitialToken = regexp.MustCompile(`name="token" value="([^"]+)"`)
+
+func TestInterstitial(t *testing.T) {
+	pcTest := NewProcessCookieTestWithDefaults()
+	terms, err := parseInterstitial("^/reports/=terms")
+	require.NoError(t, err)
+	banner, err := parseInterstitial("^/reports/secret=banner")
+	require.NoError(t, err)
+	pcTest.proxy.interstitials = []*interstitial{terms, banner}
+	require.NoError(t, pcTest.SaveSession(&sessionsapi.SessionState{Email: "jane@example.com", CreatedAt: time.Now()}))
+	cookie, err := pcTest.req.Cookie(pcTest.opts.Cookie.Name)
+	require.NoError(t, err)
+
+	serve := func(req *http.Request, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req.AddCookie(cookie)
+		rw := httptest.NewRecorder()
+		pcTest.proxy.ServeHTTP(rw, req)
+		return rw
+	}
+	authOnly := func(uri string, cookie *http.Cookie) int {
+		req := httptest.NewRequest("GET", pcTest.opts.ProxyPrefix+"/auth", nil)
+		req.Header.Set("X-Forwarded-Uri", uri)
+		return serve(req, cookie).Code
+	}
+
+	rw := serve(httptest.NewRequest("GET", "/reports/q1?page=2", nil), cookie)
+	assert.Equal(t, http.StatusFound, rw.Code)
+	assert.Equal(t, "/oauth2/interstitial?rd=%2Freports%2Fq1%3Fpage%3D2", rw.Header().Get("Location"))
+	assert.Equal(t, http.StatusAccepted, authOnly("/", cookie))
+	assert.Equal(t, http.StatusUnauthorized, authOnly("/reports/q1", cookie))
+
+	rw = serve(httptest.NewRequest("GET", "/oauth2/interstitial?rd=%2Freports%2Fq1%3Fpage%3D2", nil), cookie)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Contains(t, rw.Body.String(), "the terms notice")
+	match := interstitialToken.FindStringSubmatch(rw.Body.String())
+	require.Len(t, match, 2)
+
+	accept := func(name string, token string) *httptest.ResponseRecorder {
+		form := url.Values{"rd": {"/reports/q1?page=2"}, "interstitial": {name}, "token": {token}}
+		req := httptest.NewRequest("POST", "/oauth2/interstitial", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return serve(req, cookie)
+	}
+	assert.Equal(t, http.StatusBadRequest, accept("terms", "forged").Code)
+	assert.Equal(t, http.StatusBadRequest, accept("banner", match[1]).Code)
+
+	rw = accept("terms", match[1])
+	assert.Equal(t, http.StatusFound, rw.Code)
+	assert.Equal(t, "/reports/q1?page=2", rw.Header().Get("Location"))
+	var accepted *http.Cookie
+	for _, c := range rw.Result().Cookies() {
+		if c.Name == pcTest.opts.Cookie.Name {
+			accepted = c
+		}
+	}
+	require.NotNil(t, accepted)
+	assert.Equal(t, http.StatusAccepted, authOnly("/reports/q1", accepted))
+	assert.Equal(t, http.StatusUnauthorized, authOnly("/reports/secret", accepted))
+
+	// nothing is pending any more for the page
+	rw = serve(httptest.NewRequest("GET", "/oauth2/interstitial?rd=%2Freports%2Fq1", nil), accepted)
+	assert.Equal(t, http.StatusFound, rw.Code)
+	assert.Equal(t, "/reports/q1", rw.Header().Get("Location"))
+}
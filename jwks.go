@@ -0,0 +1,48 @@
+package oauth2proxy
+
+import (
+	"context"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/logger"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/verification"
+)
+
+// keySetRefreshTimeout bounds each refresh of the key sets, including
+// retries, so that an unreachable issuer doesn't hold up startup
+const keySetRefreshTimeout = 30 * time.Second
+
+// warmKeySets fetches the signing keys of the oidc and extra JWT issuers in
+// parallel before serving, so that the first tokens verified after a restart
+// don't wait on them. The keys are then refreshed every JWKSRefreshInterval
+// until done is closed.
+func warmKeySets(opts *Options, done <-chan struct{}) {
+	if len(opts.keySets) == 0 {
+		return
+	}
+	refresh := func() {
+		ctx, cancel := context.WithTimeout(context.Background(), keySetRefreshTimeout)
+		defer cancel()
+		verification.RefreshKeySets(ctx, opts.keySets)
+	}
+
+	start := time.Now()
+	refresh()
+	logger.Printf("Fetched the signing keys of %d issuer(s) in %s", len(opts.keySets), time.Since(start).Round(time.Millisecond))
+
+	if opts.JWKSRefreshInterval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(opts.JWKSRefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				refresh()
+			}
+		}
+	}()
+}
@@ -0,0 +1,29 @@
+package oauth2proxy
+
+import (
+	"net/http"
+
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/logger"
+	"github.com/oauth2-proxy/oauth2-proxy/providers"
+)
+
+// setLogFields identifies the request's session in the log lines written for
+// the rest of the request by hashing the user's email and the session cookie
+func (p *OAuthProxy) setLogFields(req *http.Request, session *sessionsapi.SessionState, provider providers.Provider) {
+	user := session.Email
+	if user == "" {
+		user = session.User
+	}
+	fields := logger.RequestFields{UserHash: logger.HashIdentifier(user)}
+	if c, err := req.Cookie(p.CookieName); err == nil {
+		fields.SessionHash = logger.HashIdentifier(c.Value)
+	} else if c, err := req.Cookie(p.CookieName + "_0"); err == nil {
+		// The first part of a split cookie is as unique as the whole
+		fields.SessionHash = logger.HashIdentifier(c.Value)
+	}
+	if provider != nil && provider.Data() != nil {
+		fields.Provider = provider.Data().ProviderName
+	}
+	logger.SetRequestFields(req, fields)
+}
@@ -0,0 +1,37 @@
+package oauth2proxy
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogFields(t *testing.T) {
+	pcTest := NewProcessCookieTestWithDefaults()
+	require.NoError(t, pcTest.SaveSession(&sessionsapi.SessionState{Email: "jane@example.com", CreatedAt: time.Now()}))
+	cookie, err := pcTest.req.Cookie(pcTest.opts.Cookie.Name)
+	require.NoError(t, err)
+
+	buf := bytes.NewBuffer(nil)
+	logger.SetOutput(buf)
+	logger.SetReqTemplate(logger.DefaultRequestLoggingFormat)
+	logger.SetGetClientFunc(func(r *http.Request) string { return r.RemoteAddr })
+	defer logger.SetOutput(os.Stderr)
+
+	req := httptest.NewRequest("GET", pcTest.opts.ProxyPrefix+"/auth", nil)
+	req.AddCookie(cookie)
+	rw := httptest.NewRecorder()
+	LoggingHandler(pcTest.proxy).ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusAccepted, rw.Code)
+
+	fields := "user=" + logger.HashIdentifier("jane@example.com") + " session=" + logger.HashIdentifier(cookie.Value)
+	assert.Contains(t, buf.String(), fields+"\n")
+}
@@ -1,13 +1,16 @@
 // largely adapted from https://github.com/gorilla/handlers/blob/master/handlers.go
 // to add logging of request duration as last value (and drop referrer)
 
-package main
+package oauth2proxy
 
 import (
 	"bufio"
 	"errors"
+	"math/rand"
 	"net"
 	"net/http"
+	"net/url"
+	"regexp"
 	"time"
 
 	"github.com/oauth2-proxy/oauth2-proxy/pkg/logger"
@@ -90,12 +93,31 @@ func (l *responseLogger) Flush() {
 // loggingHandler is the http.Handler implementation for LoggingHandler
 type loggingHandler struct {
 	handler http.Handler
+	// sampleRate is the fraction of requests with a status below 400 that
+	// are logged
+	sampleRate float64
+	// redactQueryParams match the names of query parameters that are removed
+	// from the logged URL
+	redactQueryParams []*regexp.Regexp
 }
 
 // LoggingHandler provides an http.Handler which logs requests to the HTTP server
 func LoggingHandler(h http.Handler) http.Handler {
 	return loggingHandler{
-		handler: h,
+		handler:    h,
+		sampleRate: 1,
+	}
+}
+
+// newLoggingHandler creates the logging middleware, applying the sampling
+// and redaction rules from the options
+func newLoggingHandler(opts *Options) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return loggingHandler{
+			handler:           h,
+			sampleRate:        opts.RequestLoggingSampleRate,
+			redactQueryParams: opts.redactQueryParams,
+		}
 	}
 }
 
@@ -103,6 +125,42 @@ func (h loggingHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	t := time.Now()
 	url := *req.URL
 	responseLogger := &responseLogger{w: w}
+	// The proxy sets the fields identifying the session once it is loaded
+	req = req.WithContext(logger.NewRequestContext(req.Context()))
 	h.handler.ServeHTTP(responseLogger, req)
+	if !h.sampled(responseLogger.Status()) {
+		return
+	}
+	url.RawQuery = h.redactQuery(url.RawQuery)
 	logger.PrintReq(responseLogger.authInfo, responseLogger.upstream, req, url, t, responseLogger.Status(), responseLogger.Size())
 }
+
+// sampled decides whether a request with the given status should be logged.
+// Client and server errors are always logged.
+func (h loggingHandler) sampled(status int) bool {
+	if status >= 400 || h.sampleRate >= 1 {
+		return true
+	}
+	return rand.Float64() < h.sampleRate
+}
+
+// redactQuery removes the query parameters matching the redaction rules
+func (h loggingHandler) redactQuery(rawQuery string) string {
+	if rawQuery == "" || len(h.redactQueryParams) == 0 {
+		return rawQuery
+	}
+	params, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		// Don't risk logging a value that should have been redacted
+		return ""
+	}
+	for name := range params {
+		for _, re := range h.redactQueryParams {
+			if re.MatchString(name) {
+				params.Del(name)
+				break
+			}
+		}
+	}
+	return params.Encode()
+}
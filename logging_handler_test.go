@@ -1,15 +1,17 @@
-package main
+package oauth2proxy
 
 import (
 	"bytes"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"regexp"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/oauth2-proxy/oauth2-proxy/pkg/logger"
+	"github.com/stretchr/testify/assert"
 )
 
 func TestLoggingHandler_ServeHTTP(t *testing.T) {
@@ -49,6 +51,8 @@ func TestLoggingHandler_ServeHTTP(t *testing.T) {
 
 		logger.SetOutput(buf)
 		logger.SetReqTemplate(test.Format)
+		// Validating options elsewhere sets the real client IP parser
+		logger.SetGetClientFunc(func(r *http.Request) string { return r.RemoteAddr })
 		if test.SilencePingLogging {
 			test.ExcludePaths = append(test.ExcludePaths, "/ping")
 		}
@@ -67,3 +71,57 @@ func TestLoggingHandler_ServeHTTP(t *testing.T) {
 		}
 	}
 }
+
+func TestLoggingHandlerSampling(t *testing.T) {
+	tests := []struct {
+		name       string
+		sampleRate float64
+		status     int
+		logged     bool
+	}{
+		{"all requests logged", 1, http.StatusOK, true},
+		{"successful request not sampled", 0, http.StatusOK, false},
+		{"redirect not sampled", 0, http.StatusFound, false},
+		{"client error always logged", 0, http.StatusForbidden, true},
+		{"server error always logged", 0, http.StatusBadGateway, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buf := bytes.NewBuffer(nil)
+			logger.SetOutput(buf)
+			logger.SetReqTemplate("{{.StatusCode}}")
+			logger.SetExcludePaths(nil)
+
+			opts := NewOptions()
+			opts.RequestLoggingSampleRate = test.sampleRate
+			h := newLoggingHandler(opts)(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				w.WriteHeader(test.status)
+			}))
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/foo", nil))
+
+			if test.logged {
+				assert.Equal(t, fmt.Sprintf("%d\n", test.status), buf.String())
+			} else {
+				assert.Equal(t, "", buf.String())
+			}
+		})
+	}
+}
+
+func TestLoggingHandlerRedactsQueryParams(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	logger.SetOutput(buf)
+	logger.SetReqTemplate("{{.RequestURI}}")
+	logger.SetExcludePaths(nil)
+
+	opts := NewOptions()
+	opts.redactQueryParams = []*regexp.Regexp{regexp.MustCompile("^(code|.*token)$")}
+	h := newLoggingHandler(opts)(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		assert.Equal(t, "secret", req.URL.Query().Get("code"), "the request itself must not be modified")
+		w.Write([]byte("test"))
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/oauth2/callback?code=secret&state=abc&access_token=xyz", nil))
+
+	assert.Equal(t, "\"/oauth2/callback?state=abc\"\n", buf.String())
+}
@@ -0,0 +1,51 @@
+package oauth2proxy
+
+import (
+	"net/http"
+	"net/url"
+	"unicode"
+)
+
+// loginHintParams are the parameters of sign in requests passed on to the
+// provider, for it to preselect the user's account or tenant
+var loginHintParams = []string{"login_hint", "domain_hint"}
+
+// maxLoginHintLength limits the length of the hints passed to the provider
+const maxLoginHintLength = 256
+
+// loginHintURL passes the hints given to the sign in request on to the
+// provider, replacing the configured defaults. Hints that can't be an
+// account or domain are ignored.
+func loginHintURL(loginURL string, req *http.Request) string {
+	params := url.Values{}
+	for _, name := range loginHintParams {
+		if hint := req.Form.Get(name); validLoginHint(hint) {
+			params.Set(name, hint)
+		}
+	}
+	if len(params) == 0 {
+		return loginURL
+	}
+	u, err := url.Parse(loginURL)
+	if err != nil {
+		return loginURL
+	}
+	query := u.Query()
+	for name := range params {
+		query.Set(name, params.Get(name))
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+func validLoginHint(hint string) bool {
+	if hint == "" || len(hint) > maxLoginHintLength {
+		return false
+	}
+	for _, r := range hint {
+		if !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
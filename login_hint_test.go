@@ -0,0 +1,58 @@
+package oauth2proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoginHintURL(t *testing.T) {
+	loginURL := "https://idp.example.com/authorize?client_id=proxy&login_hint=default%40example.com"
+
+	req := httptest.NewRequest("GET", "/oauth2/start", nil)
+	require.NoError(t, req.ParseForm())
+	assert.Equal(t, loginURL, loginHintURL(loginURL, req))
+
+	req = httptest.NewRequest("GET", "/oauth2/start?login_hint=jane%40example.com&domain_hint=example.com", nil)
+	require.NoError(t, req.ParseForm())
+	u, err := url.Parse(loginHintURL(loginURL, req))
+	require.NoError(t, err)
+	assert.Equal(t, "jane@example.com", u.Query().Get("login_hint"))
+	assert.Equal(t, "example.com", u.Query().Get("domain_hint"))
+	assert.Equal(t, "proxy", u.Query().Get("client_id"))
+
+	req = httptest.NewRequest("GET", "/oauth2/start?login_hint=jane%0A&domain_hint="+strings.Repeat("a", maxLoginHintLength+1), nil)
+	require.NoError(t, req.ParseForm())
+	assert.Equal(t, loginURL, loginHintURL(loginURL, req))
+}
+
+func TestLoginHints(t *testing.T) {
+	opts := testOptions()
+	opts.LoginHint = "default@example.com"
+	require.NoError(t, opts.Validate())
+	proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+	require.NoError(t, err)
+
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, httptest.NewRequest("GET", opts.ProxyPrefix+"/start", nil))
+	assert.Equal(t, http.StatusFound, rw.Code)
+	u, err := url.Parse(rw.Header().Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, "default@example.com", u.Query().Get("login_hint"))
+
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, httptest.NewRequest("GET", opts.ProxyPrefix+"/start?login_hint=jane%40example.com", nil))
+	u, err = url.Parse(rw.Header().Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, "jane@example.com", u.Query().Get("login_hint"))
+
+	// the sign in page passes hints on to the provider button
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, httptest.NewRequest("GET", opts.ProxyPrefix+"/sign_in?domain_hint=example.com", nil))
+	assert.Contains(t, rw.Body.String(), `<input type="hidden" name="domain_hint" value="example.com">`)
+}
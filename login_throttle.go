@@ -0,0 +1,153 @@
+package oauth2proxy
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/encryption"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/logger"
+)
+
+// loginThrottle cools users down after the provider has authenticated them
+// but they were refused as many times in a row as they may be, eg. as
+// they're not in an allowed group or their email isn't verified. Signing in
+// again straight away would only be refused again, and browsers, or the
+// applications behind the proxy, that retry it hammer both the proxy and
+// the provider.
+//
+// Failures are counted per user, with counters shared by instances of the
+// proxy when they're kept in Redis. The provider only says who the user is
+// once they're back from signing in, so the browser that starts the cool
+// down keeps a cookie, signed with the time it started, until it's over.
+type loginThrottle struct {
+	counters sessionsapi.CounterStore
+	failures int64
+	cooldown time.Duration
+}
+
+// validateLoginThrottle sets up the login throttle, counting failures with
+// the session store when it keeps counters, ie. in Redis
+func validateLoginThrottle(o *Options, msgs []string) []string {
+	o.loginThrottle = nil
+	if o.LoginThrottleFailures < 0 {
+		return append(msgs, fmt.Sprintf("login_throttle_failures (%d) must not be negative", o.LoginThrottleFailures))
+	}
+	if o.LoginThrottleFailures == 0 {
+		return msgs
+	}
+	if o.LoginThrottleCooldown <= 0 {
+		return append(msgs, fmt.Sprintf("login_throttle_cooldown (%s) must be positive", o.LoginThrottleCooldown))
+	}
+	counters, ok := o.sessionStore.(sessionsapi.CounterStore)
+	if !ok {
+		counters = newMemoryCounterStore()
+	}
+	o.loginThrottle = &loginThrottle{
+		counters: counters,
+		failures: int64(o.LoginThrottleFailures),
+		cooldown: o.LoginThrottleCooldown,
+	}
+	return msgs
+}
+
+// failuresKey is the key of the count of the user's failures. Failures
+// count for as long as the cool down after the last of them.
+func (t *loginThrottle) failuresKey(user string) string {
+	return "login-failures:" + userLimitsKey(user)
+}
+
+// fail counts a failure by the user, returning whether they must now cool
+// down
+func (t *loginThrottle) fail(ctx context.Context, user string) (bool, error) {
+	n, err := t.counters.IncrementCounter(ctx, t.failuresKey(user), 1, t.cooldown)
+	if err != nil {
+		return false, err
+	}
+	return n >= t.failures, nil
+}
+
+// reset forgets the user's failures once they've signed in
+func (t *loginThrottle) reset(ctx context.Context, user string) error {
+	n, err := t.counters.IncrementCounter(ctx, t.failuresKey(user), 0, t.cooldown)
+	if err != nil || n == 0 {
+		return err
+	}
+	_, err = t.counters.IncrementCounter(ctx, t.failuresKey(user), -n, t.cooldown)
+	return err
+}
+
+// throttledUser returns who the provider authenticated: the email of the
+// session or, failing that, its username
+func throttledUser(session *sessionsapi.SessionState) string {
+	if session.Email != "" {
+		return session.Email
+	}
+	return session.User
+}
+
+// failedLogin counts a sign in refused after the provider authenticated the
+// user, starting their cool down in the browser once they've failed too
+// many times
+func (p *OAuthProxy) failedLogin(rw http.ResponseWriter, req *http.Request, user string) {
+	if p.loginThrottle == nil || user == "" {
+		return
+	}
+	cooldown, err := p.loginThrottle.fail(req.Context(), user)
+	if err != nil {
+		logger.Printf("Error counting failed sign in: %v", err)
+		return
+	}
+	if cooldown {
+		logger.PrintAuthf(user, req, logger.AuthFailure, "Too many failed sign ins, cooling down for %s", p.loginThrottle.cooldown)
+		value := encryption.SignedValue(p.CookieSeed, p.loginThrottleCookie, userLimitsKey(user), p.now())
+		http.SetCookie(rw, p.makeCookie(req, p.loginThrottleCookie, value, p.loginThrottle.cooldown, p.now()))
+	}
+}
+
+// succeededLogin forgets the user's failed sign ins
+func (p *OAuthProxy) succeededLogin(rw http.ResponseWriter, req *http.Request, user string) {
+	if p.loginThrottle == nil || user == "" {
+		return
+	}
+	if err := p.loginThrottle.reset(req.Context(), user); err != nil {
+		logger.Printf("Error resetting failed sign ins: %v", err)
+	}
+	if _, err := req.Cookie(p.loginThrottleCookie); err == nil {
+		http.SetCookie(rw, p.makeCookie(req, p.loginThrottleCookie, "", time.Hour*-1, p.now()))
+	}
+}
+
+// loginCooldown returns how much longer the browser must wait before it
+// may sign in again, or 0 if it isn't cooling down
+func (p *OAuthProxy) loginCooldown(req *http.Request) time.Duration {
+	if p.loginThrottle == nil {
+		return 0
+	}
+	cookie, err := req.Cookie(p.loginThrottleCookie)
+	if err != nil {
+		return 0
+	}
+	now := p.now()
+	_, started, ok := encryption.ValidateAt(cookie, p.CookieSeed, p.loginThrottle.cooldown, now)
+	if wait := started.Add(p.loginThrottle.cooldown).Sub(now); ok && wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// loginCooldownPage tells the user to wait before signing in again rather
+// than sending them back to the provider
+func (p *OAuthProxy) loginCooldownPage(rw http.ResponseWriter, req *http.Request, wait time.Duration) {
+	rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	if isAjax(req) {
+		p.ErrorJSON(rw, http.StatusTooManyRequests)
+		return
+	}
+	p.ErrorPage(rw, http.StatusTooManyRequests,
+		"Too Many Requests", "Signing in has failed too many times, try again later")
+}
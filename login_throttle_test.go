@@ -0,0 +1,89 @@
+package oauth2proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/clock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoginThrottle(t *testing.T) {
+	providerServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(`{"access_token": "my_auth_token"}`))
+	}))
+	defer providerServer.Close()
+
+	opts := testOptions()
+	opts.LoginThrottleFailures = 2
+	opts.LoginThrottleCooldown = time.Minute
+	require.NoError(t, opts.Validate())
+	providerURL, _ := url.Parse(providerServer.URL)
+	provider := NewTestProvider(providerURL, "john.doe@example.com")
+	provider.GroupValidator = func(string) bool { return false }
+	opts.provider = provider
+	proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+	require.NoError(t, err)
+	mock := clock.NewMock(time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC))
+	proxy.clock = mock
+
+	var throttle *http.Cookie
+	callback := func(nonce string) int {
+		req := httptest.NewRequest("GET", "/oauth2/callback?code=callback_code&state="+nonce+":/", nil)
+		req.AddCookie(proxy.MakeCSRFCookie(req, nonce, time.Hour, mock.Now()))
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		for _, c := range rw.Result().Cookies() {
+			if c.Name == proxy.loginThrottleCookie {
+				throttle = c
+			}
+		}
+		return rw.Code
+	}
+	start := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/oauth2/start", nil)
+		if throttle != nil {
+			req.AddCookie(throttle)
+		}
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		return rw
+	}
+
+	assert.Equal(t, http.StatusForbidden, callback("first"))
+	assert.Nil(t, throttle)
+	assert.Equal(t, http.StatusFound, start().Code)
+
+	assert.Equal(t, http.StatusForbidden, callback("second"))
+	require.NotNil(t, throttle)
+	mock.Add(20 * time.Second)
+	rw := start()
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+	assert.Equal(t, "40", rw.Header().Get("Retry-After"))
+
+	// the cool down is over, and the user may sign in once they're allowed
+	mock.Add(time.Minute)
+	assert.Equal(t, http.StatusFound, start().Code)
+	provider.GroupValidator = func(string) bool { return true }
+	assert.Equal(t, http.StatusFound, callback("third"))
+	assert.Equal(t, int64(0), proxy.loginThrottle.counters.(*memoryCounterStore).counters[proxy.loginThrottle.failuresKey("john.doe@example.com")].value)
+}
+
+func TestLoginThrottleOptions(t *testing.T) {
+	o := testOptions()
+	o.LoginThrottleFailures = -1
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{"login_throttle_failures (-1) must not be negative"}), err.Error())
+
+	o = testOptions()
+	o.LoginThrottleFailures = 3
+	o.LoginThrottleCooldown = 0
+	err = o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{"login_throttle_cooldown (0s) must be positive"}), err.Error())
+}
@@ -0,0 +1,289 @@
+package oauth2proxy
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/encryption"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/logger"
+)
+
+// machineTokenPrefix starts every machine token, distinguishing them from
+// other bearer tokens such as JWTs
+const machineTokenPrefix = "o2pmt_"
+
+// maxMachineTokenRequestSize limits the size of requests to issue a token
+const maxMachineTokenRequestSize = 64 * 1024
+
+// machineTokenRequest is the body of a request to issue a machine token
+type machineTokenRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// TTL is the lifetime of the token as a duration, eg. "720h". It
+	// defaults to the longest lifetime allowed.
+	TTL string `json:"ttl"`
+}
+
+// issuedMachineToken is the response to a request to issue a machine token.
+// It is the only time the token itself is returned.
+type issuedMachineToken struct {
+	*sessionsapi.MachineToken
+	Token string `json:"token"`
+}
+
+// MachineTokens lets signed in users issue (POST), list (GET) and revoke
+// (DELETE with an "id" query parameter) their machine tokens
+func (p *OAuthProxy) MachineTokens(rw http.ResponseWriter, req *http.Request) {
+	if p.machineTokens == nil {
+		http.NotFound(rw, req)
+		return
+	}
+
+	session, err := p.getAuthenticatedSession(rw, req)
+	if errors.Is(err, sessionsapi.ErrBackendUnavailable) {
+		http.Error(rw, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
+		http.Error(rw, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	if session.Email == "" || session.IsImpersonated() {
+		http.Error(rw, "machine tokens can only be managed by users signed in with their own email", http.StatusForbidden)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		p.listMachineTokens(rw, req, session)
+	case http.MethodPost:
+		p.issueMachineToken(rw, req, session)
+	case http.MethodDelete:
+		p.revokeMachineToken(rw, req, session)
+	default:
+		rw.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (p *OAuthProxy) issueMachineToken(rw http.ResponseWriter, req *http.Request, session *sessionsapi.SessionState) {
+	var body machineTokenRequest
+	if err := json.NewDecoder(http.MaxBytesReader(rw, req.Body, maxMachineTokenRequestSize)).Decode(&body); err != nil {
+		http.Error(rw, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+	ttl, err := p.validateMachineTokenRequest(&body)
+	if err != nil {
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rawID := make([]byte, 16)
+	if _, err := rand.Read(rawID); err != nil {
+		logger.Printf("Error creating machine token ID: %v", err)
+		http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	now := p.now()
+	token := &sessionsapi.MachineToken{
+		ID:          hex.EncodeToString(rawID),
+		Name:        body.Name,
+		Owner:       session.Email,
+		OwnerGroups: session.Groups,
+		Scopes:      body.Scopes,
+		CreatedAt:   now,
+		ExpiresOn:   now.Add(ttl),
+	}
+	if err := p.machineTokens.SaveMachineToken(req.Context(), token); err != nil {
+		logger.PrintAuthf(session.Email, req, logger.AuthError, "Error saving machine token %q: %v", token.Name, err)
+		http.Error(rw, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	logger.PrintAuthf(session.Email, req, logger.AuthSuccess, "Issued machine token %s %q for %s until %s",
+		token.ID, token.Name, strings.Join(token.Scopes, ","), token.ExpiresOn.Format(time.RFC3339))
+
+	writeJSON(rw, http.StatusCreated, issuedMachineToken{
+		MachineToken: token,
+		Token:        p.signMachineToken(token.ID),
+	})
+}
+
+// validateMachineTokenRequest checks the request and returns the lifetime
+// of the token to issue
+func (p *OAuthProxy) validateMachineTokenRequest(body *machineTokenRequest) (time.Duration, error) {
+	if body.Name == "" {
+		return 0, errors.New("a name is required")
+	}
+	if len(body.Scopes) == 0 {
+		return 0, errors.New("at least one scope is required")
+	}
+	for _, scope := range body.Scopes {
+		if !strings.HasPrefix(scope, "/") {
+			return 0, fmt.Errorf("scope %q must be a path starting with /", scope)
+		}
+		// scopes are matched against clean paths
+		if strings.ContainsAny(scope, "?#\\") || strings.TrimSuffix(path.Clean(scope), "/") != strings.TrimSuffix(scope, "/") {
+			return 0, fmt.Errorf("scope %q must be a clean path without a query", scope)
+		}
+	}
+
+	if body.TTL == "" {
+		return p.machineTokenMaxTTL, nil
+	}
+	ttl, err := time.ParseDuration(body.TTL)
+	if err != nil {
+		return 0, fmt.Errorf("invalid ttl: %v", err)
+	}
+	if ttl <= 0 || ttl > p.machineTokenMaxTTL {
+		return 0, fmt.Errorf("ttl must be greater than 0 and at most %s", p.machineTokenMaxTTL)
+	}
+	return ttl, nil
+}
+
+func (p *OAuthProxy) listMachineTokens(rw http.ResponseWriter, req *http.Request, session *sessionsapi.SessionState) {
+	tokens, err := p.machineTokens.ListMachineTokens(req.Context())
+	if err != nil {
+		logger.Printf("Error listing machine tokens: %v", err)
+		http.Error(rw, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+
+	owned := []*sessionsapi.MachineToken{}
+	for _, token := range tokens {
+		if strings.EqualFold(token.Owner, session.Email) {
+			owned = append(owned, token)
+		}
+	}
+	writeJSON(rw, http.StatusOK, owned)
+}
+
+func (p *OAuthProxy) revokeMachineToken(rw http.ResponseWriter, req *http.Request, session *sessionsapi.SessionState) {
+	id := req.URL.Query().Get("id")
+	token, err := p.machineTokens.LoadMachineToken(req.Context(), id)
+	if errors.Is(err, sessionsapi.ErrNotFound) || (err == nil && !strings.EqualFold(token.Owner, session.Email)) {
+		http.NotFound(rw, req)
+		return
+	} else if err != nil {
+		logger.Printf("Error loading machine token %s: %v", id, err)
+		http.Error(rw, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+
+	if err := p.machineTokens.RevokeMachineToken(req.Context(), id); err != nil {
+		logger.Printf("Error revoking machine token %s: %v", id, err)
+		http.Error(rw, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	logger.PrintAuthf(session.Email, req, logger.AuthSuccess, "Revoked machine token %s %q", token.ID, token.Name)
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// getMachineTokenSession authenticates a request made with a machine token,
+// returning a session for the token's owner. Tokens can't be used for the
+// proxy's own endpoints, other than to check authentication, so they can't
+// be used to issue further tokens.
+func (p *OAuthProxy) getMachineTokenSession(req *http.Request, rawToken string) (*sessionsapi.SessionState, error) {
+	id, ok := p.verifyMachineToken(rawToken)
+	if !ok {
+		logger.PrintAuthf("", req, logger.AuthFailure, "Invalid machine token")
+		return nil, ErrNeedsLogin
+	}
+
+	token, err := p.machineTokens.LoadMachineToken(req.Context(), id)
+	if errors.Is(err, sessionsapi.ErrNotFound) {
+		logger.PrintAuthf("", req, logger.AuthFailure, "Machine token %s has expired or been revoked", id)
+		return nil, ErrNeedsLogin
+	} else if err != nil {
+		return nil, err
+	}
+
+	uri := req.URL.EscapedPath()
+	if uri == p.AuthOnlyPath && req.Header.Get("X-Forwarded-Uri") != "" {
+		uri = req.Header.Get("X-Forwarded-Uri")
+	}
+	switch {
+	case token.ExpiresOn.Before(p.now()):
+		logger.PrintAuthf(token.Owner, req, logger.AuthFailure, "Machine token %s has expired", id)
+		return nil, ErrNeedsLogin
+	case strings.HasPrefix(uri, p.ProxyPrefix+"/") && uri != p.AuthOnlyPath && uri != p.UserInfoPath:
+		logger.PrintAuthf(token.Owner, req, logger.AuthFailure, "Machine token %s can't be used for %s", id, uri)
+		return nil, ErrNeedsLogin
+	case !token.Allows(uri):
+		logger.PrintAuthf(token.Owner, req, logger.AuthFailure, "Machine token %s is not valid for %s", id, uri)
+		return nil, ErrNeedsLogin
+	}
+
+	// The name is chosen by the owner, so it mustn't be passed upstream
+	// as the user
+	session := &sessionsapi.SessionState{
+		Email:        token.Owner,
+		User:         token.Owner,
+		Groups:       token.OwnerGroups,
+		MachineToken: token.ID,
+		CreatedAt:    token.CreatedAt,
+		ExpiresOn:    token.ExpiresOn,
+	}
+	if !p.isAllowedUser(session) {
+		logger.PrintAuthf(token.Owner, req, logger.AuthFailure, "Machine token %s belongs to an unauthorized user", id)
+		return nil, ErrNeedsLogin
+	}
+	// tokens issued inside an access window mustn't outlast it
+	if w := p.closedAccessWindow(req, session); w != nil {
+		logger.PrintAuthf(token.Owner, req, logger.AuthFailure, "Machine token %s used outside access window %s", id, w)
+		return nil, ErrOutsideAccessWindow
+	}
+	return session, nil
+}
+
+// signMachineToken creates the token given to clients for the token ID
+func (p *OAuthProxy) signMachineToken(id string) string {
+	return machineTokenPrefix + id + "." + p.machineTokenSignature(id)
+}
+
+// verifyMachineToken checks the signature of a token, returning its ID
+func (p *OAuthProxy) verifyMachineToken(token string) (string, bool) {
+	parts := strings.SplitN(strings.TrimPrefix(token, machineTokenPrefix), ".", 2)
+	if len(parts) != 2 || !strings.HasPrefix(token, machineTokenPrefix) {
+		return "", false
+	}
+	expected := p.machineTokenSignature(parts[0])
+	if !encryption.SecureCompare(parts[1], expected) {
+		return "", false
+	}
+	return parts[0], true
+}
+
+func (p *OAuthProxy) machineTokenSignature(id string) string {
+	mac := hmac.New(sha256.New, []byte(p.CookieSeed))
+	mac.Write([]byte("machine-token:" + id))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// machineTokenFromRequest returns the machine token given as a bearer token,
+// if any
+func machineTokenFromRequest(req *http.Request) (string, bool) {
+	auth := req.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer "+machineTokenPrefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(auth, "Bearer "), true
+}
+
+// writeJSON writes v as the JSON body of the response
+func writeJSON(rw http.ResponseWriter, code int, v interface{}) {
+	rw.Header().Set("Content-Type", applicationJSON)
+	rw.WriteHeader(code)
+	if err := json.NewEncoder(rw).Encode(v); err != nil {
+		logger.Printf("Error encoding response: %v", err)
+	}
+}
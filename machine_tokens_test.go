@@ -0,0 +1,268 @@
+package oauth2proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeMachineTokenStore keeps machine tokens in memory
+type fakeMachineTokenStore struct {
+	mu     sync.Mutex
+	tokens map[string]*sessionsapi.MachineToken
+}
+
+func (s *fakeMachineTokenStore) SaveMachineToken(_ context.Context, token *sessionsapi.MachineToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[token.ID] = token
+	return nil
+}
+
+func (s *fakeMachineTokenStore) LoadMachineToken(_ context.Context, id string) (*sessionsapi.MachineToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	token, ok := s.tokens[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: machine token %s", sessionsapi.ErrNotFound, id)
+	}
+	return token, nil
+}
+
+func (s *fakeMachineTokenStore) ListMachineTokens(context.Context) ([]*sessionsapi.MachineToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var tokens []*sessionsapi.MachineToken
+	for _, token := range s.tokens {
+		tokens = append(tokens, token)
+	}
+	return tokens, nil
+}
+
+func (s *fakeMachineTokenStore) RevokeMachineToken(_ context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.tokens, id)
+	return nil
+}
+
+func newMachineTokenTest(t *testing.T) (*ProcessCookieTest, *http.Cookie) {
+	pcTest := NewProcessCookieTestWithDefaults()
+	pcTest.proxy.machineTokens = &fakeMachineTokenStore{tokens: map[string]*sessionsapi.MachineToken{}}
+	pcTest.proxy.machineTokenMaxTTL = 24 * time.Hour
+	require.NoError(t, pcTest.SaveSession(&sessionsapi.SessionState{Email: "jane@example.com", CreatedAt: time.Now()}))
+	cookie, err := pcTest.req.Cookie(pcTest.opts.Cookie.Name)
+	require.NoError(t, err)
+	return pcTest, cookie
+}
+
+func issueTestMachineToken(t *testing.T, pcTest *ProcessCookieTest, cookie *http.Cookie, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", pcTest.opts.ProxyPrefix+"/machine_tokens", strings.NewReader(body))
+	req.AddCookie(cookie)
+	rw := httptest.NewRecorder()
+	pcTest.proxy.ServeHTTP(rw, req)
+	return rw
+}
+
+func TestMachineTokenLifecycle(t *testing.T) {
+	pcTest, cookie := newMachineTokenTest(t)
+
+	rw := issueTestMachineToken(t, pcTest, cookie, `{"name": "ci", "scopes": ["/api/"], "ttl": "1h"}`)
+	require.Equal(t, http.StatusCreated, rw.Code, rw.Body.String())
+	var issued struct {
+		ID        string    `json:"id"`
+		Owner     string    `json:"owner"`
+		ExpiresOn time.Time `json:"expires_on"`
+		Token     string    `json:"token"`
+	}
+	require.NoError(t, json.Unmarshal(rw.Body.Bytes(), &issued))
+	assert.Equal(t, "jane@example.com", issued.Owner)
+	assert.True(t, strings.HasPrefix(issued.Token, machineTokenPrefix))
+	assert.WithinDuration(t, time.Now().Add(time.Hour), issued.ExpiresOn, time.Minute)
+
+	// The token authenticates requests within its scopes
+	authenticate := func(path string) (*sessionsapi.SessionState, error) {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", "Bearer "+issued.Token)
+		return pcTest.proxy.getAuthenticatedSession(httptest.NewRecorder(), req)
+	}
+	session, err := authenticate("/api/builds")
+	require.NoError(t, err)
+	assert.Equal(t, "jane@example.com", session.Email)
+	assert.Equal(t, "jane@example.com", session.User)
+	assert.Equal(t, issued.ID, session.MachineToken)
+	_, err = authenticate("/admin")
+	assert.Equal(t, ErrNeedsLogin, err)
+	_, err = authenticate("/api/../admin")
+	assert.Equal(t, ErrNeedsLogin, err)
+	_, err = authenticate("/apix")
+	assert.Equal(t, ErrNeedsLogin, err)
+
+	// nor can the path checked in auth_request mode escape them
+	forwarded := func(uri string) (*sessionsapi.SessionState, error) {
+		req := httptest.NewRequest("GET", pcTest.opts.ProxyPrefix+"/auth", nil)
+		req.Header.Set("Authorization", "Bearer "+issued.Token)
+		req.Header.Set("X-Forwarded-Uri", uri)
+		return pcTest.proxy.getAuthenticatedSession(httptest.NewRecorder(), req)
+	}
+	_, err = forwarded("/api/builds?page=2")
+	assert.NoError(t, err)
+	for _, uri := range []string{"/api/../admin", "/api%2F..%2Fadmin", "/api/%2e%2e/admin", "/apix"} {
+		_, err = forwarded(uri)
+		assert.Equal(t, ErrNeedsLogin, err, uri)
+	}
+	_, err = authenticate(pcTest.opts.ProxyPrefix + "/machine_tokens")
+	assert.Equal(t, ErrNeedsLogin, err)
+
+	// A tampered token is rejected
+	req := httptest.NewRequest("GET", "/api/builds", nil)
+	req.Header.Set("Authorization", "Bearer "+machineTokenPrefix+issued.ID+".forged")
+	_, err = pcTest.proxy.getAuthenticatedSession(httptest.NewRecorder(), req)
+	assert.Equal(t, ErrNeedsLogin, err)
+
+	// The owner can list their tokens
+	req = httptest.NewRequest("GET", pcTest.opts.ProxyPrefix+"/machine_tokens", nil)
+	req.AddCookie(cookie)
+	rw = httptest.NewRecorder()
+	pcTest.proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Contains(t, rw.Body.String(), issued.ID)
+	assert.NotContains(t, rw.Body.String(), issued.Token)
+
+	// and revoke them
+	req = httptest.NewRequest("DELETE", pcTest.opts.ProxyPrefix+"/machine_tokens?id="+issued.ID, nil)
+	req.AddCookie(cookie)
+	rw = httptest.NewRecorder()
+	pcTest.proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusNoContent, rw.Code)
+	_, err = authenticate("/api/builds")
+	assert.Equal(t, ErrNeedsLogin, err)
+}
+
+func TestMachineTokenInvalidRequests(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"invalid json", `{`},
+		{"no name", `{"scopes": ["/"]}`},
+		{"no scopes", `{"name": "ci"}`},
+		{"relative scope", `{"name": "ci", "scopes": ["api"]}`},
+		{"dot segment scope", `{"name": "ci", "scopes": ["/api/../admin"]}`},
+		{"scope with a query", `{"name": "ci", "scopes": ["/api?x=1"]}`},
+		{"ttl too long", `{"name": "ci", "scopes": ["/"], "ttl": "48h"}`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pcTest, cookie := newMachineTokenTest(t)
+			rw := issueTestMachineToken(t, pcTest, cookie, test.body)
+			assert.Equal(t, http.StatusBadRequest, rw.Code)
+		})
+	}
+}
+
+func TestMachineTokenNotPassedUpstream(t *testing.T) {
+	opts := NewOptions()
+	opts.PassBasicAuth = false
+	opts.Validate()
+	proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+machineTokenPrefix+"id.signature")
+	proxy.addHeadersForProxying(httptest.NewRecorder(), req, &sessionsapi.SessionState{Email: "jane@example.com"})
+	assert.Equal(t, "", req.Header.Get("Authorization"))
+}
+
+func TestMachineTokenNameNotPassedAsUser(t *testing.T) {
+	pcTest, cookie := newMachineTokenTest(t)
+	rw := issueTestMachineToken(t, pcTest, cookie, `{"name": "admin", "scopes": ["/"]}`)
+	require.Equal(t, http.StatusCreated, rw.Code, rw.Body.String())
+	var issued struct {
+		ID    string `json:"id"`
+		Token string `json:"token"`
+	}
+	require.NoError(t, json.Unmarshal(rw.Body.Bytes(), &issued))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+issued.Token)
+	req.Header.Set("X-Forwarded-Machine-Token-Id", "forged")
+	session, err := pcTest.proxy.getAuthenticatedSession(httptest.NewRecorder(), req)
+	require.NoError(t, err)
+	rw = httptest.NewRecorder()
+	pcTest.proxy.SetXAuthRequest = true
+	pcTest.proxy.addHeadersForProxying(rw, req, session)
+	assert.Equal(t, "jane@example.com", req.Header.Get("X-Forwarded-User"))
+	assert.Equal(t, "jane@example.com", rw.Header().Get("X-Auth-Request-User"))
+	assert.Equal(t, issued.ID, req.Header.Get("X-Forwarded-Machine-Token-Id"))
+	assert.Equal(t, issued.ID, rw.Header().Get("X-Auth-Request-Machine-Token-Id"))
+
+	// nor is a client allowed to claim a token of its own
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Forwarded-Machine-Token-Id", "forged")
+	pcTest.proxy.addHeadersForProxying(httptest.NewRecorder(), req, &sessionsapi.SessionState{Email: "jane@example.com"})
+	assert.Empty(t, req.Header.Get("X-Forwarded-Machine-Token-Id"))
+}
+
+func TestMachineTokenOutsideAccessWindow(t *testing.T) {
+	pcTest, cookie := newMachineTokenTest(t)
+	rw := issueTestMachineToken(t, pcTest, cookie, `{"name": "ci", "scopes": ["/"]}`)
+	require.Equal(t, http.StatusCreated, rw.Code, rw.Body.String())
+	var issued struct {
+		Token string `json:"token"`
+	}
+	require.NoError(t, json.Unmarshal(rw.Body.Bytes(), &issued))
+
+	// the owner's access has ended since the token was issued
+	expired, err := parseAccessWindow("^/=until:2020-06-30 email:jane@example.com", time.UTC)
+	require.NoError(t, err)
+	pcTest.proxy.accessWindows = []*accessWindow{expired}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+issued.Token)
+	_, err = pcTest.proxy.getAuthenticatedSession(httptest.NewRecorder(), req)
+	assert.Equal(t, ErrOutsideAccessWindow, err)
+}
+
+func TestMachineTokenGroupOwner(t *testing.T) {
+	pcTest := NewProcessCookieTestWithDefaults()
+	pcTest.proxy.machineTokens = &fakeMachineTokenStore{tokens: map[string]*sessionsapi.MachineToken{}}
+	pcTest.proxy.machineTokenMaxTTL = 24 * time.Hour
+	// the owner is only allowed by their group
+	pcTest.proxy.Validator = func(string) bool { return false }
+	pcTest.proxy.GroupValidator = func(groups []string) bool {
+		return len(groups) == 1 && groups[0] == "ci-admins"
+	}
+	require.NoError(t, pcTest.SaveSession(&sessionsapi.SessionState{Email: "jane@example.com", Groups: []string{"ci-admins"}, CreatedAt: time.Now()}))
+	cookie, err := pcTest.req.Cookie(pcTest.opts.Cookie.Name)
+	require.NoError(t, err)
+
+	rw := issueTestMachineToken(t, pcTest, cookie, `{"name": "ci", "scopes": ["/api/"]}`)
+	require.Equal(t, http.StatusCreated, rw.Code, rw.Body.String())
+	var issued struct {
+		Token string `json:"token"`
+	}
+	require.NoError(t, json.Unmarshal(rw.Body.Bytes(), &issued))
+
+	req := httptest.NewRequest("GET", "/api/builds", nil)
+	req.Header.Set("Authorization", "Bearer "+issued.Token)
+	session, err := pcTest.proxy.getAuthenticatedSession(httptest.NewRecorder(), req)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"ci-admins"}, session.Groups)
+
+	// once the group is no longer allowed, nor is the token
+	pcTest.proxy.GroupValidator = func([]string) bool { return false }
+	_, err = pcTest.proxy.getAuthenticatedSession(httptest.NewRecorder(), req)
+	assert.Equal(t, ErrNeedsLogin, err)
+}
@@ -0,0 +1,45 @@
+package oauth2proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/logger"
+)
+
+// defaultMaintenanceMessage is shown when the maintenance file is empty
+const defaultMaintenanceMessage = "This service is down for maintenance. Please try again later."
+
+// inMaintenance checks whether maintenance mode has been switched on by
+// creating the maintenance file. It is checked on every request so that it
+// can be toggled without restarting the proxy.
+func (p *OAuthProxy) inMaintenance() bool {
+	if p.maintenanceFile == "" {
+		return false
+	}
+	_, err := os.Stat(p.maintenanceFile)
+	return err == nil
+}
+
+// MaintenancePage serves the 503 page shown in place of proxied routes
+// during maintenance, with the contents of the maintenance file as the
+// message
+func (p *OAuthProxy) MaintenancePage(rw http.ResponseWriter, req *http.Request) {
+	prepareNoCache(rw)
+	if isAjax(req) {
+		p.ErrorJSON(rw, http.StatusServiceUnavailable)
+		return
+	}
+
+	message := defaultMaintenanceMessage
+	contents, err := ioutil.ReadFile(p.maintenanceFile)
+	if err != nil && !os.IsNotExist(err) {
+		logger.Printf("Error reading maintenance file %s: %v", p.maintenanceFile, err)
+	}
+	if text := strings.TrimSpace(string(contents)); text != "" {
+		message = text
+	}
+	p.ErrorPage(rw, http.StatusServiceUnavailable, "Service Unavailable", message)
+}
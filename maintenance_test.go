@@ -0,0 +1,58 @@
+package oauth2proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaintenanceMode(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("upstream"))
+	}))
+	t.Cleanup(upstream.Close)
+
+	dir, err := ioutil.TempDir("", "maintenance")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	maintenanceFile := filepath.Join(dir, "maintenance")
+
+	opts := NewOptions()
+	opts.Upstreams = []string{upstream.URL}
+	opts.SkipAuthRegex = []string{".*"}
+	opts.MaintenanceFile = maintenanceFile
+	_ = opts.Validate()
+	proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+	require.NoError(t, err)
+
+	serve := func(path string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, httptest.NewRequest("GET", path, nil))
+		return rw
+	}
+
+	rw := serve("/app")
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "upstream", rw.Body.String())
+
+	require.NoError(t, ioutil.WriteFile(maintenanceFile, nil, 0644))
+	rw = serve("/app")
+	assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+	assert.Contains(t, rw.Body.String(), defaultMaintenanceMessage)
+	assert.Equal(t, http.StatusOK, serve("/ping").Code)
+	assert.Equal(t, http.StatusOK, serve(opts.ProxyPrefix+"/sign_in").Code)
+
+	require.NoError(t, ioutil.WriteFile(maintenanceFile, []byte("Back at 10:00 UTC\n"), 0644))
+	rw = serve("/app")
+	assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+	assert.Contains(t, rw.Body.String(), "Back at 10:00 UTC")
+
+	require.NoError(t, os.Remove(maintenanceFile))
+	assert.Equal(t, http.StatusOK, serve("/app").Code)
+}
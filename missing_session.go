@@ -0,0 +1,30 @@
+package oauth2proxy
+
+import (
+	"expvar"
+	"net/http"
+	"net/url"
+)
+
+const (
+	// missingSessionSignIn responds to requests whose session is missing
+	// from the store the way it does to requests without a session
+	missingSessionSignIn = "sign_in"
+	// missingSessionRedirect sends users whose session is missing from the
+	// store straight to the provider, back to the page they requested
+	missingSessionRedirect = "redirect"
+)
+
+// sessionsMissing counts the requests with a session cookie whose session
+// was missing from the store, eg. evicted or revoked
+var sessionsMissing = expvar.NewInt("sessions_missing")
+
+// missingSession responds to a request whose session cookie refers to a
+// session missing from the store, once its stale cookie has been cleared
+func (p *OAuthProxy) missingSession(rw http.ResponseWriter, req *http.Request) {
+	if p.missingSessionAction == missingSessionRedirect && !isAjax(req) {
+		http.Redirect(rw, req, p.OAuthStartPath+"?rd="+url.QueryEscape(req.URL.RequestURI()), http.StatusFound)
+		return
+	}
+	p.needsLogin(rw, req)
+}
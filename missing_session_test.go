@@ -0,0 +1,75 @@
+package oauth2proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/apis/options"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/providers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMissingSession(t *testing.T) {
+	tests := []struct {
+		action   string
+		ajax     bool
+		code     int
+		location string
+	}{
+		{missingSessionSignIn, false, http.StatusForbidden, ""},
+		{missingSessionRedirect, false, http.StatusFound, "/oauth2/start?rd=%2Freports%3Fq%3D1"},
+		{missingSessionRedirect, true, http.StatusUnauthorized, ""},
+	}
+	skipWithoutRedis(t)
+	for _, test := range tests {
+		t.Run(test.action, func(t *testing.T) {
+			mr, err := miniredis.Run()
+			require.NoError(t, err)
+			defer mr.Close()
+			pcTest := NewProcessCookieTestWithOptionsModifiers(func(o *Options) {
+				o.Session.Type = options.RedisSessionStoreType
+				o.Session.Redis.ConnectionURL = "redis://" + mr.Addr()
+				o.MissingSessionAction = test.action
+			})
+			pcTest.proxy.provider = &TestProvider{ProviderData: &providers.ProviderData{}, ValidToken: true}
+			require.NoError(t, pcTest.SaveSession(&sessionsapi.SessionState{Email: "jane@example.com", CreatedAt: time.Now()}))
+			mr.FlushAll()
+
+			req := httptest.NewRequest("GET", "/reports?q=1", nil)
+			for _, c := range pcTest.req.Cookies() {
+				req.AddCookie(c)
+			}
+			if test.ajax {
+				req.Header.Set("Accept", "application/json")
+			}
+			missing := sessionsMissing.Value()
+			rw := httptest.NewRecorder()
+			pcTest.proxy.ServeHTTP(rw, req)
+			assert.Equal(t, test.code, rw.Code)
+			assert.Equal(t, test.location, rw.Header().Get("Location"))
+			assert.Equal(t, missing+1, sessionsMissing.Value())
+
+			var cleared bool
+			for _, c := range rw.Result().Cookies() {
+				if c.Name == pcTest.opts.Cookie.Name {
+					cleared = c.Value == "" && c.Expires.Before(time.Now())
+				}
+			}
+			assert.True(t, cleared)
+		})
+	}
+}
+
+func TestMissingSessionOptions(t *testing.T) {
+	o := testOptions()
+	o.MissingSessionAction = "error"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		"missing_session_action (error) must be one of ['sign_in', 'redirect']"}), err.Error())
+}
@@ -0,0 +1,112 @@
+package oauth2proxy
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/clock"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/encryption"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/logger"
+)
+
+// oauthStatesExpired counts the callbacks whose OAuth state had expired,
+// such as when users take too long to sign in at the provider
+var oauthStatesExpired = expvar.NewInt("oauth_states_expired")
+
+// memoryStateStore remembers the OAuth states this instance has redeemed
+// until they expire, for session stores that can't keep states. Unlike a
+// persistent StateStore it can't catch states replayed to other instances.
+type memoryStateStore struct {
+	ttl time.Duration
+
+	mu       sync.Mutex
+	redeemed map[string]time.Time
+}
+
+func newMemoryStateStore(ttl time.Duration) *memoryStateStore {
+	return &memoryStateStore{ttl: ttl, redeemed: map[string]time.Time{}}
+}
+
+// SaveState does nothing: states are only remembered once redeemed
+func (s *memoryStateStore) SaveState(context.Context, string, time.Duration) error {
+	return nil
+}
+
+// RedeemState fails for states that have already been redeemed
+func (s *memoryStateStore) RedeemState(_ context.Context, state string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := clock.Now()
+	for redeemed, expires := range s.redeemed {
+		if expires.Before(now) {
+			delete(s.redeemed, redeemed)
+		}
+	}
+	if _, ok := s.redeemed[state]; ok {
+		return fmt.Errorf("%w: oauth state", sessionsapi.ErrNotFound)
+	}
+	s.redeemed[state] = now.Add(s.ttl)
+	return nil
+}
+
+// encodeCSRFValue signs the CSRF cookie's value, encrypting it first when the
+// cookie secret can be used as a cipher
+func (p *OAuthProxy) encodeCSRFValue(name string, value string, now time.Time) (string, error) {
+	if p.cookieCipher != nil {
+		encrypted, err := p.cookieCipher.Encrypt(value)
+		if err != nil {
+			return "", err
+		}
+		value = encrypted
+	}
+	return encryption.SignedValue(p.CookieSeed, name, value, now), nil
+}
+
+// checkOAuthState checks the state given to the callback is the one its
+// CSRF cookie was set for, that it hasn't expired and that it hasn't been
+// redeemed before, writing an error page if not
+func (p *OAuthProxy) checkOAuthState(rw http.ResponseWriter, req *http.Request, nonce string) bool {
+	c, err := req.Cookie(p.csrfCookieName(req))
+	if err != nil {
+		logger.PrintAuthf("", req, logger.AuthFailure, "Invalid authentication via OAuth2: unable to obtain CSRF cookie")
+		p.ErrorPage(rw, http.StatusForbidden, "Permission Denied", err.Error())
+		return false
+	}
+	p.ClearCSRFCookie(rw, req)
+
+	value, signedAt, ok := encryption.ValidateAt(c, p.CookieSeed, p.oauthStateTTL, p.now())
+	if !ok && !signedAt.IsZero() {
+		oauthStatesExpired.Add(1)
+		logger.PrintAuthf("", req, logger.AuthFailure, "Invalid authentication via OAuth2: sign in took longer than %s", p.oauthStateTTL)
+		p.ErrorPage(rw, http.StatusForbidden, "Permission Denied", "Your sign in expired. Please try again.")
+		return false
+	}
+	if ok && p.cookieCipher != nil {
+		value, err = p.cookieCipher.Decrypt(value)
+		ok = err == nil
+	}
+	if !ok || !encryption.SecureCompare(value, nonce) {
+		logger.PrintAuthf("", req, logger.AuthFailure, "Invalid authentication via OAuth2: csrf token mismatch, potential attack")
+		p.ErrorPage(rw, http.StatusForbidden, "Permission Denied", "csrf failed")
+		return false
+	}
+
+	err = p.oauthStates.RedeemState(req.Context(), nonce)
+	if errors.Is(err, sessionsapi.ErrNotFound) {
+		logger.PrintAuthf("", req, logger.AuthFailure, "Invalid authentication via OAuth2: state already redeemed, potential replay")
+		p.ErrorPage(rw, http.StatusForbidden, "Permission Denied", "csrf failed")
+		return false
+	} else if err != nil {
+		logger.Printf("Error redeeming OAuth state: %v", err)
+		p.ErrorPage(rw, http.StatusInternalServerError, "Internal Error", "Internal Error")
+		return false
+	}
+	return true
+}
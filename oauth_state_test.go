@@ -0,0 +1,101 @@
+package oauth2proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/clock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryStateStore(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	mock := clock.NewMock(now)
+	clock.Set(mock)
+	defer clock.Reset()
+
+	s := newMemoryStateStore(time.Minute)
+	require.NoError(t, s.SaveState(context.Background(), "nonce", time.Minute))
+	require.NoError(t, s.RedeemState(context.Background(), "nonce"))
+	err := s.RedeemState(context.Background(), "nonce")
+	assert.True(t, errors.Is(err, sessionsapi.ErrNotFound))
+
+	// Redeemed states are forgotten once they would have expired anyway
+	mock.Add(2 * time.Minute)
+	assert.NoError(t, s.RedeemState(context.Background(), "other"))
+	assert.Len(t, s.redeemed, 1)
+}
+
+func newOAuthStateTestProxy(t *testing.T) *OAuthProxy {
+	providerServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(`{"access_token": "my_auth_token"}`))
+	}))
+	t.Cleanup(providerServer.Close)
+
+	opts := NewOptions()
+	opts.Cookie.Secret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "dlgkj"
+	opts.ClientSecret = "alkgret"
+	opts.EmailDomains = []string{"*"}
+	opts.PassAccessToken = true
+	require.NoError(t, opts.Validate())
+
+	providerURL, _ := url.Parse(providerServer.URL)
+	opts.provider = NewTestProvider(providerURL, "john.doe@example.com")
+	proxy, err := NewOAuthProxy(opts, func(email string) bool { return true })
+	require.NoError(t, err)
+	return proxy
+}
+
+func TestOAuthStateSingleUse(t *testing.T) {
+	proxy := newOAuthStateTestProxy(t)
+	req := httptest.NewRequest("GET", "/oauth2/callback?code=callback_code&state=nonce:/", nil)
+	csrf := proxy.MakeCSRFCookie(req, "nonce", time.Hour, time.Now())
+	assert.NotContains(t, csrf.Value, "nonce")
+	req.AddCookie(csrf)
+
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusFound, rw.Code)
+
+	// Replaying the callback with the same cookie fails
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+}
+
+func TestOAuthStateCookieMustBeSigned(t *testing.T) {
+	proxy := newOAuthStateTestProxy(t)
+	req := httptest.NewRequest("GET", "/oauth2/callback?code=callback_code&state=nonce:/", nil)
+	req.AddCookie(&http.Cookie{Name: proxy.CSRFCookieName, Value: "nonce"})
+
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+}
+
+func TestOAuthStateExpires(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	mock := clock.NewMock(now)
+	clock.Set(mock)
+	defer clock.Reset()
+
+	proxy := newOAuthStateTestProxy(t)
+	req := httptest.NewRequest("GET", "/oauth2/callback?code=callback_code&state=nonce:/", nil)
+	req.AddCookie(proxy.MakeCSRFCookie(req, "nonce", time.Hour, now))
+
+	mock.Add(proxy.oauthStateTTL + time.Minute)
+	expired := oauthStatesExpired.Value()
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+	assert.Contains(t, rw.Body.String(), "Your sign in expired")
+	assert.Equal(t, expired+1, oauthStatesExpired.Value())
+}
@@ -1,4 +1,4 @@
-package main
+package oauth2proxy
 
 import (
 	"context"
@@ -19,10 +19,15 @@ import (
 
 	"github.com/coreos/go-oidc"
 	"github.com/mbland/hmacauth"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/apis/options"
 	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/clock"
 	"github.com/oauth2-proxy/oauth2-proxy/pkg/cookies"
 	"github.com/oauth2-proxy/oauth2-proxy/pkg/encryption"
 	"github.com/oauth2-proxy/oauth2-proxy/pkg/logger"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/middleware"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/requests"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/webauthn"
 	"github.com/oauth2-proxy/oauth2-proxy/providers"
 	"github.com/yhat/wsutil"
 )
@@ -36,6 +41,14 @@ const (
 	httpsScheme = "https"
 
 	applicationJSON = "application/json"
+
+	// anonymousUser is passed upstream as the user for unauthenticated
+	// requests to anonymous-regex paths
+	anonymousUser = "anonymous"
+
+	// sessionTouchDivisor is the fraction of the idle timeout after which a
+	// used session is saved again, moving its idle timeout on
+	sessionTouchDivisor = 10
 )
 
 // SignatureHeaders contains the headers to be signed by the hmac algorithm
@@ -58,6 +71,31 @@ var (
 	// ErrNeedsLogin means the user should be redirected to the login page
 	ErrNeedsLogin = errors.New("redirect to login page")
 
+	// ErrSessionMissing means the request's session cookie refers to a
+	// session that is missing from the store, eg. evicted or revoked, so the
+	// user should sign in again. It matches ErrNeedsLogin.
+	ErrSessionMissing = fmt.Errorf("%w: session missing from the store", ErrNeedsLogin)
+
+	// ErrNeedsWebAuthn means the user is signed in, but should be redirected
+	// to verify their session with a WebAuthn credential
+	ErrNeedsWebAuthn = errors.New("redirect to webauthn verification")
+
+	// ErrNeedsStepUp means the user is signed in, but must authenticate
+	// again with a stronger method for the requested route
+	ErrNeedsStepUp = errors.New("redirect to step-up authentication")
+
+	// ErrNeedsInterstitial means the user is signed in, but must accept an
+	// interstitial page before continuing
+	ErrNeedsInterstitial = errors.New("redirect to interstitial page")
+
+	// ErrOutsideAccessWindow means the user is signed in, but the access
+	// window of the requested route is closed to them
+	ErrOutsideAccessWindow = errors.New("outside the access window")
+
+	// ErrRequestDeadline means the request's deadline passed while its
+	// session was loaded or refreshed
+	ErrRequestDeadline = errors.New("request deadline exceeded")
+
 	// Used to check final redirects are not susceptible to open redirects.
 	// Matches //, /\ and both of these with whitespace in between (eg / / or / \).
 	invalidRedirectRegex = regexp.MustCompile(`^/(\s|\v)?(/|\\)`)
@@ -76,6 +114,11 @@ type OAuthProxy struct {
 	CookieRefresh  time.Duration
 	CookieSameSite string
 	Validator      func(string) bool
+	// GroupValidator allows users by their groups as well as by their email
+	// with Validator, when set
+	GroupValidator func([]string) bool
+
+	cookieOptions *options.CookieOptions
 
 	RobotsPath        string
 	PingPath          string
@@ -85,17 +128,29 @@ type OAuthProxy struct {
 	OAuthCallbackPath string
 	AuthOnlyPath      string
 	UserInfoPath      string
+	ImpersonatePath   string
+	MachineTokensPath string
+	UserSessionsPath  string
+	WebAuthnPath      string
+	AssertionKeysPath string
+	InterstitialPath  string
+	CookieHandoffPath string
 
 	redirectURL          *url.URL // the url to receive requests at
+	redirectHosts        []string
 	whitelistDomains     []string
 	provider             providers.Provider
 	providerNameOverride string
 	sessionStore         sessionsapi.SessionStore
+	prevSessionStore     sessionsapi.SessionStore
 	ProxyPrefix          string
 	SignInMessage        string
 	HtpasswdFile         *HtpasswdFile
 	DisplayHtpasswdForm  bool
 	serveMux             http.Handler
+	proxyChain           middleware.Chain
+	proxyHandler         http.Handler
+	handler              http.Handler
 	SetXAuthRequest      bool
 	PassBasicAuth        bool
 	SetBasicAuth         bool
@@ -106,13 +161,61 @@ type OAuthProxy struct {
 	SetAuthorization     bool
 	PassAuthorization    bool
 	PreferEmailToUser    bool
+	headerSizeLimit      int
+	headerSizePolicy     string
+	redeemClientHeaders  []string
+	impersonationAdmins  []string
+	impersonationTTL     time.Duration
+	machineTokens        sessionsapi.MachineTokenStore
+	userSessions         sessionsapi.UserSessionStore
+	machineTokenMaxTTL   time.Duration
+	maintenanceFile      string
+	sessionTLSBinding    bool
+	sessionIdleTimeout   time.Duration
+	sessionIdentityOnly  bool
+	refreshGracePeriod   time.Duration
+	missingSessionAction string
+	cookieHandoffHosts   []string
+	webAuthn             *webauthn.RelyingParty
+	webAuthnCredentials  sessionsapi.WebAuthnCredentialStore
+	webAuthnRoutes       []*regexp.Regexp
+	stepUpRoutes         []stepUpRoute
+	stepUpACRLevels      []string
+	accessWindows        []*accessWindow
+	userLimits           *userLimits
+	requestDeadline      time.Duration
+	anyEmailAllowed      bool
+	loginThrottle        *loginThrottle
+	loginThrottleCookie  string
+	upstreamShadows      []*upstreamShadow
+	shadowMaxBodySize    int64
+	compression          *compression
+	headerTemplates      []*headerTemplate
+	identityMap          *identityMap
+	groupMapping         *groupMapping
+	interstitials        []*interstitial
+	featureFlags         *featureFlags
+	assertionSigner      *assertionSigner
+	baggageUserKey       string
+	baggageHashKey       []byte
+	traceHeaders         []string
+	cors                 *corsPolicy
+	webhooks             *webhookNotifier
+	tenants              *tenantProviders
+	cookieCipher         *encryption.Cipher
+	oauthStates          sessionsapi.StateStore
+	oauthStateTTL        time.Duration
 	skipAuthRegex        []string
 	skipAuthPreflight    bool
 	skipJwtBearerTokens  bool
 	jwtBearerVerifiers   []*oidc.IDTokenVerifier
 	compiledRegex        []*regexp.Regexp
+	wellKnownPaths       []string
+	anonymousRegex       []*regexp.Regexp
 	templates            *template.Template
 	realClientIPParser   realClientIPParser
+	clock                clock.Clock
+	httpClient           *http.Client
 	Banner               string
 	Footer               string
 }
@@ -133,9 +236,10 @@ func (u *UpstreamProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		r.Header.Set("GAP-Auth", w.Header().Get("GAP-Auth"))
 		u.auth.SignRequest(r)
 	}
-	if u.wsHandler != nil && strings.EqualFold(r.Header.Get("Connection"), "upgrade") && r.Header.Get("Upgrade") == "websocket" {
+	if u.wsHandler != nil && isWebSocket(r) {
 		u.wsHandler.ServeHTTP(w, r)
 	} else {
+		setRequestStage(r, stageUpstream)
 		u.handler.ServeHTTP(w, r)
 	}
 
@@ -146,7 +250,11 @@ func (u *UpstreamProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 func NewReverseProxy(target *url.URL, opts *Options) (proxy *httputil.ReverseProxy) {
 	proxy = httputil.NewSingleHostReverseProxy(target)
 	proxy.FlushInterval = opts.FlushInterval
-	if opts.SSLUpstreamInsecureSkipVerify {
+	if transport, ok := opts.upstreamTransports[target.Host]; ok {
+		proxy.Transport = transport
+	} else if opts.upstreamTransport != nil {
+		proxy.Transport = opts.upstreamTransport
+	} else if opts.SSLUpstreamInsecureSkipVerify {
 		proxy.Transport = &http.Transport{
 			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
 		}
@@ -177,7 +285,7 @@ func setProxyDirector(proxy *httputil.ReverseProxy) {
 
 // NewFileServer creates a http.Handler to serve files from the filesystem
 func NewFileServer(path string, filesystemPath string) (proxy http.Handler) {
-	return http.StripPrefix(path, http.FileServer(http.Dir(filesystemPath)))
+	return newFileServer(path, filesystemPath, nil)
 }
 
 // NewWebSocketOrRestReverseProxy creates a reverse proxy for REST or websocket based on url
@@ -189,6 +297,19 @@ func NewWebSocketOrRestReverseProxy(u *url.URL, opts *Options, auth hmacauth.Hma
 	} else {
 		setProxyDirector(proxy)
 	}
+	if opts.rewriteRedirects[u.Host] {
+		setProxyRedirectRewriter(proxy, u)
+	}
+	if signer := opts.upstreamSigV4[u.Host]; signer != nil {
+		setProxySigV4Signer(proxy, signer)
+	}
+	if opts.upstreamBreaker != nil {
+		breaker := newCircuitBreaker(u.Host, opts.upstreamBreaker)
+		setProxyCircuitBreaker(proxy, breaker, loadTemplates(opts.CustomTemplatesDir), opts.ProxyPrefix)
+	}
+	if opts.RequestDeadline > 0 {
+		setProxyDeadline(proxy, loadTemplates(opts.CustomTemplatesDir), opts.ProxyPrefix)
+	}
 
 	// this should give us a wss:// scheme if the url is https:// based.
 	var wsProxy *wsutil.ReverseProxy
@@ -208,8 +329,12 @@ func NewWebSocketOrRestReverseProxy(u *url.URL, opts *Options, auth hmacauth.Hma
 	}
 }
 
-// NewOAuthProxy creates a new instance of OAuthProxy from the options provided
-func NewOAuthProxy(opts *Options, validator func(string) bool) *OAuthProxy {
+// NewOAuthProxy creates a new instance of OAuthProxy from the options
+// provided, which must have been validated
+func NewOAuthProxy(opts *Options, validator func(string) bool) (*OAuthProxy, error) {
+	if opts.provider == nil {
+		return nil, errors.New("no provider is set up: the options must be validated before creating the proxy")
+	}
 	serveMux := http.NewServeMux()
 	var auth hmacauth.HmacAuth
 	if sigData := opts.signatureData; sigData != nil {
@@ -222,7 +347,11 @@ func NewOAuthProxy(opts *Options, validator func(string) bool) *OAuthProxy {
 		switch u.Scheme {
 		case httpScheme, httpsScheme:
 			logger.Printf("mapping path %q => upstream %q", path, u)
-			proxy := NewWebSocketOrRestReverseProxy(u, opts, auth)
+			upstreamAuth := auth
+			if a, ok := opts.upstreamAuth[host]; ok {
+				upstreamAuth = a
+			}
+			proxy := NewWebSocketOrRestReverseProxy(u, opts, upstreamAuth)
 			serveMux.Handle(path, proxy)
 		case "static":
 			responseCode, err := strconv.Atoi(host)
@@ -240,7 +369,7 @@ func NewOAuthProxy(opts *Options, validator func(string) bool) *OAuthProxy {
 				path = u.Fragment
 			}
 			logger.Printf("mapping path %q => file system %q", path, u.Path)
-			proxy := NewFileServer(path, u.Path)
+			proxy := newFileServer(path, u.Path, opts.upstreamFiles)
 			uProxy := UpstreamProxy{
 				upstream:  path,
 				handler:   proxy,
@@ -252,9 +381,19 @@ func NewOAuthProxy(opts *Options, validator func(string) bool) *OAuthProxy {
 			panic(fmt.Sprintf("unknown upstream protocol %s", u.Scheme))
 		}
 	}
+	for _, route := range opts.upstreamRoutes {
+		logger.Printf("mapping path %q => upstream routed by session", route.path)
+		serveMux.Handle(route.path, newUpstreamRouter(route, opts, auth))
+	}
 	for _, u := range opts.compiledRegex {
 		logger.Printf("compiled skip-auth-regex => %q", u)
 	}
+	for _, p := range opts.wellKnownPaths {
+		logger.Printf("skipping authentication for %s", p)
+	}
+	for _, u := range opts.anonymousRegex {
+		logger.Printf("compiled anonymous-regex => %q", u)
+	}
 
 	if opts.SkipJwtBearerTokens {
 		logger.Printf("Skipping JWT tokens from configured OIDC issuer: %q", opts.OIDCIssuerURL)
@@ -273,9 +412,9 @@ func NewOAuthProxy(opts *Options, validator func(string) bool) *OAuthProxy {
 		refresh = fmt.Sprintf("after %s", opts.Cookie.Refresh)
 	}
 
-	logger.Printf("Cookie settings: name:%s secure(https):%v httponly:%v expiry:%s domains:%s path:%s samesite:%s refresh:%s", opts.Cookie.Name, opts.Cookie.Secure, opts.Cookie.HTTPOnly, opts.Cookie.Expire, strings.Join(opts.Cookie.Domains, ","), opts.Cookie.Path, opts.Cookie.SameSite, refresh)
+	logger.Printf("Cookie settings: name:%s scope:%s secure(https):%v httponly:%v expiry:%s domains:%s path:%s samesite:%s refresh:%s", opts.Cookie.Name, opts.Cookie.NameScope, opts.Cookie.Secure, opts.Cookie.HTTPOnly, opts.Cookie.Expire, strings.Join(opts.Cookie.Domains, ","), opts.Cookie.Path, opts.Cookie.SameSite, refresh)
 
-	return &OAuthProxy{
+	p := &OAuthProxy{
 		CookieName:     opts.Cookie.Name,
 		CSRFCookieName: fmt.Sprintf("%v_%v", opts.Cookie.Name, "csrf"),
 		CookieSeed:     opts.Cookie.Secret,
@@ -287,6 +426,7 @@ func NewOAuthProxy(opts *Options, validator func(string) bool) *OAuthProxy {
 		CookieRefresh:  opts.Cookie.Refresh,
 		CookieSameSite: opts.Cookie.SameSite,
 		Validator:      validator,
+		cookieOptions:  &opts.Cookie,
 
 		RobotsPath:        "/robots.txt",
 		PingPath:          opts.PingPath,
@@ -296,19 +436,30 @@ func NewOAuthProxy(opts *Options, validator func(string) bool) *OAuthProxy {
 		OAuthCallbackPath: fmt.Sprintf("%s/callback", opts.ProxyPrefix),
 		AuthOnlyPath:      fmt.Sprintf("%s/auth", opts.ProxyPrefix),
 		UserInfoPath:      fmt.Sprintf("%s/userinfo", opts.ProxyPrefix),
+		ImpersonatePath:   fmt.Sprintf("%s/impersonate", opts.ProxyPrefix),
+		MachineTokensPath: fmt.Sprintf("%s/machine_tokens", opts.ProxyPrefix),
+		UserSessionsPath:  fmt.Sprintf("%s/sessions", opts.ProxyPrefix),
+		WebAuthnPath:      fmt.Sprintf("%s/webauthn", opts.ProxyPrefix),
+		AssertionKeysPath: fmt.Sprintf("%s/jwks", opts.ProxyPrefix),
+		InterstitialPath:  fmt.Sprintf("%s/interstitial", opts.ProxyPrefix),
+		CookieHandoffPath: fmt.Sprintf("%s/cookie_handoff", opts.ProxyPrefix),
 
 		ProxyPrefix:          opts.ProxyPrefix,
 		provider:             opts.provider,
 		providerNameOverride: opts.ProviderName,
 		sessionStore:         opts.sessionStore,
+		prevSessionStore:     opts.prevSessionStore,
 		serveMux:             serveMux,
 		redirectURL:          redirectURL,
+		redirectHosts:        opts.RedirectHosts,
 		whitelistDomains:     opts.WhitelistDomains,
 		skipAuthRegex:        opts.SkipAuthRegex,
 		skipAuthPreflight:    opts.SkipAuthPreflight,
 		skipJwtBearerTokens:  opts.SkipJwtBearerTokens,
 		jwtBearerVerifiers:   opts.jwtBearerVerifiers,
 		compiledRegex:        opts.compiledRegex,
+		wellKnownPaths:       opts.wellKnownPaths,
+		anonymousRegex:       opts.anonymousRegex,
 		realClientIPParser:   opts.realClientIPParser,
 		SetXAuthRequest:      opts.SetXAuthRequest,
 		PassBasicAuth:        opts.PassBasicAuth,
@@ -319,18 +470,95 @@ func NewOAuthProxy(opts *Options, validator func(string) bool) *OAuthProxy {
 		SetAuthorization:     opts.SetAuthorization,
 		PassAuthorization:    opts.PassAuthorization,
 		PreferEmailToUser:    opts.PreferEmailToUser,
+		headerSizeLimit:      opts.UpstreamHeaderSizeLimit,
+		headerSizePolicy:     opts.UpstreamHeaderSizePolicy,
+		redeemClientHeaders:  opts.RedeemClientHeaders,
+		impersonationAdmins:  opts.ImpersonationAdmins,
+		impersonationTTL:     opts.ImpersonationDuration,
+		machineTokenMaxTTL:   opts.MachineTokenMaxTTL,
+		maintenanceFile:      opts.MaintenanceFile,
+		sessionTLSBinding:    opts.SessionTLSBinding,
+		sessionIdleTimeout:   opts.Session.IdleTimeout,
+		sessionIdentityOnly:  opts.Session.IdentityOnly,
+		refreshGracePeriod:   opts.RefreshGracePeriod,
+		missingSessionAction: opts.MissingSessionAction,
+		cookieHandoffHosts:   opts.Cookie.HandoffHosts,
+		stepUpRoutes:         opts.stepUpRoutes,
+		stepUpACRLevels:      opts.StepUpACRLevels,
+		accessWindows:        opts.accessWindows,
+		userLimits:           opts.userLimits,
+		requestDeadline:      opts.RequestDeadline,
+		anyEmailAllowed:      allowsAnyEmail(opts.EmailDomains),
+		loginThrottle:        opts.loginThrottle,
+		loginThrottleCookie:  fmt.Sprintf("%v_%v", opts.Cookie.Name, "throttle"),
+		upstreamShadows:      opts.upstreamShadows,
+		shadowMaxBodySize:    opts.UpstreamShadowMaxBodySize,
+		compression:          opts.compression,
+		headerTemplates:      opts.headerTemplates,
+		identityMap:          opts.identityMap,
+		groupMapping:         opts.groupMapping,
+		interstitials:        opts.interstitials,
+		featureFlags:         opts.featureFlags,
+		assertionSigner:      opts.assertionSigner,
+		baggageUserKey:       opts.BaggageUserKey,
+		baggageHashKey:       opts.baggageHashKey,
+		traceHeaders:         opts.traceHeaders,
+		cors:                 opts.corsPolicy,
+		webhooks:             opts.webhooks,
+		tenants:              opts.tenantProviders,
+		cookieCipher:         opts.Session.Cipher,
+		oauthStateTTL:        opts.OAuthStateTTL,
 		SkipProviderButton:   opts.SkipProviderButton,
 		templates:            loadTemplates(opts.CustomTemplatesDir),
 		Banner:               opts.Banner,
 		Footer:               opts.Footer,
 	}
+
+	if opts.MachineTokens {
+		p.machineTokens, _ = opts.sessionStore.(sessionsapi.MachineTokenStore)
+	}
+	if opts.UserSessionsPage {
+		p.userSessions, _ = opts.sessionStore.(sessionsapi.UserSessionStore)
+	}
+	if states, ok := opts.sessionStore.(sessionsapi.StateStore); ok {
+		p.oauthStates = states
+	} else {
+		p.oauthStates = newMemoryStateStore(opts.OAuthStateTTL)
+	}
+	if p.webhooks != nil {
+		p.webhooks.start()
+	}
+	if opts.WebAuthnRPID != "" {
+		p.webAuthn = &webauthn.RelyingParty{ID: opts.WebAuthnRPID, Origins: opts.WebAuthnOrigins}
+		p.webAuthnCredentials, _ = opts.sessionStore.(sessionsapi.WebAuthnCredentialStore)
+		p.webAuthnRoutes = opts.webAuthnRoutes
+	}
+
+	p.proxyChain = middleware.NewChain(
+		middleware.NewScope(),
+		p.loadSession,
+		p.authorize,
+		p.limitUser,
+		p.injectHeaders,
+		p.shadowRequests,
+	)
+	p.proxyHandler = p.proxyChain.Then(p.serveMux)
+	return p, nil
+}
+
+// Use appends middlewares to the chain that handles proxied requests. They
+// are run after the user has been authorized and the upstream headers have
+// been set, immediately before the request is passed to the upstream.
+func (p *OAuthProxy) Use(constructors ...middleware.Constructor) {
+	p.proxyChain = p.proxyChain.Append(constructors...)
+	p.proxyHandler = p.proxyChain.Then(p.serveMux)
 }
 
 // GetRedirectURI returns the redirectURL that the upstream OAuth Provider will
 // redirect clients to once authenticated
 func (p *OAuthProxy) GetRedirectURI(host string) string {
-	// default to the request Host if not set
-	if p.redirectURL.Host != "" {
+	// default to the request Host if not set, or if it's a redirect host
+	if p.redirectURL.Host != "" && !p.isRedirectHost(host) {
 		return p.redirectURL.String()
 	}
 	u := *p.redirectURL
@@ -346,42 +574,91 @@ func (p *OAuthProxy) GetRedirectURI(host string) string {
 }
 
 func (p *OAuthProxy) displayCustomLoginForm() bool {
-	return p.HtpasswdFile != nil && p.DisplayHtpasswdForm
+	return p.isPasswordProvider() || p.HtpasswdFile != nil && p.DisplayHtpasswdForm
+}
+
+// isPasswordProvider checks whether users sign in to the provider with the
+// username and password form rather than being redirected to it
+func (p *OAuthProxy) isPasswordProvider() bool {
+	_, ok := p.provider.(providers.PasswordProvider)
+	return ok
 }
 
-func (p *OAuthProxy) redeemCode(ctx context.Context, host, code string) (s *sessionsapi.SessionState, err error) {
+// redeemContext returns the request's context carrying the client headers to
+// pass to the provider when redeeming or refreshing tokens. X-Forwarded-For
+// is extended with the client's address, as it is for requests to upstreams.
+func (p *OAuthProxy) redeemContext(req *http.Request) context.Context {
+	header := make(http.Header)
+	for _, name := range p.redeemClientHeaders {
+		name = http.CanonicalHeaderKey(name)
+		values := req.Header.Values(name)
+		if name == "X-Forwarded-For" {
+			if remoteIP, err := getRemoteIP(req); err == nil {
+				values = append(values, remoteIP.String())
+			}
+		}
+		if len(values) > 0 {
+			header[name] = values
+		}
+	}
+	return providers.WithClientHeaders(req.Context(), header)
+}
+
+func (p *OAuthProxy) redeemCode(ctx context.Context, provider providers.Provider, redirectURI, code string) (s *sessionsapi.SessionState, err error) {
 	if code == "" {
-		return nil, errors.New("missing code")
+		return nil, providers.ErrMissingCode
 	}
-	redirectURI := p.GetRedirectURI(host)
-	s, err = p.provider.Redeem(ctx, redirectURI, code)
+	s, err = provider.Redeem(ctx, redirectURI, code)
 	if err != nil {
 		return
 	}
 
 	if s.Email == "" {
-		s.Email, err = p.provider.GetEmailAddress(ctx, s)
+		s.Email, err = provider.GetEmailAddress(ctx, s)
 	}
 
 	if s.PreferredUsername == "" {
-		s.PreferredUsername, err = p.provider.GetPreferredUsername(ctx, s)
-		if err != nil && err.Error() == "not implemented" {
+		s.PreferredUsername, err = provider.GetPreferredUsername(ctx, s)
+		if err != nil && errors.Is(err, providers.ErrNotImplemented) {
 			err = nil
 		}
 	}
 
 	if s.User == "" {
-		s.User, err = p.provider.GetUserName(ctx, s)
-		if err != nil && err.Error() == "not implemented" {
+		s.User, err = provider.GetUserName(ctx, s)
+		if err != nil && errors.Is(err, providers.ErrNotImplemented) {
 			err = nil
 		}
 	}
+	p.groupMapping.apply(s)
 	return
 }
 
-// MakeCSRFCookie creates a cookie for CSRF
+// MakeCSRFCookie creates a cookie for CSRF, signing and, if the cookie secret
+// allows, encrypting its value
 func (p *OAuthProxy) MakeCSRFCookie(req *http.Request, value string, expiration time.Duration, now time.Time) *http.Cookie {
-	return p.makeCookie(req, p.CSRFCookieName, value, expiration, now)
+	name := p.csrfCookieName(req)
+	if value != "" {
+		encoded, err := p.encodeCSRFValue(name, value, now)
+		if err != nil {
+			logger.Printf("Error encoding CSRF cookie: %v", err)
+		}
+		value = encoded
+	}
+	return p.makeCookie(req, name, value, expiration, now)
+}
+
+// csrfCookieName returns the name of the CSRF cookie for the request, which
+// follows the session cookie name when it is scoped to the host or provider
+func (p *OAuthProxy) csrfCookieName(req *http.Request) string {
+	if p.cookieOptions == nil {
+		return p.CSRFCookieName
+	}
+	name := cookies.GetCookieName(req, p.cookieOptions)
+	if name == p.CookieName {
+		return p.CSRFCookieName
+	}
+	return fmt.Sprintf("%v_%v", name, "csrf")
 }
 
 func (p *OAuthProxy) makeCookie(req *http.Request, name string, value string, expiration time.Duration, now time.Time) *http.Cookie {
@@ -412,28 +689,45 @@ func (p *OAuthProxy) makeCookie(req *http.Request, name string, value string, ex
 // ClearCSRFCookie creates a cookie to unset the CSRF cookie stored in the user's
 // session
 func (p *OAuthProxy) ClearCSRFCookie(rw http.ResponseWriter, req *http.Request) {
-	http.SetCookie(rw, p.MakeCSRFCookie(req, "", time.Hour*-1, time.Now()))
+	http.SetCookie(rw, p.MakeCSRFCookie(req, "", time.Hour*-1, p.now()))
 }
 
 // SetCSRFCookie adds a CSRF cookie to the response
 func (p *OAuthProxy) SetCSRFCookie(rw http.ResponseWriter, req *http.Request, val string) {
-	http.SetCookie(rw, p.MakeCSRFCookie(req, val, p.CookieExpire, time.Now()))
+	http.SetCookie(rw, p.MakeCSRFCookie(req, val, p.CookieExpire, p.now()))
 }
 
 // ClearSessionCookie creates a cookie to unset the user's authentication cookie
 // stored in the user's session
 func (p *OAuthProxy) ClearSessionCookie(rw http.ResponseWriter, req *http.Request) error {
-	return p.sessionStore.Clear(rw, req)
+	return p.sessionStore.Clear(req.Context(), rw, req)
 }
 
 // LoadCookiedSession reads the user's authentication details from the request
 func (p *OAuthProxy) LoadCookiedSession(req *http.Request) (*sessionsapi.SessionState, error) {
-	return p.sessionStore.Load(req)
+	return p.sessionStore.Load(req.Context(), req)
 }
 
 // SaveSession creates a new session cookie value and sets this on the response
 func (p *OAuthProxy) SaveSession(rw http.ResponseWriter, req *http.Request, s *sessionsapi.SessionState) error {
-	return p.sessionStore.Save(rw, req, s)
+	if p.sessionTLSBinding {
+		binding, err := tlsChannelBinding(req)
+		if err != nil {
+			return fmt.Errorf("unable to bind session to the TLS connection: %v", err)
+		}
+		s.TLSBinding = binding
+	}
+	if p.sessionIdleTimeout > 0 {
+		s.LastSeen = p.now()
+	}
+	if p.sessionIdentityOnly {
+		// The tokens can still be used while handling this request
+		s = s.WithoutTokens()
+	}
+	if p.featureFlags.enabled(featureStrictSameSite, s) {
+		req = cookies.WithSameSite(req, "strict")
+	}
+	return p.sessionStore.Save(req.Context(), rw, req, s)
 }
 
 // RobotsTxt disallows scraping pages from the OAuthProxy
@@ -455,6 +749,7 @@ func (p *OAuthProxy) ErrorPage(rw http.ResponseWriter, code int, title string, m
 		Title       string
 		Message     string
 		ProxyPrefix string
+		RequestID   string
 	}{
 		Title:       fmt.Sprintf("%d %s", code, title),
 		Message:     message,
@@ -481,25 +776,41 @@ func (p *OAuthProxy) SignInPage(rw http.ResponseWriter, req *http.Request, code
 	}
 
 	t := struct {
-		ProviderName  string
-		SignInMessage template.HTML
-		CustomLogin   bool
-		Redirect      string
-		Version       string
-		ProxyPrefix   string
-		Footer        template.HTML
+		ProviderName   string
+		SignInMessage  template.HTML
+		CustomLogin    bool
+		Redirect       string
+		Version        string
+		ProxyPrefix    string
+		Footer         template.HTML
+		Tenant         string
+		ProviderButton bool
+		LoginHint      string
+		DomainHint     string
 	}{
-		ProviderName:  p.provider.Data().ProviderName,
-		SignInMessage: template.HTML(p.SignInMessage),
-		CustomLogin:   p.displayCustomLoginForm(),
-		Redirect:      redirectURL,
-		Version:       VERSION,
-		ProxyPrefix:   p.ProxyPrefix,
-		Footer:        template.HTML(p.Footer),
+		ProviderName:   p.provider.Data().ProviderName,
+		SignInMessage:  template.HTML(p.SignInMessage),
+		CustomLogin:    p.displayCustomLoginForm(),
+		Redirect:       redirectURL,
+		Version:        VERSION,
+		ProxyPrefix:    p.ProxyPrefix,
+		Footer:         template.HTML(p.Footer),
+		ProviderButton: !p.isPasswordProvider(),
+		LoginHint:      req.Form.Get("login_hint"),
+		DomainHint:     req.Form.Get("domain_hint"),
 	}
 	if p.providerNameOverride != "" {
 		t.ProviderName = p.providerNameOverride
 	}
+	if p.tenants != nil {
+		tenant := p.tenants.tenantFromRequest(req)
+		if name := p.tenants.tenants[tenant].ProviderDisplayName; name != "" {
+			t.ProviderName = name
+		}
+		if p.tenants.source == "query" {
+			t.Tenant = tenant
+		}
+	}
 	p.templates.ExecuteTemplate(rw, "sign_in.html", t)
 }
 
@@ -581,6 +892,25 @@ func validOptionalPort(port string) bool {
 	return true
 }
 
+// isAllowedUser checks whether the session's user is allowed by the email
+// domains and authenticated emails file, by their email or one of their groups
+func (p *OAuthProxy) isAllowedUser(session *sessionsapi.SessionState) bool {
+	if p.GroupValidator != nil && p.GroupValidator(session.Groups) {
+		return true
+	}
+	return p.Validator(session.Email)
+}
+
+// isAllowedPasswordUser checks a user signing in with a password. The
+// directory may have no email for them, when they're only allowed by their
+// groups, or if every email is.
+func (p *OAuthProxy) isAllowedPasswordUser(session *sessionsapi.SessionState) bool {
+	if session.Email != "" {
+		return p.isAllowedUser(session)
+	}
+	return p.anyEmailAllowed || (p.GroupValidator != nil && p.GroupValidator(session.Groups))
+}
+
 // IsValidRedirect checks whether the redirect URL is whitelisted
 func (p *OAuthProxy) IsValidRedirect(redirect string) bool {
 	switch {
@@ -635,6 +965,17 @@ func (p *OAuthProxy) IsWhitelistedPath(path string) bool {
 			return true
 		}
 	}
+	return matchWellKnownPath(p.wellKnownPaths, path) != ""
+}
+
+// IsAnonymousPath is used to check if unauthenticated requests for the path
+// are proxied as the anonymous user
+func (p *OAuthProxy) IsAnonymousPath(path string) bool {
+	for _, u := range p.anonymousRegex {
+		if u.MatchString(path) {
+			return true
+		}
+	}
 	return false
 }
 
@@ -653,16 +994,48 @@ func prepareNoCache(w http.ResponseWriter) {
 	}
 }
 
+// now returns the current time of the proxy's clock
+func (p *OAuthProxy) now() time.Time {
+	if p.clock == nil {
+		return clock.Now()
+	}
+	return p.clock.Now()
+}
+
+// withHTTPClient returns the request with the client the proxy's requests to
+// the provider are sent with in its context, if one was given
+func (p *OAuthProxy) withHTTPClient(req *http.Request) *http.Request {
+	if p.httpClient == nil {
+		return req
+	}
+	return req.WithContext(requests.WithHTTPClient(req.Context(), p.httpClient))
+}
+
 func (p *OAuthProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	req = p.withHTTPClient(req)
+	req, cancel := p.withRequestDeadline(req)
+	defer cancel()
+	if p.compression != nil && p.compression.applies(req) {
+		cw := p.compression.newWriter(rw)
+		defer cw.Close()
+		rw = cw
+	}
 	if strings.HasPrefix(req.URL.Path, p.ProxyPrefix) {
 		prepareNoCache(rw)
 	}
+	if p.cors != nil && p.isCORSPath(req.URL.Path) && p.cors.handle(rw, req) {
+		return
+	}
 
 	switch path := req.URL.Path; {
 	case path == p.RobotsPath:
 		p.RobotsTxt(rw)
 	case path == p.PingPath:
 		p.PingPage(rw)
+	case path == assertionKeysWellKnownPath && p.assertionSigner != nil:
+		p.AssertionKeys(rw, req)
+	case !strings.HasPrefix(path, p.ProxyPrefix+"/") && p.inMaintenance():
+		p.MaintenancePage(rw, req)
 	case p.IsWhitelistedRequest(req):
 		p.serveMux.ServeHTTP(rw, req)
 	case path == p.SignInPath:
@@ -677,6 +1050,20 @@ func (p *OAuthProxy) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		p.AuthenticateOnly(rw, req)
 	case path == p.UserInfoPath:
 		p.UserInfo(rw, req)
+	case path == p.ImpersonatePath:
+		p.Impersonate(rw, req)
+	case path == p.MachineTokensPath:
+		p.MachineTokens(rw, req)
+	case path == p.UserSessionsPath:
+		p.UserSessions(rw, req)
+	case path == p.WebAuthnPath || strings.HasPrefix(path, p.WebAuthnPath+"/"):
+		p.WebAuthn(rw, req)
+	case path == p.AssertionKeysPath:
+		p.AssertionKeys(rw, req)
+	case path == p.InterstitialPath:
+		p.Interstitial(rw, req)
+	case path == p.CookieHandoffPath:
+		p.CookieHandoff(rw, req)
 	default:
 		p.Proxy(rw, req)
 	}
@@ -693,9 +1080,16 @@ func (p *OAuthProxy) SignIn(rw http.ResponseWriter, req *http.Request) {
 
 	user, ok := p.ManualSignIn(rw, req)
 	if ok {
-		session := &sessionsapi.SessionState{User: user}
-		p.SaveSession(rw, req, session)
-		http.Redirect(rw, req, redirect, http.StatusFound)
+		session := &sessionsapi.SessionState{User: user, SignedInAt: p.now()}
+		if err := p.SaveSession(rw, req, session); err != nil {
+			logger.Printf("Error saving session: %s", err)
+			p.ErrorPage(rw, http.StatusInternalServerError, "Internal Error", "Internal Error")
+			return
+		}
+		p.notifyWebhook(webhookSignIn, req, session, "htpasswd", nil)
+		http.Redirect(rw, req, p.cookieHandoffRedirect(req, session, p.webAuthnRedirect(redirect)), http.StatusFound)
+	} else if provider, ok := p.provider.(providers.PasswordProvider); ok && req.Method == "POST" {
+		p.PasswordSignIn(rw, req, provider, redirect)
 	} else {
 		if p.SkipProviderButton {
 			p.OAuthStart(rw, req)
@@ -705,11 +1099,60 @@ func (p *OAuthProxy) SignIn(rw http.ResponseWriter, req *http.Request) {
 	}
 }
 
+// PasswordSignIn authenticates the username and password posted to the sign
+// in form with the provider
+func (p *OAuthProxy) PasswordSignIn(rw http.ResponseWriter, req *http.Request, provider providers.PasswordProvider, redirect string) {
+	user := req.FormValue("username")
+	session, err := provider.AuthenticatePassword(req.Context(), user, req.FormValue("password"))
+	if errors.Is(err, providers.ErrInvalidCredentials) {
+		logger.PrintAuthf(user, req, logger.AuthFailure, "Invalid authentication via %s", p.provider.Data().ProviderName)
+		p.SignInPage(rw, req, http.StatusUnauthorized)
+		return
+	} else if err != nil {
+		logger.Printf("Error authenticating %s: %s", user, err)
+		p.ErrorPage(rw, http.StatusInternalServerError, "Internal Error", "Internal Error")
+		return
+	}
+
+	p.groupMapping.apply(session)
+	if !p.isAllowedPasswordUser(session) {
+		logger.PrintAuthf(user, req, logger.AuthFailure, "Invalid authentication via %s: unauthorized email", p.provider.Data().ProviderName)
+		p.ErrorPage(rw, http.StatusForbidden, "Permission Denied", "Invalid Account")
+		return
+	}
+
+	logger.PrintAuthf(user, req, logger.AuthSuccess, "Authenticated via %s: %s", p.provider.Data().ProviderName, session)
+	session.SignedInAt = p.now()
+	if err := p.SaveSession(rw, req, session); errors.Is(err, sessionsapi.ErrSessionLimit) {
+		p.sessionLimitPage(rw, req, session, err)
+		return
+	} else if err != nil {
+		logger.Printf("Error saving session: %s", err)
+		p.ErrorPage(rw, http.StatusInternalServerError, "Internal Error", "Internal Error")
+		return
+	}
+	p.notifyWebhook(webhookSignIn, req, session, p.provider.Data().ProviderName, nil)
+	http.Redirect(rw, req, p.cookieHandoffRedirect(req, session, p.webAuthnRedirect(redirect)), http.StatusFound)
+}
+
+// sessionLimitPage rejects a sign in that would exceed the user's limit of
+// concurrent sessions
+func (p *OAuthProxy) sessionLimitPage(rw http.ResponseWriter, req *http.Request, session *sessionsapi.SessionState, err error) {
+	logger.PrintAuthf(session.Email, req, logger.AuthFailure, "Sign in rejected: %s", err)
+	p.ErrorPage(rw, http.StatusForbidden, "Permission Denied", "Too many active sessions, sign out of another session first")
+}
+
 //UserInfo endpoint outputs session email and preferred username in JSON format
 func (p *OAuthProxy) UserInfo(rw http.ResponseWriter, req *http.Request) {
 
 	session, err := p.getAuthenticatedSession(rw, req)
-	if err != nil {
+	if errors.Is(err, sessionsapi.ErrBackendUnavailable) {
+		http.Error(rw, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	} else if errors.Is(err, ErrRequestDeadline) {
+		http.Error(rw, http.StatusText(http.StatusGatewayTimeout), http.StatusGatewayTimeout)
+		return
+	} else if err != nil {
 		http.Error(rw, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
 		return
 	}
@@ -733,6 +1176,11 @@ func (p *OAuthProxy) SignOut(rw http.ResponseWriter, req *http.Request) {
 		p.ErrorPage(rw, 500, "Internal Error", err.Error())
 		return
 	}
+	if p.webhooks.wants(webhookSignOut) {
+		if session, err := p.LoadCookiedSession(req); err == nil {
+			p.notifyWebhook(webhookSignOut, req, session, p.provider.Data().ProviderName, nil)
+		}
+	}
 	p.ClearSessionCookie(rw, req)
 	http.Redirect(rw, req, redirect, http.StatusFound)
 }
@@ -740,12 +1188,41 @@ func (p *OAuthProxy) SignOut(rw http.ResponseWriter, req *http.Request) {
 // OAuthStart starts the OAuth2 authentication flow
 func (p *OAuthProxy) OAuthStart(rw http.ResponseWriter, req *http.Request) {
 	prepareNoCache(rw)
+	if p.isPasswordProvider() {
+		// there's nowhere to redirect to: users sign in with the form
+		redirect, err := p.GetRedirect(req)
+		if err != nil {
+			logger.Printf("Error obtaining redirect: %s", err.Error())
+			p.ErrorPage(rw, 500, "Internal Error", err.Error())
+			return
+		}
+		http.Redirect(rw, req, p.SignInPath+"?rd="+url.QueryEscape(redirect), http.StatusFound)
+		return
+	}
+	if !p.redirectHostAllowed(req.Host) {
+		logger.Printf("Rejecting sign in through %q: not a redirect host", req.Host)
+		p.ErrorPage(rw, http.StatusBadRequest, "Bad Request", "Unknown host")
+		return
+	}
+	if wait := p.loginCooldown(req); wait > 0 {
+		p.loginCooldownPage(rw, req, wait)
+		return
+	}
+	provider, tenant, ok := p.signInProvider(rw, req)
+	if !ok {
+		return
+	}
 	nonce, err := encryption.Nonce()
 	if err != nil {
 		logger.Printf("Error obtaining nonce: %s", err.Error())
 		p.ErrorPage(rw, 500, "Internal Error", err.Error())
 		return
 	}
+	if err := p.oauthStates.SaveState(req.Context(), nonce, p.oauthStateTTL); err != nil {
+		logger.Printf("Error saving OAuth state: %v", err)
+		p.ErrorPage(rw, 500, "Internal Error", "Internal Error")
+		return
+	}
 	p.SetCSRFCookie(rw, req, nonce)
 	redirect, err := p.GetRedirect(req)
 	if err != nil {
@@ -753,14 +1230,16 @@ func (p *OAuthProxy) OAuthStart(rw http.ResponseWriter, req *http.Request) {
 		p.ErrorPage(rw, 500, "Internal Error", err.Error())
 		return
 	}
-	redirectURI := p.GetRedirectURI(req.Host)
-	http.Redirect(rw, req, p.provider.GetLoginURL(redirectURI, fmt.Sprintf("%v:%v", nonce, redirect)), http.StatusFound)
+	redirectURI := p.tenantRedirectURI(req, tenant)
+	loginURL := loginHintURL(provider.GetLoginURL(redirectURI, fmt.Sprintf("%v:%v", nonce, redirect)), req)
+	loginURL = reauthLoginURL(loginURL, req)
+	http.Redirect(rw, req, p.stepUpLoginURL(loginURL, redirect), http.StatusFound)
 }
 
 // OAuthCallback is the OAuth2 authentication flow callback that finishes the
 // OAuth2 authentication flow
 func (p *OAuthProxy) OAuthCallback(rw http.ResponseWriter, req *http.Request) {
-	remoteAddr := getClientString(p.realClientIPParser, req, true)
+	remoteAddr := p.clientString(req)
 
 	// finish the oauth cycle
 	err := req.ParseForm()
@@ -776,13 +1255,6 @@ func (p *OAuthProxy) OAuthCallback(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	session, err := p.redeemCode(req.Context(), req.Host, req.Form.Get("code"))
-	if err != nil {
-		logger.Printf("Error redeeming code during OAuth2 callback: %s ", err.Error())
-		p.ErrorPage(rw, 500, "Internal Error", "Internal Error")
-		return
-	}
-
 	s := strings.SplitN(req.Form.Get("state"), ":", 2)
 	if len(s) != 2 {
 		logger.Printf("Error while parsing OAuth2 state: invalid length")
@@ -791,16 +1263,33 @@ func (p *OAuthProxy) OAuthCallback(rw http.ResponseWriter, req *http.Request) {
 	}
 	nonce := s[0]
 	redirect := s[1]
-	c, err := req.Cookie(p.CSRFCookieName)
-	if err != nil {
-		logger.PrintAuthf(session.Email, req, logger.AuthFailure, "Invalid authentication via OAuth2: unable too obtain CSRF cookie")
-		p.ErrorPage(rw, 403, "Permission Denied", err.Error())
+	if !p.redirectHostAllowed(req.Host) {
+		logger.Printf("Rejecting OAuth2 callback to %q: not a redirect host", req.Host)
+		p.ErrorPage(rw, http.StatusBadRequest, "Bad Request", "Unknown host")
 		return
 	}
-	p.ClearCSRFCookie(rw, req)
-	if c.Value != nonce {
-		logger.PrintAuthf(session.Email, req, logger.AuthFailure, "Invalid authentication via OAuth2: csrf token mismatch, potential attack")
-		p.ErrorPage(rw, 403, "Permission Denied", "csrf failed")
+	if !p.checkOAuthState(rw, req, nonce) {
+		return
+	}
+
+	provider, tenant, ok := p.signInProvider(rw, req)
+	if !ok {
+		return
+	}
+	session, err := p.redeemCode(p.redeemContext(req), provider, p.tenantRedirectURI(req, tenant), req.Form.Get("code"))
+	var unverified *providers.UnverifiedEmailError
+	if errors.As(err, &unverified) {
+		logger.PrintAuthf(unverified.Email, req, logger.AuthFailure, "Invalid authentication via OAuth2: %s", err)
+		p.failedLogin(rw, req, unverified.Email)
+		p.ErrorPage(rw, 403, "Permission Denied", "Unverified Email")
+		return
+	} else if errors.Is(err, providers.ErrMissingCode) || errors.Is(err, providers.ErrRedeem) {
+		logger.Printf("Error redeeming code during OAuth2 callback: %s ", err.Error())
+		p.ErrorPage(rw, 403, "Permission Denied", "Unable to redeem code")
+		return
+	} else if err != nil {
+		logger.Printf("Error redeeming code during OAuth2 callback: %s ", err.Error())
+		p.ErrorPage(rw, 500, "Internal Error", "Internal Error")
 		return
 	}
 
@@ -809,17 +1298,31 @@ func (p *OAuthProxy) OAuthCallback(rw http.ResponseWriter, req *http.Request) {
 	}
 
 	// set cookie, or deny
-	if p.Validator(session.Email) && p.provider.ValidateGroup(session.Email) {
+	if p.isAllowedUser(session) && provider.ValidateGroup(req.Context(), session.Email) {
 		logger.PrintAuthf(session.Email, req, logger.AuthSuccess, "Authenticated via OAuth2: %s", session)
+		session.Tenant = tenant
+		session.SignedInAt = p.now()
 		err := p.SaveSession(rw, req, session)
-		if err != nil {
+		if errors.Is(err, sessionsapi.ErrSessionLimit) {
+			p.sessionLimitPage(rw, req, session, err)
+			return
+		} else if err != nil {
 			logger.Printf("%s %s", remoteAddr, err)
 			p.ErrorPage(rw, 500, "Internal Error", "Internal Error")
 			return
 		}
-		http.Redirect(rw, req, redirect, http.StatusFound)
+		p.succeededLogin(rw, req, throttledUser(session))
+		p.notifyWebhook(webhookSignIn, req, session, provider.Data().ProviderName, nil)
+		// going back would only start the flow again
+		if acr := p.redirectACR(redirect); !p.satisfiesACR(session, acr) {
+			logger.PrintAuthf(session.Email, req, logger.AuthFailure, "Provider authenticated with acr %q, not the %q required for %s", session.ACR, acr, redirect)
+			p.ErrorPage(rw, http.StatusForbidden, "Permission Denied", "A stronger sign in method is required")
+			return
+		}
+		http.Redirect(rw, req, p.cookieHandoffRedirect(req, session, p.webAuthnRedirect(redirect)), http.StatusFound)
 	} else {
 		logger.PrintAuthf(session.Email, req, logger.AuthFailure, "Invalid authentication via OAuth2: unauthorized")
+		p.failedLogin(rw, req, throttledUser(session))
 		p.ErrorPage(rw, 403, "Permission Denied", "Invalid Account")
 	}
 }
@@ -827,7 +1330,16 @@ func (p *OAuthProxy) OAuthCallback(rw http.ResponseWriter, req *http.Request) {
 // AuthenticateOnly checks whether the user is currently logged in
 func (p *OAuthProxy) AuthenticateOnly(rw http.ResponseWriter, req *http.Request) {
 	session, err := p.getAuthenticatedSession(rw, req)
-	if err != nil {
+	if errors.Is(err, sessionsapi.ErrBackendUnavailable) {
+		http.Error(rw, "session store unavailable", http.StatusServiceUnavailable)
+		return
+	} else if errors.Is(err, ErrOutsideAccessWindow) {
+		http.Error(rw, "outside access window", http.StatusForbidden)
+		return
+	} else if errors.Is(err, ErrRequestDeadline) {
+		http.Error(rw, "request deadline exceeded", http.StatusGatewayTimeout)
+		return
+	} else if err != nil {
 		http.Error(rw, "unauthorized request", http.StatusUnauthorized)
 		return
 	}
@@ -840,43 +1352,204 @@ func (p *OAuthProxy) AuthenticateOnly(rw http.ResponseWriter, req *http.Request)
 // Proxy proxies the user request if the user is authenticated else it prompts
 // them to authenticate
 func (p *OAuthProxy) Proxy(rw http.ResponseWriter, req *http.Request) {
-	session, err := p.getAuthenticatedSession(rw, req)
-	switch err {
-	case nil:
-		// we are authenticated
-		p.addHeadersForProxying(rw, req, session)
-		p.serveMux.ServeHTTP(rw, req)
+	p.proxyHandler.ServeHTTP(rw, req)
+}
+
+// loadSession is the middleware that loads the user's session into the
+// request scope
+func (p *OAuthProxy) loadSession(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		scope := middleware.GetRequestScope(req)
+		scope.Session, scope.SessionError = p.getAuthenticatedSession(rw, req)
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// authorize is the middleware that prevents requests without a valid session
+// from reaching the upstream, prompting the user to authenticate instead
+func (p *OAuthProxy) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch err := middleware.GetRequestScope(req).SessionError; {
+		case err == nil:
+			// we are authenticated
+			next.ServeHTTP(rw, req)
+
+		case errors.Is(err, ErrNeedsLogin) && p.IsAnonymousPath(req.URL.Path):
+			// let the upstream decide what anonymous users may see
+			middleware.GetRequestScope(req).Session = &sessionsapi.SessionState{User: anonymousUser}
+			next.ServeHTTP(rw, req)
+
+		case errors.Is(err, ErrSessionMissing):
+			// the user's stale cookie has been cleared
+			p.missingSession(rw, req)
+
+		case errors.Is(err, ErrNeedsLogin):
+			p.needsLogin(rw, req)
+
+		case errors.Is(err, ErrNeedsStepUp):
+			// sign in again, asking the provider for a stronger method
+			if isAjax(req) {
+				p.ErrorJSON(rw, http.StatusUnauthorized)
+				return
+			}
+			http.Redirect(rw, req, p.OAuthStartPath+"?rd="+url.QueryEscape(req.URL.RequestURI()), http.StatusFound)
+
+		case errors.Is(err, ErrNeedsWebAuthn):
+			// the user must verify their session before continuing
+			if isAjax(req) {
+				p.ErrorJSON(rw, http.StatusUnauthorized)
+				return
+			}
+			http.Redirect(rw, req, p.WebAuthnPath+"?rd="+url.QueryEscape(req.URL.RequestURI()), http.StatusFound)
+
+		case errors.Is(err, ErrNeedsInterstitial):
+			// the user must accept the route's interstitial page first
+			if isAjax(req) {
+				p.ErrorJSON(rw, http.StatusUnauthorized)
+				return
+			}
+			http.Redirect(rw, req, p.InterstitialPath+"?rd="+url.QueryEscape(req.URL.RequestURI()), http.StatusFound)
+
+		case errors.Is(err, ErrOutsideAccessWindow):
+			// the user may only access the route at other times
+			if isAjax(req) {
+				p.ErrorJSON(rw, http.StatusForbidden)
+				return
+			}
+			p.ErrorPage(rw, http.StatusForbidden,
+				"Permission Denied", "Access to this page isn't permitted at this time")
+
+		case errors.Is(err, ErrRequestDeadline):
+			// the session store or provider took too long
+			p.deadlinePage(rw, req)
+
+		case errors.Is(err, sessionsapi.ErrBackendUnavailable):
+			// we can't tell whether the user has a session
+			logger.Printf("Session store unavailable: %s", err)
+			p.ErrorPage(rw, http.StatusServiceUnavailable,
+				"Service Unavailable", "Service Unavailable")
 
-	case ErrNeedsLogin:
-		// we need to send the user to a login screen
-		if isAjax(req) {
-			// no point redirecting an AJAX request
-			p.ErrorJSON(rw, http.StatusUnauthorized)
+		default:
+			// unknown error
+			logger.Printf("Unexpected internal error: %s", err)
+			p.ErrorPage(rw, http.StatusInternalServerError,
+				"Internal Error", "Internal Error")
+		}
+	})
+}
+
+// needsLogin sends the user to a login screen
+func (p *OAuthProxy) needsLogin(rw http.ResponseWriter, req *http.Request) {
+	if isAjax(req) {
+		// no point redirecting an AJAX request
+		p.ErrorJSON(rw, http.StatusUnauthorized)
+		return
+	}
+
+	if p.SkipProviderButton {
+		p.OAuthStart(rw, req)
+	} else {
+		p.SignInPage(rw, req, http.StatusForbidden)
+	}
+}
+
+// injectHeaders is the middleware that adds the user's identity to the
+// request for the upstream
+func (p *OAuthProxy) injectHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		original := req.Header.Clone()
+		p.addHeadersForProxying(rw, req, middleware.GetRequestScope(req).Session)
+		p.forwardTraceHeaders(req, original)
+		if !p.checkHeaderSize(rw, req, original) {
 			return
 		}
+		next.ServeHTTP(rw, req)
+	})
+}
 
-		if p.SkipProviderButton {
-			p.OAuthStart(rw, req)
-		} else {
-			p.SignInPage(rw, req, http.StatusForbidden)
+// droppableHeaders are the headers carrying tokens that may be removed to
+// bring a request within the upstream header size limit, in the order they
+// are removed
+var droppableHeaders = []string{"X-Forwarded-Access-Token", "Authorization"}
+
+// checkHeaderSize enforces the upstream header size limit once the user's
+// identity has been added to the request. With the "drop" policy the token
+// headers added by the proxy are removed until the request fits; requests
+// still over the limit are rejected with a 431 error, rather than leaving the
+// upstream to fail on them. It returns false if the request was rejected.
+func (p *OAuthProxy) checkHeaderSize(rw http.ResponseWriter, req *http.Request, original http.Header) bool {
+	if p.headerSizeLimit == 0 {
+		return true
+	}
+	size := headerSize(req.Header)
+	if size <= p.headerSizeLimit {
+		return true
+	}
+
+	if p.headerSizePolicy == "drop" {
+		for _, name := range droppableHeaders {
+			if size <= p.headerSizeLimit {
+				break
+			}
+			added := req.Header.Get(name)
+			if added == "" || added == original.Get(name) {
+				continue
+			}
+			logger.Printf("Dropping %s header for %s: request headers are %d bytes, over the limit of %d", name, req.URL.Path, size, p.headerSizeLimit)
+			req.Header.Del(name)
+			size = headerSize(req.Header)
+		}
+		if size <= p.headerSizeLimit {
+			return true
 		}
+	}
 
-	default:
-		// unknown error
-		logger.Printf("Unexpected internal error: %s", err)
-		p.ErrorPage(rw, http.StatusInternalServerError,
-			"Internal Error", "Internal Error")
+	logger.Printf("Rejecting request for %s: request headers are %d bytes, over the limit of %d", req.URL.Path, size, p.headerSizeLimit)
+	p.ErrorPage(rw, http.StatusRequestHeaderFieldsTooLarge, "Request Header Fields Too Large",
+		"The request headers, including your session's tokens, are too large to be sent to the application.")
+	return false
+}
+
+// headerSize is the number of bytes the header fields take on the wire
+func headerSize(h http.Header) int {
+	size := 0
+	for name, values := range h {
+		for _, v := range values {
+			size += len(name) + len(v) + len(": \r\n")
+		}
 	}
+	return size
+}
 
+// clientString returns the client address recorded in the request scope,
+// falling back to parsing the request if it has not been recorded
+func (p *OAuthProxy) clientString(req *http.Request) string {
+	if scope := middleware.GetRequestScope(req); scope != nil && scope.ClientIP != "" {
+		return scope.ClientIP
+	}
+	return getClientString(p.realClientIPParser, req, true)
 }
 
 // getAuthenticatedSession checks whether a user is authenticated and returns a session object and nil error if so
 // Returns nil, ErrNeedsLogin if user needs to login.
+// Returns nil, ErrNeedsStepUp if the user must authenticate again with a stronger method.
+// Returns nil, ErrNeedsWebAuthn if the user's session must be verified with a WebAuthn credential.
+// Returns nil, ErrNeedsInterstitial if the user must accept an interstitial page for the route.
+// Returns an error wrapping sessionsapi.ErrBackendUnavailable if the session store could not be reached.
 // Set-Cookie headers may be set on the response as a side-effect of calling this method.
 func (p *OAuthProxy) getAuthenticatedSession(rw http.ResponseWriter, req *http.Request) (*sessionsapi.SessionState, error) {
 	var session *sessionsapi.SessionState
 	var err error
-	var saveSession, clearSession, revalidated bool
+	var saveSession, clearSession, revalidated, cookieSession, touchSession, inGrace, missing bool
+	provider := p.provider
+	// embedders may load sessions without going through ServeHTTP
+	req = p.withHTTPClient(req)
+
+	if p.machineTokens != nil {
+		if token, ok := machineTokenFromRequest(req); ok {
+			return p.getMachineTokenSession(req, token)
+		}
+	}
 
 	if p.skipJwtBearerTokens && req.Header.Get("Authorization") != "" {
 		session, err = p.GetJwtSession(req)
@@ -888,56 +1561,136 @@ func (p *OAuthProxy) getAuthenticatedSession(rw http.ResponseWriter, req *http.R
 		}
 	}
 
-	remoteAddr := getClientString(p.realClientIPParser, req, true)
+	remoteAddr := p.clientString(req)
 	if session == nil {
+		setRequestStage(req, stageSession)
 		session, err = p.LoadCookiedSession(req)
-		if err != nil {
+		if _, timedOut := timedOutStage(req); err != nil && timedOut {
+			return nil, ErrRequestDeadline
+		} else if errors.Is(err, sessionsapi.ErrBackendUnavailable) {
 			logger.Printf("Error loading cookied session: %s", err)
+			return nil, err
+		} else if err != nil {
+			// Sessions saved before migrating session stores or rotating the
+			// cookie secret are saved again to the current store
+			if session = p.loadPreviousSession(req); session != nil {
+				saveSession = true
+			} else if errors.Is(err, sessionsapi.ErrExpired) {
+				// The cookie is valid but its session is gone, so the
+				// cookie is cleared rather than presented again
+				logger.PrintfRequest(req, "%s session missing from the store: removing session cookie", remoteAddr)
+				sessionsMissing.Add(1)
+				clearSession = true
+				missing = true
+			} else if !errors.Is(err, sessionsapi.ErrNotFound) {
+				logger.Printf("Error loading cookied session: %s", err)
+			}
+		}
+		cookieSession = session != nil
+
+		if session != nil && p.sessionTLSBinding && !isBoundToConnection(req, session) {
+			logger.PrintAuthf(session.Email, req, logger.AuthFailure, "Session cookie presented on a different TLS connection: removing session")
+			session = nil
+			clearSession = true
+		}
+
+		if session != nil && p.tenants != nil && !p.tenants.allowsSession(req, session) {
+			logger.PrintAuthf(session.Email, req, logger.AuthFailure, "Session for tenant %q presented to another tenant: removing session", session.Tenant)
+			session = nil
+			clearSession = true
+		}
+
+		if session != nil && p.sessionIdleTimeout > 0 {
+			if session.IsIdleAt(p.sessionIdleTimeout, p.now()) {
+				logger.PrintAuthf(session.Email, req, logger.AuthFailure, "Session idle since %s: removing session", session.LastSeen)
+				session = nil
+				clearSession = true
+			} else if p.now().Sub(session.LastSeen) > p.sessionIdleTimeout/sessionTouchDivisor {
+				// Saving the session on every request would be costly,
+				// so it's only saved again once it has been idle a while
+				touchSession = true
+			}
 		}
 
 		if session != nil {
-			if session.Age() > p.CookieRefresh && p.CookieRefresh != time.Duration(0) {
-				logger.Printf("Refreshing %s old session cookie for %s (refresh after %s)", session.Age(), session, p.CookieRefresh)
+			provider, err = p.sessionProvider(session)
+			if err != nil {
+				logger.Printf("Error loading provider for session: %s", err)
+				return nil, err
+			}
+			p.setLogFields(req, session, provider)
+
+			if age := session.AgeAt(p.now()); age > p.CookieRefresh && p.CookieRefresh != time.Duration(0) {
+				logger.PrintfRequest(req, "Refreshing %s old session cookie for %s (refresh after %s)", age, session, p.CookieRefresh)
 				saveSession = true
 			}
 
-			if ok, err := p.provider.RefreshSessionIfNeeded(req.Context(), session); err != nil {
-				logger.Printf("%s removing session. error refreshing access token %s %s", remoteAddr, err, session)
+			setRequestStage(req, stageRefresh)
+			ok, err := provider.RefreshSessionIfNeeded(p.redeemContext(req), session)
+			if _, timedOut := timedOutStage(req); err != nil && timedOut {
+				// the session is kept to be refreshed on the next request
+				return nil, ErrRequestDeadline
+			} else if err != nil && p.inRefreshGrace(session, err) {
+				// Rather than sign everyone out during a provider outage,
+				// keep using the session and try refreshing it again on the
+				// next request
+				logger.PrintfRequest(req, "WARNING: %s keeping session in its refresh grace period. error refreshing access token %s %s", remoteAddr, err, session)
+				refreshGraceServed.Add(1)
+				saveSession = false
+				inGrace = true
+			} else if err != nil {
+				reason := "error refreshing access token"
+				if errors.Is(err, providers.ErrInvalidGrant) {
+					reason = "refresh token rejected by the provider"
+				}
+				logger.PrintfRequest(req, "%s removing session. %s %s %s", remoteAddr, reason, err, session)
+				p.notifyWebhook(webhookRefreshFailure, req, session, provider.Data().ProviderName, err)
 				clearSession = true
 				session = nil
 			} else if ok {
+				p.groupMapping.apply(session)
 				saveSession = true
 				revalidated = true
 			}
 		}
 	}
 
-	if session != nil && session.IsExpired() {
-		logger.Printf("Removing session: token expired %s", session)
+	if session != nil && !inGrace && session.IsExpired() {
+		logger.PrintfRequest(req, "Removing session: token expired %s", session)
 		session = nil
 		saveSession = false
 		clearSession = true
 	}
 
 	if saveSession && !revalidated && session != nil && session.AccessToken != "" {
-		if !p.provider.ValidateSessionState(req.Context(), session) {
-			logger.Printf("Removing session: error validating %s", session)
+		if !provider.ValidateSessionState(req.Context(), session) {
+			logger.PrintfRequest(req, "Removing session: error validating %s", session)
 			saveSession = false
 			session = nil
 			clearSession = true
 		}
 	}
 
-	if session != nil && session.Email != "" && !p.Validator(session.Email) {
+	if session != nil && session.Email != "" && !p.isAllowedUser(session) {
 		logger.Printf(session.Email, req, logger.AuthFailure, "Invalid authentication via session: removing session %s", session)
 		session = nil
 		saveSession = false
 		clearSession = true
 	}
 
-	if saveSession && session != nil {
+	if session != nil && session.IsImpersonated() && !p.isImpersonationAdmin(session.Impersonator, session.ImpersonatorGroups) {
+		logger.PrintAuthf(session.Impersonator, req, logger.AuthFailure, "Impersonation of %s no longer permitted: removing session", session.Email)
+		session = nil
+		saveSession = false
+		clearSession = true
+	}
+
+	if (saveSession || touchSession) && session != nil {
+		setRequestStage(req, stageSession)
 		err = p.SaveSession(rw, req, session)
-		if err != nil {
+		if _, timedOut := timedOutStage(req); err != nil && timedOut {
+			return nil, ErrRequestDeadline
+		} else if err != nil {
 			logger.PrintAuthf(session.Email, req, logger.AuthError, "Save session error %s", err)
 			return nil, err
 		}
@@ -947,6 +1700,17 @@ func (p *OAuthProxy) getAuthenticatedSession(rw http.ResponseWriter, req *http.R
 		p.ClearSessionCookie(rw, req)
 	}
 
+	if session != nil && cookieSession && p.requiresStepUp(req, session) {
+		logger.PrintAuthf(session.Email, req, logger.AuthFailure, "Session with acr %q needs step-up authentication", session.ACR)
+		return nil, ErrNeedsStepUp
+	}
+	if session != nil && cookieSession && p.requiresWebAuthn(req, session) {
+		return nil, ErrNeedsWebAuthn
+	}
+	if session != nil && cookieSession && p.pendingInterstitial(p.policyPath(req), session) != nil {
+		return nil, ErrNeedsInterstitial
+	}
+
 	if session == nil {
 		session, err = p.CheckBasicAuth(req)
 		if err != nil {
@@ -954,15 +1718,30 @@ func (p *OAuthProxy) getAuthenticatedSession(rw http.ResponseWriter, req *http.R
 		}
 	}
 
+	if session == nil && missing {
+		return nil, ErrSessionMissing
+	}
 	if session == nil {
 		return nil, ErrNeedsLogin
 	}
+	if w := p.closedAccessWindow(req, session); w != nil {
+		logger.PrintAuthf(session.Email, req, logger.AuthFailure, "Request outside access window %s", w)
+		return nil, ErrOutsideAccessWindow
+	}
+	if !cookieSession {
+		p.setLogFields(req, session, nil)
+	}
 
 	return session, nil
 }
 
 // addHeadersForProxying adds the appropriate headers the request / response for proxying
 func (p *OAuthProxy) addHeadersForProxying(rw http.ResponseWriter, req *http.Request, session *sessionsapi.SessionState) {
+	// Machine tokens are long lived so must not be passed on
+	if _, ok := machineTokenFromRequest(req); ok {
+		req.Header.Del("Authorization")
+	}
+
 	if p.PassBasicAuth {
 		if p.PreferEmailToUser && session.Email != "" {
 			req.SetBasicAuth(session.Email, p.BasicAuthPassword)
@@ -1066,6 +1845,42 @@ func (p *OAuthProxy) addHeadersForProxying(rw http.ResponseWriter, req *http.Req
 	} else {
 		rw.Header().Set("GAP-Auth", session.Email)
 	}
+
+	if p.PassUserHeaders && len(session.Groups) > 0 {
+		req.Header["X-Forwarded-Groups"] = session.Groups
+	} else {
+		req.Header.Del("X-Forwarded-Groups")
+	}
+	if p.SetXAuthRequest && len(session.Groups) > 0 {
+		rw.Header()["X-Auth-Request-Groups"] = session.Groups
+	} else {
+		rw.Header().Del("X-Auth-Request-Groups")
+	}
+
+	if session.IsImpersonated() {
+		req.Header["X-Forwarded-Impersonated-By"] = []string{session.Impersonator}
+		if p.SetXAuthRequest {
+			rw.Header().Set("X-Auth-Request-Impersonated-By", session.Impersonator)
+		}
+	} else {
+		req.Header.Del("X-Forwarded-Impersonated-By")
+		rw.Header().Del("X-Auth-Request-Impersonated-By")
+	}
+
+	if session.MachineToken != "" {
+		req.Header["X-Forwarded-Machine-Token-Id"] = []string{session.MachineToken}
+		if p.SetXAuthRequest {
+			rw.Header().Set("X-Auth-Request-Machine-Token-Id", session.MachineToken)
+		}
+	} else {
+		req.Header.Del("X-Forwarded-Machine-Token-Id")
+		rw.Header().Del("X-Auth-Request-Machine-Token-Id")
+	}
+
+	p.addIdentityHeaders(rw, req, session)
+	p.addTemplatedHeaders(rw, req, session)
+	p.addAssertionHeader(rw, req, session)
+	p.addBaggage(rw, req, session)
 }
 
 // CheckBasicAuth checks the requests Authorization header for basic auth
@@ -1132,7 +1947,9 @@ func (p *OAuthProxy) GetJwtSession(req *http.Request) (*sessionsapi.SessionState
 			continue
 		}
 
-		return p.provider.CreateSessionStateFromBearerToken(req.Context(), rawBearerToken, bearerToken)
+		session, err := p.provider.CreateSessionStateFromBearerToken(req.Context(), rawBearerToken, bearerToken)
+		p.groupMapping.apply(session)
+		return session, err
 	}
 	return nil, fmt.Errorf("unable to verify jwt token %s", req.Header.Get("Authorization"))
 }
@@ -1,9 +1,11 @@
-package main
+package oauth2proxy
 
 import (
+	"bytes"
 	"context"
 	"crypto"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -11,6 +13,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"os"
 	"regexp"
 	"strings"
 	"testing"
@@ -19,7 +22,9 @@ import (
 	"github.com/coreos/go-oidc"
 	"github.com/mbland/hmacauth"
 	"github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/cookies"
 	"github.com/oauth2-proxy/oauth2-proxy/pkg/logger"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/middleware"
 	"github.com/oauth2-proxy/oauth2-proxy/pkg/sessions/cookie"
 	"github.com/oauth2-proxy/oauth2-proxy/providers"
 	"github.com/stretchr/testify/assert"
@@ -167,7 +172,8 @@ func TestRobotsTxt(t *testing.T) {
 	opts.Cookie.Secret = "asdkugkj"
 	opts.Validate()
 
-	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+	proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+	require.NoError(t, err)
 	rw := httptest.NewRecorder()
 	req, _ := http.NewRequest("GET", "/robots.txt", nil)
 	proxy.ServeHTTP(rw, req)
@@ -191,7 +197,8 @@ func TestIsValidRedirect(t *testing.T) {
 	}
 	opts.Validate()
 
-	proxy := NewOAuthProxy(opts, func(string) bool { return true })
+	proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+	require.NoError(t, err)
 
 	testCases := []struct {
 		Desc, Redirect string
@@ -431,10 +438,51 @@ func (tp *TestProvider) GetEmailAddress(ctx context.Context, session *sessions.S
 	return tp.EmailAddress, nil
 }
 
+func (tp *TestProvider) ValidateGroup(ctx context.Context, email string) bool {
+	return tp.GroupValidator(email)
+}
+
 func (tp *TestProvider) ValidateSessionState(ctx context.Context, session *sessions.SessionState) bool {
 	return tp.ValidToken
 }
 
+func TestOAuthCallbackRedeemRejected(t *testing.T) {
+	providerServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": "invalid_grant"}`))
+	}))
+	defer providerServer.Close()
+
+	opts := NewOptions()
+	opts.Cookie.Secret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	opts.ClientID = "dlgkj"
+	opts.ClientSecret = "alkgret"
+	opts.EmailDomains = []string{"*"}
+	assert.NoError(t, opts.Validate())
+
+	providerURL, _ := url.Parse(providerServer.URL)
+	opts.provider = NewTestProvider(providerURL, "john.doe@example.com")
+	proxy, err := NewOAuthProxy(opts, func(email string) bool { return true })
+	require.NoError(t, err)
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/oauth2/callback?code=reused_code&state=nonce:", nil)
+	req.AddCookie(proxy.MakeCSRFCookie(req, "nonce", proxy.CookieExpire, time.Now()))
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+}
+
+func TestCSRFCookieNameFollowsScope(t *testing.T) {
+	pcTest := NewProcessCookieTestWithOptionsModifiers(func(opts *Options) {
+		opts.Cookie.NameScope = "host"
+	})
+
+	req := httptest.NewRequest("GET", "http://app.example.com/oauth2/start", nil)
+	c := pcTest.proxy.MakeCSRFCookie(req, "nonce", time.Hour, time.Now())
+	assert.Equal(t, cookies.GetCookieName(req, &pcTest.opts.Cookie)+"_csrf", c.Name)
+	assert.NotEqual(t, pcTest.proxy.CSRFCookieName, c.Name)
+}
+
 func TestBasicAuthPassword(t *testing.T) {
 	providerServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		logger.Printf("%#v", r)
@@ -470,9 +518,10 @@ func TestBasicAuthPassword(t *testing.T) {
 	const emailAddress = "john.doe@example.com"
 
 	opts.provider = NewTestProvider(providerURL, emailAddress)
-	proxy := NewOAuthProxy(opts, func(email string) bool {
+	proxy, err := NewOAuthProxy(opts, func(email string) bool {
 		return email == emailAddress
 	})
+	require.NoError(t, err)
 
 	rw := httptest.NewRecorder()
 	req, _ := http.NewRequest("GET", "/oauth2/callback?code=callback_code&state=nonce:",
@@ -541,9 +590,10 @@ func TestBasicAuthWithEmail(t *testing.T) {
 	{
 		rw := httptest.NewRecorder()
 		req, _ := http.NewRequest("GET", opts.ProxyPrefix+"/testCase0", nil)
-		proxy := NewOAuthProxy(opts, func(email string) bool {
+		proxy, err := NewOAuthProxy(opts, func(email string) bool {
 			return email == emailAddress
 		})
+		require.NoError(t, err)
 		proxy.addHeadersForProxying(rw, req, session)
 		assert.Equal(t, expectedUserHeader, req.Header["Authorization"][0])
 		assert.Equal(t, userName, req.Header["X-Forwarded-User"][0])
@@ -554,9 +604,10 @@ func TestBasicAuthWithEmail(t *testing.T) {
 		rw := httptest.NewRecorder()
 		req, _ := http.NewRequest("GET", opts.ProxyPrefix+"/testCase1", nil)
 
-		proxy := NewOAuthProxy(opts, func(email string) bool {
+		proxy, err := NewOAuthProxy(opts, func(email string) bool {
 			return email == emailAddress
 		})
+		require.NoError(t, err)
 		proxy.addHeadersForProxying(rw, req, session)
 		assert.Equal(t, expectedEmailHeader, req.Header["Authorization"][0])
 		assert.Equal(t, emailAddress, req.Header["X-Forwarded-User"][0])
@@ -582,9 +633,10 @@ func TestPassUserHeadersWithEmail(t *testing.T) {
 	{
 		rw := httptest.NewRecorder()
 		req, _ := http.NewRequest("GET", opts.ProxyPrefix+"/testCase0", nil)
-		proxy := NewOAuthProxy(opts, func(email string) bool {
+		proxy, err := NewOAuthProxy(opts, func(email string) bool {
 			return email == emailAddress
 		})
+		require.NoError(t, err)
 		proxy.addHeadersForProxying(rw, req, session)
 		assert.Equal(t, userName, req.Header["X-Forwarded-User"][0])
 	}
@@ -594,14 +646,106 @@ func TestPassUserHeadersWithEmail(t *testing.T) {
 		rw := httptest.NewRecorder()
 		req, _ := http.NewRequest("GET", opts.ProxyPrefix+"/testCase1", nil)
 
-		proxy := NewOAuthProxy(opts, func(email string) bool {
+		proxy, err := NewOAuthProxy(opts, func(email string) bool {
 			return email == emailAddress
 		})
+		require.NoError(t, err)
 		proxy.addHeadersForProxying(rw, req, session)
 		assert.Equal(t, emailAddress, req.Header["X-Forwarded-User"][0])
 	}
 }
 
+func TestUpstreamHeaderSizeLimit(t *testing.T) {
+	session := &sessions.SessionState{
+		User:        "john.doe",
+		Email:       "john.doe@example.com",
+		AccessToken: strings.Repeat("a", 2000),
+		IDToken:     strings.Repeat("i", 200),
+		CreatedAt:   time.Now(),
+	}
+
+	tests := []struct {
+		name           string
+		limit          int
+		policy         string
+		expectedStatus int
+		accessToken    bool
+		authorization  bool
+	}{
+		{"no limit", 0, "reject", http.StatusOK, true, true},
+		{"within the limit", 4096, "reject", http.StatusOK, true, true},
+		{"rejected over the limit", 1024, "reject", http.StatusRequestHeaderFieldsTooLarge, false, false},
+		{"access token dropped", 1024, "drop", http.StatusOK, false, true},
+		{"all tokens dropped", 128, "drop", http.StatusOK, false, false},
+		{"rejected when tokens are not enough", 16, "drop", http.StatusRequestHeaderFieldsTooLarge, false, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			opts := NewOptions()
+			opts.PassAccessToken = true
+			opts.PassAuthorization = true
+			opts.UpstreamHeaderSizeLimit = test.limit
+			opts.UpstreamHeaderSizePolicy = test.policy
+			opts.Validate()
+			proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+			require.NoError(t, err)
+
+			var upstreamHeaders http.Header
+			setSession := func(next http.Handler) http.Handler {
+				return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+					middleware.GetRequestScope(req).Session = session
+					next.ServeHTTP(rw, req)
+				})
+			}
+			handler := middleware.NewChain(middleware.NewScope(), setSession, proxy.injectHeaders).
+				ThenFunc(func(rw http.ResponseWriter, req *http.Request) {
+					upstreamHeaders = req.Header
+				})
+
+			rw := httptest.NewRecorder()
+			handler.ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+
+			assert.Equal(t, test.expectedStatus, rw.Code)
+			if test.expectedStatus != http.StatusOK {
+				assert.Nil(t, upstreamHeaders)
+				return
+			}
+			assert.Equal(t, "john.doe", upstreamHeaders.Get("X-Forwarded-User"))
+			assert.Equal(t, test.accessToken, upstreamHeaders.Get("X-Forwarded-Access-Token") != "")
+			assert.Equal(t, test.authorization, upstreamHeaders.Get("Authorization") != "")
+		})
+	}
+}
+
+func TestRedeemContextClientHeaders(t *testing.T) {
+	var received http.Header
+	providerServer := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		received = req.Header
+		rw.Write([]byte(`{"access_token": "my_auth_token"}`))
+	}))
+	defer providerServer.Close()
+
+	opts := NewOptions()
+	opts.RedeemClientHeaders = []string{"x-forwarded-for", "X-Device-Id", "X-Not-Sent"}
+	opts.Validate()
+	proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("GET", "/oauth2/callback", nil)
+	req.RemoteAddr = "192.0.2.1:4321"
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+	req.Header.Set("X-Device-Id", "device-1")
+
+	redeemURL, _ := url.Parse(providerServer.URL)
+	provider := &providers.ProviderData{RedeemURL: redeemURL, ClientSecret: "secret"}
+	_, err = provider.Redeem(proxy.redeemContext(req), "https://example.com/oauth2/callback", "code")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"203.0.113.7", "192.0.2.1"}, received.Values("X-Forwarded-For"))
+	assert.Equal(t, "device-1", received.Get("X-Device-Id"))
+	assert.NotContains(t, received, "X-Not-Sent")
+}
+
 type PassAccessTokenTest struct {
 	providerServer *httptest.Server
 	proxy          *OAuthProxy
@@ -650,9 +794,13 @@ func NewPassAccessTokenTest(opts PassAccessTokenTestOptions) *PassAccessTokenTes
 	const emailAddress = "michael.bland@gsa.gov"
 
 	t.opts.provider = NewTestProvider(providerURL, emailAddress)
-	t.proxy = NewOAuthProxy(t.opts, func(email string) bool {
+	var err error
+	t.proxy, err = NewOAuthProxy(t.opts, func(email string) bool {
 		return email == emailAddress
 	})
+	if err != nil {
+		panic(err)
+	}
 	return t
 }
 
@@ -798,9 +946,13 @@ func NewSignInPageTest(skipProvider bool) *SignInPageTest {
 	sipTest.opts.SkipProviderButton = skipProvider
 	sipTest.opts.Validate()
 
-	sipTest.proxy = NewOAuthProxy(sipTest.opts, func(email string) bool {
+	var err error
+	sipTest.proxy, err = NewOAuthProxy(sipTest.opts, func(email string) bool {
 		return true
 	})
+	if err != nil {
+		panic(err)
+	}
 	sipTest.signInRegexp = regexp.MustCompile(signInRedirectPattern)
 	sipTest.signInProviderRegexp = regexp.MustCompile(signInSkipProvider)
 
@@ -904,9 +1056,13 @@ func NewProcessCookieTest(opts ProcessCookieTestOpts, modifiers ...OptionsModifi
 	pcTest.opts.Cookie.Refresh = time.Hour
 	pcTest.opts.Validate()
 
-	pcTest.proxy = NewOAuthProxy(pcTest.opts, func(email string) bool {
+	var err error
+	pcTest.proxy, err = NewOAuthProxy(pcTest.opts, func(email string) bool {
 		return pcTest.validateUser
 	})
+	if err != nil {
+		panic(err)
+	}
 	pcTest.proxy.provider = &TestProvider{
 		ValidToken: opts.providerValidateCookieResponse,
 	}
@@ -960,11 +1116,28 @@ func TestLoadCookiedSession(t *testing.T) {
 	assert.Equal(t, startSession.AccessToken, session.AccessToken)
 }
 
+func TestSaveSessionIdentityOnly(t *testing.T) {
+	pcTest := NewProcessCookieTestWithDefaults()
+	pcTest.proxy.sessionIdentityOnly = true
+
+	startSession := &sessions.SessionState{Email: "john.doe@example.com", AccessToken: "my_access_token", IDToken: "my_id_token", RefreshToken: "my_refresh_token", CreatedAt: time.Now()}
+	require.NoError(t, pcTest.SaveSession(startSession))
+	assert.Equal(t, "my_access_token", startSession.AccessToken)
+
+	session, err := pcTest.LoadCookiedSession()
+	require.NoError(t, err)
+	assert.Equal(t, startSession.Email, session.Email)
+	assert.Equal(t, "", session.AccessToken)
+	assert.Equal(t, "", session.IDToken)
+	assert.Equal(t, "", session.RefreshToken)
+}
+
 func TestProcessCookieNoCookieError(t *testing.T) {
 	pcTest := NewProcessCookieTestWithDefaults()
 
 	session, err := pcTest.LoadCookiedSession()
-	assert.Equal(t, "cookie \"_oauth2_proxy\" not present", err.Error())
+	assert.True(t, errors.Is(err, sessions.ErrNotFound))
+	assert.Equal(t, "session not found: cookie \"_oauth2_proxy\" not present", err.Error())
 	if session != nil {
 		t.Errorf("expected nil session. got %#v", session)
 	}
@@ -1018,6 +1191,153 @@ func TestProcessCookieFailIfRefreshSetAndCookieExpired(t *testing.T) {
 	}
 }
 
+func TestSessionIdleTimeout(t *testing.T) {
+	pcTest := NewProcessCookieTestWithOptionsModifiers(func(opts *Options) {
+		opts.Session.IdleTimeout = time.Hour
+	})
+	startSession := &sessions.SessionState{Email: "john.doe@example.com", AccessToken: "my_access_token", CreatedAt: time.Now()}
+	require.NoError(t, pcTest.SaveSession(startSession))
+	assert.WithinDuration(t, time.Now(), startSession.LastSeen, time.Minute)
+
+	// Recently used sessions aren't saved again
+	rw := httptest.NewRecorder()
+	session, err := pcTest.proxy.getAuthenticatedSession(rw, pcTest.req)
+	require.NoError(t, err)
+	assert.Equal(t, "john.doe@example.com", session.Email)
+	assert.Empty(t, rw.Result().Cookies())
+
+	// Sessions idle for a while are saved again with the time they were seen
+	pcTest.req.Header.Del("Cookie")
+	pcTest.rw = httptest.NewRecorder()
+	pcTest.proxy.sessionIdleTimeout = 0
+	startSession.LastSeen = time.Now().Add(-30 * time.Minute)
+	require.NoError(t, pcTest.SaveSession(startSession))
+	pcTest.proxy.sessionIdleTimeout = time.Hour
+	rw = httptest.NewRecorder()
+	session, err = pcTest.proxy.getAuthenticatedSession(rw, pcTest.req)
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), session.LastSeen, time.Minute)
+	assert.NotEmpty(t, rw.Result().Cookies())
+
+	// and sessions idle for longer than the timeout are removed
+	pcTest.req.Header.Del("Cookie")
+	pcTest.rw = httptest.NewRecorder()
+	pcTest.proxy.sessionIdleTimeout = 0
+	startSession.LastSeen = time.Now().Add(-2 * time.Hour)
+	require.NoError(t, pcTest.SaveSession(startSession))
+	pcTest.proxy.sessionIdleTimeout = time.Hour
+	rw = httptest.NewRecorder()
+	_, err = pcTest.proxy.getAuthenticatedSession(rw, pcTest.req)
+	assert.Equal(t, ErrNeedsLogin, err)
+	require.NotEmpty(t, rw.Result().Cookies())
+	assert.Equal(t, "", rw.Result().Cookies()[0].Value)
+}
+
+func TestProxyMiddlewareSeesAuthorizedSession(t *testing.T) {
+	pcTest := NewProcessCookieTestWithDefaults()
+	startSession := &sessions.SessionState{Email: "john.doe@example.com", AccessToken: "my_access_token", CreatedAt: time.Now()}
+	pcTest.SaveSession(startSession)
+
+	var scopedSession *sessions.SessionState
+	pcTest.proxy.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			scopedSession = middleware.GetRequestScope(req).Session
+			assert.Equal(t, "john.doe@example.com", req.Header.Get("X-Forwarded-Email"))
+			rw.WriteHeader(http.StatusTeapot)
+		})
+	})
+
+	pcTest.rw = httptest.NewRecorder()
+	pcTest.proxy.ServeHTTP(pcTest.rw, pcTest.req)
+	assert.Equal(t, http.StatusTeapot, pcTest.rw.Code)
+	assert.Equal(t, startSession.Email, scopedSession.Email)
+}
+
+func TestProxyMiddlewareSkippedWithoutSession(t *testing.T) {
+	pcTest := NewProcessCookieTestWithDefaults()
+
+	called := false
+	pcTest.proxy.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			called = true
+		})
+	})
+
+	pcTest.req.Header.Set("Accept", "application/json")
+	pcTest.proxy.ServeHTTP(pcTest.rw, pcTest.req)
+	assert.Equal(t, http.StatusUnauthorized, pcTest.rw.Code)
+	assert.False(t, called)
+}
+
+func TestNewHandlerInvalidOptions(t *testing.T) {
+	o := testOptions()
+	o.ClientID = ""
+
+	handler, err := NewHandler(o)
+	assert.Nil(t, handler)
+	assert.Equal(t, errorMsg([]string{"missing setting: client-id"}), err.Error())
+}
+
+func TestNewHandlerPing(t *testing.T) {
+	handler, err := NewHandler(testOptions())
+	assert.NoError(t, err)
+
+	rw := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/ping", nil)
+	handler.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "OK", rw.Body.String())
+}
+
+func TestLoadSession(t *testing.T) {
+	pcTest := NewProcessCookieTestWithDefaults()
+	startSession := &sessions.SessionState{Email: "john.doe@example.com", AccessToken: "my_access_token", CreatedAt: time.Now()}
+	pcTest.SaveSession(startSession)
+
+	session, err := pcTest.proxy.LoadSession(pcTest.rw, pcTest.req)
+	assert.NoError(t, err)
+	assert.Equal(t, startSession.Email, session.Email)
+}
+
+func TestLoadSessionWithoutCookie(t *testing.T) {
+	pcTest := NewProcessCookieTestWithDefaults()
+
+	session, err := pcTest.proxy.LoadSession(pcTest.rw, pcTest.req)
+	assert.Equal(t, ErrNeedsLogin, err)
+	assert.Nil(t, session)
+}
+
+func TestAuthenticatedHandler(t *testing.T) {
+	pcTest := NewProcessCookieTestWithDefaults()
+	startSession := &sessions.SessionState{Email: "john.doe@example.com", AccessToken: "my_access_token", CreatedAt: time.Now()}
+	pcTest.SaveSession(startSession)
+
+	var scopedSession *sessions.SessionState
+	handler := pcTest.proxy.Authenticated(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		scopedSession = middleware.GetRequestScope(req).Session
+		rw.WriteHeader(http.StatusTeapot)
+	}))
+
+	pcTest.rw = httptest.NewRecorder()
+	handler.ServeHTTP(pcTest.rw, pcTest.req)
+	assert.Equal(t, http.StatusTeapot, pcTest.rw.Code)
+	assert.Equal(t, startSession.Email, scopedSession.Email)
+}
+
+func TestAuthenticatedHandlerWithoutSession(t *testing.T) {
+	pcTest := NewProcessCookieTestWithDefaults()
+
+	called := false
+	handler := pcTest.proxy.Authenticated(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		called = true
+	}))
+
+	pcTest.req.Header.Set("Accept", "application/json")
+	handler.ServeHTTP(pcTest.rw, pcTest.req)
+	assert.Equal(t, http.StatusUnauthorized, pcTest.rw.Code)
+	assert.False(t, called)
+}
+
 func NewUserInfoEndpointTest() *ProcessCookieTest {
 	pcTest := NewProcessCookieTestWithDefaults()
 	pcTest.req, _ = http.NewRequest("GET",
@@ -1072,6 +1392,38 @@ func TestAuthOnlyEndpointUnauthorizedOnNoCookieSetError(t *testing.T) {
 	assert.Equal(t, "unauthorized request\n", string(bodyBytes))
 }
 
+type unavailableSessionStore struct{}
+
+func (unavailableSessionStore) Save(context.Context, http.ResponseWriter, *http.Request, *sessions.SessionState) error {
+	return sessions.ErrBackendUnavailable
+}
+
+func (unavailableSessionStore) Load(context.Context, *http.Request) (*sessions.SessionState, error) {
+	return nil, fmt.Errorf("error loading session: %w", sessions.ErrBackendUnavailable)
+}
+
+func (unavailableSessionStore) Clear(context.Context, http.ResponseWriter, *http.Request) error {
+	return sessions.ErrBackendUnavailable
+}
+
+func TestAuthOnlyEndpointServiceUnavailableOnSessionStoreError(t *testing.T) {
+	test := NewAuthOnlyEndpointTest()
+	test.proxy.sessionStore = unavailableSessionStore{}
+
+	test.proxy.ServeHTTP(test.rw, test.req)
+	assert.Equal(t, http.StatusServiceUnavailable, test.rw.Code)
+	bodyBytes, _ := ioutil.ReadAll(test.rw.Body)
+	assert.Equal(t, "session store unavailable\n", string(bodyBytes))
+}
+
+func TestProxyServiceUnavailableOnSessionStoreError(t *testing.T) {
+	pcTest := NewProcessCookieTestWithDefaults()
+	pcTest.proxy.sessionStore = unavailableSessionStore{}
+
+	pcTest.proxy.ServeHTTP(pcTest.rw, pcTest.req)
+	assert.Equal(t, http.StatusServiceUnavailable, pcTest.rw.Code)
+}
+
 func TestAuthOnlyEndpointUnauthorizedOnExpiration(t *testing.T) {
 	test := NewAuthOnlyEndpointTest(func(opts *Options) {
 		opts.Cookie.Expire = time.Duration(24) * time.Hour
@@ -1107,9 +1459,11 @@ func TestAuthOnlyEndpointSetXAuthRequestHeaders(t *testing.T) {
 	pcTest.opts.SetXAuthRequest = true
 	pcTest.opts.Validate()
 
-	pcTest.proxy = NewOAuthProxy(pcTest.opts, func(email string) bool {
+	var err error
+	pcTest.proxy, err = NewOAuthProxy(pcTest.opts, func(email string) bool {
 		return pcTest.validateUser
 	})
+	require.NoError(t, err)
 	pcTest.proxy.provider = &TestProvider{
 		ValidToken: true,
 	}
@@ -1138,9 +1492,11 @@ func TestAuthOnlyEndpointSetBasicAuthTrueRequestHeaders(t *testing.T) {
 	pcTest.opts.SetBasicAuth = true
 	pcTest.opts.Validate()
 
-	pcTest.proxy = NewOAuthProxy(pcTest.opts, func(email string) bool {
+	var err error
+	pcTest.proxy, err = NewOAuthProxy(pcTest.opts, func(email string) bool {
 		return pcTest.validateUser
 	})
+	require.NoError(t, err)
 	pcTest.proxy.provider = &TestProvider{
 		ValidToken: true,
 	}
@@ -1171,9 +1527,11 @@ func TestAuthOnlyEndpointSetBasicAuthFalseRequestHeaders(t *testing.T) {
 	pcTest.opts.SetBasicAuth = false
 	pcTest.opts.Validate()
 
-	pcTest.proxy = NewOAuthProxy(pcTest.opts, func(email string) bool {
+	var err error
+	pcTest.proxy, err = NewOAuthProxy(pcTest.opts, func(email string) bool {
 		return pcTest.validateUser
 	})
+	require.NoError(t, err)
 	pcTest.proxy.provider = &TestProvider{
 		ValidToken: true,
 	}
@@ -1213,7 +1571,8 @@ func TestAuthSkippedForPreflightRequests(t *testing.T) {
 	upstreamURL, _ := url.Parse(upstream.URL)
 	opts.provider = NewTestProvider(upstreamURL, "")
 
-	proxy := NewOAuthProxy(opts, func(string) bool { return false })
+	proxy, err := NewOAuthProxy(opts, func(string) bool { return false })
+	require.NoError(t, err)
 	rw := httptest.NewRecorder()
 	req, _ := http.NewRequest("OPTIONS", "/preflight-request", nil)
 	proxy.ServeHTTP(rw, req)
@@ -1308,7 +1667,10 @@ func (st *SignatureTest) MakeRequestWithExpectedKey(method, body, key string) {
 	if err != nil {
 		panic(err)
 	}
-	proxy := NewOAuthProxy(st.opts, func(email string) bool { return true })
+	proxy, err := NewOAuthProxy(st.opts, func(email string) bool { return true })
+	if err != nil {
+		panic(err)
+	}
 
 	var bodyBuf io.ReadCloser
 	if body != "" {
@@ -1363,7 +1725,8 @@ func TestGetRedirect(t *testing.T) {
 	options := NewOptions()
 	_ = options.Validate()
 	require.NotEmpty(t, options.ProxyPrefix)
-	proxy := NewOAuthProxy(options, func(s string) bool { return false })
+	proxy, err := NewOAuthProxy(options, func(s string) bool { return false })
+	require.NoError(t, err)
 
 	tests := []struct {
 		name             string
@@ -1404,9 +1767,13 @@ func newAjaxRequestTest() *ajaxRequestTest {
 	test.opts.ClientID = "gkljfdl"
 	test.opts.ClientSecret = "sdflkjs"
 	test.opts.Validate()
-	test.proxy = NewOAuthProxy(test.opts, func(email string) bool {
+	var err error
+	test.proxy, err = NewOAuthProxy(test.opts, func(email string) bool {
 		return true
 	})
+	if err != nil {
+		panic(err)
+	}
 	return test
 }
 
@@ -1670,9 +2037,10 @@ func Test_noCacheHeadersDoesNotExistsInResponseHeadersFromUpstream(t *testing.T)
 	opts.Upstreams = []string{upstream.URL}
 	opts.SkipAuthRegex = []string{".*"}
 	_ = opts.Validate()
-	proxy := NewOAuthProxy(opts, func(email string) bool {
+	proxy, err := NewOAuthProxy(opts, func(email string) bool {
 		return true
 	})
+	require.NoError(t, err)
 
 	rec := httptest.NewRecorder()
 	req := httptest.NewRequest(http.MethodGet, "/upstream", nil)
@@ -1686,3 +2054,366 @@ func Test_noCacheHeadersDoesNotExistsInResponseHeadersFromUpstream(t *testing.T)
 		assert.Equal(t, "", rec.Header().Get(k))
 	}
 }
+
+func TestAnonymousRegex(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Header.Get("X-Forwarded-User") + ":" + r.Header.Get("X-Forwarded-Email")))
+	}))
+	t.Cleanup(upstream.Close)
+
+	pcTest := NewProcessCookieTestWithOptionsModifiers(func(opts *Options) {
+		opts.Upstreams = []string{upstream.URL}
+		opts.AnonymousRegex = []string{"^/guest/"}
+	})
+
+	// Anonymous users are proxied to matching paths, ignoring any identity
+	// headers they send
+	req := httptest.NewRequest("GET", "/guest/page", nil)
+	req.Header.Set("X-Forwarded-User", "spoofed")
+	req.Header.Set("X-Forwarded-Email", "spoofed@example.com")
+	rw := httptest.NewRecorder()
+	pcTest.proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "anonymous:", rw.Body.String())
+	assert.Equal(t, "anonymous", rw.Header().Get("GAP-Auth"))
+
+	// but must still sign in for other paths
+	req = httptest.NewRequest("GET", "/private", nil)
+	req.Header.Set("Accept", "application/json")
+	rw = httptest.NewRecorder()
+	pcTest.proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusUnauthorized, rw.Code)
+
+	// Signed in users are proxied as themselves
+	require.NoError(t, pcTest.SaveSession(&sessions.SessionState{
+		User: "jane", Email: "jane@example.com", CreatedAt: time.Now()}))
+	pcTest.req.URL.Path = "/guest/page"
+	pcTest.proxy.ServeHTTP(pcTest.rw, pcTest.req)
+	assert.Equal(t, http.StatusOK, pcTest.rw.Code)
+	assert.Equal(t, "jane:jane@example.com", pcTest.rw.Body.String())
+}
+
+func TestCheckConfigurationInvalidOptions(t *testing.T) {
+	o := testOptions()
+	o.ClientID = ""
+	o.HtpasswdFile = "/does/not/exist"
+
+	checks := CheckConfiguration(context.Background(), o)
+	assert.Len(t, checks, 1)
+	assert.Equal(t, "configuration", checks[0].Name)
+	assert.Error(t, checks[0].Err)
+}
+
+func TestCheckConfigurationUnreadableFiles(t *testing.T) {
+	o := testOptions()
+	o.TLSCertFile = "/does/not/exist.crt"
+	o.TLSKeyFile = "/does/not/exist.key"
+	o.CustomTemplatesDir = os.TempDir()
+
+	checks := CheckConfiguration(context.Background(), o)
+	var buf bytes.Buffer
+	assert.False(t, WriteConfigReport(&buf, checks))
+	assert.Contains(t, buf.String(), "[ OK ] configuration\n")
+	assert.Contains(t, buf.String(), "[FAIL] tls certificate: ")
+	assert.Contains(t, buf.String(), "[ OK ] custom templates dir\n")
+}
+
+func TestCheckConfigurationValid(t *testing.T) {
+	provider := newProviderCheckServer(t)
+	defer provider.Close()
+
+	o := testOptions()
+	o.LoginURL = provider.URL + "/login"
+	o.RedeemURL = provider.URL + "/token"
+	checks := CheckConfiguration(context.Background(), o)
+	assert.True(t, WriteConfigReport(ioutil.Discard, checks))
+}
+
+func TestSimulateAuthorization(t *testing.T) {
+	opts := testOptions()
+	opts.SkipAuthRegex = []string{"^/public/"}
+	opts.AnonymousRegex = []string{"^/guest/"}
+	opts.SkipAuthPreflight = true
+	require.NoError(t, opts.Validate())
+
+	proxy, err := NewOAuthProxy(opts, func(email string) bool {
+		return strings.HasSuffix(email, "@example.com")
+	})
+	require.NoError(t, err)
+	tp := NewTestProvider(&url.URL{Host: "localhost"}, "")
+	tp.GroupValidator = func(email string) bool {
+		return email != "outsider@example.com"
+	}
+	proxy.provider = tp
+
+	testCases := []struct {
+		name    string
+		method  string
+		path    string
+		email   string
+		allowed bool
+		rule    string
+	}{
+		{"ping", "GET", "/ping", "", true, "/ping is always public"},
+		{"preflight", "OPTIONS", "/private", "", true, "skip-auth-preflight"},
+		{"skip auth regex", "GET", "/public/index.html", "", true, `skip-auth-regex "^/public/"`},
+		{"sign in", "GET", "/oauth2/sign_in", "", true, "/oauth2/sign_in is served by the proxy without authentication"},
+		{"anonymous regex", "GET", "/guest/index.html", "", true, `anonymous-regex "^/guest/" proxies as anonymous`},
+		{"no email", "GET", "/private", "", false, "authentication required"},
+		{"auth endpoint without email", "GET", "/oauth2/auth", "", false, "authentication required"},
+		{"invalid email", "GET", "/private", "user@other.com", false, "user@other.com is not permitted by email-domain or authenticated-emails-file"},
+		{"not in group", "GET", "/private", "outsider@example.com", false, "outsider@example.com is not a member of the groups required by the Test Provider provider"},
+		{"valid email", "GET", "/private", "user@example.com", true, "user@example.com is permitted by email-domain or authenticated-emails-file"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest(tc.method, tc.path, nil)
+			decision := proxy.SimulateAuthorization(req, tc.email)
+			assert.Equal(t, tc.allowed, decision.Allowed)
+			assert.Equal(t, tc.rule, decision.Rule)
+		})
+	}
+}
+
+func NewImpersonateEndpointTest(email string) *ProcessCookieTest {
+	pcTest := NewProcessCookieTestWithOptionsModifiers(func(opts *Options) {
+		opts.ImpersonationAdmins = []string{"admin@example.com"}
+		opts.SetXAuthRequest = true
+	})
+	pcTest.req = httptest.NewRequest("POST", pcTest.opts.ProxyPrefix+"/impersonate?rd=/app",
+		strings.NewReader(url.Values{"email": {email}}.Encode()))
+	pcTest.req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	pcTest.req.Header.Set("Origin", "http://example.com")
+	return pcTest
+}
+
+func TestImpersonateEndpoint(t *testing.T) {
+	test := NewImpersonateEndpointTest("user@example.com")
+	test.SaveSession(&sessions.SessionState{Email: "admin@example.com", User: "admin", CreatedAt: time.Now()})
+
+	rw := httptest.NewRecorder()
+	test.proxy.ServeHTTP(rw, test.req)
+	assert.Equal(t, http.StatusFound, rw.Code)
+	assert.Equal(t, "/app", rw.Header().Get("Location"))
+
+	authReq := httptest.NewRequest("GET", test.opts.ProxyPrefix+"/auth", nil)
+	for _, c := range rw.Result().Cookies() {
+		authReq.AddCookie(c)
+	}
+	session, err := test.proxy.LoadCookiedSession(authReq)
+	require.NoError(t, err)
+	assert.Equal(t, "user@example.com", session.Email)
+	assert.Equal(t, "admin@example.com", session.Impersonator)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), session.ExpiresOn, time.Minute)
+
+	authRW := httptest.NewRecorder()
+	test.proxy.ServeHTTP(authRW, authReq)
+	assert.Equal(t, http.StatusAccepted, authRW.Code)
+	assert.Equal(t, "user@example.com", authRW.Header().Get("X-Auth-Request-Email"))
+	assert.Equal(t, "admin@example.com", authRW.Header().Get("X-Auth-Request-Impersonated-By"))
+
+	// Impersonation ends if the administrator loses their rights
+	test.proxy.impersonationAdmins = nil
+	authRW = httptest.NewRecorder()
+	test.proxy.ServeHTTP(authRW, authReq)
+	assert.Equal(t, http.StatusUnauthorized, authRW.Code)
+}
+
+func TestImpersonateEndpointDenied(t *testing.T) {
+	tests := []struct {
+		name         string
+		method       string
+		session      *sessions.SessionState
+		email        string
+		origin       string
+		expectedCode int
+	}{
+		{"GET request", "GET", &sessions.SessionState{Email: "admin@example.com"}, "user@example.com", "http://example.com", http.StatusMethodNotAllowed},
+		{"not signed in", "POST", nil, "user@example.com", "http://example.com", http.StatusUnauthorized},
+		{"not an admin", "POST", &sessions.SessionState{Email: "other@example.com"}, "user@example.com", "http://example.com", http.StatusForbidden},
+		{"already impersonating", "POST", &sessions.SessionState{Email: "admin@example.com", Impersonator: "admin@example.com"}, "user@example.com", "http://example.com", http.StatusForbidden},
+		{"no user given", "POST", &sessions.SessionState{Email: "admin@example.com"}, "", "http://example.com", http.StatusBadRequest},
+		{"from another site", "POST", &sessions.SessionState{Email: "admin@example.com"}, "user@example.com", "https://evil.example.net", http.StatusForbidden},
+		{"without an origin", "POST", &sessions.SessionState{Email: "admin@example.com"}, "user@example.com", "", http.StatusForbidden},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pcTest := NewImpersonateEndpointTest(test.email)
+			pcTest.req.Method = test.method
+			pcTest.req.Header.Set("Origin", test.origin)
+			if test.session != nil {
+				require.NoError(t, pcTest.SaveSession(test.session))
+			}
+
+			rw := httptest.NewRecorder()
+			pcTest.proxy.ServeHTTP(rw, pcTest.req)
+			assert.Equal(t, test.expectedCode, rw.Code)
+			assert.Empty(t, rw.Result().Cookies())
+		})
+	}
+}
+
+func TestImpersonateEndpointGroupAdmin(t *testing.T) {
+	test := NewImpersonateEndpointTest("user@example.com")
+	test.proxy.impersonationAdmins = []string{"group:support"}
+	test.req.Header.Del("Origin")
+	test.req.Header.Set("Referer", "http://example.com/admin")
+	test.SaveSession(&sessions.SessionState{Email: "agent@example.com", Groups: []string{"staff", "support"}, CreatedAt: time.Now()})
+
+	rw := httptest.NewRecorder()
+	test.proxy.ServeHTTP(rw, test.req)
+	require.Equal(t, http.StatusFound, rw.Code)
+
+	authReq := httptest.NewRequest("GET", test.opts.ProxyPrefix+"/auth", nil)
+	for _, c := range rw.Result().Cookies() {
+		authReq.AddCookie(c)
+	}
+	session, err := test.proxy.LoadCookiedSession(authReq)
+	require.NoError(t, err)
+	assert.Equal(t, "agent@example.com", session.Impersonator)
+	assert.Equal(t, []string{"staff", "support"}, session.ImpersonatorGroups)
+	authRW := httptest.NewRecorder()
+	test.proxy.ServeHTTP(authRW, authReq)
+	assert.Equal(t, http.StatusAccepted, authRW.Code)
+
+	// the administrator's group is checked again on each request
+	test.proxy.impersonationAdmins = []string{"group:admins"}
+	authRW = httptest.NewRecorder()
+	test.proxy.ServeHTTP(authRW, authReq)
+	assert.Equal(t, http.StatusUnauthorized, authRW.Code)
+}
+
+func TestImpersonatedByHeaderNotSpoofable(t *testing.T) {
+	opts := NewOptions()
+	opts.Validate()
+	proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Forwarded-Impersonated-By", "admin@example.com")
+	proxy.addHeadersForProxying(httptest.NewRecorder(), req, &sessions.SessionState{Email: "user@example.com"})
+	assert.Equal(t, "", req.Header.Get("X-Forwarded-Impersonated-By"))
+}
+
+// TestPasswordProvider signs in jane with the password "secret"
+type TestPasswordProvider struct {
+	*providers.ProviderData
+}
+
+var _ providers.PasswordProvider = (*TestPasswordProvider)(nil)
+
+func (tp *TestPasswordProvider) AuthenticatePassword(ctx context.Context, username, password string) (*sessions.SessionState, error) {
+	if username != "jane" || password != "secret" {
+		return nil, providers.ErrInvalidCredentials
+	}
+	return &sessions.SessionState{User: "jane", Email: "jane@example.com", Groups: []string{"admins", "devs"}, CreatedAt: time.Now()}, nil
+}
+
+func TestPasswordProviderSignIn(t *testing.T) {
+	pcTest := NewProcessCookieTestWithDefaults()
+	pcTest.proxy.provider = &TestPasswordProvider{ProviderData: &providers.ProviderData{ProviderName: "LDAP"}}
+
+	signIn := func(password string) *httptest.ResponseRecorder {
+		form := url.Values{"username": {"jane"}, "password": {password}, "rd": {"/dashboard"}}
+		req := httptest.NewRequest("POST", pcTest.opts.ProxyPrefix+"/sign_in", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rw := httptest.NewRecorder()
+		pcTest.proxy.ServeHTTP(rw, req)
+		return rw
+	}
+
+	rw := signIn("wrong")
+	assert.Equal(t, http.StatusUnauthorized, rw.Code)
+
+	rw = signIn("secret")
+	require.Equal(t, http.StatusFound, rw.Code)
+	assert.Equal(t, "/dashboard", rw.Header().Get("Location"))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	for _, c := range rw.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	session, err := pcTest.proxy.getAuthenticatedSession(httptest.NewRecorder(), req)
+	require.NoError(t, err)
+	assert.Equal(t, "jane@example.com", session.Email)
+	assert.Equal(t, []string{"admins", "devs"}, session.Groups)
+
+	// The sign in page shows the form rather than the provider button
+	rw = httptest.NewRecorder()
+	pcTest.proxy.ServeHTTP(rw, httptest.NewRequest("GET", pcTest.opts.ProxyPrefix+"/sign_in", nil))
+	assert.Contains(t, rw.Body.String(), `name="password"`)
+	assert.NotContains(t, rw.Body.String(), "Sign in with LDAP")
+
+	// and there's no provider to be redirected to
+	rw = httptest.NewRecorder()
+	pcTest.proxy.ServeHTTP(rw, httptest.NewRequest("GET", pcTest.opts.ProxyPrefix+"/start?rd=/dashboard", nil))
+	assert.Equal(t, http.StatusFound, rw.Code)
+	assert.Equal(t, pcTest.opts.ProxyPrefix+"/sign_in?rd=%2Fdashboard", rw.Header().Get("Location"))
+}
+
+// noEmailPasswordProvider signs in jane without an email, as directories
+// without one for her do
+type noEmailPasswordProvider struct {
+	*TestPasswordProvider
+}
+
+func (tp *noEmailPasswordProvider) AuthenticatePassword(ctx context.Context, username, password string) (*sessions.SessionState, error) {
+	session, err := tp.TestPasswordProvider.AuthenticatePassword(ctx, username, password)
+	if session != nil {
+		session.Email = ""
+	}
+	return session, err
+}
+
+func TestPasswordProviderSignInWithoutEmail(t *testing.T) {
+	signIn := func(emailDomains []string, groupValidator func([]string) bool) int {
+		opts := testOptions()
+		opts.EmailDomains = emailDomains
+		require.NoError(t, opts.Validate())
+		proxy, err := NewOAuthProxy(opts, NewValidator(emailDomains, ""))
+		require.NoError(t, err)
+		proxy.GroupValidator = groupValidator
+		proxy.provider = &noEmailPasswordProvider{&TestPasswordProvider{ProviderData: &providers.ProviderData{ProviderName: "LDAP"}}}
+
+		form := url.Values{"username": {"jane"}, "password": {"secret"}}
+		req := httptest.NewRequest("POST", opts.ProxyPrefix+"/sign_in", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		return rw.Code
+	}
+	inAdmins := func(groups []string) bool {
+		for _, group := range groups {
+			if group == "admins" {
+				return true
+			}
+		}
+		return false
+	}
+
+	assert.Equal(t, http.StatusForbidden, signIn([]string{"example.com"}, nil))
+	assert.Equal(t, http.StatusForbidden, signIn([]string{"example.com"}, func([]string) bool { return false }))
+	assert.Equal(t, http.StatusFound, signIn([]string{"example.com"}, inAdmins))
+	assert.Equal(t, http.StatusFound, signIn([]string{"*"}, nil))
+}
+
+func TestGroupsHeaders(t *testing.T) {
+	opts := NewOptions()
+	opts.SetXAuthRequest = true
+	opts.Validate()
+	proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Forwarded-Groups", "spoofed")
+	rw := httptest.NewRecorder()
+	proxy.addHeadersForProxying(rw, req, &sessions.SessionState{User: "jane", Groups: []string{"cn=admins,dc=example,dc=com", "devs"}})
+	assert.Equal(t, []string{"cn=admins,dc=example,dc=com", "devs"}, req.Header["X-Forwarded-Groups"])
+	assert.Equal(t, []string{"cn=admins,dc=example,dc=com", "devs"}, rw.Header()["X-Auth-Request-Groups"])
+
+	req.Header.Set("X-Forwarded-Groups", "spoofed")
+	proxy.addHeadersForProxying(rw, req, &sessions.SessionState{User: "john"})
+	assert.Empty(t, req.Header.Get("X-Forwarded-Groups"))
+	assert.Empty(t, rw.Header().Get("X-Auth-Request-Groups"))
+}
@@ -0,0 +1,54 @@
+package oauth2proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/oidctest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignInWithFakeProvider(t *testing.T) {
+	idp := oidctest.NewServer()
+	defer idp.Close()
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Write([]byte(req.Header.Get("X-Forwarded-Email")))
+	}))
+	defer upstream.Close()
+
+	opts := NewOptions()
+	opts.Provider = "oidc"
+	opts.OIDCIssuerURL = idp.Issuer()
+	opts.ClientID = idp.ClientID
+	opts.ClientSecret = idp.ClientSecret
+	opts.Cookie.Secret = cookieSecret
+	opts.Cookie.Secure = false
+	// the default of the cookie-path flag
+	opts.Cookie.Path = "/"
+	opts.EmailDomains = []string{"example.com"}
+	opts.Upstreams = []string{upstream.URL}
+	opts.PassUserHeaders = true
+	require.NoError(t, opts.Validate())
+	proxy, err := NewOAuthProxy(opts, func(email string) bool { return true })
+	require.NoError(t, err)
+	frontend := httptest.NewServer(proxy)
+	defer frontend.Close()
+
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	client := &http.Client{Jar: jar}
+
+	// signing in goes through the provider and back to the page
+	resp, err := client.Get(frontend.URL + opts.ProxyPrefix + "/start?rd=/dashboard")
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "/dashboard", resp.Request.URL.Path)
+	assert.Equal(t, "jane@example.com", string(body))
+}
@@ -1,11 +1,15 @@
-package main
+package oauth2proxy
 
 import (
 	"context"
 	"crypto"
+	"crypto/cipher"
 	"crypto/tls"
 	"fmt"
+	"html/template"
+	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -15,14 +19,17 @@ import (
 	"time"
 
 	oidc "github.com/coreos/go-oidc"
-	"github.com/dgrijalva/jwt-go"
 	"github.com/mbland/hmacauth"
 	"github.com/oauth2-proxy/oauth2-proxy/pkg/apis/options"
 	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/clock"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/cookies"
 	"github.com/oauth2-proxy/oauth2-proxy/pkg/encryption"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/geoip"
 	"github.com/oauth2-proxy/oauth2-proxy/pkg/logger"
 	"github.com/oauth2-proxy/oauth2-proxy/pkg/requests"
 	"github.com/oauth2-proxy/oauth2-proxy/pkg/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/verification"
 	"github.com/oauth2-proxy/oauth2-proxy/providers"
 	"gopkg.in/natefinch/lumberjack.v2"
 )
@@ -35,6 +42,8 @@ type Options struct {
 	ProxyWebSockets    bool   `flag:"proxy-websockets" cfg:"proxy_websockets" env:"OAUTH2_PROXY_PROXY_WEBSOCKETS"`
 	HTTPAddress        string `flag:"http-address" cfg:"http_address" env:"OAUTH2_PROXY_HTTP_ADDRESS"`
 	HTTPSAddress       string `flag:"https-address" cfg:"https_address" env:"OAUTH2_PROXY_HTTPS_ADDRESS"`
+	DebugAddress       string `flag:"debug-address" cfg:"debug_address" env:"OAUTH2_PROXY_DEBUG_ADDRESS"`
+	DiagnosticsFile    string `flag:"diagnostics-file" cfg:"diagnostics_file" env:"OAUTH2_PROXY_DIAGNOSTICS_FILE"`
 	ReverseProxy       bool   `flag:"reverse-proxy" cfg:"reverse_proxy" env:"OAUTH2_PROXY_REVERSE_PROXY"`
 	RealClientIPHeader string `flag:"real-client-ip-header" cfg:"real_client_ip_header" env:"OAUTH2_PROXY_REAL_CLIENT_IP_HEADER"`
 	ForceHTTPS         bool   `flag:"force-https" cfg:"force_https" env:"OAUTH2_PROXY_FORCE_HTTPS"`
@@ -46,6 +55,11 @@ type Options struct {
 	TLSKeyFile         string `flag:"tls-key-file" cfg:"tls_key_file" env:"OAUTH2_PROXY_TLS_KEY_FILE"`
 
 	AuthenticatedEmailsFile  string   `flag:"authenticated-emails-file" cfg:"authenticated_emails_file" env:"OAUTH2_PROXY_AUTHENTICATED_EMAILS_FILE"`
+	IdentityMapFile          string   `flag:"identity-map-file" cfg:"identity_map_file" env:"OAUTH2_PROXY_IDENTITY_MAP_FILE"`
+	GroupMappings            []string `flag:"group-mapping" cfg:"group_mappings" env:"OAUTH2_PROXY_GROUP_MAPPINGS"`
+	GroupMappingDropUnmapped bool     `flag:"group-mapping-drop-unmapped" cfg:"group_mapping_drop_unmapped" env:"OAUTH2_PROXY_GROUP_MAPPING_DROP_UNMAPPED"`
+	FeatureFlags             []string `flag:"feature-flag" cfg:"feature_flags" env:"OAUTH2_PROXY_FEATURE_FLAGS"`
+	FeatureFlagsFile         string   `flag:"feature-flags-file" cfg:"feature_flags_file" env:"OAUTH2_PROXY_FEATURE_FLAGS_FILE"`
 	KeycloakGroup            string   `flag:"keycloak-group" cfg:"keycloak_group" env:"OAUTH2_PROXY_KEYCLOAK_GROUP"`
 	AzureTenant              string   `flag:"azure-tenant" cfg:"azure_tenant" env:"OAUTH2_PROXY_AZURE_TENANT"`
 	BitbucketTeam            string   `flag:"bitbucket-team" cfg:"bitbucket_team" env:"OAUTH2_PROXY_BITBUCKET_TEAM"`
@@ -60,6 +74,15 @@ type Options struct {
 	GoogleGroups             []string `flag:"google-group" cfg:"google_group" env:"OAUTH2_PROXY_GOOGLE_GROUPS"`
 	GoogleAdminEmail         string   `flag:"google-admin-email" cfg:"google_admin_email" env:"OAUTH2_PROXY_GOOGLE_ADMIN_EMAIL"`
 	GoogleServiceAccountJSON string   `flag:"google-service-account-json" cfg:"google_service_account_json" env:"OAUTH2_PROXY_GOOGLE_SERVICE_ACCOUNT_JSON"`
+	LDAPURL                  string   `flag:"ldap-url" cfg:"ldap_url" env:"OAUTH2_PROXY_LDAP_URL"`
+	LDAPBindDN               string   `flag:"ldap-bind-dn" cfg:"ldap_bind_dn" env:"OAUTH2_PROXY_LDAP_BIND_DN"`
+	LDAPBindPassword         string   `flag:"ldap-bind-password" cfg:"ldap_bind_password" env:"OAUTH2_PROXY_LDAP_BIND_PASSWORD"`
+	LDAPBaseDN               string   `flag:"ldap-base-dn" cfg:"ldap_base_dn" env:"OAUTH2_PROXY_LDAP_BASE_DN"`
+	LDAPUserAttribute        string   `flag:"ldap-user-attribute" cfg:"ldap_user_attribute" env:"OAUTH2_PROXY_LDAP_USER_ATTRIBUTE"`
+	LDAPEmailAttribute       string   `flag:"ldap-email-attribute" cfg:"ldap_email_attribute" env:"OAUTH2_PROXY_LDAP_EMAIL_ATTRIBUTE"`
+	LDAPGroupAttribute       string   `flag:"ldap-group-attribute" cfg:"ldap_group_attribute" env:"OAUTH2_PROXY_LDAP_GROUP_ATTRIBUTE"`
+	LDAPGroups               []string `flag:"ldap-group" cfg:"ldap_groups" env:"OAUTH2_PROXY_LDAP_GROUPS"`
+	LDAPInsecure             bool     `flag:"ldap-insecure-plaintext" cfg:"ldap_insecure_plaintext" env:"OAUTH2_PROXY_LDAP_INSECURE_PLAINTEXT"`
 	HtpasswdFile             string   `flag:"htpasswd-file" cfg:"htpasswd_file" env:"OAUTH2_PROXY_HTPASSWD_FILE"`
 	DisplayHtpasswdForm      bool     `flag:"display-htpasswd-form" cfg:"display_htpasswd_form" env:"OAUTH2_PROXY_DISPLAY_HTPASSWD_FORM"`
 	CustomTemplatesDir       string   `flag:"custom-templates-dir" cfg:"custom_templates_dir" env:"OAUTH2_PROXY_CUSTOM_TEMPLATES_DIR"`
@@ -71,6 +94,8 @@ type Options struct {
 
 	Upstreams                     []string      `flag:"upstream" cfg:"upstreams" env:"OAUTH2_PROXY_UPSTREAMS"`
 	SkipAuthRegex                 []string      `flag:"skip-auth-regex" cfg:"skip_auth_regex" env:"OAUTH2_PROXY_SKIP_AUTH_REGEX"`
+	SkipAuthWellKnown             []string      `flag:"skip-auth-well-known" cfg:"skip_auth_well_known" env:"OAUTH2_PROXY_SKIP_AUTH_WELL_KNOWN"`
+	AnonymousRegex                []string      `flag:"anonymous-regex" cfg:"anonymous_regex" env:"OAUTH2_PROXY_ANONYMOUS_REGEX"`
 	SkipJwtBearerTokens           bool          `flag:"skip-jwt-bearer-tokens" cfg:"skip_jwt_bearer_tokens" env:"OAUTH2_PROXY_SKIP_JWT_BEARER_TOKENS"`
 	ExtraJwtIssuers               []string      `flag:"extra-jwt-issuers" cfg:"extra_jwt_issuers" env:"OAUTH2_PROXY_EXTRA_JWT_ISSUERS"`
 	PassBasicAuth                 bool          `flag:"pass-basic-auth" cfg:"pass_basic_auth" env:"OAUTH2_PROXY_PASS_BASIC_AUTH"`
@@ -88,58 +113,201 @@ type Options struct {
 	PassAuthorization             bool          `flag:"pass-authorization-header" cfg:"pass_authorization_header" env:"OAUTH2_PROXY_PASS_AUTHORIZATION_HEADER"`
 	SkipAuthPreflight             bool          `flag:"skip-auth-preflight" cfg:"skip_auth_preflight" env:"OAUTH2_PROXY_SKIP_AUTH_PREFLIGHT"`
 	FlushInterval                 time.Duration `flag:"flush-interval" cfg:"flush_interval" env:"OAUTH2_PROXY_FLUSH_INTERVAL"`
+	UpstreamHeaderSizeLimit       int           `flag:"upstream-header-size-limit" cfg:"upstream_header_size_limit" env:"OAUTH2_PROXY_UPSTREAM_HEADER_SIZE_LIMIT"`
+	UpstreamHeaderSizePolicy      string        `flag:"upstream-header-size-policy" cfg:"upstream_header_size_policy" env:"OAUTH2_PROXY_UPSTREAM_HEADER_SIZE_POLICY"`
+	ImpersonationAdmins           []string      `flag:"impersonation-admin" cfg:"impersonation_admins" env:"OAUTH2_PROXY_IMPERSONATION_ADMINS"`
+	ImpersonationDuration         time.Duration `flag:"impersonation-duration" cfg:"impersonation_duration" env:"OAUTH2_PROXY_IMPERSONATION_DURATION"`
+	MachineTokens                 bool          `flag:"machine-tokens" cfg:"machine_tokens" env:"OAUTH2_PROXY_MACHINE_TOKENS"`
+	MachineTokenMaxTTL            time.Duration `flag:"machine-token-max-ttl" cfg:"machine_token_max_ttl" env:"OAUTH2_PROXY_MACHINE_TOKEN_MAX_TTL"`
+	MaintenanceFile               string        `flag:"maintenance-file" cfg:"maintenance_file" env:"OAUTH2_PROXY_MAINTENANCE_FILE"`
+	SessionTLSBinding             bool          `flag:"session-tls-binding" cfg:"session_tls_binding" env:"OAUTH2_PROXY_SESSION_TLS_BINDING"`
+	WebAuthnRPID                  string        `flag:"webauthn-rp-id" cfg:"webauthn_rp_id" env:"OAUTH2_PROXY_WEBAUTHN_RP_ID"`
+	WebAuthnOrigins               []string      `flag:"webauthn-origin" cfg:"webauthn_origins" env:"OAUTH2_PROXY_WEBAUTHN_ORIGINS"`
+	WebAuthnRoutes                []string      `flag:"webauthn-route" cfg:"webauthn_routes" env:"OAUTH2_PROXY_WEBAUTHN_ROUTES"`
+	StepUpRoutes                  []string      `flag:"step-up-route" cfg:"step_up_routes" env:"OAUTH2_PROXY_STEP_UP_ROUTES"`
+	StepUpACRLevels               []string      `flag:"step-up-acr-level" cfg:"step_up_acr_levels" env:"OAUTH2_PROXY_STEP_UP_ACR_LEVELS"`
+	AccessWindows                 []string      `flag:"access-window" cfg:"access_windows" env:"OAUTH2_PROXY_ACCESS_WINDOWS"`
+	AccessWindowTimezone          string        `flag:"access-window-timezone" cfg:"access_window_timezone" env:"OAUTH2_PROXY_ACCESS_WINDOW_TIMEZONE"`
+	Interstitials                 []string      `flag:"interstitial" cfg:"interstitials" env:"OAUTH2_PROXY_INTERSTITIALS"`
+	HeaderTemplates               []string      `flag:"header-template" cfg:"header_templates" env:"OAUTH2_PROXY_HEADER_TEMPLATES"`
+	RewriteRedirectUpstreams      []string      `flag:"rewrite-redirect-upstream" cfg:"rewrite_redirect_upstreams" env:"OAUTH2_PROXY_REWRITE_REDIRECT_UPSTREAMS"`
+	UserMaxConcurrentRequests     int           `flag:"user-max-concurrent-requests" cfg:"user_max_concurrent_requests" env:"OAUTH2_PROXY_USER_MAX_CONCURRENT_REQUESTS"`
+	UserBandwidthLimit            int64         `flag:"user-bandwidth-limit" cfg:"user_bandwidth_limit" env:"OAUTH2_PROXY_USER_BANDWIDTH_LIMIT"`
+	UserBandwidthWindow           time.Duration `flag:"user-bandwidth-window" cfg:"user_bandwidth_window" env:"OAUTH2_PROXY_USER_BANDWIDTH_WINDOW"`
+	UserLimitsStore               string        `flag:"user-limits-store" cfg:"user_limits_store" env:"OAUTH2_PROXY_USER_LIMITS_STORE"`
+	LoginThrottleFailures         int           `flag:"login-throttle-failures" cfg:"login_throttle_failures" env:"OAUTH2_PROXY_LOGIN_THROTTLE_FAILURES"`
+	LoginThrottleCooldown         time.Duration `flag:"login-throttle-cooldown" cfg:"login_throttle_cooldown" env:"OAUTH2_PROXY_LOGIN_THROTTLE_COOLDOWN"`
+	ProviderLookupCache           string        `flag:"provider-lookup-cache" cfg:"provider_lookup_cache" env:"OAUTH2_PROXY_PROVIDER_LOOKUP_CACHE"`
+	ProviderLookupCacheTTL        time.Duration `flag:"provider-lookup-cache-ttl" cfg:"provider_lookup_cache_ttl" env:"OAUTH2_PROXY_PROVIDER_LOOKUP_CACHE_TTL"`
+	JWKSRefreshInterval           time.Duration `flag:"jwks-refresh-interval" cfg:"jwks_refresh_interval" env:"OAUTH2_PROXY_JWKS_REFRESH_INTERVAL"`
+	AssertionKeyFile              string        `flag:"assertion-key-file" cfg:"assertion_key_file" env:"OAUTH2_PROXY_ASSERTION_KEY_FILE"`
+	AssertionVerificationKeys     []string      `flag:"assertion-verification-key-file" cfg:"assertion_verification_key_files" env:"OAUTH2_PROXY_ASSERTION_VERIFICATION_KEY_FILES"`
+	AssertionHeader               string        `flag:"assertion-header" cfg:"assertion_header" env:"OAUTH2_PROXY_ASSERTION_HEADER"`
+	AssertionIssuer               string        `flag:"assertion-issuer" cfg:"assertion_issuer" env:"OAUTH2_PROXY_ASSERTION_ISSUER"`
+	AssertionAudience             string        `flag:"assertion-audience" cfg:"assertion_audience" env:"OAUTH2_PROXY_ASSERTION_AUDIENCE"`
+	PreviousCookieSecret          string        `flag:"previous-cookie-secret" cfg:"previous_cookie_secret" env:"OAUTH2_PROXY_PREVIOUS_COOKIE_SECRET"`
+	PreviousSessionStoreType      string        `flag:"previous-session-store-type" cfg:"previous_session_store_type" env:"OAUTH2_PROXY_PREVIOUS_SESSION_STORE_TYPE"`
+	UpstreamSigning               []string      `flag:"upstream-signing" cfg:"upstream_signing" env:"OAUTH2_PROXY_UPSTREAM_SIGNING"`
+	UpstreamAWSAccessKeyID        string        `flag:"upstream-aws-access-key-id" cfg:"upstream_aws_access_key_id" env:"OAUTH2_PROXY_UPSTREAM_AWS_ACCESS_KEY_ID"`
+	UpstreamAWSSecretAccessKey    string        `flag:"upstream-aws-secret-access-key" cfg:"upstream_aws_secret_access_key" env:"OAUTH2_PROXY_UPSTREAM_AWS_SECRET_ACCESS_KEY"`
+	UpstreamAWSSessionToken       string        `flag:"upstream-aws-session-token" cfg:"upstream_aws_session_token" env:"OAUTH2_PROXY_UPSTREAM_AWS_SESSION_TOKEN"`
+	UpstreamSigV4MaxBodySize      int64         `flag:"upstream-sigv4-max-body-size" cfg:"upstream_sigv4_max_body_size" env:"OAUTH2_PROXY_UPSTREAM_SIGV4_MAX_BODY_SIZE"`
+	BaggageUserKey                string        `flag:"baggage-user-key" cfg:"baggage_user_key" env:"OAUTH2_PROXY_BAGGAGE_USER_KEY"`
+	BaggageHashKey                string        `flag:"baggage-hash-key" cfg:"baggage_hash_key" env:"OAUTH2_PROXY_BAGGAGE_HASH_KEY"`
+	TraceHeaders                  []string      `flag:"trace-header" cfg:"trace_headers" env:"OAUTH2_PROXY_TRACE_HEADERS"`
+	TLSMinVersion                 string        `flag:"tls-min-version" cfg:"tls_min_version" env:"OAUTH2_PROXY_TLS_MIN_VERSION"`
+	TLSCipherSuites               []string      `flag:"tls-cipher-suite" cfg:"tls_cipher_suites" env:"OAUTH2_PROXY_TLS_CIPHER_SUITES"`
+	TLSCurvePreferences           []string      `flag:"tls-curve-preference" cfg:"tls_curve_preferences" env:"OAUTH2_PROXY_TLS_CURVE_PREFERENCES"`
+	TLSOCSPStapling               bool          `flag:"tls-ocsp-stapling" cfg:"tls_ocsp_stapling" env:"OAUTH2_PROXY_TLS_OCSP_STAPLING"`
+	CORSAllowedOrigins            []string      `flag:"cors-allowed-origin" cfg:"cors_allowed_origins" env:"OAUTH2_PROXY_CORS_ALLOWED_ORIGINS"`
+	CORSAllowedHeaders            []string      `flag:"cors-allowed-header" cfg:"cors_allowed_headers" env:"OAUTH2_PROXY_CORS_ALLOWED_HEADERS"`
+	CORSAllowCredentials          bool          `flag:"cors-allow-credentials" cfg:"cors_allow_credentials" env:"OAUTH2_PROXY_CORS_ALLOW_CREDENTIALS"`
+	CORSMaxAge                    time.Duration `flag:"cors-max-age" cfg:"cors_max_age" env:"OAUTH2_PROXY_CORS_MAX_AGE"`
+	UserSessionsPage              bool          `flag:"user-sessions-page" cfg:"user_sessions_page" env:"OAUTH2_PROXY_USER_SESSIONS_PAGE"`
+	WebhookURLs                   []string      `flag:"webhook-url" cfg:"webhook_urls" env:"OAUTH2_PROXY_WEBHOOK_URLS"`
+	WebhookSecret                 string        `flag:"webhook-secret" cfg:"webhook_secret" env:"OAUTH2_PROXY_WEBHOOK_SECRET"`
+	WebhookEvents                 []string      `flag:"webhook-event" cfg:"webhook_events" env:"OAUTH2_PROXY_WEBHOOK_EVENTS"`
+	WebhookMaxRetries             int           `flag:"webhook-max-retries" cfg:"webhook_max_retries" env:"OAUTH2_PROXY_WEBHOOK_MAX_RETRIES"`
+	UpstreamBreakerErrorRate      float64       `flag:"upstream-breaker-error-rate" cfg:"upstream_breaker_error_rate" env:"OAUTH2_PROXY_UPSTREAM_BREAKER_ERROR_RATE"`
+	UpstreamBreakerMinRequests    int           `flag:"upstream-breaker-min-requests" cfg:"upstream_breaker_min_requests" env:"OAUTH2_PROXY_UPSTREAM_BREAKER_MIN_REQUESTS"`
+	UpstreamBreakerWindow         time.Duration `flag:"upstream-breaker-window" cfg:"upstream_breaker_window" env:"OAUTH2_PROXY_UPSTREAM_BREAKER_WINDOW"`
+	UpstreamBreakerOpenDuration   time.Duration `flag:"upstream-breaker-open-duration" cfg:"upstream_breaker_open_duration" env:"OAUTH2_PROXY_UPSTREAM_BREAKER_OPEN_DURATION"`
+	UpstreamBreakerProbes         int           `flag:"upstream-breaker-probes" cfg:"upstream_breaker_probes" env:"OAUTH2_PROXY_UPSTREAM_BREAKER_PROBES"`
+	UpstreamRetries               int           `flag:"upstream-retries" cfg:"upstream_retries" env:"OAUTH2_PROXY_UPSTREAM_RETRIES"`
+	UpstreamRetryBudget           float64       `flag:"upstream-retry-budget" cfg:"upstream_retry_budget" env:"OAUTH2_PROXY_UPSTREAM_RETRY_BUDGET"`
+	UpstreamMaxIdleConns          int           `flag:"upstream-max-idle-conns" cfg:"upstream_max_idle_conns" env:"OAUTH2_PROXY_UPSTREAM_MAX_IDLE_CONNS"`
+	UpstreamMaxIdleConnsPerHost   int           `flag:"upstream-max-idle-conns-per-host" cfg:"upstream_max_idle_conns_per_host" env:"OAUTH2_PROXY_UPSTREAM_MAX_IDLE_CONNS_PER_HOST"`
+	UpstreamIdleConnTimeout       time.Duration `flag:"upstream-idle-conn-timeout" cfg:"upstream_idle_conn_timeout" env:"OAUTH2_PROXY_UPSTREAM_IDLE_CONN_TIMEOUT"`
+	UpstreamDisableKeepAlives     bool          `flag:"upstream-disable-keep-alives" cfg:"upstream_disable_keep_alives" env:"OAUTH2_PROXY_UPSTREAM_DISABLE_KEEP_ALIVES"`
+	UpstreamTransports            []string      `flag:"upstream-transport" cfg:"upstream_transports" env:"OAUTH2_PROXY_UPSTREAM_TRANSPORTS"`
+	TokenRefreshSkew              time.Duration `flag:"token-refresh-skew" cfg:"token_refresh_skew" env:"OAUTH2_PROXY_TOKEN_REFRESH_SKEW"`
+	RequestDeadline               time.Duration `flag:"request-deadline" cfg:"request_deadline" env:"OAUTH2_PROXY_REQUEST_DEADLINE"`
+	UpstreamRoutes                []string      `flag:"upstream-route" cfg:"upstream_routes" env:"OAUTH2_PROXY_UPSTREAM_ROUTES"`
+	UpstreamShadows               []string      `flag:"upstream-shadow" cfg:"upstream_shadows" env:"OAUTH2_PROXY_UPSTREAM_SHADOWS"`
+	UpstreamShadowMaxBodySize     int64         `flag:"upstream-shadow-max-body-size" cfg:"upstream_shadow_max_body_size" env:"OAUTH2_PROXY_UPSTREAM_SHADOW_MAX_BODY_SIZE"`
+	CompressResponses             bool          `flag:"compress-responses" cfg:"compress_responses" env:"OAUTH2_PROXY_COMPRESS_RESPONSES"`
+	CompressUpstreamResponses     bool          `flag:"compress-upstream-responses" cfg:"compress_upstream_responses" env:"OAUTH2_PROXY_COMPRESS_UPSTREAM_RESPONSES"`
+	CompressMinSize               int           `flag:"compress-min-size" cfg:"compress_min_size" env:"OAUTH2_PROXY_COMPRESS_MIN_SIZE"`
+	CompressContentTypes          []string      `flag:"compress-content-type" cfg:"compress_content_types" env:"OAUTH2_PROXY_COMPRESS_CONTENT_TYPES"`
+	ProviderStartupCheck          string        `flag:"provider-startup-check" cfg:"provider_startup_check" env:"OAUTH2_PROXY_PROVIDER_STARTUP_CHECK"`
+	AllowedClockSkew              time.Duration `flag:"allowed-clock-skew" cfg:"allowed_clock_skew" env:"OAUTH2_PROXY_ALLOWED_CLOCK_SKEW"`
+	OAuthStateTTL                 time.Duration `flag:"oauth-state-ttl" cfg:"oauth_state_ttl" env:"OAUTH2_PROXY_OAUTH_STATE_TTL"`
+	RedirectHosts                 []string      `flag:"redirect-host" cfg:"redirect_hosts" env:"OAUTH2_PROXY_REDIRECT_HOSTS"`
+	RefreshGracePeriod            time.Duration `flag:"refresh-grace-period" cfg:"refresh_grace_period" env:"OAUTH2_PROXY_REFRESH_GRACE_PERIOD"`
+	MissingSessionAction          string        `flag:"missing-session-action" cfg:"missing_session_action" env:"OAUTH2_PROXY_MISSING_SESSION_ACTION"`
+	UpstreamFileIndexes           []string      `flag:"upstream-file-index" cfg:"upstream_file_indexes" env:"OAUTH2_PROXY_UPSTREAM_FILE_INDEXES"`
+	UpstreamFileListing           bool          `flag:"upstream-file-directory-listing" cfg:"upstream_file_directory_listing" env:"OAUTH2_PROXY_UPSTREAM_FILE_DIRECTORY_LISTING"`
+	UpstreamFileContentTypes      []string      `flag:"upstream-file-content-type" cfg:"upstream_file_content_types" env:"OAUTH2_PROXY_UPSTREAM_FILE_CONTENT_TYPES"`
+	UpstreamFileSniffing          bool          `flag:"upstream-file-content-sniffing" cfg:"upstream_file_content_sniffing" env:"OAUTH2_PROXY_UPSTREAM_FILE_CONTENT_SNIFFING"`
 
 	// These options allow for other providers besides Google, with
 	// potential overrides.
-	Provider                           string `flag:"provider" cfg:"provider" env:"OAUTH2_PROXY_PROVIDER"`
-	ProviderName                       string `flag:"provider-display-name" cfg:"provider_display_name" env:"OAUTH2_PROXY_PROVIDER_DISPLAY_NAME"`
-	OIDCIssuerURL                      string `flag:"oidc-issuer-url" cfg:"oidc_issuer_url" env:"OAUTH2_PROXY_OIDC_ISSUER_URL"`
-	InsecureOIDCAllowUnverifiedEmail   bool   `flag:"insecure-oidc-allow-unverified-email" cfg:"insecure_oidc_allow_unverified_email" env:"OAUTH2_PROXY_INSECURE_OIDC_ALLOW_UNVERIFIED_EMAIL"`
-	InsecureOIDCSkipIssuerVerification bool   `flag:"insecure-oidc-skip-issuer-verification" cfg:"insecure_oidc_skip_issuer_verification" env:"OAUTH2_PROXY_INSECURE_OIDC_SKIP_ISSUER_VERIFICATION"`
-	SkipOIDCDiscovery                  bool   `flag:"skip-oidc-discovery" cfg:"skip_oidc_discovery" env:"OAUTH2_PROXY_SKIP_OIDC_DISCOVERY"`
-	OIDCJwksURL                        string `flag:"oidc-jwks-url" cfg:"oidc_jwks_url" env:"OAUTH2_PROXY_OIDC_JWKS_URL"`
-	LoginURL                           string `flag:"login-url" cfg:"login_url" env:"OAUTH2_PROXY_LOGIN_URL"`
-	RedeemURL                          string `flag:"redeem-url" cfg:"redeem_url" env:"OAUTH2_PROXY_REDEEM_URL"`
-	ProfileURL                         string `flag:"profile-url" cfg:"profile_url" env:"OAUTH2_PROXY_PROFILE_URL"`
-	ProtectedResource                  string `flag:"resource" cfg:"resource" env:"OAUTH2_PROXY_RESOURCE"`
-	ValidateURL                        string `flag:"validate-url" cfg:"validate_url" env:"OAUTH2_PROXY_VALIDATE_URL"`
-	Scope                              string `flag:"scope" cfg:"scope" env:"OAUTH2_PROXY_SCOPE"`
-	Prompt                             string `flag:"prompt" cfg:"prompt" env:"OAUTH2_PROXY_PROMPT"`
-	ApprovalPrompt                     string `flag:"approval-prompt" cfg:"approval_prompt" env:"OAUTH2_PROXY_APPROVAL_PROMPT"` // Deprecated by OIDC 1.0
-	UserIDClaim                        string `flag:"user-id-claim" cfg:"user_id_claim" env:"OAUTH2_PROXY_USER_ID_CLAIM"`
+	Provider                         string   `flag:"provider" cfg:"provider" env:"OAUTH2_PROXY_PROVIDER"`
+	ProviderName                     string   `flag:"provider-display-name" cfg:"provider_display_name" env:"OAUTH2_PROXY_PROVIDER_DISPLAY_NAME"`
+	OIDCIssuerURL                    string   `flag:"oidc-issuer-url" cfg:"oidc_issuer_url" env:"OAUTH2_PROXY_OIDC_ISSUER_URL"`
+	OIDCTenantSource                 string   `flag:"oidc-tenant-source" cfg:"oidc_tenant_source" env:"OAUTH2_PROXY_OIDC_TENANT_SOURCE"`
+	OIDCTenantsFile                  string   `flag:"oidc-tenants-file" cfg:"oidc_tenants_file" env:"OAUTH2_PROXY_OIDC_TENANTS_FILE"`
+	InsecureOIDCAllowUnverifiedEmail bool     `flag:"insecure-oidc-allow-unverified-email" cfg:"insecure_oidc_allow_unverified_email" env:"OAUTH2_PROXY_INSECURE_OIDC_ALLOW_UNVERIFIED_EMAIL"`
+	SkipOIDCDiscovery                bool     `flag:"skip-oidc-discovery" cfg:"skip_oidc_discovery" env:"OAUTH2_PROXY_SKIP_OIDC_DISCOVERY"`
+	OIDCJwksURL                      string   `flag:"oidc-jwks-url" cfg:"oidc_jwks_url" env:"OAUTH2_PROXY_OIDC_JWKS_URL"`
+	LoginURL                         string   `flag:"login-url" cfg:"login_url" env:"OAUTH2_PROXY_LOGIN_URL"`
+	RedeemURL                        string   `flag:"redeem-url" cfg:"redeem_url" env:"OAUTH2_PROXY_REDEEM_URL"`
+	RedeemClientHeaders              []string `flag:"redeem-client-header" cfg:"redeem_client_headers" env:"OAUTH2_PROXY_REDEEM_CLIENT_HEADERS"`
+	ProfileURL                       string   `flag:"profile-url" cfg:"profile_url" env:"OAUTH2_PROXY_PROFILE_URL"`
+	ProtectedResource                string   `flag:"resource" cfg:"resource" env:"OAUTH2_PROXY_RESOURCE"`
+	ValidateURL                      string   `flag:"validate-url" cfg:"validate_url" env:"OAUTH2_PROXY_VALIDATE_URL"`
+	Scope                            string   `flag:"scope" cfg:"scope" env:"OAUTH2_PROXY_SCOPE"`
+	Prompt                           string   `flag:"prompt" cfg:"prompt" env:"OAUTH2_PROXY_PROMPT"`
+	ApprovalPrompt                   string   `flag:"approval-prompt" cfg:"approval_prompt" env:"OAUTH2_PROXY_APPROVAL_PROMPT"` // Deprecated by OIDC 1.0
+	UserIDClaim                      string   `flag:"user-id-claim" cfg:"user_id_claim" env:"OAUTH2_PROXY_USER_ID_CLAIM"`
+
+	Verification options.IDTokenVerificationOptions `cfg:",squash"`
 
 	// Configuration values for logging
-	LoggingFilename       string `flag:"logging-filename" cfg:"logging_filename" env:"OAUTH2_PROXY_LOGGING_FILENAME"`
-	LoggingMaxSize        int    `flag:"logging-max-size" cfg:"logging_max_size" env:"OAUTH2_PROXY_LOGGING_MAX_SIZE"`
-	LoggingMaxAge         int    `flag:"logging-max-age" cfg:"logging_max_age" env:"OAUTH2_PROXY_LOGGING_MAX_AGE"`
-	LoggingMaxBackups     int    `flag:"logging-max-backups" cfg:"logging_max_backups" env:"OAUTH2_PROXY_LOGGING_MAX_BACKUPS"`
-	LoggingLocalTime      bool   `flag:"logging-local-time" cfg:"logging_local_time" env:"OAUTH2_PROXY_LOGGING_LOCAL_TIME"`
-	LoggingCompress       bool   `flag:"logging-compress" cfg:"logging_compress" env:"OAUTH2_PROXY_LOGGING_COMPRESS"`
-	StandardLogging       bool   `flag:"standard-logging" cfg:"standard_logging" env:"OAUTH2_PROXY_STANDARD_LOGGING"`
-	StandardLoggingFormat string `flag:"standard-logging-format" cfg:"standard_logging_format" env:"OAUTH2_PROXY_STANDARD_LOGGING_FORMAT"`
-	RequestLogging        bool   `flag:"request-logging" cfg:"request_logging" env:"OAUTH2_PROXY_REQUEST_LOGGING"`
-	RequestLoggingFormat  string `flag:"request-logging-format" cfg:"request_logging_format" env:"OAUTH2_PROXY_REQUEST_LOGGING_FORMAT"`
-	ExcludeLoggingPaths   string `flag:"exclude-logging-paths" cfg:"exclude_logging_paths" env:"OAUTH2_PROXY_EXCLUDE_LOGGING_PATHS"`
-	SilencePingLogging    bool   `flag:"silence-ping-logging" cfg:"silence_ping_logging" env:"OAUTH2_PROXY_SILENCE_PING_LOGGING"`
-	AuthLogging           bool   `flag:"auth-logging" cfg:"auth_logging" env:"OAUTH2_PROXY_LOGGING_AUTH_LOGGING"`
-	AuthLoggingFormat     string `flag:"auth-logging-format" cfg:"auth_logging_format" env:"OAUTH2_PROXY_AUTH_LOGGING_FORMAT"`
-	SignatureKey          string `flag:"signature-key" cfg:"signature_key" env:"OAUTH2_PROXY_SIGNATURE_KEY"`
-	AcrValues             string `flag:"acr-values" cfg:"acr_values" env:"OAUTH2_PROXY_ACR_VALUES"`
-	JWTKey                string `flag:"jwt-key" cfg:"jwt_key" env:"OAUTH2_PROXY_JWT_KEY"`
-	JWTKeyFile            string `flag:"jwt-key-file" cfg:"jwt_key_file" env:"OAUTH2_PROXY_JWT_KEY_FILE"`
-	PubJWKURL             string `flag:"pubjwk-url" cfg:"pubjwk_url" env:"OAUTH2_PROXY_PUBJWK_URL"`
-	GCPHealthChecks       bool   `flag:"gcp-healthchecks" cfg:"gcp_healthchecks" env:"OAUTH2_PROXY_GCP_HEALTHCHECKS"`
+	LoggingFilename          string        `flag:"logging-filename" cfg:"logging_filename" env:"OAUTH2_PROXY_LOGGING_FILENAME"`
+	LoggingMaxSize           int           `flag:"logging-max-size" cfg:"logging_max_size" env:"OAUTH2_PROXY_LOGGING_MAX_SIZE"`
+	LoggingMaxAge            int           `flag:"logging-max-age" cfg:"logging_max_age" env:"OAUTH2_PROXY_LOGGING_MAX_AGE"`
+	LoggingMaxBackups        int           `flag:"logging-max-backups" cfg:"logging_max_backups" env:"OAUTH2_PROXY_LOGGING_MAX_BACKUPS"`
+	LoggingLocalTime         bool          `flag:"logging-local-time" cfg:"logging_local_time" env:"OAUTH2_PROXY_LOGGING_LOCAL_TIME"`
+	LoggingCompress          bool          `flag:"logging-compress" cfg:"logging_compress" env:"OAUTH2_PROXY_LOGGING_COMPRESS"`
+	LoggingRotateInterval    time.Duration `flag:"logging-rotate-interval" cfg:"logging_rotate_interval" env:"OAUTH2_PROXY_LOGGING_ROTATE_INTERVAL"`
+	LoggingBufferSize        int           `flag:"logging-buffer-size" cfg:"logging_buffer_size" env:"OAUTH2_PROXY_LOGGING_BUFFER_SIZE"`
+	StandardLogging          bool          `flag:"standard-logging" cfg:"standard_logging" env:"OAUTH2_PROXY_STANDARD_LOGGING"`
+	StandardLoggingFormat    string        `flag:"standard-logging-format" cfg:"standard_logging_format" env:"OAUTH2_PROXY_STANDARD_LOGGING_FORMAT"`
+	StandardLoggingTarget    string        `flag:"standard-logging-target" cfg:"standard_logging_target" env:"OAUTH2_PROXY_STANDARD_LOGGING_TARGET"`
+	RequestLogging           bool          `flag:"request-logging" cfg:"request_logging" env:"OAUTH2_PROXY_REQUEST_LOGGING"`
+	RequestLoggingFormat     string        `flag:"request-logging-format" cfg:"request_logging_format" env:"OAUTH2_PROXY_REQUEST_LOGGING_FORMAT"`
+	RequestLoggingTarget     string        `flag:"request-logging-target" cfg:"request_logging_target" env:"OAUTH2_PROXY_REQUEST_LOGGING_TARGET"`
+	RequestLoggingSampleRate float64       `flag:"request-logging-sample-rate" cfg:"request_logging_sample_rate" env:"OAUTH2_PROXY_REQUEST_LOGGING_SAMPLE_RATE"`
+	LoggingMaskEmails        bool          `flag:"logging-mask-emails" cfg:"logging_mask_emails" env:"OAUTH2_PROXY_LOGGING_MASK_EMAILS"`
+	LoggingUserPrivacy       string        `flag:"logging-user-privacy" cfg:"logging_user_privacy" env:"OAUTH2_PROXY_LOGGING_USER_PRIVACY"`
+	LoggingUserHashKey       string        `flag:"logging-user-hash-key" cfg:"logging_user_hash_key" env:"OAUTH2_PROXY_LOGGING_USER_HASH_KEY"`
+	LoggingRedactQueryParams []string      `flag:"logging-redact-query-param" cfg:"logging_redact_query_params" env:"OAUTH2_PROXY_LOGGING_REDACT_QUERY_PARAMS"`
+	ExcludeLoggingPaths      string        `flag:"exclude-logging-paths" cfg:"exclude_logging_paths" env:"OAUTH2_PROXY_EXCLUDE_LOGGING_PATHS"`
+	SilencePingLogging       bool          `flag:"silence-ping-logging" cfg:"silence_ping_logging" env:"OAUTH2_PROXY_SILENCE_PING_LOGGING"`
+	AuthLogging              bool          `flag:"auth-logging" cfg:"auth_logging" env:"OAUTH2_PROXY_LOGGING_AUTH_LOGGING"`
+	AuthLoggingFormat        string        `flag:"auth-logging-format" cfg:"auth_logging_format" env:"OAUTH2_PROXY_AUTH_LOGGING_FORMAT"`
+	AuthLoggingTarget        string        `flag:"auth-logging-target" cfg:"auth_logging_target" env:"OAUTH2_PROXY_AUTH_LOGGING_TARGET"`
+	AuthLoggingFilename      string        `flag:"auth-logging-filename" cfg:"auth_logging_filename" env:"OAUTH2_PROXY_AUTH_LOGGING_FILENAME"`
+	AuthLoggingHashChain     bool          `flag:"auth-logging-hash-chain" cfg:"auth_logging_hash_chain" env:"OAUTH2_PROXY_AUTH_LOGGING_HASH_CHAIN"`
+	AuthLoggingHashKey       string        `flag:"auth-logging-hash-key" cfg:"auth_logging_hash_key" env:"OAUTH2_PROXY_AUTH_LOGGING_HASH_KEY"`
+	AuthLoggingEncryptionKey string        `flag:"auth-logging-encryption-key" cfg:"auth_logging_encryption_key" env:"OAUTH2_PROXY_AUTH_LOGGING_ENCRYPTION_KEY"`
+	GeoIPCountryDB           string        `flag:"geoip-country-db" cfg:"geoip_country_db" env:"OAUTH2_PROXY_GEOIP_COUNTRY_DB"`
+	GeoIPASNDB               string        `flag:"geoip-asn-db" cfg:"geoip_asn_db" env:"OAUTH2_PROXY_GEOIP_ASN_DB"`
+	SignatureKey             string        `flag:"signature-key" cfg:"signature_key" env:"OAUTH2_PROXY_SIGNATURE_KEY"`
+	AcrValues                string        `flag:"acr-values" cfg:"acr_values" env:"OAUTH2_PROXY_ACR_VALUES"`
+	LoginHint                string        `flag:"login-hint" cfg:"login_hint" env:"OAUTH2_PROXY_LOGIN_HINT"`
+	DomainHint               string        `flag:"domain-hint" cfg:"domain_hint" env:"OAUTH2_PROXY_DOMAIN_HINT"`
+	JWTKey                   string        `flag:"jwt-key" cfg:"jwt_key" env:"OAUTH2_PROXY_JWT_KEY"`
+	JWTKeyFile               string        `flag:"jwt-key-file" cfg:"jwt_key_file" env:"OAUTH2_PROXY_JWT_KEY_FILE"`
+	PubJWKURL                string        `flag:"pubjwk-url" cfg:"pubjwk_url" env:"OAUTH2_PROXY_PUBJWK_URL"`
+	GCPHealthChecks          bool          `flag:"gcp-healthchecks" cfg:"gcp_healthchecks" env:"OAUTH2_PROXY_GCP_HEALTHCHECKS"`
 
 	// internal values that are set after config validation
 	redirectURL        *url.URL
 	proxyURLs          []*url.URL
 	compiledRegex      []*regexp.Regexp
+	wellKnownPaths     []string
+	anonymousRegex     []*regexp.Regexp
+	webAuthnRoutes     []*regexp.Regexp
+	stepUpRoutes       []stepUpRoute
+	accessWindows      []*accessWindow
+	interstitials      []*interstitial
+	headerTemplates    []*headerTemplate
+	identityMap        *identityMap
+	groupMapping       *groupMapping
+	featureFlags       *featureFlags
+	assertionSigner    *assertionSigner
+	baggageHashKey     []byte
+	traceHeaders       []string
+	tlsConfig          *tls.Config
+	corsPolicy         *corsPolicy
+	webhooks           *webhookNotifier
+	upstreamBreaker    *breakerConfig
+	upstreamFiles      *fileServerConfig
+	upstreamRoutes     []*upstreamRoute
+	rewriteRedirects   map[string]bool
+	upstreamAuth       map[string]hmacauth.HmacAuth
+	upstreamSigV4      map[string]*sigV4Signer
+	upstreamTransport  *http.Transport
+	upstreamTransports map[string]*http.Transport
+	lookupCache        sessionsapi.LookupCache
+	userLimits         *userLimits
+	loginThrottle      *loginThrottle
+	upstreamShadows    []*upstreamShadow
+	compression        *compression
 	provider           providers.Provider
 	sessionStore       sessionsapi.SessionStore
+	prevSessionStore   sessionsapi.SessionStore
 	signatureData      *SignatureData
 	oidcVerifier       *oidc.IDTokenVerifier
+	tenantProviders    *tenantProviders
 	jwtBearerVerifiers []*oidc.IDTokenVerifier
+	keySets            []*verification.KeySet
 	realClientIPParser realClientIPParser
+	redactQueryParams  []*regexp.Regexp
+	authLogHashKey     []byte
+	authLogCipher      cipher.AEAD
 }
 
 // SignatureData holds hmacauth signature hash and key
@@ -151,13 +319,40 @@ type SignatureData struct {
 // NewOptions constructs a new Options with defaulted values
 func NewOptions() *Options {
 	return &Options{
-		ProxyPrefix:         "/oauth2",
-		PingPath:            "/ping",
-		ProxyWebSockets:     true,
-		HTTPAddress:         "127.0.0.1:4180",
-		HTTPSAddress:        ":443",
-		ForceHTTPS:          false,
-		DisplayHtpasswdForm: true,
+		ProxyPrefix:                 "/oauth2",
+		PingPath:                    "/ping",
+		ProxyWebSockets:             true,
+		HTTPAddress:                 "127.0.0.1:4180",
+		HTTPSAddress:                ":443",
+		TLSMinVersion:               "TLS1.2",
+		CORSAllowedHeaders:          []string{"Authorization", "Content-Type", "X-Requested-With"},
+		CORSMaxAge:                  10 * time.Minute,
+		WebhookEvents:               []string{webhookSignIn, webhookSignOut, webhookRefreshFailure},
+		WebhookMaxRetries:           3,
+		UpstreamBreakerMinRequests:  20,
+		UpstreamBreakerWindow:       10 * time.Second,
+		UpstreamBreakerOpenDuration: 30 * time.Second,
+		UpstreamBreakerProbes:       3,
+		UpstreamRetryBudget:         0.2,
+		UpstreamMaxIdleConns:        100,
+		UpstreamMaxIdleConnsPerHost: http.DefaultMaxIdleConnsPerHost,
+		UpstreamIdleConnTimeout:     90 * time.Second,
+		UpstreamShadowMaxBodySize:   1 << 20,
+		UpstreamSigV4MaxBodySize:    10 << 20,
+		SkipAuthWellKnown:           []string{"acme-challenge"},
+		TraceHeaders:                defaultTraceHeaders,
+		UpstreamFileIndexes:         []string{"index.html"},
+		UpstreamFileListing:         true,
+		UpstreamFileSniffing:        true,
+		CompressMinSize:             1024,
+		CompressContentTypes:        defaultCompressContentTypes,
+		OAuthStateTTL:               15 * time.Minute,
+		MissingSessionAction:        missingSessionSignIn,
+		ForceHTTPS:                  false,
+		DisplayHtpasswdForm:         true,
+		LDAPUserAttribute:           "uid",
+		LDAPEmailAttribute:          "mail",
+		LDAPGroupAttribute:          "memberOf",
 		Cookie: options.CookieOptions{
 			Name:     "_oauth2_proxy",
 			Secure:   true,
@@ -166,7 +361,12 @@ func NewOptions() *Options {
 			Refresh:  time.Duration(0),
 		},
 		Session: options.SessionOptions{
-			Type: "cookie",
+			Type:                   "cookie",
+			UserSessionLimitAction: options.EvictUserSessionLimitAction,
+			CacheSize:              10000,
+		},
+		Verification: options.IDTokenVerificationOptions{
+			RefreshValidation: providers.RefreshValidationVerify,
 		},
 		SetXAuthRequest:                  false,
 		SkipAuthPreflight:                false,
@@ -178,17 +378,32 @@ func NewOptions() *Options {
 		SetAuthorization:                 false,
 		PassAuthorization:                false,
 		PreferEmailToUser:                false,
+		UpstreamHeaderSizePolicy:         "reject",
+		ImpersonationDuration:            time.Hour,
+		MachineTokenMaxTTL:               90 * 24 * time.Hour,
+		ProviderLookupCache:              "memory",
+		UserBandwidthWindow:              time.Minute,
+		UserLimitsStore:                  "memory",
+		LoginThrottleCooldown:            5 * time.Minute,
+		AccessWindowTimezone:             "UTC",
+		JWKSRefreshInterval:              time.Hour,
+		AssertionHeader:                  "X-Forwarded-Assertion",
+		AssertionIssuer:                  "oauth2-proxy",
 		Prompt:                           "", // Change to "login" when ApprovalPrompt officially deprecated
 		ApprovalPrompt:                   "force",
 		UserIDClaim:                      "email",
 		InsecureOIDCAllowUnverifiedEmail: false,
 		SkipOIDCDiscovery:                false,
+		OIDCTenantSource:                 "host",
 		LoggingFilename:                  "",
 		LoggingMaxSize:                   100,
 		LoggingMaxAge:                    7,
 		LoggingMaxBackups:                0,
 		LoggingLocalTime:                 true,
 		LoggingCompress:                  false,
+		LoggingRotateInterval:            time.Duration(0),
+		LoggingBufferSize:                0,
+		RequestLoggingSampleRate:         1,
 		ExcludeLoggingPaths:              "",
 		SilencePingLogging:               false,
 		StandardLogging:                  true,
@@ -230,11 +445,12 @@ func (o *Options) Validate() error {
 	if o.Cookie.Secret == "" {
 		msgs = append(msgs, "missing setting: cookie-secret")
 	}
-	if o.ClientID == "" {
+	// ldap authenticates users with their passwords, not as an OAuth client
+	if o.ClientID == "" && o.Provider != "ldap" {
 		msgs = append(msgs, "missing setting: client-id")
 	}
 	// login.gov uses a signed JWT to authenticate, not a client-secret
-	if o.Provider != "login.gov" {
+	if o.Provider != "login.gov" && o.Provider != "ldap" {
 		if o.ClientSecret == "" && o.ClientSecretFile == "" {
 			msgs = append(msgs, "missing setting: client-secret or client-secret-file")
 		}
@@ -254,11 +470,13 @@ func (o *Options) Validate() error {
 		msgs = append(msgs, "mutually exclusive: set-basic-auth and set-authorization-header can not both be true")
 	}
 
-	if o.OIDCIssuerURL != "" {
+	if strings.Contains(o.OIDCIssuerURL, tenantPlaceholder) {
+		msgs = configureTenants(o, msgs)
+	} else if o.OIDCIssuerURL != "" {
 
 		ctx := context.Background()
 
-		if o.InsecureOIDCSkipIssuerVerification && !o.SkipOIDCDiscovery {
+		if o.Verification.InsecureSkipIssuerVerification && !o.SkipOIDCDiscovery {
 			// go-oidc doesn't let us pass bypass the issuer check this in the oidc.NewProvider call
 			// (which uses discovery to get the URLs), so we'll do a quick check ourselves and if
 			// we get the URLs, we'll just use the non-discovery path.
@@ -310,21 +528,21 @@ func (o *Options) Validate() error {
 			if o.OIDCJwksURL == "" {
 				msgs = append(msgs, "missing setting: oidc-jwks-url")
 			}
-			keySet := oidc.NewRemoteKeySet(ctx, o.OIDCJwksURL)
-			o.oidcVerifier = oidc.NewVerifier(o.OIDCIssuerURL, keySet, &oidc.Config{
-				ClientID:        o.ClientID,
-				SkipIssuerCheck: o.InsecureOIDCSkipIssuerVerification,
-			})
+			keySet := verification.NewKeySet(o.OIDCJwksURL)
+			o.keySets = append(o.keySets, keySet)
+			o.oidcVerifier = verification.NewVerifier(o.OIDCIssuerURL, keySet, o.ClientID, o.Verification)
 		} else {
 			// Configure discoverable provider data.
 			provider, err := oidc.NewProvider(ctx, o.OIDCIssuerURL)
 			if err != nil {
 				return err
 			}
-			o.oidcVerifier = provider.Verifier(&oidc.Config{
-				ClientID:        o.ClientID,
-				SkipIssuerCheck: o.InsecureOIDCSkipIssuerVerification,
-			})
+			verifier, keySet, err := verification.NewKeySetProviderVerifier(provider, o.ClientID, o.Verification)
+			if err != nil {
+				return err
+			}
+			o.oidcVerifier = verifier
+			o.keySets = append(o.keySets, keySet)
 
 			o.LoginURL = provider.Endpoint().AuthURL
 			o.RedeemURL = provider.Endpoint().TokenURL
@@ -334,6 +552,18 @@ func (o *Options) Validate() error {
 		}
 	}
 
+	if o.JWKSRefreshInterval < 0 {
+		msgs = append(msgs, fmt.Sprintf("jwks_refresh_interval (%s) must not be negative", o.JWKSRefreshInterval))
+	}
+	switch o.Verification.RefreshValidation {
+	case providers.RefreshValidationVerify, providers.RefreshValidationStrict:
+	default:
+		msgs = append(msgs, fmt.Sprintf("oidc_refresh_validation (%s) must be one of %q or %q", o.Verification.RefreshValidation, providers.RefreshValidationVerify, providers.RefreshValidationStrict))
+	}
+	if o.Verification.AllowedClockSkew < 0 {
+		msgs = append(msgs, fmt.Sprintf("oidc_allowed_clock_skew (%s) must not be negative", o.Verification.AllowedClockSkew))
+	}
+
 	if o.PreferEmailToUser && !o.PassBasicAuth && !o.PassUserHeaders {
 		msgs = append(msgs, "PreferEmailToUser should only be used with PassBasicAuth or PassUserHeaders")
 	}
@@ -348,11 +578,13 @@ func (o *Options) Validate() error {
 			var jwtIssuers []jwtIssuer
 			jwtIssuers, msgs = parseJwtIssuers(o.ExtraJwtIssuers, msgs)
 			for _, jwtIssuer := range jwtIssuers {
-				verifier, err := newVerifierFromJwtIssuer(jwtIssuer)
+				verifier, keySet, err := newVerifierFromJwtIssuer(jwtIssuer, o.Verification)
 				if err != nil {
 					msgs = append(msgs, fmt.Sprintf("error building verifiers: %s", err))
+					continue
 				}
 				o.jwtBearerVerifiers = append(o.jwtBearerVerifiers, verifier)
+				o.keySets = append(o.keySets, keySet)
 			}
 		}
 	}
@@ -370,6 +602,9 @@ func (o *Options) Validate() error {
 			o.proxyURLs = append(o.proxyURLs, upstreamURL)
 		}
 	}
+	msgs = validateRewriteRedirectUpstreams(o, msgs)
+	msgs = validateUpstreamSigning(o, msgs)
+	msgs = validateUpstreamTransports(o, msgs)
 
 	for _, u := range o.SkipAuthRegex {
 		compiledRegex, err := regexp.Compile(u)
@@ -379,10 +614,21 @@ func (o *Options) Validate() error {
 		}
 		o.compiledRegex = append(o.compiledRegex, compiledRegex)
 	}
+	for _, u := range o.AnonymousRegex {
+		anonymousRegex, err := regexp.Compile(u)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("error compiling anonymous regex=%q %s", u, err))
+			continue
+		}
+		o.anonymousRegex = append(o.anonymousRegex, anonymousRegex)
+	}
 	msgs = parseProviderInfo(o, msgs)
 
 	var cipher *encryption.Cipher
-	if o.PassAccessToken || o.SetAuthorization || o.PassAuthorization || (o.Cookie.Refresh != time.Duration(0)) {
+	// header templates and upstream routes can only use the ID token's
+	// claims if it is kept
+	if o.PassAccessToken || o.SetAuthorization || o.PassAuthorization || (o.Cookie.Refresh != time.Duration(0)) ||
+		headerTemplatesUseClaims(o.HeaderTemplates) || headerTemplatesUseClaims(o.UpstreamRoutes) {
 		validCookieSecretSize := false
 		for _, i := range []int{16, 24, 32} {
 			if len(encryption.SecretBytes(o.Cookie.Secret)) == i {
@@ -401,8 +647,8 @@ func (o *Options) Validate() error {
 			msgs = append(msgs, fmt.Sprintf(
 				"cookie_secret must be 16, 24, or 32 bytes "+
 					"to create an AES cipher when "+
-					"pass_access_token == true or "+
-					"cookie_refresh != 0, but is %d bytes.%s",
+					"pass_access_token == true, "+
+					"cookie_refresh != 0 or header templates or upstream routes use .Claims, but is %d bytes.%s",
 				len(encryption.SecretBytes(o.Cookie.Secret)), suffix))
 		} else {
 			var err error
@@ -414,19 +660,76 @@ func (o *Options) Validate() error {
 	}
 
 	o.Session.Cipher = cipher
-	sessionStore, err := sessions.NewSessionStore(&o.Session, &o.Cookie)
-	if err != nil {
-		msgs = append(msgs, fmt.Sprintf("error initialising session storage: %v", err))
+	msgs = validateUserSessions(o, msgs)
+	msgs = validateSessionCache(o, msgs)
+	msgs = validateSessionGC(o, msgs)
+	if cookieMsgs := cookies.Validate(&o.Cookie); len(cookieMsgs) > 0 {
+		msgs = append(msgs, cookieMsgs...)
 	} else {
-		o.sessionStore = sessionStore
+		// The previous store is created first so that the current store is
+		// the one whose sessions are counted
+		msgs = validatePreviousSessionStore(o, msgs)
+		sessionStore, err := sessions.NewSessionStore(&o.Session, &o.Cookie)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("error initialising session storage: %v", err))
+		} else {
+			o.sessionStore = sessionStore
+		}
 	}
-
-	if o.Cookie.Refresh >= o.Cookie.Expire {
-		msgs = append(msgs, fmt.Sprintf(
-			"cookie_refresh (%s) must be less than "+
-				"cookie_expire (%s)",
-			o.Cookie.Refresh.String(),
-			o.Cookie.Expire.String()))
+	msgs = validateMachineTokens(o, msgs)
+	msgs = validateWebAuthn(o, msgs)
+	msgs = validateStepUp(o, msgs)
+	msgs = validateAccessWindows(o, msgs)
+	msgs = validateInterstitials(o, msgs)
+	msgs = validateHeaderTemplates(o, msgs)
+	msgs = validateIdentityMap(o, msgs)
+	msgs = validateGroupMapping(o, msgs)
+	msgs = validateFeatureFlags(o, msgs)
+	msgs = validateUpstreamRoutes(o, msgs)
+	msgs = validateUpstreamFiles(o, msgs)
+	msgs = validateWellKnownPaths(o, msgs)
+	msgs = validateUpstreamShadows(o, msgs)
+	msgs = validateCompression(o, msgs)
+	msgs = validateProviderLookupCache(o, msgs)
+	msgs = validateUserLimits(o, msgs)
+	msgs = validateLoginThrottle(o, msgs)
+	msgs = validateAssertions(o, msgs)
+	msgs = validateBaggage(o, msgs)
+	msgs = validateTraceHeaders(o, msgs)
+	msgs = validateCORS(o, msgs)
+	msgs = validateWebhooks(o, msgs)
+	msgs = validateUpstreamBreaker(o, msgs)
+	msgs = validateRedirectHosts(o, msgs)
+	msgs = validateSessionTokens(o, msgs)
+	if o.Session.IdleTimeout < 0 {
+		msgs = append(msgs, fmt.Sprintf("session_idle_timeout (%s) must not be negative", o.Session.IdleTimeout))
+	}
+	if o.TokenRefreshSkew < 0 {
+		msgs = append(msgs, fmt.Sprintf("token_refresh_skew (%s) must not be negative", o.TokenRefreshSkew))
+	}
+	if o.RequestDeadline < 0 {
+		msgs = append(msgs, fmt.Sprintf("request_deadline (%s) must not be negative", o.RequestDeadline))
+	}
+	switch o.ProviderStartupCheck {
+	case "", providerCheckWarn, providerCheckFail:
+	default:
+		msgs = append(msgs, fmt.Sprintf("provider_startup_check (%s) must be one of %q or %q", o.ProviderStartupCheck, providerCheckWarn, providerCheckFail))
+	}
+	if o.AllowedClockSkew < 0 {
+		msgs = append(msgs, fmt.Sprintf("allowed_clock_skew (%s) must not be negative", o.AllowedClockSkew))
+	} else {
+		clock.SetAllowedSkew(o.AllowedClockSkew)
+	}
+	if o.OAuthStateTTL <= 0 {
+		msgs = append(msgs, fmt.Sprintf("oauth_state_ttl (%s) must be positive", o.OAuthStateTTL))
+	}
+	if o.RefreshGracePeriod < 0 {
+		msgs = append(msgs, fmt.Sprintf("refresh_grace_period (%s) must not be negative", o.RefreshGracePeriod))
+	}
+	switch o.MissingSessionAction {
+	case missingSessionSignIn, missingSessionRedirect:
+	default:
+		msgs = append(msgs, fmt.Sprintf("missing_session_action (%s) must be one of ['sign_in', 'redirect']", o.MissingSessionAction))
 	}
 
 	if len(o.GoogleGroups) > 0 || o.GoogleAdminEmail != "" || o.GoogleServiceAccountJSON != "" {
@@ -441,12 +744,6 @@ func (o *Options) Validate() error {
 		}
 	}
 
-	switch o.Cookie.SameSite {
-	case "", "none", "lax", "strict":
-	default:
-		msgs = append(msgs, fmt.Sprintf("cookie_samesite (%s) must be one of ['', 'lax', 'strict', 'none']", o.Cookie.SameSite))
-	}
-
 	// Sort cookie domains by length, so that we try longer (and more specific)
 	// domains first
 	sort.Slice(o.Cookie.Domains, func(i, j int) bool {
@@ -455,9 +752,21 @@ func (o *Options) Validate() error {
 
 	msgs = parseSignatureKey(o, msgs)
 	msgs = validateCookieName(o, msgs)
+	msgs = validateCookieHandoffHosts(o, msgs)
+	msgs = validateDebugAddress(o, msgs)
+	msgs = validateUpstreamHeaderSize(o, msgs)
+	msgs = validateRedeemClientHeaders(o, msgs)
+	if o.SessionTLSBinding && (o.TLSCertFile == "" || o.TLSKeyFile == "") {
+		msgs = append(msgs, "session_tls_binding requires the proxy to terminate TLS with tls_cert_file and tls_key_file")
+	}
+	msgs = validateTLS(o, msgs)
+	if len(o.ImpersonationAdmins) > 0 && o.ImpersonationDuration <= 0 {
+		msgs = append(msgs, fmt.Sprintf("impersonation_duration (%s) must be greater than 0", o.ImpersonationDuration))
+	}
 	msgs = setupLogger(o, msgs)
 
 	if o.ReverseProxy {
+		var err error
 		o.realClientIPParser, err = getRealClientIPParser(o.RealClientIPHeader)
 		if err != nil {
 			msgs = append(msgs, fmt.Sprintf("real_client_ip_header (%s) not accepted parameter value: %v", o.RealClientIPHeader, err))
@@ -480,6 +789,9 @@ func parseProviderInfo(o *Options, msgs []string) []string {
 		Prompt:           o.Prompt,
 		ApprovalPrompt:   o.ApprovalPrompt,
 		AcrValues:        o.AcrValues,
+		LoginHint:        o.LoginHint,
+		DomainHint:       o.DomainHint,
+		RefreshSkew:      o.TokenRefreshSkew,
 	}
 	p.LoginURL, msgs = parseURL(o.LoginURL, "login", msgs)
 	p.RedeemURL, msgs = parseURL(o.RedeemURL, "redeem", msgs)
@@ -488,6 +800,9 @@ func parseProviderInfo(o *Options, msgs []string) []string {
 	p.ProtectedResource, msgs = parseURL(o.ProtectedResource, "resource", msgs)
 
 	o.provider = providers.New(o.Provider, p)
+	if o.provider == nil {
+		return append(msgs, fmt.Sprintf("provider %s is not available in this build (available: %s)", o.Provider, strings.Join(providers.Names(), ", ")))
+	}
 	switch p := o.provider.(type) {
 	case *providers.AzureProvider:
 		p.Configure(o.AzureTenant)
@@ -496,22 +811,14 @@ func parseProviderInfo(o *Options, msgs []string) []string {
 		p.SetRepo(o.GitHubRepo, o.GitHubToken)
 	case *providers.KeycloakProvider:
 		p.SetGroup(o.KeycloakGroup)
-	case *providers.GoogleProvider:
-		if o.GoogleServiceAccountJSON != "" {
-			file, err := os.Open(o.GoogleServiceAccountJSON)
-			if err != nil {
-				msgs = append(msgs, "invalid Google credentials file: "+o.GoogleServiceAccountJSON)
-			} else {
-				p.SetGroupRestriction(o.GoogleGroups, o.GoogleAdminEmail, file)
-			}
-		}
 	case *providers.BitbucketProvider:
 		p.SetTeam(o.BitbucketTeam)
 		p.SetRepository(o.BitbucketRepository)
 	case *providers.OIDCProvider:
 		p.AllowUnverifiedEmail = o.InsecureOIDCAllowUnverifiedEmail
 		p.UserIDClaim = o.UserIDClaim
-		if o.oidcVerifier == nil {
+		p.RefreshValidation = o.Verification.RefreshValidation
+		if o.oidcVerifier == nil && o.tenantProviders == nil {
 			msgs = append(msgs, "oidc provider requires an oidc issuer URL")
 		} else {
 			p.Verifier = o.oidcVerifier
@@ -531,48 +838,24 @@ func parseProviderInfo(o *Options, msgs []string) []string {
 			if err != nil {
 				msgs = append(msgs, "failed to initialize oidc provider for gitlab.com")
 			} else {
-				p.Verifier = provider.Verifier(&oidc.Config{
-					ClientID: o.ClientID,
-				})
+				p.Verifier = verification.NewProviderVerifier(provider, o.ClientID, o.Verification.WithoutInsecureSkips())
 
 				p.LoginURL, msgs = parseURL(provider.Endpoint().AuthURL, "login", msgs)
 				p.RedeemURL, msgs = parseURL(provider.Endpoint().TokenURL, "redeem", msgs)
 			}
 		}
-	case *providers.LoginGovProvider:
-		p.PubJWKURL, msgs = parseURL(o.PubJWKURL, "pubjwk", msgs)
-
-		// JWT key can be supplied via env variable or file in the filesystem, but not both.
-		switch {
-		case o.JWTKey != "" && o.JWTKeyFile != "":
-			msgs = append(msgs, "cannot set both jwt-key and jwt-key-file options")
-		case o.JWTKey == "" && o.JWTKeyFile == "":
-			msgs = append(msgs, "login.gov provider requires a private key for signing JWTs")
-		case o.JWTKey != "":
-			// The JWT Key is in the commandline argument
-			signKey, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(o.JWTKey))
-			if err != nil {
-				msgs = append(msgs, "could not parse RSA Private Key PEM")
-			} else {
-				p.JWTKey = signKey
-			}
-		case o.JWTKeyFile != "":
-			// The JWT key is in the filesystem
-			keyData, err := ioutil.ReadFile(o.JWTKeyFile)
-			if err != nil {
-				msgs = append(msgs, "could not read key file: "+o.JWTKeyFile)
-			}
-			signKey, err := jwt.ParseRSAPrivateKeyFromPEM(keyData)
-			if err != nil {
-				msgs = append(msgs, "could not parse private key from PEM file:"+o.JWTKeyFile)
-			} else {
-				p.JWTKey = signKey
-			}
-		}
+	}
+	for _, configure := range providerConfigurers {
+		msgs = configure(o, msgs)
 	}
 	return msgs
 }
 
+// providerConfigurers configure the providers that can be left out of the
+// build, from their own build tagged files, so that this file doesn't
+// depend on them
+var providerConfigurers []func(o *Options, msgs []string) []string
+
 func parseSignatureKey(o *Options, msgs []string) []string {
 	if o.SignatureKey == "" {
 		return msgs
@@ -612,26 +895,727 @@ func parseJwtIssuers(issuers []string, msgs []string) ([]jwtIssuer, []string) {
 }
 
 // newVerifierFromJwtIssuer takes in issuer information in jwtIssuer info and returns
-// a verifier for that issuer.
-func newVerifierFromJwtIssuer(jwtIssuer jwtIssuer) (*oidc.IDTokenVerifier, error) {
-	config := &oidc.Config{
-		ClientID: jwtIssuer.audience,
-	}
+// a verifier for that issuer, and the key set it verifies signatures with.
+func newVerifierFromJwtIssuer(jwtIssuer jwtIssuer, opts options.IDTokenVerificationOptions) (*oidc.IDTokenVerifier, *verification.KeySet, error) {
+	// the issuer=audience pair is checked whatever the provider allows
+	opts = opts.WithoutInsecureSkips()
 	// Try as an OpenID Connect Provider first
-	var verifier *oidc.IDTokenVerifier
 	provider, err := oidc.NewProvider(context.Background(), jwtIssuer.issuerURI)
 	if err != nil {
 		// Try as JWKS URI
 		jwksURI := strings.TrimSuffix(jwtIssuer.issuerURI, "/") + "/.well-known/jwks.json"
 		_, err := http.NewRequest("GET", jwksURI, nil)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
-		verifier = oidc.NewVerifier(jwtIssuer.issuerURI, oidc.NewRemoteKeySet(context.Background(), jwksURI), config)
-	} else {
-		verifier = provider.Verifier(config)
+		keySet := verification.NewKeySet(jwksURI)
+		return verification.NewVerifier(jwtIssuer.issuerURI, keySet, jwtIssuer.audience, opts), keySet, nil
 	}
-	return verifier, nil
+	return verification.NewKeySetProviderVerifier(provider, jwtIssuer.audience, opts)
+}
+
+// validateDebugAddress ensures the debug handlers, which expose the internals
+// of the process, can only be reached from the local machine
+func validateDebugAddress(o *Options, msgs []string) []string {
+	if o.DebugAddress == "" {
+		return msgs
+	}
+	host, _, err := net.SplitHostPort(o.DebugAddress)
+	if err != nil {
+		return append(msgs, fmt.Sprintf("invalid debug-address %q: %v", o.DebugAddress, err))
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return append(msgs, fmt.Sprintf("debug-address must listen on a loopback address, got %q", o.DebugAddress))
+	}
+	return msgs
+}
+
+func validateUpstreamHeaderSize(o *Options, msgs []string) []string {
+	if o.UpstreamHeaderSizeLimit < 0 {
+		msgs = append(msgs, fmt.Sprintf("upstream_header_size_limit (%d) must not be negative", o.UpstreamHeaderSizeLimit))
+	}
+	switch o.UpstreamHeaderSizePolicy {
+	case "reject", "drop":
+	default:
+		msgs = append(msgs, fmt.Sprintf("upstream_header_size_policy (%s) must be one of ['reject', 'drop']", o.UpstreamHeaderSizePolicy))
+	}
+	return msgs
+}
+
+func validateMachineTokens(o *Options, msgs []string) []string {
+	if !o.MachineTokens {
+		return msgs
+	}
+	if o.MachineTokenMaxTTL <= 0 {
+		msgs = append(msgs, fmt.Sprintf("machine_token_max_ttl (%s) must be greater than 0", o.MachineTokenMaxTTL))
+	}
+	if o.sessionStore != nil {
+		if _, ok := o.sessionStore.(sessionsapi.MachineTokenStore); !ok {
+			msgs = append(msgs, fmt.Sprintf("machine_tokens requires a session store able to keep them, such as redis, not %s", o.Session.Type))
+		}
+	}
+	return msgs
+}
+
+func validateWebAuthn(o *Options, msgs []string) []string {
+	if o.WebAuthnRPID == "" {
+		if len(o.WebAuthnRoutes) > 0 {
+			msgs = append(msgs, "webauthn_routes requires a webauthn_rp_id")
+		}
+		return msgs
+	}
+	if strings.ContainsAny(o.WebAuthnRPID, ":/") {
+		msgs = append(msgs, fmt.Sprintf("webauthn_rp_id (%s) must be a domain, eg. example.com", o.WebAuthnRPID))
+	}
+	if len(o.WebAuthnOrigins) == 0 {
+		o.WebAuthnOrigins = []string{"https://" + o.WebAuthnRPID}
+	}
+	for _, origin := range o.WebAuthnOrigins {
+		u, err := url.Parse(origin)
+		if err != nil || u.Host == "" || (u.Path != "" && u.Path != "/") {
+			msgs = append(msgs, fmt.Sprintf("webauthn_origins (%s) must be origins, eg. https://auth.example.com", origin))
+		}
+	}
+	for _, r := range o.WebAuthnRoutes {
+		route, err := regexp.Compile(r)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("error compiling webauthn route regex=%q %s", r, err))
+			continue
+		}
+		o.webAuthnRoutes = append(o.webAuthnRoutes, route)
+	}
+	if o.sessionStore != nil {
+		if _, ok := o.sessionStore.(sessionsapi.WebAuthnCredentialStore); !ok {
+			msgs = append(msgs, fmt.Sprintf("webauthn_rp_id requires a session store able to keep credentials, such as redis, not %s", o.Session.Type))
+		}
+	}
+	return msgs
+}
+
+// validateSessionTokens checks that nothing needs the provider's tokens when
+// sessions don't keep them
+func validateSessionTokens(o *Options, msgs []string) []string {
+	if !o.Session.IdentityOnly {
+		return msgs
+	}
+	for _, option := range []struct {
+		name string
+		used bool
+	}{
+		{"pass_access_token", o.PassAccessToken},
+		{"set_authorization_header", o.SetAuthorization},
+		{"pass_authorization_header", o.PassAuthorization},
+		{"cookie_refresh", o.Cookie.Refresh != time.Duration(0)},
+		{"header templates using .Claims", headerTemplatesUseClaims(o.HeaderTemplates)},
+		{"upstream routes using .Claims", headerTemplatesUseClaims(o.UpstreamRoutes)},
+	} {
+		if option.used {
+			msgs = append(msgs, fmt.Sprintf("session_identity_only can't be used with %s, which needs the provider's tokens", option.name))
+		}
+	}
+	return msgs
+}
+
+func validateProviderLookupCache(o *Options, msgs []string) []string {
+	if o.ProviderLookupCacheTTL < 0 {
+		return append(msgs, fmt.Sprintf("provider_lookup_cache_ttl (%s) must not be negative", o.ProviderLookupCacheTTL))
+	}
+	if o.ProviderLookupCacheTTL == 0 {
+		return msgs
+	}
+	switch o.ProviderLookupCache {
+	case "memory":
+		o.lookupCache = providers.NewMemoryLookupCache()
+	case "redis":
+		if o.sessionStore == nil {
+			return msgs
+		}
+		lookupCache, ok := o.sessionStore.(sessionsapi.LookupCache)
+		if !ok {
+			return append(msgs, fmt.Sprintf("provider_lookup_cache redis requires the redis session store, not %s", o.Session.Type))
+		}
+		o.lookupCache = lookupCache
+	default:
+		return append(msgs, fmt.Sprintf("provider_lookup_cache (%s) must be one of memory or redis", o.ProviderLookupCache))
+	}
+	if o.provider != nil {
+		o.provider.Data().LookupCache = o.lookupCache
+		o.provider.Data().LookupCacheTTL = o.ProviderLookupCacheTTL
+	}
+	return msgs
+}
+
+func validateUserLimits(o *Options, msgs []string) []string {
+	if o.UserMaxConcurrentRequests < 0 {
+		msgs = append(msgs, fmt.Sprintf("user_max_concurrent_requests (%d) must not be negative", o.UserMaxConcurrentRequests))
+	}
+	if o.UserBandwidthLimit < 0 {
+		msgs = append(msgs, fmt.Sprintf("user_bandwidth_limit (%d) must not be negative", o.UserBandwidthLimit))
+	}
+	if o.UserBandwidthLimit > 0 && o.UserBandwidthWindow <= 0 {
+		return append(msgs, fmt.Sprintf("user_bandwidth_window (%s) must be positive", o.UserBandwidthWindow))
+	}
+	if o.UserMaxConcurrentRequests <= 0 && o.UserBandwidthLimit <= 0 {
+		return msgs
+	}
+	var counters sessionsapi.CounterStore
+	switch o.UserLimitsStore {
+	case "memory":
+		counters = newMemoryCounterStore()
+	case "redis":
+		if o.sessionStore == nil {
+			return msgs
+		}
+		store, ok := o.sessionStore.(sessionsapi.CounterStore)
+		if !ok {
+			return append(msgs, fmt.Sprintf("user_limits_store redis requires the redis session store, not %s", o.Session.Type))
+		}
+		counters = store
+	default:
+		return append(msgs, fmt.Sprintf("user_limits_store (%s) must be one of memory or redis", o.UserLimitsStore))
+	}
+	o.userLimits = &userLimits{
+		counters:    counters,
+		maxRequests: int64(o.UserMaxConcurrentRequests),
+		maxBytes:    o.UserBandwidthLimit,
+		window:      o.UserBandwidthWindow,
+	}
+	return msgs
+}
+
+// validatePreviousSessionStore creates the store sessions are migrated from
+// when the session store type or cookie secret changes, which is the current
+// store configured with the previous type and secret
+func validatePreviousSessionStore(o *Options, msgs []string) []string {
+	if o.PreviousCookieSecret == "" && o.PreviousSessionStoreType == "" {
+		return msgs
+	}
+
+	sessionOpts := o.Session
+	if o.PreviousSessionStoreType != "" {
+		sessionOpts.Type = o.PreviousSessionStoreType
+	}
+	cookieOpts := o.Cookie
+	if o.PreviousCookieSecret != "" {
+		cookieOpts.Secret = o.PreviousCookieSecret
+		if o.Session.Cipher != nil {
+			cipher, err := encryption.NewCipher(encryption.SecretBytes(o.PreviousCookieSecret))
+			if err != nil {
+				return append(msgs, fmt.Sprintf("previous_cookie_secret must be 16, 24, or 32 bytes to create an AES cipher: %v", err))
+			}
+			sessionOpts.Cipher = cipher
+		}
+	}
+	if sessionOpts.Type == o.Session.Type && cookieOpts.Secret == o.Cookie.Secret {
+		return append(msgs, "previous_cookie_secret or previous_session_store_type must differ from the current cookie_secret and session_store_type")
+	}
+
+	store, err := sessions.NewSessionStore(&sessionOpts, &cookieOpts)
+	if err != nil {
+		return append(msgs, fmt.Sprintf("error initialising previous session storage: %v", err))
+	}
+	o.prevSessionStore = store
+	return msgs
+}
+
+func validateCORS(o *Options, msgs []string) []string {
+	if len(o.CORSAllowedOrigins) == 0 {
+		return msgs
+	}
+	if o.CORSMaxAge < 0 {
+		return append(msgs, fmt.Sprintf("cors_max_age (%s) must not be negative", o.CORSMaxAge))
+	}
+	policy, err := newCORSPolicy(o.CORSAllowedOrigins, o.CORSAllowedHeaders, o.CORSAllowCredentials, o.CORSMaxAge)
+	if err != nil {
+		return append(msgs, err.Error())
+	}
+	o.corsPolicy = policy
+	return msgs
+}
+
+// validateWebhooks builds the notifier sending authentication events to the
+// webhook URLs
+func validateWebhooks(o *Options, msgs []string) []string {
+	if len(o.WebhookURLs) == 0 {
+		return msgs
+	}
+	if o.WebhookSecret == "" {
+		msgs = append(msgs, "webhook_secret is required to sign webhooks")
+	}
+	if o.WebhookMaxRetries < 0 {
+		msgs = append(msgs, fmt.Sprintf("webhook_max_retries (%d) must not be negative", o.WebhookMaxRetries))
+	}
+	webhooks, err := newWebhookNotifier(o.WebhookURLs, o.WebhookSecret, o.WebhookEvents, o.WebhookMaxRetries)
+	if err != nil {
+		return append(msgs, err.Error())
+	}
+	o.webhooks = webhooks
+	return msgs
+}
+
+// validateUpstreamBreaker checks the circuit breaker and retries of the
+// upstreams, enabled when either is set
+func validateUpstreamBreaker(o *Options, msgs []string) []string {
+	if o.UpstreamBreakerErrorRate == 0 && o.UpstreamRetries == 0 {
+		return msgs
+	}
+	if o.UpstreamBreakerErrorRate < 0 || o.UpstreamBreakerErrorRate > 1 {
+		msgs = append(msgs, fmt.Sprintf("upstream_breaker_error_rate (%g) must be between 0 and 1", o.UpstreamBreakerErrorRate))
+	}
+	if o.UpstreamBreakerMinRequests < 1 {
+		msgs = append(msgs, fmt.Sprintf("upstream_breaker_min_requests (%d) must be at least 1", o.UpstreamBreakerMinRequests))
+	}
+	if o.UpstreamBreakerWindow <= 0 {
+		msgs = append(msgs, fmt.Sprintf("upstream_breaker_window (%s) must be positive", o.UpstreamBreakerWindow))
+	}
+	if o.UpstreamBreakerOpenDuration <= 0 {
+		msgs = append(msgs, fmt.Sprintf("upstream_breaker_open_duration (%s) must be positive", o.UpstreamBreakerOpenDuration))
+	}
+	if o.UpstreamBreakerProbes < 1 {
+		msgs = append(msgs, fmt.Sprintf("upstream_breaker_probes (%d) must be at least 1", o.UpstreamBreakerProbes))
+	}
+	if o.UpstreamRetries < 0 {
+		msgs = append(msgs, fmt.Sprintf("upstream_retries (%d) must not be negative", o.UpstreamRetries))
+	}
+	if o.UpstreamRetryBudget < 0 || o.UpstreamRetryBudget > 1 {
+		msgs = append(msgs, fmt.Sprintf("upstream_retry_budget (%g) must be between 0 and 1", o.UpstreamRetryBudget))
+	}
+	o.upstreamBreaker = &breakerConfig{
+		errorRate:    o.UpstreamBreakerErrorRate,
+		minRequests:  o.UpstreamBreakerMinRequests,
+		window:       o.UpstreamBreakerWindow,
+		openDuration: o.UpstreamBreakerOpenDuration,
+		probes:       o.UpstreamBreakerProbes,
+		retries:      o.UpstreamRetries,
+		retryBudget:  o.UpstreamRetryBudget,
+	}
+	return msgs
+}
+
+func validateBaggage(o *Options, msgs []string) []string {
+	if o.BaggageUserKey == "" {
+		return msgs
+	}
+	if strings.ContainsAny(o.BaggageUserKey, " \t\r\n,;=") {
+		msgs = append(msgs, fmt.Sprintf("baggage_user_key (%s) must be a valid baggage key", o.BaggageUserKey))
+	}
+	o.baggageHashKey = []byte(o.BaggageHashKey)
+	if o.BaggageHashKey == "" {
+		o.baggageHashKey = []byte(o.Cookie.Secret)
+	}
+	return msgs
+}
+
+func validateAssertions(o *Options, msgs []string) []string {
+	if o.AssertionKeyFile == "" {
+		if len(o.AssertionVerificationKeys) > 0 {
+			msgs = append(msgs, "assertion_verification_key_files requires an assertion_key_file")
+		}
+		return msgs
+	}
+	if o.AssertionHeader == "" || strings.ContainsAny(o.AssertionHeader, " \t\r\n:") {
+		return append(msgs, fmt.Sprintf("assertion_header (%s) must be a valid header name", o.AssertionHeader))
+	}
+	signer, err := newAssertionSigner(o.AssertionKeyFile, o.AssertionVerificationKeys, o.AssertionHeader, o.AssertionIssuer, o.AssertionAudience)
+	if err != nil {
+		return append(msgs, err.Error())
+	}
+	o.assertionSigner = signer
+	return msgs
+}
+
+func validateStepUp(o *Options, msgs []string) []string {
+	if len(o.StepUpRoutes) > 0 && o.Provider != "oidc" {
+		msgs = append(msgs, fmt.Sprintf("step_up_routes requires the oidc provider, not %s", o.Provider))
+	}
+	for _, r := range o.StepUpRoutes {
+		route, err := parseStepUpRoute(r)
+		if err != nil {
+			msgs = append(msgs, err.Error())
+			continue
+		}
+		if len(o.StepUpACRLevels) > 0 && !stepUpACRLevel(route.acr, o.StepUpACRLevels) {
+			msgs = append(msgs, fmt.Sprintf("step_up_route (%s) requires an acr missing from step_up_acr_levels", r))
+		}
+		o.stepUpRoutes = append(o.stepUpRoutes, route)
+	}
+	return msgs
+}
+
+func validateAccessWindows(o *Options, msgs []string) []string {
+	if len(o.AccessWindows) == 0 {
+		return msgs
+	}
+	loc, err := time.LoadLocation(o.AccessWindowTimezone)
+	if err != nil {
+		return append(msgs, fmt.Sprintf("invalid access_window_timezone (%s): %v", o.AccessWindowTimezone, err))
+	}
+	for _, s := range o.AccessWindows {
+		w, err := parseAccessWindow(s, loc)
+		if err != nil {
+			msgs = append(msgs, err.Error())
+			continue
+		}
+		o.accessWindows = append(o.accessWindows, w)
+	}
+	return msgs
+}
+
+// validateInterstitials parses the interstitials, loading the pages of those
+// with one in the custom templates directory
+func validateInterstitials(o *Options, msgs []string) []string {
+	templates := map[string]*template.Template{}
+	for _, s := range o.Interstitials {
+		i, err := parseInterstitial(s)
+		if err != nil {
+			msgs = append(msgs, err.Error())
+			continue
+		}
+		t, ok := templates[i.name]
+		if !ok {
+			t, err = loadInterstitialTemplate(o.CustomTemplatesDir, i.name)
+			if err != nil {
+				msgs = append(msgs, fmt.Sprintf("error loading interstitial %s template: %v", i.name, err))
+				continue
+			}
+			templates[i.name] = t
+		}
+		i.template = t
+		o.interstitials = append(o.interstitials, i)
+	}
+	return msgs
+}
+
+// validateRewriteRedirectUpstreams records the hosts of the upstreams whose
+// redirects are rewritten, which must be configured http(s) upstreams
+func validateRewriteRedirectUpstreams(o *Options, msgs []string) []string {
+	o.rewriteRedirects = map[string]bool{}
+	for _, u := range o.RewriteRedirectUpstreams {
+		var found bool
+		for _, upstream := range o.proxyURLs {
+			if (upstream.Scheme == "http" || upstream.Scheme == "https") && strings.TrimSuffix(upstream.String(), "/") == strings.TrimSuffix(u, "/") {
+				o.rewriteRedirects[upstream.Host] = true
+				found = true
+			}
+		}
+		if !found {
+			msgs = append(msgs, fmt.Sprintf("rewrite_redirect_upstream (%s) must be one of the http or https upstreams", u))
+		}
+	}
+	return msgs
+}
+
+// validateUpstreamSigning parses the signing of each upstream, which must be
+// configured http or https upstreams. SigV4 credentials not given as options
+// are taken from the standard AWS environment variables.
+func validateUpstreamSigning(o *Options, msgs []string) []string {
+	o.upstreamAuth = map[string]hmacauth.HmacAuth{}
+	o.upstreamSigV4 = map[string]*sigV4Signer{}
+	aws := sigV4Signer{
+		accessKeyID:     o.UpstreamAWSAccessKeyID,
+		secretAccessKey: o.UpstreamAWSSecretAccessKey,
+		sessionToken:    o.UpstreamAWSSessionToken,
+		maxBodySize:     o.UpstreamSigV4MaxBodySize,
+	}
+	if o.UpstreamSigV4MaxBodySize <= 0 {
+		msgs = append(msgs, fmt.Sprintf("upstream_sigv4_max_body_size (%d) must be positive", o.UpstreamSigV4MaxBodySize))
+	}
+	if aws.accessKeyID == "" {
+		aws.accessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
+		aws.secretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		aws.sessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+
+	for _, s := range o.UpstreamSigning {
+		u, auth, sigV4, err := parseUpstreamSigning(s, aws)
+		if err != nil {
+			msgs = append(msgs, err.Error())
+			continue
+		}
+		var found bool
+		for _, upstream := range o.proxyURLs {
+			if (upstream.Scheme == "http" || upstream.Scheme == "https") && strings.TrimSuffix(upstream.String(), "/") == strings.TrimSuffix(u, "/") {
+				if auth != nil {
+					o.upstreamAuth[upstream.Host] = auth
+				} else {
+					o.upstreamSigV4[upstream.Host] = sigV4
+				}
+				found = true
+			}
+		}
+		if !found {
+			msgs = append(msgs, fmt.Sprintf("upstream_signing for %s must be for one of the http or https upstreams", u))
+		}
+	}
+	return msgs
+}
+
+// validateUpstreamTransports creates the transport requests are proxied to
+// upstreams with, and the transports of the upstreams with their own settings
+func validateUpstreamTransports(o *Options, msgs []string) []string {
+	if o.UpstreamMaxIdleConns < 0 {
+		msgs = append(msgs, fmt.Sprintf("upstream_max_idle_conns (%d) must not be negative", o.UpstreamMaxIdleConns))
+	}
+	if o.UpstreamMaxIdleConnsPerHost < 0 {
+		msgs = append(msgs, fmt.Sprintf("upstream_max_idle_conns_per_host (%d) must not be negative", o.UpstreamMaxIdleConnsPerHost))
+	}
+	if o.UpstreamIdleConnTimeout < 0 {
+		msgs = append(msgs, fmt.Sprintf("upstream_idle_conn_timeout (%s) must not be negative", o.UpstreamIdleConnTimeout))
+	}
+	defaults := transportSettings{
+		maxIdleConns:        o.UpstreamMaxIdleConns,
+		maxIdleConnsPerHost: o.UpstreamMaxIdleConnsPerHost,
+		idleConnTimeout:     o.UpstreamIdleConnTimeout,
+		disableKeepAlives:   o.UpstreamDisableKeepAlives,
+	}
+	o.upstreamTransport = defaults.newTransport(o.SSLUpstreamInsecureSkipVerify)
+	o.upstreamTransports = map[string]*http.Transport{}
+
+	for _, s := range o.UpstreamTransports {
+		u, settings, err := parseUpstreamTransport(s, defaults)
+		if err != nil {
+			msgs = append(msgs, err.Error())
+			continue
+		}
+		var found bool
+		for _, upstream := range o.proxyURLs {
+			if (upstream.Scheme == "http" || upstream.Scheme == "https") && strings.TrimSuffix(upstream.String(), "/") == strings.TrimSuffix(u, "/") {
+				o.upstreamTransports[upstream.Host] = settings.newTransport(o.SSLUpstreamInsecureSkipVerify)
+				found = true
+			}
+		}
+		if !found {
+			msgs = append(msgs, fmt.Sprintf("upstream_transport for %s must be for one of the http or https upstreams", u))
+		}
+	}
+	return msgs
+}
+
+func validateHeaderTemplates(o *Options, msgs []string) []string {
+	for _, t := range o.HeaderTemplates {
+		h, err := parseHeaderTemplate(t)
+		if err != nil {
+			msgs = append(msgs, err.Error())
+			continue
+		}
+		o.headerTemplates = append(o.headerTemplates, h)
+	}
+	return msgs
+}
+
+func validateIdentityMap(o *Options, msgs []string) []string {
+	if o.IdentityMapFile == "" {
+		return msgs
+	}
+	m, err := loadIdentityMap(o.IdentityMapFile)
+	if err != nil {
+		return append(msgs, err.Error())
+	}
+	o.identityMap = m
+	return msgs
+}
+
+func validateGroupMapping(o *Options, msgs []string) []string {
+	m, err := parseGroupMapping(o.GroupMappings, o.GroupMappingDropUnmapped)
+	if err != nil {
+		return append(msgs, err.Error())
+	}
+	o.groupMapping = m
+	return msgs
+}
+
+func validateFeatureFlags(o *Options, msgs []string) []string {
+	if len(o.FeatureFlags) == 0 && o.FeatureFlagsFile == "" {
+		return msgs
+	}
+	flags := map[string]int{}
+	for _, s := range o.FeatureFlags {
+		name, percentage, err := parseFeatureFlag(s)
+		if err != nil {
+			msgs = append(msgs, err.Error())
+			continue
+		}
+		flags[name] = percentage
+	}
+	f, err := newFeatureFlags(flags, o.FeatureFlagsFile)
+	if err != nil {
+		return append(msgs, err.Error())
+	}
+	o.featureFlags = f
+	return msgs
+}
+
+// validateUpstreamFiles parses how file:// upstreams serve their directories
+func validateUpstreamFiles(o *Options, msgs []string) []string {
+	c, err := parseFileServerConfig(o.UpstreamFileIndexes, o.UpstreamFileListing, o.UpstreamFileContentTypes, o.UpstreamFileSniffing)
+	if err != nil {
+		return append(msgs, err.Error())
+	}
+	o.upstreamFiles = c
+	return msgs
+}
+
+// validateWellKnownPaths parses the well-known URIs that skip authentication
+func validateWellKnownPaths(o *Options, msgs []string) []string {
+	paths, err := parseWellKnownPaths(o.SkipAuthWellKnown)
+	if err != nil {
+		return append(msgs, err.Error())
+	}
+	o.wellKnownPaths = paths
+	return msgs
+}
+
+// validateUpstreamRoutes parses the upstream routes, whose paths can't also
+// be the path of an upstream
+func validateUpstreamRoutes(o *Options, msgs []string) []string {
+	paths := map[string]bool{}
+	for _, u := range o.proxyURLs {
+		if u.Scheme == "file" && u.Fragment != "" {
+			paths[u.Fragment] = true
+		} else {
+			paths[u.Path] = true
+		}
+	}
+	for _, r := range o.UpstreamRoutes {
+		route, err := parseUpstreamRoute(r)
+		if err != nil {
+			msgs = append(msgs, err.Error())
+			continue
+		}
+		if paths[route.path] {
+			msgs = append(msgs, fmt.Sprintf("upstream_route %s is already the path of an upstream", route.path))
+			continue
+		}
+		paths[route.path] = true
+		o.upstreamRoutes = append(o.upstreamRoutes, route)
+	}
+	return msgs
+}
+
+func validateUpstreamShadows(o *Options, msgs []string) []string {
+	if o.UpstreamShadowMaxBodySize < 0 {
+		msgs = append(msgs, fmt.Sprintf("upstream_shadow_max_body_size (%d) must not be negative", o.UpstreamShadowMaxBodySize))
+	}
+	for _, s := range o.UpstreamShadows {
+		shadow, err := parseUpstreamShadow(s, o.SSLUpstreamInsecureSkipVerify)
+		if err != nil {
+			msgs = append(msgs, err.Error())
+			continue
+		}
+		o.upstreamShadows = append(o.upstreamShadows, shadow)
+	}
+	return msgs
+}
+
+func validateCompression(o *Options, msgs []string) []string {
+	if o.CompressUpstreamResponses && !o.CompressResponses {
+		msgs = append(msgs, "compress_upstream_responses requires compress_responses")
+	}
+	if !o.CompressResponses {
+		return msgs
+	}
+	if o.CompressMinSize < 0 {
+		msgs = append(msgs, fmt.Sprintf("compress_min_size (%d) must not be negative", o.CompressMinSize))
+	}
+	contentTypes, err := parseCompressContentTypes(o.CompressContentTypes)
+	if err != nil {
+		return append(msgs, err.Error())
+	}
+	o.compression = &compression{
+		minSize:      o.CompressMinSize,
+		contentTypes: contentTypes,
+		upstreams:    o.CompressUpstreamResponses,
+	}
+	return msgs
+}
+
+// headerTemplatesUseClaims checks whether any header template uses the ID
+// token's claims
+func headerTemplatesUseClaims(templates []string) bool {
+	for _, t := range templates {
+		if strings.Contains(t, ".Claims") {
+			return true
+		}
+	}
+	return false
+}
+
+func stepUpACRLevel(acr string, levels []string) bool {
+	for _, level := range levels {
+		if level == acr {
+			return true
+		}
+	}
+	return false
+}
+
+// redeemReservedHeaders are set by the proxy on token requests so can't be
+// copied from the client's request
+var redeemReservedHeaders = []string{"Authorization", "Connection", "Content-Length", "Content-Type", "Cookie", "Host", "Transfer-Encoding"}
+
+func validateRedeemClientHeaders(o *Options, msgs []string) []string {
+	for _, name := range o.RedeemClientHeaders {
+		name = http.CanonicalHeaderKey(name)
+		for _, reserved := range redeemReservedHeaders {
+			if name == reserved {
+				msgs = append(msgs, fmt.Sprintf("redeem_client_headers: %s can't be passed to the provider", name))
+			}
+		}
+	}
+	return msgs
+}
+
+// validateUserSessions checks the limit on each user's sessions can be
+// enforced, and their sessions listed, which needs the index of users'
+// sessions kept in Redis
+func validateUserSessions(o *Options, msgs []string) []string {
+	if o.UserSessionsPage {
+		if o.Session.Type != options.RedisSessionStoreType {
+			msgs = append(msgs, "user_sessions_page requires session_store_type redis, as only Redis keeps an index of users' sessions")
+		}
+		o.Session.IndexUsers = true
+	}
+	switch o.Session.UserSessionLimitAction {
+	case options.EvictUserSessionLimitAction, options.RejectUserSessionLimitAction:
+	default:
+		msgs = append(msgs, fmt.Sprintf("user_session_limit_action (%s) must be one of ['evict', 'reject']", o.Session.UserSessionLimitAction))
+	}
+	if o.Session.MaxUserSessions < 0 {
+		msgs = append(msgs, fmt.Sprintf("max_user_sessions (%d) must not be negative", o.Session.MaxUserSessions))
+	} else if o.Session.MaxUserSessions > 0 && o.Session.Type != options.RedisSessionStoreType {
+		msgs = append(msgs, "max_user_sessions requires session_store_type redis, as only Redis keeps an index of users' sessions")
+	}
+	return msgs
+}
+
+// validateSessionCache checks the in-memory session cache, which is only
+// kept in front of Redis
+func validateSessionCache(o *Options, msgs []string) []string {
+	if o.Session.CacheTTL < 0 {
+		return append(msgs, fmt.Sprintf("session_cache_ttl (%s) must not be negative", o.Session.CacheTTL))
+	}
+	if o.Session.CacheTTL == 0 {
+		return msgs
+	}
+	if o.Session.Type != options.RedisSessionStoreType {
+		msgs = append(msgs, "session_cache_ttl requires session_store_type redis")
+	}
+	if o.Session.CacheSize <= 0 {
+		msgs = append(msgs, fmt.Sprintf("session_cache_size (%d) must be positive", o.Session.CacheSize))
+	}
+	return msgs
+}
+
+// validateSessionGC checks the session store has garbage to collect when it's
+// collected periodically
+func validateSessionGC(o *Options, msgs []string) []string {
+	if o.Session.GCInterval < 0 {
+		return append(msgs, fmt.Sprintf("session_gc_interval (%s) must not be negative", o.Session.GCInterval))
+	}
+	if o.Session.GCInterval > 0 && o.Session.Type != options.RedisSessionStoreType {
+		msgs = append(msgs, "session_gc_interval requires session_store_type redis")
+	}
+	return msgs
 }
 
 func validateCookieName(o *Options, msgs []string) []string {
@@ -639,10 +1623,87 @@ func validateCookieName(o *Options, msgs []string) []string {
 	if cookie.String() == "" {
 		return append(msgs, fmt.Sprintf("invalid cookie name: %q", o.Cookie.Name))
 	}
+
+	switch o.Cookie.NameScope {
+	case "", "host":
+	case "provider":
+		o.Cookie.ScopeID = fmt.Sprintf("%s:%s", o.Provider, o.ClientID)
+	default:
+		msgs = append(msgs, fmt.Sprintf("cookie_name_scope (%s) must be one of ['', 'host', 'provider']", o.Cookie.NameScope))
+	}
+
+	for i, hostName := range o.Cookie.HostNames {
+		parts := strings.SplitN(hostName, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			msgs = append(msgs, fmt.Sprintf("invalid cookie host name %q, expected host=name", hostName))
+			continue
+		}
+		cookie := &http.Cookie{Name: parts[1]}
+		if cookie.String() == "" {
+			msgs = append(msgs, fmt.Sprintf("invalid cookie name for host %q: %q", parts[0], parts[1]))
+		}
+		o.Cookie.HostNames[i] = parts[0] + "=" + cookies.PrefixName(o.Cookie.Prefix, parts[1])
+	}
+
+	// The prefix is added to the name, rather than when making cookies, so
+	// that every cookie derived from it, such as the CSRF cookie, has it too
+	o.Cookie.Name = cookies.PrefixName(o.Cookie.Prefix, o.Cookie.Name)
 	return msgs
 }
 
+// newGeoLookupFunc resolves the clients in auth logs, which may be logged
+// with or without a port
+func newGeoLookupFunc(resolver *geoip.Resolver) logger.GeoLookupFunc {
+	return func(client string) (string, string) {
+		info := resolver.Lookup(parseIP(client))
+		return info.Country, info.ASN
+	}
+}
+
+// newLoggingTarget creates the writer for a logger's target, returning nil if
+// the logger should use the default output
+func newLoggingTarget(o *Options, target string, facility logger.Facility, name string, msgs *[]string) io.Writer {
+	if target == "" {
+		return nil
+	}
+	w, err := logger.NewTargetWriter(target, facility)
+	if err != nil {
+		*msgs = append(*msgs, fmt.Sprintf("%s_logging_target: %v", name, err))
+		return nil
+	}
+	if o.LoggingBufferSize > 0 {
+		return logger.NewAsyncWriter(w, o.LoggingBufferSize)
+	}
+	return w
+}
+
 func setupLogger(o *Options, msgs []string) []string {
+	if o.LoggingRotateInterval < 0 {
+		msgs = append(msgs, "logging_rotate_interval must not be negative")
+	}
+	if o.LoggingBufferSize < 0 {
+		msgs = append(msgs, "logging_buffer_size must not be negative")
+	}
+	if o.RequestLoggingSampleRate < 0 || o.RequestLoggingSampleRate > 1 {
+		msgs = append(msgs, fmt.Sprintf("request_logging_sample_rate (%v) must be between 0 and 1", o.RequestLoggingSampleRate))
+	}
+	switch o.LoggingUserPrivacy {
+	case "", logger.UserPrivacyTruncate, logger.UserPrivacyHash:
+	default:
+		msgs = append(msgs, fmt.Sprintf("logging_user_privacy (%s) must be one of ['', '%s', '%s']", o.LoggingUserPrivacy, logger.UserPrivacyTruncate, logger.UserPrivacyHash))
+	}
+	o.redactQueryParams = nil
+	for _, param := range o.LoggingRedactQueryParams {
+		re, err := regexp.Compile(param)
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("error compiling logging_redact_query_params regex=%q %s", param, err))
+			continue
+		}
+		o.redactQueryParams = append(o.redactQueryParams, re)
+	}
+
+	var logWriter io.Writer = os.Stderr
+
 	// Setup the log file
 	if len(o.LoggingFilename) > 0 {
 		// Validate that the file/dir can be written
@@ -656,7 +1717,7 @@ func setupLogger(o *Options, msgs []string) []string {
 
 		logger.Printf("Redirecting logging to file: %s", o.LoggingFilename)
 
-		logWriter := &lumberjack.Logger{
+		fileWriter := &lumberjack.Logger{
 			Filename:   o.LoggingFilename,
 			MaxSize:    o.LoggingMaxSize, // megabytes
 			MaxAge:     o.LoggingMaxAge,  // days
@@ -664,10 +1725,24 @@ func setupLogger(o *Options, msgs []string) []string {
 			LocalTime:  o.LoggingLocalTime,
 			Compress:   o.LoggingCompress,
 		}
+		if o.LoggingRotateInterval > 0 {
+			logger.RotateEvery(fileWriter, o.LoggingRotateInterval)
+		}
+		logWriter = fileWriter
+	}
 
+	if o.LoggingBufferSize > 0 {
+		logWriter = logger.NewAsyncWriter(logWriter, o.LoggingBufferSize)
+	}
+	if len(o.LoggingFilename) > 0 || o.LoggingBufferSize > 0 {
 		logger.SetOutput(logWriter)
 	}
 
+	logger.SetStandardOutput(newLoggingTarget(o, o.StandardLoggingTarget, logger.FacilityDaemon, "standard", &msgs))
+	msgs = validateAuthLogging(o, msgs)
+	logger.SetAuthOutput(newAuthLogWriter(o, &msgs))
+	logger.SetReqOutput(newLoggingTarget(o, o.RequestLoggingTarget, logger.FacilityDaemon, "request", &msgs))
+
 	// Supply a sanity warning to the logger if all logging is disabled
 	if !o.StandardLogging && !o.AuthLogging && !o.RequestLogging {
 		logger.Print("Warning: Logging disabled. No further logs will be shown.")
@@ -680,6 +1755,23 @@ func setupLogger(o *Options, msgs []string) []string {
 	logger.SetStandardTemplate(o.StandardLoggingFormat)
 	logger.SetAuthTemplate(o.AuthLoggingFormat)
 	logger.SetReqTemplate(o.RequestLoggingFormat)
+	logger.SetMaskEmails(o.LoggingMaskEmails)
+	logger.SetUserPrivacy(o.LoggingUserPrivacy)
+	// Hashes are keyed so that they can't be reversed by hashing guesses
+	hashKey := o.LoggingUserHashKey
+	if hashKey == "" {
+		hashKey = o.Cookie.Secret
+	}
+	logger.SetHashKey([]byte(hashKey))
+	logger.SetGeoLookupFunc(nil)
+	if o.GeoIPCountryDB != "" || o.GeoIPASNDB != "" {
+		resolver, err := geoip.NewResolver(o.GeoIPCountryDB, o.GeoIPASNDB)
+		if err != nil {
+			msgs = append(msgs, err.Error())
+		} else {
+			logger.SetGeoLookupFunc(newGeoLookupFunc(resolver))
+		}
+	}
 	logger.SetGetClientFunc(func(r *http.Request) string {
 		return getClientString(o.realClientIPParser, r, false)
 	})
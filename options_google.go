@@ -0,0 +1,32 @@
+//go:build !no_google
+// +build !no_google
+
+package oauth2proxy
+
+import (
+	"os"
+
+	"github.com/oauth2-proxy/oauth2-proxy/providers"
+)
+
+func init() {
+	providerConfigurers = append(providerConfigurers, configureGoogleProvider)
+}
+
+// configureGoogleProvider restricts the Google provider to the members of
+// the Google groups
+func configureGoogleProvider(o *Options, msgs []string) []string {
+	p, ok := o.provider.(*providers.GoogleProvider)
+	if !ok {
+		return msgs
+	}
+	if o.GoogleServiceAccountJSON != "" {
+		file, err := os.Open(o.GoogleServiceAccountJSON)
+		if err != nil {
+			msgs = append(msgs, "invalid Google credentials file: "+o.GoogleServiceAccountJSON)
+		} else {
+			p.SetGroupRestriction(o.GoogleGroups, o.GoogleAdminEmail, file)
+		}
+	}
+	return msgs
+}
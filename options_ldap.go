@@ -0,0 +1,44 @@
+//go:build !no_ldap
+// +build !no_ldap
+
+package oauth2proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/url"
+
+	"github.com/oauth2-proxy/oauth2-proxy/providers"
+)
+
+func init() {
+	providerConfigurers = append(providerConfigurers, configureLDAPProvider)
+}
+
+// configureLDAPProvider sets the directory the LDAP provider authenticates
+// users against
+func configureLDAPProvider(o *Options, msgs []string) []string {
+	p, ok := o.provider.(*providers.LDAPProvider)
+	if !ok {
+		return msgs
+	}
+	if o.LDAPURL == "" {
+		msgs = append(msgs, "ldap provider requires an ldap-url")
+	} else if u, err := url.Parse(o.LDAPURL); err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") {
+		msgs = append(msgs, fmt.Sprintf("ldap_url (%s) must be an ldap:// or ldaps:// URL", o.LDAPURL))
+	}
+	if o.LDAPBaseDN == "" {
+		msgs = append(msgs, "ldap provider requires an ldap-base-dn")
+	}
+	p.URL = o.LDAPURL
+	p.BindDN = o.LDAPBindDN
+	p.BindPassword = o.LDAPBindPassword
+	p.BaseDN = o.LDAPBaseDN
+	p.UserAttribute = o.LDAPUserAttribute
+	p.EmailAttribute = o.LDAPEmailAttribute
+	p.GroupAttribute = o.LDAPGroupAttribute
+	p.Groups = o.LDAPGroups
+	p.TLSConfig = &tls.Config{InsecureSkipVerify: o.SSLInsecureSkipVerify}
+	p.InsecurePlaintext = o.LDAPInsecure
+	return msgs
+}
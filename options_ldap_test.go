@@ -0,0 +1,42 @@
+//go:build !no_ldap
+// +build !no_ldap
+
+package oauth2proxy
+
+import (
+	"testing"
+
+	"github.com/oauth2-proxy/oauth2-proxy/providers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLDAPProviderOptions(t *testing.T) {
+	o := testOptions()
+	o.Provider = "ldap"
+	o.ClientID = ""
+	o.ClientSecret = ""
+	err := o.Validate()
+	assert.Equal(t, errorMsg([]string{
+		"ldap provider requires an ldap-url",
+		"ldap provider requires an ldap-base-dn"}), err.Error())
+
+	o.LDAPURL = "ldap.example.com:389"
+	o.LDAPBaseDN = "dc=example,dc=com"
+	err = o.Validate()
+	assert.Equal(t, errorMsg([]string{
+		"ldap_url (ldap.example.com:389) must be an ldap:// or ldaps:// URL"}), err.Error())
+
+	o.LDAPURL = "ldaps://ldap.example.com"
+	o.LDAPBaseDN = "dc=example,dc=com"
+	o.LDAPUserAttribute = "sAMAccountName"
+	o.LDAPGroups = []string{"admins"}
+	assert.NoError(t, o.Validate())
+	p, ok := o.provider.(*providers.LDAPProvider)
+	require.True(t, ok)
+	assert.Equal(t, "ldaps://ldap.example.com", p.URL)
+	assert.Equal(t, "sAMAccountName", p.UserAttribute)
+	assert.Equal(t, "mail", p.EmailAttribute)
+	assert.Equal(t, []string{"admins"}, p.Groups)
+	assert.False(t, p.InsecurePlaintext)
+}
@@ -0,0 +1,54 @@
+//go:build !no_logingov
+// +build !no_logingov
+
+package oauth2proxy
+
+import (
+	"io/ioutil"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/oauth2-proxy/oauth2-proxy/providers"
+)
+
+func init() {
+	providerConfigurers = append(providerConfigurers, configureLoginGovProvider)
+}
+
+// configureLoginGovProvider loads the key the login.gov provider signs its
+// JWTs with
+func configureLoginGovProvider(o *Options, msgs []string) []string {
+	p, ok := o.provider.(*providers.LoginGovProvider)
+	if !ok {
+		return msgs
+	}
+	p.PubJWKURL, msgs = parseURL(o.PubJWKURL, "pubjwk", msgs)
+
+	// JWT key can be supplied via env variable or file in the filesystem, but not both.
+	switch {
+	case o.JWTKey != "" && o.JWTKeyFile != "":
+		msgs = append(msgs, "cannot set both jwt-key and jwt-key-file options")
+	case o.JWTKey == "" && o.JWTKeyFile == "":
+		msgs = append(msgs, "login.gov provider requires a private key for signing JWTs")
+	case o.JWTKey != "":
+		// The JWT Key is in the commandline argument
+		signKey, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(o.JWTKey))
+		if err != nil {
+			msgs = append(msgs, "could not parse RSA Private Key PEM")
+		} else {
+			p.JWTKey = signKey
+		}
+	case o.JWTKeyFile != "":
+		// The JWT key is in the filesystem
+		keyData, err := ioutil.ReadFile(o.JWTKeyFile)
+		if err != nil {
+			msgs = append(msgs, "could not read key file: "+o.JWTKeyFile)
+		}
+		signKey, err := jwt.ParseRSAPrivateKeyFromPEM(keyData)
+		if err != nil {
+			msgs = append(msgs, "could not parse private key from PEM file:"+o.JWTKeyFile)
+		} else {
+			p.JWTKey = signKey
+		}
+	}
+	return msgs
+}
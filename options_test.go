@@ -1,7 +1,10 @@
-package main
+package oauth2proxy
 
 import (
+	"context"
 	"crypto"
+	"crypto/tls"
+	"encoding/base64"
 	"fmt"
 	"io/ioutil"
 	"net/url"
@@ -10,6 +13,8 @@ import (
 	"testing"
 	"time"
 
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/clock"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -97,32 +102,6 @@ func TestClientSecretFileOption(t *testing.T) {
 	assert.Equal(t, "testcase", s)
 }
 
-func TestGoogleGroupOptions(t *testing.T) {
-	o := testOptions()
-	o.GoogleGroups = []string{"googlegroup"}
-	err := o.Validate()
-	assert.NotEqual(t, nil, err)
-
-	expected := errorMsg([]string{
-		"missing setting: google-admin-email",
-		"missing setting: google-service-account-json"})
-	assert.Equal(t, expected, err.Error())
-}
-
-func TestGoogleGroupInvalidFile(t *testing.T) {
-	o := testOptions()
-	o.GoogleGroups = []string{"test_group"}
-	o.GoogleAdminEmail = "admin@example.com"
-	o.GoogleServiceAccountJSON = "file_doesnt_exist.json"
-	err := o.Validate()
-	assert.NotEqual(t, nil, err)
-
-	expected := errorMsg([]string{
-		"invalid Google credentials file: file_doesnt_exist.json",
-	})
-	assert.Equal(t, expected, err.Error())
-}
-
 func TestInitializedOptions(t *testing.T) {
 	o := testOptions()
 	assert.Equal(t, nil, o.Validate())
@@ -194,16 +173,31 @@ func TestCompiledRegexError(t *testing.T) {
 	assert.Equal(t, expected, err.Error())
 }
 
-func TestDefaultProviderApiSettings(t *testing.T) {
+func TestAnonymousRegexError(t *testing.T) {
 	o := testOptions()
-	assert.Equal(t, nil, o.Validate())
-	p := o.provider.Data()
-	assert.Equal(t, "https://accounts.google.com/o/oauth2/auth?access_type=offline",
-		p.LoginURL.String())
-	assert.Equal(t, "https://www.googleapis.com/oauth2/v3/token",
-		p.RedeemURL.String())
-	assert.Equal(t, "", p.ProfileURL.String())
-	assert.Equal(t, "profile email", p.Scope)
+	o.AnonymousRegex = []string{"/guest/", "(foobaz"}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"error compiling anonymous regex=\"(foobaz\" error parsing regexp: " +
+			"missing closing ): `(foobaz`"})
+	assert.Equal(t, expected, err.Error())
+	assert.Len(t, o.anonymousRegex, 1)
+}
+
+func TestSessionTLSBindingRequiresTLS(t *testing.T) {
+	o := testOptions()
+	o.SessionTLSBinding = true
+	err := o.Validate()
+	assert.Equal(t, errorMsg([]string{
+		"session_tls_binding requires the proxy to terminate TLS with tls_cert_file and tls_key_file"}), err.Error())
+
+	o = testOptions()
+	o.SessionTLSBinding = true
+	o.TLSCertFile = "cert.pem"
+	o.TLSKeyFile = "key.pem"
+	assert.NoError(t, o.Validate())
 }
 
 func TestPassAccessTokenRequiresSpecificCookieSecretLengths(t *testing.T) {
@@ -369,3 +363,706 @@ func TestRealClientIPHeader(t *testing.T) {
 	assert.Equal(t, expected, err.Error())
 	assert.Nil(t, o.realClientIPParser)
 }
+
+func TestNegativeAllowedClockSkew(t *testing.T) {
+	o := testOptions()
+	o.Verification.AllowedClockSkew = -time.Minute
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"oidc_allowed_clock_skew (-1m0s) must not be negative"})
+	assert.Equal(t, expected, err.Error())
+}
+
+func TestCookieNameScope(t *testing.T) {
+	o := testOptions()
+	o.Cookie.NameScope = "tenant"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"cookie_name_scope (tenant) must be one of ['', 'host', 'provider']"})
+	assert.Equal(t, expected, err.Error())
+
+	o = testOptions()
+	o.Provider = "google"
+	o.Cookie.NameScope = "provider"
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, "google:"+clientID, o.Cookie.ScopeID)
+}
+
+func TestCookieHostNames(t *testing.T) {
+	o := testOptions()
+	o.Cookie.HostNames = []string{"app.example.com=_app_session", "api.example.com", "admin.example.com=_admin;session"}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"invalid cookie host name \"api.example.com\", expected host=name",
+		"invalid cookie name for host \"admin.example.com\": \"_admin;session\""})
+	assert.Equal(t, expected, err.Error())
+}
+
+func TestSameSiteNoneRequiresSecure(t *testing.T) {
+	o := testOptions()
+	o.Cookie.SameSite = "none"
+	o.Cookie.Secure = false
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"cookie_samesite (none) requires cookie_secure: " +
+			"browsers reject SameSite=None cookies without the Secure attribute, " +
+			"set cookie_secure=true or choose a different cookie_samesite"})
+	assert.Equal(t, expected, err.Error())
+
+	o = testOptions()
+	o.Cookie.SameSite = "none"
+	o.Cookie.Secure = true
+	assert.Equal(t, nil, o.Validate())
+}
+
+func TestDebugAddress(t *testing.T) {
+	for _, addr := range []string{"127.0.0.1:6060", "localhost:6060", "[::1]:6060"} {
+		o := testOptions()
+		o.DebugAddress = addr
+		assert.Equal(t, nil, o.Validate(), addr)
+	}
+
+	o := testOptions()
+	o.DebugAddress = ":6060"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"debug-address must listen on a loopback address, got \":6060\""})
+	assert.Equal(t, expected, err.Error())
+
+	o = testOptions()
+	o.DebugAddress = "127.0.0.1"
+	err = o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "invalid debug-address \"127.0.0.1\"")
+}
+
+func TestUpstreamHeaderSize(t *testing.T) {
+	o := testOptions()
+	o.UpstreamHeaderSizeLimit = -1
+	o.UpstreamHeaderSizePolicy = "truncate"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"upstream_header_size_limit (-1) must not be negative",
+		"upstream_header_size_policy (truncate) must be one of ['reject', 'drop']"})
+	assert.Equal(t, expected, err.Error())
+
+	o = testOptions()
+	o.UpstreamHeaderSizeLimit = 8192
+	o.UpstreamHeaderSizePolicy = "drop"
+	assert.Equal(t, nil, o.Validate())
+}
+
+func TestRedeemClientHeaders(t *testing.T) {
+	o := testOptions()
+	o.RedeemClientHeaders = []string{"X-Forwarded-For", "cookie"}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"redeem_client_headers: Cookie can't be passed to the provider"})
+	assert.Equal(t, expected, err.Error())
+}
+
+func TestImpersonationDuration(t *testing.T) {
+	o := testOptions()
+	o.ImpersonationAdmins = []string{"admin@example.com"}
+	o.ImpersonationDuration = 0
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"impersonation_duration (0s) must be greater than 0"})
+	assert.Equal(t, expected, err.Error())
+}
+
+func TestMachineTokensRequirePersistentStore(t *testing.T) {
+	o := testOptions()
+	o.MachineTokens = true
+	o.MachineTokenMaxTTL = 0
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"machine_token_max_ttl (0s) must be greater than 0",
+		"machine_tokens requires a session store able to keep them, such as redis, not cookie"})
+	assert.Equal(t, expected, err.Error())
+}
+
+func TestWebAuthnOptions(t *testing.T) {
+	o := testOptions()
+	o.WebAuthnRoutes = []string{"^/admin/"}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{"webauthn_routes requires a webauthn_rp_id"}), err.Error())
+
+	o = testOptions()
+	o.WebAuthnRPID = "https://example.com"
+	o.WebAuthnOrigins = []string{"example.com"}
+	o.WebAuthnRoutes = []string{"("}
+	err = o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"webauthn_rp_id (https://example.com) must be a domain, eg. example.com",
+		"webauthn_origins (example.com) must be origins, eg. https://auth.example.com",
+		"error compiling webauthn route regex=\"(\" error parsing regexp: missing closing ): `(`",
+		"webauthn_rp_id requires a session store able to keep credentials, such as redis, not cookie"})
+	assert.Equal(t, expected, err.Error())
+}
+
+func TestStepUpOptions(t *testing.T) {
+	o := testOptions()
+	o.StepUpRoutes = []string{"^/admin/=mfa", "^/billing/", "^/keys/=hwk"}
+	o.StepUpACRLevels = []string{"pwd", "mfa"}
+	o.Provider = "github"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"step_up_routes requires the oidc provider, not github",
+		"step_up_route (^/billing/) must be of the form <regex>=<acr>",
+		"step_up_route (^/keys/=hwk) requires an acr missing from step_up_acr_levels"})
+	assert.Equal(t, expected, err.Error())
+}
+
+func TestAccessWindowOptions(t *testing.T) {
+	o := testOptions()
+	o.AccessWindows = []string{"^/admin/=Mon-Fri 08:00-18:00", "^/billing/"}
+	o.AccessWindowTimezone = "Mars/Olympus_Mons"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "invalid access_window_timezone (Mars/Olympus_Mons)")
+
+	o = testOptions()
+	o.AccessWindows = []string{"^/admin/=Mon-Fri 08:00-18:00", "^/billing/"}
+	o.AccessWindowTimezone = "Europe/London"
+	err = o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"access_window (^/billing/) must be of the form <regex>=<schedule>"})
+	assert.Equal(t, expected, err.Error())
+	assert.Len(t, o.accessWindows, 1)
+}
+
+func TestUserLimitsOptions(t *testing.T) {
+	o := testOptions()
+	o.UserMaxConcurrentRequests = -1
+	o.UserBandwidthLimit = 1024
+	o.UserBandwidthWindow = 0
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"user_max_concurrent_requests (-1) must not be negative",
+		"user_bandwidth_window (0s) must be positive"})
+	assert.Equal(t, expected, err.Error())
+
+	o = testOptions()
+	o.UserMaxConcurrentRequests = 10
+	o.UserLimitsStore = "redis"
+	err = o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected = errorMsg([]string{
+		"user_limits_store redis requires the redis session store, not cookie"})
+	assert.Equal(t, expected, err.Error())
+
+	o.UserLimitsStore = "memory"
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, int64(10), o.userLimits.maxRequests)
+}
+
+func TestUpstreamShadowOptions(t *testing.T) {
+	o := testOptions()
+	o.UpstreamShadows = []string{"/api/=10:http://canary.internal:8080", "/admin/=50"}
+	o.UpstreamShadowMaxBodySize = -1
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"upstream_shadow_max_body_size (-1) must not be negative",
+		"upstream_shadow (/admin/=50) must be of the form <path>=<percent>:<upstream>"})
+	assert.Equal(t, expected, err.Error())
+	assert.Len(t, o.upstreamShadows, 1)
+}
+
+func TestHeaderTemplateOptions(t *testing.T) {
+	o := testOptions()
+	o.HeaderTemplates = []string{"X-User={{.Email | lower}}", "X-Tenant", "X-Broken={{.Email"}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"header_template (X-Tenant) must be of the form <header>=<template>",
+		"error parsing header_template X-Broken: template: X-Broken:1: unclosed action"})
+	assert.Equal(t, expected, err.Error())
+	assert.Len(t, o.headerTemplates, 1)
+}
+
+func TestRewriteRedirectUpstreams(t *testing.T) {
+	o := testOptions()
+	o.Upstreams = []string{"http://app.internal:8080", "file:///var/www#/static/"}
+	o.RewriteRedirectUpstreams = []string{"http://app.internal:8080/", "file:///var/www#/static/"}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"rewrite_redirect_upstream (file:///var/www#/static/) must be one of the http or https upstreams"})
+	assert.Equal(t, expected, err.Error())
+	assert.Equal(t, map[string]bool{"app.internal:8080": true}, o.rewriteRedirects)
+}
+
+func TestProviderLookupCache(t *testing.T) {
+	o := testOptions()
+	o.ProviderLookupCacheTTL = 5 * time.Minute
+	assert.Equal(t, nil, o.Validate())
+	assert.NotNil(t, o.lookupCache)
+	assert.Equal(t, o.lookupCache, o.provider.Data().LookupCache)
+	assert.Equal(t, 5*time.Minute, o.provider.Data().LookupCacheTTL)
+
+	o = testOptions()
+	o.ProviderLookupCache = "redis"
+	o.ProviderLookupCacheTTL = 5 * time.Minute
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"provider_lookup_cache redis requires the redis session store, not cookie"})
+	assert.Equal(t, expected, err.Error())
+}
+
+func TestNegativeJWKSRefreshInterval(t *testing.T) {
+	o := testOptions()
+	o.JWKSRefreshInterval = -time.Minute
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"jwks_refresh_interval (-1m0s) must not be negative"})
+	assert.Equal(t, expected, err.Error())
+}
+
+func TestAssertionOptions(t *testing.T) {
+	o := testOptions()
+	o.AssertionKeyFile = "/nonexistent/assertion.pem"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"error reading assertion_key_file: open /nonexistent/assertion.pem: no such file or directory"})
+	assert.Equal(t, expected, err.Error())
+
+	o = testOptions()
+	o.AssertionKeyFile = writeAssertionKey(t, []byte("not a key"))
+	o.AssertionHeader = "X Assertion"
+	err = o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected = errorMsg([]string{
+		"assertion_header (X Assertion) must be a valid header name"})
+	assert.Equal(t, expected, err.Error())
+
+	o = testOptions()
+	o.AssertionVerificationKeys = []string{"/etc/oauth2-proxy/next.pem"}
+	err = o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected = errorMsg([]string{
+		"assertion_verification_key_files requires an assertion_key_file"})
+	assert.Equal(t, expected, err.Error())
+}
+
+func TestUpstreamSigningOptions(t *testing.T) {
+	o := testOptions()
+	o.UpstreamSigning = []string{
+		"http://127.0.0.1:8080/=hmac:sha256:secret",
+		"http://127.0.0.1:9090/=hmac:sha256:secret",
+	}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"upstream_signing for http://127.0.0.1:9090/ must be for one of the http or https upstreams"})
+	assert.Equal(t, expected, err.Error())
+	assert.NotNil(t, o.upstreamAuth["127.0.0.1:8080"])
+
+	o = testOptions()
+	o.UpstreamSigning = []string{"http://127.0.0.1:8080/=sigv4:eu-west-1:execute-api"}
+	o.UpstreamAWSAccessKeyID = "AKIDEXAMPLE"
+	o.UpstreamAWSSecretAccessKey = "secret"
+	assert.NoError(t, o.Validate())
+	assert.Equal(t, "execute-api", o.upstreamSigV4["127.0.0.1:8080"].service)
+	assert.Equal(t, int64(10<<20), o.upstreamSigV4["127.0.0.1:8080"].maxBodySize)
+
+	o.UpstreamSigV4MaxBodySize = 0
+	err = o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{"upstream_sigv4_max_body_size (0) must be positive"}), err.Error())
+}
+
+func TestBaggageOptions(t *testing.T) {
+	o := testOptions()
+	o.BaggageUserKey = "enduser id"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"baggage_user_key (enduser id) must be a valid baggage key"})
+	assert.Equal(t, expected, err.Error())
+
+	o = testOptions()
+	o.BaggageUserKey = "enduser.id"
+	assert.NoError(t, o.Validate())
+	assert.Equal(t, []byte(cookieSecret), o.baggageHashKey)
+}
+
+func TestTLSOptions(t *testing.T) {
+	o := testOptions()
+	assert.NoError(t, o.Validate())
+	assert.Equal(t, uint16(tls.VersionTLS12), o.tlsConfig.MinVersion)
+
+	o = testOptions()
+	o.TLSMinVersion = "TLS1.1"
+	o.TLSCipherSuites = []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_RSA_WITH_RC4_128_SHA"}
+	o.TLSCurvePreferences = []string{"X25519", "P224"}
+	o.TLSOCSPStapling = true
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"tls_min_version (TLS1.1) must be one of TLS1.2 or TLS1.3",
+		"tls_cipher_suite (TLS_RSA_WITH_RC4_128_SHA) is not a supported secure cipher suite",
+		"tls_curve_preference (P224) must be one of X25519, P256, P384 or P521",
+		"tls_ocsp_stapling requires the proxy to terminate TLS with tls_cert_file and tls_key_file"})
+	assert.Equal(t, expected, err.Error())
+
+	o = testOptions()
+	o.TLSMinVersion = "TLS1.3"
+	o.TLSCurvePreferences = []string{"X25519", "P256"}
+	assert.NoError(t, o.Validate())
+	assert.Equal(t, uint16(tls.VersionTLS13), o.tlsConfig.MinVersion)
+	assert.Equal(t, []tls.CurveID{tls.X25519, tls.CurveP256}, o.tlsConfig.CurvePreferences)
+}
+
+func TestCORSOptions(t *testing.T) {
+	o := testOptions()
+	o.CORSAllowedOrigins = []string{"*"}
+	o.CORSAllowCredentials = true
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"cors_allowed_origin (*) can't be used with cors_allow_credentials"})
+	assert.Equal(t, expected, err.Error())
+
+	o = testOptions()
+	o.CORSAllowedOrigins = []string{"https://app.example.com"}
+	o.CORSMaxAge = -time.Minute
+	err = o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected = errorMsg([]string{
+		"cors_max_age (-1m0s) must not be negative"})
+	assert.Equal(t, expected, err.Error())
+}
+
+func TestCookiePrefixOptions(t *testing.T) {
+	o := testOptions()
+	o.Cookie.Prefix = "host"
+	o.Cookie.Path = "/"
+	o.Cookie.HostNames = []string{"admin.example.com=_admin_session"}
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, "__Host-_oauth2_proxy", o.Cookie.Name)
+	assert.Equal(t, []string{"admin.example.com=__Host-_admin_session"}, o.Cookie.HostNames)
+
+	o = testOptions()
+	o.Cookie.Prefix = "host"
+	o.Cookie.Path = "/"
+	o.Cookie.Domains = []string{"example.com"}
+	err := o.Validate()
+	assert.Equal(t, errorMsg([]string{
+		"cookie_prefix (host) can't be used with cookie_domain as __Host- cookies must not set a Domain"}), err.Error())
+}
+
+func TestUserSessionLimitOptions(t *testing.T) {
+	o := testOptions()
+	o.Session.MaxUserSessions = 3
+	err := o.Validate()
+	assert.Equal(t, errorMsg([]string{
+		"max_user_sessions requires session_store_type redis, as only Redis keeps an index of users' sessions"}), err.Error())
+
+	o = testOptions()
+	o.Session.MaxUserSessions = -1
+	o.Session.UserSessionLimitAction = "queue"
+	err = o.Validate()
+	assert.Equal(t, errorMsg([]string{
+		"user_session_limit_action (queue) must be one of ['evict', 'reject']",
+		"max_user_sessions (-1) must not be negative"}), err.Error())
+}
+
+func TestSessionCacheOptions(t *testing.T) {
+	o := testOptions()
+	o.Session.CacheTTL = time.Minute
+	o.Session.CacheSize = 0
+	err := o.Validate()
+	assert.Equal(t, errorMsg([]string{
+		"session_cache_ttl requires session_store_type redis",
+		"session_cache_size (0) must be positive"}), err.Error())
+
+	o = testOptions()
+	o.Session.CacheTTL = -time.Minute
+	err = o.Validate()
+	assert.Equal(t, errorMsg([]string{
+		"session_cache_ttl (-1m0s) must not be negative"}), err.Error())
+}
+
+func TestWebhookOptions(t *testing.T) {
+	o := testOptions()
+	o.WebhookURLs = []string{"https://hooks.example.com/auth"}
+	o.WebhookMaxRetries = -1
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"webhook_secret is required to sign webhooks",
+		"webhook_max_retries (-1) must not be negative"})
+	assert.Equal(t, expected, err.Error())
+
+	o = testOptions()
+	o.WebhookURLs = []string{"hooks.example.com/auth"}
+	o.WebhookSecret = "secret"
+	err = o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected = errorMsg([]string{
+		"webhook_url (hooks.example.com/auth) must be an http or https URL"})
+	assert.Equal(t, expected, err.Error())
+
+	o = testOptions()
+	o.WebhookURLs = []string{"https://hooks.example.com/auth"}
+	o.WebhookSecret = "secret"
+	o.WebhookEvents = []string{"sign_in", "sign_up"}
+	err = o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected = errorMsg([]string{
+		"webhook_event (sign_up) must be one of sign_in, sign_out or refresh_failure"})
+	assert.Equal(t, expected, err.Error())
+}
+
+func TestUpstreamBreakerOptions(t *testing.T) {
+	o := testOptions()
+	o.UpstreamBreakerErrorRate = 1.5
+	o.UpstreamBreakerProbes = 0
+	o.UpstreamRetries = -1
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"upstream_breaker_error_rate (1.5) must be between 0 and 1",
+		"upstream_breaker_probes (0) must be at least 1",
+		"upstream_retries (-1) must not be negative"})
+	assert.Equal(t, expected, err.Error())
+}
+
+func TestTokenRefreshSkew(t *testing.T) {
+	o := testOptions()
+	o.TokenRefreshSkew = -time.Minute
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"token_refresh_skew (-1m0s) must not be negative"})
+	assert.Equal(t, expected, err.Error())
+
+	o = testOptions()
+	o.TokenRefreshSkew = time.Minute
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, time.Minute, o.provider.Data().RefreshSkew)
+}
+
+func TestAllowedClockSkew(t *testing.T) {
+	o := testOptions()
+	o.AllowedClockSkew = -time.Second
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"allowed_clock_skew (-1s) must not be negative"})
+	assert.Equal(t, expected, err.Error())
+
+	o = testOptions()
+	o.AllowedClockSkew = time.Minute
+	assert.Equal(t, nil, o.Validate())
+	assert.Equal(t, time.Minute, clock.AllowedSkew())
+	clock.SetAllowedSkew(0)
+}
+
+func TestOAuthStateTTL(t *testing.T) {
+	o := testOptions()
+	o.OAuthStateTTL = 0
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"oauth_state_ttl (0s) must be positive"})
+	assert.Equal(t, expected, err.Error())
+}
+
+func TestSessionIdentityOnly(t *testing.T) {
+	o := testOptions()
+	o.Session.IdentityOnly = true
+	assert.Equal(t, nil, o.Validate())
+
+	o = testOptions()
+	o.Cookie.Secret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	o.Session.IdentityOnly = true
+	o.PassAccessToken = true
+	o.Cookie.Refresh = time.Minute
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"session_identity_only can't be used with pass_access_token, which needs the provider's tokens",
+		"session_identity_only can't be used with cookie_refresh, which needs the provider's tokens"})
+	assert.Equal(t, expected, err.Error())
+
+	skipWithoutRedis(t)
+	o = testOptions()
+	o.Cookie.Secret = "xyzzyplughxyzzyplughxyzzyplughxp"
+	o.Session.IdentityOnly = true
+	o.Session.Type = options.RedisSessionStoreType
+	o.Session.Redis.ConnectionURL = "redis://localhost:6379"
+	o.SetAuthorization = true
+	o.HeaderTemplates = []string{"X-Team={{.Claims.team}}"}
+	err = o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected = errorMsg([]string{
+		"session_identity_only can't be used with set_authorization_header, which needs the provider's tokens",
+		"session_identity_only can't be used with header templates using .Claims, which needs the provider's tokens"})
+	assert.Equal(t, expected, err.Error())
+}
+
+func TestRefreshGracePeriodOption(t *testing.T) {
+	o := testOptions()
+	o.RefreshGracePeriod = -time.Minute
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"refresh_grace_period (-1m0s) must not be negative"})
+	assert.Equal(t, expected, err.Error())
+}
+
+func TestOIDCRefreshValidation(t *testing.T) {
+	o := testOptions()
+	o.Verification.RefreshValidation = "none"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		`oidc_refresh_validation (none) must be one of "verify" or "strict"`})
+	assert.Equal(t, expected, err.Error())
+}
+
+func TestNegativeLoggingBufferSize(t *testing.T) {
+	o := testOptions()
+	o.LoggingBufferSize = -1
+	o.LoggingRotateInterval = -time.Hour
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"logging_rotate_interval must not be negative",
+		"logging_buffer_size must not be negative"})
+	assert.Equal(t, expected, err.Error())
+}
+
+func TestInvalidLoggingTarget(t *testing.T) {
+	o := testOptions()
+	o.AuthLoggingTarget = "kafka://localhost:9092"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"auth_logging_target: invalid logging target \"kafka://localhost:9092\": " +
+			"must be one of syslog, syslog[+udp|+tcp|+unix]://<address> or journald"})
+	assert.Equal(t, expected, err.Error())
+}
+
+func TestLoggingUserPrivacy(t *testing.T) {
+	o := testOptions()
+	o.LoggingUserPrivacy = "encrypt"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"logging_user_privacy (encrypt) must be one of ['', 'truncate', 'hash']"})
+	assert.Equal(t, expected, err.Error())
+
+	o = testOptions()
+	o.LoggingUserPrivacy = "hash"
+	assert.Equal(t, nil, o.Validate())
+}
+
+func TestRequestLoggingSampleRate(t *testing.T) {
+	o := testOptions()
+	o.RequestLoggingSampleRate = 1.5
+	o.LoggingRedactQueryParams = []string{"(code"}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"request_logging_sample_rate (1.5) must be between 0 and 1",
+		"error compiling logging_redact_query_params regex=\"(code\" error parsing regexp: missing closing ): `(code`"})
+	assert.Equal(t, expected, err.Error())
+
+	o = testOptions()
+	o.RequestLoggingSampleRate = 0.01
+	o.LoggingRedactQueryParams = []string{"^code$"}
+	assert.Equal(t, nil, o.Validate())
+	assert.Len(t, o.redactQueryParams, 1)
+}
+
+func TestGeoIPDatabaseNotFound(t *testing.T) {
+	o := testOptions()
+	o.GeoIPCountryDB = "/does/not/exist.mmdb"
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Contains(t, err.Error(), "unable to open GeoIP country database \"/does/not/exist.mmdb\"")
+}
+
+func TestExtraJwtIssuerIgnoresInsecureSkips(t *testing.T) {
+	issuer := jwtIssuer{issuerURI: "http://127.0.0.1:1/idp", audience: "extra-audience"}
+	verifier, _, err := newVerifierFromJwtIssuer(issuer, options.IDTokenVerificationOptions{
+		InsecureSkipIssuerVerification:   true,
+		InsecureSkipAudienceVerification: true,
+	})
+	assert.NoError(t, err)
+
+	token := func(iss, aud string) string {
+		header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+		payload := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"iss":%q,"aud":%q,"sub":"1234567890","exp":%d}`, iss, aud, time.Now().Add(time.Hour).Unix())))
+		return header + "." + payload + ".c2lnbmF0dXJl"
+	}
+	_, err = verifier.Verify(context.Background(), token(issuer.issuerURI, "other-audience"))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "audience")
+	_, err = verifier.Verify(context.Background(), token("https://other.example.com", issuer.audience))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "different provider")
+}
@@ -13,4 +13,21 @@ type CookieOptions struct {
 	Secure   bool          `flag:"cookie-secure" cfg:"cookie_secure" env:"OAUTH2_PROXY_COOKIE_SECURE"`
 	HTTPOnly bool          `flag:"cookie-httponly" cfg:"cookie_httponly" env:"OAUTH2_PROXY_COOKIE_HTTPONLY"`
 	SameSite string        `flag:"cookie-samesite" cfg:"cookie_samesite" env:"OAUTH2_PROXY_COOKIE_SAMESITE"`
+
+	// NameScope adds a suffix unique to the request host ("host") or to the
+	// configured provider ("provider") to the cookie name
+	NameScope string `flag:"cookie-name-scope" cfg:"cookie_name_scope" env:"OAUTH2_PROXY_COOKIE_NAME_SCOPE"`
+	// HostNames overrides the cookie name for specific hosts, given as
+	// host=name pairs
+	HostNames []string `flag:"cookie-host-name" cfg:"cookie_host_names" env:"OAUTH2_PROXY_COOKIE_HOST_NAMES"`
+	// ScopeID identifies the provider when the NameScope is "provider"
+	ScopeID string `cfg:",internal"`
+	// Prefix adds the __Secure- ("secure") or __Host- ("host") prefix to
+	// the cookie names, so that browsers only accept the cookies with the
+	// attributes the prefix requires
+	Prefix string `flag:"cookie-prefix" cfg:"cookie_prefix" env:"OAUTH2_PROXY_COOKIE_PREFIX"`
+	// HandoffHosts are hosts the proxy serves under the other Domains, which
+	// users are sent through after signing in so that they're signed in to
+	// every domain at once
+	HandoffHosts []string `flag:"cookie-handoff-host" cfg:"cookie_handoff_hosts" env:"OAUTH2_PROXY_COOKIE_HANDOFF_HOSTS"`
 }
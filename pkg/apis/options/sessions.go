@@ -1,14 +1,52 @@
 package options
 
-import "github.com/oauth2-proxy/oauth2-proxy/pkg/encryption"
+import (
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/encryption"
+)
 
 // SessionOptions contains configuration options for the SessionStore providers.
 type SessionOptions struct {
 	Type   string             `flag:"session-store-type" cfg:"session_store_type" env:"OAUTH2_PROXY_SESSION_STORE_TYPE"`
 	Cipher *encryption.Cipher `cfg:",internal"`
 	Redis  RedisStoreOptions  `cfg:",squash"`
+
+	// IdleTimeout invalidates sessions that haven't been used for this long,
+	// even if the cookie hasn't expired
+	IdleTimeout time.Duration `flag:"session-idle-timeout" cfg:"session_idle_timeout" env:"OAUTH2_PROXY_SESSION_IDLE_TIMEOUT"`
+	// MaxUserSessions limits the number of concurrent sessions each user may
+	// have in stores that index sessions by user
+	MaxUserSessions int `flag:"max-user-sessions" cfg:"max_user_sessions" env:"OAUTH2_PROXY_MAX_USER_SESSIONS"`
+	// UserSessionLimitAction is what happens to new sessions over the limit:
+	// the user's oldest session is removed ("evict") or the new session
+	// isn't saved ("reject")
+	UserSessionLimitAction string `flag:"user-session-limit-action" cfg:"user_session_limit_action" env:"OAUTH2_PROXY_USER_SESSION_LIMIT_ACTION"`
+	// CacheTTL keeps sessions loaded from the redis store in memory for this
+	// long, so that requests made with them needn't load them again
+	CacheTTL time.Duration `flag:"session-cache-ttl" cfg:"session_cache_ttl" env:"OAUTH2_PROXY_SESSION_CACHE_TTL"`
+	// CacheSize is the most sessions kept in memory, the least recently used
+	// being dropped first
+	CacheSize int `flag:"session-cache-size" cfg:"session_cache_size" env:"OAUTH2_PROXY_SESSION_CACHE_SIZE"`
+	// IdentityOnly never saves the provider's tokens in sessions, with any
+	// session store
+	IdentityOnly bool `flag:"session-identity-only" cfg:"session_identity_only" env:"OAUTH2_PROXY_SESSION_IDENTITY_ONLY"`
+	// GCInterval collects the garbage of the session store this often, eg
+	// sessions held without an expiry, when positive
+	GCInterval time.Duration `flag:"session-gc-interval" cfg:"session_gc_interval" env:"OAUTH2_PROXY_SESSION_GC_INTERVAL"`
+	// IndexUsers indexes sessions by user, as needed to limit or list each
+	// user's sessions
+	IndexUsers bool `cfg:",internal"`
 }
 
+// EvictUserSessionLimitAction removes the user's oldest session when a new
+// session would exceed their limit
+var EvictUserSessionLimitAction = "evict"
+
+// RejectUserSessionLimitAction refuses to save new sessions that would exceed
+// the user's limit
+var RejectUserSessionLimitAction = "reject"
+
 // CookieSessionStoreType is used to indicate the CookieSessionStore should be
 // used for storing sessions.
 var CookieSessionStoreType = "cookie"
@@ -0,0 +1,23 @@
+package options
+
+import "time"
+
+// IDTokenVerificationOptions contains configuration options relating to the
+// verification of ID Tokens issued by the provider and by any extra JWT issuers
+type IDTokenVerificationOptions struct {
+	AllowedClockSkew                 time.Duration `flag:"oidc-allowed-clock-skew" cfg:"oidc_allowed_clock_skew" env:"OAUTH2_PROXY_OIDC_ALLOWED_CLOCK_SKEW"`
+	InsecureSkipIssuerVerification   bool          `flag:"insecure-oidc-skip-issuer-verification" cfg:"insecure_oidc_skip_issuer_verification" env:"OAUTH2_PROXY_INSECURE_OIDC_SKIP_ISSUER_VERIFICATION"`
+	InsecureSkipAudienceVerification bool          `flag:"insecure-oidc-skip-audience-verification" cfg:"insecure_oidc_skip_audience_verification" env:"OAUTH2_PROXY_INSECURE_OIDC_SKIP_AUDIENCE_VERIFICATION"`
+	// RefreshValidation is how strictly ID tokens issued when refreshing
+	// sessions are validated: "verify" or "strict"
+	RefreshValidation string `flag:"oidc-refresh-validation" cfg:"oidc_refresh_validation" env:"OAUTH2_PROXY_OIDC_REFRESH_VALIDATION"`
+}
+
+// WithoutInsecureSkips returns the options with the issuer and audience
+// checked. The insecure skips only apply to the OIDC provider's ID tokens,
+// not to other issuers, whose issuer and audience are always checked.
+func (o IDTokenVerificationOptions) WithoutInsecureSkips() IDTokenVerificationOptions {
+	o.InsecureSkipIssuerVerification = false
+	o.InsecureSkipAudienceVerification = false
+	return o
+}
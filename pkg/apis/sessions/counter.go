@@ -0,0 +1,15 @@
+package sessions
+
+import (
+	"context"
+	"time"
+)
+
+// CounterStore is implemented by session stores able to keep counters shared
+// by instances of the proxy, such as those of per-user limits. Counters that
+// don't exist start at zero, and expire ttl after they were last changed.
+type CounterStore interface {
+	// IncrementCounter adds delta to the counter at key, returning its new
+	// value
+	IncrementCounter(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error)
+}
@@ -0,0 +1,25 @@
+package sessions
+
+import (
+	"context"
+	"time"
+)
+
+// StoredRecord is a raw record of a session store, as held by its backend.
+// Records are copied between stores verbatim: session values are encrypted
+// with secrets held only in the users' cookies, so can't be decoded offline.
+type StoredRecord struct {
+	Key   string `json:"key"`
+	Value []byte `json:"value"`
+	// ExpiresOn is when the backend evicts the record, zero if never
+	ExpiresOn time.Time `json:"expires_on,omitempty"`
+}
+
+// Exporter is implemented by session stores holding sessions server side so
+// that their records can be copied into another store, eg when migrating
+// between deployments of the backend. Importing a record that has expired
+// returns an error wrapping ErrExpired.
+type Exporter interface {
+	ExportRecords(ctx context.Context, fn func(*StoredRecord) error) error
+	ImportRecord(ctx context.Context, record *StoredRecord) error
+}
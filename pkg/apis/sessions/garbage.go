@@ -0,0 +1,29 @@
+package sessions
+
+import (
+	"context"
+	"fmt"
+)
+
+// GarbageReport counts what collecting the garbage of a session store found
+type GarbageReport struct {
+	// Sessions is the number of sessions held in the store
+	Sessions int64 `json:"sessions"`
+	// Unbounded is the number of sessions held without an expiry, which were
+	// given one so that they're removed if they're no longer used
+	Unbounded int64 `json:"unbounded"`
+	// Orphaned is the number of records referring to sessions that no
+	// longer exist, eg in the index of a user's sessions, that were deleted
+	Orphaned int64 `json:"orphaned"`
+}
+
+func (r *GarbageReport) String() string {
+	return fmt.Sprintf("%d sessions, %d given an expiry, %d orphaned records deleted", r.Sessions, r.Unbounded, r.Orphaned)
+}
+
+// GarbageCollector is implemented by session stores holding sessions server
+// side, so that records left behind by sessions that have ended, or that the
+// backend won't expire by itself, can be removed
+type GarbageCollector interface {
+	CollectGarbage(ctx context.Context) (*GarbageReport, error)
+}
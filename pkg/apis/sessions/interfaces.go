@@ -1,12 +1,45 @@
 package sessions
 
 import (
+	"context"
+	"errors"
 	"net/http"
 )
 
-// SessionStore is an interface to storing user sessions in the proxy
+var (
+	// ErrNotFound is returned when the request carries no session
+	ErrNotFound = errors.New("session not found")
+
+	// ErrExpired is returned when the request references a session that
+	// has expired or has been removed from the store
+	ErrExpired = errors.New("session expired")
+
+	// ErrBackendUnavailable is returned when the backend of the session store
+	// could not be reached, meaning it is unknown whether a session exists
+	ErrBackendUnavailable = errors.New("session store unavailable")
+
+	// ErrSessionLimit is returned when saving a new session for a user who
+	// already has as many sessions as they're allowed
+	ErrSessionLimit = errors.New("too many sessions for user")
+)
+
+// SessionStore is an interface to storing user sessions in the proxy.
+// Errors returned wrap ErrNotFound, ErrExpired or ErrBackendUnavailable
+// where applicable and should be checked with errors.Is.
 type SessionStore interface {
-	Save(rw http.ResponseWriter, req *http.Request, s *SessionState) error
-	Load(req *http.Request) (*SessionState, error)
-	Clear(rw http.ResponseWriter, req *http.Request) error
+	Save(ctx context.Context, rw http.ResponseWriter, req *http.Request, s *SessionState) error
+	Load(ctx context.Context, req *http.Request) (*SessionState, error)
+	Clear(ctx context.Context, rw http.ResponseWriter, req *http.Request) error
+}
+
+// Pinger is implemented by session stores backed by an external service so
+// that connectivity can be checked before any requests are served.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// Counter is implemented by session stores able to report how many sessions
+// they hold, so that the number of concurrent users can be tracked
+type Counter interface {
+	CountSessions(ctx context.Context) (int64, error)
 }
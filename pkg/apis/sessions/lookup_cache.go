@@ -0,0 +1,15 @@
+package sessions
+
+import (
+	"context"
+	"time"
+)
+
+// LookupCache is implemented by session stores able to cache the results of
+// provider lookups, such as userinfo and group membership, so that instances
+// of the proxy can share them. Loading a key that isn't cached, or whose TTL
+// has passed, returns an error wrapping ErrNotFound.
+type LookupCache interface {
+	LoadLookup(ctx context.Context, key string) (string, error)
+	SaveLookup(ctx context.Context, key, value string, ttl time.Duration) error
+}
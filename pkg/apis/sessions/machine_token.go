@@ -0,0 +1,73 @@
+package sessions
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/clock"
+)
+
+// MachineToken is a long lived token issued to a user for systems, such as
+// CI pipelines, to call upstreams without a browser. The token itself is
+// signed by the proxy; only its metadata is kept by the store.
+type MachineToken struct {
+	ID string `json:"id"`
+	// Name describes what the token is used for. It's chosen by the owner,
+	// so it's never passed upstream.
+	Name string `json:"name"`
+	// Owner is the email of the user who issued the token. Requests made
+	// with the token are made as the owner.
+	Owner string `json:"owner"`
+	// OwnerGroups are the owner's groups when the token was issued, so
+	// that owners allowed by their groups rather than their email can use
+	// it
+	OwnerGroups []string `json:"owner_groups,omitempty"`
+	// Scopes are the path prefixes the token may be used for
+	Scopes    []string  `json:"scopes"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresOn time.Time `json:"expires_on"`
+}
+
+// IsExpired checks whether the token has expired
+func (t *MachineToken) IsExpired() bool {
+	return t.ExpiresOn.Before(clock.Now())
+}
+
+// Allows checks whether the token may be used for a request to the escaped
+// path, which may have a query as X-Forwarded-Uri does. Scopes only match
+// whole segments, and paths with dot segments are refused rather than
+// resolved, as the upstream may not resolve them the same way.
+func (t *MachineToken) Allows(escapedPath string) bool {
+	if i := strings.IndexAny(escapedPath, "?#"); i >= 0 {
+		escapedPath = escapedPath[:i]
+	}
+	path, err := url.PathUnescape(escapedPath)
+	if err != nil || !strings.HasPrefix(path, "/") || strings.Contains(path, "\\") {
+		return false
+	}
+	for _, segment := range strings.Split(path, "/") {
+		if segment == "." || segment == ".." {
+			return false
+		}
+	}
+	for _, scope := range t.Scopes {
+		prefix := strings.TrimSuffix(scope, "/")
+		if path == scope || path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// MachineTokenStore is implemented by persistent session stores able to keep
+// machine tokens, so that they can be listed and revoked. Loading a token
+// that doesn't exist or has been revoked returns an error wrapping
+// ErrNotFound.
+type MachineTokenStore interface {
+	SaveMachineToken(ctx context.Context, token *MachineToken) error
+	LoadMachineToken(ctx context.Context, id string) (*MachineToken, error)
+	ListMachineTokens(ctx context.Context) ([]*MachineToken, error)
+	RevokeMachineToken(ctx context.Context, id string) error
+}
@@ -0,0 +1,43 @@
+package sessions_test
+
+import (
+	"testing"
+
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMachineTokenAllows(t *testing.T) {
+	token := &sessions.MachineToken{Scopes: []string{"/api/", "/status"}}
+
+	tests := map[string]bool{
+		"/api/":                 true,
+		"/api":                  true,
+		"/api/builds":           true,
+		"/api/builds?page=2":    true,
+		"/api/a%20b":            true,
+		"/status":               true,
+		"/status/":              true,
+		"/status?verbose=1":     true,
+		"/apix":                 false,
+		"/apix/builds":          false,
+		"/statusx":              false,
+		"/admin":                false,
+		"/api/../admin":         false,
+		"/api/./builds":         false,
+		"/api/..":               false,
+		"/api%2F..%2Fadmin":     false,
+		"/api/%2e%2e/admin":     false,
+		"/api/..%5Cadmin":       false,
+		"/api/%zz":              false,
+		"api/builds":            false,
+		"/admin?next=/api/jobs": false,
+	}
+	for path, allowed := range tests {
+		assert.Equal(t, allowed, token.Allows(path), path)
+	}
+
+	token = &sessions.MachineToken{Scopes: []string{"/"}}
+	assert.True(t, token.Allows("/anything/at/all"))
+	assert.False(t, token.Allows("/anything/../else"))
+}
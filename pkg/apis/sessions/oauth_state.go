@@ -0,0 +1,16 @@
+package sessions
+
+import (
+	"context"
+	"time"
+)
+
+// StateStore is implemented by session stores able to keep the OAuth state
+// of sign ins in progress, so that each state can be redeemed by exactly one
+// callback, whichever instance of the proxy it reaches. Redeeming a state
+// that wasn't saved, has already been redeemed or whose TTL has passed
+// returns an error wrapping ErrNotFound.
+type StateStore interface {
+	SaveState(ctx context.Context, state string, ttl time.Duration) error
+	RedeemState(ctx context.Context, state string) error
+}
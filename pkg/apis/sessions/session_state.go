@@ -6,40 +6,126 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/clock"
 	"github.com/oauth2-proxy/oauth2-proxy/pkg/encryption"
 )
 
+// ErrDecode is returned when a session cannot be decoded from its encoded form
+var ErrDecode = errors.New("error decoding session")
+
 // SessionState is used to store information about the currently authenticated user session
 type SessionState struct {
 	AccessToken       string    `json:",omitempty"`
 	IDToken           string    `json:",omitempty"`
 	CreatedAt         time.Time `json:"-"`
 	ExpiresOn         time.Time `json:"-"`
+	LastSeen          time.Time `json:"-"`
+	SignedInAt        time.Time `json:"-"`
 	RefreshToken      string    `json:",omitempty"`
 	Email             string    `json:",omitempty"`
 	User              string    `json:",omitempty"`
 	PreferredUsername string    `json:",omitempty"`
+	Groups            []string  `json:",omitempty"`
+
+	// ACR and AMR are the authentication context class and methods the
+	// provider reported for the sign in, checked by step-up policies
+	ACR string   `json:",omitempty"`
+	AMR []string `json:",omitempty"`
+
+	// Impersonator is the email of the administrator who created this
+	// session to act as the user, or empty for the user's own session
+	Impersonator string `json:",omitempty"`
+	// ImpersonatorGroups are the administrator's groups, so that whether
+	// they may still impersonate users can be checked
+	ImpersonatorGroups []string `json:",omitempty"`
+
+	// Tenant is the tenant the session was signed in to, when the proxy
+	// serves many tenants
+	Tenant string `json:",omitempty"`
+
+	// TLSBinding identifies the TLS connection the session was created on,
+	// when sessions are bound to TLS connections
+	TLSBinding string `json:",omitempty"`
+
+	// WebAuthnVerified is set once the user has verified the session with a
+	// WebAuthn credential, when a second factor is required
+	WebAuthnVerified bool `json:",omitempty"`
+
+	// Acknowledged are the names of the interstitial pages, eg. terms of
+	// use, the user has accepted in this session
+	Acknowledged []string `json:",omitempty"`
+
+	// MachineToken is the ID of the machine token the request was made
+	// with, for sessions created from one. They're never saved.
+	MachineToken string `json:"-"`
 }
 
 // SessionStateJSON is used to encode SessionState into JSON without exposing time.Time zero value
 type SessionStateJSON struct {
 	*SessionState
-	CreatedAt *time.Time `json:",omitempty"`
-	ExpiresOn *time.Time `json:",omitempty"`
+	CreatedAt  *time.Time `json:",omitempty"`
+	ExpiresOn  *time.Time `json:",omitempty"`
+	LastSeen   *time.Time `json:",omitempty"`
+	SignedInAt *time.Time `json:",omitempty"`
 }
 
-// IsExpired checks whether the session has expired
+// IsExpired checks whether the session has expired, allowing for the skew
+// between the proxy's clock and the provider's
 func (s *SessionState) IsExpired() bool {
-	if !s.ExpiresOn.IsZero() && s.ExpiresOn.Before(time.Now()) {
+	if !s.ExpiresOn.IsZero() && clock.Expired(s.ExpiresOn) {
 		return true
 	}
 	return false
 }
 
+// IsIdle checks whether the session has gone unused for longer than the idle
+// timeout. Sessions last seen before idle timeouts were enabled never are.
+func (s *SessionState) IsIdle(timeout time.Duration) bool {
+	return s.IsIdleAt(timeout, clock.Now())
+}
+
+// IsIdleAt checks whether the session had gone unused for longer than the
+// idle timeout at now
+func (s *SessionState) IsIdleAt(timeout time.Duration, now time.Time) bool {
+	return !s.LastSeen.IsZero() && now.Sub(s.LastSeen) > timeout
+}
+
+// IsImpersonated checks whether the session was created by an administrator
+// impersonating the user
+func (s *SessionState) IsImpersonated() bool {
+	return s.Impersonator != ""
+}
+
+// HasAcknowledged checks whether the user has accepted the named
+// interstitial page in this session
+func (s *SessionState) HasAcknowledged(name string) bool {
+	for _, n := range s.Acknowledged {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// WithoutTokens returns a copy of the session without the provider's access,
+// ID and refresh tokens, keeping only the user's identity
+func (s *SessionState) WithoutTokens() *SessionState {
+	ss := *s
+	ss.AccessToken = ""
+	ss.IDToken = ""
+	ss.RefreshToken = ""
+	return &ss
+}
+
 // Age returns the age of a session
 func (s *SessionState) Age() time.Duration {
+	return s.AgeAt(clock.Now())
+}
+
+// AgeAt returns the age of a session at now
+func (s *SessionState) AgeAt(now time.Time) time.Duration {
 	if !s.CreatedAt.IsZero() {
-		return time.Now().Truncate(time.Second).Sub(s.CreatedAt)
+		return now.Truncate(time.Second).Sub(s.CreatedAt)
 	}
 	return 0
 }
@@ -62,6 +148,9 @@ func (s *SessionState) String() string {
 	if s.RefreshToken != "" {
 		o += " refresh_token:true"
 	}
+	if s.Impersonator != "" {
+		o += fmt.Sprintf(" impersonator:%s", s.Impersonator)
+	}
 	return o + "}"
 }
 
@@ -73,6 +162,22 @@ func (s *SessionState) EncodeSessionState(c *encryption.Cipher) (string, error)
 		ss.Email = s.Email
 		ss.User = s.User
 		ss.PreferredUsername = s.PreferredUsername
+		ss.Groups = s.Groups
+		ss.ACR = s.ACR
+		ss.AMR = s.AMR
+		ss.Tenant = s.Tenant
+		ss.TLSBinding = s.TLSBinding
+		ss.WebAuthnVerified = s.WebAuthnVerified
+		ss.Acknowledged = s.Acknowledged
+		ss.LastSeen = s.LastSeen
+		ss.SignedInAt = s.SignedInAt
+		// Impersonation must be kept, along with its time limit
+		if s.IsImpersonated() {
+			ss.Impersonator = s.Impersonator
+			ss.ImpersonatorGroups = s.ImpersonatorGroups
+			ss.CreatedAt = s.CreatedAt
+			ss.ExpiresOn = s.ExpiresOn
+		}
 	} else {
 		ss = *s
 		var err error
@@ -94,6 +199,12 @@ func (s *SessionState) EncodeSessionState(c *encryption.Cipher) (string, error)
 				return "", err
 			}
 		}
+		if ss.Impersonator != "" {
+			ss.Impersonator, err = c.Encrypt(ss.Impersonator)
+			if err != nil {
+				return "", err
+			}
+		}
 		if ss.AccessToken != "" {
 			ss.AccessToken, err = c.Encrypt(ss.AccessToken)
 			if err != nil {
@@ -121,6 +232,12 @@ func (s *SessionState) EncodeSessionState(c *encryption.Cipher) (string, error)
 	if !ss.ExpiresOn.IsZero() {
 		ssj.ExpiresOn = &ss.ExpiresOn
 	}
+	if !ss.LastSeen.IsZero() {
+		ssj.LastSeen = &ss.LastSeen
+	}
+	if !ss.SignedInAt.IsZero() {
+		ssj.SignedInAt = &ss.SignedInAt
+	}
 	b, err := json.Marshal(ssj)
 	return string(b), err
 }
@@ -131,10 +248,10 @@ func DecodeSessionState(v string, c *encryption.Cipher) (*SessionState, error) {
 	var ss *SessionState
 	err := json.Unmarshal([]byte(v), &ssj)
 	if err != nil {
-		return nil, fmt.Errorf("error unmarshalling session: %w", err)
+		return nil, fmt.Errorf("%w: error unmarshalling session: %v", ErrDecode, err)
 	}
 	if ssj.SessionState == nil {
-		return nil, errors.New("expected session state to not be nil")
+		return nil, fmt.Errorf("%w: expected session state to not be nil", ErrDecode)
 	}
 
 	// Extract SessionState and CreatedAt,ExpiresOn value from SessionStateJSON
@@ -145,14 +262,36 @@ func DecodeSessionState(v string, c *encryption.Cipher) (*SessionState, error) {
 	if ssj.ExpiresOn != nil {
 		ss.ExpiresOn = *ssj.ExpiresOn
 	}
+	if ssj.LastSeen != nil {
+		ss.LastSeen = *ssj.LastSeen
+	}
+	if ssj.SignedInAt != nil {
+		ss.SignedInAt = *ssj.SignedInAt
+	}
 
 	if c == nil {
 		// Load only Email and User when cipher is unavailable
-		ss = &SessionState{
+		loaded := &SessionState{
 			Email:             ss.Email,
 			User:              ss.User,
 			PreferredUsername: ss.PreferredUsername,
+			Groups:            ss.Groups,
+			ACR:               ss.ACR,
+			AMR:               ss.AMR,
+			Tenant:            ss.Tenant,
+			TLSBinding:        ss.TLSBinding,
+			WebAuthnVerified:  ss.WebAuthnVerified,
+			Acknowledged:      ss.Acknowledged,
+			LastSeen:          ss.LastSeen,
+			SignedInAt:        ss.SignedInAt,
 		}
+		if ss.IsImpersonated() {
+			loaded.Impersonator = ss.Impersonator
+			loaded.ImpersonatorGroups = ss.ImpersonatorGroups
+			loaded.CreatedAt = ss.CreatedAt
+			loaded.ExpiresOn = ss.ExpiresOn
+		}
+		ss = loaded
 	} else {
 		// Backward compatibility with using unencrypted Email
 		if ss.Email != "" {
@@ -171,25 +310,31 @@ func DecodeSessionState(v string, c *encryption.Cipher) (*SessionState, error) {
 		if ss.PreferredUsername != "" {
 			ss.PreferredUsername, err = c.Decrypt(ss.PreferredUsername)
 			if err != nil {
-				return nil, err
+				return nil, fmt.Errorf("%w: %v", ErrDecode, err)
+			}
+		}
+		if ss.Impersonator != "" {
+			ss.Impersonator, err = c.Decrypt(ss.Impersonator)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrDecode, err)
 			}
 		}
 		if ss.AccessToken != "" {
 			ss.AccessToken, err = c.Decrypt(ss.AccessToken)
 			if err != nil {
-				return nil, err
+				return nil, fmt.Errorf("%w: %v", ErrDecode, err)
 			}
 		}
 		if ss.IDToken != "" {
 			ss.IDToken, err = c.Decrypt(ss.IDToken)
 			if err != nil {
-				return nil, err
+				return nil, fmt.Errorf("%w: %v", ErrDecode, err)
 			}
 		}
 		if ss.RefreshToken != "" {
 			ss.RefreshToken, err = c.Decrypt(ss.RefreshToken)
 			if err != nil {
-				return nil, err
+				return nil, fmt.Errorf("%w: %v", ErrDecode, err)
 			}
 		}
 	}
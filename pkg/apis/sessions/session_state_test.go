@@ -1,11 +1,13 @@
 package sessions_test
 
 import (
+	"errors"
 	"fmt"
 	"testing"
 	"time"
 
 	"github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/clock"
 	"github.com/oauth2-proxy/oauth2-proxy/pkg/encryption"
 	"github.com/stretchr/testify/assert"
 )
@@ -142,6 +144,32 @@ func TestSessionStateSerializationNoCipherWithUser(t *testing.T) {
 	assert.Equal(t, "", ss.RefreshToken)
 }
 
+func TestSessionStateSerializationImpersonated(t *testing.T) {
+	c, err := encryption.NewCipher([]byte(secret))
+	assert.Equal(t, nil, err)
+
+	s := &sessions.SessionState{
+		Email:        "user@domain.com",
+		User:         "user@domain.com",
+		Impersonator: "admin@domain.com",
+		CreatedAt:    time.Now().Truncate(time.Second),
+		ExpiresOn:    time.Now().Add(time.Hour).Truncate(time.Second),
+	}
+	for _, cipher := range []*encryption.Cipher{c, nil} {
+		encoded, err := s.EncodeSessionState(cipher)
+		assert.Equal(t, nil, err)
+		if cipher != nil {
+			assert.NotContains(t, encoded, s.Impersonator)
+		}
+
+		ss, err := sessions.DecodeSessionState(encoded, cipher)
+		assert.Equal(t, nil, err)
+		assert.True(t, ss.IsImpersonated())
+		assert.Equal(t, s.Impersonator, ss.Impersonator)
+		assert.Equal(t, s.ExpiresOn.Unix(), ss.ExpiresOn.Unix())
+	}
+}
+
 func TestExpired(t *testing.T) {
 	s := &sessions.SessionState{ExpiresOn: time.Now().Add(time.Duration(-1) * time.Minute)}
 	assert.Equal(t, true, s.IsExpired())
@@ -153,6 +181,43 @@ func TestExpired(t *testing.T) {
 	assert.Equal(t, false, s.IsExpired())
 }
 
+func TestExpiredAllowsClockSkew(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	clock.Set(clock.NewMock(now))
+	defer clock.Reset()
+	clock.SetAllowedSkew(time.Minute)
+	defer clock.SetAllowedSkew(0)
+
+	s := &sessions.SessionState{ExpiresOn: now.Add(-30 * time.Second)}
+	assert.Equal(t, false, s.IsExpired())
+
+	s = &sessions.SessionState{ExpiresOn: now.Add(-2 * time.Minute)}
+	assert.Equal(t, true, s.IsExpired())
+}
+
+func TestIsIdle(t *testing.T) {
+	s := &sessions.SessionState{LastSeen: time.Now().Add(-time.Hour)}
+	assert.Equal(t, true, s.IsIdle(30*time.Minute))
+	assert.Equal(t, false, s.IsIdle(2*time.Hour))
+
+	s = &sessions.SessionState{}
+	assert.Equal(t, false, s.IsIdle(time.Minute))
+}
+
+func TestSessionStateSerializationLastSeen(t *testing.T) {
+	lastSeen := time.Now().Add(-time.Minute).Truncate(time.Second)
+	s := &sessions.SessionState{Email: "user@domain.com", LastSeen: lastSeen}
+	c, err := encryption.NewCipher([]byte(secret))
+	assert.Equal(t, nil, err)
+	for _, c := range []*encryption.Cipher{nil, c} {
+		encoded, err := s.EncodeSessionState(c)
+		assert.Equal(t, nil, err)
+		ss, err := sessions.DecodeSessionState(encoded, c)
+		assert.Equal(t, nil, err)
+		assert.True(t, lastSeen.Equal(ss.LastSeen))
+	}
+}
+
 type testCase struct {
 	sessions.SessionState
 	Encoded string
@@ -281,6 +346,7 @@ func TestDecodeSessionState(t *testing.T) {
 		t.Logf("i:%d Encoded:%#vsessions.SessionState:%#v Error:%#v", i, tc.Encoded, ss, err)
 		if tc.Error {
 			assert.Error(t, err)
+			assert.True(t, errors.Is(err, sessions.ErrDecode))
 			assert.Nil(t, ss)
 			continue
 		}
@@ -0,0 +1,31 @@
+package sessions
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// UserSession describes one of a user's active sessions, so that they can
+// recognise the devices they're signed in on and revoke sessions they don't
+type UserSession struct {
+	// ID identifies the session to revoke it, without revealing its ticket
+	ID        string    `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	// LastSeen, IP and UserAgent are recorded when the session was last
+	// saved, so are only as recent as the last refresh of the session
+	LastSeen  time.Time `json:"last_seen"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	// Current is set for the session the request listing them was made with
+	Current bool `json:"current"`
+}
+
+// UserSessionStore is implemented by persistent session stores that index
+// sessions by user, so that users can list and revoke their sessions.
+// Revoking a session that doesn't exist returns an error wrapping
+// ErrNotFound.
+type UserSessionStore interface {
+	ListUserSessions(ctx context.Context, req *http.Request, s *SessionState) ([]*UserSession, error)
+	RevokeUserSession(ctx context.Context, s *SessionState, id string) error
+}
@@ -0,0 +1,26 @@
+package sessions
+
+import (
+	"context"
+	"time"
+)
+
+// WebAuthnCredential is a passkey, or other WebAuthn authenticator, that a
+// user has registered as a second factor
+type WebAuthnCredential struct {
+	ID []byte `json:"id"`
+	// PublicKey is the credential's COSE encoded public key
+	PublicKey []byte `json:"public_key"`
+	// SignCount is the authenticator's signature counter at the last use of
+	// the credential, used to detect cloned authenticators
+	SignCount uint32    `json:"sign_count"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// WebAuthnCredentialStore is implemented by persistent session stores able
+// to keep users' WebAuthn credentials. Loading the credentials of a user who
+// has registered none returns an empty list.
+type WebAuthnCredentialStore interface {
+	LoadWebAuthnCredentials(ctx context.Context, user string) ([]*WebAuthnCredential, error)
+	SaveWebAuthnCredentials(ctx context.Context, user string, credentials []*WebAuthnCredential) error
+}
@@ -0,0 +1,102 @@
+// Package clock is the proxy's source of the current time. It can be
+// replaced with a Mock so that tests control the time, and holds the skew
+// allowed between the proxy's clock and those of other servers, such as
+// other instances of the proxy and the provider, when checking expiry.
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the current time
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+// Mock is a Clock whose time only changes when it is set or advanced
+type Mock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewMock returns a Mock stopped at the given time
+func NewMock(now time.Time) *Mock {
+	return &Mock{now: now}
+}
+
+// Now returns the mock's current time
+func (m *Mock) Now() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.now
+}
+
+// Set sets the mock's current time
+func (m *Mock) Set(now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.now = now
+}
+
+// Add advances the mock's current time by d
+func (m *Mock) Add(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.now = m.now.Add(d)
+}
+
+var (
+	mu          sync.RWMutex
+	current     Clock = realClock{}
+	allowedSkew time.Duration
+)
+
+// Now returns the current time of the clock in use
+func Now() time.Time {
+	mu.RLock()
+	c := current
+	mu.RUnlock()
+	return c.Now()
+}
+
+// Since returns the time elapsed since t by the clock in use
+func Since(t time.Time) time.Duration {
+	return Now().Sub(t)
+}
+
+// Set replaces the clock in use, eg. with a Mock in tests
+func Set(c Clock) {
+	mu.Lock()
+	defer mu.Unlock()
+	current = c
+}
+
+// Reset restores the real clock
+func Reset() {
+	Set(realClock{})
+}
+
+// SetAllowedSkew sets how far other servers' clocks may be from the proxy's
+func SetAllowedSkew(skew time.Duration) {
+	mu.Lock()
+	defer mu.Unlock()
+	allowedSkew = skew
+}
+
+// AllowedSkew returns how far other servers' clocks may be from the proxy's
+func AllowedSkew() time.Duration {
+	mu.RLock()
+	defer mu.RUnlock()
+	return allowedSkew
+}
+
+// Expired checks whether t, as told by another server's clock, has passed,
+// allowing for the skew between the clocks
+func Expired(t time.Time) bool {
+	return Now().Add(-AllowedSkew()).After(t)
+}
@@ -0,0 +1,40 @@
+package clock
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMock(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	mock := NewMock(now)
+	Set(mock)
+	defer Reset()
+
+	assert.Equal(t, now, Now())
+	mock.Add(time.Minute)
+	assert.Equal(t, now.Add(time.Minute), Now())
+	assert.Equal(t, time.Minute, Since(now))
+	mock.Set(now)
+	assert.Equal(t, now, Now())
+
+	Reset()
+	assert.WithinDuration(t, time.Now(), Now(), time.Second)
+}
+
+func TestExpired(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	Set(NewMock(now))
+	defer Reset()
+
+	assert.True(t, Expired(now.Add(-time.Second)))
+	assert.False(t, Expired(now))
+	assert.False(t, Expired(now.Add(time.Second)))
+
+	SetAllowedSkew(time.Minute)
+	defer SetAllowedSkew(0)
+	assert.False(t, Expired(now.Add(-30*time.Second)))
+	assert.True(t, Expired(now.Add(-2*time.Minute)))
+}
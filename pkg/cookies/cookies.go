@@ -1,6 +1,8 @@
 package cookies
 
 import (
+	"context"
+	"crypto/sha256"
 	"fmt"
 	"net"
 	"net/http"
@@ -11,6 +13,95 @@ import (
 	"github.com/oauth2-proxy/oauth2-proxy/pkg/logger"
 )
 
+const (
+	// HostPrefix is the prefix of cookies browsers only accept when Secure,
+	// with the Path / and without a Domain, binding them to the host
+	HostPrefix = "__Host-"
+
+	// SecurePrefix is the prefix of cookies browsers only accept when Secure
+	SecurePrefix = "__Secure-"
+)
+
+// Validate checks the cookie options for combinations that would be rejected
+// by browsers or would break sessions at runtime, returning a message
+// describing each problem found
+func Validate(cookieOpts *options.CookieOptions) []string {
+	msgs := []string{}
+
+	switch cookieOpts.SameSite {
+	case "", "lax", "strict":
+	case "none":
+		if !cookieOpts.Secure {
+			msgs = append(msgs, "cookie_samesite (none) requires cookie_secure: "+
+				"browsers reject SameSite=None cookies without the Secure attribute, "+
+				"set cookie_secure=true or choose a different cookie_samesite")
+		}
+	default:
+		msgs = append(msgs, fmt.Sprintf("cookie_samesite (%s) must be one of ['', 'lax', 'strict', 'none']", cookieOpts.SameSite))
+	}
+
+	msgs = append(msgs, validatePrefix(cookieOpts)...)
+
+	if cookieOpts.Refresh >= cookieOpts.Expire {
+		msgs = append(msgs, fmt.Sprintf(
+			"cookie_refresh (%s) must be less than "+
+				"cookie_expire (%s)",
+			cookieOpts.Refresh.String(),
+			cookieOpts.Expire.String()))
+	}
+
+	return msgs
+}
+
+// validatePrefix checks that the cookies will have the attributes browsers
+// require of cookies with the configured prefix, or with a name given with it
+func validatePrefix(cookieOpts *options.CookieOptions) []string {
+	msgs := []string{}
+
+	prefix := cookieOpts.Prefix
+	switch {
+	case prefix == "" && strings.HasPrefix(cookieOpts.Name, HostPrefix):
+		prefix = "host"
+	case prefix == "" && strings.HasPrefix(cookieOpts.Name, SecurePrefix):
+		prefix = "secure"
+	case prefix != "" && prefix != "host" && prefix != "secure":
+		return append(msgs, fmt.Sprintf("cookie_prefix (%s) must be one of ['', 'secure', 'host']", cookieOpts.Prefix))
+	}
+	if prefix == "" {
+		return msgs
+	}
+
+	if !cookieOpts.Secure {
+		msgs = append(msgs, fmt.Sprintf("cookie_prefix (%s) requires cookie_secure: "+
+			"browsers reject prefixed cookies without the Secure attribute", prefix))
+	}
+	if prefix == "host" {
+		if cookieOpts.Path != "/" {
+			msgs = append(msgs, fmt.Sprintf("cookie_prefix (host) requires cookie_path to be / not %q", cookieOpts.Path))
+		}
+		if len(cookieOpts.Domains) > 0 {
+			msgs = append(msgs, "cookie_prefix (host) can't be used with cookie_domain as __Host- cookies must not set a Domain")
+		}
+	}
+	return msgs
+}
+
+// PrefixName adds the cookie prefix to the name, unless it already has it
+func PrefixName(prefix string, name string) string {
+	switch prefix {
+	case "host":
+		prefix = HostPrefix
+	case "secure":
+		prefix = SecurePrefix
+	default:
+		return name
+	}
+	if strings.HasPrefix(name, prefix) {
+		return name
+	}
+	return prefix + name
+}
+
 // MakeCookie constructs a cookie from the given parameters,
 // discovering the domain from the request if not specified.
 func MakeCookie(req *http.Request, name string, value string, path string, domain string, httpOnly bool, secure bool, expiration time.Duration, now time.Time, sameSite http.SameSite) *http.Cookie {
@@ -19,7 +110,7 @@ func MakeCookie(req *http.Request, name string, value string, path string, domai
 		if h, _, err := net.SplitHostPort(host); err == nil {
 			host = h
 		}
-		if !strings.HasSuffix(host, domain) {
+		if !domainMatches(host, domain) {
 			logger.Printf("Warning: request host is %q but using configured cookie domain of %q", host, domain)
 		}
 	}
@@ -36,33 +127,101 @@ func MakeCookie(req *http.Request, name string, value string, path string, domai
 	}
 }
 
+// sameSiteKey is the context key of the SameSite value overriding the
+// configured one
+type sameSiteKey struct{}
+
+// WithSameSite returns a shallow copy of the request for which cookies made
+// from options use the given SameSite value rather than the configured one,
+// eg. for the users a stricter value is being rolled out to
+func WithSameSite(req *http.Request, sameSite string) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), sameSiteKey{}, sameSite))
+}
+
+func requestSameSite(req *http.Request, cookieOpts *options.CookieOptions) http.SameSite {
+	if sameSite, ok := req.Context().Value(sameSiteKey{}).(string); ok {
+		return ParseSameSite(sameSite)
+	}
+	return ParseSameSite(cookieOpts.SameSite)
+}
+
 // MakeCookieFromOptions constructs a cookie based on the given *options.CookieOptions,
 // value and creation time
 func MakeCookieFromOptions(req *http.Request, name string, value string, cookieOpts *options.CookieOptions, expiration time.Duration, now time.Time) *http.Cookie {
 	domain := GetCookieDomain(req, cookieOpts.Domains)
 
 	if domain != "" {
-		return MakeCookie(req, name, value, cookieOpts.Path, domain, cookieOpts.HTTPOnly, cookieOpts.Secure, expiration, now, ParseSameSite(cookieOpts.SameSite))
+		return MakeCookie(req, name, value, cookieOpts.Path, domain, cookieOpts.HTTPOnly, cookieOpts.Secure, expiration, now, requestSameSite(req, cookieOpts))
 	}
 	// If nothing matches, create the cookie with the shortest domain
 	logger.Printf("Warning: request host %q did not match any of the specific cookie domains of %q", GetRequestHost(req), strings.Join(cookieOpts.Domains, ","))
 	defaultDomain := ""
-	if len(cookieOpts.Domains) > 0 {
-		defaultDomain = cookieOpts.Domains[len(cookieOpts.Domains)-1]
+	for _, d := range cookieOpts.Domains {
+		if defaultDomain == "" || len(d) < len(defaultDomain) {
+			defaultDomain = d
+		}
 	}
-	return MakeCookie(req, name, value, cookieOpts.Path, defaultDomain, cookieOpts.HTTPOnly, cookieOpts.Secure, expiration, now, ParseSameSite(cookieOpts.SameSite))
+	return MakeCookie(req, name, value, cookieOpts.Path, defaultDomain, cookieOpts.HTTPOnly, cookieOpts.Secure, expiration, now, requestSameSite(req, cookieOpts))
 }
 
 // GetCookieDomain returns the correct cookie domain given a list of domains
-// by checking the X-Fowarded-Host and host header of an an http request
+// by checking the X-Fowarded-Host and host header of an an http request.
+// The longest domain matching the request host is returned, regardless of
+// the order the domains are given in.
 func GetCookieDomain(req *http.Request, cookieDomains []string) string {
 	host := GetRequestHost(req)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	selected := ""
 	for _, domain := range cookieDomains {
-		if strings.HasSuffix(host, domain) {
-			return domain
+		if len(domain) > len(selected) && domainMatches(host, domain) {
+			selected = domain
+		}
+	}
+	return selected
+}
+
+// domainMatches checks whether the host is the domain or one of its
+// subdomains, ignoring case and any leading dot on the domain
+func domainMatches(host string, domain string) bool {
+	host = strings.ToLower(host)
+	domain = strings.ToLower(strings.TrimPrefix(domain, "."))
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// GetCookieName returns the name of the session cookie for the request,
+// taking any per host override or configured name scope into account
+func GetCookieName(req *http.Request, cookieOpts *options.CookieOptions) string {
+	host := GetRequestHost(req)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	for _, hostName := range cookieOpts.HostNames {
+		parts := strings.SplitN(hostName, "=", 2)
+		if len(parts) == 2 && strings.EqualFold(parts[0], host) {
+			return parts[1]
 		}
 	}
-	return ""
+
+	switch cookieOpts.NameScope {
+	case "host":
+		return scopedCookieName(cookieOpts.Name, "h", strings.ToLower(host))
+	case "provider":
+		return scopedCookieName(cookieOpts.Name, "p", cookieOpts.ScopeID)
+	default:
+		return cookieOpts.Name
+	}
+}
+
+// scopedCookieName appends a short, stable suffix derived from the scope to
+// the cookie name. The suffix starts with a letter so that it can't be
+// mistaken for the index of a split cookie.
+func scopedCookieName(name string, kind string, scope string) string {
+	sum := sha256.Sum256([]byte(scope))
+	return fmt.Sprintf("%s_%s%x", name, kind, sum[:4])
 }
 
 // GetRequestHost return the request host header or X-Forwarded-Host if present
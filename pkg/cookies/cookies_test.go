@@ -0,0 +1,167 @@
+package cookies
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/apis/options"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetCookieDomain(t *testing.T) {
+	testCases := []struct {
+		name          string
+		host          string
+		forwardedHost string
+		domains       []string
+		expected      string
+	}{
+		{"no domains", "app.example.com", "", []string{}, ""},
+		{"exact match", "example.com", "", []string{"example.com"}, "example.com"},
+		{"subdomain match", "app.example.com", "", []string{"example.org", "example.com"}, "example.com"},
+		{"second host", "www.example.org", "", []string{"example.com", "example.org"}, "example.org"},
+		{"longest match regardless of order", "app.sub.example.com", "", []string{"example.com", "sub.example.com"}, "sub.example.com"},
+		{"leading dot", "app.example.com", "", []string{".example.com"}, ".example.com"},
+		{"host with port", "app.example.com:8443", "", []string{"example.com"}, "example.com"},
+		{"case insensitive", "App.Example.COM", "", []string{"example.com"}, "example.com"},
+		{"suffix without label boundary", "notexample.com", "", []string{"example.com"}, ""},
+		{"forwarded host", "internal", "app.example.org", []string{"example.com", "example.org"}, "example.org"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "http://"+tc.host+"/", nil)
+			if tc.forwardedHost != "" {
+				req.Header.Set("X-Forwarded-Host", tc.forwardedHost)
+			}
+			assert.Equal(t, tc.expected, GetCookieDomain(req, tc.domains))
+		})
+	}
+}
+
+func TestMakeCookieFromOptionsDomain(t *testing.T) {
+	opts := &options.CookieOptions{
+		Domains: []string{"a.example.com", "example.org", "example.com"},
+		Path:    "/",
+	}
+
+	req := httptest.NewRequest("GET", "http://www.example.org/", nil)
+	assert.Equal(t, "example.org", MakeCookieFromOptions(req, "_oauth2_proxy", "", opts, time.Hour, time.Now()).Domain)
+
+	req = httptest.NewRequest("GET", "http://a.example.com/", nil)
+	assert.Equal(t, "a.example.com", MakeCookieFromOptions(req, "_oauth2_proxy", "", opts, time.Hour, time.Now()).Domain)
+
+	// Falls back to the shortest domain when nothing matches
+	req = httptest.NewRequest("GET", "http://example.net/", nil)
+	assert.Equal(t, "example.org", MakeCookieFromOptions(req, "_oauth2_proxy", "", opts, time.Hour, time.Now()).Domain)
+}
+
+func TestMakeCookieFromOptionsSameSite(t *testing.T) {
+	opts := &options.CookieOptions{Path: "/", SameSite: "lax"}
+
+	req := httptest.NewRequest("GET", "http://www.example.org/", nil)
+	assert.Equal(t, http.SameSiteLaxMode, MakeCookieFromOptions(req, "_oauth2_proxy", "", opts, time.Hour, time.Now()).SameSite)
+
+	req = WithSameSite(req, "strict")
+	assert.Equal(t, http.SameSiteStrictMode, MakeCookieFromOptions(req, "_oauth2_proxy", "", opts, time.Hour, time.Now()).SameSite)
+}
+
+func TestGetCookieName(t *testing.T) {
+	opts := &options.CookieOptions{
+		Name:      "_oauth2_proxy",
+		HostNames: []string{"admin.example.com=_admin_session"},
+	}
+
+	req := httptest.NewRequest("GET", "http://app.example.com/", nil)
+	assert.Equal(t, "_oauth2_proxy", GetCookieName(req, opts))
+
+	req = httptest.NewRequest("GET", "http://admin.example.com:8443/", nil)
+	assert.Equal(t, "_admin_session", GetCookieName(req, opts))
+
+	opts.NameScope = "host"
+	app := GetCookieName(httptest.NewRequest("GET", "http://app.example.com/", nil), opts)
+	other := GetCookieName(httptest.NewRequest("GET", "http://other.example.com/", nil), opts)
+	assert.Regexp(t, "^_oauth2_proxy_h[0-9a-f]{8}$", app)
+	assert.NotEqual(t, app, other)
+	assert.Equal(t, app, GetCookieName(httptest.NewRequest("GET", "http://APP.example.com:443/", nil), opts))
+
+	opts.NameScope = "provider"
+	opts.ScopeID = "google:client-id"
+	assert.Regexp(t, "^_oauth2_proxy_p[0-9a-f]{8}$", GetCookieName(httptest.NewRequest("GET", "http://app.example.com/", nil), opts))
+	assert.Equal(t, "_admin_session", GetCookieName(req, opts))
+}
+
+func TestValidate(t *testing.T) {
+	testCases := []struct {
+		name     string
+		opts     options.CookieOptions
+		expected []string
+	}{
+		{
+			name:     "valid options",
+			opts:     options.CookieOptions{SameSite: "lax", Expire: time.Hour, Refresh: time.Minute},
+			expected: []string{},
+		},
+		{
+			name:     "SameSite none with Secure",
+			opts:     options.CookieOptions{SameSite: "none", Secure: true, Expire: time.Hour},
+			expected: []string{},
+		},
+		{
+			name: "SameSite none without Secure",
+			opts: options.CookieOptions{SameSite: "none", Expire: time.Hour},
+			expected: []string{"cookie_samesite (none) requires cookie_secure: " +
+				"browsers reject SameSite=None cookies without the Secure attribute, " +
+				"set cookie_secure=true or choose a different cookie_samesite"},
+		},
+		{
+			name:     "invalid SameSite",
+			opts:     options.CookieOptions{SameSite: "relaxed", Expire: time.Hour},
+			expected: []string{"cookie_samesite (relaxed) must be one of ['', 'lax', 'strict', 'none']"},
+		},
+		{
+			name:     "host prefix",
+			opts:     options.CookieOptions{Prefix: "host", Secure: true, Path: "/", Expire: time.Hour},
+			expected: []string{},
+		},
+		{
+			name: "host prefix with a domain and path",
+			opts: options.CookieOptions{Prefix: "host", Secure: true, Path: "/app", Domains: []string{"example.com"}, Expire: time.Hour},
+			expected: []string{
+				"cookie_prefix (host) requires cookie_path to be / not \"/app\"",
+				"cookie_prefix (host) can't be used with cookie_domain as __Host- cookies must not set a Domain",
+			},
+		},
+		{
+			name: "secure prefix named without Secure",
+			opts: options.CookieOptions{Name: "__Secure-session", Path: "/app", Expire: time.Hour},
+			expected: []string{"cookie_prefix (secure) requires cookie_secure: " +
+				"browsers reject prefixed cookies without the Secure attribute"},
+		},
+		{
+			name:     "invalid prefix",
+			opts:     options.CookieOptions{Prefix: "site", Secure: true, Expire: time.Hour},
+			expected: []string{"cookie_prefix (site) must be one of ['', 'secure', 'host']"},
+		},
+		{
+			name:     "Refresh not less than Expire",
+			opts:     options.CookieOptions{Expire: time.Hour, Refresh: time.Hour},
+			expected: []string{"cookie_refresh (1h0m0s) must be less than cookie_expire (1h0m0s)"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, Validate(&tc.opts))
+		})
+	}
+}
+
+func TestPrefixName(t *testing.T) {
+	assert.Equal(t, "__Host-_oauth2_proxy", PrefixName("host", "_oauth2_proxy"))
+	assert.Equal(t, "__Secure-_oauth2_proxy", PrefixName("secure", "_oauth2_proxy"))
+	assert.Equal(t, "__Host-_oauth2_proxy", PrefixName("host", "__Host-_oauth2_proxy"))
+	assert.Equal(t, "_oauth2_proxy", PrefixName("", "_oauth2_proxy"))
+}
@@ -8,6 +8,7 @@ import (
 	"crypto/sha1"
 	"crypto/sha256"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"hash"
 	"io"
@@ -15,6 +16,16 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/clock"
+)
+
+var (
+	// ErrInvalidSignature is returned when a signed cookie fails validation
+	ErrInvalidSignature = errors.New("cookie signature not valid")
+
+	// ErrDecrypt is returned when a cookie value cannot be decrypted
+	ErrDecrypt = errors.New("failed to decrypt cookie value")
 )
 
 // SecretBytes attempts to base64 decode the secret, if that fails it treats the secret as binary
@@ -45,6 +56,11 @@ func addPadding(secret string) string {
 
 // Validate ensures a cookie is properly signed
 func Validate(cookie *http.Cookie, seed string, expiration time.Duration) (value string, t time.Time, ok bool) {
+	return ValidateAt(cookie, seed, expiration, clock.Now())
+}
+
+// ValidateAt ensures a cookie is properly signed, and hadn't expired at now
+func ValidateAt(cookie *http.Cookie, seed string, expiration time.Duration, now time.Time) (value string, t time.Time, ok bool) {
 	// value, timestamp, sig
 	parts := strings.Split(cookie.Value, "|")
 	if len(parts) != 3 {
@@ -58,9 +74,11 @@ func Validate(cookie *http.Cookie, seed string, expiration time.Duration) (value
 		// The expiration timestamp set when the cookie was created
 		// isn't sent back by the browser. Hence, we check whether the
 		// creation timestamp stored in the cookie falls within the
-		// window defined by (Now()-expiration, Now()].
+		// window defined by (Now()-expiration, Now()], widened by the
+		// skew allowed between the clocks of the proxy's instances.
 		t = time.Unix(int64(ts), 0)
-		if t.After(time.Now().Add(expiration*-1)) && t.Before(time.Now().Add(time.Minute*5)) {
+		skew := clock.AllowedSkew()
+		if t.After(now.Add(-expiration-skew)) && t.Before(now.Add(time.Minute*5+skew)) {
 			// it's a valid cookie. now get the contents
 			rawValue, err := base64.URLEncoding.DecodeString(parts[0])
 			if err == nil {
@@ -108,7 +126,7 @@ func checkHmac(input, expected string) bool {
 	if err1 == nil {
 		expectedMAC, err2 := base64.URLEncoding.DecodeString(expected)
 		if err2 == nil {
-			return hmac.Equal(inputMAC, expectedMAC)
+			return SecureCompareBytes(inputMAC, expectedMAC)
 		}
 	}
 	return false
@@ -145,13 +163,13 @@ func (c *Cipher) Encrypt(value string) (string, error) {
 func (c *Cipher) Decrypt(s string) (string, error) {
 	encrypted, err := base64.StdEncoding.DecodeString(s)
 	if err != nil {
-		return "", fmt.Errorf("failed to decrypt cookie value %s", err)
+		return "", fmt.Errorf("%w %s", ErrDecrypt, err)
 	}
 
 	if len(encrypted) < aes.BlockSize {
-		return "", fmt.Errorf("encrypted cookie value should be "+
+		return "", fmt.Errorf("%w: encrypted cookie value should be "+
 			"at least %d bytes, but is only %d bytes",
-			aes.BlockSize, len(encrypted))
+			ErrDecrypt, aes.BlockSize, len(encrypted))
 	}
 
 	iv := encrypted[:aes.BlockSize]
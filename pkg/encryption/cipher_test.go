@@ -4,8 +4,12 @@ import (
 	"crypto/sha1"
 	"crypto/sha256"
 	"encoding/base64"
+	"errors"
+	"net/http"
 	"testing"
+	"time"
 
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/clock"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -26,6 +30,29 @@ func TestSignAndValidate(t *testing.T) {
 	assert.False(t, checkSignature(sha1sig, seed, key, "tampered", epoch))
 }
 
+func TestSignedValueExpiry(t *testing.T) {
+	seed := "0123456789abcdef"
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	mock := clock.NewMock(now)
+	clock.Set(mock)
+	defer clock.Reset()
+
+	cookie := &http.Cookie{Name: "cookie-name", Value: SignedValue(seed, "cookie-name", "value", now)}
+	value, _, ok := Validate(cookie, seed, time.Hour)
+	assert.True(t, ok)
+	assert.Equal(t, "value", value)
+
+	mock.Add(time.Hour + time.Minute)
+	_, _, ok = Validate(cookie, seed, time.Hour)
+	assert.False(t, ok)
+
+	// Signed by an instance whose clock is behind
+	clock.SetAllowedSkew(2 * time.Minute)
+	defer clock.SetAllowedSkew(0)
+	_, _, ok = Validate(cookie, seed, time.Hour)
+	assert.True(t, ok)
+}
+
 func TestEncodeAndDecodeAccessToken(t *testing.T) {
 	const secret = "0123456789abcdefghijklmnopqrstuv"
 	const token = "my access token"
@@ -60,3 +87,14 @@ func TestEncodeAndDecodeAccessTokenB64(t *testing.T) {
 	assert.NotEqual(t, token, encoded)
 	assert.Equal(t, token, decoded)
 }
+
+func TestDecryptInvalidValue(t *testing.T) {
+	c, err := NewCipher([]byte("0123456789abcdefghijklmnopqrstuv"))
+	assert.Equal(t, nil, err)
+
+	_, err = c.Decrypt("not base64!")
+	assert.True(t, errors.Is(err, ErrDecrypt))
+
+	_, err = c.Decrypt(base64.StdEncoding.EncodeToString([]byte("short")))
+	assert.True(t, errors.Is(err, ErrDecrypt))
+}
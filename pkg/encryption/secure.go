@@ -0,0 +1,30 @@
+package encryption
+
+import (
+	"crypto/subtle"
+	"runtime"
+)
+
+// SecureCompare reports whether two secrets, such as tokens, signatures or
+// nonces, are equal in constant time, so that comparing them doesn't leak how
+// much of a guess was right. Comparisons of secrets should always use it (or
+// SecureCompareBytes) rather than ==.
+func SecureCompare(a, b string) bool {
+	return SecureCompareBytes([]byte(a), []byte(b))
+}
+
+// SecureCompareBytes reports whether two secrets are equal in constant time
+func SecureCompareBytes(a, b []byte) bool {
+	return subtle.ConstantTimeCompare(a, b) == 1
+}
+
+// Zero overwrites secret material, such as a decrypted key or session ticket
+// secret, once it is no longer needed so that it doesn't linger in memory.
+// Strings can't be zeroed, so secrets should be kept as byte slices where
+// this matters.
+func Zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+	runtime.KeepAlive(b)
+}
@@ -0,0 +1,27 @@
+package encryption
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSecureCompare(t *testing.T) {
+	assert.True(t, SecureCompare("secret", "secret"))
+	assert.True(t, SecureCompare("", ""))
+	assert.False(t, SecureCompare("secret", "secreT"))
+	assert.False(t, SecureCompare("secret", "secret2"))
+	assert.False(t, SecureCompare("secret", ""))
+
+	assert.True(t, SecureCompareBytes([]byte{1, 2, 3}, []byte{1, 2, 3}))
+	assert.False(t, SecureCompareBytes([]byte{1, 2, 3}, []byte{1, 2, 4}))
+}
+
+func TestZero(t *testing.T) {
+	b := []byte("a decrypted key")
+	Zero(b)
+	assert.Equal(t, make([]byte, len("a decrypted key")), b)
+
+	// Zeroing nothing is fine
+	Zero(nil)
+}
@@ -0,0 +1,94 @@
+package geoip
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Info is the geographic and network information known about an IP address.
+// Fields are empty when they are not known.
+type Info struct {
+	// Country is the ISO 3166-1 alpha-2 code of the country, eg. "GB"
+	Country string
+	// ASN is the autonomous system number, eg. "AS15169"
+	ASN string
+	// ASOrganization is the organisation owning the autonomous system
+	ASOrganization string
+}
+
+// Resolver looks up IP addresses in MaxMind country and ASN databases
+type Resolver struct {
+	country *maxminddb.Reader
+	asn     *maxminddb.Reader
+}
+
+// NewResolver opens the MaxMind databases at the paths given. Either path may
+// be empty, in which case that information is not resolved. Country lookups
+// may use either a GeoIP2/GeoLite2 Country or City database.
+func NewResolver(countryDB, asnDB string) (*Resolver, error) {
+	r := &Resolver{}
+	var err error
+	if countryDB != "" {
+		r.country, err = maxminddb.Open(countryDB)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open GeoIP country database %q: %v", countryDB, err)
+		}
+	}
+	if asnDB != "" {
+		r.asn, err = maxminddb.Open(asnDB)
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("unable to open GeoIP ASN database %q: %v", asnDB, err)
+		}
+	}
+	return r, nil
+}
+
+// Lookup resolves the information known about ip. Lookup errors result in
+// empty fields rather than failing, as GeoIP information is only advisory.
+func (r *Resolver) Lookup(ip net.IP) Info {
+	var info Info
+	if ip == nil {
+		return info
+	}
+
+	if r.country != nil {
+		var record struct {
+			Country struct {
+				ISOCode string `maxminddb:"iso_code"`
+			} `maxminddb:"country"`
+		}
+		if err := r.country.Lookup(ip, &record); err == nil {
+			info.Country = record.Country.ISOCode
+		}
+	}
+
+	if r.asn != nil {
+		var record struct {
+			Number       uint   `maxminddb:"autonomous_system_number"`
+			Organization string `maxminddb:"autonomous_system_organization"`
+		}
+		if err := r.asn.Lookup(ip, &record); err == nil && record.Number != 0 {
+			info.ASN = "AS" + strconv.FormatUint(uint64(record.Number), 10)
+			info.ASOrganization = record.Organization
+		}
+	}
+	return info
+}
+
+// Close closes the underlying databases
+func (r *Resolver) Close() error {
+	var err error
+	for _, db := range []*maxminddb.Reader{r.country, r.asn} {
+		if db == nil {
+			continue
+		}
+		if closeErr := db.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,27 @@
+package geoip
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewResolverMissingDatabase(t *testing.T) {
+	_, err := NewResolver("/does/not/exist.mmdb", "")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unable to open GeoIP country database \"/does/not/exist.mmdb\"")
+
+	_, err = NewResolver("", "/does/not/exist.mmdb")
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unable to open GeoIP ASN database \"/does/not/exist.mmdb\"")
+}
+
+func TestResolverWithoutDatabases(t *testing.T) {
+	r, err := NewResolver("", "")
+	assert.NoError(t, err)
+	defer r.Close()
+
+	assert.Equal(t, Info{}, r.Lookup(net.ParseIP("8.8.8.8")))
+	assert.Equal(t, Info{}, r.Lookup(nil))
+}
@@ -0,0 +1,176 @@
+package ldap
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// BER tags of the ASN.1 types used by LDAP (RFC 4511). Only single byte tags
+// are needed.
+const (
+	tagBoolean     = 0x01
+	tagInteger     = 0x02
+	tagOctetString = 0x04
+	tagEnumerated  = 0x0a
+	tagSequence    = 0x30
+
+	tagBindRequest           = 0x60
+	tagBindResponse          = 0x61
+	tagUnbindRequest         = 0x42
+	tagSearchRequest         = 0x63
+	tagSearchResultEntry     = 0x64
+	tagSearchResultDone      = 0x65
+	tagSearchResultReference = 0x73
+	tagExtendedRequest       = 0x77
+	tagExtendedResponse      = 0x78
+
+	tagAuthSimple     = 0x80
+	tagExtendedName   = 0x80
+	tagFilterEquality = 0xa3
+)
+
+// maxPacketSize limits the size of responses read from the server
+const maxPacketSize = 4 << 20
+
+var errMalformed = errors.New("malformed BER packet")
+
+// packet is a decoded BER element
+type packet struct {
+	tag      byte
+	value    []byte
+	children []*packet
+}
+
+func encode(tag byte, content ...[]byte) []byte {
+	length := 0
+	for _, c := range content {
+		length += len(c)
+	}
+	b := append([]byte{tag}, encodeLength(length)...)
+	for _, c := range content {
+		b = append(b, c...)
+	}
+	return b
+}
+
+func encodeLength(n int) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	return append([]byte{0x80 | byte(len(b))}, b...)
+}
+
+func encodeInt(tag byte, n int64) []byte {
+	b := []byte{byte(n)}
+	for n > 0x7f || n < -0x80 {
+		n >>= 8
+		b = append([]byte{byte(n)}, b...)
+	}
+	return encode(tag, b)
+}
+
+func encodeString(tag byte, s string) []byte {
+	return encode(tag, []byte(s))
+}
+
+func encodeBool(b bool) []byte {
+	if b {
+		return encode(tagBoolean, []byte{0xff})
+	}
+	return encode(tagBoolean, []byte{0x00})
+}
+
+// readPacket reads a single BER element
+func readPacket(r *bufio.Reader) (*packet, error) {
+	tag, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	first, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	length := int(first)
+	if first&0x80 != 0 {
+		count := int(first & 0x7f)
+		if count == 0 || count > 4 {
+			return nil, fmt.Errorf("%w: unsupported length", errMalformed)
+		}
+		length = 0
+		for i := 0; i < count; i++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+			length = length<<8 | int(b)
+		}
+	}
+	if length > maxPacketSize {
+		return nil, fmt.Errorf("%w: packet of %d bytes is too large", errMalformed, length)
+	}
+	value := make([]byte, length)
+	if _, err := io.ReadFull(r, value); err != nil {
+		return nil, err
+	}
+	return decode(tag, value)
+}
+
+// decode parses the value of a BER element, and its children if it is
+// constructed
+func decode(tag byte, value []byte) (*packet, error) {
+	p := &packet{tag: tag, value: value}
+	if tag&0x20 == 0 {
+		return p, nil
+	}
+	for rest := value; len(rest) > 0; {
+		if len(rest) < 2 {
+			return nil, errMalformed
+		}
+		childTag, length, header := rest[0], int(rest[1]), 2
+		if rest[1]&0x80 != 0 {
+			count := int(rest[1] & 0x7f)
+			if count == 0 || count > 4 || len(rest) < 2+count {
+				return nil, errMalformed
+			}
+			length = 0
+			for _, b := range rest[2 : 2+count] {
+				length = length<<8 | int(b)
+			}
+			header += count
+		}
+		if length < 0 || len(rest) < header+length {
+			return nil, errMalformed
+		}
+		child, err := decode(childTag, rest[header:header+length])
+		if err != nil {
+			return nil, err
+		}
+		p.children = append(p.children, child)
+		rest = rest[header+length:]
+	}
+	return p, nil
+}
+
+func (p *packet) int() int64 {
+	var n int64
+	for i, b := range p.value {
+		if i == 0 && b&0x80 != 0 {
+			n = -1
+		}
+		n = n<<8 | int64(b)
+	}
+	return n
+}
+
+func (p *packet) child(i int) (*packet, error) {
+	if i >= len(p.children) {
+		return nil, fmt.Errorf("%w: expected at least %d elements", errMalformed, i+1)
+	}
+	return p.children[i], nil
+}
@@ -0,0 +1,299 @@
+// Package ldap is a minimal LDAPv3 client, supporting the StartTLS, simple
+// binds and equality searches needed to authenticate users against an LDAP
+// or Active Directory server.
+package ldap
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Result codes returned by servers (RFC 4511 section 4.1.9)
+const (
+	resultSuccess                 = 0
+	resultProtocolError           = 2
+	resultSizeLimitExceeded       = 4
+	resultConfidentialityRequired = 13
+	resultInvalidCredentials      = 49
+	searchScopeWholeSubtree       = 2
+	derefAliasesNever             = 0
+	searchSizeLimit               = 2
+	protocolVersion               = 3
+	defaultPort, defaultTLSPort   = "389", "636"
+	oidStartTLS                   = "1.3.6.1.4.1.1466.20037"
+)
+
+// ErrInvalidCredentials is matched by errors for binds with a wrong DN or
+// password
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// Error is an unsuccessful result returned by the server
+type Error struct {
+	ResultCode int64
+	Message    string
+}
+
+// Error implements the error interface
+func (e *Error) Error() string {
+	return fmt.Sprintf("ldap result code %d: %s", e.ResultCode, e.Message)
+}
+
+// Is allows Error to be matched against ErrInvalidCredentials
+func (e *Error) Is(target error) bool {
+	return target == ErrInvalidCredentials && e.ResultCode == resultInvalidCredentials
+}
+
+// Entry is an entry found by a search
+type Entry struct {
+	DN string
+	// Attributes holds the values of each attribute, by lower case name
+	Attributes map[string][]string
+}
+
+// Values returns the values of the attribute
+func (e *Entry) Values(name string) []string {
+	return e.Attributes[strings.ToLower(name)]
+}
+
+// Conn is a connection to an LDAP server. It is not safe for concurrent use.
+type Conn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	host    string
+	timeout time.Duration
+	msgID   int64
+}
+
+// Dial connects to the server at an ldap:// or ldaps:// URL. Each operation
+// must complete within the timeout.
+func Dial(rawURL string, tlsConfig *tls.Config, timeout time.Duration) (*Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var conn net.Conn
+	dialer := &net.Dialer{Timeout: timeout}
+	switch u.Scheme {
+	case "ldap":
+		conn, err = dialer.Dial("tcp", hostPort(u, defaultPort))
+	case "ldaps":
+		conn, err = tls.DialWithDialer(dialer, "tcp", hostPort(u, defaultTLSPort), clientTLSConfig(tlsConfig, u.Hostname()))
+	default:
+		return nil, fmt.Errorf("unsupported ldap url scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{conn: conn, reader: bufio.NewReader(conn), host: u.Hostname(), timeout: timeout}, nil
+}
+
+// clientTLSConfig verifies the server's certificate against its host name,
+// unless the config names another
+func clientTLSConfig(tlsConfig *tls.Config, host string) *tls.Config {
+	config := &tls.Config{}
+	if tlsConfig != nil {
+		config = tlsConfig.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+	return config
+}
+
+func hostPort(u *url.URL, port string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// StartTLS upgrades a connection to an ldap:// URL to TLS (RFC 4511 section
+// 4.14), so that binds don't send passwords in the clear. It must be called
+// before any other operation.
+func (c *Conn) StartTLS(tlsConfig *tls.Config) error {
+	if err := c.send(encode(tagExtendedRequest, encodeString(tagExtendedName, oidStartTLS))); err != nil {
+		return err
+	}
+	op, err := c.receive()
+	if err != nil {
+		return err
+	}
+	if _, err := checkResult(op, tagExtendedResponse); err != nil {
+		return err
+	}
+	if c.reader.Buffered() > 0 {
+		return fmt.Errorf("%w: unexpected data before the TLS handshake", errMalformed)
+	}
+
+	conn := tls.Client(c.conn, clientTLSConfig(tlsConfig, c.host))
+	if err := conn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return err
+	}
+	if err := conn.Handshake(); err != nil {
+		return err
+	}
+	c.conn = conn
+	c.reader = bufio.NewReader(conn)
+	return nil
+}
+
+// Bind authenticates the connection with a simple bind. Binds with an empty
+// password are refused: servers treat them as unauthenticated binds, which
+// succeed for any DN.
+func (c *Conn) Bind(dn, password string) error {
+	if password == "" {
+		return &Error{ResultCode: resultInvalidCredentials, Message: "empty password"}
+	}
+	if err := c.send(encode(tagBindRequest,
+		encodeInt(tagInteger, protocolVersion),
+		encodeString(tagOctetString, dn),
+		encodeString(tagAuthSimple, password),
+	)); err != nil {
+		return err
+	}
+	op, err := c.receive()
+	if err != nil {
+		return err
+	}
+	_, err = checkResult(op, tagBindResponse)
+	return err
+}
+
+// Search finds the entries under baseDN whose attribute equals value,
+// returning the requested attributes. At most two entries are returned,
+// which is enough for callers to tell whether an entry is unique. As the
+// filter is encoded rather than parsed, the value needs no escaping.
+func (c *Conn) Search(baseDN, attribute, value string, attributes []string) ([]*Entry, error) {
+	var attrs [][]byte
+	for _, a := range attributes {
+		attrs = append(attrs, encodeString(tagOctetString, a))
+	}
+	if err := c.send(encode(tagSearchRequest,
+		encodeString(tagOctetString, baseDN),
+		encodeInt(tagEnumerated, searchScopeWholeSubtree),
+		encodeInt(tagEnumerated, derefAliasesNever),
+		encodeInt(tagInteger, searchSizeLimit),
+		encodeInt(tagInteger, int64(c.timeout/time.Second)),
+		encodeBool(false),
+		encode(tagFilterEquality, encodeString(tagOctetString, attribute), encodeString(tagOctetString, value)),
+		encode(tagSequence, attrs...),
+	)); err != nil {
+		return nil, err
+	}
+
+	var entries []*Entry
+	for {
+		op, err := c.receive()
+		if err != nil {
+			return nil, err
+		}
+		switch op.tag {
+		case tagSearchResultEntry:
+			entry, err := parseEntry(op)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		case tagSearchResultReference:
+			// referrals to other servers aren't followed
+		case tagSearchResultDone:
+			code, err := checkResult(op, tagSearchResultDone)
+			if err != nil && code != resultSizeLimitExceeded {
+				return nil, err
+			}
+			return entries, nil
+		default:
+			return nil, fmt.Errorf("%w: unexpected search response 0x%x", errMalformed, op.tag)
+		}
+	}
+}
+
+// Close unbinds and closes the connection
+func (c *Conn) Close() error {
+	_ = c.send(encode(tagUnbindRequest))
+	return c.conn.Close()
+}
+
+// send writes a request with the next message ID
+func (c *Conn) send(op []byte) error {
+	c.msgID++
+	if err := c.conn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return err
+	}
+	_, err := c.conn.Write(encode(tagSequence, encodeInt(tagInteger, c.msgID), op))
+	return err
+}
+
+// receive reads the response to the last request
+func (c *Conn) receive() (*packet, error) {
+	msg, err := readPacket(c.reader)
+	if err != nil {
+		return nil, err
+	}
+	if msg.tag != tagSequence {
+		return nil, fmt.Errorf("%w: expected a message", errMalformed)
+	}
+	id, err := msg.child(0)
+	if err != nil {
+		return nil, err
+	}
+	if id.int() != c.msgID {
+		return nil, fmt.Errorf("%w: response to message %d, expected %d", errMalformed, id.int(), c.msgID)
+	}
+	return msg.child(1)
+}
+
+// checkResult returns the result code of an LDAPResult, and an error if
+// it's unsuccessful
+func checkResult(op *packet, tag byte) (int64, error) {
+	if op.tag != tag {
+		return 0, fmt.Errorf("%w: unexpected response 0x%x", errMalformed, op.tag)
+	}
+	code, err := op.child(0)
+	if err != nil {
+		return 0, err
+	}
+	message, err := op.child(2)
+	if err != nil {
+		return 0, err
+	}
+	if code.int() != resultSuccess {
+		return code.int(), &Error{ResultCode: code.int(), Message: string(message.value)}
+	}
+	return resultSuccess, nil
+}
+
+func parseEntry(op *packet) (*Entry, error) {
+	dn, err := op.child(0)
+	if err != nil {
+		return nil, err
+	}
+	attrs, err := op.child(1)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &Entry{DN: string(dn.value), Attributes: map[string][]string{}}
+	for _, attr := range attrs.children {
+		name, err := attr.child(0)
+		if err != nil {
+			return nil, err
+		}
+		vals, err := attr.child(1)
+		if err != nil {
+			return nil, err
+		}
+		key := strings.ToLower(string(name.value))
+		for _, v := range vals.children {
+			entry.Attributes[key] = append(entry.Attributes[key], string(v.value))
+		}
+	}
+	return entry, nil
+}
@@ -0,0 +1,167 @@
+package ldap
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeServer answers binds for a single user and searches by uid. Given a
+// TLS config, it only accepts binds once the client has started TLS.
+func fakeServer(t *testing.T, serverTLS *tls.Config) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveFake(conn, serverTLS)
+		}
+	}()
+	return "ldap://" + listener.Addr().String()
+}
+
+func serveFake(conn net.Conn, serverTLS *tls.Config) {
+	defer func() { conn.Close() }()
+	r := bufio.NewReader(conn)
+	secure := serverTLS == nil
+	for {
+		msg, err := readPacket(r)
+		if err != nil {
+			return
+		}
+		id := encodeInt(tagInteger, msg.children[0].int())
+		op := msg.children[1]
+		reply := func(content ...[]byte) {
+			conn.Write(encode(tagSequence, append([][]byte{id}, content...)...))
+		}
+		result := func(tag byte, code int64) []byte {
+			return encode(tag, encodeInt(tagEnumerated, code), encodeString(tagOctetString, ""), encodeString(tagOctetString, "message"))
+		}
+
+		switch op.tag {
+		case tagExtendedRequest:
+			if serverTLS == nil || string(op.children[0].value) != oidStartTLS {
+				reply(result(tagExtendedResponse, resultProtocolError))
+				continue
+			}
+			reply(result(tagExtendedResponse, resultSuccess))
+			conn = tls.Server(conn, serverTLS)
+			r = bufio.NewReader(conn)
+			secure = true
+		case tagBindRequest:
+			code := int64(resultInvalidCredentials)
+			if !secure {
+				code = resultConfidentialityRequired
+			} else if string(op.children[1].value) == "uid=jane,dc=example,dc=com" && string(op.children[2].value) == "secret" {
+				code = resultSuccess
+			}
+			reply(result(tagBindResponse, code))
+		case tagSearchRequest:
+			filter := op.children[6]
+			if string(filter.children[1].value) == "jane" {
+				reply(encode(tagSearchResultEntry,
+					encodeString(tagOctetString, "uid=jane,dc=example,dc=com"),
+					encode(tagSequence,
+						encode(tagSequence,
+							encodeString(tagOctetString, "memberOf"),
+							encode(0x31, encodeString(tagOctetString, "cn=admins,dc=example,dc=com"), encodeString(tagOctetString, "cn=devs,dc=example,dc=com")),
+						),
+					),
+				))
+			}
+			reply(result(tagSearchResultDone, resultSuccess))
+		case tagUnbindRequest:
+			return
+		}
+	}
+}
+
+func TestBindAndSearch(t *testing.T) {
+	conn, err := Dial(fakeServer(t, nil), nil, time.Second)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	err = conn.Bind("uid=jane,dc=example,dc=com", "wrong")
+	assert.True(t, errors.Is(err, ErrInvalidCredentials))
+	assert.True(t, errors.Is(conn.Bind("uid=jane,dc=example,dc=com", ""), ErrInvalidCredentials))
+	require.NoError(t, conn.Bind("uid=jane,dc=example,dc=com", "secret"))
+
+	entries, err := conn.Search("dc=example,dc=com", "uid", "jane", []string{"memberOf"})
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "uid=jane,dc=example,dc=com", entries[0].DN)
+	assert.Equal(t, []string{"cn=admins,dc=example,dc=com", "cn=devs,dc=example,dc=com"}, entries[0].Values("MEMBEROF"))
+
+	entries, err = conn.Search("dc=example,dc=com", "uid", "john", nil)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestStartTLS(t *testing.T) {
+	// borrow the test server's certificate, which is valid for 127.0.0.1
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	server.Close()
+	serverTLS := &tls.Config{Certificates: server.TLS.Certificates}
+	clientTLS := server.Client().Transport.(*http.Transport).TLSClientConfig
+	url := fakeServer(t, serverTLS)
+
+	conn, err := Dial(url, nil, time.Second)
+	require.NoError(t, err)
+	err = conn.Bind("uid=jane,dc=example,dc=com", "secret")
+	var ldapErr *Error
+	require.True(t, errors.As(err, &ldapErr))
+	assert.Equal(t, int64(resultConfidentialityRequired), ldapErr.ResultCode)
+	conn.Close()
+
+	conn, err = Dial(url, nil, time.Second)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.StartTLS(clientTLS))
+	require.NoError(t, conn.Bind("uid=jane,dc=example,dc=com", "secret"))
+	entries, err := conn.Search("dc=example,dc=com", "uid", "jane", nil)
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+}
+
+func TestStartTLSUntrustedCertificate(t *testing.T) {
+	server := httptest.NewTLSServer(http.NotFoundHandler())
+	server.Close()
+	conn, err := Dial(fakeServer(t, &tls.Config{Certificates: server.TLS.Certificates}), nil, time.Second)
+	require.NoError(t, err)
+	defer conn.Close()
+	assert.Error(t, conn.StartTLS(nil))
+}
+
+func TestDialUnsupportedScheme(t *testing.T) {
+	_, err := Dial("http://example.com", nil, time.Second)
+	assert.Error(t, err)
+}
+
+func TestEncodeDecode(t *testing.T) {
+	for _, n := range []int64{0, 1, 127, 128, 255, 256, 65536, -1, -129} {
+		p, err := decode(tagSequence, encodeInt(tagInteger, n))
+		require.NoError(t, err)
+		assert.Equal(t, n, p.children[0].int())
+	}
+
+	long := make([]byte, 300)
+	p, err := decode(tagSequence, encode(tagOctetString, long))
+	require.NoError(t, err)
+	assert.Len(t, p.children[0].value, 300)
+
+	_, err = decode(tagSequence, []byte{tagOctetString, 5, 'a'})
+	assert.True(t, errors.Is(err, errMalformed))
+}
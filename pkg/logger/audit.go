@@ -0,0 +1,358 @@
+package logger
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GenesisHash is the previous hash of the first record of a hash chain
+var GenesisHash = strings.Repeat("0", sha256.Size*2)
+
+// EncryptedExt is the extension added to rotated audit log files once they
+// are encrypted
+const EncryptedExt = ".enc"
+
+// backupTimeFormat names rotated files the way lumberjack does
+const backupTimeFormat = "2006-01-02T15-04-05.000"
+
+// chainedRecordRegex matches the hash of the previous record at the end of a
+// chained record, as added by chainRecord
+var chainedRecordRegex = regexp.MustCompile(`(?: prev=|,"prev":")([0-9a-f]{64})"?}?$`)
+
+// HashChainWriter makes a log tamper evident by ending each record with the
+// keyed hash of the record before it, so that records can't be changed,
+// removed or reordered without breaking the chain, nor the chain recomputed
+// without the key. Each write must be a single line record, as the Logger
+// writes them.
+type HashChainWriter struct {
+	w   io.Writer
+	key []byte
+
+	mu   sync.Mutex
+	prev string
+}
+
+// NewHashChainWriter chains the records written to w, continuing the chain
+// from the record with the prev hash, or starting a new chain if it's empty
+func NewHashChainWriter(w io.Writer, key []byte, prev string) *HashChainWriter {
+	if prev == "" {
+		prev = GenesisHash
+	}
+	return &HashChainWriter{w: w, key: key, prev: prev}
+}
+
+func (c *HashChainWriter) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	record := chainRecord(bytes.TrimRight(p, "\n"), c.prev)
+	if _, err := c.w.Write(append(record, '\n')); err != nil {
+		return 0, err
+	}
+	c.prev = recordHash(c.key, record)
+	return len(p), nil
+}
+
+// chainRecord adds the previous hash to the record, as a "prev" field of
+// JSON records or else a prev= suffix
+func chainRecord(record []byte, prev string) []byte {
+	if len(record) > 2 && record[0] == '{' && record[len(record)-1] == '}' {
+		return []byte(fmt.Sprintf(`%s,"prev":"%s"}`, record[:len(record)-1], prev))
+	}
+	return []byte(fmt.Sprintf("%s prev=%s", record, prev))
+}
+
+func recordHash(key []byte, record []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(record)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// LastRecordHash returns the hash of the last record in a chained log file,
+// to continue its chain from, or "" if the file doesn't exist or is empty
+func LastRecordHash(filename string, key []byte) (string, error) {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	// records are far shorter than this, so the last one is in the tail
+	const tail = 1 << 20
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	offset := info.Size() - tail
+	if offset < 0 {
+		offset = 0
+	}
+	b := make([]byte, info.Size()-offset)
+	if _, err := f.ReadAt(b, offset); err != nil && err != io.EOF {
+		return "", err
+	}
+	b = bytes.TrimRight(b, "\n")
+	if len(b) == 0 {
+		return "", nil
+	}
+	return recordHash(key, b[bytes.LastIndexByte(b, '\n')+1:]), nil
+}
+
+// ChainReport describes the records of a verified hash chain
+type ChainReport struct {
+	// Records is the number of records verified
+	Records int
+	// Chains is the number of chains the records belong to. The proxy starts
+	// a new chain when it starts without a log file to continue from.
+	Chains int
+	// Last is the hash of the last record verified
+	Last string
+}
+
+func (r ChainReport) String() string {
+	return fmt.Sprintf("%d records in %d chains, ending with %s", r.Records, r.Chains, r.Last)
+}
+
+// VerifyHashChain checks the records read from r continue the chain of the
+// records verified before with the report, counting them in it. The first
+// record verified may continue a chain from records that are no longer
+// available, such as from log files removed by rotation.
+func VerifyHashChain(r io.Reader, key []byte, report *ChainReport) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	for n := 1; scanner.Scan(); n++ {
+		record := scanner.Bytes()
+		if len(record) == 0 {
+			continue
+		}
+		m := chainedRecordRegex.FindSubmatch(record)
+		if m == nil {
+			return fmt.Errorf("line %d is not a chained record", n)
+		}
+		switch prev := string(m[1]); {
+		case prev == GenesisHash || report.Records == 0:
+			report.Chains++
+		case prev != report.Last:
+			return fmt.Errorf("line %d doesn't follow the record before it: records were changed, removed or reordered", n)
+		}
+		report.Last = recordHash(key, record)
+		report.Records++
+	}
+	return scanner.Err()
+}
+
+// EncryptedRotatingFile writes a log file, rotating it once it reaches its
+// maximum size, or when Rotate is called, and encrypting the rotated files
+// so that they are only readable with the key. The file being written isn't
+// encrypted, so that it can still be followed.
+type EncryptedRotatingFile struct {
+	filename   string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+	localTime  bool
+	aead       cipher.AEAD
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+
+	// encryptMu stops rotations close together encrypting the same files
+	encryptMu sync.Mutex
+}
+
+// NewEncryptedRotatingFile opens filename for appending. Rotated files are
+// encrypted with aead and removed once there are more than maxBackups, or
+// they are older than maxAge; zero keeps them. The names of rotated files
+// carry the time they were rotated at, in local time or UTC.
+func NewEncryptedRotatingFile(filename string, maxSize int64, maxAge time.Duration, maxBackups int, localTime bool, aead cipher.AEAD) (*EncryptedRotatingFile, error) {
+	f := &EncryptedRotatingFile{
+		filename:   filename,
+		maxSize:    maxSize,
+		maxAge:     maxAge,
+		maxBackups: maxBackups,
+		localTime:  localTime,
+		aead:       aead,
+	}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	// encrypt any files rotated but not encrypted before a restart
+	go f.encryptBackups()
+	return f, nil
+}
+
+func (f *EncryptedRotatingFile) open() error {
+	file, err := os.OpenFile(f.filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+func (f *EncryptedRotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Rotate moves the file aside to be encrypted, and starts a new one
+func (f *EncryptedRotatingFile) Rotate() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.rotate()
+}
+
+func (f *EncryptedRotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	now := time.Now()
+	if !f.localTime {
+		now = now.UTC()
+	}
+	ext := filepath.Ext(f.filename)
+	backup := fmt.Sprintf("%s-%s%s", strings.TrimSuffix(f.filename, ext), now.Format(backupTimeFormat), ext)
+	if err := os.Rename(f.filename, backup); err != nil {
+		return err
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	go f.encryptBackups()
+	return nil
+}
+
+// Close closes the file being written
+func (f *EncryptedRotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.file.Close()
+}
+
+// backups returns the rotated files, encrypted or not, oldest first
+func (f *EncryptedRotatingFile) backups() ([]string, error) {
+	ext := filepath.Ext(f.filename)
+	prefix := strings.TrimSuffix(f.filename, ext) + "-"
+	matches, err := filepath.Glob(prefix + "*")
+	if err != nil {
+		return nil, err
+	}
+	var backups []string
+	for _, m := range matches {
+		name := strings.TrimSuffix(m, EncryptedExt)
+		if !strings.HasSuffix(name, ext) {
+			continue
+		}
+		if _, err := time.Parse(backupTimeFormat, strings.TrimSuffix(strings.TrimPrefix(name, prefix), ext)); err == nil {
+			backups = append(backups, m)
+		}
+	}
+	// the timestamps sort in the order the files were rotated
+	sort.Strings(backups)
+	return backups, nil
+}
+
+// encryptBackups encrypts the rotated files that aren't yet, and removes
+// the ones that are no longer kept
+func (f *EncryptedRotatingFile) encryptBackups() {
+	f.encryptMu.Lock()
+	defer f.encryptMu.Unlock()
+
+	backups, err := f.backups()
+	if err != nil {
+		Printf("error listing rotated audit log files: %v", err)
+		return
+	}
+	for i, backup := range backups {
+		if strings.HasSuffix(backup, EncryptedExt) {
+			continue
+		}
+		if err := f.encrypt(backup); err != nil {
+			Printf("error encrypting %s: %v", backup, err)
+			continue
+		}
+		backups[i] = backup + EncryptedExt
+	}
+
+	for i, backup := range backups {
+		keep := f.maxBackups <= 0 || i >= len(backups)-f.maxBackups
+		if keep && f.maxAge > 0 {
+			if info, err := os.Stat(backup); err == nil && time.Since(info.ModTime()) > f.maxAge {
+				keep = false
+			}
+		}
+		if !keep {
+			if err := os.Remove(backup); err != nil {
+				Printf("error removing %s: %v", backup, err)
+			}
+		}
+	}
+}
+
+func (f *EncryptedRotatingFile) encrypt(name string) error {
+	plaintext, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, f.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(name+EncryptedExt, f.aead.Seal(nonce, nonce, plaintext, nil), 0600); err != nil {
+		return err
+	}
+	return os.Remove(name)
+}
+
+// ReadAuditFile returns the contents of an audit log file, decrypting it
+// with aead if it was encrypted when rotated
+func ReadAuditFile(name string, aead cipher.AEAD) ([]byte, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil || !strings.HasSuffix(name, EncryptedExt) {
+		return b, err
+	}
+	if aead == nil {
+		return nil, fmt.Errorf("%s is encrypted, but no key was given", name)
+	}
+	if len(b) < aead.NonceSize() {
+		return nil, errors.New("encrypted file is truncated")
+	}
+	plaintext, err := aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting %s: %v", name, err)
+	}
+	return plaintext, nil
+}
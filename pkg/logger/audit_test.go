@@ -0,0 +1,132 @@
+package logger
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHashChain(t *testing.T) {
+	key := []byte("secret")
+	var buf bytes.Buffer
+	w := NewHashChainWriter(&buf, key, "")
+	w.Write([]byte("jane@example.com [AuthSuccess] Authenticated via OAuth2\n"))
+	w.Write([]byte(`{"user":"john@example.com","status":"AuthFailure"}` + "\n"))
+	w.Write([]byte("john@example.com [AuthSuccess] Authenticated via OAuth2\n"))
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	require.Len(t, lines, 3)
+	assert.Equal(t, "jane@example.com [AuthSuccess] Authenticated via OAuth2 prev="+GenesisHash, lines[0])
+	assert.True(t, strings.HasPrefix(lines[1], `{"user":"john@example.com","status":"AuthFailure","prev":"`), lines[1])
+
+	report := &ChainReport{}
+	require.NoError(t, VerifyHashChain(strings.NewReader(buf.String()), key, report))
+	assert.Equal(t, 3, report.Records)
+	assert.Equal(t, 1, report.Chains)
+
+	// a chain verified in parts, eg. across rotated files, is the same chain
+	report = &ChainReport{}
+	require.NoError(t, VerifyHashChain(strings.NewReader(lines[0]+"\n"+lines[1]), key, report))
+	require.NoError(t, VerifyHashChain(strings.NewReader(lines[2]), key, report))
+	assert.Equal(t, 3, report.Records)
+	assert.Equal(t, 1, report.Chains)
+
+	// records removed from the start of the chain can't be told apart from
+	// rotated files that have been removed
+	assert.NoError(t, VerifyHashChain(strings.NewReader(lines[1]+"\n"+lines[2]), key, &ChainReport{}))
+
+	tests := map[string]string{
+		"changed":   strings.Replace(buf.String(), "AuthFailure", "AuthSuccess", 1),
+		"removed":   lines[0] + "\n" + lines[2],
+		"reordered": lines[0] + "\n" + lines[2] + "\n" + lines[1],
+		"unchained": lines[0] + "\n" + "john@example.com [AuthSuccess] Authenticated via OAuth2",
+	}
+	for name, log := range tests {
+		t.Run(name, func(t *testing.T) {
+			assert.Error(t, VerifyHashChain(strings.NewReader(log), key, &ChainReport{}))
+		})
+	}
+
+	assert.Error(t, VerifyHashChain(strings.NewReader(buf.String()), []byte("other"), &ChainReport{}))
+}
+
+func TestHashChainContinuesAfterRestart(t *testing.T) {
+	key := []byte("secret")
+	name := filepath.Join(t.TempDir(), "auth.log")
+
+	prev, err := LastRecordHash(name, key)
+	require.NoError(t, err)
+	assert.Equal(t, "", prev)
+
+	for i := 0; i < 2; i++ {
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		require.NoError(t, err)
+		prev, err := LastRecordHash(name, key)
+		require.NoError(t, err)
+		w := NewHashChainWriter(f, key, prev)
+		w.Write([]byte("first\n"))
+		w.Write([]byte("second\n"))
+		f.Close()
+	}
+
+	f, err := os.Open(name)
+	require.NoError(t, err)
+	defer f.Close()
+	report := &ChainReport{}
+	require.NoError(t, VerifyHashChain(f, key, report))
+	assert.Equal(t, 4, report.Records)
+	assert.Equal(t, 1, report.Chains)
+}
+
+func TestEncryptedRotatingFile(t *testing.T) {
+	block, err := aes.NewCipher([]byte("0123456789abcdef"))
+	require.NoError(t, err)
+	aead, err := cipher.NewGCM(block)
+	require.NoError(t, err)
+
+	dir := t.TempDir()
+	name := filepath.Join(dir, "auth.log")
+	f, err := NewEncryptedRotatingFile(name, 0, 0, 2, false, aead)
+	require.NoError(t, err)
+	defer f.Close()
+
+	for _, record := range []string{"first\n", "second\n", "third\n"} {
+		_, err := f.Write([]byte(record))
+		require.NoError(t, err)
+		require.NoError(t, f.Rotate())
+		// rotated files are named by the millisecond
+		time.Sleep(2 * time.Millisecond)
+	}
+	_, err = f.Write([]byte("fourth\n"))
+	require.NoError(t, err)
+
+	var backups []string
+	assert.Eventually(t, func() bool {
+		backups, err = f.backups()
+		return err == nil && len(backups) == 2 &&
+			strings.HasSuffix(backups[0], EncryptedExt) && strings.HasSuffix(backups[1], EncryptedExt)
+	}, time.Second, 10*time.Millisecond)
+
+	b, err := ioutil.ReadFile(backups[1])
+	require.NoError(t, err)
+	assert.NotContains(t, string(b), "third")
+
+	b, err = ReadAuditFile(backups[1], aead)
+	require.NoError(t, err)
+	assert.Equal(t, "third\n", string(b))
+	b, err = ReadAuditFile(name, aead)
+	require.NoError(t, err)
+	assert.Equal(t, "fourth\n", string(b))
+
+	_, err = ReadAuditFile(backups[1], nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,90 @@
+package logger
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+type requestFieldsKey struct{}
+
+// RequestFields identify the user and session a request was made with, so
+// that the log lines written while handling it can be tied together without
+// exposing the user's email or session cookie
+type RequestFields struct {
+	// UserHash is the HashIdentifier of the user's email or username
+	UserHash string
+	// SessionHash is the HashIdentifier of the session cookie's value: the
+	// ticket with the redis session store
+	SessionHash string
+	// Provider is the name of the provider the session was signed in with
+	Provider string
+}
+
+// String formats the fields that are set, eg.
+// "user=1f2e3d4c5b6a7980 session=0a1b2c3d4e5f6071 provider=Google"
+func (f RequestFields) String() string {
+	var parts []string
+	if f.UserHash != "" {
+		parts = append(parts, "user="+f.UserHash)
+	}
+	if f.SessionHash != "" {
+		parts = append(parts, "session="+f.SessionHash)
+	}
+	if f.Provider != "" {
+		parts = append(parts, "provider="+f.Provider)
+	}
+	return strings.Join(parts, " ")
+}
+
+// requestFields holds the fields of a request. It is attached to the
+// request's context before the fields are known, so that they can be set
+// by handlers further down the chain and read by the middleware that logs
+// the request once it has been handled.
+type requestFields struct {
+	mu     sync.Mutex
+	fields RequestFields
+}
+
+// NewRequestContext returns a context that the fields of the request it
+// belongs to can be set on with SetRequestFields
+func NewRequestContext(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(requestFieldsKey{}).(*requestFields); ok {
+		return ctx
+	}
+	return context.WithValue(ctx, requestFieldsKey{}, &requestFields{})
+}
+
+// SetRequestFields sets the fields included in the log lines written for
+// the rest of the request. It does nothing if the request's context wasn't
+// created with NewRequestContext.
+func SetRequestFields(req *http.Request, f RequestFields) {
+	if rf, ok := req.Context().Value(requestFieldsKey{}).(*requestFields); ok {
+		rf.mu.Lock()
+		defer rf.mu.Unlock()
+		rf.fields = f
+	}
+}
+
+// GetRequestFields returns the fields set for the request, if any
+func GetRequestFields(req *http.Request) RequestFields {
+	if req == nil {
+		return RequestFields{}
+	}
+	if rf, ok := req.Context().Value(requestFieldsKey{}).(*requestFields); ok {
+		rf.mu.Lock()
+		defer rf.mu.Unlock()
+		return rf.fields
+	}
+	return RequestFields{}
+}
+
+// HashIdentifier hashes an identifier, such as an email address, so that it
+// can be logged and searched for without being exposed, with the key set by
+// SetHashKey if any. Empty identifiers hash to the empty string.
+func HashIdentifier(s string) string {
+	std.mu.Lock()
+	defer std.mu.Unlock()
+	return std.hashIdentifier(s)
+}
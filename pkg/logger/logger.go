@@ -1,12 +1,15 @@
 package logger
 
 import (
+	"bytes"
+	"expvar"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"os"
 	"runtime"
+	"strings"
 	"sync"
 	"text/template"
 	"time"
@@ -17,11 +20,11 @@ type AuthStatus string
 
 const (
 	// DefaultStandardLoggingFormat defines the default standard log format
-	DefaultStandardLoggingFormat = "[{{.Timestamp}}] [{{.File}}] {{.Message}}"
+	DefaultStandardLoggingFormat = "[{{.Timestamp}}] [{{.File}}] {{.Message}}{{with .Context}} {{.}}{{end}}"
 	// DefaultAuthLoggingFormat defines the default auth log format
-	DefaultAuthLoggingFormat = "{{.Client}} - {{.Username}} [{{.Timestamp}}] [{{.Status}}] {{.Message}}"
+	DefaultAuthLoggingFormat = "{{.Client}} - {{.Username}} [{{.Timestamp}}] [{{.Status}}] {{.Message}}{{with .Context}} {{.}}{{end}}"
 	// DefaultRequestLoggingFormat defines the default request log format
-	DefaultRequestLoggingFormat = "{{.Client}} - {{.Username}} [{{.Timestamp}}] {{.Host}} {{.RequestMethod}} {{.Upstream}} {{.RequestURI}} {{.Protocol}} {{.UserAgent}} {{.StatusCode}} {{.ResponseSize}} {{.RequestDuration}}"
+	DefaultRequestLoggingFormat = "{{.Client}} - {{.Username}} [{{.Timestamp}}] {{.Host}} {{.RequestMethod}} {{.Upstream}} {{.RequestURI}} {{.Protocol}} {{.UserAgent}} {{.StatusCode}} {{.ResponseSize}} {{.RequestDuration}}{{with .Context}} {{.}}{{end}}"
 
 	// AuthSuccess indicates that an auth attempt has succeeded explicitly
 	AuthSuccess AuthStatus = "AuthSuccess"
@@ -43,13 +46,17 @@ const (
 // These are the containers for all values that are available as variables in the logging formats.
 // All values are pre-formatted strings so it is easy to use them in the format string.
 type stdLogMessageData struct {
+	Context,
 	Timestamp,
 	File,
 	Message string
 }
 
 type authLogMessageData struct {
+	ASN,
 	Client,
+	Context,
+	Country,
 	Host,
 	Protocol,
 	RequestMethod,
@@ -62,6 +69,7 @@ type authLogMessageData struct {
 
 type reqLogMessageData struct {
 	Client,
+	Context,
 	Host,
 	Protocol,
 	RequestDuration,
@@ -75,6 +83,14 @@ type reqLogMessageData struct {
 	Username string
 }
 
+// GeoLookupFunc resolves the ISO country code and autonomous system number
+// of a client, as returned by the GetClientFunc. Unknown values are empty.
+type GeoLookupFunc = func(client string) (country, asn string)
+
+// authEvents counts auth events by status and the client's country when
+// GeoIP lookups are enabled. It is published with expvar.
+var authEvents = expvar.NewMap("auth_events_by_country")
+
 // Returns the apparent "real client IP" as a string.
 type GetClientFunc = func(r *http.Request) string
 
@@ -87,10 +103,17 @@ type Logger struct {
 	mu             sync.Mutex
 	flag           int
 	writer         io.Writer
+	stdWriter      io.Writer
+	authWriter     io.Writer
+	reqWriter      io.Writer
 	stdEnabled     bool
 	authEnabled    bool
 	reqEnabled     bool
+	maskEmails     bool
+	userPrivacy    string
+	hashKey        []byte
 	getClientFunc  GetClientFunc
+	geoLookupFunc  GeoLookupFunc
 	excludePaths   map[string]struct{}
 	stdLogTemplate *template.Template
 	authTemplate   *template.Template
@@ -118,6 +141,16 @@ var std = New(LstdFlags)
 // Output a standard log template with a simple message.
 // Write a final newline at the end of every message.
 func (l *Logger) Output(calldepth int, message string) {
+	l.output(calldepth+1, nil, message)
+}
+
+// OutputRequest outputs a standard log template like Output, including the
+// fields set for the request being handled with SetRequestFields
+func (l *Logger) OutputRequest(calldepth int, req *http.Request, message string) {
+	l.output(calldepth+1, req, message)
+}
+
+func (l *Logger) output(calldepth int, req *http.Request, message string) {
 	if !l.stdEnabled {
 		return
 	}
@@ -132,13 +165,12 @@ func (l *Logger) Output(calldepth int, message string) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
-	l.stdLogTemplate.Execute(l.writer, stdLogMessageData{
+	l.writeTemplate(l.stdWriter, l.stdLogTemplate, stdLogMessageData{
+		Context:   GetRequestFields(req).String(),
 		Timestamp: FormatTimestamp(now),
 		File:      file,
 		Message:   message,
 	})
-
-	l.writer.Write([]byte("\n"))
 }
 
 // PrintAuthf writes auth info to the logger. Requires an http.Request to
@@ -157,11 +189,30 @@ func (l *Logger) PrintAuthf(username string, req *http.Request, status AuthStatu
 
 	client := l.getClientFunc(req)
 
+	message := fmt.Sprintf(format, a...)
+
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
-	l.authTemplate.Execute(l.writer, authLogMessageData{
+	if obfuscated := l.obfuscateUser(username); obfuscated != username {
+		// Messages often name the user too
+		message = strings.ReplaceAll(message, username, obfuscated)
+		username = obfuscated
+	}
+
+	country, asn := "-", "-"
+	if l.geoLookupFunc != nil {
+		if c, a := l.geoLookupFunc(client); c != "" || a != "" {
+			country, asn = orDash(c), orDash(a)
+		}
+		authEvents.Add(string(status)+":"+country, 1)
+	}
+
+	l.writeTemplate(l.authWriter, l.authTemplate, authLogMessageData{
+		ASN:           asn,
 		Client:        client,
+		Context:       GetRequestFields(req).String(),
+		Country:       country,
 		Host:          req.Host,
 		Protocol:      req.Proto,
 		RequestMethod: req.Method,
@@ -169,10 +220,8 @@ func (l *Logger) PrintAuthf(username string, req *http.Request, status AuthStatu
 		UserAgent:     fmt.Sprintf("%q", req.UserAgent()),
 		Username:      username,
 		Status:        string(status),
-		Message:       fmt.Sprintf(format, a...),
+		Message:       message,
 	})
-
-	l.writer.Write([]byte("\n"))
 }
 
 // PrintReq writes request details to the Logger using the http.Request,
@@ -208,8 +257,11 @@ func (l *Logger) PrintReq(username, upstream string, req *http.Request, url url.
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
-	l.reqTemplate.Execute(l.writer, reqLogMessageData{
+	username = l.obfuscateUser(username)
+
+	l.writeTemplate(l.reqWriter, l.reqTemplate, reqLogMessageData{
 		Client:          client,
+		Context:         GetRequestFields(req).String(),
 		Host:            req.Host,
 		Protocol:        req.Proto,
 		RequestDuration: fmt.Sprintf("%0.3f", duration),
@@ -222,8 +274,38 @@ func (l *Logger) PrintReq(username, upstream string, req *http.Request, url url.
 		UserAgent:       fmt.Sprintf("%q", req.UserAgent()),
 		Username:        username,
 	})
+}
 
-	l.writer.Write([]byte("\n"))
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// MaskEmail masks the local part of an email address, keeping only its first
+// character, eg. j***@example.com. Values that are not email addresses are
+// returned unchanged.
+func MaskEmail(s string) string {
+	at := strings.LastIndex(s, "@")
+	if at < 1 {
+		return s
+	}
+	return s[:1] + "***" + s[at:]
+}
+
+// writeTemplate renders the template and its final newline in a single
+// Write, so that messages are never interleaved or split by the writer.
+// Messages are written to w, or the Logger's writer if w is nil.
+// The caller must hold l.mu.
+func (l *Logger) writeTemplate(w io.Writer, t *template.Template, data interface{}) {
+	if w == nil {
+		w = l.writer
+	}
+	var buf bytes.Buffer
+	t.Execute(&buf, data)
+	buf.WriteByte('\n')
+	w.Write(buf.Bytes())
 }
 
 // GetFileLineString will find the caller file and line number
@@ -277,6 +359,30 @@ func (l *Logger) SetFlags(flag int) {
 	l.flag = flag
 }
 
+// SetStandardOutput sets the output destination for standard logging,
+// overriding the Logger's writer. A nil writer restores the default.
+func (l *Logger) SetStandardOutput(w io.Writer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.stdWriter = w
+}
+
+// SetAuthOutput sets the output destination for auth logging, overriding the
+// Logger's writer. A nil writer restores the default.
+func (l *Logger) SetAuthOutput(w io.Writer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.authWriter = w
+}
+
+// SetReqOutput sets the output destination for request logging, overriding
+// the Logger's writer. A nil writer restores the default.
+func (l *Logger) SetReqOutput(w io.Writer) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.reqWriter = w
+}
+
 // SetStandardEnabled enables or disables standard logging.
 func (l *Logger) SetStandardEnabled(e bool) {
 	l.mu.Lock()
@@ -298,6 +404,22 @@ func (l *Logger) SetReqEnabled(e bool) {
 	l.reqEnabled = e
 }
 
+// SetGeoLookupFunc sets the function used to resolve the country and ASN of
+// clients in auth logs. A nil function disables the lookups.
+func (l *Logger) SetGeoLookupFunc(f GeoLookupFunc) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.geoLookupFunc = f
+}
+
+// SetMaskEmails enables or disables masking the local part of email
+// addresses logged as usernames.
+func (l *Logger) SetMaskEmails(e bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.maskEmails = e
+}
+
 // SetGetClientFunc sets the function which determines the apparent "real client IP".
 func (l *Logger) SetGetClientFunc(f GetClientFunc) {
 	l.mu.Lock()
@@ -360,6 +482,37 @@ func SetOutput(w io.Writer) {
 	std.writer = w
 }
 
+// SetStandardOutput sets the output destination for standard logging for
+// the standard logger.
+func SetStandardOutput(w io.Writer) {
+	std.SetStandardOutput(w)
+}
+
+// SetAuthOutput sets the output destination for auth logging for the
+// standard logger.
+func SetAuthOutput(w io.Writer) {
+	std.SetAuthOutput(w)
+}
+
+// SetReqOutput sets the output destination for request logging for the
+// standard logger.
+func SetReqOutput(w io.Writer) {
+	std.SetReqOutput(w)
+}
+
+// Flush waits for any output buffered by the standard logger's writers to be
+// written, so that it is not lost when the process exits.
+func Flush() {
+	std.mu.Lock()
+	writers := []io.Writer{std.writer, std.stdWriter, std.authWriter, std.reqWriter}
+	std.mu.Unlock()
+	for _, w := range writers {
+		if f, ok := w.(interface{ Flush() }); ok {
+			f.Flush()
+		}
+	}
+}
+
 // SetStandardEnabled enables or disables standard logging for the
 // standard logger.
 func SetStandardEnabled(e bool) {
@@ -378,6 +531,18 @@ func SetReqEnabled(e bool) {
 	std.SetReqEnabled(e)
 }
 
+// SetGeoLookupFunc sets the function used to resolve the country and ASN of
+// clients in auth logs for the standard logger.
+func SetGeoLookupFunc(f GeoLookupFunc) {
+	std.SetGeoLookupFunc(f)
+}
+
+// SetMaskEmails enables or disables masking the local part of email
+// addresses logged as usernames for the standard logger.
+func SetMaskEmails(e bool) {
+	std.SetMaskEmails(e)
+}
+
 // SetGetClientFunc sets the function which determines the apparent IP address
 // set by a reverse proxy for the standard logger.
 func SetGetClientFunc(f GetClientFunc) {
@@ -419,6 +584,13 @@ func Printf(format string, v ...interface{}) {
 	std.Output(2, fmt.Sprintf(format, v...))
 }
 
+// PrintfRequest calls OutputRequest to print to the standard logger, including
+// the fields set for the request. Arguments are handled in the manner of
+// fmt.Printf.
+func PrintfRequest(req *http.Request, format string, v ...interface{}) {
+	std.OutputRequest(2, req, fmt.Sprintf(format, v...))
+}
+
 // Println calls Output to print to the standard logger.
 // Arguments are handled in the manner of fmt.Println.
 func Println(v ...interface{}) {
@@ -428,18 +600,21 @@ func Println(v ...interface{}) {
 // Fatal is equivalent to Print() followed by a call to os.Exit(1).
 func Fatal(v ...interface{}) {
 	std.Output(2, fmt.Sprint(v...))
+	Flush()
 	os.Exit(1)
 }
 
 // Fatalf is equivalent to Printf() followed by a call to os.Exit(1).
 func Fatalf(format string, v ...interface{}) {
 	std.Output(2, fmt.Sprintf(format, v...))
+	Flush()
 	os.Exit(1)
 }
 
 // Fatalln is equivalent to Println() followed by a call to os.Exit(1).
 func Fatalln(v ...interface{}) {
 	std.Output(2, fmt.Sprintln(v...))
+	Flush()
 	os.Exit(1)
 }
 
@@ -0,0 +1,117 @@
+package logger
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMaskEmail(t *testing.T) {
+	assert.Equal(t, "j***@example.com", MaskEmail("john.doe@example.com"))
+	assert.Equal(t, "j***@example.com", MaskEmail("j@example.com"))
+	assert.Equal(t, "john", MaskEmail("john"))
+	assert.Equal(t, "@example.com", MaskEmail("@example.com"))
+	assert.Equal(t, "-", MaskEmail("-"))
+}
+
+func TestLoggerMaskEmails(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(0)
+	l.writer = &buf
+	l.SetAuthTemplate("{{.Username}}")
+	l.SetMaskEmails(true)
+
+	l.PrintAuthf("john.doe@example.com", httptest.NewRequest("GET", "/", nil), AuthSuccess, "")
+	assert.Equal(t, "j***@example.com\n", buf.String())
+}
+
+func TestLoggerGeoLookup(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(0)
+	l.writer = &buf
+	l.SetAuthTemplate("{{.Client}} {{.Country}} {{.ASN}} [{{.Status}}]")
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "203.0.113.1"
+
+	l.PrintAuthf("", req, AuthSuccess, "")
+	l.SetGeoLookupFunc(func(client string) (string, string) {
+		if client == "203.0.113.1" {
+			return "GB", "AS64496"
+		}
+		return "", ""
+	})
+	before := authEvents.Get("AuthFailure:GB")
+	l.PrintAuthf("", req, AuthFailure, "")
+	req.RemoteAddr = "198.51.100.1"
+	l.PrintAuthf("", req, AuthSuccess, "")
+
+	assert.Equal(t, "203.0.113.1 - - [AuthSuccess]\n203.0.113.1 GB AS64496 [AuthFailure]\n198.51.100.1 - - [AuthSuccess]\n", buf.String())
+	after := authEvents.Get("AuthFailure:GB")
+	if assert.NotNil(t, after) {
+		var prev int64
+		if before != nil {
+			prev = before.(*expvar.Int).Value()
+		}
+		assert.Equal(t, prev+1, after.(*expvar.Int).Value())
+	}
+}
+
+func TestLoggerRequestFields(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(0)
+	l.writer = &buf
+	l.SetStandardTemplate("{{.Message}}{{with .Context}} {{.}}{{end}}")
+	l.SetAuthTemplate("[{{.Status}}] {{.Message}}{{with .Context}} {{.}}{{end}}")
+
+	req := httptest.NewRequest("GET", "/", nil)
+	SetRequestFields(req, RequestFields{UserHash: "1234"})
+	l.OutputRequest(1, req, "no context")
+
+	req = req.WithContext(NewRequestContext(req.Context()))
+	SetRequestFields(req, RequestFields{UserHash: HashIdentifier("jane@example.com"), Provider: "Google"})
+	l.OutputRequest(1, req, "refreshing")
+	l.PrintAuthf("", req, AuthSuccess, "signed in")
+
+	user := HashIdentifier("jane@example.com")
+	assert.Len(t, user, 16)
+	assert.Equal(t, "no context\nrefreshing user="+user+" provider=Google\n[AuthSuccess] signed in user="+user+" provider=Google\n", buf.String())
+	assert.Equal(t, "", HashIdentifier(""))
+}
+
+func TestTruncateIdentifier(t *testing.T) {
+	assert.Equal(t, "j***@example.com", TruncateIdentifier("john.doe@example.com"))
+	assert.Equal(t, "j***", TruncateIdentifier("john.doe"))
+	assert.Equal(t, "é***", TruncateIdentifier("éloïse"))
+	assert.Equal(t, "-", TruncateIdentifier("-"))
+	assert.Equal(t, "", TruncateIdentifier(""))
+}
+
+func TestLoggerUserPrivacy(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(0)
+	l.writer = &buf
+	l.SetAuthTemplate("{{.Username}} {{.Message}}")
+	l.SetReqTemplate("{{.Username}}")
+	req := httptest.NewRequest("GET", "/", nil)
+
+	l.SetUserPrivacy(UserPrivacyTruncate)
+	l.PrintAuthf("john.doe@example.com", req, AuthSuccess, "Authenticated: john.doe@example.com")
+	l.PrintReq("jdoe", "", req, *req.URL, time.Now(), 200, 0)
+
+	l.SetUserPrivacy(UserPrivacyHash)
+	l.SetHashKey([]byte("key"))
+	l.PrintAuthf("john.doe@example.com", req, AuthSuccess, "Authenticated: john.doe@example.com")
+	l.PrintReq("", "", req, *req.URL, time.Now(), 200, 0)
+
+	mac := hmac.New(sha256.New, []byte("key"))
+	mac.Write([]byte("john.doe@example.com"))
+	hash := hex.EncodeToString(mac.Sum(nil)[:8])
+	assert.Equal(t, "j***@example.com Authenticated: j***@example.com\nj***\n"+hash+" Authenticated: "+hash+"\n-\n", buf.String())
+}
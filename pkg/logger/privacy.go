@@ -0,0 +1,99 @@
+package logger
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"unicode/utf8"
+)
+
+// The modes of obfuscating the users logged in request and auth logs
+const (
+	// UserPrivacyTruncate keeps the first character of the user, and the
+	// domain of email addresses, eg. j***@example.com
+	UserPrivacyTruncate = "truncate"
+	// UserPrivacyHash replaces the user with the HashIdentifier of the user,
+	// so that the lines of the same user can still be correlated
+	UserPrivacyHash = "hash"
+)
+
+// TruncateIdentifier keeps the first character of an identifier: of the
+// local part of email addresses, keeping their domain, eg. j***@example.com,
+// or of other identifiers, eg. j***
+func TruncateIdentifier(s string) string {
+	if s == "" || s == "-" {
+		return s
+	}
+	if at := strings.LastIndex(s, "@"); at >= 1 {
+		return MaskEmail(s)
+	}
+	_, size := utf8.DecodeRuneInString(s)
+	return s[:size] + "***"
+}
+
+// hashIdentifier hashes an identifier with the logger's hash key, if any.
+// The caller must hold l.mu.
+func (l *Logger) hashIdentifier(s string) string {
+	if s == "" {
+		return ""
+	}
+	var sum []byte
+	if len(l.hashKey) > 0 {
+		mac := hmac.New(sha256.New, l.hashKey)
+		mac.Write([]byte(s))
+		sum = mac.Sum(nil)
+	} else {
+		digest := sha256.Sum256([]byte(s))
+		sum = digest[:]
+	}
+	return hex.EncodeToString(sum[:8])
+}
+
+// obfuscateUser obfuscates a user logged in request and auth logs as set by
+// SetUserPrivacy and SetMaskEmails. The caller must hold l.mu.
+func (l *Logger) obfuscateUser(username string) string {
+	if username == "-" {
+		return username
+	}
+	switch l.userPrivacy {
+	case UserPrivacyTruncate:
+		return TruncateIdentifier(username)
+	case UserPrivacyHash:
+		return l.hashIdentifier(username)
+	}
+	if l.maskEmails {
+		return MaskEmail(username)
+	}
+	return username
+}
+
+// SetUserPrivacy sets how the users logged in request and auth logs, and
+// in the messages of auth logs, are obfuscated: UserPrivacyTruncate,
+// UserPrivacyHash or "" to log them as they are.
+func (l *Logger) SetUserPrivacy(mode string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.userPrivacy = mode
+}
+
+// SetHashKey sets the key identifiers are hashed with, so that hashes of
+// guessable identifiers such as email addresses can't be reversed by anyone
+// without the key. Identifiers are hashed without a key if it is empty.
+func (l *Logger) SetHashKey(key []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.hashKey = key
+}
+
+// SetUserPrivacy sets how users are obfuscated in the request and auth logs
+// of the standard logger.
+func SetUserPrivacy(mode string) {
+	std.SetUserPrivacy(mode)
+}
+
+// SetHashKey sets the key identifiers are hashed with by the standard logger
+// and HashIdentifier.
+func SetHashKey(key []byte) {
+	std.SetHashKey(key)
+}
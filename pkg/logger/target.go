@@ -0,0 +1,204 @@
+package logger
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// Facility is a syslog facility as defined by RFC5424
+type Facility int
+
+// Syslog facilities used by the proxy's loggers
+const (
+	FacilityDaemon   Facility = 3
+	FacilityAuthPriv Facility = 10
+)
+
+// severityInfo is the syslog severity all messages are logged with
+const severityInfo = 6
+
+const (
+	defaultSyslogSocket   = "/dev/log"
+	defaultJournaldSocket = "/run/systemd/journal/socket"
+	appName               = "oauth2-proxy"
+)
+
+// NewTargetWriter creates a writer for a logging target, which may be
+// "syslog" for the local syslog daemon on /dev/log, "journald" for the local
+// systemd journal or a syslog server address in the form
+// syslog[+udp|+tcp|+unix]://<address> (UDP when no transport is given).
+// Syslog messages are formatted following RFC5424 and sent with the given
+// facility.
+func NewTargetWriter(target string, facility Facility) (io.Writer, error) {
+	switch target {
+	case "syslog":
+		return NewSyslogWriter("unixgram", defaultSyslogSocket, facility)
+	case "journald":
+		return NewJournaldWriter(defaultJournaldSocket, facility)
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid logging target %q: %v", target, err)
+	}
+	switch u.Scheme {
+	case "syslog", "syslog+udp":
+		return NewSyslogWriter("udp", u.Host, facility)
+	case "syslog+tcp":
+		return NewSyslogWriter("tcp", u.Host, facility)
+	case "syslog+unix":
+		return NewSyslogWriter("unixgram", u.Path, facility)
+	default:
+		return nil, fmt.Errorf("invalid logging target %q: must be one of syslog, syslog[+udp|+tcp|+unix]://<address> or journald", target)
+	}
+}
+
+// SyslogWriter is an io.Writer sending each write as a RFC5424 syslog message
+type SyslogWriter struct {
+	network  string
+	address  string
+	facility Facility
+	hostname string
+	pid      int
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// NewSyslogWriter connects to the syslog server at address over the network
+// given, which may be "udp", "tcp" or "unixgram"
+func NewSyslogWriter(network, address string, facility Facility) (*SyslogWriter, error) {
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "-"
+	}
+	w := &SyslogWriter{
+		network:  network,
+		address:  address,
+		facility: facility,
+		hostname: hostname,
+		pid:      os.Getpid(),
+	}
+	if err := w.connect(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *SyslogWriter) connect() error {
+	conn, err := net.Dial(w.network, w.address)
+	if err != nil {
+		return fmt.Errorf("unable to connect to syslog at %s://%s: %v", w.network, w.address, err)
+	}
+	w.conn = conn
+	return nil
+}
+
+// Write sends p as a single syslog message, reconnecting once if the
+// connection has been lost
+func (w *SyslogWriter) Write(p []byte) (int, error) {
+	msg := w.format(time.Now(), p)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.conn != nil {
+		if _, err := w.conn.Write(msg); err == nil {
+			return len(p), nil
+		}
+		w.conn.Close()
+		w.conn = nil
+	}
+	if err := w.connect(); err != nil {
+		return 0, err
+	}
+	if _, err := w.conn.Write(msg); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// format builds the RFC5424 message for p. Messages sent over TCP are framed
+// with their length as described in RFC6587.
+func (w *SyslogWriter) format(ts time.Time, p []byte) []byte {
+	msg := fmt.Sprintf("<%d>1 %s %s %s %d - - %s",
+		int(w.facility)*8+severityInfo,
+		ts.UTC().Format(time.RFC3339Nano),
+		w.hostname,
+		appName,
+		w.pid,
+		bytes.TrimRight(p, "\n"))
+	if w.network == "tcp" {
+		msg = fmt.Sprintf("%d %s", len(msg), msg)
+	}
+	return []byte(msg)
+}
+
+// Close closes the connection to the syslog server
+func (w *SyslogWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.conn == nil {
+		return nil
+	}
+	err := w.conn.Close()
+	w.conn = nil
+	return err
+}
+
+// JournaldWriter is an io.Writer sending each write to the systemd journal
+// using its native protocol
+type JournaldWriter struct {
+	conn     net.Conn
+	facility Facility
+}
+
+// NewJournaldWriter connects to the journal's socket at path
+func NewJournaldWriter(path string, facility Facility) (*JournaldWriter, error) {
+	conn, err := net.Dial("unixgram", path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to journald at %s: %v", path, err)
+	}
+	return &JournaldWriter{conn: conn, facility: facility}, nil
+}
+
+// Write sends p to the journal as a single entry
+func (w *JournaldWriter) Write(p []byte) (int, error) {
+	var buf bytes.Buffer
+	writeJournalField(&buf, "MESSAGE", bytes.TrimRight(p, "\n"))
+	writeJournalField(&buf, "PRIORITY", []byte(fmt.Sprint(severityInfo)))
+	writeJournalField(&buf, "SYSLOG_FACILITY", []byte(fmt.Sprint(int(w.facility))))
+	writeJournalField(&buf, "SYSLOG_IDENTIFIER", []byte(appName))
+	if _, err := w.conn.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close closes the connection to the journal
+func (w *JournaldWriter) Close() error {
+	return w.conn.Close()
+}
+
+// writeJournalField encodes a field in the journal's native format. Values
+// containing newlines must be length prefixed rather than newline terminated.
+func writeJournalField(buf *bytes.Buffer, key string, value []byte) {
+	buf.WriteString(key)
+	if bytes.IndexByte(value, '\n') < 0 {
+		buf.WriteByte('=')
+		buf.Write(value)
+		buf.WriteByte('\n')
+		return
+	}
+	buf.WriteByte('\n')
+	binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	buf.Write(value)
+	buf.WriteByte('\n')
+}
@@ -0,0 +1,145 @@
+package logger
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var rfc5424Regexp = regexp.MustCompile(`^<(\d+)>1 \S+ \S+ oauth2-proxy \d+ - - (.*)$`)
+
+func TestSyslogWriterUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close()
+
+	w, err := NewTargetWriter("syslog://"+conn.LocalAddr().String(), FacilityAuthPriv)
+	require.NoError(t, err)
+
+	_, err = w.Write([]byte("user logged in\n"))
+	require.NoError(t, err)
+
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	require.NoError(t, err)
+
+	matches := rfc5424Regexp.FindStringSubmatch(string(buf[:n]))
+	require.NotNil(t, matches, string(buf[:n]))
+	assert.Equal(t, "86", matches[1])
+	assert.Equal(t, "user logged in", matches[2])
+}
+
+func TestSyslogWriterTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		var length int
+		fmt.Fscanf(r, "%d ", &length)
+		msg := make([]byte, length)
+		r.Read(msg)
+		received <- string(msg)
+	}()
+
+	w, err := NewTargetWriter("syslog+tcp://"+ln.Addr().String(), FacilityDaemon)
+	require.NoError(t, err)
+	_, err = w.Write([]byte("GET / 200\n"))
+	require.NoError(t, err)
+
+	select {
+	case msg := <-received:
+		matches := rfc5424Regexp.FindStringSubmatch(msg)
+		require.NotNil(t, matches, msg)
+		assert.Equal(t, "30", matches[1])
+		assert.Equal(t, "GET / 200", matches[2])
+	case <-time.After(time.Second):
+		t.Fatal("expected a syslog message")
+	}
+}
+
+func TestJournaldWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journald")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "socket")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	w, err := NewJournaldWriter(path, FacilityDaemon)
+	require.NoError(t, err)
+	defer w.Close()
+
+	buf := make([]byte, 1024)
+	_, err = w.Write([]byte("single line\n"))
+	require.NoError(t, err)
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "MESSAGE=single line\nPRIORITY=6\nSYSLOG_FACILITY=3\nSYSLOG_IDENTIFIER=oauth2-proxy\n", string(buf[:n]))
+
+	_, err = w.Write([]byte("two\nlines\n"))
+	require.NoError(t, err)
+	n, err = conn.Read(buf)
+	require.NoError(t, err)
+	var expected bytes.Buffer
+	expected.WriteString("MESSAGE\n")
+	binary.Write(&expected, binary.LittleEndian, uint64(len("two\nlines")))
+	expected.WriteString("two\nlines\n")
+	assert.True(t, strings.HasPrefix(string(buf[:n]), expected.String()))
+}
+
+func TestNewTargetWriterInvalid(t *testing.T) {
+	_, err := NewTargetWriter("kafka://localhost:9092", FacilityDaemon)
+	assert.EqualError(t, err, `invalid logging target "kafka://localhost:9092": must be one of syslog, syslog[+udp|+tcp|+unix]://<address> or journald`)
+}
+
+func TestLoggerOutputs(t *testing.T) {
+	var std, auth, req, def bytes.Buffer
+	l := New(0)
+	l.writer = &def
+	l.SetStandardTemplate("{{.Message}}")
+	l.SetAuthTemplate("{{.Message}}")
+	l.SetReqTemplate("{{.StatusCode}}")
+
+	r := httptest.NewRequest("GET", "/", nil)
+	l.SetAuthOutput(&auth)
+	l.Output(1, "standard")
+	l.PrintAuthf("user", r, AuthSuccess, "auth")
+	l.PrintReq("user", "", r, *r.URL, time.Now(), 200, 0)
+	assert.Equal(t, "standard\n200\n", def.String())
+	assert.Equal(t, "auth\n", auth.String())
+
+	def.Reset()
+	l.SetStandardOutput(&std)
+	l.SetReqOutput(&req)
+	l.SetAuthOutput(nil)
+	l.Output(1, "standard")
+	l.PrintAuthf("user", r, AuthSuccess, "auth")
+	l.PrintReq("user", "", r, *r.URL, time.Now(), 200, 0)
+	assert.Equal(t, "auth\n", def.String())
+	assert.Equal(t, "standard\n", std.String())
+	assert.Equal(t, "200\n", req.String())
+}
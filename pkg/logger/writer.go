@@ -0,0 +1,121 @@
+package logger
+
+import (
+	"expvar"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// droppedMessages counts the log messages dropped by all AsyncWriters
+// because their buffers were full. It is published with expvar.
+var droppedMessages = expvar.NewInt("logger_dropped_messages")
+
+type asyncEntry struct {
+	data    []byte
+	flushed chan struct{}
+}
+
+// AsyncWriter is an io.Writer that buffers writes in memory and passes them
+// to the underlying writer in the background, so that logging never blocks
+// request handling on slow disks. When the buffer is full, writes are
+// dropped and counted rather than blocking.
+type AsyncWriter struct {
+	writer  io.Writer
+	entries chan asyncEntry
+	dropped uint64
+	closed  chan struct{}
+	once    sync.Once
+}
+
+// NewAsyncWriter creates an AsyncWriter buffering up to bufferSize writes
+// to w
+func NewAsyncWriter(w io.Writer, bufferSize int) *AsyncWriter {
+	aw := &AsyncWriter{
+		writer:  w,
+		entries: make(chan asyncEntry, bufferSize),
+		closed:  make(chan struct{}),
+	}
+	go aw.run()
+	return aw
+}
+
+func (aw *AsyncWriter) run() {
+	defer close(aw.closed)
+	for entry := range aw.entries {
+		if entry.flushed != nil {
+			close(entry.flushed)
+			continue
+		}
+		aw.writer.Write(entry.data)
+	}
+}
+
+// Write queues p to be written to the underlying writer. It never blocks and
+// never returns an error; if the buffer is full the write is dropped.
+func (aw *AsyncWriter) Write(p []byte) (int, error) {
+	data := make([]byte, len(p))
+	copy(data, p)
+	select {
+	case aw.entries <- asyncEntry{data: data}:
+	default:
+		atomic.AddUint64(&aw.dropped, 1)
+		droppedMessages.Add(1)
+	}
+	return len(p), nil
+}
+
+// Dropped returns the number of writes dropped because the buffer was full
+func (aw *AsyncWriter) Dropped() uint64 {
+	return atomic.LoadUint64(&aw.dropped)
+}
+
+// Flush blocks until all of the writes queued before it have been passed to
+// the underlying writer
+func (aw *AsyncWriter) Flush() {
+	flushed := make(chan struct{})
+	aw.entries <- asyncEntry{flushed: flushed}
+	<-flushed
+}
+
+// Close flushes any queued writes and stops the background writer. The
+// AsyncWriter must not be written to after it has been closed.
+func (aw *AsyncWriter) Close() error {
+	aw.once.Do(func() {
+		close(aw.entries)
+	})
+	<-aw.closed
+	return nil
+}
+
+// Rotator is implemented by writers that can be rotated on demand, such as
+// lumberjack.Logger
+type Rotator interface {
+	Rotate() error
+}
+
+// RotateEvery rotates r at every interval until the returned stop function is
+// called. This complements size based rotation for log files that should be
+// rotated periodically, eg. daily.
+func RotateEvery(r Rotator, interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-ticker.C:
+				if err := r.Rotate(); err != nil {
+					Printf("error rotating log file: %v", err)
+				}
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() { close(done) })
+	}
+}
@@ -0,0 +1,106 @@
+package logger
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// blockingWriter blocks every Write until release is closed
+type blockingWriter struct {
+	release chan struct{}
+	mu      sync.Mutex
+	buf     bytes.Buffer
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	<-w.release
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.Write(p)
+}
+
+func TestAsyncWriterWritesInOrder(t *testing.T) {
+	var buf bytes.Buffer
+	aw := NewAsyncWriter(&buf, 10)
+
+	p := []byte("first\n")
+	aw.Write(p)
+	// The writer must copy the data as callers may reuse their buffers
+	copy(p, "xxxxx\n")
+	aw.Write([]byte("second\n"))
+	assert.NoError(t, aw.Close())
+
+	assert.Equal(t, "first\nsecond\n", buf.String())
+	assert.Equal(t, uint64(0), aw.Dropped())
+}
+
+func TestAsyncWriterDropsWhenFull(t *testing.T) {
+	w := &blockingWriter{release: make(chan struct{})}
+	aw := NewAsyncWriter(w, 1)
+	before := droppedMessages.Value()
+
+	// The first write may be picked up by the background writer straight
+	// away, leaving room for one more in the buffer
+	for i := 0; i < 5; i++ {
+		aw.Write([]byte("line\n"))
+	}
+	dropped := aw.Dropped()
+	assert.True(t, dropped >= 3, "expected at least 3 dropped writes, got %d", dropped)
+	assert.Equal(t, int64(dropped), droppedMessages.Value()-before)
+
+	close(w.release)
+	aw.Close()
+	assert.Equal(t, 5-int(dropped), bytes.Count(w.buf.Bytes(), []byte("\n")))
+}
+
+func TestAsyncWriterFlush(t *testing.T) {
+	var buf bytes.Buffer
+	aw := NewAsyncWriter(&buf, 10)
+	defer aw.Close()
+
+	aw.Write([]byte("line\n"))
+	aw.Flush()
+	assert.Equal(t, "line\n", buf.String())
+}
+
+func TestFlush(t *testing.T) {
+	var buf bytes.Buffer
+	aw := NewAsyncWriter(&buf, 10)
+	defer aw.Close()
+	std.mu.Lock()
+	previous := std.writer
+	std.mu.Unlock()
+	SetOutput(aw)
+	defer SetOutput(previous)
+
+	Print("shutting down")
+	Flush()
+	assert.Contains(t, buf.String(), "shutting down")
+}
+
+type countingRotator struct {
+	rotations chan struct{}
+}
+
+func (r *countingRotator) Rotate() error {
+	r.rotations <- struct{}{}
+	return nil
+}
+
+func TestRotateEvery(t *testing.T) {
+	r := &countingRotator{rotations: make(chan struct{}, 10)}
+	stop := RotateEvery(r, 10*time.Millisecond)
+	defer stop()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-r.rotations:
+		case <-time.After(time.Second):
+			t.Fatal("expected the writer to be rotated")
+		}
+	}
+}
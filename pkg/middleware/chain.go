@@ -0,0 +1,75 @@
+// Package middleware provides the building blocks used to compose the proxy's
+// request handling.
+//
+// The proxy handles each request by passing it through a chain of
+// middlewares, in the following order:
+//
+//  1. HTTPS redirect   - redirects plain HTTP requests when forced to HTTPS
+//  2. Health checks    - answers GCP health checks when enabled
+//  3. Request scope    - attaches a RequestScope to the request context
+//  4. Real client IP   - records the client address in the request scope
+//  5. Logging          - logs the request once the response has been written
+//  6. Routing          - serves the proxy's own endpoints (sign in, callback, ...)
+//  7. Session loading  - loads (and refreshes) the user's session
+//  8. Authorization    - sends unauthenticated users to the sign in flow
+//  9. Header injection - adds the identity headers for the upstream
+//  10. Upstream proxy   - proxies the request to the configured upstream
+//
+// Additional middlewares may be inserted between header injection and the
+// upstream proxy, where the session in the request scope is guaranteed to be
+// present and authorized.
+package middleware
+
+import "net/http"
+
+// Constructor is a function that wraps an http.Handler with additional
+// behaviour, returning the wrapped handler
+type Constructor func(http.Handler) http.Handler
+
+// Chain is an immutable list of middleware Constructors. The first
+// Constructor in the chain is the outermost handler and therefore sees the
+// request first.
+type Chain struct {
+	constructors []Constructor
+}
+
+// NewChain creates a new Chain from the given Constructors
+func NewChain(constructors ...Constructor) Chain {
+	return Chain{constructors: append([]Constructor{}, constructors...)}
+}
+
+// Append returns a new Chain with the given Constructors added after those
+// already in the chain
+func (c Chain) Append(constructors ...Constructor) Chain {
+	newCons := make([]Constructor, 0, len(c.constructors)+len(constructors))
+	newCons = append(newCons, c.constructors...)
+	newCons = append(newCons, constructors...)
+	return Chain{constructors: newCons}
+}
+
+// Extend returns a new Chain with the Constructors of the given Chain added
+// after those already in the chain
+func (c Chain) Extend(chain Chain) Chain {
+	return c.Append(chain.constructors...)
+}
+
+// Then wraps the final handler with each middleware in the chain and returns
+// the resulting http.Handler. A nil handler is replaced with
+// http.DefaultServeMux.
+func (c Chain) Then(h http.Handler) http.Handler {
+	if h == nil {
+		h = http.DefaultServeMux
+	}
+	for i := len(c.constructors) - 1; i >= 0; i-- {
+		h = c.constructors[i](h)
+	}
+	return h
+}
+
+// ThenFunc works like Then but takes an http.HandlerFunc
+func (c Chain) ThenFunc(fn http.HandlerFunc) http.Handler {
+	if fn == nil {
+		return c.Then(nil)
+	}
+	return c.Then(fn)
+}
@@ -0,0 +1,64 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func tagMiddleware(tag string) Constructor {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.Header().Add("X-Order", tag)
+			next.ServeHTTP(rw, req)
+		})
+	}
+}
+
+func serveChain(h http.Handler) []string {
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	h.ServeHTTP(rw, req)
+	return rw.Header().Values("X-Order")
+}
+
+func TestChainOrdering(t *testing.T) {
+	final := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Add("X-Order", "final")
+	})
+
+	chain := NewChain(tagMiddleware("one"), tagMiddleware("two"))
+	assert.Equal(t, []string{"one", "two", "final"}, serveChain(chain.Then(final)))
+
+	extended := chain.Append(tagMiddleware("three")).Extend(NewChain(tagMiddleware("four")))
+	assert.Equal(t, []string{"one", "two", "three", "four", "final"}, serveChain(extended.ThenFunc(final)))
+
+	// The original chain must not be modified by Append
+	assert.Equal(t, []string{"one", "two", "final"}, serveChain(chain.Then(final)))
+}
+
+func TestScope(t *testing.T) {
+	var scopes []*RequestScope
+	record := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		scopes = append(scopes, GetRequestScope(req))
+	})
+
+	req := httptest.NewRequest("GET", "/", nil)
+	assert.Nil(t, GetRequestScope(req))
+
+	// A nested scope middleware must reuse the existing scope
+	var outer *RequestScope
+	h := NewChain(NewScope(), func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			outer = GetRequestScope(req)
+			next.ServeHTTP(rw, req)
+		})
+	}, NewScope()).Then(record)
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	assert.Equal(t, 1, len(scopes))
+	assert.NotNil(t, outer)
+	assert.True(t, outer == scopes[0])
+}
@@ -0,0 +1,46 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+)
+
+type scopeKey struct{}
+
+// RequestScope contains information about the request that is shared
+// between the middlewares handling it
+type RequestScope struct {
+	// ClientIP is the human readable address of the client, including the
+	// real client IP when running behind a reverse proxy
+	ClientIP string
+
+	// Session is the session loaded for the request, if any
+	Session *sessionsapi.SessionState
+
+	// SessionError is the error, if any, encountered while loading the session
+	SessionError error
+}
+
+// NewScope creates a middleware that attaches a new RequestScope to the
+// request context, unless one is already present
+func NewScope() Constructor {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if GetRequestScope(req) != nil {
+				next.ServeHTTP(rw, req)
+				return
+			}
+			ctx := context.WithValue(req.Context(), scopeKey{}, &RequestScope{})
+			next.ServeHTTP(rw, req.WithContext(ctx))
+		})
+	}
+}
+
+// GetRequestScope returns the RequestScope attached to the request, or nil if
+// the request has not been passed through the scope middleware
+func GetRequestScope(req *http.Request) *RequestScope {
+	scope, _ := req.Context().Value(scopeKey{}).(*RequestScope)
+	return scope
+}
@@ -0,0 +1,371 @@
+// Package oidctest provides an in-process OpenID Connect provider for
+// integration tests of the proxy, of applications embedding it and of
+// providers, without running Dex or signing in to a real provider.
+//
+// The provider serves discovery, its signing keys, and the authorization,
+// token and userinfo endpoints. Authorization requests are approved at once
+// as the user selected by the login_hint parameter or set with SignInAs.
+package oidctest
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	jose "gopkg.in/square/go-jose.v2"
+	"gopkg.in/square/go-jose.v2/jwt"
+)
+
+// The paths of the provider's endpoints
+const (
+	DiscoveryPath = "/.well-known/openid-configuration"
+	JWKSPath      = "/jwks"
+	AuthorizePath = "/authorize"
+	TokenPath     = "/token"
+	UserInfoPath  = "/userinfo"
+)
+
+// User is a user of the provider. Its fields are the claims of the ID tokens
+// and userinfo responses issued for the user, along with Claims.
+type User struct {
+	Subject           string
+	Email             string
+	EmailVerified     bool
+	Name              string
+	PreferredUsername string
+	Groups            []string
+	// Claims are further claims, eg. acr or a tenant
+	Claims map[string]interface{}
+}
+
+func (u *User) claims() map[string]interface{} {
+	claims := map[string]interface{}{"sub": u.Subject}
+	if u.Email != "" {
+		claims["email"] = u.Email
+		claims["email_verified"] = u.EmailVerified
+	}
+	if u.Name != "" {
+		claims["name"] = u.Name
+	}
+	if u.PreferredUsername != "" {
+		claims["preferred_username"] = u.PreferredUsername
+	}
+	if len(u.Groups) > 0 {
+		claims["groups"] = u.Groups
+	}
+	for k, v := range u.Claims {
+		claims[k] = v
+	}
+	return claims
+}
+
+// grant is what an authorization code or refresh token was issued for
+type grant struct {
+	user        *User
+	clientID    string
+	redirectURI string
+	nonce       string
+	scope       string
+	expires     time.Time
+}
+
+// Server is an OpenID Connect provider served over HTTP on a loopback
+// address. Its fields may be changed before the first request.
+type Server struct {
+	*httptest.Server
+
+	// ClientID and ClientSecret are the credentials clients must use
+	ClientID     string
+	ClientSecret string
+	// TokenTTL is how long the access and ID tokens issued are valid for
+	TokenTTL time.Duration
+
+	key    *jose.JSONWebKey
+	signer jose.Signer
+
+	mu            sync.Mutex
+	users         map[string]*User
+	signedIn      string
+	codes         map[string]*grant
+	accessTokens  map[string]*grant
+	refreshTokens map[string]*grant
+	requests      []*http.Request
+}
+
+// NewServer starts a provider with a client "oidctest-client" and a single
+// verified user, jane@example.com. Close it when done.
+func NewServer() *Server {
+	s := NewUnstartedServer()
+	s.Start()
+	return s
+}
+
+// NewUnstartedServer returns a provider that isn't serving yet, eg. to be
+// started with StartTLS. Start it when ready, then Close it when done.
+func NewUnstartedServer() *Server {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(fmt.Sprintf("oidctest: generating signing key: %v", err))
+	}
+	jwk := &jose.JSONWebKey{Key: key, KeyID: "oidctest", Algorithm: string(jose.RS256), Use: "sig"}
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: jose.RS256, Key: jwk}, (&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		panic(fmt.Sprintf("oidctest: creating signer: %v", err))
+	}
+
+	s := &Server{
+		ClientID:      "oidctest-client",
+		ClientSecret:  "oidctest-secret",
+		TokenTTL:      time.Hour,
+		key:           jwk,
+		signer:        signer,
+		users:         map[string]*User{},
+		codes:         map[string]*grant{},
+		accessTokens:  map[string]*grant{},
+		refreshTokens: map[string]*grant{},
+	}
+	s.AddUser(User{
+		Subject:       "1234567890",
+		Email:         "jane@example.com",
+		EmailVerified: true,
+		Name:          "Jane Doe",
+		Groups:        []string{"admins"},
+	})
+	s.signedIn = "jane@example.com"
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(DiscoveryPath, s.discovery)
+	mux.HandleFunc(JWKSPath, s.jwks)
+	mux.HandleFunc(AuthorizePath, s.authorize)
+	mux.HandleFunc(TokenPath, s.token)
+	mux.HandleFunc(UserInfoPath, s.userInfo)
+	s.Server = httptest.NewUnstartedServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		s.mu.Lock()
+		s.requests = append(s.requests, req.Clone(req.Context()))
+		s.mu.Unlock()
+		mux.ServeHTTP(rw, req)
+	}))
+	return s
+}
+
+// Issuer returns the issuer URL of the provider, to configure clients with
+func (s *Server) Issuer() string {
+	return s.URL
+}
+
+// AddUser adds a user, or replaces the user with the same email
+func (s *Server) AddUser(u User) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users[strings.ToLower(u.Email)] = &u
+}
+
+// SignInAs sets the user authorization requests without a login_hint are
+// approved as
+func (s *Server) SignInAs(email string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.signedIn = strings.ToLower(email)
+}
+
+// Requests returns the requests made to the provider so far, eg. to check
+// the parameters of authorization requests. Their bodies have been read.
+func (s *Server) Requests() []*http.Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*http.Request(nil), s.requests...)
+}
+
+// IDToken signs an ID token for the user with the given audience, eg. to
+// test bearer token authentication
+func (s *Server) IDToken(u User, audience string) (string, error) {
+	return s.idToken(&u, audience, "")
+}
+
+func (s *Server) discovery(rw http.ResponseWriter, req *http.Request) {
+	writeJSON(rw, http.StatusOK, map[string]interface{}{
+		"issuer":                                s.URL,
+		"authorization_endpoint":                s.URL + AuthorizePath,
+		"token_endpoint":                        s.URL + TokenPath,
+		"userinfo_endpoint":                     s.URL + UserInfoPath,
+		"jwks_uri":                              s.URL + JWKSPath,
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{string(jose.RS256)},
+		"grant_types_supported":                 []string{"authorization_code", "refresh_token"},
+		"scopes_supported":                      []string{"openid", "email", "profile", "groups", "offline_access"},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post"},
+	})
+}
+
+func (s *Server) jwks(rw http.ResponseWriter, req *http.Request) {
+	writeJSON(rw, http.StatusOK, jose.JSONWebKeySet{Keys: []jose.JSONWebKey{s.key.Public()}})
+}
+
+// authorize approves the request as the signed in user, redirecting back to
+// the client with an authorization code
+func (s *Server) authorize(rw http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	if q.Get("client_id") != s.ClientID {
+		http.Error(rw, "unknown client_id", http.StatusBadRequest)
+		return
+	}
+	redirectURI, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || !redirectURI.IsAbs() {
+		http.Error(rw, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	params := redirectURI.Query()
+	params.Set("state", q.Get("state"))
+	if q.Get("response_type") != "code" {
+		params.Set("error", "unsupported_response_type")
+		redirectURI.RawQuery = params.Encode()
+		http.Redirect(rw, req, redirectURI.String(), http.StatusFound)
+		return
+	}
+
+	s.mu.Lock()
+	email := s.signedIn
+	if hint := q.Get("login_hint"); hint != "" {
+		email = strings.ToLower(hint)
+	}
+	user, ok := s.users[email]
+	code := newToken()
+	if ok {
+		s.codes[code] = &grant{
+			user:        user,
+			clientID:    s.ClientID,
+			redirectURI: redirectURI.String(),
+			nonce:       q.Get("nonce"),
+			scope:       q.Get("scope"),
+			expires:     time.Now().Add(time.Minute),
+		}
+	}
+	s.mu.Unlock()
+
+	if ok {
+		params.Set("code", code)
+	} else {
+		params.Set("error", "access_denied")
+	}
+	redirectURI.RawQuery = params.Encode()
+	http.Redirect(rw, req, redirectURI.String(), http.StatusFound)
+}
+
+// token redeems authorization codes and refresh tokens
+func (s *Server) token(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if err := req.ParseForm(); err != nil {
+		tokenError(rw, http.StatusBadRequest, "invalid_request")
+		return
+	}
+	clientID, clientSecret, ok := req.BasicAuth()
+	if !ok {
+		clientID, clientSecret = req.PostForm.Get("client_id"), req.PostForm.Get("client_secret")
+	}
+	if clientID != s.ClientID || subtle.ConstantTimeCompare([]byte(clientSecret), []byte(s.ClientSecret)) != 1 {
+		tokenError(rw, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+
+	s.mu.Lock()
+	var g *grant
+	switch req.PostForm.Get("grant_type") {
+	case "authorization_code":
+		g = s.codes[req.PostForm.Get("code")]
+		delete(s.codes, req.PostForm.Get("code"))
+		if g != nil && g.redirectURI != req.PostForm.Get("redirect_uri") {
+			g = nil
+		}
+	case "refresh_token":
+		g = s.refreshTokens[req.PostForm.Get("refresh_token")]
+		delete(s.refreshTokens, req.PostForm.Get("refresh_token"))
+	default:
+		s.mu.Unlock()
+		tokenError(rw, http.StatusBadRequest, "unsupported_grant_type")
+		return
+	}
+	if g == nil || time.Now().After(g.expires) {
+		s.mu.Unlock()
+		tokenError(rw, http.StatusBadRequest, "invalid_grant")
+		return
+	}
+	accessToken, refreshToken := newToken(), newToken()
+	expires := time.Now().Add(s.TokenTTL)
+	s.accessTokens[accessToken] = &grant{user: g.user, clientID: g.clientID, scope: g.scope, expires: expires}
+	s.refreshTokens[refreshToken] = &grant{user: g.user, clientID: g.clientID, scope: g.scope, expires: time.Now().Add(24 * time.Hour)}
+	s.mu.Unlock()
+
+	// refresh tokens are issued without the nonce, so that refreshed ID
+	// tokens don't repeat it
+	idToken, err := s.idToken(g.user, g.clientID, g.nonce)
+	if err != nil {
+		tokenError(rw, http.StatusInternalServerError, "server_error")
+		return
+	}
+	writeJSON(rw, http.StatusOK, map[string]interface{}{
+		"access_token":  accessToken,
+		"token_type":    "Bearer",
+		"expires_in":    int(s.TokenTTL.Seconds()),
+		"refresh_token": refreshToken,
+		"id_token":      idToken,
+		"scope":         g.scope,
+	})
+}
+
+func (s *Server) userInfo(rw http.ResponseWriter, req *http.Request) {
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	s.mu.Lock()
+	g := s.accessTokens[token]
+	s.mu.Unlock()
+	if g == nil || time.Now().After(g.expires) {
+		rw.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+		http.Error(rw, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	writeJSON(rw, http.StatusOK, g.user.claims())
+}
+
+func (s *Server) idToken(u *User, audience string, nonce string) (string, error) {
+	now := time.Now()
+	claims := u.claims()
+	claims["iss"] = s.URL
+	claims["aud"] = audience
+	claims["iat"] = jwt.NewNumericDate(now)
+	claims["exp"] = jwt.NewNumericDate(now.Add(s.TokenTTL))
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+	return jwt.Signed(s.signer).Claims(claims).CompactSerialize()
+}
+
+func newToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("oidctest: generating token: %v", err))
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func tokenError(rw http.ResponseWriter, code int, err string) {
+	writeJSON(rw, code, map[string]string{"error": err})
+}
+
+func writeJSON(rw http.ResponseWriter, code int, v interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.WriteHeader(code)
+	json.NewEncoder(rw).Encode(v)
+}
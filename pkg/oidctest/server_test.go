@@ -0,0 +1,90 @@
+package oidctest
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"testing"
+
+	oidc "github.com/coreos/go-oidc"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/oauth2"
+)
+
+func TestServer(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+	s.AddUser(User{Subject: "42", Email: "john@example.com", Groups: []string{"devs"}, Claims: map[string]interface{}{"acr": "mfa"}})
+
+	ctx := context.Background()
+	provider, err := oidc.NewProvider(ctx, s.Issuer())
+	require.NoError(t, err)
+	config := oauth2.Config{
+		ClientID:     s.ClientID,
+		ClientSecret: s.ClientSecret,
+		Endpoint:     provider.Endpoint(),
+		RedirectURL:  "https://app.example.com/callback",
+		Scopes:       []string{oidc.ScopeOpenID, "email"},
+	}
+	verifier := provider.Verifier(&oidc.Config{ClientID: s.ClientID})
+
+	// authorization requests are approved as the user of the login_hint
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(config.AuthCodeURL("state1", oauth2.SetAuthURLParam("login_hint", "john@example.com"), oidc.Nonce("nonce1")))
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusFound, resp.StatusCode)
+	callback, err := url.Parse(resp.Header.Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, "app.example.com", callback.Host)
+	assert.Equal(t, "state1", callback.Query().Get("state"))
+
+	token, err := config.Exchange(ctx, callback.Query().Get("code"))
+	require.NoError(t, err)
+	idToken, err := verifier.Verify(ctx, token.Extra("id_token").(string))
+	require.NoError(t, err)
+	assert.Equal(t, "42", idToken.Subject)
+	assert.Equal(t, "nonce1", idToken.Nonce)
+	var claims struct {
+		Email  string   `json:"email"`
+		Groups []string `json:"groups"`
+		ACR    string   `json:"acr"`
+	}
+	require.NoError(t, idToken.Claims(&claims))
+	assert.Equal(t, "john@example.com", claims.Email)
+	assert.Equal(t, []string{"devs"}, claims.Groups)
+	assert.Equal(t, "mfa", claims.ACR)
+
+	// codes can only be redeemed once
+	_, err = config.Exchange(ctx, callback.Query().Get("code"))
+	assert.Error(t, err)
+
+	userInfo, err := provider.UserInfo(ctx, config.TokenSource(ctx, token))
+	require.NoError(t, err)
+	assert.Equal(t, "john@example.com", userInfo.Email)
+
+	// refreshed tokens are issued for the same user, without the nonce
+	token.Expiry = token.Expiry.Add(-2 * s.TokenTTL)
+	refreshed, err := config.TokenSource(ctx, token).Token()
+	require.NoError(t, err)
+	assert.NotEqual(t, token.AccessToken, refreshed.AccessToken)
+	idToken, err = verifier.Verify(ctx, refreshed.Extra("id_token").(string))
+	require.NoError(t, err)
+	assert.Equal(t, "42", idToken.Subject)
+	assert.Empty(t, idToken.Nonce)
+
+	// users that don't exist are denied
+	s.SignInAs("nobody@example.com")
+	resp, err = client.Get(config.AuthCodeURL("state2"))
+	require.NoError(t, err)
+	resp.Body.Close()
+	callback, err = url.Parse(resp.Header.Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, "access_denied", callback.Query().Get("error"))
+
+	requests := s.Requests()
+	assert.Equal(t, DiscoveryPath, requests[0].URL.Path)
+	assert.Equal(t, AuthorizePath, requests[1].URL.Path)
+	assert.Equal(t, "john@example.com", requests[1].URL.Query().Get("login_hint"))
+}
@@ -9,11 +9,31 @@ import (
 
 	"github.com/bitly/go-simplejson"
 	"github.com/oauth2-proxy/oauth2-proxy/pkg/logger"
+	"golang.org/x/oauth2"
 )
 
+// WithHTTPClient returns a copy of ctx carrying the client that requests made
+// with it are sent with, here and by the oauth2 package
+func WithHTTPClient(ctx context.Context, client *http.Client) context.Context {
+	return context.WithValue(ctx, oauth2.HTTPClient, client)
+}
+
+// HTTPClient returns the client carried by ctx, or http.DefaultClient
+func HTTPClient(ctx context.Context) *http.Client {
+	if c, ok := ctx.Value(oauth2.HTTPClient).(*http.Client); ok && c != nil {
+		return c
+	}
+	return http.DefaultClient
+}
+
+// Do sends the request with the client carried by its context
+func Do(req *http.Request) (*http.Response, error) {
+	return HTTPClient(req.Context()).Do(req)
+}
+
 // Request parses the request body into a simplejson.Json object
 func Request(req *http.Request) (*simplejson.Json, error) {
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := Do(req)
 	if err != nil {
 		logger.Printf("%s %s %s", req.Method, req.URL, err)
 		return nil, err
@@ -42,7 +62,7 @@ func Request(req *http.Request) (*simplejson.Json, error) {
 
 // RequestJSON parses the request body into the given interface
 func RequestJSON(req *http.Request, v interface{}) error {
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := Do(req)
 	if err != nil {
 		logger.Printf("%s %s %s", req.Method, req.URL, err)
 		return err
@@ -70,5 +90,5 @@ func RequestUnparsedResponse(ctx context.Context, url string, header http.Header
 	}
 	req.Header = header
 
-	return http.DefaultClient.Do(req)
+	return Do(req)
 }
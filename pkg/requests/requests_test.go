@@ -134,3 +134,29 @@ func TestRequestUnparsedResponseUsingHeaders(t *testing.T) {
 
 	assert.Equal(t, "some payload", string(body))
 }
+
+func TestRequestWithHTTPClient(t *testing.T) {
+	backend := testBackend(t, 200, "{\"foo\": \"bar\"}")
+	defer backend.Close()
+
+	var sent int
+	client := &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		sent++
+		return http.DefaultTransport.RoundTrip(req)
+	})}
+	ctx := WithHTTPClient(context.Background(), client)
+	assert.Equal(t, client, HTTPClient(ctx))
+	assert.Equal(t, http.DefaultClient, HTTPClient(context.Background()))
+
+	req, err := http.NewRequestWithContext(ctx, "GET", backend.URL, nil)
+	require.NoError(t, err)
+	_, err = Request(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, sent)
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
@@ -0,0 +1,76 @@
+package cookie
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/encryption"
+)
+
+// dataKeyPrefix marks cookie values sealed with a per-session data key
+const dataKeyPrefix = "dk1."
+
+// dataKeyLength is the size of the AES-256 data keys
+const dataKeyLength = 32
+
+// sealWithDataKey encodes the session with a new random data key and stores
+// the data key alongside it, encrypted with the master cipher. As in the
+// redis store, where each ticket has its own key, the master key only ever
+// encrypts small random keys rather than session contents: both the
+// session's tokens and the encoded session are encrypted with the data key.
+func sealWithDataKey(ss *sessions.SessionState, master *encryption.Cipher) (string, error) {
+	key := make([]byte, dataKeyLength)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return "", fmt.Errorf("failed to create data key: %v", err)
+	}
+	defer encryption.Zero(key)
+	dataCipher, err := encryption.NewCipher(key)
+	if err != nil {
+		return "", fmt.Errorf("failed to create data key cipher: %v", err)
+	}
+
+	value, err := ss.EncodeSessionState(dataCipher)
+	if err != nil {
+		return "", err
+	}
+	payload, err := dataCipher.Encrypt(value)
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt session: %v", err)
+	}
+	wrappedKey, err := master.Encrypt(string(key))
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt data key: %v", err)
+	}
+	return dataKeyPrefix + wrappedKey + "." + payload, nil
+}
+
+// openWithDataKey decodes a session sealed by sealWithDataKey
+func openWithDataKey(value string, master *encryption.Cipher) (*sessions.SessionState, error) {
+	if master == nil {
+		return nil, errors.New("session was sealed with a data key but no cookie cipher is configured")
+	}
+	parts := strings.SplitN(strings.TrimPrefix(value, dataKeyPrefix), ".", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("%w: malformed data key session", encryption.ErrDecrypt)
+	}
+
+	key, err := master.Decrypt(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	keyBytes := []byte(key)
+	defer encryption.Zero(keyBytes)
+	dataCipher, err := encryption.NewCipher(keyBytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid data key: %v", encryption.ErrDecrypt, err)
+	}
+	decrypted, err := dataCipher.Decrypt(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	return sessions.DecodeSessionState(decrypted, dataCipher)
+}
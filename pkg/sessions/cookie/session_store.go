@@ -1,7 +1,8 @@
 package cookie
 
 import (
-	"errors"
+	"context"
+	"expvar"
 	"fmt"
 	"net/http"
 	"regexp"
@@ -10,6 +11,7 @@ import (
 
 	"github.com/oauth2-proxy/oauth2-proxy/pkg/apis/options"
 	"github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/clock"
 	"github.com/oauth2-proxy/oauth2-proxy/pkg/cookies"
 	"github.com/oauth2-proxy/oauth2-proxy/pkg/encryption"
 	"github.com/oauth2-proxy/oauth2-proxy/pkg/logger"
@@ -21,6 +23,11 @@ const (
 	maxCookieLength = 3840
 )
 
+// cookiesIssued counts the session cookies set by cookie session stores. It
+// is published with expvar so the rate of sessions being created or
+// refreshed can be tracked.
+var cookiesIssued = expvar.NewInt("sessions_cookies_issued")
+
 // Ensure CookieSessionStore implements the interface
 var _ sessions.SessionStore = &SessionStore{}
 
@@ -33,29 +40,31 @@ type SessionStore struct {
 
 // Save takes a sessions.SessionState and stores the information from it
 // within Cookies set on the HTTP response writer
-func (s *SessionStore) Save(rw http.ResponseWriter, req *http.Request, ss *sessions.SessionState) error {
+func (s *SessionStore) Save(ctx context.Context, rw http.ResponseWriter, req *http.Request, ss *sessions.SessionState) error {
 	if ss.CreatedAt.IsZero() {
-		ss.CreatedAt = time.Now()
+		ss.CreatedAt = clock.Now()
 	}
 	value, err := cookieForSession(ss, s.CookieCipher)
 	if err != nil {
 		return err
 	}
 	s.setSessionCookie(rw, req, value, ss.CreatedAt)
+	cookiesIssued.Add(1)
 	return nil
 }
 
 // Load reads sessions.SessionState information from Cookies within the
 // HTTP request object
-func (s *SessionStore) Load(req *http.Request) (*sessions.SessionState, error) {
-	c, err := loadCookie(req, s.CookieOptions.Name)
+func (s *SessionStore) Load(ctx context.Context, req *http.Request) (*sessions.SessionState, error) {
+	name := cookies.GetCookieName(req, s.CookieOptions)
+	c, err := loadCookie(req, name)
 	if err != nil {
 		// always http.ErrNoCookie
-		return nil, fmt.Errorf("cookie %q not present", s.CookieOptions.Name)
+		return nil, fmt.Errorf("%w: cookie %q not present", sessions.ErrNotFound, name)
 	}
 	val, _, ok := encryption.Validate(c, s.CookieOptions.Secret, s.CookieOptions.Expire)
 	if !ok {
-		return nil, errors.New("cookie signature not valid")
+		return nil, encryption.ErrInvalidSignature
 	}
 
 	session, err := sessionFromCookie(val, s.CookieCipher)
@@ -67,13 +76,13 @@ func (s *SessionStore) Load(req *http.Request) (*sessions.SessionState, error) {
 
 // Clear clears any saved session information by writing a cookie to
 // clear the session
-func (s *SessionStore) Clear(rw http.ResponseWriter, req *http.Request) error {
+func (s *SessionStore) Clear(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
 	// matches CookieName, CookieName_<number>
-	var cookieNameRegex = regexp.MustCompile(fmt.Sprintf("^%s(_\\d+)?$", s.CookieOptions.Name))
+	var cookieNameRegex = regexp.MustCompile(fmt.Sprintf("^%s(_\\d+)?$", regexp.QuoteMeta(cookies.GetCookieName(req, s.CookieOptions))))
 
 	for _, c := range req.Cookies() {
 		if cookieNameRegex.MatchString(c.Name) {
-			clearCookie := s.makeCookie(req, c.Name, "", time.Hour*-1, time.Now())
+			clearCookie := s.makeCookie(req, c.Name, "", time.Hour*-1, clock.Now())
 
 			http.SetCookie(rw, clearCookie)
 		}
@@ -82,13 +91,21 @@ func (s *SessionStore) Clear(rw http.ResponseWriter, req *http.Request) error {
 	return nil
 }
 
-// cookieForSession serializes a session state for storage in a cookie
+// cookieForSession serializes a session state for storage in a cookie.
+// When there is a cipher, the session is sealed with its own data key.
 func cookieForSession(s *sessions.SessionState, c *encryption.Cipher) (string, error) {
-	return s.EncodeSessionState(c)
+	if c == nil {
+		return s.EncodeSessionState(nil)
+	}
+	return sealWithDataKey(s, c)
 }
 
-// sessionFromCookie deserializes a session from a cookie value
-func sessionFromCookie(v string, c *encryption.Cipher) (s *sessions.SessionState, err error) {
+// sessionFromCookie deserializes a session from a cookie value. Cookies set
+// before sessions were sealed with data keys are still accepted.
+func sessionFromCookie(v string, c *encryption.Cipher) (*sessions.SessionState, error) {
+	if strings.HasPrefix(v, dataKeyPrefix) {
+		return openWithDataKey(v, c)
+	}
 	return sessions.DecodeSessionState(v, c)
 }
 
@@ -102,11 +119,12 @@ func (s *SessionStore) setSessionCookie(rw http.ResponseWriter, req *http.Reques
 // makeSessionCookie creates an http.Cookie containing the authenticated user's
 // authentication details
 func (s *SessionStore) makeSessionCookie(req *http.Request, value string, now time.Time) []*http.Cookie {
+	name := cookies.GetCookieName(req, s.CookieOptions)
 	if value != "" {
-		value = encryption.SignedValue(s.CookieOptions.Secret, s.CookieOptions.Name, value, now)
+		value = encryption.SignedValue(s.CookieOptions.Secret, name, value, now)
 	}
-	c := s.makeCookie(req, s.CookieOptions.Name, value, s.CookieOptions.Expire, now)
-	if len(c.Value) > 4096-len(s.CookieOptions.Name) {
+	c := s.makeCookie(req, name, value, s.CookieOptions.Expire, now)
+	if len(c.Value) > 4096-len(name) {
 		return splitCookie(c)
 	}
 	return []*http.Cookie{c}
@@ -198,7 +216,7 @@ func joinCookies(cookies []*http.Cookie) (*http.Cookie, error) {
 	for i := 1; i < len(cookies); i++ {
 		c.Value += cookies[i].Value
 	}
-	c.Name = strings.TrimRight(c.Name, "_0")
+	c.Name = strings.TrimSuffix(c.Name, "_0")
 	return c, nil
 }
 
@@ -2,10 +2,14 @@ package cookie
 
 import (
 	"net/http"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/encryption"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func Test_copyCookie(t *testing.T) {
@@ -28,3 +32,52 @@ func Test_copyCookie(t *testing.T) {
 	got := copyCookie(c)
 	assert.Equal(t, c, got)
 }
+
+func Test_cookieForSessionDataKeys(t *testing.T) {
+	master, err := encryption.NewCipher([]byte("0123456789abcdefghijklmnopqrstuv"))
+	require.NoError(t, err)
+	ss := &sessions.SessionState{Email: "jane@example.com", AccessToken: "token"}
+
+	first, err := cookieForSession(ss, master)
+	require.NoError(t, err)
+	second, err := cookieForSession(ss, master)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(first, dataKeyPrefix))
+	assert.NotEqual(t, strings.Split(first, ".")[1], strings.Split(second, ".")[1])
+
+	loaded, err := sessionFromCookie(first, master)
+	require.NoError(t, err)
+	assert.Equal(t, "jane@example.com", loaded.Email)
+	assert.Equal(t, "token", loaded.AccessToken)
+
+	// The session's tokens are encrypted with the data key, not the master key
+	parts := strings.SplitN(strings.TrimPrefix(first, dataKeyPrefix), ".", 2)
+	key, err := master.Decrypt(parts[0])
+	require.NoError(t, err)
+	dataCipher, err := encryption.NewCipher([]byte(key))
+	require.NoError(t, err)
+	encoded, err := dataCipher.Decrypt(parts[1])
+	require.NoError(t, err)
+	if wrongKey, err := sessions.DecodeSessionState(encoded, master); err == nil {
+		assert.NotEqual(t, "token", wrongKey.AccessToken)
+	}
+	loaded, err = sessions.DecodeSessionState(encoded, dataCipher)
+	require.NoError(t, err)
+	assert.Equal(t, "token", loaded.AccessToken)
+
+	// Cookies set before data keys were introduced can still be read
+	legacy, err := ss.EncodeSessionState(master)
+	require.NoError(t, err)
+	loaded, err = sessionFromCookie(legacy, master)
+	require.NoError(t, err)
+	assert.Equal(t, "token", loaded.AccessToken)
+
+	// Without a cipher there is no master key to seal with
+	plain, err := cookieForSession(&sessions.SessionState{Email: "jane@example.com"}, nil)
+	require.NoError(t, err)
+	assert.False(t, strings.HasPrefix(plain, dataKeyPrefix))
+	_, err = sessionFromCookie(first, nil)
+	assert.Error(t, err)
+	_, err = sessionFromCookie(dataKeyPrefix+"garbage", master)
+	assert.Error(t, err)
+}
@@ -0,0 +1,51 @@
+package sessions
+
+import (
+	"context"
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/logger"
+)
+
+// countTimeout bounds how long counting the sessions in a store may take
+const countTimeout = 5 * time.Second
+
+var (
+	counterMu sync.Mutex
+	counter   sessions.Counter
+)
+
+func init() {
+	expvar.Publish("sessions_active", expvar.Func(activeSessions))
+}
+
+// setCounter sets the store whose sessions are reported by the
+// sessions_active gauge. Stores that can't count their sessions clear it.
+func setCounter(ss sessions.SessionStore) {
+	counterMu.Lock()
+	defer counterMu.Unlock()
+	counter, _ = ss.(sessions.Counter)
+}
+
+// activeSessions counts the sessions in the current store, returning nil
+// when the store can't count them or is unavailable
+func activeSessions() interface{} {
+	counterMu.Lock()
+	c := counter
+	counterMu.Unlock()
+	if c == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), countTimeout)
+	defer cancel()
+	n, err := c.CountSessions(ctx)
+	if err != nil {
+		logger.Printf("Error counting active sessions: %v", err)
+		return nil
+	}
+	return n
+}
@@ -2,6 +2,7 @@ package redis
 
 import (
 	"context"
+	"sync"
 	"time"
 
 	"github.com/go-redis/redis/v7"
@@ -12,8 +13,40 @@ type Client interface {
 	Get(ctx context.Context, key string) ([]byte, error)
 	Set(ctx context.Context, key string, value []byte, expiration time.Duration) error
 	Del(ctx context.Context, key string) error
+	// Take deletes key, reporting whether it existed, so that only one of
+	// several callers racing to delete it succeeds
+	Take(ctx context.Context, key string) (bool, error)
+	Ping(ctx context.Context) error
+	// Count returns the number of keys matching pattern, using SCAN so
+	// as not to block the server
+	Count(ctx context.Context, pattern string) (int64, error)
+	// Keys returns the keys matching pattern, using SCAN
+	Keys(ctx context.Context, pattern string) ([]string, error)
+	// TTL returns the time to live of key, -1 if it has no expiry and -2 if
+	// it doesn't exist
+	TTL(ctx context.Context, key string) (time.Duration, error)
+	// Expire sets the expiration of key
+	Expire(ctx context.Context, key string, expiration time.Duration) error
+	// IncrBy adds delta to the integer at key, and sets its expiration, in
+	// a transaction
+	IncrBy(ctx context.Context, key string, delta int64, expiration time.Duration) (int64, error)
+	// HSet sets field of the hash at key to value, and sets the hash's
+	// expiration, in a transaction
+	HSet(ctx context.Context, key, field string, value []byte, expiration time.Duration) error
+	// HGetAll returns the fields of the hash at key, none if it doesn't exist
+	HGetAll(ctx context.Context, key string) (map[string]string, error)
+	// HDel deletes fields of the hash at key
+	HDel(ctx context.Context, key string, fields ...string) error
+	// Publish sends message to the subscribers of channel
+	Publish(ctx context.Context, channel string, message string) error
+	// Subscribe calls fn with each message published to channel until ctx
+	// is done or the subscription fails
+	Subscribe(ctx context.Context, channel string, fn func(message string)) error
 }
 
+// scanCount is the number of keys requested from each SCAN iteration
+const scanCount = 1000
+
 var _ Client = (*client)(nil)
 
 type client struct {
@@ -36,6 +69,73 @@ func (c *client) Del(ctx context.Context, key string) error {
 	return c.WithContext(ctx).Del(key).Err()
 }
 
+func (c *client) Take(ctx context.Context, key string) (bool, error) {
+	n, err := c.WithContext(ctx).Del(key).Result()
+	return n > 0, err
+}
+
+func (c *client) Ping(ctx context.Context) error {
+	return c.WithContext(ctx).Ping().Err()
+}
+
+func (c *client) Count(ctx context.Context, pattern string) (int64, error) {
+	return countKeys(c.WithContext(ctx), pattern)
+}
+
+func (c *client) Keys(ctx context.Context, pattern string) ([]string, error) {
+	var keys []string
+	err := scanKeys(c.WithContext(ctx), pattern, func(batch []string) {
+		keys = append(keys, batch...)
+	})
+	return keys, err
+}
+
+func (c *client) TTL(ctx context.Context, key string) (time.Duration, error) {
+	return c.WithContext(ctx).PTTL(key).Result()
+}
+
+func (c *client) Expire(ctx context.Context, key string, expiration time.Duration) error {
+	return c.WithContext(ctx).PExpire(key, expiration).Err()
+}
+
+func (c *client) IncrBy(ctx context.Context, key string, delta int64, expiration time.Duration) (int64, error) {
+	var incr *redis.IntCmd
+	_, err := c.WithContext(ctx).TxPipelined(func(pipe redis.Pipeliner) error {
+		incr = pipe.IncrBy(key, delta)
+		pipe.PExpire(key, expiration)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return incr.Val(), nil
+}
+
+func (c *client) HSet(ctx context.Context, key, field string, value []byte, expiration time.Duration) error {
+	_, err := c.WithContext(ctx).TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.HSet(key, field, value)
+		pipe.PExpire(key, expiration)
+		return nil
+	})
+	return err
+}
+
+func (c *client) HGetAll(ctx context.Context, key string) (map[string]string, error) {
+	return c.WithContext(ctx).HGetAll(key).Result()
+}
+
+func (c *client) HDel(ctx context.Context, key string, fields ...string) error {
+	return c.WithContext(ctx).HDel(key, fields...).Err()
+}
+
+func (c *client) Publish(ctx context.Context, channel string, message string) error {
+	return c.WithContext(ctx).Publish(channel, message).Err()
+}
+
+func (c *client) Subscribe(ctx context.Context, channel string, fn func(message string)) error {
+	return receive(ctx, c.WithContext(ctx).Subscribe(channel), fn)
+}
+
 var _ Client = (*clusterClient)(nil)
 
 type clusterClient struct {
@@ -57,3 +157,147 @@ func (c *clusterClient) Set(ctx context.Context, key string, value []byte, expir
 func (c *clusterClient) Del(ctx context.Context, key string) error {
 	return c.WithContext(ctx).Del(key).Err()
 }
+
+func (c *clusterClient) Take(ctx context.Context, key string) (bool, error) {
+	n, err := c.WithContext(ctx).Del(key).Result()
+	return n > 0, err
+}
+
+func (c *clusterClient) Ping(ctx context.Context) error {
+	return c.WithContext(ctx).Ping().Err()
+}
+
+// Count scans each master of the cluster, as every key is held by
+// exactly one of them
+func (c *clusterClient) Count(ctx context.Context, pattern string) (int64, error) {
+	var mu sync.Mutex
+	var total int64
+	err := c.WithContext(ctx).ForEachMaster(func(master *redis.Client) error {
+		n, err := countKeys(master.WithContext(ctx), pattern)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		total += n
+		mu.Unlock()
+		return nil
+	})
+	return total, err
+}
+
+func (c *clusterClient) Keys(ctx context.Context, pattern string) ([]string, error) {
+	var mu sync.Mutex
+	var keys []string
+	err := c.WithContext(ctx).ForEachMaster(func(master *redis.Client) error {
+		return scanKeys(master.WithContext(ctx), pattern, func(batch []string) {
+			mu.Lock()
+			keys = append(keys, batch...)
+			mu.Unlock()
+		})
+	})
+	return keys, err
+}
+
+func (c *clusterClient) TTL(ctx context.Context, key string) (time.Duration, error) {
+	return c.WithContext(ctx).PTTL(key).Result()
+}
+
+func (c *clusterClient) Expire(ctx context.Context, key string, expiration time.Duration) error {
+	return c.WithContext(ctx).PExpire(key, expiration).Err()
+}
+
+func (c *clusterClient) IncrBy(ctx context.Context, key string, delta int64, expiration time.Duration) (int64, error) {
+	var incr *redis.IntCmd
+	_, err := c.WithContext(ctx).TxPipelined(func(pipe redis.Pipeliner) error {
+		incr = pipe.IncrBy(key, delta)
+		pipe.PExpire(key, expiration)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return incr.Val(), nil
+}
+
+func (c *clusterClient) HSet(ctx context.Context, key, field string, value []byte, expiration time.Duration) error {
+	_, err := c.WithContext(ctx).TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.HSet(key, field, value)
+		pipe.PExpire(key, expiration)
+		return nil
+	})
+	return err
+}
+
+func (c *clusterClient) HGetAll(ctx context.Context, key string) (map[string]string, error) {
+	return c.WithContext(ctx).HGetAll(key).Result()
+}
+
+func (c *clusterClient) HDel(ctx context.Context, key string, fields ...string) error {
+	return c.WithContext(ctx).HDel(key, fields...).Err()
+}
+
+func (c *clusterClient) Publish(ctx context.Context, channel string, message string) error {
+	return c.WithContext(ctx).Publish(channel, message).Err()
+}
+
+func (c *clusterClient) Subscribe(ctx context.Context, channel string, fn func(message string)) error {
+	return receive(ctx, c.WithContext(ctx).Subscribe(channel), fn)
+}
+
+// receive waits for a subscription to be confirmed then calls fn with each
+// message received on it until ctx is done or the subscription fails
+func receive(ctx context.Context, ps *redis.PubSub, fn func(message string)) error {
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		// Closing the subscription unblocks the receive in progress
+		select {
+		case <-ctx.Done():
+		case <-stop:
+		}
+		ps.Close()
+	}()
+
+	if _, err := ps.Receive(); err != nil {
+		return err
+	}
+	for {
+		msg, err := ps.ReceiveMessage()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		fn(msg.Payload)
+	}
+}
+
+// countKeys iterates a SCAN over all keys matching pattern
+func countKeys(c *redis.Client, pattern string) (int64, error) {
+	var total int64
+	err := scanKeys(c, pattern, func(keys []string) {
+		total += int64(len(keys))
+	})
+	if err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+// scanKeys iterates a SCAN over all keys matching pattern, passing each batch
+// of keys returned to fn
+func scanKeys(c *redis.Client, pattern string, fn func(keys []string)) error {
+	var cursor uint64
+	for {
+		keys, next, err := c.Scan(cursor, pattern, scanCount).Result()
+		if err != nil {
+			return err
+		}
+		fn(keys)
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
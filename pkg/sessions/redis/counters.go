@@ -0,0 +1,24 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+)
+
+// counterPrefix prefixes the keys of counters shared by instances of the
+// proxy
+const counterPrefix = "oauth2-proxy-counter:"
+
+var _ sessions.CounterStore = (*SessionStore)(nil)
+
+// IncrementCounter adds delta to a counter, resetting its TTL
+func (store *SessionStore) IncrementCounter(ctx context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	n, err := store.Client.IncrBy(ctx, counterPrefix+key, delta, ttl)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", sessions.ErrBackendUnavailable, err)
+	}
+	return n, nil
+}
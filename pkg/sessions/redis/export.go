@@ -0,0 +1,85 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/clock"
+)
+
+var _ sessions.Exporter = (*SessionStore)(nil)
+
+// exportPatterns returns the SCAN patterns matching the keys exported: the
+// session handles, machine tokens and WebAuthn credentials. Cached provider
+// lookups are left behind as they're refetched on demand.
+func (store *SessionStore) exportPatterns() []string {
+	return append(store.handlePatterns(),
+		escapePattern(machineTokenPrefix)+"*",
+		escapePattern(webAuthnCredentialPrefix)+"*",
+	)
+}
+
+// ExportRecords passes each session, machine token and WebAuthn credential
+// held in redis to fn, along with when it expires. Keys evicted during the
+// export are skipped.
+func (store *SessionStore) ExportRecords(ctx context.Context, fn func(*sessions.StoredRecord) error) error {
+	for _, pattern := range store.exportPatterns() {
+		keys, err := store.Client.Keys(ctx, pattern)
+		if err != nil {
+			return fmt.Errorf("%w: %v", sessions.ErrBackendUnavailable, err)
+		}
+		for _, key := range keys {
+			record, err := store.exportRecord(ctx, key)
+			if err == redis.Nil {
+				continue
+			} else if err != nil {
+				return fmt.Errorf("%w: %v", sessions.ErrBackendUnavailable, err)
+			}
+			if err := fn(record); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// exportRecord reads the key and its expiry, returning redis.Nil if it no
+// longer exists
+func (store *SessionStore) exportRecord(ctx context.Context, key string) (*sessions.StoredRecord, error) {
+	ttl, err := store.Client.TTL(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if ttl == -2 {
+		return nil, redis.Nil
+	}
+	value, err := store.Client.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	record := &sessions.StoredRecord{Key: key, Value: value}
+	if ttl > 0 {
+		record.ExpiresOn = clock.Now().Add(ttl)
+	}
+	return record, nil
+}
+
+// ImportRecord writes an exported record to redis, expiring it when it
+// would have expired in the store it was exported from
+func (store *SessionStore) ImportRecord(ctx context.Context, record *sessions.StoredRecord) error {
+	var expiration time.Duration
+	if !record.ExpiresOn.IsZero() {
+		expiration = time.Until(record.ExpiresOn)
+		if expiration <= 0 {
+			return fmt.Errorf("%w: %s", sessions.ErrExpired, record.Key)
+		}
+	}
+	if err := store.Client.Set(ctx, record.Key, record.Value, expiration); err != nil {
+		return fmt.Errorf("%w: %v", sessions.ErrBackendUnavailable, err)
+	}
+	return nil
+}
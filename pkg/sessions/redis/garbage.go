@@ -0,0 +1,58 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+)
+
+var _ sessions.GarbageCollector = (*SessionStore)(nil)
+
+// CollectGarbage scans redis for sessions held without an expiry, eg imported
+// from a store without one or written by hand, giving them the lifetime of a
+// session saved now, and deletes the entries of the indexes of users'
+// sessions referring to sessions that no longer exist. Redis expires every
+// other key by itself.
+func (store *SessionStore) CollectGarbage(ctx context.Context) (*sessions.GarbageReport, error) {
+	report := &sessions.GarbageReport{}
+	for _, pattern := range store.handlePatterns() {
+		keys, err := store.Client.Keys(ctx, pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", sessions.ErrBackendUnavailable, err)
+		}
+		for _, key := range keys {
+			ttl, err := store.Client.TTL(ctx, key)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v", sessions.ErrBackendUnavailable, err)
+			}
+			switch ttl {
+			case -2:
+				continue
+			case -1:
+				if err := store.Client.Expire(ctx, key, store.ttl()); err != nil {
+					return nil, fmt.Errorf("%w: %v", sessions.ErrBackendUnavailable, err)
+				}
+				report.Unbounded++
+			}
+			report.Sessions++
+		}
+	}
+
+	indexes, err := store.Client.Keys(ctx, escapePattern(userSessionsPrefix)+"*")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", sessions.ErrBackendUnavailable, err)
+	}
+	for _, key := range indexes {
+		fields, err := store.Client.HGetAll(ctx, key)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", sessions.ErrBackendUnavailable, err)
+		}
+		_, removed, err := store.pruneUserSessions(ctx, key, fields)
+		if err != nil {
+			return nil, err
+		}
+		report.Orphaned += int64(removed)
+	}
+	return report, nil
+}
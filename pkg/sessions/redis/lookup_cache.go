@@ -0,0 +1,35 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+)
+
+// lookupCachePrefix prefixes the keys of cached provider lookups. The keys
+// are hashed by the provider so don't reveal tokens or users.
+const lookupCachePrefix = "oauth2-proxy-lookup:"
+
+var _ sessions.LookupCache = (*SessionStore)(nil)
+
+// LoadLookup loads a cached provider lookup
+func (store *SessionStore) LoadLookup(ctx context.Context, key string) (string, error) {
+	value, err := store.Client.Get(ctx, lookupCachePrefix+key)
+	if err == redis.Nil {
+		return "", fmt.Errorf("%w: lookup %s", sessions.ErrNotFound, key)
+	} else if err != nil {
+		return "", fmt.Errorf("%w: %v", sessions.ErrBackendUnavailable, err)
+	}
+	return string(value), nil
+}
+
+// SaveLookup caches the result of a provider lookup for ttl
+func (store *SessionStore) SaveLookup(ctx context.Context, key, value string, ttl time.Duration) error {
+	if err := store.Client.Set(ctx, lookupCachePrefix+key, []byte(value), ttl); err != nil {
+		return fmt.Errorf("%w: %v", sessions.ErrBackendUnavailable, err)
+	}
+	return nil
+}
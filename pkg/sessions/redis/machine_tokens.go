@@ -0,0 +1,86 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+)
+
+// machineTokenPrefix prefixes the keys of machine tokens. The separator
+// differs from ticket handles so that tokens aren't counted as sessions.
+const machineTokenPrefix = "oauth2-proxy-machine-token:"
+
+var _ sessions.MachineTokenStore = (*SessionStore)(nil)
+
+// SaveMachineToken stores the token until it expires
+func (store *SessionStore) SaveMachineToken(ctx context.Context, token *sessions.MachineToken) error {
+	value, err := json.Marshal(token)
+	if err != nil {
+		return fmt.Errorf("error encoding machine token: %v", err)
+	}
+	expiration := time.Until(token.ExpiresOn)
+	if expiration <= 0 {
+		return fmt.Errorf("machine token %s has already expired", token.ID)
+	}
+	if err := store.Client.Set(ctx, machineTokenPrefix+token.ID, value, expiration); err != nil {
+		return fmt.Errorf("%w: %v", sessions.ErrBackendUnavailable, err)
+	}
+	return nil
+}
+
+// LoadMachineToken loads the token with the given ID
+func (store *SessionStore) LoadMachineToken(ctx context.Context, id string) (*sessions.MachineToken, error) {
+	value, err := store.Client.Get(ctx, machineTokenPrefix+id)
+	if err == redis.Nil {
+		return nil, fmt.Errorf("%w: machine token %s", sessions.ErrNotFound, id)
+	} else if err != nil {
+		return nil, fmt.Errorf("%w: %v", sessions.ErrBackendUnavailable, err)
+	}
+
+	token := &sessions.MachineToken{}
+	if err := json.Unmarshal(value, token); err != nil {
+		return nil, fmt.Errorf("error decoding machine token %s: %v", id, err)
+	}
+	return token, nil
+}
+
+// ListMachineTokens returns every token that has not expired or been
+// revoked, oldest first
+func (store *SessionStore) ListMachineTokens(ctx context.Context) ([]*sessions.MachineToken, error) {
+	keys, err := store.Client.Keys(ctx, escapePattern(machineTokenPrefix)+"*")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", sessions.ErrBackendUnavailable, err)
+	}
+
+	tokens := make([]*sessions.MachineToken, 0, len(keys))
+	for _, key := range keys {
+		token, err := store.LoadMachineToken(ctx, strings.TrimPrefix(key, machineTokenPrefix))
+		if err != nil {
+			// The token may have expired or been revoked since the scan
+			if errors.Is(err, sessions.ErrNotFound) {
+				continue
+			}
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].CreatedAt.Before(tokens[j].CreatedAt)
+	})
+	return tokens, nil
+}
+
+// RevokeMachineToken removes the token so that it can no longer be used
+func (store *SessionStore) RevokeMachineToken(ctx context.Context, id string) error {
+	if err := store.Client.Del(ctx, machineTokenPrefix+id); err != nil {
+		return fmt.Errorf("%w: %v", sessions.ErrBackendUnavailable, err)
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+)
+
+// statePrefix prefixes the keys of the OAuth states of sign ins in progress
+const statePrefix = "oauth2-proxy-state:"
+
+var _ sessions.StateStore = (*SessionStore)(nil)
+
+// SaveState keeps the OAuth state of a sign in for ttl
+func (store *SessionStore) SaveState(ctx context.Context, state string, ttl time.Duration) error {
+	if err := store.Client.Set(ctx, statePrefix+state, []byte{1}, ttl); err != nil {
+		return fmt.Errorf("%w: %v", sessions.ErrBackendUnavailable, err)
+	}
+	return nil
+}
+
+// RedeemState removes the OAuth state of a sign in, failing if it has
+// already been removed
+func (store *SessionStore) RedeemState(ctx context.Context, state string) error {
+	ok, err := store.Client.Take(ctx, statePrefix+state)
+	if err != nil {
+		return fmt.Errorf("%w: %v", sessions.ErrBackendUnavailable, err)
+	}
+	if !ok {
+		return fmt.Errorf("%w: oauth state", sessions.ErrNotFound)
+	}
+	return nil
+}
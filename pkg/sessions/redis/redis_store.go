@@ -18,11 +18,15 @@ import (
 	"github.com/go-redis/redis/v7"
 	"github.com/oauth2-proxy/oauth2-proxy/pkg/apis/options"
 	"github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/clock"
 	"github.com/oauth2-proxy/oauth2-proxy/pkg/cookies"
 	"github.com/oauth2-proxy/oauth2-proxy/pkg/encryption"
 	"github.com/oauth2-proxy/oauth2-proxy/pkg/logger"
 )
 
+// ticketIDLength is the number of random bytes in a ticket ID
+const ticketIDLength = 16
+
 // TicketData is a structure representing the ticket used in server session storage
 type TicketData struct {
 	TicketID string
@@ -35,8 +39,24 @@ type SessionStore struct {
 	CookieCipher  *encryption.Cipher
 	CookieOptions *options.CookieOptions
 	Client        Client
+	IdleTimeout   time.Duration
+
+	// MaxUserSessions limits the sessions of each user when positive, with
+	// the UserSessionLimitAction deciding which is dropped
+	MaxUserSessions        int
+	UserSessionLimitAction string
+	IndexUsers             bool
+
+	// cache holds recently loaded sessions in memory when the session cache
+	// is enabled, invalidated across instances by instanceID's publications
+	cache        *sessionCache
+	instanceID   string
+	stopWatching context.CancelFunc
 }
 
+var _ sessions.Pinger = (*SessionStore)(nil)
+var _ sessions.Counter = (*SessionStore)(nil)
+
 // NewRedisSessionStore initialises a new instance of the SessionStore from
 // the configuration given
 func NewRedisSessionStore(opts *options.SessionOptions, cookieOpts *options.CookieOptions) (sessions.SessionStore, error) {
@@ -49,9 +69,23 @@ func NewRedisSessionStore(opts *options.SessionOptions, cookieOpts *options.Cook
 		Client:        client,
 		CookieCipher:  opts.Cipher,
 		CookieOptions: cookieOpts,
+		IdleTimeout:   opts.IdleTimeout,
+
+		MaxUserSessions:        opts.MaxUserSessions,
+		UserSessionLimitAction: opts.UserSessionLimitAction,
+		IndexUsers:             opts.IndexUsers || opts.MaxUserSessions > 0,
+	}
+	if opts.CacheTTL > 0 {
+		rs.instanceID, err = newInstanceID()
+		if err != nil {
+			return nil, fmt.Errorf("error creating session cache instance ID: %v", err)
+		}
+		rs.cache = newSessionCache(opts.CacheSize, opts.CacheTTL)
+		ctx, cancel := context.WithCancel(context.Background())
+		rs.stopWatching = cancel
+		go rs.watchInvalidations(ctx)
 	}
 	return rs, nil
-
 }
 
 func newRedisCmdable(opts options.RedisStoreOptions) (Client, error) {
@@ -110,26 +144,40 @@ func newRedisCmdable(opts options.RedisStoreOptions) (Client, error) {
 
 // Save takes a sessions.SessionState and stores the information from it
 // to redies, and adds a new ticket cookie on the HTTP response writer
-func (store *SessionStore) Save(rw http.ResponseWriter, req *http.Request, s *sessions.SessionState) error {
+func (store *SessionStore) Save(ctx context.Context, rw http.ResponseWriter, req *http.Request, s *sessions.SessionState) error {
 	if s.CreatedAt.IsZero() {
-		s.CreatedAt = time.Now()
+		s.CreatedAt = clock.Now()
 	}
 
 	// Old sessions that we are refreshing would have a request cookie
-	// New sessions don't, so we ignore the error. storeValue will check requestCookie
-	requestCookie, _ := req.Cookie(store.CookieOptions.Name)
+	// New sessions don't, so we ignore the error. getTicket will check requestCookie
+	name := cookies.GetCookieName(req, store.CookieOptions)
+	requestCookie, _ := req.Cookie(name)
 	value, err := s.EncodeSessionState(store.CookieCipher)
 	if err != nil {
 		return err
 	}
-	ctx := req.Context()
-	ticketString, err := store.storeValue(ctx, value, store.CookieOptions.Expire, requestCookie)
+	ticket, err := store.getTicket(name, requestCookie)
+	if err != nil {
+		return fmt.Errorf("error getting ticket: %v", err)
+	}
+	if store.IndexUsers {
+		if err := store.indexUserSession(ctx, req, s, ticket.asHandle(name)); err != nil {
+			return err
+		}
+	}
+	ticketString, err := store.storeValue(ctx, name, value, store.ttl(), ticket)
+	// The ticket's secret is only needed to encrypt the session and encode
+	// the cookie's value
+	encryption.Zero(ticket.Secret)
 	if err != nil {
 		return err
 	}
+	store.invalidate(ctx, ticket.asHandle(name))
 
 	ticketCookie := store.makeCookie(
 		req,
+		name,
 		ticketString,
 		store.CookieOptions.Expire,
 		s.CreatedAt,
@@ -141,65 +189,99 @@ func (store *SessionStore) Save(rw http.ResponseWriter, req *http.Request, s *se
 
 // Load reads sessions.SessionState information from a ticket
 // cookie within the HTTP request object
-func (store *SessionStore) Load(req *http.Request) (*sessions.SessionState, error) {
-	requestCookie, err := req.Cookie(store.CookieOptions.Name)
+func (store *SessionStore) Load(ctx context.Context, req *http.Request) (*sessions.SessionState, error) {
+	name := cookies.GetCookieName(req, store.CookieOptions)
+	requestCookie, err := req.Cookie(name)
 	if err != nil {
-		return nil, fmt.Errorf("error loading session: %s", err)
+		return nil, fmt.Errorf("error loading session: %w: %v", sessions.ErrNotFound, err)
 	}
 
 	val, _, ok := encryption.Validate(requestCookie, store.CookieOptions.Secret, store.CookieOptions.Expire)
 	if !ok {
-		return nil, fmt.Errorf("cookie signature not valid")
+		return nil, encryption.ErrInvalidSignature
 	}
-	ctx := req.Context()
-	session, err := store.loadSessionFromString(ctx, val)
+	session, err := store.loadSessionFromString(ctx, name, val)
 	if err != nil {
-		return nil, fmt.Errorf("error loading session: %s", err)
+		return nil, fmt.Errorf("error loading session: %w", err)
 	}
 	return session, nil
 }
 
 // loadSessionFromString loads the session based on the ticket value
-func (store *SessionStore) loadSessionFromString(ctx context.Context, value string) (*sessions.SessionState, error) {
-	ticket, err := decodeTicket(store.CookieOptions.Name, value)
+func (store *SessionStore) loadSessionFromString(ctx context.Context, name string, value string) (*sessions.SessionState, error) {
+	ticket, err := decodeTicket(name, value)
 	if err != nil {
 		return nil, err
 	}
+	defer encryption.Zero(ticket.Secret)
 
-	resultBytes, err := store.Client.Get(ctx, ticket.asHandle(store.CookieOptions.Name))
-	if err != nil {
-		return nil, err
+	handle := ticket.asHandle(name)
+	if store.cache == nil {
+		return store.loadSession(ctx, handle, ticket.Secret)
+	}
+	if session, ok := store.cache.get(handle, ticket.Secret); ok {
+		return session, nil
 	}
+	// The session is only cached if it isn't invalidated while it's loaded,
+	// or a session saved or cleared meanwhile would be replaced by the stale
+	// one until the cache TTL passes
+	generation := store.cache.beginLoad(handle)
+	session, err := store.loadSession(ctx, handle, ticket.Secret)
+	store.cache.endLoad(handle, generation, ticket.Secret, session)
+	return session, err
+}
 
-	block, err := aes.NewCipher(ticket.Secret)
+// loadSession loads the session at handle from Redis, decrypting it with the
+// ticket's secret
+func (store *SessionStore) loadSession(ctx context.Context, handle string, secret []byte) (*sessions.SessionState, error) {
+	resultBytes, err := store.Client.Get(ctx, handle)
+	if err == redis.Nil {
+		// The ticket is valid but the session has since been evicted
+		return nil, sessions.ErrExpired
+	} else if err != nil {
+		return nil, fmt.Errorf("%w: %v", sessions.ErrBackendUnavailable, err)
+	}
+
+	block, err := aes.NewCipher(secret)
 	if err != nil {
 		return nil, err
 	}
 	// Use secret as the IV too, because each entry has it's own key
-	stream := cipher.NewCFBDecrypter(block, ticket.Secret)
+	stream := cipher.NewCFBDecrypter(block, secret)
 	stream.XORKeyStream(resultBytes, resultBytes)
 
 	session, err := sessions.DecodeSessionState(string(resultBytes), store.CookieCipher)
+	encryption.Zero(resultBytes)
 	if err != nil {
 		return nil, err
 	}
 	return session, nil
 }
 
+// Close stops watching for the invalidations of cached sessions
+func (store *SessionStore) Close() error {
+	if store.stopWatching != nil {
+		store.stopWatching()
+	}
+	return nil
+}
+
 // Clear clears any saved session information for a given ticket cookie
 // from redis, and then clears the session
-func (store *SessionStore) Clear(rw http.ResponseWriter, req *http.Request) error {
+func (store *SessionStore) Clear(ctx context.Context, rw http.ResponseWriter, req *http.Request) error {
 	// We go ahead and clear the cookie first, always.
+	name := cookies.GetCookieName(req, store.CookieOptions)
 	clearCookie := store.makeCookie(
 		req,
+		name,
 		"",
 		time.Hour*-1,
-		time.Now(),
+		clock.Now(),
 	)
 	http.SetCookie(rw, clearCookie)
 
 	// If there was an existing cookie we should clear the session in redis
-	requestCookie, err := req.Cookie(store.CookieOptions.Name)
+	requestCookie, err := req.Cookie(name)
 	if err != nil && err == http.ErrNoCookie {
 		// No existing cookie so can't clear redis
 		return nil
@@ -209,30 +291,95 @@ func (store *SessionStore) Clear(rw http.ResponseWriter, req *http.Request) erro
 
 	val, _, ok := encryption.Validate(requestCookie, store.CookieOptions.Secret, store.CookieOptions.Expire)
 	if !ok {
-		return fmt.Errorf("cookie signature not valid")
+		return encryption.ErrInvalidSignature
 	}
 
 	// We only return an error if we had an issue with redis
 	// If there's an issue decoding the ticket, ignore it
-	ticket, _ := decodeTicket(store.CookieOptions.Name, val)
+	ticket, _ := decodeTicket(name, val)
 	if ticket != nil {
-		ctx := req.Context()
-		err := store.Client.Del(ctx, ticket.asHandle(store.CookieOptions.Name))
+		err := store.Client.Del(ctx, ticket.asHandle(name))
 		if err != nil {
-			return fmt.Errorf("error clearing cookie from redis: %s", err)
+			return fmt.Errorf("error clearing cookie from redis: %w: %v", sessions.ErrBackendUnavailable, err)
 		}
+		store.invalidate(ctx, ticket.asHandle(name))
 	}
 	return nil
 }
 
+// Ping checks that the redis backend is reachable
+func (store *SessionStore) Ping(ctx context.Context) error {
+	if err := store.Client.Ping(ctx); err != nil {
+		return fmt.Errorf("%w: %v", sessions.ErrBackendUnavailable, err)
+	}
+	return nil
+}
+
+// CountSessions approximates the number of sessions held in redis by
+// scanning for keys in the form of a ticket handle. Keys may be counted twice
+// if they are written while the scan is in progress.
+func (store *SessionStore) CountSessions(ctx context.Context) (int64, error) {
+	var total int64
+	for _, pattern := range store.handlePatterns() {
+		n, err := store.Client.Count(ctx, pattern)
+		if err != nil {
+			return 0, fmt.Errorf("%w: %v", sessions.ErrBackendUnavailable, err)
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// handlePatterns returns the SCAN patterns matching the handles of every
+// cookie name this store may use. Scoped cookie names share the configured
+// name as a prefix, host specific names are matched separately unless they
+// share it too.
+func (store *SessionStore) handlePatterns() []string {
+	ticketID := strings.Repeat("[0-9a-f]", hex.EncodedLen(ticketIDLength))
+	name := store.CookieOptions.Name
+	patterns := []string{escapePattern(name) + "*-" + ticketID}
+	for _, hostName := range store.CookieOptions.HostNames {
+		parts := strings.SplitN(hostName, "=", 2)
+		if len(parts) != 2 || strings.HasPrefix(parts[1], name) {
+			continue
+		}
+		patterns = append(patterns, escapePattern(parts[1])+"-"+ticketID)
+	}
+	return patterns
+}
+
+// escapePattern escapes the characters with a special meaning in redis glob
+// style patterns
+func escapePattern(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// ttl returns how long sessions are kept in Redis: until the cookie expires,
+// or until they've been idle for the idle timeout if that is sooner, as each
+// use of the session saves it again
+func (store *SessionStore) ttl() time.Duration {
+	if store.IdleTimeout > 0 && store.IdleTimeout < store.CookieOptions.Expire {
+		return store.IdleTimeout
+	}
+	return store.CookieOptions.Expire
+}
+
 // makeCookie makes a cookie, signing the value if present
-func (store *SessionStore) makeCookie(req *http.Request, value string, expires time.Duration, now time.Time) *http.Cookie {
+func (store *SessionStore) makeCookie(req *http.Request, name string, value string, expires time.Duration, now time.Time) *http.Cookie {
 	if value != "" {
-		value = encryption.SignedValue(store.CookieOptions.Secret, store.CookieOptions.Name, value, now)
+		value = encryption.SignedValue(store.CookieOptions.Secret, name, value, now)
 	}
 	return cookies.MakeCookieFromOptions(
 		req,
-		store.CookieOptions.Name,
+		name,
 		value,
 		store.CookieOptions,
 		expires,
@@ -240,12 +387,7 @@ func (store *SessionStore) makeCookie(req *http.Request, value string, expires t
 	)
 }
 
-func (store *SessionStore) storeValue(ctx context.Context, value string, expiration time.Duration, requestCookie *http.Cookie) (string, error) {
-	ticket, err := store.getTicket(requestCookie)
-	if err != nil {
-		return "", fmt.Errorf("error getting ticket: %v", err)
-	}
-
+func (store *SessionStore) storeValue(ctx context.Context, name string, value string, expiration time.Duration, ticket *TicketData) (string, error) {
 	ciphertext := make([]byte, len(value))
 	block, err := aes.NewCipher(ticket.Secret)
 	if err != nil {
@@ -256,17 +398,17 @@ func (store *SessionStore) storeValue(ctx context.Context, value string, expirat
 	stream := cipher.NewCFBEncrypter(block, ticket.Secret)
 	stream.XORKeyStream(ciphertext, []byte(value))
 
-	handle := ticket.asHandle(store.CookieOptions.Name)
+	handle := ticket.asHandle(name)
 	err = store.Client.Set(ctx, handle, ciphertext, expiration)
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("%w: %v", sessions.ErrBackendUnavailable, err)
 	}
-	return ticket.encodeTicket(store.CookieOptions.Name), nil
+	return ticket.encodeTicket(name), nil
 }
 
 // getTicket retrieves an existing ticket from the cookie if present,
 // or creates a new ticket
-func (store *SessionStore) getTicket(requestCookie *http.Cookie) (*TicketData, error) {
+func (store *SessionStore) getTicket(name string, requestCookie *http.Cookie) (*TicketData, error) {
 	if requestCookie == nil {
 		return newTicket()
 	}
@@ -279,7 +421,7 @@ func (store *SessionStore) getTicket(requestCookie *http.Cookie) (*TicketData, e
 	}
 
 	// Valid cookie, decode the ticket
-	ticket, err := decodeTicket(store.CookieOptions.Name, val)
+	ticket, err := decodeTicket(name, val)
 	if err != nil {
 		// If we can't decode the ticket we have to create a new one
 		return newTicket()
@@ -288,7 +430,7 @@ func (store *SessionStore) getTicket(requestCookie *http.Cookie) (*TicketData, e
 }
 
 func newTicket() (*TicketData, error) {
-	rawID := make([]byte, 16)
+	rawID := make([]byte, ticketIDLength)
 	if _, err := io.ReadFull(rand.Reader, rawID); err != nil {
 		return nil, fmt.Errorf("failed to create new ticket ID %s", err)
 	}
@@ -0,0 +1,227 @@
+package redis
+
+import (
+	"container/list"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/clock"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/encryption"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/logger"
+)
+
+// sessionInvalidationsChannel is the channel each instance of the proxy
+// publishes the handles of the sessions it saves or removes on, so that the
+// other instances drop them from their session caches
+const sessionInvalidationsChannel = "oauth2-proxy-session-invalidations"
+
+// invalidationRetryInterval is how long to wait before subscribing to
+// invalidations again when the subscription fails
+const invalidationRetryInterval = 5 * time.Second
+
+var (
+	sessionCacheHits   = expvar.NewInt("sessions_cache_hits")
+	sessionCacheMisses = expvar.NewInt("sessions_cache_misses")
+)
+
+type cachedSession struct {
+	handle     string
+	secretHash [sha256.Size]byte
+	session    *sessions.SessionState
+	expiresOn  time.Time
+}
+
+// sessionCache is an LRU cache of the sessions loaded from Redis, keyed by
+// ticket handle. Entries keep a hash of the ticket's secret so that a
+// session is only served from the cache to requests with the whole ticket,
+// as it is from Redis.
+type sessionCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	entries map[string]*list.Element
+	lru     *list.List
+	// loads tracks the handles with loads from Redis in flight, so that a
+	// session invalidated while it's loaded isn't cached
+	loads map[string]*pendingLoad
+}
+
+// pendingLoad counts the loads of a handle in flight, and the invalidations
+// of the handle since the first of them began
+type pendingLoad struct {
+	count      int
+	generation uint64
+}
+
+func newSessionCache(size int, ttl time.Duration) *sessionCache {
+	return &sessionCache{
+		size:    size,
+		ttl:     ttl,
+		entries: map[string]*list.Element{},
+		lru:     list.New(),
+		loads:   map[string]*pendingLoad{},
+	}
+}
+
+// get returns a copy of the cached session for the ticket, if any
+func (c *sessionCache) get(handle string, secret []byte) (*sessions.SessionState, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[handle]
+	if !ok {
+		sessionCacheMisses.Add(1)
+		return nil, false
+	}
+	entry := elem.Value.(*cachedSession)
+	secretHash := sha256.Sum256(secret)
+	if clock.Now().After(entry.expiresOn) || !encryption.SecureCompareBytes(secretHash[:], entry.secretHash[:]) {
+		c.removeElement(elem)
+		sessionCacheMisses.Add(1)
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	sessionCacheHits.Add(1)
+	return copySession(entry.session), true
+}
+
+// beginLoad records that the session at handle is being loaded from Redis,
+// returning its generation to pass to endLoad
+func (c *sessionCache) beginLoad(handle string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	load, ok := c.loads[handle]
+	if !ok {
+		load = &pendingLoad{}
+		c.loads[handle] = load
+	}
+	load.count++
+	return load.generation
+}
+
+// endLoad caches the session loaded with the ticket, if any, unless the
+// handle was invalidated since its load began
+func (c *sessionCache) endLoad(handle string, generation uint64, secret []byte, s *sessions.SessionState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	load := c.loads[handle]
+	load.count--
+	if load.count == 0 {
+		delete(c.loads, handle)
+	}
+	if s != nil && load.generation == generation {
+		c.set(handle, secret, s)
+	}
+}
+
+// set caches a copy of the session loaded with the ticket, evicting the least
+// recently used session if the cache is full. The lock must be held.
+func (c *sessionCache) set(handle string, secret []byte, s *sessions.SessionState) {
+	if elem, ok := c.entries[handle]; ok {
+		c.removeElement(elem)
+	}
+	for c.lru.Len() >= c.size {
+		c.removeElement(c.lru.Back())
+	}
+	c.entries[handle] = c.lru.PushFront(&cachedSession{
+		handle:     handle,
+		secretHash: sha256.Sum256(secret),
+		session:    copySession(s),
+		expiresOn:  clock.Now().Add(c.ttl),
+	})
+}
+
+// remove drops the session at handle from the cache, and stops the loads of
+// it in flight from caching it
+func (c *sessionCache) remove(handle string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if load, ok := c.loads[handle]; ok {
+		load.generation++
+	}
+	if elem, ok := c.entries[handle]; ok {
+		c.removeElement(elem)
+	}
+}
+
+// purge drops every session from the cache
+func (c *sessionCache) purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, load := range c.loads {
+		load.generation++
+	}
+	c.entries = map[string]*list.Element{}
+	c.lru.Init()
+}
+
+func (c *sessionCache) removeElement(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*cachedSession).handle)
+}
+
+// copySession copies a session so that callers changing the session they
+// were served don't change the cached session
+func copySession(s *sessions.SessionState) *sessions.SessionState {
+	c := *s
+	c.Groups = append([]string(nil), s.Groups...)
+	c.AMR = append([]string(nil), s.AMR...)
+	return &c
+}
+
+// newInstanceID identifies this instance of the proxy in the invalidations it
+// publishes, so that it can ignore its own
+func newInstanceID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// invalidate drops the sessions at the handles from this instance's session
+// cache and publishes them for the other instances to drop theirs. Other
+// instances serve the sessions from their caches until the cache TTL passes
+// if the invalidations can't be published.
+func (store *SessionStore) invalidate(ctx context.Context, handles ...string) {
+	if store.cache == nil {
+		return
+	}
+	for _, handle := range handles {
+		store.cache.remove(handle)
+		if err := store.Client.Publish(ctx, sessionInvalidationsChannel, store.instanceID+" "+handle); err != nil {
+			logger.Printf("Error publishing session invalidation: %v", err)
+		}
+	}
+}
+
+// watchInvalidations drops the sessions other instances publish invalidations
+// of from the session cache until ctx is done. Invalidations may be missed
+// while the subscription is down, so the cache is purged whenever it fails.
+func (store *SessionStore) watchInvalidations(ctx context.Context) {
+	for {
+		err := store.Client.Subscribe(ctx, sessionInvalidationsChannel, func(message string) {
+			parts := strings.SplitN(message, " ", 2)
+			if len(parts) != 2 || parts[0] == store.instanceID {
+				return
+			}
+			store.cache.remove(parts[1])
+		})
+		store.cache.purge()
+		if ctx.Err() != nil {
+			return
+		}
+		logger.Printf("Error receiving session invalidations, retrying in %s: %v", invalidationRetryInterval, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(invalidationRetryInterval):
+		}
+	}
+}
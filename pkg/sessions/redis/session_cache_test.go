@@ -0,0 +1,143 @@
+package redis
+
+import (
+	"context"
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/clock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionCache(t *testing.T) {
+	now := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	mock := clock.NewMock(now)
+	clock.Set(mock)
+	defer clock.Reset()
+
+	c := newSessionCache(2, time.Minute)
+	c.set("a", []byte("secret-a"), &sessions.SessionState{Email: "a@example.com", Groups: []string{"admins"}})
+	c.set("b", []byte("secret-b"), &sessions.SessionState{Email: "b@example.com"})
+
+	s, ok := c.get("a", []byte("secret-a"))
+	require.True(t, ok)
+	assert.Equal(t, "a@example.com", s.Email)
+
+	// Sessions served are copies of the cached session
+	s.Groups[0] = "changed"
+	s, _ = c.get("a", []byte("secret-a"))
+	assert.Equal(t, []string{"admins"}, s.Groups)
+
+	// Only requests with the ticket's secret are served the session
+	_, ok = c.get("b", []byte("wrong"))
+	assert.False(t, ok)
+	c.set("b", []byte("secret-b"), &sessions.SessionState{Email: "b@example.com"})
+
+	// The least recently used session is evicted
+	_, ok = c.get("a", []byte("secret-a"))
+	assert.True(t, ok)
+	c.set("c", []byte("secret-c"), &sessions.SessionState{Email: "c@example.com"})
+	_, ok = c.get("b", []byte("secret-b"))
+	assert.False(t, ok)
+	_, ok = c.get("a", []byte("secret-a"))
+	assert.True(t, ok)
+
+	mock.Add(time.Minute + time.Second)
+	_, ok = c.get("a", []byte("secret-a"))
+	assert.False(t, ok)
+
+	c.set("a", []byte("secret-a"), &sessions.SessionState{Email: "a@example.com"})
+	c.remove("a")
+	_, ok = c.get("a", []byte("secret-a"))
+	assert.False(t, ok)
+}
+
+func TestSessionCacheInvalidatedLoad(t *testing.T) {
+	c := newSessionCache(10, time.Minute)
+	secret := []byte("secret-a")
+	stale := &sessions.SessionState{Email: "stale@example.com"}
+
+	// the session is saved elsewhere while it's loaded: the stale session
+	// loaded isn't cached
+	generation := c.beginLoad("a")
+	c.remove("a")
+	c.endLoad("a", generation, secret, stale)
+	_, ok := c.get("a", secret)
+	assert.False(t, ok)
+	assert.Empty(t, c.loads)
+
+	generation = c.beginLoad("a")
+	c.purge()
+	c.endLoad("a", generation, secret, stale)
+	_, ok = c.get("a", secret)
+	assert.False(t, ok)
+
+	generation = c.beginLoad("a")
+	c.endLoad("a", generation, secret, &sessions.SessionState{Email: "a@example.com"})
+	s, ok := c.get("a", secret)
+	require.True(t, ok)
+	assert.Equal(t, "a@example.com", s.Email)
+}
+
+func TestSessionCacheInvalidation(t *testing.T) {
+	mr, err := miniredis.Run()
+	require.NoError(t, err)
+	defer mr.Close()
+
+	cookieOpts := &options.CookieOptions{
+		Name:   "_oauth2_proxy",
+		Secret: "0123456789abcdef",
+		Expire: time.Hour,
+	}
+	opts := &options.SessionOptions{
+		Redis:     options.RedisStoreOptions{ConnectionURL: "redis://" + mr.Addr()},
+		CacheTTL:  time.Minute,
+		CacheSize: 10,
+	}
+	// Two instances of the proxy sharing a Redis server
+	first, err := NewRedisSessionStore(opts, cookieOpts)
+	require.NoError(t, err)
+	second, err := NewRedisSessionStore(opts, cookieOpts)
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		return mr.PubSubNumSub(sessionInvalidationsChannel)[sessionInvalidationsChannel] == 2
+	}, time.Second, 10*time.Millisecond)
+
+	ctx := context.Background()
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	require.NoError(t, first.Save(ctx, rw, req, &sessions.SessionState{Email: "user@example.com"}))
+	req = httptest.NewRequest("GET", "/", nil)
+	for _, c := range rw.Result().Cookies() {
+		req.AddCookie(c)
+	}
+
+	s, err := second.Load(ctx, req)
+	require.NoError(t, err)
+	assert.Equal(t, "user@example.com", s.Email)
+
+	// Loaded again from the cache rather than Redis
+	mr.FlushAll()
+	s, err = second.Load(ctx, req)
+	require.NoError(t, err)
+	assert.Equal(t, "user@example.com", s.Email)
+
+	// Clearing the session on one instance drops it from the other's cache
+	require.NoError(t, first.Clear(ctx, httptest.NewRecorder(), req))
+	assert.Eventually(t, func() bool {
+		_, err := second.Load(ctx, req)
+		return err != nil
+	}, time.Second, 10*time.Millisecond)
+	// Closing the stores stops them watching for invalidations
+	require.NoError(t, first.(io.Closer).Close())
+	require.NoError(t, second.(io.Closer).Close())
+	assert.Eventually(t, func() bool {
+		return mr.PubSubNumSub(sessionInvalidationsChannel)[sessionInvalidationsChannel] == 0
+	}, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,331 @@
+package redis
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/clock"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/cookies"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/encryption"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/logger"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/middleware"
+)
+
+// userSessionsPrefix prefixes the keys of the index of each user's sessions,
+// a hash of the handles of their sessions to their entries. The separator
+// differs from ticket handles so that they aren't counted as sessions.
+const userSessionsPrefix = "oauth2-proxy-user-index:"
+
+// legacyUserSessionsPrefix prefixes the keys of the indexes of older
+// versions, which kept each user's sessions in a single JSON list
+const legacyUserSessionsPrefix = "oauth2-proxy-user-sessions:"
+
+// maxUserAgentLength limits the length of the user agents kept in the index
+const maxUserAgentLength = 256
+
+var _ sessions.UserSessionStore = (*SessionStore)(nil)
+
+// userSession is an entry in the index of a user's sessions
+type userSession struct {
+	Handle    string    `json:"handle"`
+	CreatedAt time.Time `json:"created_at"`
+	LastSeen  time.Time `json:"last_seen"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+}
+
+// id identifies the session to its user without revealing the handle
+func (entry *userSession) id() string {
+	sum := sha256.Sum256([]byte(entry.Handle))
+	return hex.EncodeToString(sum[:8])
+}
+
+// userSessionsKey returns the key of the index of the user's sessions. The
+// user is hashed so that keys don't reveal who is signed in.
+func userSessionsKey(s *sessions.SessionState) (string, bool) {
+	user := s.User
+	if user == "" {
+		user = s.Email
+	}
+	if user == "" {
+		return "", false
+	}
+	sum := sha256.Sum256([]byte(user))
+	return userSessionsPrefix + hex.EncodeToString(sum[:]), true
+}
+
+// indexUserSession adds the session about to be saved at the handle to the
+// index of its user's sessions, or updates when it was last seen and from
+// where. When the sessions of each user are limited, the user's oldest
+// sessions are evicted, or ErrSessionLimit is returned, if they already have
+// as many as they're allowed. Each session is its own field of the index, so
+// concurrent sign ins by the same user are all indexed, though they may
+// briefly exceed the limit.
+func (store *SessionStore) indexUserSession(ctx context.Context, req *http.Request, s *sessions.SessionState, handle string) error {
+	key, ok := userSessionsKey(s)
+	if !ok {
+		return nil
+	}
+	index, err := store.loadUserSessions(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	entry := userSession{
+		Handle:    handle,
+		CreatedAt: s.CreatedAt,
+		LastSeen:  clock.Now(),
+		IP:        clientIP(req),
+		UserAgent: req.UserAgent(),
+	}
+	if len(entry.UserAgent) > maxUserAgentLength {
+		entry.UserAgent = entry.UserAgent[:maxUserAgentLength]
+	}
+
+	for _, indexed := range index {
+		if indexed.Handle == handle {
+			entry.CreatedAt = indexed.CreatedAt
+			return store.saveUserSession(ctx, key, entry)
+		}
+	}
+	if err := store.limitUserSessions(ctx, key, index, handle); err != nil {
+		return err
+	}
+	return store.saveUserSession(ctx, key, entry)
+}
+
+// limitUserSessions makes room for a new session in the index at key
+func (store *SessionStore) limitUserSessions(ctx context.Context, key string, index []userSession, handle string) error {
+	if store.MaxUserSessions <= 0 || len(index) < store.MaxUserSessions {
+		return nil
+	}
+	// Sessions saved before the limit was set are indexed as they're saved
+	// again rather than rejected
+	exists, err := store.handleExists(ctx, handle)
+	if err != nil || exists {
+		return err
+	}
+
+	if store.UserSessionLimitAction == options.RejectUserSessionLimitAction {
+		return fmt.Errorf("%w: %d sessions", sessions.ErrSessionLimit, len(index))
+	}
+	sort.Slice(index, func(i, j int) bool {
+		return index[i].CreatedAt.Before(index[j].CreatedAt)
+	})
+	evict := len(index) - store.MaxUserSessions + 1
+	var evicted []string
+	for _, entry := range index[:evict] {
+		if err := store.Client.Del(ctx, entry.Handle); err != nil {
+			return fmt.Errorf("%w: %v", sessions.ErrBackendUnavailable, err)
+		}
+		store.invalidate(ctx, entry.Handle)
+		evicted = append(evicted, entry.Handle)
+	}
+	if err := store.Client.HDel(ctx, key, evicted...); err != nil {
+		return fmt.Errorf("%w: %v", sessions.ErrBackendUnavailable, err)
+	}
+	logger.Printf("Evicted %d oldest session(s) of a user over the limit of %d", evict, store.MaxUserSessions)
+	return nil
+}
+
+// ListUserSessions lists the active sessions of the session's user, marking
+// the session of the request as current
+func (store *SessionStore) ListUserSessions(ctx context.Context, req *http.Request, s *sessions.SessionState) ([]*sessions.UserSession, error) {
+	list := []*sessions.UserSession{}
+	key, ok := userSessionsKey(s)
+	if !ok {
+		return list, nil
+	}
+	index, err := store.loadUserSessions(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	current := store.requestHandle(req)
+	for _, entry := range index {
+		list = append(list, &sessions.UserSession{
+			ID:        entry.id(),
+			CreatedAt: entry.CreatedAt,
+			LastSeen:  entry.LastSeen,
+			IP:        entry.IP,
+			UserAgent: entry.UserAgent,
+			Current:   entry.Handle == current,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].LastSeen.After(list[j].LastSeen)
+	})
+	return list, nil
+}
+
+// RevokeUserSession removes one of the session's user's sessions
+func (store *SessionStore) RevokeUserSession(ctx context.Context, s *sessions.SessionState, id string) error {
+	key, ok := userSessionsKey(s)
+	if !ok {
+		return fmt.Errorf("%w: user session %s", sessions.ErrNotFound, id)
+	}
+	index, err := store.loadUserSessions(ctx, key)
+	if err != nil {
+		return err
+	}
+	for _, entry := range index {
+		if entry.id() != id {
+			continue
+		}
+		if err := store.Client.Del(ctx, entry.Handle); err != nil {
+			return fmt.Errorf("%w: %v", sessions.ErrBackendUnavailable, err)
+		}
+		store.invalidate(ctx, entry.Handle)
+		if err := store.Client.HDel(ctx, key, entry.Handle); err != nil {
+			return fmt.Errorf("%w: %v", sessions.ErrBackendUnavailable, err)
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: user session %s", sessions.ErrNotFound, id)
+}
+
+// loadUserSessions loads the index of a user's sessions, removing sessions
+// that have since expired or been cleared
+func (store *SessionStore) loadUserSessions(ctx context.Context, key string) ([]userSession, error) {
+	fields, err := store.Client.HGetAll(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", sessions.ErrBackendUnavailable, err)
+	}
+	if len(fields) == 0 {
+		return store.migrateUserSessions(ctx, key)
+	}
+	index, _, err := store.pruneUserSessions(ctx, key, fields)
+	return index, err
+}
+
+// pruneUserSessions decodes the fields of the index at key, deleting those of
+// sessions that have since expired or been cleared, and returns the sessions
+// remaining along with how many were deleted
+func (store *SessionStore) pruneUserSessions(ctx context.Context, key string, fields map[string]string) ([]userSession, int, error) {
+	var index []userSession
+	var removed []string
+	for handle, value := range fields {
+		var entry userSession
+		if err := json.Unmarshal([]byte(value), &entry); err != nil {
+			logger.Printf("Error decoding a user session, removing it from the index: %v", err)
+			removed = append(removed, handle)
+			continue
+		}
+		exists, err := store.handleExists(ctx, handle)
+		if err != nil {
+			return nil, 0, err
+		}
+		if !exists {
+			removed = append(removed, handle)
+			continue
+		}
+		entry.Handle = handle
+		index = append(index, entry)
+	}
+	if len(removed) > 0 {
+		if err := store.Client.HDel(ctx, key, removed...); err != nil {
+			return nil, 0, fmt.Errorf("%w: %v", sessions.ErrBackendUnavailable, err)
+		}
+	}
+	return index, len(removed), nil
+}
+
+// migrateUserSessions moves the sessions of an index in the format of older
+// versions, if the user has one, into the index at key
+func (store *SessionStore) migrateUserSessions(ctx context.Context, key string) ([]userSession, error) {
+	legacyKey := legacyUserSessionsPrefix + strings.TrimPrefix(key, userSessionsPrefix)
+	value, err := store.Client.Get(ctx, legacyKey)
+	if err == redis.Nil {
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("%w: %v", sessions.ErrBackendUnavailable, err)
+	}
+
+	var legacy []userSession
+	if err := json.Unmarshal(value, &legacy); err != nil {
+		logger.Printf("Error decoding user sessions, resetting the index: %v", err)
+	}
+	var index []userSession
+	for _, entry := range legacy {
+		exists, err := store.handleExists(ctx, entry.Handle)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			continue
+		}
+		if err := store.saveUserSession(ctx, key, entry); err != nil {
+			return nil, err
+		}
+		index = append(index, entry)
+	}
+	if err := store.Client.Del(ctx, legacyKey); err != nil {
+		return nil, fmt.Errorf("%w: %v", sessions.ErrBackendUnavailable, err)
+	}
+	return index, nil
+}
+
+// saveUserSession adds or replaces a session in the index at key
+func (store *SessionStore) saveUserSession(ctx context.Context, key string, entry userSession) error {
+	value, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("error encoding user session: %v", err)
+	}
+	// No session outlives the cookie, so neither does the index, which is
+	// kept for as long as the user's most recently saved session
+	if err := store.Client.HSet(ctx, key, entry.Handle, value, store.CookieOptions.Expire); err != nil {
+		return fmt.Errorf("%w: %v", sessions.ErrBackendUnavailable, err)
+	}
+	return nil
+}
+
+// handleExists checks whether a session is stored at the handle
+func (store *SessionStore) handleExists(ctx context.Context, handle string) (bool, error) {
+	ttl, err := store.Client.TTL(ctx, handle)
+	if err != nil {
+		return false, fmt.Errorf("%w: %v", sessions.ErrBackendUnavailable, err)
+	}
+	return ttl != -2, nil
+}
+
+// requestHandle returns the handle of the session the request's cookie
+// refers to, if any
+func (store *SessionStore) requestHandle(req *http.Request) string {
+	name := cookies.GetCookieName(req, store.CookieOptions)
+	requestCookie, err := req.Cookie(name)
+	if err != nil {
+		return ""
+	}
+	val, _, ok := encryption.Validate(requestCookie, store.CookieOptions.Secret, store.CookieOptions.Expire)
+	if !ok {
+		return ""
+	}
+	ticket, err := decodeTicket(name, val)
+	if err != nil {
+		return ""
+	}
+	return ticket.asHandle(name)
+}
+
+// clientIP returns the address of the client, taking the real client IP
+// from the request scope when the proxy has determined it
+func clientIP(req *http.Request) string {
+	if scope := middleware.GetRequestScope(req); scope != nil && scope.ClientIP != "" {
+		return scope.ClientIP
+	}
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		return host
+	}
+	return req.RemoteAddr
+}
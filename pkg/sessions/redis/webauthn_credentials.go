@@ -0,0 +1,55 @@
+package redis
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/go-redis/redis/v7"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+)
+
+// webAuthnCredentialPrefix prefixes the keys of users' WebAuthn credentials.
+// The separator differs from ticket handles so that they aren't counted as
+// sessions.
+const webAuthnCredentialPrefix = "oauth2-proxy-webauthn:"
+
+var _ sessions.WebAuthnCredentialStore = (*SessionStore)(nil)
+
+// webAuthnCredentialKey returns the key of the user's credentials. The user
+// is hashed so that keys don't reveal who has registered credentials.
+func webAuthnCredentialKey(user string) string {
+	sum := sha256.Sum256([]byte(user))
+	return webAuthnCredentialPrefix + hex.EncodeToString(sum[:])
+}
+
+// LoadWebAuthnCredentials loads the credentials registered by the user
+func (store *SessionStore) LoadWebAuthnCredentials(ctx context.Context, user string) ([]*sessions.WebAuthnCredential, error) {
+	value, err := store.Client.Get(ctx, webAuthnCredentialKey(user))
+	if err == redis.Nil {
+		return []*sessions.WebAuthnCredential{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("%w: %v", sessions.ErrBackendUnavailable, err)
+	}
+
+	var credentials []*sessions.WebAuthnCredential
+	if err := json.Unmarshal(value, &credentials); err != nil {
+		return nil, fmt.Errorf("error decoding webauthn credentials: %v", err)
+	}
+	return credentials, nil
+}
+
+// SaveWebAuthnCredentials replaces the credentials registered by the user.
+// They are kept until replaced.
+func (store *SessionStore) SaveWebAuthnCredentials(ctx context.Context, user string, credentials []*sessions.WebAuthnCredential) error {
+	value, err := json.Marshal(credentials)
+	if err != nil {
+		return fmt.Errorf("error encoding webauthn credentials: %v", err)
+	}
+	if err := store.Client.Set(ctx, webAuthnCredentialKey(user), value, 0); err != nil {
+		return fmt.Errorf("%w: %v", sessions.ErrBackendUnavailable, err)
+	}
+	return nil
+}
@@ -2,21 +2,60 @@ package sessions
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/oauth2-proxy/oauth2-proxy/pkg/apis/options"
 	"github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/cookies"
 	"github.com/oauth2-proxy/oauth2-proxy/pkg/sessions/cookie"
-	"github.com/oauth2-proxy/oauth2-proxy/pkg/sessions/redis"
 )
 
-// NewSessionStore creates a SessionStore from the provided configuration
-func NewSessionStore(opts *options.SessionOptions, cookieOpts *options.CookieOptions) (sessions.SessionStore, error) {
-	switch opts.Type {
-	case options.CookieSessionStoreType:
+// StoreConstructor creates a SessionStore of a type from the configuration
+type StoreConstructor func(opts *options.SessionOptions, cookieOpts *options.CookieOptions) (sessions.SessionStore, error)
+
+// registry holds the constructors of the session stores compiled into the
+// binary
+var registry = map[string]StoreConstructor{
+	options.CookieSessionStoreType: func(opts *options.SessionOptions, cookieOpts *options.CookieOptions) (sessions.SessionStore, error) {
 		return cookie.NewCookieSessionStore(opts, cookieOpts)
-	case options.RedisSessionStoreType:
-		return redis.NewRedisSessionStore(opts, cookieOpts)
-	default:
+	},
+}
+
+// Register makes a session store type available to NewSessionStore. The
+// redis store registers itself unless it's left out of the build with the
+// no_redis build tag; programs embedding the proxy can register their own
+// before loading the options.
+func Register(storeType string, constructor StoreConstructor) {
+	registry[storeType] = constructor
+}
+
+// Types returns the session store types that are available, sorted
+func Types() []string {
+	types := make([]string, 0, len(registry))
+	for storeType := range registry {
+		types = append(types, storeType)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// NewSessionStore creates a SessionStore from the provided configuration.
+// The store created is the one reported by the sessions_active gauge.
+func NewSessionStore(opts *options.SessionOptions, cookieOpts *options.CookieOptions) (sessions.SessionStore, error) {
+	if msgs := cookies.Validate(cookieOpts); len(msgs) > 0 {
+		return nil, fmt.Errorf("invalid cookie options: %s", strings.Join(msgs, ", "))
+	}
+
+	constructor, ok := registry[opts.Type]
+	if !ok {
 		return nil, fmt.Errorf("unknown session store type '%s'", opts.Type)
 	}
+	ss, err := constructor(opts, cookieOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	setCounter(ss)
+	return ss, nil
 }
@@ -0,0 +1,8 @@
+//go:build no_redis
+// +build no_redis
+
+package sessions_test
+
+// withRedis is whether the redis session store is built in, so that the
+// tests using it can be skipped when it's left out with no_redis
+const withRedis = false
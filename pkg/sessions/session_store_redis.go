@@ -0,0 +1,16 @@
+//go:build !no_redis
+// +build !no_redis
+
+package sessions
+
+import (
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/sessions/redis"
+)
+
+func init() {
+	Register(options.RedisSessionStoreType, func(opts *options.SessionOptions, cookieOpts *options.CookieOptions) (sessions.SessionStore, error) {
+		return redis.NewRedisSessionStore(opts, cookieOpts)
+	})
+}
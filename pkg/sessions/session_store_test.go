@@ -1,8 +1,11 @@
 package sessions_test
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
+	"expvar"
 	"net/http"
 	"net/http/httptest"
 	"strconv"
@@ -45,11 +48,12 @@ var _ = Describe("NewSessionStore", func() {
 			})
 
 			It("have the correct name set", func() {
+				name := cookiesapi.GetCookieName(request, cookieOpts)
 				if len(cookies) == 1 {
-					Expect(cookies[0].Name).To(Equal(cookieOpts.Name))
+					Expect(cookies[0].Name).To(Equal(name))
 				} else {
 					for _, cookie := range cookies {
-						Expect(cookie.Name).To(ContainSubstring(cookieOpts.Name))
+						Expect(cookie.Name).To(ContainSubstring(name))
 					}
 				}
 			})
@@ -109,14 +113,14 @@ var _ = Describe("NewSessionStore", func() {
 			BeforeEach(func() {
 				req := httptest.NewRequest("GET", "http://example.com/", nil)
 				saveResp := httptest.NewRecorder()
-				err := ss.Save(saveResp, req, session)
+				err := ss.Save(req.Context(), saveResp, req, session)
 				Expect(err).ToNot(HaveOccurred())
 
 				resultCookies = saveResp.Result().Cookies()
 				for _, c := range resultCookies {
 					request.AddCookie(c)
 				}
-				err = ss.Clear(response, request)
+				err = ss.Clear(request.Context(), response, request)
 				Expect(err).ToNot(HaveOccurred())
 			})
 
@@ -130,7 +134,7 @@ var _ = Describe("NewSessionStore", func() {
 						loadReq.AddCookie(c)
 					}
 
-					loadedAfterClear, loadErr = ss.Load(loadReq)
+					loadedAfterClear, loadErr = ss.Load(loadReq.Context(), loadReq)
 				})
 
 				It("returns an empty session", func() {
@@ -140,17 +144,78 @@ var _ = Describe("NewSessionStore", func() {
 				It("returns an error", func() {
 					Expect(loadErr).To(HaveOccurred())
 				})
+
+				It("reports the session as expired", func() {
+					Expect(errors.Is(loadErr, sessionsapi.ErrExpired)).To(BeTrue())
+				})
 			})
 
 			CheckCookieOptions()
 		})
+
+		Context("when the backend is unavailable", func() {
+			var loadErr error
+
+			BeforeEach(func() {
+				req := httptest.NewRequest("GET", "http://example.com/", nil)
+				saveResp := httptest.NewRecorder()
+				err := ss.Save(req.Context(), saveResp, req, session)
+				Expect(err).ToNot(HaveOccurred())
+
+				for _, c := range saveResp.Result().Cookies() {
+					request.AddCookie(c)
+				}
+				mr.Close()
+
+				_, loadErr = ss.Load(request.Context(), request)
+			})
+
+			It("returns an ErrBackendUnavailable error from Load", func() {
+				Expect(errors.Is(loadErr, sessionsapi.ErrBackendUnavailable)).To(BeTrue())
+			})
+
+			It("returns an ErrBackendUnavailable error from Save", func() {
+				err := ss.Save(request.Context(), response, request, session)
+				Expect(errors.Is(err, sessionsapi.ErrBackendUnavailable)).To(BeTrue())
+			})
+
+			It("returns an ErrBackendUnavailable error from Ping", func() {
+				pinger, ok := ss.(sessionsapi.Pinger)
+				Expect(ok).To(BeTrue())
+				Expect(errors.Is(pinger.Ping(request.Context()), sessionsapi.ErrBackendUnavailable)).To(BeTrue())
+			})
+		})
+
+		Context("when counting sessions", func() {
+			BeforeEach(func() {
+				cookieOpts.HostNames = []string{"other.example.com=_other"}
+				for _, host := range []string{"example.com", "example.com", "other.example.com"} {
+					req := httptest.NewRequest("GET", "http://"+host+"/", nil)
+					err := ss.Save(req.Context(), httptest.NewRecorder(), req, session)
+					Expect(err).ToNot(HaveOccurred())
+				}
+				Expect(mr.Set("unrelated-key", "value")).To(Succeed())
+			})
+
+			It("counts each saved session", func() {
+				counter, ok := ss.(sessionsapi.Counter)
+				Expect(ok).To(BeTrue())
+				n, err := counter.CountSessions(request.Context())
+				Expect(err).ToNot(HaveOccurred())
+				Expect(n).To(BeEquivalentTo(3))
+			})
+
+			It("reports the count with expvar", func() {
+				Expect(expvar.Get("sessions_active").String()).To(Equal("3"))
+			})
+		})
 	}
 
 	SessionStoreInterfaceTests := func(persistent bool) {
 		Context("when Save is called", func() {
 			Context("with no existing session", func() {
 				BeforeEach(func() {
-					err := ss.Save(response, request, session)
+					err := ss.Save(request.Context(), response, request, session)
 					Expect(err).ToNot(HaveOccurred())
 				})
 
@@ -171,7 +236,7 @@ var _ = Describe("NewSessionStore", func() {
 					cookie := cookiesapi.MakeCookieFromOptions(request, cookieOpts.Name, value, cookieOpts, cookieOpts.Expire, time.Now())
 					request.AddCookie(cookie)
 
-					err := ss.Save(response, request, session)
+					err := ss.Save(request.Context(), response, request, session)
 					Expect(err).ToNot(HaveOccurred())
 				})
 
@@ -190,7 +255,7 @@ var _ = Describe("NewSessionStore", func() {
 					By("saving a session")
 					req := httptest.NewRequest("GET", "http://example.com/", nil)
 					saveResp := httptest.NewRecorder()
-					err = ss.Save(saveResp, req, session)
+					err = ss.Save(req.Context(), saveResp, req, session)
 					Expect(err).ToNot(HaveOccurred())
 
 					By("and clearing the session")
@@ -198,11 +263,11 @@ var _ = Describe("NewSessionStore", func() {
 						request.AddCookie(c)
 					}
 					clearResp := httptest.NewRecorder()
-					err = ss.Clear(clearResp, request)
+					err = ss.Clear(request.Context(), clearResp, request)
 					Expect(err).ToNot(HaveOccurred())
 
 					By("then saving a request with the cleared session")
-					err = ss.Save(response, request, session)
+					err = ss.Save(request.Context(), response, request, session)
 				})
 
 				It("no error should occur", func() {
@@ -217,13 +282,13 @@ var _ = Describe("NewSessionStore", func() {
 			BeforeEach(func() {
 				req := httptest.NewRequest("GET", "http://example.com/", nil)
 				saveResp := httptest.NewRecorder()
-				err := ss.Save(saveResp, req, session)
+				err := ss.Save(req.Context(), saveResp, req, session)
 				Expect(err).ToNot(HaveOccurred())
 
 				for _, c := range saveResp.Result().Cookies() {
 					request.AddCookie(c)
 				}
-				err = ss.Clear(response, request)
+				err = ss.Clear(request.Context(), response, request)
 				Expect(err).ToNot(HaveOccurred())
 			})
 
@@ -239,7 +304,7 @@ var _ = Describe("NewSessionStore", func() {
 				var loadedSession *sessionsapi.SessionState
 				BeforeEach(func() {
 					var err error
-					loadedSession, err = ss.Load(request)
+					loadedSession, err = ss.Load(request.Context(), request)
 					Expect(err).ToNot(HaveOccurred())
 				})
 
@@ -270,7 +335,7 @@ var _ = Describe("NewSessionStore", func() {
 			BeforeEach(func() {
 				req := httptest.NewRequest("GET", "http://example.com/", nil)
 				resp := httptest.NewRecorder()
-				err := ss.Save(resp, req, session)
+				err := ss.Save(req.Context(), resp, req, session)
 				Expect(err).ToNot(HaveOccurred())
 
 				for _, cookie := range resp.Result().Cookies() {
@@ -282,6 +347,14 @@ var _ = Describe("NewSessionStore", func() {
 				LoadSessionTests()
 			})
 
+			Context("without a session cookie", func() {
+				It("returns an ErrNotFound error", func() {
+					loadedSession, err := ss.Load(context.Background(), httptest.NewRequest("GET", "http://example.com/", nil))
+					Expect(errors.Is(err, sessionsapi.ErrNotFound)).To(BeTrue())
+					Expect(loadedSession).To(BeNil())
+				})
+			})
+
 			// Test TTLs and cleanup of persistent session storage
 			// For non-persistent we rely on the browser cookie lifecycle
 			if persistent {
@@ -306,12 +379,13 @@ var _ = Describe("NewSessionStore", func() {
 							mr.FastForward(cookieOpts.Expire + time.Minute)
 						}
 
-						loadedSession, err = ss.Load(request)
+						loadedSession, err = ss.Load(request.Context(), request)
 						Expect(err).To(HaveOccurred())
 					})
 
 					It("returns an error loading the session", func() {
 						Expect(err).To(HaveOccurred())
+						Expect(errors.Is(err, sessionsapi.ErrExpired)).To(BeTrue())
 					})
 
 					It("returns an empty session", func() {
@@ -358,6 +432,34 @@ var _ = Describe("NewSessionStore", func() {
 			SessionStoreInterfaceTests(persistent)
 		})
 
+		Context("with a host scoped cookie name", func() {
+			BeforeEach(func() {
+				cookieOpts.NameScope = "host"
+
+				var err error
+				ss, err = sessions.NewSessionStore(opts, cookieOpts)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			It("does not load sessions saved for another host", func() {
+				req := httptest.NewRequest("GET", "http://other.example.com/", nil)
+				resp := httptest.NewRecorder()
+				err := ss.Save(req.Context(), resp, req, session)
+				Expect(err).ToNot(HaveOccurred())
+
+				for _, c := range resp.Result().Cookies() {
+					Expect(c.Name).ToNot(Equal(cookieOpts.Name))
+					request.AddCookie(c)
+				}
+
+				loadedSession, err := ss.Load(request.Context(), request)
+				Expect(errors.Is(err, sessionsapi.ErrNotFound)).To(BeTrue())
+				Expect(loadedSession).To(BeNil())
+			})
+
+			SessionStoreInterfaceTests(persistent)
+		})
+
 		Context("with a cipher", func() {
 			BeforeEach(func() {
 				secret := make([]byte, 32)
@@ -419,10 +521,28 @@ var _ = Describe("NewSessionStore", func() {
 		Context("the cookie.SessionStore", func() {
 			RunSessionTests(false)
 		})
+
+		It("counts the session cookies issued", func() {
+			ss, err := sessions.NewSessionStore(opts, cookieOpts)
+			Expect(err).NotTo(HaveOccurred())
+			issued := expvar.Get("sessions_cookies_issued").(*expvar.Int)
+			before := issued.Value()
+			Expect(ss.Save(request.Context(), response, request, session)).To(Succeed())
+			Expect(issued.Value()).To(Equal(before + 1))
+		})
+
+		It("does not report active sessions", func() {
+			_, err := sessions.NewSessionStore(opts, cookieOpts)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(expvar.Get("sessions_active").String()).To(Equal("null"))
+		})
 	})
 
 	Context("with type 'redis'", func() {
 		BeforeEach(func() {
+			if !withRedis {
+				Skip("the redis session store is left out of the build")
+			}
 			var err error
 			mr, err = miniredis.Run()
 			Expect(err).ToNot(HaveOccurred())
@@ -443,6 +563,450 @@ var _ = Describe("NewSessionStore", func() {
 		Context("the redis.SessionStore", func() {
 			RunSessionTests(true)
 		})
+
+		Context("keeping machine tokens", func() {
+			var store sessionsapi.MachineTokenStore
+			var token *sessionsapi.MachineToken
+
+			BeforeEach(func() {
+				ss, err := sessions.NewSessionStore(opts, cookieOpts)
+				Expect(err).ToNot(HaveOccurred())
+				var ok bool
+				store, ok = ss.(sessionsapi.MachineTokenStore)
+				Expect(ok).To(BeTrue())
+
+				token = &sessionsapi.MachineToken{
+					ID:        "0123456789abcdef0123456789abcdef",
+					Name:      "ci",
+					Owner:     "jane@example.com",
+					Scopes:    []string{"/api/"},
+					CreatedAt: time.Now().Truncate(time.Second),
+					ExpiresOn: time.Now().Add(time.Hour).Truncate(time.Second),
+				}
+				Expect(store.SaveMachineToken(context.Background(), token)).To(Succeed())
+			})
+
+			It("loads a saved token", func() {
+				loaded, err := store.LoadMachineToken(context.Background(), token.ID)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(loaded.Name).To(Equal(token.Name))
+				Expect(loaded.Scopes).To(Equal(token.Scopes))
+				Expect(loaded.ExpiresOn.Equal(token.ExpiresOn)).To(BeTrue())
+			})
+
+			It("lists saved tokens", func() {
+				tokens, err := store.ListMachineTokens(context.Background())
+				Expect(err).ToNot(HaveOccurred())
+				Expect(tokens).To(HaveLen(1))
+				Expect(tokens[0].ID).To(Equal(token.ID))
+			})
+
+			It("does not count tokens as sessions", func() {
+				n, err := store.(sessionsapi.Counter).CountSessions(context.Background())
+				Expect(err).ToNot(HaveOccurred())
+				Expect(n).To(BeEquivalentTo(0))
+			})
+
+			It("expires tokens", func() {
+				mr.FastForward(time.Hour + time.Minute)
+				_, err := store.LoadMachineToken(context.Background(), token.ID)
+				Expect(errors.Is(err, sessionsapi.ErrNotFound)).To(BeTrue())
+			})
+
+			It("revokes tokens", func() {
+				Expect(store.RevokeMachineToken(context.Background(), token.ID)).To(Succeed())
+				_, err := store.LoadMachineToken(context.Background(), token.ID)
+				Expect(errors.Is(err, sessionsapi.ErrNotFound)).To(BeTrue())
+				tokens, err := store.ListMachineTokens(context.Background())
+				Expect(err).ToNot(HaveOccurred())
+				Expect(tokens).To(BeEmpty())
+			})
+		})
+
+		Context("keeping webauthn credentials", func() {
+			var store sessionsapi.WebAuthnCredentialStore
+
+			BeforeEach(func() {
+				ss, err := sessions.NewSessionStore(opts, cookieOpts)
+				Expect(err).ToNot(HaveOccurred())
+				var ok bool
+				store, ok = ss.(sessionsapi.WebAuthnCredentialStore)
+				Expect(ok).To(BeTrue())
+			})
+
+			It("loads no credentials for new users", func() {
+				credentials, err := store.LoadWebAuthnCredentials(context.Background(), "jane@example.com")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(credentials).To(BeEmpty())
+			})
+
+			It("loads saved credentials without expiring them", func() {
+				saved := []*sessionsapi.WebAuthnCredential{{
+					ID:        []byte("credential-1"),
+					PublicKey: []byte("public-key"),
+					SignCount: 3,
+					CreatedAt: time.Now().Truncate(time.Second),
+				}}
+				Expect(store.SaveWebAuthnCredentials(context.Background(), "jane@example.com", saved)).To(Succeed())
+				mr.FastForward(365 * 24 * time.Hour)
+
+				credentials, err := store.LoadWebAuthnCredentials(context.Background(), "jane@example.com")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(credentials).To(HaveLen(1))
+				Expect(credentials[0].ID).To(Equal(saved[0].ID))
+				Expect(credentials[0].SignCount).To(Equal(saved[0].SignCount))
+
+				n, err := store.(sessionsapi.Counter).CountSessions(context.Background())
+				Expect(err).ToNot(HaveOccurred())
+				Expect(n).To(BeEquivalentTo(0))
+			})
+		})
+
+		Context("exporting records", func() {
+			It("imports sessions into another redis that load with the same cookie", func() {
+				ss, err := sessions.NewSessionStore(opts, cookieOpts)
+				Expect(err).ToNot(HaveOccurred())
+				req := httptest.NewRequest("GET", "http://example.com/", nil)
+				saveResp := httptest.NewRecorder()
+				Expect(ss.Save(req.Context(), saveResp, req, session)).To(Succeed())
+				Expect(ss.(sessionsapi.LookupCache).SaveLookup(context.Background(), "email:abc", "jane@example.com", time.Minute)).To(Succeed())
+
+				var records []*sessionsapi.StoredRecord
+				err = ss.(sessionsapi.Exporter).ExportRecords(context.Background(), func(record *sessionsapi.StoredRecord) error {
+					records = append(records, record)
+					return nil
+				})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(records).To(HaveLen(1))
+				Expect(records[0].ExpiresOn).To(BeTemporally("~", time.Now().Add(cookieOpts.Expire), time.Second))
+
+				target, err := miniredis.Run()
+				Expect(err).ToNot(HaveOccurred())
+				defer target.Close()
+				targetOpts := *opts
+				targetOpts.Redis.ConnectionURL = "redis://" + target.Addr()
+				targetStore, err := sessions.NewSessionStore(&targetOpts, cookieOpts)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(targetStore.(sessionsapi.Exporter).ImportRecord(context.Background(), records[0])).To(Succeed())
+
+				loadReq := httptest.NewRequest("GET", "http://example.com/", nil)
+				for _, c := range saveResp.Result().Cookies() {
+					loadReq.AddCookie(c)
+				}
+				loaded, err := targetStore.Load(loadReq.Context(), loadReq)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(loaded.Email).To(Equal(session.Email))
+				Expect(target.TTL(records[0].Key)).To(BeNumerically("~", cookieOpts.Expire, time.Second))
+
+				records[0].ExpiresOn = time.Now().Add(-time.Minute)
+				err = targetStore.(sessionsapi.Exporter).ImportRecord(context.Background(), records[0])
+				Expect(errors.Is(err, sessionsapi.ErrExpired)).To(BeTrue())
+			})
+		})
+
+		Context("with an idle timeout", func() {
+			It("removes sessions that aren't saved again within the idle timeout", func() {
+				opts.IdleTimeout = 10 * time.Minute
+				ss, err := sessions.NewSessionStore(opts, cookieOpts)
+				Expect(err).ToNot(HaveOccurred())
+				req := httptest.NewRequest("GET", "http://example.com/", nil)
+				saveResp := httptest.NewRecorder()
+				Expect(ss.Save(req.Context(), saveResp, req, session)).To(Succeed())
+				for _, c := range saveResp.Result().Cookies() {
+					req.AddCookie(c)
+				}
+
+				mr.FastForward(5 * time.Minute)
+				Expect(ss.Save(req.Context(), httptest.NewRecorder(), req, session)).To(Succeed())
+				mr.FastForward(5 * time.Minute)
+				_, err = ss.Load(req.Context(), req)
+				Expect(err).ToNot(HaveOccurred())
+
+				mr.FastForward(10*time.Minute + time.Second)
+				_, err = ss.Load(req.Context(), req)
+				Expect(err).To(HaveOccurred())
+			})
+		})
+
+		Context("limiting user sessions", func() {
+			// signIn saves a new session for the user, returning the
+			// request carrying its cookie
+			signIn := func(ss sessionsapi.SessionStore, createdAt time.Time) (*http.Request, error) {
+				s := *session
+				s.CreatedAt = createdAt
+				req := httptest.NewRequest("GET", "http://example.com/", nil)
+				rw := httptest.NewRecorder()
+				if err := ss.Save(req.Context(), rw, req, &s); err != nil {
+					return nil, err
+				}
+				for _, c := range rw.Result().Cookies() {
+					req.AddCookie(c)
+				}
+				return req, nil
+			}
+
+			BeforeEach(func() {
+				opts.MaxUserSessions = 2
+			})
+
+			It("evicts the user's oldest session", func() {
+				opts.UserSessionLimitAction = options.EvictUserSessionLimitAction
+				ss, err := sessions.NewSessionStore(opts, cookieOpts)
+				Expect(err).ToNot(HaveOccurred())
+				first, err := signIn(ss, time.Now().Add(-time.Hour))
+				Expect(err).ToNot(HaveOccurred())
+				second, err := signIn(ss, time.Now().Add(-time.Minute))
+				Expect(err).ToNot(HaveOccurred())
+
+				// Saving an existing session again doesn't count
+				Expect(ss.Save(first.Context(), httptest.NewRecorder(), first, session)).To(Succeed())
+
+				third, err := signIn(ss, time.Now())
+				Expect(err).ToNot(HaveOccurred())
+				_, err = ss.Load(first.Context(), first)
+				Expect(errors.Is(err, sessionsapi.ErrExpired)).To(BeTrue())
+				for _, req := range []*http.Request{second, third} {
+					_, err = ss.Load(req.Context(), req)
+					Expect(err).ToNot(HaveOccurred())
+				}
+			})
+
+			It("rejects new sessions over the limit", func() {
+				opts.UserSessionLimitAction = options.RejectUserSessionLimitAction
+				ss, err := sessions.NewSessionStore(opts, cookieOpts)
+				Expect(err).ToNot(HaveOccurred())
+				first, err := signIn(ss, time.Now())
+				Expect(err).ToNot(HaveOccurred())
+				_, err = signIn(ss, time.Now())
+				Expect(err).ToNot(HaveOccurred())
+
+				_, err = signIn(ss, time.Now())
+				Expect(errors.Is(err, sessionsapi.ErrSessionLimit)).To(BeTrue())
+
+				// Once a session ends, another can be started
+				Expect(ss.Clear(first.Context(), httptest.NewRecorder(), first)).To(Succeed())
+				_, err = signIn(ss, time.Now())
+				Expect(err).ToNot(HaveOccurred())
+			})
+		})
+
+		Context("indexing user sessions", func() {
+			var ss sessionsapi.SessionStore
+
+			BeforeEach(func() {
+				opts.IndexUsers = true
+				var err error
+				ss, err = sessions.NewSessionStore(opts, cookieOpts)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			signIn := func() *http.Request {
+				req := httptest.NewRequest("GET", "http://example.com/", nil)
+				rw := httptest.NewRecorder()
+				s := *session
+				Expect(ss.Save(req.Context(), rw, req, &s)).To(Succeed())
+				for _, c := range rw.Result().Cookies() {
+					req.AddCookie(c)
+				}
+				return req
+			}
+
+			indexKeys := func(prefix string) []string {
+				var keys []string
+				for _, key := range mr.Keys() {
+					if strings.HasPrefix(key, prefix) {
+						keys = append(keys, key)
+					}
+				}
+				return keys
+			}
+
+			It("indexes each session as a field of a hash kept as long as the cookie", func() {
+				signIn()
+				req := signIn()
+
+				keys := indexKeys("oauth2-proxy-user-index:")
+				Expect(keys).To(HaveLen(1))
+				fields, err := mr.HKeys(keys[0])
+				Expect(err).ToNot(HaveOccurred())
+				Expect(fields).To(HaveLen(2))
+				Expect(mr.TTL(keys[0])).To(Equal(cookieOpts.Expire))
+
+				// Cleared sessions are removed from the index when it's next loaded
+				Expect(ss.Clear(req.Context(), httptest.NewRecorder(), req)).To(Succeed())
+				list, err := ss.(sessionsapi.UserSessionStore).ListUserSessions(req.Context(), req, session)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(list).To(HaveLen(1))
+				fields, err = mr.HKeys(keys[0])
+				Expect(err).ToNot(HaveOccurred())
+				Expect(fields).To(HaveLen(1))
+			})
+
+			It("moves the indexes of older versions into hashes", func() {
+				req := signIn()
+				key := indexKeys("oauth2-proxy-user-index:")[0]
+				fields, err := mr.HKeys(key)
+				Expect(err).ToNot(HaveOccurred())
+				entry := mr.HGet(key, fields[0])
+				mr.Del(key)
+				legacyKey := "oauth2-proxy-user-sessions:" + strings.TrimPrefix(key, "oauth2-proxy-user-index:")
+				Expect(mr.Set(legacyKey, "["+entry+"]")).To(Succeed())
+
+				list, err := ss.(sessionsapi.UserSessionStore).ListUserSessions(req.Context(), req, session)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(list).To(HaveLen(1))
+				Expect(list[0].Current).To(BeTrue())
+				Expect(mr.Exists(legacyKey)).To(BeFalse())
+				Expect(mr.HGet(key, fields[0])).To(Equal(entry))
+			})
+		})
+
+		Context("collecting garbage", func() {
+			It("bounds sessions without an expiry and prunes orphaned index entries", func() {
+				opts.IndexUsers = true
+				ss, err := sessions.NewSessionStore(opts, cookieOpts)
+				Expect(err).ToNot(HaveOccurred())
+				var reqs []*http.Request
+				for i := 0; i < 3; i++ {
+					req := httptest.NewRequest("GET", "http://example.com/", nil)
+					rw := httptest.NewRecorder()
+					s := *session
+					Expect(ss.Save(req.Context(), rw, req, &s)).To(Succeed())
+					for _, c := range rw.Result().Cookies() {
+						req.AddCookie(c)
+					}
+					reqs = append(reqs, req)
+				}
+
+				var handles []string
+				for _, key := range mr.Keys() {
+					if strings.HasPrefix(key, cookieOpts.Name+"-") {
+						handles = append(handles, key)
+					}
+				}
+				Expect(handles).To(HaveLen(3))
+				// an imported session without an expiry, and sessions ended
+				// without being removed from the index
+				value, err := mr.Get(handles[0])
+				Expect(err).ToNot(HaveOccurred())
+				Expect(mr.Set(handles[0], value)).To(Succeed())
+				mr.Del(handles[1])
+				mr.Del(handles[2])
+
+				report, err := ss.(sessionsapi.GarbageCollector).CollectGarbage(context.Background())
+				Expect(err).ToNot(HaveOccurred())
+				Expect(*report).To(Equal(sessionsapi.GarbageReport{Sessions: 1, Unbounded: 1, Orphaned: 2}))
+				Expect(mr.TTL(handles[0])).To(Equal(cookieOpts.Expire))
+
+				report, err = ss.(sessionsapi.GarbageCollector).CollectGarbage(context.Background())
+				Expect(err).ToNot(HaveOccurred())
+				Expect(*report).To(Equal(sessionsapi.GarbageReport{Sessions: 1}))
+			})
+		})
+
+		Context("caching provider lookups", func() {
+			var cache sessionsapi.LookupCache
+
+			BeforeEach(func() {
+				ss, err := sessions.NewSessionStore(opts, cookieOpts)
+				Expect(err).ToNot(HaveOccurred())
+				var ok bool
+				cache, ok = ss.(sessionsapi.LookupCache)
+				Expect(ok).To(BeTrue())
+			})
+
+			It("loads cached lookups until their ttl passes", func() {
+				_, err := cache.LoadLookup(context.Background(), "email:abc")
+				Expect(errors.Is(err, sessionsapi.ErrNotFound)).To(BeTrue())
+
+				Expect(cache.SaveLookup(context.Background(), "email:abc", "jane@example.com", time.Minute)).To(Succeed())
+				value, err := cache.LoadLookup(context.Background(), "email:abc")
+				Expect(err).ToNot(HaveOccurred())
+				Expect(value).To(Equal("jane@example.com"))
+
+				n, err := cache.(sessionsapi.Counter).CountSessions(context.Background())
+				Expect(err).ToNot(HaveOccurred())
+				Expect(n).To(BeEquivalentTo(0))
+
+				mr.FastForward(2 * time.Minute)
+				_, err = cache.LoadLookup(context.Background(), "email:abc")
+				Expect(errors.Is(err, sessionsapi.ErrNotFound)).To(BeTrue())
+			})
+		})
+
+		Context("keeping counters", func() {
+			var counters sessionsapi.CounterStore
+
+			BeforeEach(func() {
+				ss, err := sessions.NewSessionStore(opts, cookieOpts)
+				Expect(err).ToNot(HaveOccurred())
+				var ok bool
+				counters, ok = ss.(sessionsapi.CounterStore)
+				Expect(ok).To(BeTrue())
+			})
+
+			It("increments counters until their ttl passes", func() {
+				n, err := counters.IncrementCounter(context.Background(), "requests", 2, time.Minute)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(n).To(BeEquivalentTo(2))
+				n, err = counters.IncrementCounter(context.Background(), "requests", -1, time.Minute)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(n).To(BeEquivalentTo(1))
+
+				count, err := counters.(sessionsapi.Counter).CountSessions(context.Background())
+				Expect(err).ToNot(HaveOccurred())
+				Expect(count).To(BeEquivalentTo(0))
+
+				mr.FastForward(2 * time.Minute)
+				n, err = counters.IncrementCounter(context.Background(), "requests", 0, time.Minute)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(n).To(BeEquivalentTo(0))
+			})
+		})
+
+		Context("keeping oauth states", func() {
+			var states sessionsapi.StateStore
+
+			BeforeEach(func() {
+				ss, err := sessions.NewSessionStore(opts, cookieOpts)
+				Expect(err).ToNot(HaveOccurred())
+				var ok bool
+				states, ok = ss.(sessionsapi.StateStore)
+				Expect(ok).To(BeTrue())
+			})
+
+			It("redeems each state once", func() {
+				Expect(states.SaveState(context.Background(), "nonce", time.Minute)).To(Succeed())
+				Expect(states.RedeemState(context.Background(), "nonce")).To(Succeed())
+
+				err := states.RedeemState(context.Background(), "nonce")
+				Expect(errors.Is(err, sessionsapi.ErrNotFound)).To(BeTrue())
+				err = states.RedeemState(context.Background(), "unknown")
+				Expect(errors.Is(err, sessionsapi.ErrNotFound)).To(BeTrue())
+			})
+
+			It("doesn't redeem states once their ttl passes", func() {
+				Expect(states.SaveState(context.Background(), "nonce", time.Minute)).To(Succeed())
+				mr.FastForward(2 * time.Minute)
+				err := states.RedeemState(context.Background(), "nonce")
+				Expect(errors.Is(err, sessionsapi.ErrNotFound)).To(BeTrue())
+			})
+		})
+	})
+
+	Context("with invalid cookie options", func() {
+		BeforeEach(func() {
+			opts.Type = options.CookieSessionStoreType
+			cookieOpts.SameSite = "none"
+			cookieOpts.Secure = false
+		})
+
+		It("returns an error", func() {
+			ss, err := sessions.NewSessionStore(opts, cookieOpts)
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(HavePrefix("invalid cookie options: cookie_samesite (none) requires cookie_secure"))
+			Expect(ss).To(BeNil())
+		})
 	})
 
 	Context("with an invalid type", func() {
@@ -0,0 +1,201 @@
+package verification
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/logger"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+const (
+	// refreshAttempts is the number of times Refresh tries to fetch keys
+	refreshAttempts = 3
+
+	// minRefreshInterval limits how often keys are fetched for tokens
+	// signed by unknown keys, so that such tokens can't be used to flood
+	// the issuer with requests
+	minRefreshInterval = 10 * time.Second
+)
+
+// refreshRetryDelay is the delay before the first retry of a failed fetch,
+// doubled for each further retry
+var refreshRetryDelay = time.Second
+
+var _ oidc.KeySet = (*KeySet)(nil)
+
+// KeySet verifies the signatures of tokens with the keys of an issuer's JSON
+// Web Key Set. Unlike go-oidc's remote key set, keys can be fetched ahead of
+// use with Refresh so that verifying the first token doesn't wait on the
+// issuer. Keys are fetched on demand too when a token is signed by an
+// unknown key, as happens when the issuer rotates its keys.
+type KeySet struct {
+	URL string
+
+	// fetchMu serialises fetches, so that concurrent requests for unknown
+	// keys wait for a single fetch
+	fetchMu   sync.Mutex
+	mu        sync.RWMutex
+	keys      []jose.JSONWebKey
+	fetchedAt time.Time
+}
+
+// NewKeySet returns a KeySet for the JSON Web Key Set at jwksURL. No keys are
+// fetched until it is refreshed or used.
+func NewKeySet(jwksURL string) *KeySet {
+	return &KeySet{URL: jwksURL}
+}
+
+// VerifySignature verifies the token's signature, returning its payload
+func (k *KeySet) VerifySignature(ctx context.Context, jwt string) ([]byte, error) {
+	jws, err := jose.ParseSigned(jwt)
+	if err != nil {
+		return nil, fmt.Errorf("malformed jwt: %v", err)
+	}
+	if payload, ok := k.verify(jws); ok {
+		return payload, nil
+	}
+
+	if err := k.fetchIfStale(ctx); err != nil {
+		return nil, fmt.Errorf("failed to verify signature: %v", err)
+	}
+	if payload, ok := k.verify(jws); ok {
+		return payload, nil
+	}
+	return nil, errors.New("failed to verify signature: no known key signed the token")
+}
+
+// verify checks the signature against the cached keys
+func (k *KeySet) verify(jws *jose.JSONWebSignature) ([]byte, bool) {
+	keyID := ""
+	for _, sig := range jws.Signatures {
+		keyID = sig.Header.KeyID
+		break
+	}
+
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	for _, key := range k.keys {
+		if keyID == "" || key.KeyID == keyID {
+			if payload, err := jws.Verify(&key); err == nil {
+				return payload, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// Refresh fetches the keys, retrying with backoff when the fetch fails.
+// The keys already cached are kept if every attempt fails.
+func (k *KeySet) Refresh(ctx context.Context) error {
+	delay := refreshRetryDelay
+	var err error
+	for attempt := 1; ; attempt++ {
+		k.fetchMu.Lock()
+		err = k.fetch(ctx)
+		k.fetchMu.Unlock()
+		if err == nil || attempt == refreshAttempts {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// fetchIfStale fetches the keys unless they were fetched within
+// minRefreshInterval
+func (k *KeySet) fetchIfStale(ctx context.Context) error {
+	k.fetchMu.Lock()
+	defer k.fetchMu.Unlock()
+
+	k.mu.RLock()
+	fetchedAt := k.fetchedAt
+	k.mu.RUnlock()
+	if time.Since(fetchedAt) < minRefreshInterval {
+		return nil
+	}
+	return k.fetch(ctx)
+}
+
+// fetch replaces the cached keys with those served by the issuer. It must be
+// called holding fetchMu.
+func (k *KeySet) fetch(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", k.URL, nil)
+	if err != nil {
+		return fmt.Errorf("error creating request for %s: %v", k.URL, err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("error fetching keys from %s: %v", k.URL, err)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("error reading keys from %s: %v", k.URL, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("got %d fetching keys from %s: %s", resp.StatusCode, k.URL, body)
+	}
+
+	var keySet jose.JSONWebKeySet
+	if err := json.Unmarshal(body, &keySet); err != nil {
+		return fmt.Errorf("error decoding keys from %s: %v", k.URL, err)
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.keys = keySet.Keys
+	k.fetchedAt = time.Now()
+	return nil
+}
+
+// RefreshKeySets refreshes the key sets in parallel, logging those that
+// couldn't be fetched
+func RefreshKeySets(ctx context.Context, keySets []*KeySet) {
+	var wg sync.WaitGroup
+	for _, keySet := range keySets {
+		wg.Add(1)
+		go func(keySet *KeySet) {
+			defer wg.Done()
+			if err := keySet.Refresh(ctx); err != nil {
+				logger.Printf("Error refreshing JWKS: %v", err)
+			}
+		}(keySet)
+	}
+	wg.Wait()
+}
+
+// NewKeySetProviderVerifier constructs an IDTokenVerifier from a discovered
+// OIDC provider like NewProviderVerifier, but verifying signatures with a
+// KeySet for the provider's JWKS, which is returned so that it can be
+// refreshed ahead of use
+func NewKeySetProviderVerifier(provider *oidc.Provider, audience string, opts options.IDTokenVerificationOptions) (*oidc.IDTokenVerifier, *KeySet, error) {
+	var claims struct {
+		Issuer  string `json:"issuer"`
+		JWKSURL string `json:"jwks_uri"`
+	}
+	if err := provider.Claims(&claims); err != nil {
+		return nil, nil, err
+	}
+	if claims.JWKSURL == "" {
+		return nil, nil, errors.New("provider discovery returned no jwks_uri")
+	}
+
+	config := Config(audience, opts)
+	config.SupportedSigningAlgs = providerSigningAlgs(provider)
+	keySet := NewKeySet(claims.JWKSURL)
+	return oidc.NewVerifier(claims.Issuer, keySet, config), keySet, nil
+}
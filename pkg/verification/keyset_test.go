@@ -0,0 +1,202 @@
+package verification
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/coreos/go-oidc"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/apis/options"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ed25519"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+type jwksIssuer struct {
+	*httptest.Server
+	keys     jose.JSONWebKeySet
+	requests int32
+	failures int32
+}
+
+func newJWKSIssuer(t *testing.T) *jwksIssuer {
+	issuer := &jwksIssuer{}
+	issuer.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(rw).Encode(map[string]interface{}{
+				"issuer":                                issuer.URL,
+				"authorization_endpoint":                issuer.URL + "/authorize",
+				"token_endpoint":                        issuer.URL + "/token",
+				"jwks_uri":                              issuer.URL + "/keys",
+				"id_token_signing_alg_values_supported": []string{"RS256", "HS256"},
+			})
+		case "/keys":
+			atomic.AddInt32(&issuer.requests, 1)
+			if atomic.AddInt32(&issuer.failures, -1) >= 0 {
+				rw.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			json.NewEncoder(rw).Encode(issuer.keys)
+		default:
+			rw.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(issuer.Close)
+	return issuer
+}
+
+// addKey adds a new RSA signing key to the issuer's key set, returning a
+// function to sign tokens with it
+func (i *jwksIssuer) addKey(t *testing.T, keyID string) func(claims map[string]interface{}) string {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	return i.addSigningKey(t, keyID, jose.RS256, key, key.Public())
+}
+
+func (i *jwksIssuer) addSigningKey(t *testing.T, keyID string, alg jose.SignatureAlgorithm, key, public interface{}) func(claims map[string]interface{}) string {
+	i.keys.Keys = append(i.keys.Keys, jose.JSONWebKey{Key: public, KeyID: keyID, Algorithm: string(alg), Use: "sig"})
+
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: alg, Key: key}, (&jose.SignerOptions{}).WithHeader("kid", keyID))
+	require.NoError(t, err)
+	return func(claims map[string]interface{}) string {
+		payload, err := json.Marshal(claims)
+		require.NoError(t, err)
+		jws, err := signer.Sign(payload)
+		require.NoError(t, err)
+		token, err := jws.CompactSerialize()
+		require.NoError(t, err)
+		return token
+	}
+}
+
+func TestKeySetVerifySignature(t *testing.T) {
+	issuer := newJWKSIssuer(t)
+	sign := issuer.addKey(t, "key-1")
+	keySet := NewKeySet(issuer.URL + "/keys")
+
+	require.NoError(t, keySet.Refresh(context.Background()))
+	assert.Equal(t, int32(1), issuer.requests)
+
+	payload, err := keySet.VerifySignature(context.Background(), sign(map[string]interface{}{"sub": "1234567890"}))
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"sub": "1234567890"}`, string(payload))
+	assert.Equal(t, int32(1), issuer.requests)
+
+	// Tokens signed by unknown keys don't cause a fetch while the keys are fresh
+	rotated := issuer.addKey(t, "key-2")
+	_, err = keySet.VerifySignature(context.Background(), rotated(map[string]interface{}{"sub": "1234567890"}))
+	assert.Error(t, err)
+	assert.Equal(t, int32(1), issuer.requests)
+
+	// But do once they're older than minRefreshInterval
+	keySet.fetchedAt = time.Now().Add(-minRefreshInterval)
+	_, err = keySet.VerifySignature(context.Background(), rotated(map[string]interface{}{"sub": "1234567890"}))
+	assert.NoError(t, err)
+	assert.Equal(t, int32(2), issuer.requests)
+
+	_, err = keySet.VerifySignature(context.Background(), "not-a-jwt")
+	assert.Error(t, err)
+}
+
+func TestKeySetRefreshRetries(t *testing.T) {
+	defer func(delay time.Duration) { refreshRetryDelay = delay }(refreshRetryDelay)
+	refreshRetryDelay = time.Millisecond
+
+	issuer := newJWKSIssuer(t)
+	sign := issuer.addKey(t, "key-1")
+	issuer.failures = refreshAttempts - 1
+	keySet := NewKeySet(issuer.URL + "/keys")
+	require.NoError(t, keySet.Refresh(context.Background()))
+	assert.Equal(t, int32(refreshAttempts), issuer.requests)
+
+	// Cached keys are kept when refreshing fails
+	issuer.failures = refreshAttempts
+	assert.Error(t, keySet.Refresh(context.Background()))
+	_, err := keySet.VerifySignature(context.Background(), sign(map[string]interface{}{"sub": "1234567890"}))
+	assert.NoError(t, err)
+}
+
+func TestRefreshKeySets(t *testing.T) {
+	var keySets []*KeySet
+	var issuers []*jwksIssuer
+	for i := 0; i < 3; i++ {
+		issuer := newJWKSIssuer(t)
+		issuer.addKey(t, fmt.Sprintf("key-%d", i))
+		issuers = append(issuers, issuer)
+		keySets = append(keySets, NewKeySet(issuer.URL+"/keys"))
+	}
+	RefreshKeySets(context.Background(), keySets)
+	for i, keySet := range keySets {
+		assert.Len(t, keySet.keys, 1)
+		assert.Equal(t, int32(1), issuers[i].requests)
+	}
+}
+
+func TestVerifierSigningAlgorithms(t *testing.T) {
+	issuer := newJWKSIssuer(t)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	edPublic, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signers := map[string]func(map[string]interface{}) string{
+		"RS256": issuer.addKey(t, "rsa"),
+		"ES256": issuer.addSigningKey(t, "ec", jose.ES256, ecKey, ecKey.Public()),
+		"EdDSA": issuer.addSigningKey(t, "ed", jose.EdDSA, edKey, edPublic),
+	}
+
+	verifier := NewVerifier(issuer.URL, NewKeySet(issuer.URL+"/keys"), testAudience, options.IDTokenVerificationOptions{})
+	for alg, sign := range signers {
+		_, err := verifier.Verify(context.Background(), sign(map[string]interface{}{
+			"iss": issuer.URL,
+			"aud": testAudience,
+			"exp": time.Now().Add(time.Hour).Unix(),
+		}))
+		assert.NoError(t, err, alg)
+	}
+}
+
+func TestNewKeySetProviderVerifier(t *testing.T) {
+	issuer := newJWKSIssuer(t)
+	sign := issuer.addKey(t, "key-1")
+	provider, err := oidc.NewProvider(context.Background(), issuer.URL)
+	require.NoError(t, err)
+
+	verifier, keySet, err := NewKeySetProviderVerifier(provider, testAudience, options.IDTokenVerificationOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, issuer.URL+"/keys", keySet.URL)
+	require.NoError(t, keySet.Refresh(context.Background()))
+
+	token := sign(map[string]interface{}{
+		"iss": issuer.URL,
+		"aud": testAudience,
+		"sub": "1234567890",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	idToken, err := verifier.Verify(context.Background(), token)
+	require.NoError(t, err)
+	assert.Equal(t, "1234567890", idToken.Subject)
+	assert.Equal(t, int32(1), issuer.requests)
+
+	// Only the algorithms the provider advertises are accepted
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	issuer.keys.Keys = nil
+	token = issuer.addSigningKey(t, "ed", jose.EdDSA, edKey, edKey.Public())(map[string]interface{}{
+		"iss": issuer.URL,
+		"aud": testAudience,
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	_, err = verifier.Verify(context.Background(), token)
+	assert.Error(t, err)
+}
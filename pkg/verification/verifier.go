@@ -0,0 +1,84 @@
+package verification
+
+import (
+	"time"
+
+	"github.com/coreos/go-oidc"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/clock"
+	jose "gopkg.in/square/go-jose.v2"
+)
+
+// supportedSigningAlgs are the algorithms tokens may be signed with. Unlike
+// go-oidc's own list, it includes EdDSA, for Ed25519 keys.
+var supportedSigningAlgs = map[string]bool{
+	oidc.RS256:         true,
+	oidc.RS384:         true,
+	oidc.RS512:         true,
+	oidc.ES256:         true,
+	oidc.ES384:         true,
+	oidc.ES512:         true,
+	oidc.PS256:         true,
+	oidc.PS384:         true,
+	oidc.PS512:         true,
+	string(jose.EdDSA): true,
+}
+
+// defaultSigningAlgs are the algorithms tokens may be signed with when the
+// issuer doesn't advertise the algorithms it uses
+var defaultSigningAlgs = []string{oidc.RS256, oidc.ES256, string(jose.EdDSA)}
+
+// Config builds the go-oidc verifier configuration for tokens intended for
+// the given audience, applying the configured verification options
+func Config(audience string, opts options.IDTokenVerificationOptions) *oidc.Config {
+	config := &oidc.Config{
+		ClientID:          audience,
+		SkipIssuerCheck:   opts.InsecureSkipIssuerVerification,
+		SkipClientIDCheck: opts.InsecureSkipAudienceVerification,
+	}
+
+	// go-oidc only checks the expiry against the current time so we allow
+	// for skew by moving the verifier's clock backwards
+	skew := opts.AllowedClockSkew
+	config.Now = func() time.Time {
+		return clock.Now().Add(-skew)
+	}
+	return config
+}
+
+// NewVerifier constructs an IDTokenVerifier for the issuer using the
+// provided key set, for use when OIDC discovery is not available
+func NewVerifier(issuerURL string, keySet oidc.KeySet, audience string, opts options.IDTokenVerificationOptions) *oidc.IDTokenVerifier {
+	config := Config(audience, opts)
+	config.SupportedSigningAlgs = defaultSigningAlgs
+	return oidc.NewVerifier(issuerURL, keySet, config)
+}
+
+// NewProviderVerifier constructs an IDTokenVerifier from a discovered
+// OIDC provider
+func NewProviderVerifier(provider *oidc.Provider, audience string, opts options.IDTokenVerificationOptions) *oidc.IDTokenVerifier {
+	config := Config(audience, opts)
+	config.SupportedSigningAlgs = providerSigningAlgs(provider)
+	return provider.Verifier(config)
+}
+
+// providerSigningAlgs returns the supported algorithms a discovered provider
+// advertises signing ID tokens with, or the defaults if it advertises none
+func providerSigningAlgs(provider *oidc.Provider) []string {
+	var claims struct {
+		Algorithms []string `json:"id_token_signing_alg_values_supported"`
+	}
+	if err := provider.Claims(&claims); err != nil {
+		return defaultSigningAlgs
+	}
+	var algs []string
+	for _, alg := range claims.Algorithms {
+		if supportedSigningAlgs[alg] {
+			algs = append(algs, alg)
+		}
+	}
+	if len(algs) == 0 {
+		return defaultSigningAlgs
+	}
+	return algs
+}
@@ -0,0 +1,84 @@
+package verification
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/apis/options"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/clock"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testIssuer   = "https://issuer.example.com"
+	testAudience = "https://test.myapp.com"
+)
+
+type noOpKeySet struct{}
+
+func (noOpKeySet) VerifySignature(ctx context.Context, jwt string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.Split(jwt, ".")[1])
+}
+
+func newTestToken(t *testing.T, issuer, audience string, expiry time.Time) string {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`))
+	payload, err := json.Marshal(map[string]interface{}{
+		"iss": issuer,
+		"aud": audience,
+		"sub": "1234567890",
+		"exp": expiry.Unix(),
+	})
+	assert.NoError(t, err)
+	return header + "." + base64.RawURLEncoding.EncodeToString(payload) + ".c2lnbmF0dXJl"
+}
+
+func TestConfigDefaults(t *testing.T) {
+	config := Config(testAudience, options.IDTokenVerificationOptions{})
+	assert.Equal(t, testAudience, config.ClientID)
+	assert.False(t, config.SkipIssuerCheck)
+	assert.False(t, config.SkipClientIDCheck)
+}
+
+func TestConfigInsecureOptions(t *testing.T) {
+	config := Config(testAudience, options.IDTokenVerificationOptions{
+		InsecureSkipIssuerVerification:   true,
+		InsecureSkipAudienceVerification: true,
+	})
+	assert.True(t, config.SkipIssuerCheck)
+	assert.True(t, config.SkipClientIDCheck)
+}
+
+func TestVerifierAllowedClockSkew(t *testing.T) {
+	expiry := time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC)
+	clock.Set(clock.NewMock(expiry.Add(30 * time.Second)))
+	defer clock.Reset()
+	token := newTestToken(t, testIssuer, testAudience, expiry)
+
+	verifier := NewVerifier(testIssuer, noOpKeySet{}, testAudience, options.IDTokenVerificationOptions{})
+	_, err := verifier.Verify(context.Background(), token)
+	assert.Error(t, err)
+
+	verifier = NewVerifier(testIssuer, noOpKeySet{}, testAudience, options.IDTokenVerificationOptions{
+		AllowedClockSkew: time.Minute,
+	})
+	_, err = verifier.Verify(context.Background(), token)
+	assert.NoError(t, err)
+}
+
+func TestVerifierAudience(t *testing.T) {
+	token := newTestToken(t, testIssuer, "https://other.myapp.com", time.Now().Add(time.Hour))
+
+	verifier := NewVerifier(testIssuer, noOpKeySet{}, testAudience, options.IDTokenVerificationOptions{})
+	_, err := verifier.Verify(context.Background(), token)
+	assert.Error(t, err)
+
+	verifier = NewVerifier(testIssuer, noOpKeySet{}, testAudience, options.IDTokenVerificationOptions{
+		InsecureSkipAudienceVerification: true,
+	})
+	_, err = verifier.Verify(context.Background(), token)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,130 @@
+package webauthn
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// maxCBORDepth limits the nesting of decoded CBOR items
+const maxCBORDepth = 16
+
+var errMalformedCBOR = errors.New("malformed CBOR")
+
+// decodeCBOR decodes the first CBOR item (RFC 7049) in b, returning it and
+// the bytes after it. Only the definite length encodings produced by
+// authenticators are supported. Maps are decoded to map[interface{}]interface{}
+// with int64 or string keys, integers to int64, byte strings to []byte and
+// text strings to string.
+func decodeCBOR(b []byte) (interface{}, []byte, error) {
+	return decodeCBORItem(b, 0)
+}
+
+func decodeCBORItem(b []byte, depth int) (interface{}, []byte, error) {
+	if depth > maxCBORDepth {
+		return nil, nil, fmt.Errorf("%w: nested too deeply", errMalformedCBOR)
+	}
+	major, arg, rest, err := decodeCBORHead(b)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch major {
+	case 0:
+		if arg > 1<<63-1 {
+			return nil, nil, fmt.Errorf("%w: integer overflows", errMalformedCBOR)
+		}
+		return int64(arg), rest, nil
+	case 1:
+		if arg > 1<<63-1 {
+			return nil, nil, fmt.Errorf("%w: integer overflows", errMalformedCBOR)
+		}
+		return -1 - int64(arg), rest, nil
+	case 2, 3:
+		if arg > uint64(len(rest)) {
+			return nil, nil, fmt.Errorf("%w: string is truncated", errMalformedCBOR)
+		}
+		if major == 2 {
+			return rest[:arg], rest[arg:], nil
+		}
+		return string(rest[:arg]), rest[arg:], nil
+	case 4:
+		if arg > uint64(len(rest)) {
+			return nil, nil, fmt.Errorf("%w: array is truncated", errMalformedCBOR)
+		}
+		items := make([]interface{}, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			var item interface{}
+			if item, rest, err = decodeCBORItem(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+		}
+		return items, rest, nil
+	case 5:
+		if arg > uint64(len(rest)) {
+			return nil, nil, fmt.Errorf("%w: map is truncated", errMalformedCBOR)
+		}
+		m := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			var key, value interface{}
+			if key, rest, err = decodeCBORItem(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, fmt.Errorf("%w: unsupported map key %T", errMalformedCBOR, key)
+			}
+			if value, rest, err = decodeCBORItem(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+			m[key] = value
+		}
+		return m, rest, nil
+	case 6:
+		// tags only annotate the item that follows
+		return decodeCBORItem(rest, depth+1)
+	default:
+		switch arg {
+		case 20:
+			return false, rest, nil
+		case 21:
+			return true, rest, nil
+		case 22, 23:
+			return nil, rest, nil
+		}
+		// floats aren't used by WebAuthn, so are skipped
+		return nil, rest, nil
+	}
+}
+
+// decodeCBORHead decodes the major type and argument of a CBOR item
+func decodeCBORHead(b []byte) (byte, uint64, []byte, error) {
+	if len(b) == 0 {
+		return 0, 0, nil, fmt.Errorf("%w: unexpected end of input", errMalformedCBOR)
+	}
+	major, info, rest := b[0]>>5, b[0]&0x1f, b[1:]
+
+	var size int
+	switch {
+	case info < 24:
+		return major, uint64(info), rest, nil
+	case info == 24:
+		size = 1
+	case info == 25:
+		size = 2
+	case info == 26:
+		size = 4
+	case info == 27:
+		size = 8
+	default:
+		return 0, 0, nil, fmt.Errorf("%w: indefinite lengths are not supported", errMalformedCBOR)
+	}
+	if len(rest) < size {
+		return 0, 0, nil, fmt.Errorf("%w: unexpected end of input", errMalformedCBOR)
+	}
+	buf := make([]byte, 8)
+	copy(buf[8-size:], rest[:size])
+	return major, binary.BigEndian.Uint64(buf), rest[size:], nil
+}
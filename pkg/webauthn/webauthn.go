@@ -0,0 +1,332 @@
+// Package webauthn verifies the WebAuthn registrations and assertions made by
+// browsers with navigator.credentials, so that passkeys can be used as a
+// second factor. Attestation statements aren't verified: users may register
+// any authenticator they hold.
+package webauthn
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/clock"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/encryption"
+)
+
+// Authenticator data flags (WebAuthn section 6.1)
+const (
+	flagUserPresent            = 0x01
+	flagAttestedCredentialData = 0x40
+)
+
+// COSE key parameters (RFC 8152) of the supported algorithms
+const (
+	coseKeyType     = 1
+	coseAlgorithm   = 3
+	coseEC2Curve    = -1
+	coseEC2X        = -2
+	coseEC2Y        = -3
+	coseRSAModulus  = -1
+	coseRSAExponent = -2
+
+	coseKeyTypeEC2 = 2
+	coseKeyTypeRSA = 3
+	coseCurveP256  = 1
+
+	// AlgorithmES256 is ECDSA with P-256 and SHA-256
+	AlgorithmES256 = -7
+	// AlgorithmRS256 is RSASSA-PKCS1-v1_5 with SHA-256
+	AlgorithmRS256 = -257
+)
+
+// challengeSize is the number of random bytes in a challenge
+const challengeSize = 32
+
+// RelyingParty verifies the credentials of a relying party: the domain, ID,
+// that credentials are scoped to, used from pages on any of Origins
+type RelyingParty struct {
+	ID      string
+	Origins []string
+}
+
+// Registration is the response of navigator.credentials.create() with its
+// fields base64url encoded
+type Registration struct {
+	ClientDataJSON    string `json:"clientDataJSON"`
+	AttestationObject string `json:"attestationObject"`
+}
+
+// Assertion is the response of navigator.credentials.get() with its fields
+// base64url encoded
+type Assertion struct {
+	ID                string `json:"id"`
+	ClientDataJSON    string `json:"clientDataJSON"`
+	AuthenticatorData string `json:"authenticatorData"`
+	Signature         string `json:"signature"`
+}
+
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+type authenticatorData struct {
+	flags        byte
+	signCount    uint32
+	credentialID []byte
+	publicKey    []byte
+}
+
+// NewChallenge returns a random base64url encoded challenge
+func NewChallenge() (string, error) {
+	b := make([]byte, challengeSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// VerifyRegistration checks a new credential was created for the challenge,
+// returning the credential to be stored
+func (rp *RelyingParty) VerifyRegistration(r *Registration, challenge string) (*sessions.WebAuthnCredential, error) {
+	rawClientData, err := decodeField("clientDataJSON", r.ClientDataJSON)
+	if err != nil {
+		return nil, err
+	}
+	if err := rp.verifyClientData(rawClientData, "webauthn.create", challenge); err != nil {
+		return nil, err
+	}
+
+	rawAttestation, err := decodeField("attestationObject", r.AttestationObject)
+	if err != nil {
+		return nil, err
+	}
+	attestation, _, err := decodeCBOR(rawAttestation)
+	if err != nil {
+		return nil, fmt.Errorf("invalid attestationObject: %v", err)
+	}
+	m, ok := attestation.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("invalid attestationObject: expected a map")
+	}
+	rawAuthData, ok := m["authData"].([]byte)
+	if !ok {
+		return nil, errors.New("invalid attestationObject: missing authData")
+	}
+	authData, err := rp.parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+	if authData.credentialID == nil {
+		return nil, errors.New("authenticator data has no attested credential")
+	}
+	if _, err := parsePublicKey(authData.publicKey); err != nil {
+		return nil, err
+	}
+
+	return &sessions.WebAuthnCredential{
+		ID:        authData.credentialID,
+		PublicKey: authData.publicKey,
+		SignCount: authData.signCount,
+		CreatedAt: clock.Now(),
+	}, nil
+}
+
+// VerifyAssertion checks that one of the credentials signed the challenge,
+// returning it with its signature counter updated
+func (rp *RelyingParty) VerifyAssertion(a *Assertion, challenge string, credentials []*sessions.WebAuthnCredential) (*sessions.WebAuthnCredential, error) {
+	id, err := decodeField("id", a.ID)
+	if err != nil {
+		return nil, err
+	}
+	var credential *sessions.WebAuthnCredential
+	for _, c := range credentials {
+		if bytes.Equal(c.ID, id) {
+			credential = c
+			break
+		}
+	}
+	if credential == nil {
+		return nil, errors.New("unknown credential")
+	}
+
+	rawClientData, err := decodeField("clientDataJSON", a.ClientDataJSON)
+	if err != nil {
+		return nil, err
+	}
+	if err := rp.verifyClientData(rawClientData, "webauthn.get", challenge); err != nil {
+		return nil, err
+	}
+	rawAuthData, err := decodeField("authenticatorData", a.AuthenticatorData)
+	if err != nil {
+		return nil, err
+	}
+	authData, err := rp.parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := decodeField("signature", a.Signature)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := parsePublicKey(credential.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	// The authenticator signs its data followed by the client data's hash
+	clientDataHash := sha256.Sum256(rawClientData)
+	signed := append(append([]byte{}, rawAuthData...), clientDataHash[:]...)
+	if err := verifySignature(key, signed, signature); err != nil {
+		return nil, err
+	}
+
+	// Authenticators without a counter always report 0
+	if (authData.signCount != 0 || credential.SignCount != 0) && authData.signCount <= credential.SignCount {
+		return nil, fmt.Errorf("signature counter %d is not greater than %d: the authenticator may have been cloned", authData.signCount, credential.SignCount)
+	}
+	credential.SignCount = authData.signCount
+	return credential, nil
+}
+
+func decodeField(name, value string) ([]byte, error) {
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(b) == 0 {
+		return nil, fmt.Errorf("invalid %s", name)
+	}
+	return b, nil
+}
+
+func (rp *RelyingParty) verifyClientData(raw []byte, typ, challenge string) error {
+	var data clientData
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return fmt.Errorf("invalid clientDataJSON: %v", err)
+	}
+	if data.Type != typ {
+		return fmt.Errorf("client data type is %q, expected %q", data.Type, typ)
+	}
+	if challenge == "" || !encryption.SecureCompare(data.Challenge, challenge) {
+		return errors.New("client data challenge does not match")
+	}
+	for _, origin := range rp.Origins {
+		if data.Origin == origin {
+			return nil
+		}
+	}
+	return fmt.Errorf("client data origin %q is not allowed", data.Origin)
+}
+
+func (rp *RelyingParty) parseAuthenticatorData(b []byte) (*authenticatorData, error) {
+	if len(b) < 37 {
+		return nil, errors.New("authenticator data is too short")
+	}
+	rpIDHash := sha256.Sum256([]byte(rp.ID))
+	if !encryption.SecureCompareBytes(b[:32], rpIDHash[:]) {
+		return nil, errors.New("authenticator data is for another relying party")
+	}
+	data := &authenticatorData{
+		flags:     b[32],
+		signCount: binary.BigEndian.Uint32(b[33:37]),
+	}
+	if data.flags&flagUserPresent == 0 {
+		return nil, errors.New("user was not present")
+	}
+	if data.flags&flagAttestedCredentialData == 0 {
+		return data, nil
+	}
+
+	// AAGUID, credential ID length, credential ID, COSE public key
+	rest := b[37:]
+	if len(rest) < 18 {
+		return nil, errors.New("attested credential data is too short")
+	}
+	idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if len(rest) < idLength {
+		return nil, errors.New("attested credential data is too short")
+	}
+	data.credentialID, rest = rest[:idLength], rest[idLength:]
+	_, after, err := decodeCBOR(rest)
+	if err != nil {
+		return nil, fmt.Errorf("invalid credential public key: %v", err)
+	}
+	data.publicKey = rest[:len(rest)-len(after)]
+	return data, nil
+}
+
+// parsePublicKey decodes a COSE public key of a supported algorithm
+func parsePublicKey(b []byte) (crypto.PublicKey, error) {
+	decoded, _, err := decodeCBOR(b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid credential public key: %v", err)
+	}
+	m, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("invalid credential public key: expected a map")
+	}
+	param := func(label int64) []byte {
+		b, _ := m[label].([]byte)
+		return b
+	}
+
+	kty, _ := m[int64(coseKeyType)].(int64)
+	alg, _ := m[int64(coseAlgorithm)].(int64)
+	switch {
+	case kty == coseKeyTypeEC2 && alg == AlgorithmES256:
+		if crv, _ := m[int64(coseEC2Curve)].(int64); crv != coseCurveP256 {
+			return nil, fmt.Errorf("unsupported curve %d", crv)
+		}
+		x, y := param(coseEC2X), param(coseEC2Y)
+		if len(x) != 32 || len(y) != 32 {
+			return nil, errors.New("invalid P-256 public key")
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("invalid P-256 public key")
+		}
+		return key, nil
+	case kty == coseKeyTypeRSA && alg == AlgorithmRS256:
+		n, e := param(coseRSAModulus), param(coseRSAExponent)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("invalid RSA public key")
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	default:
+		return nil, fmt.Errorf("unsupported public key type %d with algorithm %d", kty, alg)
+	}
+}
+
+func verifySignature(key crypto.PublicKey, signed, signature []byte) error {
+	digest := sha256.Sum256(signed)
+	switch key := key.(type) {
+	case *ecdsa.PublicKey:
+		var sig struct{ R, S *big.Int }
+		if rest, err := asn1.Unmarshal(signature, &sig); err != nil || len(rest) != 0 {
+			return errors.New("invalid ECDSA signature")
+		}
+		if !ecdsa.Verify(key, digest[:], sig.R, sig.S) {
+			return errors.New("signature does not match")
+		}
+		return nil
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+			return errors.New("signature does not match")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported public key %T", key)
+	}
+}
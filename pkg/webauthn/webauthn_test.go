@@ -0,0 +1,200 @@
+package webauthn
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"math/big"
+	"testing"
+
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testRP = &RelyingParty{ID: "example.com", Origins: []string{"https://auth.example.com"}}
+
+// encodeCBOR encodes the subset of CBOR used by authenticators
+func encodeCBOR(v interface{}) []byte {
+	head := func(major byte, n uint64) []byte {
+		switch {
+		case n < 24:
+			return []byte{major<<5 | byte(n)}
+		case n < 256:
+			return []byte{major<<5 | 24, byte(n)}
+		default:
+			b := []byte{major<<5 | 25, 0, 0}
+			binary.BigEndian.PutUint16(b[1:], uint16(n))
+			return b
+		}
+	}
+	switch v := v.(type) {
+	case int:
+		if v < 0 {
+			return head(1, uint64(-1-v))
+		}
+		return head(0, uint64(v))
+	case []byte:
+		return append(head(2, uint64(len(v))), v...)
+	case string:
+		return append(head(3, uint64(len(v))), v...)
+	case map[interface{}]interface{}:
+		b := head(5, uint64(len(v)))
+		for key, value := range v {
+			b = append(b, encodeCBOR(key)...)
+			b = append(b, encodeCBOR(value)...)
+		}
+		return b
+	}
+	panic("unsupported type")
+}
+
+// testAuthenticator is a software authenticator with a P-256 key
+type testAuthenticator struct {
+	id        []byte
+	key       *ecdsa.PrivateKey
+	signCount uint32
+}
+
+func newTestAuthenticator(t *testing.T) *testAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	return &testAuthenticator{id: []byte("credential-1"), key: key}
+}
+
+func (a *testAuthenticator) authData(rpID string, attested bool) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	b := append([]byte{}, rpIDHash[:]...)
+	flags := byte(flagUserPresent)
+	if attested {
+		flags |= flagAttestedCredentialData
+	}
+	b = append(b, flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(b[33:], a.signCount)
+	if attested {
+		b = append(b, make([]byte, 16)...)
+		b = append(b, byte(len(a.id)>>8), byte(len(a.id)))
+		b = append(b, a.id...)
+		b = append(b, encodeCBOR(map[interface{}]interface{}{
+			coseKeyType:   coseKeyTypeEC2,
+			coseAlgorithm: AlgorithmES256,
+			coseEC2Curve:  coseCurveP256,
+			coseEC2X:      a.key.X.FillBytes(make([]byte, 32)),
+			coseEC2Y:      a.key.Y.FillBytes(make([]byte, 32)),
+		})...)
+	}
+	return b
+}
+
+func testClientData(typ, challenge, origin string) []byte {
+	b, _ := json.Marshal(clientData{Type: typ, Challenge: challenge, Origin: origin})
+	return b
+}
+
+func (a *testAuthenticator) register(challenge string) *Registration {
+	attestation := encodeCBOR(map[interface{}]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[interface{}]interface{}{},
+		"authData": a.authData(testRP.ID, true),
+	})
+	return &Registration{
+		ClientDataJSON:    base64.RawURLEncoding.EncodeToString(testClientData("webauthn.create", challenge, testRP.Origins[0])),
+		AttestationObject: base64.RawURLEncoding.EncodeToString(attestation),
+	}
+}
+
+func (a *testAuthenticator) assert(t *testing.T, rpID, challenge, origin string) *Assertion {
+	a.signCount++
+	authData := a.authData(rpID, false)
+	clientDataJSON := testClientData("webauthn.get", challenge, origin)
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	r, s, err := ecdsa.Sign(rand.Reader, a.key, digest[:])
+	require.NoError(t, err)
+	signature, err := asn1.Marshal(struct{ R, S *big.Int }{r, s})
+	require.NoError(t, err)
+	return &Assertion{
+		ID:                base64.RawURLEncoding.EncodeToString(a.id),
+		ClientDataJSON:    base64.RawURLEncoding.EncodeToString(clientDataJSON),
+		AuthenticatorData: base64.RawURLEncoding.EncodeToString(authData),
+		Signature:         base64.RawURLEncoding.EncodeToString(signature),
+	}
+}
+
+func TestRegisterAndAssert(t *testing.T) {
+	authenticator := newTestAuthenticator(t)
+	challenge, err := NewChallenge()
+	require.NoError(t, err)
+
+	credential, err := testRP.VerifyRegistration(authenticator.register(challenge), challenge)
+	require.NoError(t, err)
+	assert.Equal(t, authenticator.id, credential.ID)
+
+	_, err = testRP.VerifyRegistration(authenticator.register(challenge), "another-challenge")
+	assert.Error(t, err)
+
+	credentials := []*sessions.WebAuthnCredential{credential}
+	verified, err := testRP.VerifyAssertion(authenticator.assert(t, testRP.ID, challenge, testRP.Origins[0]), challenge, credentials)
+	require.NoError(t, err)
+	assert.Equal(t, uint32(1), verified.SignCount)
+
+	tests := map[string]*Assertion{
+		"wrong challenge":     authenticator.assert(t, testRP.ID, "another-challenge", testRP.Origins[0]),
+		"wrong origin":        authenticator.assert(t, testRP.ID, challenge, "https://evil.example.net"),
+		"wrong relying party": authenticator.assert(t, "evil.example.net", challenge, testRP.Origins[0]),
+		"unknown credential": func() *Assertion {
+			a := newTestAuthenticator(t)
+			a.id = []byte("credential-2")
+			return a.assert(t, testRP.ID, challenge, testRP.Origins[0])
+		}(),
+		"forged by another key": func() *Assertion {
+			a := newTestAuthenticator(t)
+			a.signCount = 10
+			return a.assert(t, testRP.ID, challenge, testRP.Origins[0])
+		}(),
+	}
+	for name, assertion := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := testRP.VerifyAssertion(assertion, challenge, credentials)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestAssertionSignCount(t *testing.T) {
+	authenticator := newTestAuthenticator(t)
+	credential, err := testRP.VerifyRegistration(authenticator.register("challenge"), "challenge")
+	require.NoError(t, err)
+	credentials := []*sessions.WebAuthnCredential{credential}
+
+	authenticator.signCount = 5
+	_, err = testRP.VerifyAssertion(authenticator.assert(t, testRP.ID, "challenge", testRP.Origins[0]), "challenge", credentials)
+	require.NoError(t, err)
+
+	// A replayed or cloned counter is refused
+	authenticator.signCount = 3
+	_, err = testRP.VerifyAssertion(authenticator.assert(t, testRP.ID, "challenge", testRP.Origins[0]), "challenge", credentials)
+	assert.Error(t, err)
+}
+
+func TestDecodeCBOR(t *testing.T) {
+	v, rest, err := decodeCBOR([]byte{0x82, 0x01, 0x38, 0x18, 0xf5})
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{int64(1), int64(-25)}, v)
+	assert.Equal(t, []byte{0xf5}, rest)
+
+	for _, b := range [][]byte{
+		{},
+		{0x5f},                         // indefinite length byte string
+		{0x43, 0x01},                   // truncated byte string
+		{0x9a, 0xff, 0xff, 0xff, 0xff}, // array longer than the input
+	} {
+		_, _, err := decodeCBOR(b)
+		assert.Error(t, err, b)
+	}
+}
@@ -0,0 +1,149 @@
+package oauth2proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/logger"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/requests"
+)
+
+// The modes of the provider startup check
+const (
+	providerCheckWarn = "warn"
+	providerCheckFail = "fail"
+)
+
+// providerCheckTimeout bounds how long each request made to check the
+// provider may take
+const providerCheckTimeout = 10 * time.Second
+
+// providerCheckCode is the authorization code redeemed to check the client
+// credentials. The provider should reject it, but only after authenticating
+// the client.
+const providerCheckCode = "oauth2-proxy-credentials-check"
+
+// rejectedClientErrors are the errors providers give for a token request
+// whose client credentials are wrong
+var rejectedClientErrors = map[string]bool{
+	"invalid_client": true,
+	// GitHub
+	"incorrect_client_credentials": true,
+}
+
+// checkProvider checks that the provider's login and redeem URLs are
+// reachable, and that the provider accepts the client credentials. Any OIDC
+// discovery has already been done by validating the options.
+func checkProvider(ctx context.Context, opts *Options) []ConfigCheck {
+	data := opts.provider.Data()
+	client := &http.Client{
+		Transport: requests.HTTPClient(ctx).Transport,
+		Timeout:   providerCheckTimeout,
+		// A login URL redirecting elsewhere is reachable enough
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	var checks []ConfigCheck
+	if data.LoginURL != nil && data.LoginURL.String() != "" {
+		checks = append(checks, ConfigCheck{Name: "provider login url", Err: checkLoginURL(ctx, client, data.LoginURL)})
+	}
+	if data.RedeemURL != nil && data.RedeemURL.String() != "" {
+		var redirectURL string
+		if opts.redirectURL != nil {
+			redirectURL = opts.redirectURL.String()
+		}
+		clientSecret, err := data.GetClientSecret()
+		if err == nil {
+			err = checkClientCredentials(ctx, client, data.RedeemURL, redirectURL, data.ClientID, clientSecret)
+		}
+		checks = append(checks, ConfigCheck{Name: "provider client credentials", Err: err})
+	}
+	return checks
+}
+
+func checkLoginURL(ctx context.Context, client *http.Client, loginURL *url.URL) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", loginURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("%s returned %s", loginURL, resp.Status)
+	}
+	return nil
+}
+
+// checkClientCredentials redeems a code the provider can't have issued,
+// which providers reject as invalid_grant when the client credentials are
+// right and invalid_client when they are wrong
+func checkClientCredentials(ctx context.Context, client *http.Client, redeemURL *url.URL, redirectURL, clientID, clientSecret string) error {
+	params := url.Values{}
+	params.Add("redirect_uri", redirectURL)
+	params.Add("client_id", clientID)
+	params.Add("client_secret", clientSecret)
+	params.Add("code", providerCheckCode)
+	params.Add("grant_type", "authorization_code")
+
+	req, err := http.NewRequestWithContext(ctx, "POST", redeemURL.String(), strings.NewReader(params.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("%s returned %s", redeemURL, resp.Status)
+	}
+
+	// Like redeeming, blindly try json and x-www-form-urlencoded
+	var result struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(body, &result) != nil {
+		if values, err := url.ParseQuery(string(body)); err == nil {
+			result.Error = values.Get("error")
+		}
+	}
+	if rejectedClientErrors[result.Error] || resp.StatusCode == http.StatusUnauthorized {
+		return fmt.Errorf("the provider rejected the client credentials for %s", clientID)
+	}
+	return nil
+}
+
+// checkProviderAtStartup runs the provider checks if the options ask for
+// them, logging their failures or, in fail mode, returning the first
+func checkProviderAtStartup(ctx context.Context, opts *Options) error {
+	if opts.ProviderStartupCheck == "" {
+		return nil
+	}
+	for _, check := range checkProvider(ctx, opts) {
+		if check.Err == nil {
+			continue
+		}
+		if opts.ProviderStartupCheck == providerCheckFail {
+			return fmt.Errorf("%s check failed: %v", check.Name, check.Err)
+		}
+		logger.Printf("WARNING: %s check failed: %v", check.Name, check.Err)
+	}
+	return nil
+}
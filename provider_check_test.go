@@ -0,0 +1,83 @@
+package oauth2proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newProviderCheckServer(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/login":
+			http.Redirect(rw, req, "/sign_in", http.StatusFound)
+		case "/token":
+			require.NoError(t, req.ParseForm())
+			assert.Equal(t, "authorization_code", req.PostForm.Get("grant_type"))
+			rw.Header().Set("Content-Type", "application/json")
+			if req.PostForm.Get("client_secret") != clientSecret {
+				rw.WriteHeader(http.StatusUnauthorized)
+				rw.Write([]byte(`{"error": "invalid_client"}`))
+				return
+			}
+			rw.WriteHeader(http.StatusBadRequest)
+			rw.Write([]byte(`{"error": "invalid_grant"}`))
+		default:
+			http.NotFound(rw, req)
+		}
+	}))
+}
+
+func TestCheckProvider(t *testing.T) {
+	provider := newProviderCheckServer(t)
+	defer provider.Close()
+
+	opts := testOptions()
+	opts.LoginURL = provider.URL + "/login"
+	opts.RedeemURL = provider.URL + "/token"
+	require.NoError(t, opts.Validate())
+
+	checks := checkProvider(context.Background(), opts)
+	require.Len(t, checks, 2)
+	for _, check := range checks {
+		assert.NoError(t, check.Err, check.Name)
+	}
+
+	opts.provider.Data().ClientSecret = "wrong"
+	checks = checkProvider(context.Background(), opts)
+	assert.NoError(t, checks[0].Err)
+	assert.EqualError(t, checks[1].Err, "the provider rejected the client credentials for "+clientID)
+
+	provider.Close()
+	checks = checkProvider(context.Background(), opts)
+	assert.Error(t, checks[0].Err)
+	assert.Error(t, checks[1].Err)
+}
+
+func TestProviderStartupCheck(t *testing.T) {
+	provider := newProviderCheckServer(t)
+	defer provider.Close()
+
+	for mode, fails := range map[string]bool{"": false, "warn": false, "fail": true} {
+		opts := testOptions()
+		opts.LoginURL = provider.URL + "/login"
+		opts.RedeemURL = provider.URL + "/token"
+		opts.ClientSecret = "wrong"
+		opts.ProviderStartupCheck = mode
+		_, err := New(opts)
+		if fails {
+			assert.EqualError(t, err, "provider client credentials check failed: the provider rejected the client credentials for "+clientID)
+		} else {
+			assert.NoError(t, err, mode)
+		}
+	}
+
+	opts := testOptions()
+	opts.ProviderStartupCheck = "strict"
+	err := opts.Validate()
+	assert.Equal(t, errorMsg([]string{`provider_startup_check (strict) must be one of "warn" or "fail"`}), err.Error())
+}
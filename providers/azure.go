@@ -13,6 +13,7 @@ import (
 
 	"github.com/bitly/go-simplejson"
 	"github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/clock"
 	"github.com/oauth2-proxy/oauth2-proxy/pkg/logger"
 	"github.com/oauth2-proxy/oauth2-proxy/pkg/requests"
 )
@@ -25,6 +26,10 @@ type AzureProvider struct {
 
 var _ Provider = (*AzureProvider)(nil)
 
+func init() {
+	Register("azure", func(p *ProviderData) Provider { return NewAzureProvider(p) })
+}
+
 // NewAzureProvider initiates a new AzureProvider
 func NewAzureProvider(p *ProviderData) *AzureProvider {
 	p.ProviderName = "Azure"
@@ -73,7 +78,7 @@ func (p *AzureProvider) Configure(tenant string) {
 
 func (p *AzureProvider) Redeem(ctx context.Context, redirectURL, code string) (s *sessions.SessionState, err error) {
 	if code == "" {
-		err = errors.New("missing code")
+		err = ErrMissingCode
 		return
 	}
 	clientSecret, err := p.GetClientSecret()
@@ -97,9 +102,10 @@ func (p *AzureProvider) Redeem(ctx context.Context, redirectURL, code string) (s
 		return
 	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	setClientHeaders(req)
 
 	var resp *http.Response
-	resp, err = http.DefaultClient.Do(req)
+	resp, err = requests.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -111,7 +117,7 @@ func (p *AzureProvider) Redeem(ctx context.Context, redirectURL, code string) (s
 	}
 
 	if resp.StatusCode != 200 {
-		err = fmt.Errorf("got %d from %q %s", resp.StatusCode, p.RedeemURL.String(), body)
+		err = &RedeemError{StatusCode: resp.StatusCode, URL: p.RedeemURL.String(), Body: body}
 		return
 	}
 
@@ -129,7 +135,7 @@ func (p *AzureProvider) Redeem(ctx context.Context, redirectURL, code string) (s
 	s = &sessions.SessionState{
 		AccessToken:  jsonResponse.AccessToken,
 		IDToken:      jsonResponse.IDToken,
-		CreatedAt:    time.Now(),
+		CreatedAt:    clock.Now(),
 		ExpiresOn:    time.Unix(jsonResponse.ExpiresOn, 0),
 		RefreshToken: jsonResponse.RefreshToken,
 	}
@@ -161,12 +167,19 @@ func getEmailFromJSON(json *simplejson.Json) (string, error) {
 
 // GetEmailAddress returns the Account email address
 func (p *AzureProvider) GetEmailAddress(ctx context.Context, s *sessions.SessionState) (string, error) {
-	var email string
-	var err error
-
 	if s.AccessToken == "" {
 		return "", errors.New("missing access token")
 	}
+	return p.cachedLookup(ctx, "email", s.AccessToken, func() (string, error) {
+		return p.getEmailAddress(ctx, s)
+	})
+}
+
+// getEmailAddress looks up the Account email address from the Graph API
+func (p *AzureProvider) getEmailAddress(ctx context.Context, s *sessions.SessionState) (string, error) {
+	var email string
+	var err error
+
 	req, err := http.NewRequestWithContext(ctx, "GET", p.ProfileURL.String(), nil)
 	if err != nil {
 		return "", err
@@ -20,6 +20,10 @@ type BitbucketProvider struct {
 
 var _ Provider = (*BitbucketProvider)(nil)
 
+func init() {
+	Register("bitbucket", func(p *ProviderData) Provider { return NewBitbucketProvider(p) })
+}
+
 // NewBitbucketProvider initiates a new BitbucketProvider
 func NewBitbucketProvider(p *ProviderData) *BitbucketProvider {
 	p.ProviderName = "Bitbucket"
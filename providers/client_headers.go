@@ -0,0 +1,57 @@
+package providers
+
+import (
+	"context"
+	"net/http"
+
+	"golang.org/x/oauth2"
+)
+
+type clientHeadersKey struct{}
+
+// WithClientHeaders returns a copy of ctx carrying headers from the client's
+// request, which are added to the requests made to the provider's token
+// endpoint when redeeming or refreshing tokens with that context. Some
+// identity providers use them to score the risk of a login.
+func WithClientHeaders(ctx context.Context, header http.Header) context.Context {
+	if len(header) == 0 {
+		return ctx
+	}
+	return context.WithValue(ctx, clientHeadersKey{}, header)
+}
+
+// setClientHeaders adds the client headers carried by the request's context
+// to the request
+func setClientHeaders(req *http.Request) {
+	header, _ := req.Context().Value(clientHeadersKey{}).(http.Header)
+	for name, values := range header {
+		req.Header[name] = append([]string(nil), values...)
+	}
+}
+
+// clientHeadersContext returns ctx configured so that requests made by the
+// oauth2 package carry the client headers in ctx
+func clientHeadersContext(ctx context.Context) context.Context {
+	if _, ok := ctx.Value(clientHeadersKey{}).(http.Header); !ok {
+		return ctx
+	}
+	base := http.DefaultTransport
+	if c, ok := ctx.Value(oauth2.HTTPClient).(*http.Client); ok && c.Transport != nil {
+		base = c.Transport
+	}
+	client := &http.Client{Transport: clientHeadersTransport{base: base}}
+	return context.WithValue(ctx, oauth2.HTTPClient, client)
+}
+
+// clientHeadersTransport adds the client headers to each request it makes
+type clientHeadersTransport struct {
+	base http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper
+func (t clientHeadersTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrippers must not modify the request they are given
+	req = req.Clone(req.Context())
+	setClientHeaders(req)
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,75 @@
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+)
+
+func newClientHeadersServer(t *testing.T, received *http.Header) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		*received = r.Header.Clone()
+		rw.Header().Set("Content-Type", "application/json")
+		body, err := json.Marshal(redeemTokenResponse{
+			AccessToken:  accessToken,
+			ExpiresIn:    10,
+			TokenType:    "Bearer",
+			RefreshToken: refreshToken,
+		})
+		assert.NoError(t, err)
+		rw.Write(body)
+	}))
+}
+
+func withTestClientHeaders(ctx context.Context) context.Context {
+	return WithClientHeaders(ctx, http.Header{
+		"X-Forwarded-For": []string{"203.0.113.7"},
+		"X-Device-Id":     []string{"device-1"},
+	})
+}
+
+func TestRedeemWithClientHeaders(t *testing.T) {
+	var received http.Header
+	b := newClientHeadersServer(t, &received)
+	defer b.Close()
+
+	redeemURL, _ := url.Parse(b.URL + "/token")
+	p := &ProviderData{RedeemURL: redeemURL, ClientSecret: "secret"}
+	_, err := p.Redeem(withTestClientHeaders(context.Background()), "https://example.com/oauth2/callback", "code1234")
+	assert.NoError(t, err)
+	assert.Equal(t, "203.0.113.7", received.Get("X-Forwarded-For"))
+	assert.Equal(t, "device-1", received.Get("X-Device-Id"))
+	assert.Equal(t, "application/x-www-form-urlencoded", received.Get("Content-Type"))
+}
+
+func TestOIDCRefreshWithClientHeaders(t *testing.T) {
+	var received http.Header
+	b := newClientHeadersServer(t, &received)
+	defer b.Close()
+
+	serverURL, _ := url.Parse(b.URL)
+	p := newOIDCProvider(serverURL)
+	_, err := p.RefreshSessionIfNeeded(withTestClientHeaders(context.Background()), &sessions.SessionState{
+		RefreshToken: refreshToken,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "203.0.113.7", received.Get("X-Forwarded-For"))
+	assert.Equal(t, "device-1", received.Get("X-Device-Id"))
+}
+
+func TestOIDCRefreshWithoutClientHeaders(t *testing.T) {
+	var received http.Header
+	b := newClientHeadersServer(t, &received)
+	defer b.Close()
+
+	serverURL, _ := url.Parse(b.URL)
+	p := newOIDCProvider(serverURL)
+	p.RefreshSessionIfNeeded(context.Background(), &sessions.SessionState{RefreshToken: refreshToken})
+	assert.Equal(t, "", received.Get("X-Device-Id"))
+}
@@ -18,6 +18,10 @@ type DigitalOceanProvider struct {
 
 var _ Provider = (*DigitalOceanProvider)(nil)
 
+func init() {
+	Register("digitalocean", func(p *ProviderData) Provider { return NewDigitalOceanProvider(p) })
+}
+
 // NewDigitalOceanProvider initiates a new DigitalOceanProvider
 func NewDigitalOceanProvider(p *ProviderData) *DigitalOceanProvider {
 	p.ProviderName = "DigitalOcean"
@@ -0,0 +1,148 @@
+package providers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/oauth2"
+)
+
+var (
+	// ErrNotImplemented is returned by providers that don't support an
+	// optional Provider method
+	ErrNotImplemented = errors.New("not implemented")
+
+	// ErrMissingCode is returned when redeeming an empty authorization code
+	ErrMissingCode = errors.New("missing code")
+
+	// ErrRedeem is matched by errors returned when the identity provider
+	// rejects an attempt to redeem an authorization code
+	ErrRedeem = errors.New("unable to redeem code")
+
+	// ErrProviderUnavailable is matched by errors returned when the identity
+	// provider can't be reached or fails with a server error, which may
+	// succeed if retried later
+	ErrProviderUnavailable = errors.New("provider unavailable")
+
+	// ErrInvalidGrant is matched by errors returned when the identity
+	// provider rejects a refresh token, or authorization code, as invalid,
+	// expired or revoked, which won't succeed if retried: the user must sign
+	// in again
+	ErrInvalidGrant = errors.New("invalid grant")
+
+	// ErrInvalidCredentials is returned when a user signs in with a wrong
+	// username or password
+	ErrInvalidCredentials = errors.New("invalid credentials")
+
+	// ErrUnverifiedEmail is matched by errors returned when the identity
+	// provider authenticates a user whose email address it hasn't verified
+	ErrUnverifiedEmail = errors.New("email isn't verified")
+)
+
+// UnverifiedEmailError is returned when the identity provider authenticates
+// a user whose email address it hasn't verified. It matches
+// ErrUnverifiedEmail with errors.Is.
+type UnverifiedEmailError struct {
+	Email string
+}
+
+// Error implements the error interface
+func (e *UnverifiedEmailError) Error() string {
+	return fmt.Sprintf("email %s isn't verified", e.Email)
+}
+
+// Is allows UnverifiedEmailError to be matched against ErrUnverifiedEmail
+func (e *UnverifiedEmailError) Is(target error) bool {
+	return target == ErrUnverifiedEmail
+}
+
+// RedeemError describes an unsuccessful response from the provider's token
+// endpoint. It matches ErrRedeem with errors.Is, ErrInvalidGrant for
+// invalid_grant errors, and ErrProviderUnavailable for server errors and
+// rate limiting.
+type RedeemError struct {
+	StatusCode int
+	URL        string
+	Body       []byte
+}
+
+// Error implements the error interface
+func (e *RedeemError) Error() string {
+	return fmt.Sprintf("got %d from %q %s", e.StatusCode, e.URL, e.Body)
+}
+
+// Is allows RedeemError to be matched against ErrRedeem, ErrInvalidGrant
+// and ErrProviderUnavailable
+func (e *RedeemError) Is(target error) bool {
+	switch target {
+	case ErrRedeem:
+		return true
+	case ErrInvalidGrant:
+		return e.Code() == "invalid_grant"
+	case ErrProviderUnavailable:
+		return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+	}
+	return false
+}
+
+// Code returns the OAuth 2.0 error code of the response, eg.
+// "invalid_grant", from its JSON or form encoded body, or "" if it has none
+func (e *RedeemError) Code() string {
+	var body struct {
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(e.Body, &body); err == nil {
+		return body.Error
+	}
+	if values, err := url.ParseQuery(string(e.Body)); err == nil {
+		return values.Get("error")
+	}
+	return ""
+}
+
+// unavailableError wraps a network error talking to the provider so that it
+// matches ErrProviderUnavailable
+type unavailableError struct {
+	err error
+}
+
+func (e *unavailableError) Error() string {
+	return e.err.Error()
+}
+
+func (e *unavailableError) Unwrap() error {
+	return e.err
+}
+
+func (e *unavailableError) Is(target error) bool {
+	return target == ErrProviderUnavailable
+}
+
+// tokenExchangeError converts an error response from the token endpoint
+// returned by the oauth2 package into a RedeemError, marking network errors
+// as ErrProviderUnavailable
+func tokenExchangeError(err error, tokenURL string) error {
+	var retrieveErr *oauth2.RetrieveError
+	if errors.As(err, &retrieveErr) && retrieveErr.Response != nil {
+		return &RedeemError{
+			StatusCode: retrieveErr.Response.StatusCode,
+			URL:        tokenURL,
+			Body:       retrieveErr.Body,
+		}
+	}
+	return networkError(err)
+}
+
+// networkError marks network errors, such as timeouts and refused
+// connections, as ErrProviderUnavailable
+func networkError(err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return &unavailableError{err: err}
+	}
+	return err
+}
@@ -18,6 +18,10 @@ type FacebookProvider struct {
 
 var _ Provider = (*FacebookProvider)(nil)
 
+func init() {
+	Register("facebook", func(p *ProviderData) Provider { return NewFacebookProvider(p) })
+}
+
 // NewFacebookProvider initiates a new FacebookProvider
 func NewFacebookProvider(p *ProviderData) *FacebookProvider {
 	p.ProviderName = "Facebook"
@@ -14,6 +14,7 @@ import (
 
 	"github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
 	"github.com/oauth2-proxy/oauth2-proxy/pkg/logger"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/requests"
 )
 
 // GitHubProvider represents an GitHub based Identity Provider
@@ -27,6 +28,10 @@ type GitHubProvider struct {
 
 var _ Provider = (*GitHubProvider)(nil)
 
+func init() {
+	Register("github", func(p *ProviderData) Provider { return NewGitHubProvider(p) })
+}
+
 // NewGitHubProvider initiates a new GitHubProvider
 func NewGitHubProvider(p *ProviderData) *GitHubProvider {
 	p.ProviderName = "GitHub"
@@ -106,7 +111,7 @@ func (p *GitHubProvider) hasOrg(ctx context.Context, accessToken string) (bool,
 		}
 		req, _ := http.NewRequestWithContext(ctx, "GET", endpoint.String(), nil)
 		req.Header = getGitHubHeader(accessToken)
-		resp, err := http.DefaultClient.Do(req)
+		resp, err := requests.Do(req)
 		if err != nil {
 			return false, err
 		}
@@ -182,7 +187,7 @@ func (p *GitHubProvider) hasOrgAndTeam(ctx context.Context, accessToken string)
 
 		req, _ := http.NewRequestWithContext(ctx, "GET", endpoint.String(), nil)
 		req.Header = getGitHubHeader(accessToken)
-		resp, err := http.DefaultClient.Do(req)
+		resp, err := requests.Do(req)
 		if err != nil {
 			return false, err
 		}
@@ -292,7 +297,7 @@ func (p *GitHubProvider) hasRepo(ctx context.Context, accessToken string) (bool,
 
 	req, _ := http.NewRequestWithContext(ctx, "GET", endpoint.String(), nil)
 	req.Header = getGitHubHeader(accessToken)
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := requests.Do(req)
 	if err != nil {
 		return false, err
 	}
@@ -327,7 +332,7 @@ func (p *GitHubProvider) isCollaborator(ctx context.Context, username, accessTok
 	}
 	req, _ := http.NewRequestWithContext(ctx, "GET", endpoint.String(), nil)
 	req.Header = getGitHubHeader(accessToken)
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := requests.Do(req)
 	if err != nil {
 		return false, err
 	}
@@ -349,6 +354,14 @@ func (p *GitHubProvider) isCollaborator(ctx context.Context, username, accessTok
 
 // GetEmailAddress returns the Account email address
 func (p *GitHubProvider) GetEmailAddress(ctx context.Context, s *sessions.SessionState) (string, error) {
+	return p.cachedLookup(ctx, "email", s.AccessToken, func() (string, error) {
+		return p.getEmailAddress(ctx, s)
+	})
+}
+
+// getEmailAddress looks up the Account email address, checking the org, team
+// or repo first when they're required
+func (p *GitHubProvider) getEmailAddress(ctx context.Context, s *sessions.SessionState) (string, error) {
 
 	var emails []struct {
 		Email    string `json:"email"`
@@ -380,7 +393,7 @@ func (p *GitHubProvider) GetEmailAddress(ctx context.Context, s *sessions.Sessio
 	}
 	req, _ := http.NewRequestWithContext(ctx, "GET", endpoint.String(), nil)
 	req.Header = getGitHubHeader(s.AccessToken)
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := requests.Do(req)
 	if err != nil {
 		return "", err
 	}
@@ -416,6 +429,14 @@ func (p *GitHubProvider) GetEmailAddress(ctx context.Context, s *sessions.Sessio
 
 // GetUserName returns the Account user name
 func (p *GitHubProvider) GetUserName(ctx context.Context, s *sessions.SessionState) (string, error) {
+	return p.cachedLookup(ctx, "user", s.AccessToken, func() (string, error) {
+		return p.getUserName(ctx, s)
+	})
+}
+
+// getUserName looks up the Account user name, checking the user is a
+// collaborator on the repo when a token is given for it
+func (p *GitHubProvider) getUserName(ctx context.Context, s *sessions.SessionState) (string, error) {
 	var user struct {
 		Login string `json:"login"`
 		Email string `json:"email"`
@@ -433,7 +454,7 @@ func (p *GitHubProvider) GetUserName(ctx context.Context, s *sessions.SessionSta
 	}
 
 	req.Header = getGitHubHeader(s.AccessToken)
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := requests.Do(req)
 	if err != nil {
 		return "", err
 	}
@@ -11,6 +11,8 @@ import (
 
 	oidc "github.com/coreos/go-oidc"
 	"github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/clock"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/requests"
 	"golang.org/x/oauth2"
 )
 
@@ -27,6 +29,10 @@ type GitLabProvider struct {
 
 var _ Provider = (*GitLabProvider)(nil)
 
+func init() {
+	Register("gitlab", func(p *ProviderData) Provider { return NewGitLabProvider(p) })
+}
+
 // NewGitLabProvider initiates a new GitLabProvider
 func NewGitLabProvider(p *ProviderData) *GitLabProvider {
 	p.ProviderName = "GitLab"
@@ -53,9 +59,9 @@ func (p *GitLabProvider) Redeem(ctx context.Context, redirectURL, code string) (
 		},
 		RedirectURL: redirectURL,
 	}
-	token, err := c.Exchange(ctx, code)
+	token, err := c.Exchange(clientHeadersContext(ctx), code)
 	if err != nil {
-		return nil, fmt.Errorf("token exchange: %v", err)
+		return nil, fmt.Errorf("token exchange: %w", tokenExchangeError(err, p.RedeemURL.String()))
 	}
 	s, err = p.createSessionState(ctx, token)
 	if err != nil {
@@ -67,7 +73,7 @@ func (p *GitLabProvider) Redeem(ctx context.Context, redirectURL, code string) (
 // RefreshSessionIfNeeded checks if the session has expired and uses the
 // RefreshToken to fetch a new ID token if required
 func (p *GitLabProvider) RefreshSessionIfNeeded(ctx context.Context, s *sessions.SessionState) (bool, error) {
-	if s == nil || s.ExpiresOn.After(time.Now()) || s.RefreshToken == "" {
+	if s == nil || !p.refreshDue(s) || s.RefreshToken == "" {
 		return false, nil
 	}
 
@@ -75,7 +81,7 @@ func (p *GitLabProvider) RefreshSessionIfNeeded(ctx context.Context, s *sessions
 
 	err := p.redeemRefreshToken(ctx, s)
 	if err != nil {
-		return false, fmt.Errorf("unable to redeem refresh token: %v", err)
+		return false, fmt.Errorf("unable to redeem refresh token: %w", err)
 	}
 
 	fmt.Printf("refreshed id token %s (expired on %s)\n", s, origExpiration)
@@ -97,11 +103,11 @@ func (p *GitLabProvider) redeemRefreshToken(ctx context.Context, s *sessions.Ses
 	}
 	t := &oauth2.Token{
 		RefreshToken: s.RefreshToken,
-		Expiry:       time.Now().Add(-time.Hour),
+		Expiry:       clock.Now().Add(-time.Hour),
 	}
-	token, err := c.TokenSource(ctx, t).Token()
+	token, err := c.TokenSource(clientHeadersContext(ctx), t).Token()
 	if err != nil {
-		return fmt.Errorf("failed to get token: %v", err)
+		return fmt.Errorf("failed to get token: %w", tokenExchangeError(err, p.RedeemURL.String()))
 	}
 	newSession, err := p.createSessionState(ctx, token)
 	if err != nil {
@@ -137,7 +143,7 @@ func (p *GitLabProvider) getUserInfo(ctx context.Context, s *sessions.SessionSta
 	}
 	req.Header.Set("Authorization", "Bearer "+s.AccessToken)
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := requests.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("failed to perform user info request: %v", err)
 	}
@@ -213,7 +219,7 @@ func (p *GitLabProvider) createSessionState(ctx context.Context, token *oauth2.T
 		AccessToken:  token.AccessToken,
 		IDToken:      rawIDToken,
 		RefreshToken: token.RefreshToken,
-		CreatedAt:    time.Now(),
+		CreatedAt:    clock.Now(),
 		ExpiresOn:    idToken.Expiry,
 	}, nil
 }
@@ -1,3 +1,6 @@
+//go:build !no_google
+// +build !no_google
+
 package providers
 
 import (
@@ -15,7 +18,9 @@ import (
 	"time"
 
 	"github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/clock"
 	"github.com/oauth2-proxy/oauth2-proxy/pkg/logger"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/requests"
 	"golang.org/x/oauth2/google"
 	admin "google.golang.org/api/admin/directory/v1"
 	"google.golang.org/api/googleapi"
@@ -28,11 +33,15 @@ type GoogleProvider struct {
 	RedeemRefreshURL *url.URL
 	// GroupValidator is a function that determines if the passed email is in
 	// the configured Google group.
-	GroupValidator func(string) bool
+	GroupValidator func(context.Context, string) bool
 }
 
 var _ Provider = (*GoogleProvider)(nil)
 
+func init() {
+	Register("google", func(p *ProviderData) Provider { return NewGoogleProvider(p) })
+}
+
 type claims struct {
 	Subject       string `json:"sub"`
 	Email         string `json:"email"`
@@ -68,7 +77,7 @@ func NewGoogleProvider(p *ProviderData) *GoogleProvider {
 		ProviderData: p,
 		// Set a default GroupValidator to just always return valid (true), it will
 		// be overwritten if we configured a Google group restriction.
-		GroupValidator: func(email string) bool {
+		GroupValidator: func(ctx context.Context, email string) bool {
 			return true
 		},
 	}
@@ -94,7 +103,7 @@ func claimsFromIDToken(idToken string) (*claims, error) {
 		return nil, errors.New("missing email")
 	}
 	if !c.EmailVerified {
-		return nil, fmt.Errorf("email %s not listed as verified", c.Email)
+		return nil, &UnverifiedEmailError{Email: c.Email}
 	}
 	return c, nil
 }
@@ -102,7 +111,7 @@ func claimsFromIDToken(idToken string) (*claims, error) {
 // Redeem exchanges the OAuth2 authentication token for an ID token
 func (p *GoogleProvider) Redeem(ctx context.Context, redirectURL, code string) (s *sessions.SessionState, err error) {
 	if code == "" {
-		err = errors.New("missing code")
+		err = ErrMissingCode
 		return
 	}
 	clientSecret, err := p.GetClientSecret()
@@ -122,8 +131,9 @@ func (p *GoogleProvider) Redeem(ctx context.Context, redirectURL, code string) (
 		return
 	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	setClientHeaders(req)
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := requests.Do(req)
 	if err != nil {
 		return
 	}
@@ -135,7 +145,7 @@ func (p *GoogleProvider) Redeem(ctx context.Context, redirectURL, code string) (
 	}
 
 	if resp.StatusCode != 200 {
-		err = fmt.Errorf("got %d from %q %s", resp.StatusCode, p.RedeemURL.String(), body)
+		err = &RedeemError{StatusCode: resp.StatusCode, URL: p.RedeemURL.String(), Body: body}
 		return
 	}
 
@@ -156,8 +166,8 @@ func (p *GoogleProvider) Redeem(ctx context.Context, redirectURL, code string) (
 	s = &sessions.SessionState{
 		AccessToken:  jsonResponse.AccessToken,
 		IDToken:      jsonResponse.IDToken,
-		CreatedAt:    time.Now(),
-		ExpiresOn:    time.Now().Add(time.Duration(jsonResponse.ExpiresIn) * time.Second).Truncate(time.Second),
+		CreatedAt:    clock.Now(),
+		ExpiresOn:    clock.Now().Add(time.Duration(jsonResponse.ExpiresIn) * time.Second).Truncate(time.Second),
 		RefreshToken: jsonResponse.RefreshToken,
 		Email:        c.Email,
 		User:         c.Subject,
@@ -171,11 +181,22 @@ func (p *GoogleProvider) Redeem(ctx context.Context, redirectURL, code string) (
 // account credentials.
 func (p *GoogleProvider) SetGroupRestriction(groups []string, adminEmail string, credentialsReader io.Reader) {
 	adminService := getAdminService(adminEmail, credentialsReader)
-	p.GroupValidator = func(email string) bool {
-		return userInGroup(adminService, groups, email)
+	p.GroupValidator = func(ctx context.Context, email string) bool {
+		// Membership is cached by email rather than access token. Only
+		// members are cached, so that failed checks are retried.
+		_, err := p.cachedLookup(ctx, "group", email, func() (string, error) {
+			if !userInGroup(ctx, adminService, groups, email) {
+				return "", errNotInGroup
+			}
+			return "true", nil
+		})
+		return err == nil
 	}
 }
 
+// errNotInGroup is returned by group lookups for users outside the groups
+var errNotInGroup = errors.New("not in the group(s)")
+
 func getAdminService(adminEmail string, credentialsReader io.Reader) *admin.Service {
 	data, err := ioutil.ReadAll(credentialsReader)
 	if err != nil {
@@ -196,10 +217,10 @@ func getAdminService(adminEmail string, credentialsReader io.Reader) *admin.Serv
 	return adminService
 }
 
-func userInGroup(service *admin.Service, groups []string, email string) bool {
+func userInGroup(ctx context.Context, service *admin.Service, groups []string, email string) bool {
 	for _, group := range groups {
 		// Use the HasMember API to checking for the user's presence in each group or nested subgroups
-		req := service.Members.HasMember(group, email)
+		req := service.Members.HasMember(group, email).Context(ctx)
 		r, err := req.Do()
 		if err != nil {
 			gerr, ok := err.(*googleapi.Error)
@@ -211,7 +232,7 @@ func userInGroup(service *admin.Service, groups []string, email string) bool {
 				// One case that can cause this is if the user email is from a different domain than the group,
 				// e.g. "member@otherdomain.com" in the group "group@mydomain.com" will result in a 400 error
 				// from the HasMember API. In that case, attempt to query the member object directly from the group.
-				req := service.Members.Get(group, email)
+				req := service.Members.Get(group, email).Context(ctx)
 				r, err := req.Do()
 
 				if err != nil {
@@ -238,14 +259,14 @@ func userInGroup(service *admin.Service, groups []string, email string) bool {
 
 // ValidateGroup validates that the provided email exists in the configured Google
 // group(s).
-func (p *GoogleProvider) ValidateGroup(email string) bool {
-	return p.GroupValidator(email)
+func (p *GoogleProvider) ValidateGroup(ctx context.Context, email string) bool {
+	return p.GroupValidator(ctx, email)
 }
 
 // RefreshSessionIfNeeded checks if the session has expired and uses the
 // RefreshToken to fetch a new ID token if required
 func (p *GoogleProvider) RefreshSessionIfNeeded(ctx context.Context, s *sessions.SessionState) (bool, error) {
-	if s == nil || s.ExpiresOn.After(time.Now()) || s.RefreshToken == "" {
+	if s == nil || !p.refreshDue(s) || s.RefreshToken == "" {
 		return false, nil
 	}
 
@@ -255,14 +276,14 @@ func (p *GoogleProvider) RefreshSessionIfNeeded(ctx context.Context, s *sessions
 	}
 
 	// re-check that the user is in the proper google group(s)
-	if !p.ValidateGroup(s.Email) {
+	if !p.ValidateGroup(ctx, s.Email) {
 		return false, fmt.Errorf("%s is no longer in the group(s)", s.Email)
 	}
 
 	origExpiration := s.ExpiresOn
 	s.AccessToken = newToken
 	s.IDToken = newIDToken
-	s.ExpiresOn = time.Now().Add(duration).Truncate(time.Second)
+	s.ExpiresOn = clock.Now().Add(duration).Truncate(time.Second)
 	logger.Printf("refreshed access token %s (expired on %s)", s, origExpiration)
 	return true, nil
 }
@@ -285,9 +306,11 @@ func (p *GoogleProvider) redeemRefreshToken(ctx context.Context, refreshToken st
 		return
 	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	setClientHeaders(req)
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := requests.Do(req)
 	if err != nil {
+		err = networkError(err)
 		return
 	}
 	var body []byte
@@ -298,7 +321,7 @@ func (p *GoogleProvider) redeemRefreshToken(ctx context.Context, refreshToken st
 	}
 
 	if resp.StatusCode != 200 {
-		err = fmt.Errorf("got %d from %q %s", resp.StatusCode, p.RedeemURL.String(), body)
+		err = &RedeemError{StatusCode: resp.StatusCode, URL: p.RedeemURL.String(), Body: body}
 		return
 	}
 
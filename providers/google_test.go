@@ -1,9 +1,13 @@
+//go:build !no_google
+// +build !no_google
+
 package providers
 
 import (
 	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -112,19 +116,19 @@ func TestGoogleProviderGetEmailAddress(t *testing.T) {
 
 func TestGoogleProviderValidateGroup(t *testing.T) {
 	p := newGoogleProvider()
-	p.GroupValidator = func(email string) bool {
+	p.GroupValidator = func(ctx context.Context, email string) bool {
 		return email == "michael.bland@gsa.gov"
 	}
-	assert.Equal(t, true, p.ValidateGroup("michael.bland@gsa.gov"))
-	p.GroupValidator = func(email string) bool {
+	assert.Equal(t, true, p.ValidateGroup(context.Background(), "michael.bland@gsa.gov"))
+	p.GroupValidator = func(ctx context.Context, email string) bool {
 		return email != "michael.bland@gsa.gov"
 	}
-	assert.Equal(t, false, p.ValidateGroup("michael.bland@gsa.gov"))
+	assert.Equal(t, false, p.ValidateGroup(context.Background(), "michael.bland@gsa.gov"))
 }
 
 func TestGoogleProviderWithoutValidateGroup(t *testing.T) {
 	p := newGoogleProvider()
-	assert.Equal(t, true, p.ValidateGroup("michael.bland@gsa.gov"))
+	assert.Equal(t, true, p.ValidateGroup(context.Background(), "michael.bland@gsa.gov"))
 }
 
 //
@@ -197,6 +201,25 @@ func TestGoogleProviderGetEmailAddressEmailMissing(t *testing.T) {
 
 }
 
+func TestGoogleProviderGetEmailAddressEmailNotVerified(t *testing.T) {
+	p := newGoogleProvider()
+	body, err := json.Marshal(redeemResponse{
+		AccessToken: "a1234",
+		IDToken:     "ignored prefix." + base64.RawURLEncoding.EncodeToString([]byte(`{"email": "michael.bland@gsa.gov", "email_verified":false}`)),
+	})
+	assert.Equal(t, nil, err)
+	var server *httptest.Server
+	p.RedeemURL, server = newRedeemServer(body)
+	defer server.Close()
+
+	_, err = p.Redeem(context.Background(), "http://redirect/", "code1234")
+	assert.True(t, errors.Is(err, ErrUnverifiedEmail))
+	var unverified *UnverifiedEmailError
+	if assert.True(t, errors.As(err, &unverified)) {
+		assert.Equal(t, "michael.bland@gsa.gov", unverified.Email)
+	}
+}
+
 func TestGoogleProviderUserInGroup(t *testing.T) {
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path == "/groups/group@example.com/hasMember/member-in-domain@example.com" {
@@ -237,15 +260,31 @@ func TestGoogleProviderUserInGroup(t *testing.T) {
 	service.BasePath = ts.URL
 	assert.Equal(t, nil, err)
 
-	result := userInGroup(service, []string{"group@example.com"}, "member-in-domain@example.com")
+	result := userInGroup(ctx, service, []string{"group@example.com"}, "member-in-domain@example.com")
 	assert.True(t, result)
 
-	result = userInGroup(service, []string{"group@example.com"}, "member-out-of-domain@otherexample.com")
+	result = userInGroup(ctx, service, []string{"group@example.com"}, "member-out-of-domain@otherexample.com")
 	assert.True(t, result)
 
-	result = userInGroup(service, []string{"group@example.com"}, "non-member-in-domain@example.com")
+	result = userInGroup(ctx, service, []string{"group@example.com"}, "non-member-in-domain@example.com")
+	assert.False(t, result)
+
+	result = userInGroup(ctx, service, []string{"group@example.com"}, "non-member-out-of-domain@otherexample.com")
 	assert.False(t, result)
+}
+
+func TestGoogleProviderUserInGroupCanceledContext(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, `{"isMember": true}`)
+	}))
+	defer ts.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	service, err := admin.NewService(ctx, option.WithHTTPClient(ts.Client()))
+	service.BasePath = ts.URL
+	assert.Equal(t, nil, err)
 
-	result = userInGroup(service, []string{"group@example.com"}, "non-member-out-of-domain@otherexample.com")
+	cancel()
+	result := userInGroup(ctx, service, []string{"group@example.com"}, "member-in-domain@example.com")
 	assert.False(t, result)
 }
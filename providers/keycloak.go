@@ -17,6 +17,10 @@ type KeycloakProvider struct {
 
 var _ Provider = (*KeycloakProvider)(nil)
 
+func init() {
+	Register("keycloak", func(p *ProviderData) Provider { return NewKeycloakProvider(p) })
+}
+
 func NewKeycloakProvider(p *ProviderData) *KeycloakProvider {
 	p.ProviderName = "Keycloak"
 	if p.LoginURL == nil || p.LoginURL.String() == "" {
@@ -0,0 +1,169 @@
+//go:build !no_ldap
+// +build !no_ldap
+
+package providers
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/clock"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/ldap"
+)
+
+// ldapConn is the subset of an *ldap.Conn used by the LDAP provider
+type ldapConn interface {
+	Bind(dn, password string) error
+	Search(baseDN, attribute, value string, attributes []string) ([]*ldap.Entry, error)
+	Close() error
+}
+
+// LDAPProvider authenticates users by binding to an LDAP or Active Directory
+// server with their credentials
+type LDAPProvider struct {
+	*ProviderData
+
+	URL          string
+	BindDN       string
+	BindPassword string
+	BaseDN       string
+	// UserAttribute is matched against the username to find a user's entry,
+	// eg. "uid", or "sAMAccountName" for Active Directory
+	UserAttribute  string
+	EmailAttribute string
+	GroupAttribute string
+	// Groups restricts sign in to members of any of these groups, given as
+	// DNs or CNs
+	Groups    []string
+	TLSConfig *tls.Config
+	Timeout   time.Duration
+	// InsecurePlaintext skips starting TLS on connections to ldap:// URLs,
+	// sending passwords in the clear
+	InsecurePlaintext bool
+
+	dial func() (ldapConn, error)
+}
+
+var _ Provider = (*LDAPProvider)(nil)
+
+var _ PasswordProvider = (*LDAPProvider)(nil)
+
+func init() {
+	Register("ldap", func(p *ProviderData) Provider { return NewLDAPProvider(p) })
+}
+
+// NewLDAPProvider initiates a new LDAPProvider
+func NewLDAPProvider(p *ProviderData) *LDAPProvider {
+	p.ProviderName = "LDAP"
+	provider := &LDAPProvider{
+		ProviderData:   p,
+		UserAttribute:  "uid",
+		EmailAttribute: "mail",
+		GroupAttribute: "memberOf",
+		Timeout:        10 * time.Second,
+	}
+	provider.dial = provider.dialLDAP
+	return provider
+}
+
+// dialLDAP connects to the server, starting TLS on connections to ldap://
+// URLs unless that's been turned off
+func (p *LDAPProvider) dialLDAP() (ldapConn, error) {
+	conn, err := ldap.Dial(p.URL, p.TLSConfig, p.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(strings.ToLower(p.URL), "ldap://") && !p.InsecurePlaintext {
+		if err := conn.StartTLS(p.TLSConfig); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("error starting TLS: %v", err)
+		}
+	}
+	return conn, nil
+}
+
+// Redeem is not supported: users sign in with a password
+func (p *LDAPProvider) Redeem(ctx context.Context, redirectURL, code string) (*sessions.SessionState, error) {
+	return nil, ErrNotImplemented
+}
+
+// AuthenticatePassword finds the user's entry, using the service account if
+// one is configured, and checks the password by binding as the user
+func (p *LDAPProvider) AuthenticatePassword(ctx context.Context, username, password string) (*sessions.SessionState, error) {
+	if username == "" || password == "" {
+		return nil, ErrInvalidCredentials
+	}
+
+	conn, err := p.dial()
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to %s: %v", p.URL, err)
+	}
+	defer conn.Close()
+
+	if p.BindDN != "" {
+		if err := conn.Bind(p.BindDN, p.BindPassword); err != nil {
+			return nil, fmt.Errorf("error binding as %s: %v", p.BindDN, err)
+		}
+	}
+	entries, err := conn.Search(p.BaseDN, p.UserAttribute, username, []string{p.EmailAttribute, p.GroupAttribute})
+	if err != nil {
+		return nil, fmt.Errorf("error searching for %s=%s: %v", p.UserAttribute, username, err)
+	}
+	if len(entries) != 1 {
+		return nil, ErrInvalidCredentials
+	}
+	entry := entries[0]
+
+	if err := conn.Bind(entry.DN, password); errors.Is(err, ldap.ErrInvalidCredentials) {
+		return nil, ErrInvalidCredentials
+	} else if err != nil {
+		return nil, fmt.Errorf("error binding as %s: %v", entry.DN, err)
+	}
+
+	groups := entry.Values(p.GroupAttribute)
+	if !p.inGroups(groups) {
+		return nil, ErrInvalidCredentials
+	}
+
+	session := &sessions.SessionState{
+		User:      username,
+		Groups:    groups,
+		CreatedAt: clock.Now(),
+	}
+	if emails := entry.Values(p.EmailAttribute); len(emails) > 0 {
+		session.Email = emails[0]
+	}
+	return session, nil
+}
+
+// inGroups checks whether any of the user's groups is allowed
+func (p *LDAPProvider) inGroups(groups []string) bool {
+	if len(p.Groups) == 0 {
+		return true
+	}
+	for _, group := range groups {
+		cn := groupCN(group)
+		for _, allowed := range p.Groups {
+			if strings.EqualFold(allowed, group) || strings.EqualFold(allowed, cn) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// groupCN returns the common name of a group DN, eg. "admins" for
+// "cn=admins,ou=groups,dc=example,dc=com"
+func groupCN(dn string) string {
+	rdn := strings.SplitN(dn, ",", 2)[0]
+	parts := strings.SplitN(rdn, "=", 2)
+	if len(parts) != 2 || !strings.EqualFold(strings.TrimSpace(parts[0]), "cn") {
+		return ""
+	}
+	return strings.TrimSpace(parts[1])
+}
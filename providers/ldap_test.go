@@ -0,0 +1,157 @@
+//go:build !no_ldap
+// +build !no_ldap
+
+package providers
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/ldap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	testLDAPBindDN = "cn=proxy,dc=example,dc=com"
+	testLDAPUserDN = "uid=jane,ou=people,dc=example,dc=com"
+)
+
+// fakeLDAPConn accepts the service account and jane's credentials
+type fakeLDAPConn struct {
+	entries []*ldap.Entry
+	bound   string
+}
+
+func (c *fakeLDAPConn) Bind(dn, password string) error {
+	if (dn == testLDAPBindDN && password == "proxy-secret") || (dn == testLDAPUserDN && password == "jane-secret") {
+		c.bound = dn
+		return nil
+	}
+	return &ldap.Error{ResultCode: 49, Message: "invalid credentials"}
+}
+
+func (c *fakeLDAPConn) Search(baseDN, attribute, value string, attributes []string) ([]*ldap.Entry, error) {
+	if c.bound != testLDAPBindDN {
+		return nil, &ldap.Error{ResultCode: 50, Message: "insufficient access rights"}
+	}
+	if attribute == "uid" && value == "jane" {
+		return c.entries, nil
+	}
+	return nil, nil
+}
+
+func (c *fakeLDAPConn) Close() error { return nil }
+
+func testLDAPProvider(entries ...*ldap.Entry) *LDAPProvider {
+	p := NewLDAPProvider(&ProviderData{})
+	p.URL = "ldap://ldap.example.com"
+	p.BindDN = testLDAPBindDN
+	p.BindPassword = "proxy-secret"
+	p.BaseDN = "dc=example,dc=com"
+	p.dial = func() (ldapConn, error) {
+		return &fakeLDAPConn{entries: entries}, nil
+	}
+	return p
+}
+
+var testLDAPEntry = &ldap.Entry{
+	DN: testLDAPUserDN,
+	Attributes: map[string][]string{
+		"mail":     {"jane@example.com"},
+		"memberof": {"cn=admins,ou=groups,dc=example,dc=com", "cn=devs,ou=groups,dc=example,dc=com"},
+	},
+}
+
+func TestLDAPProviderDefaults(t *testing.T) {
+	p := NewLDAPProvider(&ProviderData{})
+	assert.Equal(t, "LDAP", p.Data().ProviderName)
+	assert.Equal(t, "uid", p.UserAttribute)
+	assert.Equal(t, "mail", p.EmailAttribute)
+	assert.Equal(t, "memberOf", p.GroupAttribute)
+
+	_, err := p.Redeem(context.Background(), "", "code")
+	assert.Equal(t, ErrNotImplemented, err)
+}
+
+func TestLDAPProviderAuthenticatePassword(t *testing.T) {
+	p := testLDAPProvider(testLDAPEntry)
+	session, err := p.AuthenticatePassword(context.Background(), "jane", "jane-secret")
+	require.NoError(t, err)
+	assert.Equal(t, "jane", session.User)
+	assert.Equal(t, "jane@example.com", session.Email)
+	assert.Equal(t, testLDAPEntry.Values("memberOf"), session.Groups)
+
+	for _, creds := range [][2]string{{"jane", "wrong"}, {"jane", ""}, {"john", "jane-secret"}, {"", ""}} {
+		_, err := p.AuthenticatePassword(context.Background(), creds[0], creds[1])
+		assert.Equal(t, ErrInvalidCredentials, err, creds[0])
+	}
+
+	// Ambiguous usernames are refused
+	p = testLDAPProvider(testLDAPEntry, &ldap.Entry{DN: "uid=jane,ou=contractors,dc=example,dc=com"})
+	_, err = p.AuthenticatePassword(context.Background(), "jane", "jane-secret")
+	assert.Equal(t, ErrInvalidCredentials, err)
+
+	// A wrong service account password is a configuration error
+	p = testLDAPProvider(testLDAPEntry)
+	p.BindPassword = "wrong"
+	_, err = p.AuthenticatePassword(context.Background(), "jane", "jane-secret")
+	assert.Error(t, err)
+	assert.False(t, errors.Is(err, ErrInvalidCredentials))
+}
+
+func TestLDAPProviderGroups(t *testing.T) {
+	tests := []struct {
+		groups  []string
+		allowed bool
+	}{
+		{nil, true},
+		{[]string{"admins"}, true},
+		{[]string{"CN=Devs,OU=Groups,DC=example,DC=com"}, true},
+		{[]string{"ops", "devs"}, true},
+		{[]string{"ops"}, false},
+		{[]string{"groups"}, false},
+	}
+
+	for _, test := range tests {
+		p := testLDAPProvider(testLDAPEntry)
+		p.Groups = test.groups
+		_, err := p.AuthenticatePassword(context.Background(), "jane", "jane-secret")
+		if test.allowed {
+			assert.NoError(t, err, test.groups)
+		} else {
+			assert.Equal(t, ErrInvalidCredentials, err, test.groups)
+		}
+	}
+}
+
+func TestLDAPProviderStartTLS(t *testing.T) {
+	// the server doesn't support StartTLS, and hangs up on the request
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Read(make([]byte, 1))
+			conn.Close()
+		}
+	}()
+
+	p := NewLDAPProvider(&ProviderData{})
+	p.URL = "ldap://" + listener.Addr().String()
+	p.Timeout = time.Second
+	_, err = p.dialLDAP()
+	assert.Error(t, err)
+
+	p.InsecurePlaintext = true
+	conn, err := p.dialLDAP()
+	require.NoError(t, err)
+	conn.Close()
+}
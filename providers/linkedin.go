@@ -18,6 +18,10 @@ type LinkedInProvider struct {
 
 var _ Provider = (*LinkedInProvider)(nil)
 
+func init() {
+	Register("linkedin", func(p *ProviderData) Provider { return NewLinkedInProvider(p) })
+}
+
 // NewLinkedInProvider initiates a new LinkedInProvider
 func NewLinkedInProvider(p *ProviderData) *LinkedInProvider {
 	p.ProviderName = "LinkedIn"
@@ -1,3 +1,6 @@
+//go:build !no_logingov
+// +build !no_logingov
+
 package providers
 
 import (
@@ -5,7 +8,6 @@ import (
 	"context"
 	"crypto/rsa"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io/ioutil"
 	"math/rand"
@@ -15,6 +17,8 @@ import (
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/clock"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/requests"
 	"gopkg.in/square/go-jose.v2"
 )
 
@@ -31,6 +35,10 @@ type LoginGovProvider struct {
 
 var _ Provider = (*LoginGovProvider)(nil)
 
+func init() {
+	Register("login.gov", func(p *ProviderData) Provider { return NewLoginGovProvider(p) })
+}
+
 // For generating a nonce
 var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
 
@@ -91,9 +99,13 @@ type loginGovCustomClaims struct {
 }
 
 // checkNonce checks the nonce in the id_token
-func checkNonce(idToken string, p *LoginGovProvider) (err error) {
+func checkNonce(ctx context.Context, idToken string, p *LoginGovProvider) (err error) {
 	token, err := jwt.ParseWithClaims(idToken, &loginGovCustomClaims{}, func(token *jwt.Token) (interface{}, error) {
-		resp, myerr := http.Get(p.PubJWKURL.String())
+		req, myerr := http.NewRequestWithContext(ctx, "GET", p.PubJWKURL.String(), nil)
+		if myerr != nil {
+			return nil, myerr
+		}
+		resp, myerr := requests.Do(req)
 		if myerr != nil {
 			return nil, myerr
 		}
@@ -137,7 +149,7 @@ func emailFromUserInfo(ctx context.Context, accessToken string, userInfoEndpoint
 	}
 	req.Header.Set("Authorization", "Bearer "+accessToken)
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := requests.Do(req)
 	if err != nil {
 		return
 	}
@@ -169,7 +181,7 @@ func emailFromUserInfo(ctx context.Context, accessToken string, userInfoEndpoint
 	}
 	email = emailData.Email
 	if !emailData.EmailVerified {
-		err = fmt.Errorf("email %s not listed as verified", email)
+		err = &UnverifiedEmailError{Email: email}
 		return
 	}
 	return
@@ -178,7 +190,7 @@ func emailFromUserInfo(ctx context.Context, accessToken string, userInfoEndpoint
 // Redeem exchanges the OAuth2 authentication token for an ID token
 func (p *LoginGovProvider) Redeem(ctx context.Context, redirectURL, code string) (s *sessions.SessionState, err error) {
 	if code == "" {
-		err = errors.New("missing code")
+		err = ErrMissingCode
 		return
 	}
 
@@ -186,7 +198,7 @@ func (p *LoginGovProvider) Redeem(ctx context.Context, redirectURL, code string)
 		Issuer:    p.ClientID,
 		Subject:   p.ClientID,
 		Audience:  p.RedeemURL.String(),
-		ExpiresAt: time.Now().Add(5 * time.Minute).Unix(),
+		ExpiresAt: clock.Now().Add(5 * time.Minute).Unix(),
 		Id:        randSeq(32),
 	}
 	token := jwt.NewWithClaims(jwt.GetSigningMethod("RS256"), claims)
@@ -207,9 +219,10 @@ func (p *LoginGovProvider) Redeem(ctx context.Context, redirectURL, code string)
 		return
 	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	setClientHeaders(req)
 
 	var resp *http.Response
-	resp, err = http.DefaultClient.Do(req)
+	resp, err = requests.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -221,7 +234,7 @@ func (p *LoginGovProvider) Redeem(ctx context.Context, redirectURL, code string)
 	}
 
 	if resp.StatusCode != 200 {
-		err = fmt.Errorf("got %d from %q %s", resp.StatusCode, p.RedeemURL.String(), body)
+		err = &RedeemError{StatusCode: resp.StatusCode, URL: p.RedeemURL.String(), Body: body}
 		return
 	}
 
@@ -238,7 +251,7 @@ func (p *LoginGovProvider) Redeem(ctx context.Context, redirectURL, code string)
 	}
 
 	// check nonce here
-	err = checkNonce(jsonResponse.IDToken, p)
+	err = checkNonce(ctx, jsonResponse.IDToken, p)
 	if err != nil {
 		return
 	}
@@ -254,8 +267,8 @@ func (p *LoginGovProvider) Redeem(ctx context.Context, redirectURL, code string)
 	s = &sessions.SessionState{
 		AccessToken: jsonResponse.AccessToken,
 		IDToken:     jsonResponse.IDToken,
-		CreatedAt:   time.Now(),
-		ExpiresOn:   time.Now().Add(time.Duration(jsonResponse.ExpiresIn) * time.Second).Truncate(time.Second),
+		CreatedAt:   clock.Now(),
+		ExpiresOn:   clock.Now().Add(time.Duration(jsonResponse.ExpiresIn) * time.Second).Truncate(time.Second),
 		Email:       email,
 	}
 	return
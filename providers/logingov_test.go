@@ -1,3 +1,6 @@
+//go:build !no_logingov
+// +build !no_logingov
+
 package providers
 
 import (
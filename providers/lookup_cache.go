@@ -0,0 +1,92 @@
+package providers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/logger"
+)
+
+type memoryLookup struct {
+	value     string
+	expiresOn time.Time
+}
+
+// memoryLookupCache caches provider lookups in the process
+type memoryLookupCache struct {
+	mu        sync.Mutex
+	lookups   map[string]memoryLookup
+	nextPrune time.Time
+}
+
+var _ sessions.LookupCache = (*memoryLookupCache)(nil)
+
+// NewMemoryLookupCache returns a LookupCache held in memory, for when the
+// results of lookups needn't be shared between instances of the proxy
+func NewMemoryLookupCache() sessions.LookupCache {
+	return &memoryLookupCache{lookups: map[string]memoryLookup{}}
+}
+
+// LoadLookup loads a cached lookup
+func (c *memoryLookupCache) LoadLookup(_ context.Context, key string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	lookup, ok := c.lookups[key]
+	if !ok || lookup.expiresOn.Before(time.Now()) {
+		return "", fmt.Errorf("%w: lookup %s", sessions.ErrNotFound, key)
+	}
+	return lookup.value, nil
+}
+
+// SaveLookup caches the result of a lookup for ttl. Expired lookups are
+// removed at most once every ttl, so that the cache doesn't grow unbounded.
+func (c *memoryLookupCache) SaveLookup(_ context.Context, key, value string, ttl time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := time.Now()
+	if now.After(c.nextPrune) {
+		for k, lookup := range c.lookups {
+			if lookup.expiresOn.Before(now) {
+				delete(c.lookups, k)
+			}
+		}
+		c.nextPrune = now.Add(ttl)
+	}
+	c.lookups[key] = memoryLookup{value: value, expiresOn: now.Add(ttl)}
+	return nil
+}
+
+// cachedLookup returns the cached result of the lookup of kind for subject,
+// usually an access token, calling lookup when it isn't cached. Subjects are
+// hashed so that tokens aren't kept in the cache. Failed lookups aren't
+// cached, and lookups are made uncached when the cache is unavailable.
+func (p *ProviderData) cachedLookup(ctx context.Context, kind, subject string, lookup func() (string, error)) (string, error) {
+	if p.LookupCache == nil || p.LookupCacheTTL <= 0 || subject == "" {
+		return lookup()
+	}
+
+	sum := sha256.Sum256([]byte(p.ClientID + ":" + subject))
+	key := kind + ":" + hex.EncodeToString(sum[:])
+	value, err := p.LookupCache.LoadLookup(ctx, key)
+	if err == nil {
+		return value, nil
+	}
+	if !errors.Is(err, sessions.ErrNotFound) {
+		logger.Printf("Error loading cached %s lookup: %v", kind, err)
+	}
+
+	value, err = lookup()
+	if err != nil {
+		return value, err
+	}
+	if err := p.LookupCache.SaveLookup(ctx, key, value, p.LookupCacheTTL); err != nil {
+		logger.Printf("Error caching %s lookup: %v", kind, err)
+	}
+	return value, nil
+}
@@ -0,0 +1,58 @@
+package providers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryLookupCache(t *testing.T) {
+	cache := NewMemoryLookupCache()
+	_, err := cache.LoadLookup(context.Background(), "email:abc")
+	assert.True(t, errors.Is(err, sessions.ErrNotFound))
+
+	require.NoError(t, cache.SaveLookup(context.Background(), "email:abc", "jane@example.com", time.Minute))
+	value, err := cache.LoadLookup(context.Background(), "email:abc")
+	require.NoError(t, err)
+	assert.Equal(t, "jane@example.com", value)
+
+	require.NoError(t, cache.SaveLookup(context.Background(), "email:abc", "jane@example.com", -time.Second))
+	_, err = cache.LoadLookup(context.Background(), "email:abc")
+	assert.True(t, errors.Is(err, sessions.ErrNotFound))
+}
+
+func TestGitHubProviderGetEmailAddressCached(t *testing.T) {
+	requests := 0
+	b := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(`[ {"email": "michael.bland@gsa.gov", "verified": true, "primary": true} ]`))
+	}))
+	defer b.Close()
+
+	bURL, _ := url.Parse(b.URL)
+	p := testGitHubProvider(bURL.Host)
+	p.LookupCache = NewMemoryLookupCache()
+	p.LookupCacheTTL = time.Minute
+
+	session := CreateAuthorizedSession()
+	for i := 0; i < 3; i++ {
+		email, err := p.GetEmailAddress(context.Background(), session)
+		require.NoError(t, err)
+		assert.Equal(t, "michael.bland@gsa.gov", email)
+	}
+	assert.Equal(t, 1, requests)
+
+	// Lookups are cached per access token
+	session.AccessToken = "other_token"
+	_, err := p.GetEmailAddress(context.Background(), session)
+	require.NoError(t, err)
+	assert.Equal(t, 2, requests)
+}
@@ -17,6 +17,10 @@ type NextcloudProvider struct {
 
 var _ Provider = (*NextcloudProvider)(nil)
 
+func init() {
+	Register("nextcloud", func(p *ProviderData) Provider { return NewNextcloudProvider(p) })
+}
+
 // NewNextcloudProvider initiates a new NextcloudProvider
 func NewNextcloudProvider(p *ProviderData) *NextcloudProvider {
 	p.ProviderName = "Nextcloud"
@@ -11,6 +11,7 @@ import (
 	"golang.org/x/oauth2"
 
 	"github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/clock"
 	"github.com/oauth2-proxy/oauth2-proxy/pkg/requests"
 )
 
@@ -23,6 +24,10 @@ type OIDCProvider struct {
 	Verifier             *oidc.IDTokenVerifier
 	AllowUnverifiedEmail bool
 	UserIDClaim          string
+	// RefreshValidation is how strictly ID tokens issued when refreshing
+	// sessions are validated: RefreshValidationVerify or
+	// RefreshValidationStrict
+	RefreshValidation string
 }
 
 // NewOIDCProvider initiates a new OIDCProvider
@@ -33,6 +38,10 @@ func NewOIDCProvider(p *ProviderData) *OIDCProvider {
 
 var _ Provider = (*OIDCProvider)(nil)
 
+func init() {
+	Register("oidc", func(p *ProviderData) Provider { return NewOIDCProvider(p) })
+}
+
 // Redeem exchanges the OAuth2 authentication token for an ID token
 func (p *OIDCProvider) Redeem(ctx context.Context, redirectURL, code string) (s *sessions.SessionState, err error) {
 	clientSecret, err := p.GetClientSecret()
@@ -48,9 +57,9 @@ func (p *OIDCProvider) Redeem(ctx context.Context, redirectURL, code string) (s
 		},
 		RedirectURL: redirectURL,
 	}
-	token, err := c.Exchange(ctx, code)
+	token, err := c.Exchange(clientHeadersContext(ctx), code)
 	if err != nil {
-		return nil, fmt.Errorf("token exchange: %v", err)
+		return nil, fmt.Errorf("token exchange: %w", tokenExchangeError(err, p.RedeemURL.String()))
 	}
 
 	// in the initial exchange the id token is mandatory
@@ -63,7 +72,7 @@ func (p *OIDCProvider) Redeem(ctx context.Context, redirectURL, code string) (s
 
 	s, err = p.createSessionState(ctx, token, idToken)
 	if err != nil {
-		return nil, fmt.Errorf("unable to update session: %v", err)
+		return nil, fmt.Errorf("unable to update session: %w", err)
 	}
 
 	return
@@ -72,13 +81,13 @@ func (p *OIDCProvider) Redeem(ctx context.Context, redirectURL, code string) (s
 // RefreshSessionIfNeeded checks if the session has expired and uses the
 // RefreshToken to fetch a new Access Token (and optional ID token) if required
 func (p *OIDCProvider) RefreshSessionIfNeeded(ctx context.Context, s *sessions.SessionState) (bool, error) {
-	if s == nil || s.ExpiresOn.After(time.Now()) || s.RefreshToken == "" {
+	if s == nil || !p.refreshDue(s) || s.RefreshToken == "" {
 		return false, nil
 	}
 
 	err := p.redeemRefreshToken(ctx, s)
 	if err != nil {
-		return false, fmt.Errorf("unable to redeem refresh token: %v", err)
+		return false, fmt.Errorf("unable to redeem refresh token: %w", err)
 	}
 
 	fmt.Printf("refreshed access token %s (expired on %s)\n", s, s.ExpiresOn)
@@ -100,11 +109,11 @@ func (p *OIDCProvider) redeemRefreshToken(ctx context.Context, s *sessions.Sessi
 	}
 	t := &oauth2.Token{
 		RefreshToken: s.RefreshToken,
-		Expiry:       time.Now().Add(-time.Hour),
+		Expiry:       clock.Now().Add(-time.Hour),
 	}
-	token, err := c.TokenSource(ctx, t).Token()
+	token, err := c.TokenSource(clientHeadersContext(ctx), t).Token()
 	if err != nil {
-		return fmt.Errorf("failed to get token: %v", err)
+		return fmt.Errorf("failed to get token: %w", tokenExchangeError(err, p.RedeemURL.String()))
 	}
 
 	// in the token refresh response the id_token is optional
@@ -112,6 +121,9 @@ func (p *OIDCProvider) redeemRefreshToken(ctx context.Context, s *sessions.Sessi
 	if err != nil {
 		return fmt.Errorf("unable to extract id_token from response: %v", err)
 	}
+	if err := checkRefreshValidation(p.RefreshValidation, s.IDToken, idToken); err != nil {
+		return err
+	}
 
 	newSession, err := p.createSessionState(ctx, token, idToken)
 	if err != nil {
@@ -125,6 +137,8 @@ func (p *OIDCProvider) redeemRefreshToken(ctx context.Context, s *sessions.Sessi
 		s.Email = newSession.Email
 		s.User = newSession.User
 		s.PreferredUsername = newSession.PreferredUsername
+		s.ACR = newSession.ACR
+		s.AMR = newSession.AMR
 	}
 
 	s.AccessToken = newSession.AccessToken
@@ -165,7 +179,7 @@ func (p *OIDCProvider) createSessionState(ctx context.Context, token *oauth2.Tok
 
 	newSession.AccessToken = token.AccessToken
 	newSession.RefreshToken = token.RefreshToken
-	newSession.CreatedAt = time.Now()
+	newSession.CreatedAt = clock.Now()
 	newSession.ExpiresOn = token.Expiry
 	return newSession, nil
 }
@@ -207,10 +221,12 @@ func (p *OIDCProvider) createSessionStateInternal(ctx context.Context, rawIDToke
 
 	newSession.User = claims.Subject
 	newSession.PreferredUsername = claims.PreferredUsername
+	newSession.ACR = claims.ACR
+	newSession.AMR = claims.AMR
 
 	verifyEmail := (p.UserIDClaim == emailClaim) && !p.AllowUnverifiedEmail
 	if verifyEmail && claims.Verified != nil && !*claims.Verified {
-		return nil, fmt.Errorf("email in id_token (%s) isn't verified", claims.UserID)
+		return nil, &UnverifiedEmailError{Email: claims.UserID}
 	}
 
 	return newSession, nil
@@ -247,6 +263,19 @@ func (p *OIDCProvider) findClaimsFromIDToken(ctx context.Context, idToken *oidc.
 	}
 	claims.UserID = fmt.Sprint(userID)
 
+	// acr and amr are read leniently, as providers don't all follow the spec
+	claims.ACR, _ = claims.rawClaims["acr"].(string)
+	switch amr := claims.rawClaims["amr"].(type) {
+	case string:
+		claims.AMR = []string{amr}
+	case []interface{}:
+		for _, method := range amr {
+			if s, ok := method.(string); ok {
+				claims.AMR = append(claims.AMR, s)
+			}
+		}
+	}
+
 	if p.UserIDClaim == emailClaim && claims.UserID == "" {
 		if profileURL == "" {
 			return nil, fmt.Errorf("id_token did not contain an email")
@@ -281,7 +310,9 @@ func (p *OIDCProvider) findClaimsFromIDToken(ctx context.Context, idToken *oidc.
 type OIDCClaims struct {
 	rawClaims         map[string]interface{}
 	UserID            string
-	Subject           string `json:"sub"`
-	Verified          *bool  `json:"email_verified"`
-	PreferredUsername string `json:"preferred_username"`
+	Subject           string   `json:"sub"`
+	Verified          *bool    `json:"email_verified"`
+	PreferredUsername string   `json:"preferred_username"`
+	ACR               string   `json:"-"`
+	AMR               []string `json:"-"`
 }
@@ -0,0 +1,103 @@
+package providers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	oidc "github.com/coreos/go-oidc"
+)
+
+// The levels of validation of the ID tokens issued when refreshing sessions
+const (
+	// RefreshValidationVerify verifies the ID token's signature, issuer,
+	// audience and expiry, as when signing in
+	RefreshValidationVerify = "verify"
+	// RefreshValidationStrict also checks the ID token was issued for the
+	// same sign in as the session's original ID token
+	RefreshValidationStrict = "strict"
+)
+
+// refreshClaims are the claims of an ID token that must not change when it
+// is refreshed
+type refreshClaims struct {
+	Issuer   string   `json:"iss"`
+	Subject  string   `json:"sub"`
+	Audience audience `json:"aud"`
+	AuthTime int64    `json:"auth_time"`
+	Nonce    string   `json:"nonce"`
+}
+
+// audience is an aud claim, which may be a single string or a list
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var s string
+	if json.Unmarshal(b, &s) == nil {
+		*a = audience{s}
+		return nil
+	}
+	var l []string
+	if err := json.Unmarshal(b, &l); err != nil {
+		return err
+	}
+	*a = l
+	return nil
+}
+
+// checkRefreshedIDToken checks a verified ID token issued when refreshing a
+// session was issued for the same sign in as the session's original ID token.
+// Per OpenID Connect Core 12.2 it must have the same issuer, subject and
+// audience, the same auth_time if any, and no nonce other than the original.
+func checkRefreshedIDToken(original string, refreshed *oidc.IDToken) error {
+	var want, got refreshClaims
+	if err := unverifiedClaims(original, &want); err != nil {
+		return fmt.Errorf("unable to read the session's id_token: %v", err)
+	}
+	if err := refreshed.Claims(&got); err != nil {
+		return err
+	}
+
+	switch {
+	case got.Issuer != want.Issuer:
+		return fmt.Errorf("issuer %q doesn't match the session's %q", got.Issuer, want.Issuer)
+	case got.Subject != want.Subject:
+		return fmt.Errorf("subject %q doesn't match the session's %q", got.Subject, want.Subject)
+	case strings.Join(got.Audience, " ") != strings.Join(want.Audience, " "):
+		return fmt.Errorf("audience %q doesn't match the session's %q", got.Audience, want.Audience)
+	case want.AuthTime != 0 && got.AuthTime != want.AuthTime:
+		return errors.New("auth_time doesn't match the session's")
+	case got.Nonce != "" && got.Nonce != want.Nonce:
+		return errors.New("nonce doesn't match the session's")
+	}
+	return nil
+}
+
+// unverifiedClaims decodes the claims of a JWT without verifying it, for
+// tokens that were verified before being kept in the session
+func unverifiedClaims(rawToken string, v interface{}) error {
+	parts := strings.Split(rawToken, ".")
+	if len(parts) != 3 {
+		return errors.New("malformed jwt")
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(payload, v)
+}
+
+// checkRefreshValidation applies the refresh validation level to a verified
+// ID token issued when refreshing a session with the original ID token, if
+// the session kept it
+func checkRefreshValidation(level string, original string, refreshed *oidc.IDToken) error {
+	if level != RefreshValidationStrict || refreshed == nil || original == "" {
+		return nil
+	}
+	if err := checkRefreshedIDToken(original, refreshed); err != nil {
+		return fmt.Errorf("refreshed id_token wasn't issued for the same sign in: %v", err)
+	}
+	return nil
+}
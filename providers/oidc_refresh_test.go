@@ -0,0 +1,69 @@
+package providers
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOIDCProviderRefreshValidation(t *testing.T) {
+	original, err := newSignedTestIDToken(defaultIDToken)
+	require.NoError(t, err)
+	otherUser := defaultIDToken
+	otherUser.Subject = "987654321"
+
+	tests := []struct {
+		name       string
+		level      string
+		refreshed  idTokenClaims
+		original   string
+		errMessage string
+	}{
+		{"verified", RefreshValidationVerify, otherUser, original, ""},
+		{"strict, same sign in", RefreshValidationStrict, defaultIDToken, original, ""},
+		{"strict, other subject", RefreshValidationStrict, otherUser, original,
+			`unable to redeem refresh token: refreshed id_token wasn't issued for the same sign in: subject "987654321" doesn't match the session's "123456789"`},
+		{"strict, no original", RefreshValidationStrict, otherUser, "", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			idToken, err := newSignedTestIDToken(test.refreshed)
+			require.NoError(t, err)
+			body, _ := json.Marshal(redeemTokenResponse{
+				AccessToken:  accessToken,
+				ExpiresIn:    10,
+				TokenType:    "Bearer",
+				RefreshToken: refreshToken,
+				IDToken:      idToken,
+			})
+			server, provider := newTestSetup(body)
+			defer server.Close()
+			provider.RefreshValidation = test.level
+
+			session := &sessions.SessionState{IDToken: test.original, RefreshToken: refreshToken}
+			refreshed, err := provider.RefreshSessionIfNeeded(context.Background(), session)
+			if test.errMessage == "" {
+				assert.NoError(t, err)
+				assert.True(t, refreshed)
+				assert.Equal(t, idToken, session.IDToken)
+			} else {
+				assert.EqualError(t, err, test.errMessage)
+				assert.Equal(t, test.original, session.IDToken)
+			}
+		})
+	}
+}
+
+func TestCheckRefreshedIDTokenClaims(t *testing.T) {
+	var claims refreshClaims
+	require.NoError(t, json.Unmarshal([]byte(`{"aud": "a"}`), &claims))
+	assert.Equal(t, audience{"a"}, claims.Audience)
+	require.NoError(t, json.Unmarshal([]byte(`{"aud": ["a", "b"]}`), &claims))
+	assert.Equal(t, audience{"a", "b"}, claims.Audience)
+
+	assert.Error(t, unverifiedClaims("not-a-jwt", &claims))
+}
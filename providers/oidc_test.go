@@ -188,6 +188,29 @@ func TestOIDCProviderRedeem_custom_userid(t *testing.T) {
 	assert.Equal(t, defaultIDToken.Phone, session.Email)
 }
 
+func TestOIDCProviderRedeem_acr(t *testing.T) {
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	idToken, _ := jwt.NewWithClaims(jwt.SigningMethodRS256, struct {
+		idTokenClaims
+		ACR string   `json:"acr"`
+		AMR []string `json:"amr"`
+	}{defaultIDToken, "urn:example:mfa", []string{"pwd", "otp"}}).SignedString(key)
+	body, _ := json.Marshal(redeemTokenResponse{
+		AccessToken: accessToken,
+		ExpiresIn:   10,
+		TokenType:   "Bearer",
+		IDToken:     idToken,
+	})
+
+	server, provider := newTestSetup(body)
+	defer server.Close()
+
+	session, err := provider.Redeem(context.Background(), provider.RedeemURL.String(), "code1234")
+	assert.Equal(t, nil, err)
+	assert.Equal(t, "urn:example:mfa", session.ACR)
+	assert.Equal(t, []string{"pwd", "otp"}, session.AMR)
+}
+
 func TestOIDCProviderRefreshSessionIfNeededWithoutIdToken(t *testing.T) {
 
 	idToken, _ := newSignedTestIDToken(defaultIDToken)
@@ -254,6 +277,41 @@ func TestOIDCProviderRefreshSessionIfNeededWithIdToken(t *testing.T) {
 	assert.Equal(t, refreshToken, existingSession.RefreshToken)
 }
 
+func TestOIDCProviderRefreshSessionIfNeededWithSkew(t *testing.T) {
+	body, _ := json.Marshal(redeemTokenResponse{
+		AccessToken:  accessToken,
+		ExpiresIn:    3600,
+		TokenType:    "Bearer",
+		RefreshToken: refreshToken,
+	})
+
+	server, provider := newTestSetup(body)
+	defer server.Close()
+
+	// Without a skew, a token expiring in 30s is still used
+	existingSession := &sessions.SessionState{
+		AccessToken:  "changeit",
+		ExpiresOn:    time.Now().Add(30 * time.Second),
+		RefreshToken: refreshToken,
+	}
+	refreshed, err := provider.RefreshSessionIfNeeded(context.Background(), existingSession)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, refreshed)
+	assert.Equal(t, "changeit", existingSession.AccessToken)
+
+	// but is refreshed when it expires within the skew
+	provider.RefreshSkew = time.Minute
+	refreshed, err = provider.RefreshSessionIfNeeded(context.Background(), existingSession)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, true, refreshed)
+	assert.Equal(t, accessToken, existingSession.AccessToken)
+
+	// and the new token isn't refreshed again
+	refreshed, err = provider.RefreshSessionIfNeeded(context.Background(), existingSession)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, false, refreshed)
+}
+
 func TestOIDCProvider_findVerifiedIdToken(t *testing.T) {
 
 	server, provider := newTestSetup([]byte(""))
@@ -290,3 +348,29 @@ func TestOIDCProvider_findVerifiedIdToken(t *testing.T) {
 	assert.Equal(t, nil, err)
 	assert.Equal(t, true, verifiedIDToken == nil)
 }
+
+func TestOIDCProviderRefreshSessionIfNeededProviderUnavailable(t *testing.T) {
+	status := http.StatusServiceUnavailable
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Add("content-type", "application/json")
+		rw.WriteHeader(status)
+		rw.Write([]byte(`{"error":"temporarily_unavailable"}`))
+	}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+	provider := newOIDCProvider(serverURL)
+	session := &sessions.SessionState{RefreshToken: refreshToken}
+
+	_, err := provider.RefreshSessionIfNeeded(context.Background(), session)
+	assert.True(t, errors.Is(err, ErrProviderUnavailable))
+
+	// Rejected refresh tokens won't be accepted on a retry
+	status = http.StatusBadRequest
+	_, err = provider.RefreshSessionIfNeeded(context.Background(), session)
+	assert.Error(t, err)
+	assert.False(t, errors.Is(err, ErrProviderUnavailable))
+
+	server.Close()
+	_, err = provider.RefreshSessionIfNeeded(context.Background(), session)
+	assert.True(t, errors.Is(err, ErrProviderUnavailable))
+}
@@ -4,7 +4,10 @@ import (
 	"errors"
 	"io/ioutil"
 	"net/url"
+	"time"
 
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/clock"
 	"github.com/oauth2-proxy/oauth2-proxy/pkg/logger"
 )
 
@@ -26,11 +29,28 @@ type ProviderData struct {
 	ClientSecretFile string
 	Scope            string
 	Prompt           string
+	// LoginHint and DomainHint are passed to the provider by default, for it
+	// to preselect the user's account or tenant when they sign in
+	LoginHint  string
+	DomainHint string
+	// LookupCache, when set, caches the results of userinfo and group
+	// lookups for LookupCacheTTL
+	LookupCache    sessions.LookupCache
+	LookupCacheTTL time.Duration
+	// RefreshSkew is how long before the access token expires that the
+	// session is refreshed, so that a token about to expire isn't passed on
+	RefreshSkew time.Duration
 }
 
 // Data returns the ProviderData
 func (p *ProviderData) Data() *ProviderData { return p }
 
+// refreshDue checks whether the session's access token expires within the
+// refresh skew, or has already expired
+func (p *ProviderData) refreshDue(s *sessions.SessionState) bool {
+	return s.ExpiresOn.Before(clock.Now().Add(p.RefreshSkew))
+}
+
 func (p *ProviderData) GetClientSecret() (clientSecret string, err error) {
 	if p.ClientSecret != "" || p.ClientSecretFile == "" {
 		return p.ClientSecret, nil
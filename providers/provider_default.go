@@ -4,16 +4,16 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
-	"time"
 
 	"github.com/coreos/go-oidc"
 
 	"github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/clock"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/requests"
 )
 
 var _ Provider = (*ProviderData)(nil)
@@ -21,7 +21,7 @@ var _ Provider = (*ProviderData)(nil)
 // Redeem provides a default implementation of the OAuth2 token redemption process
 func (p *ProviderData) Redeem(ctx context.Context, redirectURL, code string) (s *sessions.SessionState, err error) {
 	if code == "" {
-		err = errors.New("missing code")
+		err = ErrMissingCode
 		return
 	}
 	clientSecret, err := p.GetClientSecret()
@@ -45,9 +45,10 @@ func (p *ProviderData) Redeem(ctx context.Context, redirectURL, code string) (s
 		return
 	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	setClientHeaders(req)
 
 	var resp *http.Response
-	resp, err = http.DefaultClient.Do(req)
+	resp, err = requests.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -59,7 +60,7 @@ func (p *ProviderData) Redeem(ctx context.Context, redirectURL, code string) (s
 	}
 
 	if resp.StatusCode != 200 {
-		err = fmt.Errorf("got %d from %q %s", resp.StatusCode, p.RedeemURL.String(), body)
+		err = &RedeemError{StatusCode: resp.StatusCode, URL: p.RedeemURL.String(), Body: body}
 		return
 	}
 
@@ -81,7 +82,7 @@ func (p *ProviderData) Redeem(ctx context.Context, redirectURL, code string) (s
 		return
 	}
 	if a := v.Get("access_token"); a != "" {
-		s = &sessions.SessionState{AccessToken: a, CreatedAt: time.Now()}
+		s = &sessions.SessionState{AccessToken: a, CreatedAt: clock.Now()}
 	} else {
 		err = fmt.Errorf("no access token found %s", body)
 	}
@@ -103,28 +104,34 @@ func (p *ProviderData) GetLoginURL(redirectURI, state string) string {
 	params.Set("client_id", p.ClientID)
 	params.Set("response_type", "code")
 	params.Add("state", state)
+	if p.LoginHint != "" {
+		params.Set("login_hint", p.LoginHint)
+	}
+	if p.DomainHint != "" {
+		params.Set("domain_hint", p.DomainHint)
+	}
 	a.RawQuery = params.Encode()
 	return a.String()
 }
 
 // GetEmailAddress returns the Account email address
 func (p *ProviderData) GetEmailAddress(ctx context.Context, s *sessions.SessionState) (string, error) {
-	return "", errors.New("not implemented")
+	return "", ErrNotImplemented
 }
 
 // GetUserName returns the Account username
 func (p *ProviderData) GetUserName(ctx context.Context, s *sessions.SessionState) (string, error) {
-	return "", errors.New("not implemented")
+	return "", ErrNotImplemented
 }
 
 // GetPreferredUsername returns the Account preferred username
 func (p *ProviderData) GetPreferredUsername(ctx context.Context, s *sessions.SessionState) (string, error) {
-	return "", errors.New("not implemented")
+	return "", ErrNotImplemented
 }
 
 // ValidateGroup validates that the provided email exists in the configured provider
 // email group(s).
-func (p *ProviderData) ValidateGroup(email string) bool {
+func (p *ProviderData) ValidateGroup(ctx context.Context, email string) bool {
 	return true
 }
 
@@ -156,7 +163,7 @@ func (p *ProviderData) CreateSessionStateFromBearerToken(ctx context.Context, ra
 	}
 
 	if claims.Verified != nil && !*claims.Verified {
-		return nil, fmt.Errorf("email in id_token (%s) isn't verified", claims.Email)
+		return nil, &UnverifiedEmailError{Email: claims.Email}
 	}
 
 	newSession := &sessions.SessionState{
@@ -2,6 +2,10 @@ package providers
 
 import (
 	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"testing"
 	"time"
 
@@ -17,3 +21,71 @@ func TestRefresh(t *testing.T) {
 	assert.Equal(t, false, refreshed)
 	assert.Equal(t, nil, err)
 }
+
+func TestRedeemMissingCode(t *testing.T) {
+	p := &ProviderData{}
+	session, err := p.Redeem(context.Background(), "https://example.com/oauth2/callback", "")
+	assert.Nil(t, session)
+	assert.Equal(t, ErrMissingCode, err)
+}
+
+func TestRedeemRejected(t *testing.T) {
+	b := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error":"invalid_grant"}`))
+	}))
+	defer b.Close()
+
+	redeemURL, _ := url.Parse(b.URL + "/token")
+	p := &ProviderData{RedeemURL: redeemURL, ClientSecret: "secret"}
+	session, err := p.Redeem(context.Background(), "https://example.com/oauth2/callback", "code1234")
+	assert.Nil(t, session)
+	assert.True(t, errors.Is(err, ErrRedeem))
+
+	var redeemErr *RedeemError
+	if assert.True(t, errors.As(err, &redeemErr)) {
+		assert.Equal(t, http.StatusBadRequest, redeemErr.StatusCode)
+		assert.Equal(t, redeemURL.String(), redeemErr.URL)
+		assert.Equal(t, `{"error":"invalid_grant"}`, string(redeemErr.Body))
+		assert.Equal(t, "invalid_grant", redeemErr.Code())
+	}
+	assert.True(t, errors.Is(err, ErrInvalidGrant))
+	assert.False(t, errors.Is(err, ErrProviderUnavailable))
+}
+
+func TestRedeemErrorIs(t *testing.T) {
+	tests := []struct {
+		err         *RedeemError
+		code        string
+		invalid     bool
+		unavailable bool
+	}{
+		{&RedeemError{StatusCode: 400, Body: []byte(`{"error":"invalid_grant","error_description":"revoked"}`)}, "invalid_grant", true, false},
+		{&RedeemError{StatusCode: 400, Body: []byte(`error=invalid_grant&error_description=expired`)}, "invalid_grant", true, false},
+		{&RedeemError{StatusCode: 401, Body: []byte(`{"error":"invalid_client"}`)}, "invalid_client", false, false},
+		{&RedeemError{StatusCode: 429, Body: []byte(`slow down`)}, "", false, true},
+		{&RedeemError{StatusCode: 503, Body: []byte(`<html>unavailable</html>`)}, "", false, true},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.code, test.err.Code(), string(test.err.Body))
+		assert.True(t, errors.Is(test.err, ErrRedeem))
+		assert.Equal(t, test.invalid, errors.Is(test.err, ErrInvalidGrant), string(test.err.Body))
+		assert.Equal(t, test.unavailable, errors.Is(test.err, ErrProviderUnavailable), string(test.err.Body))
+	}
+}
+
+func TestGetLoginURLHints(t *testing.T) {
+	loginURL, _ := url.Parse("https://idp.example.com/authorize")
+	p := &ProviderData{LoginURL: loginURL, ClientID: "proxy"}
+	u, err := url.Parse(p.GetLoginURL("https://example.com/oauth2/callback", "state"))
+	assert.NoError(t, err)
+	_, ok := u.Query()["login_hint"]
+	assert.False(t, ok)
+
+	p.LoginHint = "jane@example.com"
+	p.DomainHint = "example.com"
+	u, err = url.Parse(p.GetLoginURL("https://example.com/oauth2/callback", "state"))
+	assert.NoError(t, err)
+	assert.Equal(t, "jane@example.com", u.Query().Get("login_hint"))
+	assert.Equal(t, "example.com", u.Query().Get("domain_hint"))
+}
@@ -2,6 +2,7 @@ package providers
 
 import (
 	"context"
+	"sort"
 
 	"github.com/coreos/go-oidc"
 	"github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
@@ -14,39 +15,57 @@ type Provider interface {
 	GetUserName(ctx context.Context, s *sessions.SessionState) (string, error)
 	GetPreferredUsername(ctx context.Context, s *sessions.SessionState) (string, error)
 	Redeem(ctx context.Context, redirectURI, code string) (*sessions.SessionState, error)
-	ValidateGroup(string) bool
+	ValidateGroup(ctx context.Context, email string) bool
 	ValidateSessionState(ctx context.Context, s *sessions.SessionState) bool
 	GetLoginURL(redirectURI, finalRedirect string) string
+	// RefreshSessionIfNeeded refreshes the session's tokens when they're due
+	// to expire, reporting whether it did. Errors match ErrInvalidGrant when
+	// the refresh can never succeed, and ErrProviderUnavailable when it may
+	// if retried later.
 	RefreshSessionIfNeeded(ctx context.Context, s *sessions.SessionState) (bool, error)
 	CreateSessionStateFromBearerToken(ctx context.Context, rawIDToken string, idToken *oidc.IDToken) (*sessions.SessionState, error)
 }
 
-// New provides a new Provider based on the configured provider string
+// PasswordProvider is implemented by providers that authenticate users with
+// the username and password entered in the proxy's sign in form, rather than
+// redirecting them to the identity provider
+type PasswordProvider interface {
+	AuthenticatePassword(ctx context.Context, username, password string) (*sessions.SessionState, error)
+}
+
+// defaultProvider is the provider used when the configured one isn't known
+const defaultProvider = "google"
+
+// registry holds the constructors of the providers compiled into the binary
+var registry = map[string]func(*ProviderData) Provider{}
+
+// Register makes a provider available to New under name. The built in
+// providers register themselves, unless they're left out of the build with
+// their no_<provider> build tag; programs embedding the proxy can register
+// their own before loading the options.
+func Register(name string, constructor func(*ProviderData) Provider) {
+	registry[name] = constructor
+}
+
+// Names returns the names of the providers that are available, sorted
+func Names() []string {
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// New provides a new Provider based on the configured provider string,
+// falling back to Google for unknown names. It returns nil when neither is
+// available.
 func New(provider string, p *ProviderData) Provider {
-	switch provider {
-	case "linkedin":
-		return NewLinkedInProvider(p)
-	case "facebook":
-		return NewFacebookProvider(p)
-	case "github":
-		return NewGitHubProvider(p)
-	case "keycloak":
-		return NewKeycloakProvider(p)
-	case "azure":
-		return NewAzureProvider(p)
-	case "gitlab":
-		return NewGitLabProvider(p)
-	case "oidc":
-		return NewOIDCProvider(p)
-	case "login.gov":
-		return NewLoginGovProvider(p)
-	case "bitbucket":
-		return NewBitbucketProvider(p)
-	case "nextcloud":
-		return NewNextcloudProvider(p)
-	case "digitalocean":
-		return NewDigitalOceanProvider(p)
-	default:
-		return NewGoogleProvider(p)
+	constructor, ok := registry[provider]
+	if !ok {
+		if constructor, ok = registry[defaultProvider]; !ok {
+			return nil
+		}
 	}
+	return constructor(p)
 }
@@ -0,0 +1,25 @@
+package providers
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNew(t *testing.T) {
+	assert.IsType(t, &GitHubProvider{}, New("github", &ProviderData{}))
+
+	Register("custom", func(p *ProviderData) Provider { return p })
+	defer delete(registry, "custom")
+	assert.Contains(t, Names(), "custom")
+	p := &ProviderData{}
+	assert.Equal(t, p, New("custom", p))
+
+	// unknown providers fall back to the default provider, if it's built in
+	if google, ok := registry[defaultProvider]; ok {
+		delete(registry, defaultProvider)
+		defer Register(defaultProvider, google)
+	}
+	assert.NotContains(t, Names(), defaultProvider)
+	assert.Nil(t, New("unknown", &ProviderData{}))
+}
@@ -1,4 +1,4 @@
-package main
+package oauth2proxy
 
 import (
 	"fmt"
@@ -7,6 +7,7 @@ import (
 	"strings"
 
 	"github.com/oauth2-proxy/oauth2-proxy/pkg/logger"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/middleware"
 )
 
 type realClientIPParser interface {
@@ -34,7 +35,8 @@ type xForwardedForClientIPParser struct {
 // * https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/X-Forwarded-For.
 // Returns the `<client>` portion specified in the above document.
 // Additionally, is capable of parsing IPs with the port included, for v4 in the format "<ip>:<port>" and for v6 in the
-// format "[<ip>]:<port>".  With-port and without-port formats are seamlessly supported concurrently.
+// format "[<ip>]:<port>".  With-port and without-port formats are seamlessly supported concurrently, as are
+// bracketed v6 IPs without a port, v6 zones and quoted IPs. See parseIP.
 func (p xForwardedForClientIPParser) GetRealClientIP(h http.Header) (net.IP, error) {
 	var ipStr string
 	if realIP := h.Get(p.header); realIP != "" {
@@ -50,11 +52,7 @@ func (p xForwardedForClientIPParser) GetRealClientIP(h http.Header) (net.IP, err
 	}
 	ipStr = strings.TrimSpace(ipStr)
 
-	if ipHost, _, err := net.SplitHostPort(ipStr); err == nil {
-		ipStr = ipHost
-	}
-
-	ip := net.ParseIP(ipStr)
+	ip := parseIP(ipStr)
 	if ip == nil {
 		return nil, fmt.Errorf("unable to parse ip (%s) from %s header", ipStr, http.CanonicalHeaderKey(p.header))
 	}
@@ -62,11 +60,29 @@ func (p xForwardedForClientIPParser) GetRealClientIP(h http.Header) (net.IP, err
 	return ip, nil
 }
 
+// parseIP parses an IP address as it appears in forwarding headers and remote
+// addresses: with or without a port, bracketed or quoted, and with or without
+// an IPv6 zone, which is dropped as it only means something to the host that
+// added it. IPv4-mapped IPv6 addresses are equal to, and print as, the IPv4
+// address they map. Returns nil if s isn't an IP address.
+func parseIP(s string) net.IP {
+	s = strings.Trim(s, `"`)
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	} else if strings.HasPrefix(s, "[") && strings.HasSuffix(s, "]") {
+		s = s[1 : len(s)-1]
+	}
+	if zone := strings.IndexByte(s, '%'); zone != -1 {
+		s = s[:zone]
+	}
+	return net.ParseIP(s)
+}
+
 // getRemoteIP obtains the IP of the low-level connected network host
 func getRemoteIP(req *http.Request) (net.IP, error) {
 	if ipStr, _, err := net.SplitHostPort(req.RemoteAddr); err != nil {
 		return nil, fmt.Errorf("unable to get ip and port from http.RemoteAddr (%s)", req.RemoteAddr)
-	} else if ip := net.ParseIP(ipStr); ip != nil {
+	} else if ip := parseIP(ipStr); ip != nil {
 		return ip, nil
 	} else {
 		return nil, fmt.Errorf("unable to parse ip (%s)", ipStr)
@@ -100,3 +116,16 @@ func getClientString(p realClientIPParser, req *http.Request, full bool) (s stri
 	}
 	return remoteIPStr
 }
+
+// newRealClientIPMiddleware records the human readable client address,
+// including the real client IP if available, in the request scope
+func newRealClientIPMiddleware(p realClientIPParser) middleware.Constructor {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			if scope := middleware.GetRequestScope(req); scope != nil {
+				scope.ClientIP = getClientString(p, req, true)
+			}
+			next.ServeHTTP(rw, req)
+		})
+	}
+}
@@ -1,4 +1,4 @@
-package main
+package oauth2proxy
 
 import (
 	"net"
@@ -63,6 +63,13 @@ func TestXForwardedForClientIPParser(t *testing.T) {
 		{"[::1]:1234", "", net.ParseIP("::1")},
 		{"10.0.10.11:1234", "", net.ParseIP("10.0.10.11")},
 		{"192.168.10.50, 10.0.0.1, 1.2.3.4", "", net.ParseIP("192.168.10.50")},
+		{"[2001:db8::1], 10.0.0.1", "", net.ParseIP("2001:db8::1")},
+		{"[2001:db8::1]:4711, [2001:db8::2]", "", net.ParseIP("2001:db8::1")},
+		{"fe80::1%eth0", "", net.ParseIP("fe80::1")},
+		{"[fe80::1%25eth0]:1234", "", net.ParseIP("fe80::1")},
+		{"::ffff:192.0.2.1", "", net.ParseIP("192.0.2.1")},
+		{"\"[2001:db8::1]:4711\"", "", net.ParseIP("2001:db8::1")},
+		{"[1.2.3.4", "unable to parse ip ([1.2.3.4) from X-Forwarded-For header", nil},
 		{"nil", "unable to parse ip (nil) from X-Forwarded-For header", nil},
 		{"10000.10000.10000.10000", "unable to parse ip (10000.10000.10000.10000) from X-Forwarded-For header", nil},
 	}
@@ -117,6 +124,8 @@ func TestGetRemoteIP(t *testing.T) {
 		{"10000.10000.10000.10000:8080", "unable to parse ip (10000.10000.10000.10000)", nil},
 		{"[::1]:48290", "", net.ParseIP("::1")},
 		{"10.254.244.165:62750", "", net.ParseIP("10.254.244.165")},
+		{"[fe80::1%eth0]:62750", "", net.ParseIP("fe80::1")},
+		{"[::ffff:10.254.244.165]:62750", "", net.ParseIP("10.254.244.165")},
 	}
 
 	for _, test := range tests {
@@ -157,6 +166,8 @@ func TestGetClientString(t *testing.T) {
 		{nil, "10.254.244.165:62750", "", "10.254.244.165", "10.254.244.165"},
 		// Parser is nil, the contents of X-Forwarded-For should be ignored in all cases.
 		{nil, "[2001:470:26:307:a5a1:1177:2ae3:e9c3]:48290", "127.0.0.1", "2001:470:26:307:a5a1:1177:2ae3:e9c3", "2001:470:26:307:a5a1:1177:2ae3:e9c3"},
+		// IPv4-mapped addresses are logged as IPv4
+		{p, "[::ffff:10.0.0.1]:48290", "[::ffff:99.103.56.12]", "99.103.56.12", "10.0.0.1 (99.103.56.12)"},
 	}
 
 	for _, test := range tests {
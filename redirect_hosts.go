@@ -0,0 +1,41 @@
+package oauth2proxy
+
+import (
+	"fmt"
+	"strings"
+)
+
+// isRedirectHost checks whether the request host is one of the redirect
+// hosts, so that the redirect URL can be derived from it. Like whitelisted
+// domains, hosts prefixed with a . match their subdomains, and a port of *
+// matches any port.
+func (p *OAuthProxy) isRedirectHost(host string) bool {
+	hostname, port := splitHostPort(host)
+	for _, allowed := range p.redirectHosts {
+		allowedHostname, allowedPort := splitHostPort(strings.TrimPrefix(allowed, "."))
+		if hostname != allowedHostname && !(strings.HasPrefix(allowed, ".") && strings.HasSuffix(hostname, "."+allowedHostname)) {
+			continue
+		}
+		if allowedPort == "*" || allowedPort == port {
+			return true
+		}
+	}
+	return false
+}
+
+// redirectHostAllowed checks whether a sign in can be completed through the
+// request host: either the redirect URL has a host of its own, or the request
+// host is one of the redirect hosts
+func (p *OAuthProxy) redirectHostAllowed(host string) bool {
+	return len(p.redirectHosts) == 0 || p.redirectURL.Host != "" || p.isRedirectHost(host)
+}
+
+func validateRedirectHosts(o *Options, msgs []string) []string {
+	for _, host := range o.RedirectHosts {
+		hostname, _ := splitHostPort(strings.TrimPrefix(host, "."))
+		if hostname == "" || strings.ContainsAny(host, "/?#@") {
+			msgs = append(msgs, fmt.Sprintf("redirect_host (%s) must be a host, optionally with a port", host))
+		}
+	}
+	return msgs
+}
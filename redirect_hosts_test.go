@@ -0,0 +1,75 @@
+package oauth2proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsRedirectHost(t *testing.T) {
+	proxy := &OAuthProxy{redirectHosts: []string{"app.example.com", ".internal.example.com", "localhost:*"}}
+
+	for host, expected := range map[string]bool{
+		"app.example.com":          true,
+		"app.example.com:8443":     false,
+		"a.internal.example.com":   true,
+		"internal.example.com":     true,
+		"evilinternal.example.com": false,
+		"localhost:4180":           true,
+		"other.example.com":        false,
+	} {
+		assert.Equal(t, expected, proxy.isRedirectHost(host), host)
+	}
+}
+
+func TestRedirectHosts(t *testing.T) {
+	for _, redirectURL := range []string{"", "https://auth.example.com/oauth2/callback"} {
+		opts := testOptions()
+		opts.RedirectURL = redirectURL
+		opts.RedirectHosts = []string{"a.example.com", "b.example.com"}
+		require.NoError(t, opts.Validate())
+		proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+		require.NoError(t, err)
+
+		for _, host := range []string{"a.example.com", "b.example.com"} {
+			assert.Equal(t, "https://"+host+"/oauth2/callback", proxy.GetRedirectURI(host))
+
+			rw := httptest.NewRecorder()
+			proxy.ServeHTTP(rw, httptest.NewRequest("GET", "https://"+host+"/oauth2/start", nil))
+			assert.Equal(t, http.StatusFound, rw.Code)
+			location, err := url.Parse(rw.Header().Get("Location"))
+			assert.NoError(t, err)
+			assert.Equal(t, "https://"+host+"/oauth2/callback", location.Query().Get("redirect_uri"))
+		}
+
+		// Other hosts fall back to the redirect URL, or can't sign in if it
+		// has no host
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, httptest.NewRequest("GET", "https://evil.example.com/oauth2/start", nil))
+		if redirectURL == "" {
+			assert.Equal(t, http.StatusBadRequest, rw.Code)
+		} else {
+			assert.Equal(t, http.StatusFound, rw.Code)
+			location, err := url.Parse(rw.Header().Get("Location"))
+			assert.NoError(t, err)
+			assert.Equal(t, redirectURL, location.Query().Get("redirect_uri"))
+		}
+	}
+}
+
+func TestRedirectHostOptions(t *testing.T) {
+	o := testOptions()
+	o.RedirectHosts = []string{"app.example.com", "https://app.example.com", ".", "app.example.com/callback"}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"redirect_host (https://app.example.com) must be a host, optionally with a port",
+		"redirect_host (.) must be a host, optionally with a port",
+		"redirect_host (app.example.com/callback) must be a host, optionally with a port"})
+	assert.Equal(t, expected, err.Error())
+}
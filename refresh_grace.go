@@ -0,0 +1,30 @@
+package oauth2proxy
+
+import (
+	"errors"
+	"expvar"
+
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/providers"
+)
+
+// refreshGraceServed counts the requests served with a session whose refresh
+// failed because the provider was unavailable
+var refreshGraceServed = expvar.NewInt("refresh_grace_served")
+
+// inRefreshGrace checks whether a session whose refresh failed with err may
+// still be used: the provider must have been unavailable, and the session's
+// tokens must not have expired yet, as when refreshed ahead of their expiry,
+// or have expired less than the grace period ago
+func (p *OAuthProxy) inRefreshGrace(session *sessionsapi.SessionState, err error) bool {
+	if !errors.Is(err, providers.ErrProviderUnavailable) {
+		return false
+	}
+	if !session.ExpiresOn.IsZero() && !session.IsExpired() {
+		return true
+	}
+	if p.refreshGracePeriod <= 0 {
+		return false
+	}
+	return session.ExpiresOn.IsZero() || p.now().Sub(session.ExpiresOn) <= p.refreshGracePeriod
+}
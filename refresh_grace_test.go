@@ -0,0 +1,70 @@
+package oauth2proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/providers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type refreshFailingProvider struct {
+	*TestProvider
+	err error
+}
+
+func (p *refreshFailingProvider) RefreshSessionIfNeeded(context.Context, *sessionsapi.SessionState) (bool, error) {
+	return false, p.err
+}
+
+func TestRefreshGracePeriod(t *testing.T) {
+	unavailable := fmt.Errorf("unable to redeem refresh token: %w", &providers.RedeemError{StatusCode: 503})
+	rejected := fmt.Errorf("unable to redeem refresh token: %w", &providers.RedeemError{StatusCode: 400})
+	revoked := fmt.Errorf("unable to redeem refresh token: %w", &providers.RedeemError{StatusCode: 400, Body: []byte(`{"error":"invalid_grant"}`)})
+
+	tests := []struct {
+		name      string
+		grace     time.Duration
+		err       error
+		expiredAt time.Duration
+		kept      bool
+	}{
+		{"disabled", 0, unavailable, time.Minute, false},
+		{"provider unavailable", time.Hour, unavailable, time.Minute, true},
+		{"grace period over", time.Hour, unavailable, 2 * time.Hour, false},
+		{"refresh rejected", time.Hour, rejected, time.Minute, false},
+		{"refresh token revoked", time.Hour, revoked, time.Minute, false},
+		{"refreshed before expiry", 0, unavailable, -time.Minute, true},
+		{"revoked before expiry", 0, revoked, -time.Minute, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			pcTest := NewProcessCookieTestWithDefaults()
+			pcTest.proxy.refreshGracePeriod = test.grace
+			pcTest.proxy.provider = &refreshFailingProvider{TestProvider: &TestProvider{ProviderData: &providers.ProviderData{}, ValidToken: true}, err: test.err}
+			require.NoError(t, pcTest.SaveSession(&sessionsapi.SessionState{
+				Email:        "john.doe@example.com",
+				AccessToken:  "my_access_token",
+				RefreshToken: "my_refresh_token",
+				CreatedAt:    time.Now(),
+				ExpiresOn:    time.Now().Add(-test.expiredAt),
+			}))
+
+			served := refreshGraceServed.Value()
+			session, err := pcTest.proxy.getAuthenticatedSession(pcTest.rw, pcTest.req)
+			if test.kept {
+				require.NoError(t, err)
+				assert.Equal(t, "john.doe@example.com", session.Email)
+				assert.Equal(t, served+1, refreshGraceServed.Value())
+			} else {
+				assert.True(t, errors.Is(err, ErrNeedsLogin))
+				assert.Equal(t, served, refreshGraceServed.Value())
+			}
+		})
+	}
+}
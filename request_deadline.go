@@ -0,0 +1,125 @@
+package oauth2proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/http/httputil"
+	"sync"
+
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/logger"
+)
+
+// The stages of a request its deadline may pass in, as they're described
+// on the error page
+const (
+	stageSession  = "loading the session"
+	stageRefresh  = "refreshing the session"
+	stageUpstream = "waiting for the upstream"
+)
+
+type requestStageKey struct{}
+
+// requestStage is the stage a request with a deadline is in, so that the
+// error page can say which of them ran out of time
+type requestStage struct {
+	mu    sync.Mutex
+	stage string
+}
+
+// withRequestDeadline gives the request the deadline that loading its
+// session, refreshing it and calling the upstream must all finish by, each
+// with the time the stages before it left. Websocket requests have no
+// deadline, as they last as long as their connection.
+func (p *OAuthProxy) withRequestDeadline(req *http.Request) (*http.Request, context.CancelFunc) {
+	if p.requestDeadline <= 0 || isWebSocket(req) {
+		return req, func() {}
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), p.requestDeadline)
+	ctx = context.WithValue(ctx, requestStageKey{}, &requestStage{})
+	return req.WithContext(ctx), cancel
+}
+
+// setRequestStage records the stage the request is starting, if it has a
+// deadline
+func setRequestStage(req *http.Request, stage string) {
+	if s, ok := req.Context().Value(requestStageKey{}).(*requestStage); ok {
+		s.mu.Lock()
+		s.stage = stage
+		s.mu.Unlock()
+	}
+}
+
+// timedOutStage returns the stage the request's deadline passed in, and
+// whether it has passed
+func timedOutStage(req *http.Request) (string, bool) {
+	s, ok := req.Context().Value(requestStageKey{}).(*requestStage)
+	if !ok || !errors.Is(req.Context().Err(), context.DeadlineExceeded) {
+		return "", false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.stage, true
+}
+
+// deadlineMessage tells the user which stage of their request timed out
+func deadlineMessage(stage string) string {
+	if stage == "" {
+		return "The request timed out"
+	}
+	return fmt.Sprintf("The request timed out %s", stage)
+}
+
+// deadlinePage rejects a request whose deadline passed before it reached
+// the upstream
+func (p *OAuthProxy) deadlinePage(rw http.ResponseWriter, req *http.Request) {
+	stage, _ := timedOutStage(req)
+	logger.PrintfRequest(req, "Request deadline of %s passed %s", p.requestDeadline, stage)
+	if isAjax(req) {
+		p.ErrorJSON(rw, http.StatusGatewayTimeout)
+		return
+	}
+	p.ErrorPage(rw, http.StatusGatewayTimeout, "Gateway Timeout", deadlineMessage(stage))
+}
+
+// setProxyDeadline serves the error page saying which stage timed out when
+// the request's deadline passes before the upstream responds. Other errors
+// are handled as they were.
+func setProxyDeadline(proxy *httputil.ReverseProxy, templates *template.Template, proxyPrefix string) {
+	next := proxy.ErrorHandler
+	proxy.ErrorHandler = func(rw http.ResponseWriter, req *http.Request, err error) {
+		stage, ok := timedOutStage(req)
+		if !ok {
+			if next != nil {
+				next(rw, req, err)
+				return
+			}
+			logger.Printf("Error proxying request to upstream: %v", err)
+			rw.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		logger.PrintfRequest(req, "Request deadline passed %s: %v", stage, err)
+		prepareNoCache(rw)
+		if isAjax(req) {
+			rw.Header().Set("Content-Type", applicationJSON)
+			rw.WriteHeader(http.StatusGatewayTimeout)
+			return
+		}
+		rw.WriteHeader(http.StatusGatewayTimeout)
+		t := struct {
+			Title       string
+			Message     string
+			ProxyPrefix string
+			RequestID   string
+		}{
+			Title:       fmt.Sprintf("%d %s", http.StatusGatewayTimeout, "Gateway Timeout"),
+			Message:     deadlineMessage(stage),
+			ProxyPrefix: proxyPrefix,
+		}
+		if err := templates.ExecuteTemplate(rw, "error.html", t); err != nil {
+			logger.Printf("Error rendering error template: %v", err)
+		}
+	}
+}
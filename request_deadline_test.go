@@ -0,0 +1,82 @@
+package oauth2proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/providers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type slowRefreshProvider struct {
+	*TestProvider
+}
+
+func (p *slowRefreshProvider) RefreshSessionIfNeeded(ctx context.Context, _ *sessionsapi.SessionState) (bool, error) {
+	<-ctx.Done()
+	return false, ctx.Err()
+}
+
+func TestRequestDeadlineRefresh(t *testing.T) {
+	pcTest := NewProcessCookieTestWithDefaults()
+	pcTest.proxy.requestDeadline = 20 * time.Millisecond
+	pcTest.proxy.provider = &slowRefreshProvider{TestProvider: &TestProvider{ProviderData: &providers.ProviderData{}, ValidToken: true}}
+	require.NoError(t, pcTest.SaveSession(&sessionsapi.SessionState{
+		Email:        "john.doe@example.com",
+		AccessToken:  "my_access_token",
+		RefreshToken: "my_refresh_token",
+		CreatedAt:    time.Now(),
+	}))
+
+	rw := httptest.NewRecorder()
+	pcTest.proxy.ServeHTTP(rw, pcTest.req)
+	assert.Equal(t, http.StatusGatewayTimeout, rw.Code)
+	assert.Contains(t, rw.Body.String(), "The request timed out refreshing the session")
+	// the session is kept to be refreshed again
+	for _, c := range rw.Result().Cookies() {
+		assert.NotEqual(t, pcTest.opts.Cookie.Name, c.Name)
+	}
+}
+
+func TestRequestDeadlineUpstream(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		select {
+		case <-req.Context().Done():
+		case <-time.After(time.Second):
+		}
+	}))
+	defer upstream.Close()
+
+	opts := testOptions()
+	opts.Upstreams = []string{upstream.URL}
+	opts.SkipAuthRegex = []string{".*"}
+	opts.RequestDeadline = 20 * time.Millisecond
+	require.NoError(t, opts.Validate())
+	proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+	require.NoError(t, err)
+
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, httptest.NewRequest("GET", "/", nil))
+	assert.Equal(t, http.StatusGatewayTimeout, rw.Code)
+	assert.Contains(t, rw.Body.String(), "The request timed out waiting for the upstream")
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept", "application/json")
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusGatewayTimeout, rw.Code)
+	assert.Empty(t, rw.Body.String())
+}
+
+func TestRequestDeadlineOption(t *testing.T) {
+	o := testOptions()
+	o.RequestDeadline = -time.Second
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{"request_deadline (-1s) must not be negative"}), err.Error())
+}
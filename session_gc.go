@@ -0,0 +1,64 @@
+package oauth2proxy
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"time"
+
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/logger"
+)
+
+var (
+	sessionGCRuns      = expvar.NewInt("session_gc_runs")
+	sessionGCErrors    = expvar.NewInt("session_gc_errors")
+	sessionGCUnbounded = expvar.NewInt("session_gc_unbounded")
+	sessionGCOrphaned  = expvar.NewInt("session_gc_orphaned")
+)
+
+// CollectSessionGarbage removes the records of the configured session store
+// that its backend won't remove by itself, reporting what was found. The
+// options must have been validated.
+func CollectSessionGarbage(ctx context.Context, opts *Options) (*sessionsapi.GarbageReport, error) {
+	collector, ok := opts.sessionStore.(sessionsapi.GarbageCollector)
+	if !ok {
+		return nil, fmt.Errorf("the %s session store holds no garbage to collect", opts.Session.Type)
+	}
+	report, err := collector.CollectGarbage(ctx)
+	if err != nil {
+		sessionGCErrors.Add(1)
+		return nil, err
+	}
+	sessionGCRuns.Add(1)
+	sessionGCUnbounded.Add(report.Unbounded)
+	sessionGCOrphaned.Add(report.Orphaned)
+	return report, nil
+}
+
+// collectSessionGarbage collects the garbage of the session store every
+// session_gc_interval until done is closed
+func collectSessionGarbage(opts *Options, done <-chan struct{}) {
+	if opts.Session.GCInterval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(opts.Session.GCInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				ctx, cancel := context.WithTimeout(context.Background(), opts.Session.GCInterval)
+				report, err := CollectSessionGarbage(ctx, opts)
+				cancel()
+				if err != nil {
+					logger.Printf("Error collecting session garbage: %v", err)
+					continue
+				}
+				logger.Printf("Collected session garbage: %s", report)
+			}
+		}
+	}()
+}
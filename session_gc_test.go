@@ -0,0 +1,51 @@
+package oauth2proxy
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCollectSessionGarbage(t *testing.T) {
+	o := redisTestOptions(t)
+	require.NoError(t, o.Validate())
+	req := httptest.NewRequest("GET", "/", nil)
+	session := &sessionsapi.SessionState{Email: "jane@example.com", CreatedAt: time.Now()}
+	require.NoError(t, o.sessionStore.Save(req.Context(), httptest.NewRecorder(), req, session))
+
+	runs := sessionGCRuns.Value()
+	report, err := CollectSessionGarbage(context.Background(), o)
+	require.NoError(t, err)
+	assert.Equal(t, sessionsapi.GarbageReport{Sessions: 1}, *report)
+	assert.Equal(t, runs+1, sessionGCRuns.Value())
+
+	o = testOptions()
+	require.NoError(t, o.Validate())
+	_, err = CollectSessionGarbage(context.Background(), o)
+	assert.EqualError(t, err, "the cookie session store holds no garbage to collect")
+}
+
+func TestSessionGCOptions(t *testing.T) {
+	o := redisTestOptions(t)
+	o.Session.GCInterval = time.Hour
+	assert.NoError(t, o.Validate())
+
+	o = testOptions()
+	o.Session.GCInterval = time.Hour
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		"session_gc_interval requires session_store_type redis"}), err.Error())
+
+	o = testOptions()
+	o.Session.GCInterval = -time.Hour
+	err = o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		"session_gc_interval (-1h0m0s) must not be negative"}), err.Error())
+}
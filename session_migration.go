@@ -0,0 +1,85 @@
+package oauth2proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/logger"
+)
+
+// ExportSessions writes the records of the configured session store to w, as
+// a JSON object per line, returning how many were written. The options must
+// have been validated.
+func ExportSessions(ctx context.Context, opts *Options, w io.Writer) (int, error) {
+	exporter, ok := opts.sessionStore.(sessionsapi.Exporter)
+	if !ok {
+		return 0, fmt.Errorf("sessions can't be exported from the %s session store", opts.Session.Type)
+	}
+
+	var n int
+	enc := json.NewEncoder(w)
+	err := exporter.ExportRecords(ctx, func(record *sessionsapi.StoredRecord) error {
+		if err := enc.Encode(record); err != nil {
+			return fmt.Errorf("error writing session: %v", err)
+		}
+		n++
+		return nil
+	})
+	return n, err
+}
+
+// ImportSessions imports the records written by ExportSessions from r into
+// the configured session store, returning how many were imported. Records
+// that have expired since they were exported are skipped. The options must
+// have been validated.
+func ImportSessions(ctx context.Context, opts *Options, r io.Reader) (int, error) {
+	exporter, ok := opts.sessionStore.(sessionsapi.Exporter)
+	if !ok {
+		return 0, fmt.Errorf("sessions can't be imported into the %s session store", opts.Session.Type)
+	}
+
+	var n int
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		record := &sessionsapi.StoredRecord{}
+		if err := json.Unmarshal(scanner.Bytes(), record); err != nil {
+			return n, fmt.Errorf("error decoding session on line %d: %v", line, err)
+		}
+		err := exporter.ImportRecord(ctx, record)
+		if errors.Is(err, sessionsapi.ErrExpired) {
+			continue
+		} else if err != nil {
+			return n, err
+		}
+		n++
+	}
+	if err := scanner.Err(); err != nil {
+		return n, fmt.Errorf("error reading sessions: %v", err)
+	}
+	return n, nil
+}
+
+// loadPreviousSession loads the request's session from the store configured
+// by previous_session_store_type and previous_cookie_secret, if any, for it to
+// be saved again to the current store
+func (p *OAuthProxy) loadPreviousSession(req *http.Request) *sessionsapi.SessionState {
+	if p.prevSessionStore == nil {
+		return nil
+	}
+	session, err := p.prevSessionStore.Load(req.Context(), req)
+	if err != nil {
+		return nil
+	}
+	logger.Printf("Migrating session from the previous session store: %s", session)
+	return session
+}
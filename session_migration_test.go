@@ -0,0 +1,133 @@
+package oauth2proxy
+
+import (
+	"bytes"
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/apis/options"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// skipWithoutRedis skips a test using the redis session store when it's
+// left out of the build
+func skipWithoutRedis(t *testing.T) {
+	t.Helper()
+	if !withRedis {
+		t.Skip("the redis session store is left out of the build")
+	}
+}
+
+func redisTestOptions(t *testing.T) *Options {
+	skipWithoutRedis(t)
+	mr, err := miniredis.Run()
+	require.NoError(t, err)
+	t.Cleanup(mr.Close)
+
+	o := testOptions()
+	o.Session.Type = options.RedisSessionStoreType
+	o.Session.Redis.ConnectionURL = "redis://" + mr.Addr()
+	return o
+}
+
+func TestExportImportSessions(t *testing.T) {
+	source := redisTestOptions(t)
+	require.NoError(t, source.Validate())
+	req := httptest.NewRequest("GET", "/", nil)
+	rw := httptest.NewRecorder()
+	session := &sessionsapi.SessionState{Email: "jane@example.com", CreatedAt: time.Now()}
+	require.NoError(t, source.sessionStore.Save(req.Context(), rw, req, session))
+
+	var buf bytes.Buffer
+	n, err := ExportSessions(context.Background(), source, &buf)
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	target := redisTestOptions(t)
+	require.NoError(t, target.Validate())
+	n, err = ImportSessions(context.Background(), target, strings.NewReader(buf.String()+"\n"))
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+
+	// The cookie issued by the source loads the session from the target
+	req = httptest.NewRequest("GET", "/", nil)
+	for _, cookie := range rw.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	loaded, err := target.sessionStore.Load(req.Context(), req)
+	require.NoError(t, err)
+	assert.Equal(t, "jane@example.com", loaded.Email)
+
+	_, err = ImportSessions(context.Background(), target, strings.NewReader("not json"))
+	assert.Error(t, err)
+
+	cookieStore := testOptions()
+	require.NoError(t, cookieStore.Validate())
+	_, err = ExportSessions(context.Background(), cookieStore, &buf)
+	assert.Error(t, err)
+}
+
+func TestPreviousSessionStoreMigration(t *testing.T) {
+	previous := testOptions()
+	previous.Cookie.Secret = "old-cookie-key-!"
+	previous.Cookie.Refresh = time.Hour
+	require.NoError(t, previous.Validate())
+	req := httptest.NewRequest("GET", "/", nil)
+	rw := httptest.NewRecorder()
+	session := &sessionsapi.SessionState{Email: "jane@example.com", CreatedAt: time.Now()}
+	require.NoError(t, previous.sessionStore.Save(req.Context(), rw, req, session))
+
+	o := redisTestOptions(t)
+	o.Cookie.Secret = "new-cookie-key-!"
+	o.Cookie.Refresh = time.Hour
+	o.PreviousCookieSecret = previous.Cookie.Secret
+	o.PreviousSessionStoreType = options.CookieSessionStoreType
+	require.NoError(t, o.Validate())
+	proxy, err := NewOAuthProxy(o, func(string) bool { return true })
+	require.NoError(t, err)
+	proxy.provider = &TestProvider{ValidToken: true}
+
+	req = httptest.NewRequest("GET", "/", nil)
+	for _, cookie := range rw.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	rw = httptest.NewRecorder()
+	migrated, err := proxy.getAuthenticatedSession(rw, req)
+	require.NoError(t, err)
+	assert.Equal(t, "jane@example.com", migrated.Email)
+
+	// The session is saved to the current store with the current secret
+	req = httptest.NewRequest("GET", "/", nil)
+	for _, cookie := range rw.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	loaded, err := o.sessionStore.Load(req.Context(), req)
+	require.NoError(t, err)
+	assert.Equal(t, "jane@example.com", loaded.Email)
+}
+
+func TestPreviousSessionStoreOptions(t *testing.T) {
+	o := testOptions()
+	o.PreviousCookieSecret = cookieSecret
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"previous_cookie_secret or previous_session_store_type must differ from the current cookie_secret and session_store_type"})
+	assert.Equal(t, expected, err.Error())
+
+	o = testOptions()
+	o.PreviousSessionStoreType = "memcached"
+	err = o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected = errorMsg([]string{
+		"error initialising previous session storage: unknown session store type 'memcached'"})
+	assert.Equal(t, expected, err.Error())
+}
@@ -0,0 +1,70 @@
+package oauth2proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+)
+
+// AuthorizationDecision is the outcome of evaluating the configured
+// authorization rules against a request
+type AuthorizationDecision struct {
+	Allowed bool
+	// Rule describes the rule that decided the outcome
+	Rule string
+}
+
+func (d AuthorizationDecision) String() string {
+	if d.Allowed {
+		return "allowed: " + d.Rule
+	}
+	return "denied: " + d.Rule
+}
+
+// SimulateAuthorization evaluates the rules the proxy would apply to req on
+// behalf of a user with the given email, in the same order as ServeHTTP,
+// without needing a real session. This is intended for debugging the
+// configured policies.
+// Group membership is checked with the provider, so this may make requests
+// to the provider's APIs.
+func (p *OAuthProxy) SimulateAuthorization(req *http.Request, email string) AuthorizationDecision {
+	path := req.URL.Path
+	switch {
+	case path == p.RobotsPath || path == p.PingPath:
+		return AuthorizationDecision{Allowed: true, Rule: fmt.Sprintf("%s is always public", path)}
+	case p.skipAuthPreflight && req.Method == "OPTIONS":
+		return AuthorizationDecision{Allowed: true, Rule: "skip-auth-preflight"}
+	}
+	for _, u := range p.compiledRegex {
+		if u.MatchString(path) {
+			return AuthorizationDecision{Allowed: true, Rule: fmt.Sprintf("skip-auth-regex %q", u)}
+		}
+	}
+	if wk := matchWellKnownPath(p.wellKnownPaths, path); wk != "" {
+		return AuthorizationDecision{Allowed: true, Rule: fmt.Sprintf("skip-auth-well-known %s", wk)}
+	}
+	if strings.HasPrefix(path, p.ProxyPrefix+"/") && path != p.AuthOnlyPath && path != p.UserInfoPath {
+		return AuthorizationDecision{Allowed: true, Rule: fmt.Sprintf("%s is served by the proxy without authentication", path)}
+	}
+
+	if email == "" {
+		for _, u := range p.anonymousRegex {
+			if u.MatchString(path) {
+				return AuthorizationDecision{Allowed: true, Rule: fmt.Sprintf("anonymous-regex %q proxies as %s", u, anonymousUser)}
+			}
+		}
+		return AuthorizationDecision{Allowed: false, Rule: "authentication required"}
+	}
+	if !p.Validator(email) {
+		return AuthorizationDecision{Allowed: false, Rule: fmt.Sprintf("%s is not permitted by email-domain or authenticated-emails-file", email)}
+	}
+	if !p.provider.ValidateGroup(req.Context(), email) {
+		return AuthorizationDecision{Allowed: false, Rule: fmt.Sprintf("%s is not a member of the groups required by the %s provider", email, p.provider.Data().ProviderName)}
+	}
+	if w := p.closedAccessWindow(req, &sessionsapi.SessionState{Email: email}); w != nil {
+		return AuthorizationDecision{Allowed: false, Rule: fmt.Sprintf("access-window %q is closed", w)}
+	}
+	return AuthorizationDecision{Allowed: true, Rule: fmt.Sprintf("%s is permitted by email-domain or authenticated-emails-file", email)}
+}
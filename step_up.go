@@ -0,0 +1,123 @@
+package oauth2proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+)
+
+// stepUpRoute requires sessions used for paths matching regex to have been
+// authenticated with at least acr
+type stepUpRoute struct {
+	regex *regexp.Regexp
+	acr   string
+}
+
+// parseStepUpRoute parses a step-up route of the form <regex>=<acr>. The
+// last "=" separates them, as regexes may contain one.
+func parseStepUpRoute(s string) (stepUpRoute, error) {
+	i := strings.LastIndex(s, "=")
+	if i < 0 || strings.TrimSpace(s[i+1:]) == "" {
+		return stepUpRoute{}, fmt.Errorf("step_up_route (%s) must be of the form <regex>=<acr>", s)
+	}
+	regex, err := regexp.Compile(s[:i])
+	if err != nil {
+		return stepUpRoute{}, fmt.Errorf("error compiling step_up_route regex=%q %s", s[:i], err)
+	}
+	return stepUpRoute{regex: regex, acr: strings.TrimSpace(s[i+1:])}, nil
+}
+
+// stepUpACR returns the ACR required for the path, or "" when it has no
+// step-up policy. The first matching route applies.
+func (p *OAuthProxy) stepUpACR(path string) string {
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path = path[:i]
+	}
+	for _, route := range p.stepUpRoutes {
+		if route.regex.MatchString(path) {
+			return route.acr
+		}
+	}
+	return ""
+}
+
+// satisfiesACR checks whether the session was authenticated strongly enough:
+// with the required ACR, with a stronger one of the configured levels, or
+// with the required value among its authentication methods (AMR)
+func (p *OAuthProxy) satisfiesACR(session *sessionsapi.SessionState, required string) bool {
+	if required == "" || session.ACR == required {
+		return true
+	}
+	for _, method := range session.AMR {
+		if method == required {
+			return true
+		}
+	}
+	have, want := -1, -1
+	for i, level := range p.stepUpACRLevels {
+		if level == session.ACR {
+			have = i
+		}
+		if level == required {
+			want = i
+		}
+	}
+	return have >= 0 && want >= 0 && have >= want
+}
+
+// requiresStepUp checks whether the user must authenticate again with a
+// stronger method before the session can be used for the request
+func (p *OAuthProxy) requiresStepUp(req *http.Request, session *sessionsapi.SessionState) bool {
+	if len(p.stepUpRoutes) == 0 {
+		return false
+	}
+	return !p.satisfiesACR(session, p.stepUpACR(p.policyPath(req)))
+}
+
+// policyPath returns the path route policies are applied to: the path of the
+// request, or for the auth endpoint the path of the original request, from
+// X-Forwarded-Uri, without its query
+func (p *OAuthProxy) policyPath(req *http.Request) string {
+	path := req.URL.Path
+	if path == p.AuthOnlyPath && req.Header.Get("X-Forwarded-Uri") != "" {
+		path = req.Header.Get("X-Forwarded-Uri")
+	}
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path = path[:i]
+	}
+	return path
+}
+
+// redirectACR returns the ACR required by the page users return to after
+// signing in
+func (p *OAuthProxy) redirectACR(redirect string) string {
+	if len(p.stepUpRoutes) == 0 {
+		return ""
+	}
+	rd, err := url.Parse(redirect)
+	if err != nil {
+		return ""
+	}
+	return p.stepUpACR(rd.Path)
+}
+
+// stepUpLoginURL requests the ACR required by the page users are returning
+// to, when it has a step-up policy, in place of the configured acr_values
+func (p *OAuthProxy) stepUpLoginURL(loginURL, redirect string) string {
+	acr := p.redirectACR(redirect)
+	if acr == "" {
+		return loginURL
+	}
+	u, err := url.Parse(loginURL)
+	if err != nil {
+		return loginURL
+	}
+	params := u.Query()
+	params.Set("acr_values", acr)
+	u.RawQuery = params.Encode()
+	return u.String()
+}
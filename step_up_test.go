@@ -0,0 +1,91 @@
+package oauth2proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseStepUpRoute(t *testing.T) {
+	route, err := parseStepUpRoute("^/admin/(a=b)?=urn:example:mfa")
+	require.NoError(t, err)
+	assert.Equal(t, "^/admin/(a=b)?", route.regex.String())
+	assert.Equal(t, "urn:example:mfa", route.acr)
+
+	for _, s := range []string{"^/admin/", "^/admin/=", "(=mfa"} {
+		_, err := parseStepUpRoute(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestSatisfiesACR(t *testing.T) {
+	p := &OAuthProxy{stepUpACRLevels: []string{"pwd", "mfa", "hwk"}}
+	tests := []struct {
+		acr      string
+		amr      []string
+		required string
+		expected bool
+	}{
+		{"", nil, "", true},
+		{"mfa", nil, "mfa", true},
+		{"hwk", nil, "mfa", true},
+		{"pwd", nil, "mfa", false},
+		{"pwd", []string{"pwd", "mfa"}, "mfa", true},
+		{"urn:other", nil, "mfa", false},
+		{"mfa", nil, "urn:other", false},
+	}
+	for _, test := range tests {
+		session := &sessionsapi.SessionState{ACR: test.acr, AMR: test.amr}
+		assert.Equal(t, test.expected, p.satisfiesACR(session, test.required), "%s %v %s", test.acr, test.amr, test.required)
+	}
+}
+
+func TestStepUpRequired(t *testing.T) {
+	pcTest := NewProcessCookieTestWithDefaults()
+	route, err := parseStepUpRoute("^/admin/=mfa")
+	require.NoError(t, err)
+	pcTest.proxy.stepUpRoutes = []stepUpRoute{route}
+	require.NoError(t, pcTest.SaveSession(&sessionsapi.SessionState{Email: "jane@example.com", ACR: "pwd", CreatedAt: time.Now()}))
+	cookie, err := pcTest.req.Cookie(pcTest.opts.Cookie.Name)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("GET", "/admin/users?page=2", nil)
+	req.AddCookie(cookie)
+	rw := httptest.NewRecorder()
+	pcTest.proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusFound, rw.Code)
+	assert.Equal(t, "/oauth2/start?rd=%2Fadmin%2Fusers%3Fpage%3D2", rw.Header().Get("Location"))
+
+	tests := map[string]int{
+		"/":            http.StatusAccepted,
+		"/admin/users": http.StatusUnauthorized,
+	}
+	for uri, code := range tests {
+		req := httptest.NewRequest("GET", pcTest.opts.ProxyPrefix+"/auth", nil)
+		req.AddCookie(cookie)
+		req.Header.Set("X-Forwarded-Uri", uri)
+		rw := httptest.NewRecorder()
+		pcTest.proxy.ServeHTTP(rw, req)
+		assert.Equal(t, code, rw.Code, uri)
+	}
+}
+
+func TestStepUpLoginURL(t *testing.T) {
+	route, err := parseStepUpRoute("^/admin/=mfa")
+	require.NoError(t, err)
+	p := &OAuthProxy{stepUpRoutes: []stepUpRoute{route}}
+
+	loginURL := "https://idp.example.com/authorize?acr_values=pwd&client_id=proxy"
+	assert.Equal(t, loginURL, p.stepUpLoginURL(loginURL, "/"))
+
+	u, err := url.Parse(p.stepUpLoginURL(loginURL, "/admin/users?page=2"))
+	require.NoError(t, err)
+	assert.Equal(t, "mfa", u.Query().Get("acr_values"))
+	assert.Equal(t, "proxy", u.Query().Get("client_id"))
+}
@@ -0,0 +1,77 @@
+package oauth2proxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// systemdListenFDsStart is the first file descriptor systemd passes sockets
+// in, after stdin, stdout and stderr
+const systemdListenFDsStart = 3
+
+// systemdListeners returns the sockets passed by systemd socket activation,
+// by their FileDescriptorName, which is the name of the socket unit unless
+// set. The environment variables passing them are unset, so that they
+// aren't inherited by child processes.
+func systemdListeners() (map[string]net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		// the sockets, if any, are for another process
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+	var names []string
+	if fdNames := os.Getenv("LISTEN_FDNAMES"); fdNames != "" {
+		names = strings.Split(fdNames, ":")
+	}
+
+	listeners := make(map[string]net.Listener, n)
+	for i := 0; i < n; i++ {
+		name := "unknown"
+		if i < len(names) {
+			name = names[i]
+		}
+		if _, ok := listeners[name]; ok {
+			return nil, fmt.Errorf("systemd passed more than one socket named %s", name)
+		}
+		f := os.NewFile(uintptr(systemdListenFDsStart+i), name)
+		ln, err := net.FileListener(f)
+		// the listener has its own copy of the file descriptor
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("systemd socket %s isn't a listening socket: %v", name, err)
+		}
+		listeners[name] = ln
+	}
+	return listeners, nil
+}
+
+// systemdNotify sends a state change, eg. READY=1, to systemd when it
+// started the proxy as a Type=notify service, doing nothing otherwise
+func systemdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if strings.HasPrefix(socket, "@") {
+		// an abstract socket
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
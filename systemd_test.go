@@ -0,0 +1,73 @@
+package oauth2proxy
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSystemdListenersForOtherProcess(t *testing.T) {
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	os.Setenv("LISTEN_FDS", "1")
+	listeners, err := systemdListeners()
+	assert.NoError(t, err)
+	assert.Empty(t, listeners)
+	// and aren't passed on
+	_, ok := os.LookupEnv("LISTEN_FDS")
+	assert.False(t, ok)
+}
+
+func TestSystemdNotify(t *testing.T) {
+	os.Unsetenv("NOTIFY_SOCKET")
+	assert.NoError(t, systemdNotify("READY=1"))
+
+	dir, err := ioutil.TempDir("", "systemd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	os.Setenv("NOTIFY_SOCKET", socket)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+	require.NoError(t, systemdNotify("READY=1"))
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "READY=1", string(buf[:n]))
+}
+
+func TestServerListen(t *testing.T) {
+	httpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer httpLn.Close()
+	httpsLn, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer httpsLn.Close()
+
+	s := NewServer(NewOptions(), nil)
+	s.activated = map[string]net.Listener{"http": httpLn, "https": httpsLn}
+	ln, err := s.listen("https", "tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	assert.Equal(t, httpsLn, ln)
+
+	// a single socket is used whatever its name
+	s.activated = map[string]net.Listener{"oauth2-proxy.socket": httpLn}
+	ln, err = s.listen("https", "tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	assert.Equal(t, httpLn, ln)
+
+	// and without sockets the server listens itself
+	s.activated = nil
+	ln, err = s.listen("http", "tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	assert.NotEqual(t, httpLn.Addr(), ln.Addr())
+}
@@ -1,4 +1,4 @@
-package main
+package oauth2proxy
 
 import (
 	"bytes"
@@ -23,11 +23,11 @@ func TestLoadTemplates(t *testing.T) {
 
 	var defaultSignin bytes.Buffer
 	templates.ExecuteTemplate(&defaultSignin, "sign_in.html", data)
-	assert.Equal(t, "\n<!DOCTYPE html>", defaultSignin.String()[0:16])
+	assert.Equal(t, "<!DOCTYPE html>", defaultSignin.String()[0:15])
 
 	var defaultError bytes.Buffer
 	templates.ExecuteTemplate(&defaultError, "error.html", data)
-	assert.Equal(t, "\n<!DOCTYPE html>", defaultError.String()[0:16])
+	assert.Equal(t, "<!DOCTYPE html>", defaultError.String()[0:15])
 
 	dir, err := ioutil.TempDir("", "templatetest")
 	if err != nil {
@@ -54,6 +54,20 @@ func TestLoadTemplates(t *testing.T) {
 	var errtpl bytes.Buffer
 	templates.ExecuteTemplate(&errtpl, "error.html", data)
 	assert.Equal(t, "Testing testing TESTING", errtpl.String())
+
+	// Templates missing from the directory are built in
+	if err := os.Remove(signInFile); err != nil {
+		log.Fatal(err)
+	}
+	templates = loadTemplates(dir)
+
+	sitpl.Reset()
+	templates.ExecuteTemplate(&sitpl, "sign_in.html", data)
+	assert.Equal(t, "<!DOCTYPE html>", sitpl.String()[0:15])
+
+	errtpl.Reset()
+	templates.ExecuteTemplate(&errtpl, "error.html", data)
+	assert.Equal(t, "Testing testing TESTING", errtpl.String())
 }
 
 func TestTemplatesCompile(t *testing.T) {
@@ -0,0 +1,250 @@
+package oauth2proxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+
+	oidc "github.com/coreos/go-oidc"
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/logger"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/verification"
+	"github.com/oauth2-proxy/oauth2-proxy/providers"
+)
+
+// tenantPlaceholder is replaced with the tenant in a templated OIDC issuer
+// URL, eg. https://sso.example.com/realms/{tenant}
+const tenantPlaceholder = "{tenant}"
+
+// tenantQueryParam names the tenant to sign in to when tenants are taken
+// from the query
+const tenantQueryParam = "tenant"
+
+// errUnknownTenant is returned for tenants missing from the tenants file
+var errUnknownTenant = errors.New("unknown tenant")
+
+// tenantNameRegex restricts tenant names to a single DNS label so that they
+// are safe to substitute into the issuer URL
+var tenantNameRegex = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// TenantConfig is the configuration of a tenant in the tenants file. The
+// client credentials default to the proxy's client-id and client-secret.
+type TenantConfig struct {
+	ClientID            string `json:"client_id"`
+	ClientSecret        string `json:"client_secret"`
+	ProviderDisplayName string `json:"provider_display_name"`
+}
+
+// tenantProviders serves many tenants from one proxy, each signing in with
+// its own realm of the identity provider. The provider for a tenant is
+// created, using OIDC discovery on the tenant's issuer URL, the first time
+// it is needed.
+type tenantProviders struct {
+	// source is where the tenant of a request is taken from: the first
+	// label of the "host" or the "query"
+	source      string
+	tenants     map[string]TenantConfig
+	newProvider func(tenant string, config TenantConfig) (providers.Provider, error)
+
+	mu        sync.Mutex
+	providers map[string]providers.Provider
+}
+
+// loadTenants reads a JSON tenants file, which maps tenant names to their
+// configuration
+func loadTenants(path string) (map[string]TenantConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	tenants := map[string]TenantConfig{}
+	if err := json.Unmarshal(data, &tenants); err != nil {
+		return nil, err
+	}
+	for name := range tenants {
+		if !tenantNameRegex.MatchString(name) {
+			return nil, fmt.Errorf("invalid tenant name %q: must be lowercase letters, digits and dashes", name)
+		}
+	}
+	return tenants, nil
+}
+
+// tenantFromRequest returns the tenant named by the request
+func (t *tenantProviders) tenantFromRequest(req *http.Request) string {
+	if t.source == "query" {
+		return req.URL.Query().Get(tenantQueryParam)
+	}
+	host := req.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.SplitN(host, ".", 2)[0])
+}
+
+// provider returns the provider for the tenant, creating it if needed.
+// Providers that fail to be created, eg. because the identity provider
+// couldn't be reached, are retried the next time they are needed.
+func (t *tenantProviders) provider(tenant string) (providers.Provider, error) {
+	config, ok := t.tenants[tenant]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", errUnknownTenant, tenant)
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if p, ok := t.providers[tenant]; ok {
+		return p, nil
+	}
+	p, err := t.newProvider(tenant, config)
+	if err != nil {
+		return nil, fmt.Errorf("error configuring provider for tenant %q: %v", tenant, err)
+	}
+	t.providers[tenant] = p
+	return p, nil
+}
+
+// configureTenants sets up the tenants of a templated OIDC issuer URL
+func configureTenants(o *Options, msgs []string) []string {
+	if o.Provider != "oidc" {
+		msgs = append(msgs, "a templated oidc-issuer-url can only be used with the oidc provider")
+	}
+	if o.SkipOIDCDiscovery {
+		msgs = append(msgs, "a templated oidc-issuer-url requires OIDC discovery")
+	}
+	switch o.OIDCTenantSource {
+	case "host":
+		if redirectURL, err := url.Parse(o.RedirectURL); err == nil && redirectURL.Host != "" {
+			msgs = append(msgs, "oidc_tenant_source 'host' requires a redirect-url without a host so that each tenant is redirected back to its own host")
+		}
+	case "query":
+	default:
+		msgs = append(msgs, fmt.Sprintf("oidc_tenant_source (%s) must be one of ['host', 'query']", o.OIDCTenantSource))
+	}
+	if o.OIDCTenantsFile == "" {
+		return append(msgs, "a templated oidc-issuer-url requires an oidc-tenants-file")
+	}
+	tenants, err := loadTenants(o.OIDCTenantsFile)
+	if err != nil {
+		return append(msgs, fmt.Sprintf("error loading oidc-tenants-file %s: %v", o.OIDCTenantsFile, err))
+	}
+	if o.Scope == "" {
+		o.Scope = "openid email profile"
+	}
+
+	o.tenantProviders = &tenantProviders{
+		source:    o.OIDCTenantSource,
+		tenants:   tenants,
+		providers: map[string]providers.Provider{},
+		newProvider: func(tenant string, config TenantConfig) (providers.Provider, error) {
+			// The provider outlives the request that creates it, so it can't
+			// use the request's context to fetch signing keys
+			issuer, err := oidc.NewProvider(context.Background(), strings.Replace(o.OIDCIssuerURL, tenantPlaceholder, tenant, -1))
+			if err != nil {
+				return nil, err
+			}
+			data := &providers.ProviderData{
+				Scope:             o.Scope,
+				ClientID:          o.ClientID,
+				ClientSecret:      o.ClientSecret,
+				ClientSecretFile:  o.ClientSecretFile,
+				Prompt:            o.Prompt,
+				ApprovalPrompt:    o.ApprovalPrompt,
+				AcrValues:         o.AcrValues,
+				LoginHint:         o.LoginHint,
+				DomainHint:        o.DomainHint,
+				LookupCache:       o.lookupCache,
+				LookupCacheTTL:    o.ProviderLookupCacheTTL,
+				RefreshSkew:       o.TokenRefreshSkew,
+				ProfileURL:        &url.URL{},
+				ProtectedResource: &url.URL{},
+				ValidateURL:       &url.URL{},
+			}
+			if config.ClientID != "" {
+				data.ClientID = config.ClientID
+				data.ClientSecret = config.ClientSecret
+				data.ClientSecretFile = ""
+			}
+			if data.LoginURL, err = url.Parse(issuer.Endpoint().AuthURL); err != nil {
+				return nil, err
+			}
+			if data.RedeemURL, err = url.Parse(issuer.Endpoint().TokenURL); err != nil {
+				return nil, err
+			}
+
+			p := providers.NewOIDCProvider(data)
+			p.AllowUnverifiedEmail = o.InsecureOIDCAllowUnverifiedEmail
+			p.UserIDClaim = o.UserIDClaim
+			p.RefreshValidation = o.Verification.RefreshValidation
+			p.Verifier = verification.NewProviderVerifier(issuer, data.ClientID, o.Verification)
+			if config.ProviderDisplayName != "" {
+				p.ProviderName = config.ProviderDisplayName
+			}
+			return p, nil
+		},
+	}
+	return msgs
+}
+
+// allowsSession checks whether the session may be used for the request.
+// When tenants are taken from the host, a session is only valid on the host
+// of the tenant it was signed in to.
+func (t *tenantProviders) allowsSession(req *http.Request, session *sessionsapi.SessionState) bool {
+	if _, ok := t.tenants[session.Tenant]; !ok {
+		return false
+	}
+	return t.source != "host" || session.Tenant == t.tenantFromRequest(req)
+}
+
+// signInProvider returns the provider, and tenant, the request signs in
+// with, writing an error page if there is none
+func (p *OAuthProxy) signInProvider(rw http.ResponseWriter, req *http.Request) (providers.Provider, string, bool) {
+	if p.tenants == nil {
+		return p.provider, "", true
+	}
+	tenant := p.tenants.tenantFromRequest(req)
+	provider, err := p.tenants.provider(tenant)
+	if errors.Is(err, errUnknownTenant) {
+		logger.Printf("Sign in to unknown tenant %q", tenant)
+		p.ErrorPage(rw, http.StatusNotFound, "Not Found", "Unknown tenant")
+		return nil, "", false
+	} else if err != nil {
+		logger.Printf("Error loading provider: %s", err)
+		p.ErrorPage(rw, http.StatusServiceUnavailable, "Service Unavailable", "Service Unavailable")
+		return nil, "", false
+	}
+	return provider, tenant, true
+}
+
+// sessionProvider returns the provider the session was signed in with
+func (p *OAuthProxy) sessionProvider(session *sessionsapi.SessionState) (providers.Provider, error) {
+	if p.tenants == nil {
+		return p.provider, nil
+	}
+	return p.tenants.provider(session.Tenant)
+}
+
+// tenantRedirectURI returns the redirect URI for the tenant. When tenants
+// are taken from the query, the tenant is added to it so that the callback
+// knows which tenant to redeem the code with.
+func (p *OAuthProxy) tenantRedirectURI(req *http.Request, tenant string) string {
+	redirectURI := p.GetRedirectURI(req.Host)
+	if p.tenants == nil || p.tenants.source != "query" {
+		return redirectURI
+	}
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		return redirectURI
+	}
+	q := u.Query()
+	q.Set(tenantQueryParam, tenant)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
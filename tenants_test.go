@@ -0,0 +1,164 @@
+package oauth2proxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTenantIssuer serves OIDC discovery for any realm under /realms/
+func newTenantIssuer(t *testing.T) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		issuer := server.URL + strings.TrimSuffix(req.URL.Path, "/.well-known/openid-configuration")
+		writeJSON(rw, http.StatusOK, map[string]interface{}{
+			"issuer":                                issuer,
+			"authorization_endpoint":                issuer + "/auth",
+			"token_endpoint":                        issuer + "/token",
+			"jwks_uri":                              issuer + "/certs",
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func newTenantOptions(t *testing.T, issuer, source string) *Options {
+	dir, err := ioutil.TempDir("", "tenants")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	tenantsFile := filepath.Join(dir, "tenants.json")
+	tenants := map[string]TenantConfig{
+		"acme":   {ClientID: "acme-client", ClientSecret: "acme-secret", ProviderDisplayName: "Acme SSO"},
+		"globex": {},
+	}
+	data, err := json.Marshal(tenants)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(tenantsFile, data, 0644))
+
+	opts := testOptions()
+	opts.Provider = "oidc"
+	opts.OIDCIssuerURL = issuer + "/realms/{tenant}"
+	opts.OIDCTenantSource = source
+	opts.OIDCTenantsFile = tenantsFile
+	return opts
+}
+
+func TestTenantSignInFromHost(t *testing.T) {
+	issuer := newTenantIssuer(t)
+	opts := newTenantOptions(t, issuer.URL, "host")
+	require.NoError(t, opts.Validate())
+	proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+	require.NoError(t, err)
+
+	start := func(host string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/oauth2/start", nil)
+		req.Host = host
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		return rw
+	}
+
+	// Each tenant signs in with its own realm and credentials
+	rw := start("acme.example.com")
+	require.Equal(t, http.StatusFound, rw.Code)
+	location, err := url.Parse(rw.Header().Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, issuer.URL+"/realms/acme/auth", location.Scheme+"://"+location.Host+location.Path)
+	assert.Equal(t, "acme-client", location.Query().Get("client_id"))
+	assert.Equal(t, "https://acme.example.com/oauth2/callback", location.Query().Get("redirect_uri"))
+
+	rw = start("globex.example.com")
+	require.Equal(t, http.StatusFound, rw.Code)
+	location, err = url.Parse(rw.Header().Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, "/realms/globex/auth", location.Path)
+	assert.Equal(t, clientID, location.Query().Get("client_id"))
+
+	assert.Equal(t, http.StatusNotFound, start("initech.example.com").Code)
+
+	// The sign in button names the tenant's provider
+	req := httptest.NewRequest("GET", "/oauth2/sign_in", nil)
+	req.Host = "acme.example.com"
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Contains(t, rw.Body.String(), "Sign in with Acme SSO")
+}
+
+func TestTenantSignInFromQuery(t *testing.T) {
+	issuer := newTenantIssuer(t)
+	opts := newTenantOptions(t, issuer.URL, "query")
+	require.NoError(t, opts.Validate())
+	proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("GET", "/oauth2/start?tenant=acme", nil)
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	require.Equal(t, http.StatusFound, rw.Code)
+	location, err := url.Parse(rw.Header().Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, "/realms/acme/auth", location.Path)
+	assert.Equal(t, "https://example.com/oauth2/callback?tenant=acme", location.Query().Get("redirect_uri"))
+
+	req = httptest.NewRequest("GET", "/oauth2/sign_in?tenant=acme", nil)
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Contains(t, rw.Body.String(), `<input type="hidden" name="tenant" value="acme">`)
+}
+
+func TestTenantSessionBoundToHost(t *testing.T) {
+	issuer := newTenantIssuer(t)
+	opts := newTenantOptions(t, issuer.URL, "host")
+	require.NoError(t, opts.Validate())
+	proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+	require.NoError(t, err)
+
+	rw := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Host = "acme.example.com"
+	require.NoError(t, proxy.SaveSession(rw, req, &sessionsapi.SessionState{
+		Email: "jane@acme.com", Tenant: "acme", CreatedAt: time.Now()}))
+
+	load := func(host string) error {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = host
+		for _, c := range rw.Result().Cookies() {
+			req.AddCookie(c)
+		}
+		_, err := proxy.getAuthenticatedSession(httptest.NewRecorder(), req)
+		return err
+	}
+	assert.NoError(t, load("acme.example.com"))
+	assert.Equal(t, ErrNeedsLogin, load("globex.example.com"))
+}
+
+func TestTenantOptions(t *testing.T) {
+	opts := newTenantOptions(t, "https://sso.example.com", "host")
+	opts.RedirectURL = "https://auth.example.com/oauth2/callback"
+	assert.Equal(t, errorMsg([]string{
+		"oidc_tenant_source 'host' requires a redirect-url without a host so that each tenant is redirected back to its own host"}),
+		opts.Validate().Error())
+
+	opts = newTenantOptions(t, "https://sso.example.com", "cookie")
+	opts.OIDCTenantsFile = ""
+	assert.Equal(t, errorMsg([]string{
+		"oidc_tenant_source (cookie) must be one of ['host', 'query']",
+		"a templated oidc-issuer-url requires an oidc-tenants-file",
+		"oidc provider requires an oidc issuer URL"}),
+		opts.Validate().Error())
+
+	_, err := loadTenants("/does/not/exist")
+	assert.Error(t, err)
+}
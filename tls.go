@@ -0,0 +1,231 @@
+package oauth2proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/clock"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/logger"
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	// ocspFetchTimeout bounds each request to the OCSP responder
+	ocspFetchTimeout = 10 * time.Second
+
+	// ocspRetryInterval is how long to wait before fetching a response
+	// again after failing to
+	ocspRetryInterval = 5 * time.Minute
+)
+
+var tlsVersions = map[string]uint16{
+	"TLS1.2": tls.VersionTLS12,
+	"TLS1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+// validateTLS builds the configuration of the TLS listener from the minimum
+// version, cipher suites and curves allowed
+func validateTLS(o *Options, msgs []string) []string {
+	config := &tls.Config{NextProtos: []string{"http/1.1"}}
+
+	version, ok := tlsVersions[o.TLSMinVersion]
+	if !ok {
+		msgs = append(msgs, fmt.Sprintf("tls_min_version (%s) must be one of TLS1.2 or TLS1.3", o.TLSMinVersion))
+	}
+	config.MinVersion = version
+
+	if len(o.TLSCipherSuites) > 0 {
+		suites := map[string]uint16{}
+		for _, suite := range tls.CipherSuites() {
+			suites[suite.Name] = suite.ID
+		}
+		for _, name := range o.TLSCipherSuites {
+			id, ok := suites[name]
+			if !ok {
+				msgs = append(msgs, fmt.Sprintf("tls_cipher_suite (%s) is not a supported secure cipher suite", name))
+				continue
+			}
+			config.CipherSuites = append(config.CipherSuites, id)
+		}
+		if version == tls.VersionTLS13 {
+			msgs = append(msgs, "tls_cipher_suites can't be restricted with tls_min_version TLS1.3 as the TLS 1.3 cipher suites aren't configurable")
+		}
+	}
+
+	for _, name := range o.TLSCurvePreferences {
+		curve, ok := tlsCurves[name]
+		if !ok {
+			msgs = append(msgs, fmt.Sprintf("tls_curve_preference (%s) must be one of X25519, P256, P384 or P521", name))
+			continue
+		}
+		config.CurvePreferences = append(config.CurvePreferences, curve)
+	}
+
+	if o.TLSOCSPStapling && (o.TLSCertFile == "" || o.TLSKeyFile == "") {
+		msgs = append(msgs, "tls_ocsp_stapling requires the proxy to terminate TLS with tls_cert_file and tls_key_file")
+	}
+	o.tlsConfig = config
+	return msgs
+}
+
+// ocspStapler keeps an OCSP response for the certificate, fetched from its
+// issuer's responder, to staple to TLS handshakes so that clients needn't
+// ask the responder themselves
+type ocspStapler struct {
+	leaf      *x509.Certificate
+	issuer    *x509.Certificate
+	responder string
+	client    *http.Client
+
+	mu   sync.RWMutex
+	cert tls.Certificate
+	// expires is the next update of the stapled response, after which it
+	// is no longer stapled
+	expires time.Time
+}
+
+// newOCSPStapler returns a stapler for the certificate, which must be
+// followed in its chain by the certificate of its issuer
+func newOCSPStapler(cert tls.Certificate) (*ocspStapler, error) {
+	if len(cert.Certificate) < 2 {
+		return nil, errors.New("the certificate file must include the issuer's certificate to staple OCSP responses")
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return nil, err
+	}
+	if len(leaf.OCSPServer) == 0 {
+		return nil, errors.New("the certificate has no OCSP responder")
+	}
+	return &ocspStapler{
+		leaf:      leaf,
+		issuer:    issuer,
+		responder: leaf.OCSPServer[0],
+		client:    &http.Client{Timeout: ocspFetchTimeout},
+		cert:      cert,
+	}, nil
+}
+
+// GetCertificate returns the certificate with the current OCSP response
+func (s *ocspStapler) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	cert := s.cert
+	if !s.expires.IsZero() && clock.Now().After(s.expires) {
+		cert.OCSPStaple = nil
+	}
+	return &cert, nil
+}
+
+// refresh fetches a new response, stapling it if the certificate is good.
+// It returns when the response should next be refreshed: halfway to its
+// next update, so that there is time to retry before it expires.
+func (s *ocspStapler) refresh(ctx context.Context) (time.Duration, error) {
+	body, err := ocsp.CreateRequest(s.leaf, s.issuer, nil)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", s.responder, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/ocsp-request")
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("error fetching OCSP response from %s: %v", s.responder, err)
+	}
+	raw, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return 0, fmt.Errorf("error reading OCSP response from %s: %v", s.responder, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("got %d fetching OCSP response from %s", resp.StatusCode, s.responder)
+	}
+
+	response, err := ocsp.ParseResponseForCert(raw, s.leaf, s.issuer)
+	if err != nil {
+		return 0, fmt.Errorf("invalid OCSP response from %s: %v", s.responder, err)
+	}
+	if response.Status != ocsp.Good {
+		return 0, fmt.Errorf("OCSP responder %s reports the certificate is not good (status %d)", s.responder, response.Status)
+	}
+
+	s.mu.Lock()
+	s.cert.OCSPStaple = raw
+	s.expires = response.NextUpdate
+	s.mu.Unlock()
+
+	if response.NextUpdate.IsZero() {
+		return time.Hour, nil
+	}
+	next := time.Until(response.ThisUpdate.Add(response.NextUpdate.Sub(response.ThisUpdate) / 2))
+	if next < time.Minute {
+		next = time.Minute
+	}
+	return next, nil
+}
+
+// run refreshes the response until done is closed, retrying failures every
+// ocspRetryInterval
+func (s *ocspStapler) run(first time.Duration, done <-chan struct{}) {
+	timer := time.NewTimer(first)
+	defer timer.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-timer.C:
+		}
+		next, err := s.fetch()
+		if err != nil {
+			next = ocspRetryInterval
+		}
+		timer.Reset(next)
+	}
+}
+
+// fetch refreshes the response, logging any failure
+func (s *ocspStapler) fetch() (time.Duration, error) {
+	next, err := s.refresh(context.Background())
+	if err != nil {
+		logger.Printf("Error stapling OCSP response: %v", err)
+	}
+	return next, err
+}
+
+// startOCSPStapling staples OCSP responses for the listener's certificate,
+// fetching the first before serving
+func startOCSPStapling(config *tls.Config, done <-chan struct{}) error {
+	stapler, err := newOCSPStapler(config.Certificates[0])
+	if err != nil {
+		return err
+	}
+	next, err := stapler.fetch()
+	if err != nil {
+		next = ocspRetryInterval
+	}
+	config.Certificates = nil
+	config.GetCertificate = stapler.GetCertificate
+	go stapler.run(next, done)
+	return nil
+}
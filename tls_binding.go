@@ -0,0 +1,40 @@
+package oauth2proxy
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/encryption"
+)
+
+// tlsBindingLabel is the RFC 5705 exporter label used to derive the keying
+// material sessions are bound to
+const tlsBindingLabel = "EXPERIMENTAL-oauth2-proxy-session-binding"
+
+// tlsChannelBinding returns an identifier for the TLS connection of the
+// request. It is a hash of keying material exported from the connection,
+// which is unique to the connection and known only to the two ends of it.
+func tlsChannelBinding(req *http.Request) (string, error) {
+	if req.TLS == nil {
+		return "", errors.New("request was not made over TLS")
+	}
+	ekm, err := req.TLS.ExportKeyingMaterial(tlsBindingLabel, nil, 32)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(ekm)
+	return base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+// isBoundToConnection checks whether the session was created on the TLS
+// connection the request was made on
+func isBoundToConnection(req *http.Request, session *sessionsapi.SessionState) bool {
+	binding, err := tlsChannelBinding(req)
+	if err != nil || session.TLSBinding == "" {
+		return false
+	}
+	return encryption.SecureCompare(binding, session.TLSBinding)
+}
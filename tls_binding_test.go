@@ -0,0 +1,60 @@
+package oauth2proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionTLSBinding(t *testing.T) {
+	pcTest := NewProcessCookieTestWithDefaults()
+	pcTest.proxy.sessionTLSBinding = true
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/save" {
+			session := &sessionsapi.SessionState{Email: "jane@example.com", CreatedAt: time.Now()}
+			require.NoError(t, pcTest.proxy.SaveSession(rw, req, session))
+			return
+		}
+		if _, err := pcTest.proxy.getAuthenticatedSession(rw, req); err != nil {
+			rw.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+
+	get := func(client *http.Client, path string, cookies []*http.Cookie) *http.Response {
+		req, err := http.NewRequest("GET", server.URL+path, nil)
+		require.NoError(t, err)
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		resp, err := client.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp
+	}
+
+	client := server.Client()
+	cookies := get(client, "/save", nil).Cookies()
+	require.NotEmpty(t, cookies)
+
+	// The session is valid on the connection it was created on
+	assert.Equal(t, http.StatusOK, get(client, "/check", cookies).StatusCode)
+
+	// but not when replayed on another connection
+	other := &http.Client{Transport: server.Client().Transport.(*http.Transport).Clone()}
+	assert.Equal(t, http.StatusUnauthorized, get(other, "/check", cookies).StatusCode)
+}
+
+func TestSessionTLSBindingWithoutTLS(t *testing.T) {
+	pcTest := NewProcessCookieTestWithDefaults()
+	pcTest.proxy.sessionTLSBinding = true
+
+	err := pcTest.SaveSession(&sessionsapi.SessionState{Email: "jane@example.com"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,112 @@
+package oauth2proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ocsp"
+)
+
+// newOCSPTestCertificate returns a certificate, chained to its issuer, whose
+// OCSP responder reports the given status
+func newOCSPTestCertificate(t *testing.T, status int) tls.Certificate {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, caKey.Public(), caKey)
+	require.NoError(t, err)
+	ca, err := x509.ParseCertificate(caDER)
+	require.NoError(t, err)
+
+	responder := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		ocspReq, err := ocsp.ParseRequest(body)
+		require.NoError(t, err)
+		resp, err := ocsp.CreateResponse(ca, ca, ocsp.Response{
+			Status:       status,
+			SerialNumber: ocspReq.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Minute),
+			NextUpdate:   time.Now().Add(time.Hour),
+		}, caKey)
+		require.NoError(t, err)
+		rw.Header().Set("Content-Type", "application/ocsp-response")
+		rw.Write(resp)
+	}))
+	t.Cleanup(responder.Close)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		OCSPServer:   []string{responder.URL},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, key.Public(), caKey)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der, caDER}, PrivateKey: key}
+}
+
+func TestOCSPStapling(t *testing.T) {
+	config := &tls.Config{Certificates: []tls.Certificate{newOCSPTestCertificate(t, ocsp.Good)}}
+	done := make(chan struct{})
+	defer close(done)
+	require.NoError(t, startOCSPStapling(config, done))
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		if conn, err := ln.Accept(); err == nil {
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NotEmpty(t, conn.ConnectionState().OCSPResponse)
+	response, err := ocsp.ParseResponse(conn.ConnectionState().OCSPResponse, nil)
+	require.NoError(t, err)
+	assert.Equal(t, ocsp.Good, response.Status)
+}
+
+func TestOCSPStaplingRevoked(t *testing.T) {
+	stapler, err := newOCSPStapler(newOCSPTestCertificate(t, ocsp.Revoked))
+	require.NoError(t, err)
+	_, err = stapler.fetch()
+	assert.Error(t, err)
+	cert, err := stapler.GetCertificate(nil)
+	require.NoError(t, err)
+	assert.Empty(t, cert.OCSPStaple)
+
+	// The issuer is needed to request a response
+	cert.Certificate = cert.Certificate[:1]
+	_, err = newOCSPStapler(*cert)
+	assert.Error(t, err)
+}
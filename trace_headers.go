@@ -0,0 +1,96 @@
+package oauth2proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// defaultTraceHeaders are the W3C Trace Context and Baggage headers, and the
+// single and multiple header forms of Zipkin's B3 propagation
+var defaultTraceHeaders = []string{
+	"traceparent", "tracestate", "baggage",
+	"b3", "X-B3-TraceId", "X-B3-SpanId", "X-B3-ParentSpanId", "X-B3-Sampled", "X-B3-Flags",
+}
+
+// proxyHeaderPrefixes are the prefixes of the headers the proxy sets, or
+// removes, with the user's identity
+var proxyHeaderPrefixes = []string{"X-Forwarded-", "X-Auth-Request-"}
+
+// proxyHeaders are the other headers the proxy sets or removes
+var proxyHeaders = []string{"Authorization", "Cookie", "GAP-Auth", SignatureHeader}
+
+// validateTraceHeaders checks the trace headers can be forwarded untouched,
+// which they can't if the proxy sets them itself
+func validateTraceHeaders(o *Options, msgs []string) []string {
+	o.traceHeaders = nil
+	for _, name := range o.TraceHeaders {
+		if name == "" || strings.ContainsAny(name, " \t\r\n:") {
+			msgs = append(msgs, fmt.Sprintf("trace_header (%s) must be a valid header name", name))
+			continue
+		}
+		name = http.CanonicalHeaderKey(name)
+		if isProxyHeader(o, name) {
+			msgs = append(msgs, fmt.Sprintf("trace_header (%s) is set by the proxy and can't be forwarded untouched", name))
+			continue
+		}
+		o.traceHeaders = append(o.traceHeaders, name)
+	}
+	return msgs
+}
+
+// isProxyHeader reports whether the proxy sets the header, from the user's
+// identity or as configured
+func isProxyHeader(o *Options, name string) bool {
+	for _, prefix := range proxyHeaderPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	for _, h := range proxyHeaders {
+		if name == h {
+			return true
+		}
+	}
+	for _, h := range o.headerTemplates {
+		if name == h.name {
+			return true
+		}
+	}
+	return o.AssertionKeyFile != "" && name == http.CanonicalHeaderKey(o.AssertionHeader)
+}
+
+// forwardTraceHeaders passes the trace headers of the original request on
+// upstream as they were sent, and keeps them from being removed as hop-by-hop
+// headers when the client lists them in Connection. The baggage is the
+// exception when the user's ID is added to it.
+func (p *OAuthProxy) forwardTraceHeaders(req *http.Request, original http.Header) {
+	if len(p.traceHeaders) == 0 {
+		return
+	}
+	trace := map[string]bool{}
+	for _, name := range p.traceHeaders {
+		trace[name] = true
+		if name == baggageHeader && p.baggageUserKey != "" {
+			continue
+		}
+		if values, ok := original[name]; ok {
+			req.Header[name] = values
+		}
+	}
+
+	var connection []string
+	for _, v := range req.Header.Values("Connection") {
+		for _, token := range strings.Split(v, ",") {
+			token = strings.TrimSpace(token)
+			if token != "" && !trace[http.CanonicalHeaderKey(token)] {
+				connection = append(connection, token)
+			}
+		}
+	}
+	if len(connection) > 0 {
+		req.Header.Set("Connection", strings.Join(connection, ", "))
+	} else {
+		req.Header.Del("Connection")
+	}
+}
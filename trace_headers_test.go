@@ -0,0 +1,72 @@
+package oauth2proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"testing"
+
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/middleware"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestForwardTraceHeaders(t *testing.T) {
+	var received http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		received = req.Header
+	}))
+	defer upstream.Close()
+	upstreamURL, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+
+	opts := testOptions()
+	opts.BaggageUserKey = "enduser.id"
+	require.NoError(t, opts.Validate())
+	proxy, err := NewOAuthProxy(opts, func(string) bool { return true })
+	require.NoError(t, err)
+	session := &sessionsapi.SessionState{User: "john.doe", Email: "john.doe@example.com"}
+	setSession := func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			middleware.GetRequestScope(req).Session = session
+			next.ServeHTTP(rw, req)
+		})
+	}
+	handler := middleware.NewChain(middleware.NewScope(), setSession, proxy.injectHeaders).
+		Then(httputil.NewSingleHostReverseProxy(upstreamURL))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	req.Header.Set("X-B3-TraceId", "80f198ee56343ba864fe8b2a57d3eff7")
+	req.Header.Set("Baggage", "tenant=acme")
+	req.Header.Set("Connection", "keep-alive, traceparent, X-Hop")
+	req.Header.Set("X-Hop", "1")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	require.NotNil(t, received)
+	assert.Equal(t, "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", received.Get("Traceparent"))
+	assert.Equal(t, "80f198ee56343ba864fe8b2a57d3eff7", received.Get("X-B3-TraceId"))
+	assert.Equal(t, "tenant=acme,enduser.id="+userBaggageID(opts.baggageHashKey, session), received.Get("Baggage"))
+	// other headers listed in Connection are still removed
+	assert.Empty(t, received.Get("X-Hop"))
+}
+
+func TestTraceHeaderOptions(t *testing.T) {
+	o := testOptions()
+	require.NoError(t, o.Validate())
+	assert.Contains(t, o.traceHeaders, "Traceparent")
+	assert.Contains(t, o.traceHeaders, "X-B3-Traceid")
+
+	o = testOptions()
+	o.HeaderTemplates = []string{"X-Request-Id={{.User}}"}
+	o.TraceHeaders = []string{"X-Request-Id", "X-Forwarded-User", "authorization", "b3 flags"}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		"trace_header (X-Request-Id) is set by the proxy and can't be forwarded untouched",
+		"trace_header (X-Forwarded-User) is set by the proxy and can't be forwarded untouched",
+		"trace_header (Authorization) is set by the proxy and can't be forwarded untouched",
+		"trace_header (b3 flags) must be a valid header name"}), err.Error())
+}
@@ -0,0 +1,267 @@
+package oauth2proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/http/httputil"
+	"sync"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/logger"
+)
+
+// errUpstreamUnavailable is returned for requests to an upstream while its
+// circuit breaker is open
+var errUpstreamUnavailable = errors.New("upstream circuit breaker is open")
+
+// The states of a circuit breaker
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// breakerConfig configures the circuit breaker and retries of each upstream
+type breakerConfig struct {
+	// errorRate is the fraction of failed requests that opens the breaker,
+	// or 0 to never open it
+	errorRate   float64
+	minRequests int
+	window      time.Duration
+	// openDuration is how long the breaker stays open before probing the
+	// upstream again
+	openDuration time.Duration
+	// probes is the number of requests that must succeed in a row while
+	// half-open to close the breaker
+	probes      int
+	retries     int
+	retryBudget float64
+}
+
+// circuitBreaker tracks the failures of an upstream over a window, rejecting
+// requests for a while once too many fail so that a struggling upstream
+// isn't overwhelmed further. Retries are counted too, so that they can be
+// limited to a fraction of requests.
+type circuitBreaker struct {
+	upstream string
+	config   *breakerConfig
+
+	mu          sync.Mutex
+	state       int
+	windowStart time.Time
+	requests    int
+	failures    int
+	retries     int
+	openedAt    time.Time
+	// probing and probed count the requests let through while half-open, and
+	// those of them that have succeeded
+	probing int
+	probed  int
+}
+
+func newCircuitBreaker(upstream string, config *breakerConfig) *circuitBreaker {
+	return &circuitBreaker{
+		upstream:    upstream,
+		config:      config,
+		windowStart: time.Now(),
+	}
+}
+
+// allow checks whether a request may be sent to the upstream, letting a few
+// probes through once the breaker has been open for long enough
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.config.openDuration {
+			return false
+		}
+		logger.Printf("Circuit breaker for upstream %s is half-open: probing", b.upstream)
+		b.state = breakerHalfOpen
+		b.probing, b.probed = 0, 0
+		fallthrough
+	case breakerHalfOpen:
+		if b.probing >= b.config.probes {
+			return false
+		}
+		b.probing++
+	}
+	return true
+}
+
+// record records the outcome of a request allowed to the upstream
+func (b *circuitBreaker) record(failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerHalfOpen:
+		if failed {
+			b.open()
+			return
+		}
+		b.probed++
+		if b.probed >= b.config.probes {
+			logger.Printf("Circuit breaker for upstream %s is closed", b.upstream)
+			b.state = breakerClosed
+			b.resetWindow()
+		}
+	case breakerClosed:
+		if time.Since(b.windowStart) >= b.config.window {
+			b.resetWindow()
+		}
+		b.requests++
+		if failed {
+			b.failures++
+		}
+		if b.config.errorRate > 0 && b.requests >= b.config.minRequests &&
+			float64(b.failures) >= b.config.errorRate*float64(b.requests) {
+			b.open()
+		}
+	}
+}
+
+// cancel releases a request allowed to the upstream without an outcome, so
+// that a probe can be sent in its place
+func (b *circuitBreaker) cancel() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerHalfOpen && b.probing > b.probed {
+		b.probing--
+	}
+}
+
+// retryAllowed checks whether the retry budget allows another retry, counting
+// it if so. At least one retry is allowed per window.
+func (b *circuitBreaker) retryAllowed() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state != breakerClosed {
+		return false
+	}
+	if b.retries >= 1 && float64(b.retries) >= b.config.retryBudget*float64(b.requests) {
+		return false
+	}
+	b.retries++
+	return true
+}
+
+func (b *circuitBreaker) open() {
+	logger.Printf("Circuit breaker for upstream %s is open: %d of %d requests failed", b.upstream, b.failures, b.requests)
+	b.state = breakerOpen
+	b.openedAt = time.Now()
+}
+
+func (b *circuitBreaker) resetWindow() {
+	b.windowStart = time.Now()
+	b.requests, b.failures, b.retries = 0, 0, 0
+}
+
+// breakerTransport sends requests through the upstream's circuit breaker,
+// retrying idempotent requests that fail
+type breakerTransport struct {
+	breaker *circuitBreaker
+	next    http.RoundTripper
+}
+
+// setProxyCircuitBreaker guards the upstream with a circuit breaker, serving
+// the error page with a request ID when the upstream can't be reached
+func setProxyCircuitBreaker(proxy *httputil.ReverseProxy, breaker *circuitBreaker, templates *template.Template, proxyPrefix string) {
+	next := proxy.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	proxy.Transport = &breakerTransport{breaker: breaker, next: next}
+	proxy.ErrorHandler = func(rw http.ResponseWriter, req *http.Request, err error) {
+		id := requestID(req)
+		logger.Printf("Error proxying request %s to upstream %s: %v", id, breaker.upstream, err)
+		message := "The service could not be reached. Please try again later."
+		if errors.Is(err, errUpstreamUnavailable) {
+			message = "The service is temporarily unavailable. Please try again later."
+		}
+		rw.Header().Set("X-Request-Id", id)
+		prepareNoCache(rw)
+		if isAjax(req) {
+			writeJSON(rw, http.StatusBadGateway, map[string]string{"error": message, "request_id": id})
+			return
+		}
+		rw.WriteHeader(http.StatusBadGateway)
+		t := struct {
+			Title       string
+			Message     string
+			ProxyPrefix string
+			RequestID   string
+		}{
+			Title:       fmt.Sprintf("%d %s", http.StatusBadGateway, "Bad Gateway"),
+			Message:     message,
+			ProxyPrefix: proxyPrefix,
+			RequestID:   id,
+		}
+		if err := templates.ExecuteTemplate(rw, "error.html", t); err != nil {
+			logger.Printf("Error rendering error template: %v", err)
+		}
+	}
+}
+
+func (t *breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		if !t.breaker.allow() {
+			return nil, errUpstreamUnavailable
+		}
+		resp, err := t.next.RoundTrip(req)
+		failed := err != nil || resp.StatusCode == http.StatusBadGateway ||
+			resp.StatusCode == http.StatusServiceUnavailable || resp.StatusCode == http.StatusGatewayTimeout
+		// Requests the client gave up on say nothing of the upstream
+		if req.Context().Err() != nil {
+			t.breaker.cancel()
+			return resp, err
+		}
+		t.breaker.record(failed)
+
+		if !failed || attempt >= t.breaker.config.retries || !retryable(req) || !t.breaker.retryAllowed() {
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req.Body = body
+		}
+	}
+}
+
+// retryable checks whether the request can safely be sent again: its method
+// must be idempotent, and any body must be replayable
+func retryable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+	default:
+		return false
+	}
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// requestID returns the ID a load balancer in front of the proxy gave the
+// request, or a new one, for errors to be traced back to
+func requestID(req *http.Request) string {
+	if id := req.Header.Get("X-Request-Id"); id != "" {
+		return id
+	}
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,114 @@
+package oauth2proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	b := newCircuitBreaker("backend", &breakerConfig{
+		errorRate:    0.5,
+		minRequests:  4,
+		window:       time.Minute,
+		openDuration: 10 * time.Millisecond,
+		probes:       2,
+	})
+
+	// Failures under the minimum number of requests don't open the breaker
+	for _, failed := range []bool{true, true, true, false} {
+		require.True(t, b.allow())
+		b.record(failed)
+	}
+	assert.False(t, b.allow())
+
+	// Once open for long enough, only the probes are let through
+	time.Sleep(20 * time.Millisecond)
+	assert.True(t, b.allow())
+	assert.True(t, b.allow())
+	assert.False(t, b.allow())
+	b.record(false)
+	b.record(true)
+	assert.False(t, b.allow())
+
+	// and they must all succeed for the breaker to close
+	time.Sleep(20 * time.Millisecond)
+	assert.True(t, b.allow())
+	b.cancel()
+	assert.True(t, b.allow())
+	assert.True(t, b.allow())
+	b.record(false)
+	b.record(false)
+	assert.True(t, b.allow())
+	assert.True(t, b.allow())
+	assert.True(t, b.allow())
+}
+
+func TestCircuitBreakerRetryBudget(t *testing.T) {
+	b := newCircuitBreaker("backend", &breakerConfig{minRequests: 1, window: time.Minute, probes: 1, retries: 1, retryBudget: 0.2})
+
+	// One retry is always allowed, then no more than a fifth of requests
+	assert.True(t, b.retryAllowed())
+	assert.False(t, b.retryAllowed())
+	for i := 0; i < 10; i++ {
+		b.record(false)
+	}
+	assert.True(t, b.retryAllowed())
+	assert.False(t, b.retryAllowed())
+}
+
+func TestUpstreamCircuitBreaker(t *testing.T) {
+	var hits int32
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer upstream.Close()
+
+	u, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+	opts := NewOptions()
+	opts.UpstreamBreakerErrorRate = 0.5
+	opts.UpstreamBreakerMinRequests = 3
+	opts.UpstreamRetries = 1
+	opts.UpstreamRetryBudget = 1
+	require.Empty(t, validateUpstreamBreaker(opts, nil))
+	proxy := NewWebSocketOrRestReverseProxy(u, opts, nil)
+
+	request := func(method string) *httptest.ResponseRecorder {
+		var body io.Reader
+		if method == "POST" {
+			body = strings.NewReader("body")
+		}
+		req := httptest.NewRequest(method, "http://proxy.example.com/items", body)
+		req.RequestURI = "/items"
+		req.Header.Set("X-Request-Id", "abc123")
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		return rw
+	}
+
+	// Idempotent requests are retried, others aren't
+	rw := request("GET")
+	assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&hits))
+	rw = request("POST")
+	assert.Equal(t, http.StatusServiceUnavailable, rw.Code)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&hits))
+
+	// Once open, the upstream isn't sent requests
+	rw = request("GET")
+	assert.Equal(t, http.StatusBadGateway, rw.Code)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&hits))
+	assert.Equal(t, "abc123", rw.Header().Get("X-Request-Id"))
+	assert.Contains(t, rw.Body.String(), "Request ID: abc123")
+	assert.Contains(t, rw.Body.String(), "temporarily unavailable")
+}
@@ -0,0 +1,160 @@
+package oauth2proxy
+
+import (
+	"fmt"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// indexPage is the page http.FileServer serves for directories, which the
+// fileSystem maps to the first index file configured that exists
+const indexPage = "/index.html"
+
+// fileServerConfig configures how file:// upstreams serve their directories
+type fileServerConfig struct {
+	// indexes are the files served for a directory, in order of preference
+	indexes []string
+	// listing lists the files of directories without an index file, which
+	// are otherwise not found
+	listing bool
+	// contentTypes maps file extensions to the content types they're served
+	// with, ahead of the system's MIME types
+	contentTypes map[string]string
+	// sniff detects the content type of files with an unknown extension from
+	// their content, which are otherwise served as application/octet-stream
+	sniff bool
+}
+
+// defaultFileServerConfig serves directories the way http.FileServer does
+var defaultFileServerConfig = &fileServerConfig{
+	indexes: []string{"index.html"},
+	listing: true,
+	sniff:   true,
+}
+
+// parseFileServerConfig parses the options of file:// upstreams
+func parseFileServerConfig(indexes []string, listing bool, contentTypes []string, sniff bool) (*fileServerConfig, error) {
+	c := &fileServerConfig{listing: listing, sniff: sniff, contentTypes: map[string]string{}}
+	for _, index := range indexes {
+		if index == "" || strings.ContainsAny(index, `/\`) || index == "." || index == ".." {
+			return nil, fmt.Errorf("upstream_file_index (%s) must be a file name", index)
+		}
+		c.indexes = append(c.indexes, index)
+	}
+	for _, ct := range contentTypes {
+		parts := strings.SplitN(ct, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], ".") || len(parts[0]) < 2 {
+			return nil, fmt.Errorf("upstream_file_content_type (%s) must be of the form .<extension>=<content type>", ct)
+		}
+		if _, _, err := mime.ParseMediaType(parts[1]); err != nil {
+			return nil, fmt.Errorf("upstream_file_content_type (%s) has an invalid content type: %v", ct, err)
+		}
+		c.contentTypes[strings.ToLower(parts[0])] = parts[1]
+	}
+	return c, nil
+}
+
+// fileServer serves the files of a directory for a file:// upstream
+type fileServer struct {
+	config *fileServerConfig
+	root   http.FileSystem
+	files  http.Handler
+}
+
+// newFileServer creates a http.Handler serving the files under
+// filesystemPath at path
+func newFileServer(path string, filesystemPath string, config *fileServerConfig) http.Handler {
+	if config == nil {
+		config = defaultFileServerConfig
+	}
+	s := &fileServer{config: config, root: http.Dir(filesystemPath)}
+	s.files = http.FileServer(fileSystem{s})
+	return http.StripPrefix(path, s)
+}
+
+func (s *fileServer) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	name := path.Clean("/" + req.URL.Path)
+	if s.isDir(name) {
+		if req.URL.Path != "" && !strings.HasSuffix(req.URL.Path, "/") {
+			// http.FileServer redirects to the directory's canonical path
+			s.files.ServeHTTP(rw, req)
+			return
+		}
+		index := s.index(name)
+		if index == "" {
+			if !s.config.listing {
+				http.NotFound(rw, req)
+				return
+			}
+			s.files.ServeHTTP(rw, req)
+			return
+		}
+		name = index
+	}
+	s.setContentType(rw, name)
+	s.files.ServeHTTP(rw, req)
+}
+
+// setContentType sets the content type of the named file when it's
+// configured for its extension, or when it's unknown and not sniffed, so
+// that http.FileServer keeps it
+func (s *fileServer) setContentType(rw http.ResponseWriter, name string) {
+	ext := strings.ToLower(path.Ext(name))
+	if ct, ok := s.config.contentTypes[ext]; ok {
+		rw.Header().Set("Content-Type", ct)
+		return
+	}
+	if s.config.sniff || mime.TypeByExtension(ext) != "" {
+		return
+	}
+	rw.Header().Set("Content-Type", "application/octet-stream")
+	rw.Header().Set("X-Content-Type-Options", "nosniff")
+}
+
+// index returns the path of the directory's index file, or "" if it has
+// none
+func (s *fileServer) index(dir string) string {
+	for _, index := range s.config.indexes {
+		name := path.Join(dir, index)
+		f, err := s.root.Open(name)
+		if err != nil {
+			continue
+		}
+		info, err := f.Stat()
+		f.Close()
+		if err == nil && !info.IsDir() {
+			return name
+		}
+	}
+	return ""
+}
+
+func (s *fileServer) isDir(name string) bool {
+	f, err := s.root.Open(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	return err == nil && info.IsDir()
+}
+
+// fileSystem opens the configured index file when http.FileServer looks for
+// the index.html of a directory
+type fileSystem struct {
+	server *fileServer
+}
+
+func (fs fileSystem) Open(name string) (http.File, error) {
+	if dir := path.Clean("/" + strings.TrimSuffix(name, indexPage)); strings.HasSuffix(name, indexPage) && fs.server.isDir(dir) {
+		index := fs.server.index(dir)
+		if index == "" {
+			return nil, os.ErrNotExist
+		}
+		return fs.server.root.Open(index)
+	}
+	return fs.server.root.Open(name)
+}
@@ -0,0 +1,105 @@
+package oauth2proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeUpstreamFiles(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "upstream-files")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	files := map[string]string{
+		"index.html":          "<p>home</p>",
+		"guide/index.htm":     "<p>guide</p>",
+		"guide/intro.md":      "# Intro",
+		"assets/logo.unknown": "<html>not really</html>",
+		"assets/app.css":      "body {}",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0700))
+		require.NoError(t, ioutil.WriteFile(path, []byte(content), 0600))
+	}
+	return dir
+}
+
+func TestParseFileServerConfig(t *testing.T) {
+	c, err := parseFileServerConfig([]string{"index.htm", "README.md"}, false, []string{".MD=text/markdown; charset=utf-8"}, false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"index.htm", "README.md"}, c.indexes)
+	assert.Equal(t, map[string]string{".md": "text/markdown; charset=utf-8"}, c.contentTypes)
+
+	for _, index := range []string{"", "docs/index.html", ".."} {
+		_, err := parseFileServerConfig([]string{index}, true, nil, true)
+		assert.Error(t, err, index)
+	}
+	for _, ct := range []string{"md=text/markdown", ".md", ".=text/plain", ".md=text/markdown;;"} {
+		_, err := parseFileServerConfig(nil, true, []string{ct}, true)
+		assert.Error(t, err, ct)
+	}
+}
+
+func TestFileServer(t *testing.T) {
+	dir := writeUpstreamFiles(t)
+	get := func(h http.Handler, path string) *httptest.ResponseRecorder {
+		rw := httptest.NewRecorder()
+		h.ServeHTTP(rw, httptest.NewRequest("GET", path, nil))
+		return rw
+	}
+
+	// by default, directories are served like http.FileServer does
+	h := newFileServer("/docs/", dir, nil)
+	rw := get(h, "/docs/")
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "<p>home</p>", rw.Body.String())
+	rw = get(h, "/docs/guide/")
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Contains(t, rw.Body.String(), `<a href="intro.md">`)
+	rw = get(h, "/docs/guide")
+	assert.Equal(t, http.StatusMovedPermanently, rw.Code)
+	assert.Equal(t, "guide/", rw.Header().Get("Location"))
+	assert.Equal(t, "text/html; charset=utf-8", get(h, "/docs/assets/logo.unknown").Header().Get("Content-Type"))
+
+	c, err := parseFileServerConfig([]string{"index.htm", "index.html"}, false, []string{".md=text/markdown"}, false)
+	require.NoError(t, err)
+	h = newFileServer("/docs/", dir, c)
+	rw = get(h, "/docs/")
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "<p>home</p>", rw.Body.String())
+	rw = get(h, "/docs/guide/")
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Equal(t, "<p>guide</p>", rw.Body.String())
+	assert.Equal(t, "text/html; charset=utf-8", rw.Header().Get("Content-Type"))
+	assert.Equal(t, http.StatusNotFound, get(h, "/docs/assets/").Code)
+
+	rw = get(h, "/docs/guide/intro.md")
+	assert.Equal(t, "text/markdown", rw.Header().Get("Content-Type"))
+	assert.Equal(t, "# Intro", rw.Body.String())
+	assert.Equal(t, "text/css; charset=utf-8", get(h, "/docs/assets/app.css").Header().Get("Content-Type"))
+	rw = get(h, "/docs/assets/logo.unknown")
+	assert.Equal(t, "application/octet-stream", rw.Header().Get("Content-Type"))
+	assert.Equal(t, "nosniff", rw.Header().Get("X-Content-Type-Options"))
+}
+
+func TestUpstreamFilesOptions(t *testing.T) {
+	o := testOptions()
+	o.UpstreamFileContentTypes = []string{"md=text/markdown"}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		"upstream_file_content_type (md=text/markdown) must be of the form .<extension>=<content type>"}), err.Error())
+
+	o = testOptions()
+	require.NoError(t, o.Validate())
+	assert.Equal(t, defaultFileServerConfig.indexes, o.upstreamFiles.indexes)
+	assert.True(t, o.upstreamFiles.listing)
+	assert.True(t, o.upstreamFiles.sniff)
+}
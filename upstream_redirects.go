@@ -0,0 +1,95 @@
+package oauth2proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/cookies"
+)
+
+type externalURLKey struct{}
+
+// setProxyRedirectRewriter rewrites the redirects and cookies an upstream
+// issues for its own, internal, host to the host the client requested, for
+// upstreams that are unaware of the proxy
+func setProxyRedirectRewriter(proxy *httputil.ReverseProxy, target *url.URL) {
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		external := &url.URL{Scheme: httpScheme, Host: cookies.GetRequestHost(req)}
+		if req.TLS != nil {
+			external.Scheme = httpsScheme
+		} else if proto := strings.ToLower(req.Header.Get("X-Forwarded-Proto")); proto == httpScheme || proto == httpsScheme {
+			external.Scheme = proto
+		}
+		director(req)
+		*req = *req.WithContext(context.WithValue(req.Context(), externalURLKey{}, external))
+	}
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		external, ok := resp.Request.Context().Value(externalURLKey{}).(*url.URL)
+		if !ok || external.Host == "" {
+			return nil
+		}
+		rewriteLocation(resp.Header, target, external)
+		rewriteCookieDomains(resp.Header, target, external)
+		return nil
+	}
+}
+
+// rewriteLocation points absolute redirects to the upstream's host at the
+// external host instead
+func rewriteLocation(header http.Header, target, external *url.URL) {
+	location, err := url.Parse(header.Get("Location"))
+	if err != nil || !location.IsAbs() || !sameHost(location, target) {
+		return
+	}
+	location.Scheme = external.Scheme
+	location.Host = external.Host
+	header.Set("Location", location.String())
+}
+
+// rewriteCookieDomains sets the Domain of cookies scoped to the upstream's
+// host to the external host. Cookies for other domains are left alone.
+func rewriteCookieDomains(header http.Header, target, external *url.URL) {
+	externalHost := hostname(external.Host)
+	for i, cookie := range header["Set-Cookie"] {
+		attributes := strings.Split(cookie, ";")
+		for j, attribute := range attributes {
+			parts := strings.SplitN(strings.TrimSpace(attribute), "=", 2)
+			if len(parts) != 2 || !strings.EqualFold(parts[0], "Domain") {
+				continue
+			}
+			if strings.EqualFold(strings.TrimPrefix(parts[1], "."), target.Hostname()) {
+				attributes[j] = " Domain=" + externalHost
+			}
+		}
+		header["Set-Cookie"][i] = strings.Join(attributes, ";")
+	}
+}
+
+// sameHost checks whether the URL is for the target's host, treating
+// default ports as equivalent to none
+func sameHost(u, target *url.URL) bool {
+	return strings.EqualFold(u.Hostname(), target.Hostname()) && effectivePort(u) == effectivePort(target)
+}
+
+func effectivePort(u *url.URL) string {
+	if port := u.Port(); port != "" {
+		return port
+	}
+	if strings.EqualFold(u.Scheme, httpsScheme) {
+		return "443"
+	}
+	return "80"
+}
+
+// hostname strips the port from a host
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
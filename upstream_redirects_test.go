@@ -0,0 +1,58 @@
+package oauth2proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxyRedirectRewriter(t *testing.T) {
+	var backendURL *url.URL
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Set-Cookie", "session=abc; Path=/; Domain="+backendURL.Hostname()+"; HttpOnly")
+		w.Header().Add("Set-Cookie", "other=def; Domain=example.net")
+		http.Redirect(w, r, backendURL.String()+"/login?next=%2F", http.StatusFound)
+	}))
+	defer backend.Close()
+	backendURL, _ = url.Parse(backend.URL)
+
+	proxy := NewReverseProxy(backendURL, &Options{FlushInterval: time.Second})
+	setProxyUpstreamHostHeader(proxy, backendURL)
+	setProxyRedirectRewriter(proxy, backendURL)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Host = "app.example.com"
+	req.Header.Set("X-Forwarded-Proto", "https")
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+
+	require.Equal(t, http.StatusFound, rw.Code)
+	assert.Equal(t, "https://app.example.com/login?next=%2F", rw.Header().Get("Location"))
+	assert.Equal(t, []string{
+		"session=abc; Path=/; Domain=app.example.com; HttpOnly",
+		"other=def; Domain=example.net",
+	}, rw.Header()["Set-Cookie"])
+}
+
+func TestRewriteLocation(t *testing.T) {
+	target, _ := url.Parse("http://app.internal")
+	external, _ := url.Parse("https://app.example.com:8443")
+
+	tests := map[string]string{
+		"http://app.internal/a?b=c":    "https://app.example.com:8443/a?b=c",
+		"http://APP.internal:80/a":     "https://app.example.com:8443/a",
+		"http://app.internal:8080/a":   "http://app.internal:8080/a",
+		"https://idp.example.com/auth": "https://idp.example.com/auth",
+		"/relative":                    "/relative",
+	}
+	for location, expected := range tests {
+		header := http.Header{"Location": {location}}
+		rewriteLocation(header, target, external)
+		assert.Equal(t, expected, header.Get("Location"), location)
+	}
+}
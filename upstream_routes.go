@@ -0,0 +1,157 @@
+package oauth2proxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/mbland/hmacauth"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/logger"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/middleware"
+)
+
+// maxRouteProxies bounds the number of upstreams each route keeps a proxy
+// for, in case a claim takes many values
+const maxRouteProxies = 1000
+
+// upstreamRoute proxies requests under a path to an upstream chosen by a
+// template over the session, eg. to a backend per tenant
+type upstreamRoute struct {
+	path     string
+	template *template.Template
+	// host matches the hosts the template may produce, where each value
+	// templated into the host must be a single DNS label, so that claims
+	// can't point the route at an arbitrary host
+	host *regexp.Regexp
+}
+
+// parseUpstreamRoute parses a route of the form <path>=<upstream template>
+func parseUpstreamRoute(s string) (*upstreamRoute, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || !strings.HasPrefix(parts[0], "/") || parts[1] == "" {
+		return nil, fmt.Errorf("upstream_route (%s) must be of the form <path>=<upstream template>", s)
+	}
+	t, err := template.New(parts[0]).Funcs(headerTemplateFuncs).Option("missingkey=zero").Parse(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("error parsing upstream_route %s: %v", parts[0], err)
+	}
+	host, err := routeHostPattern(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("upstream_route %s %v", parts[0], err)
+	}
+	return &upstreamRoute{path: parts[0], template: t, host: host}, nil
+}
+
+// routeHostPattern returns a pattern matching the hosts the template can
+// produce, with each action in the host matching a DNS label
+func routeHostPattern(text string) (*regexp.Regexp, error) {
+	i := strings.Index(text, "://")
+	if i < 0 || strings.Contains(text[:i], "{{") {
+		return nil, fmt.Errorf("must start with an http or https scheme")
+	}
+	var b strings.Builder
+	b.WriteString("^")
+	for rest := text[i+3:]; rest != ""; {
+		if strings.HasPrefix(rest, "{{") {
+			end := strings.Index(rest, "}}")
+			if end < 0 {
+				return nil, fmt.Errorf("has an unterminated action")
+			}
+			b.WriteString("[A-Za-z0-9-]+")
+			rest = rest[end+2:]
+			continue
+		}
+		literal := rest
+		if next := strings.Index(rest, "{{"); next >= 0 {
+			literal = rest[:next]
+		}
+		if end := strings.IndexAny(literal, "/?#"); end >= 0 {
+			b.WriteString(regexp.QuoteMeta(literal[:end]))
+			break
+		}
+		b.WriteString(regexp.QuoteMeta(literal))
+		rest = rest[len(literal):]
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// upstream evaluates the template for the session, checking that it
+// produces the URL of an upstream the route allows
+func (r *upstreamRoute) upstream(data *headerTemplateData) (*url.URL, error) {
+	var b strings.Builder
+	if err := r.template.Execute(&b, data); err != nil {
+		return nil, err
+	}
+	rendered := strings.ReplaceAll(b.String(), "<no value>", "")
+	u, err := url.Parse(strings.TrimSpace(rendered))
+	if err != nil {
+		return nil, err
+	}
+	if (u.Scheme != httpScheme && u.Scheme != httpsScheme) || u.User != nil || u.RawQuery != "" || u.Fragment != "" || (u.Path != "" && u.Path != "/") {
+		return nil, fmt.Errorf("%q is not the URL of an upstream", rendered)
+	}
+	if !r.host.MatchString(u.Host) {
+		return nil, fmt.Errorf("%q is not a host the route allows", u.Host)
+	}
+	return u, nil
+}
+
+// upstreamRouter proxies the requests for a route, keeping a proxy for each
+// upstream it routes to
+type upstreamRouter struct {
+	route *upstreamRoute
+	opts  *Options
+	auth  hmacauth.HmacAuth
+
+	mu      sync.Mutex
+	proxies map[string]http.Handler
+}
+
+func newUpstreamRouter(route *upstreamRoute, opts *Options, auth hmacauth.HmacAuth) *upstreamRouter {
+	return &upstreamRouter{
+		route:   route,
+		opts:    opts,
+		auth:    auth,
+		proxies: map[string]http.Handler{},
+	}
+}
+
+func (r *upstreamRouter) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	scope := middleware.GetRequestScope(req)
+	if scope == nil || scope.Session == nil {
+		http.Error(rw, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	u, err := r.route.upstream(newHeaderTemplateData(scope.Session))
+	if err != nil {
+		logger.PrintAuthf(scope.Session.Email, req, logger.AuthFailure, "No upstream for %s: %v", r.route.path, err)
+		http.Error(rw, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+	r.proxy(u).ServeHTTP(rw, req)
+}
+
+// proxy returns the proxy to the upstream, creating it if need be
+func (r *upstreamRouter) proxy(u *url.URL) http.Handler {
+	key := u.Scheme + "://" + u.Host
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if proxy, ok := r.proxies[key]; ok {
+		return proxy
+	}
+
+	auth := r.auth
+	if a, ok := r.opts.upstreamAuth[u.Host]; ok {
+		auth = a
+	}
+	proxy := NewWebSocketOrRestReverseProxy(u, r.opts, auth)
+	if len(r.proxies) < maxRouteProxies {
+		r.proxies[key] = proxy
+	}
+	return proxy
+}
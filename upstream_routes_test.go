@@ -0,0 +1,105 @@
+package oauth2proxy
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseUpstreamRoute(t *testing.T) {
+	route, err := parseUpstreamRoute("/api/=https://{{.Claims.tenant}}.api.internal:8443")
+	require.NoError(t, err)
+	assert.Equal(t, "/api/", route.path)
+
+	for _, s := range []string{
+		"/api/",
+		"api=https://backend",
+		"/api/=backend.internal",
+		"/api/={{.Claims.scheme}}://backend",
+		"/api/=https://{{.Claims.tenant",
+	} {
+		_, err := parseUpstreamRoute(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestUpstreamRouteUpstream(t *testing.T) {
+	route, err := parseUpstreamRoute("/api/=https://{{.Claims.tenant}}.api.internal:8443/")
+	require.NoError(t, err)
+
+	u, err := route.upstream(&headerTemplateData{Claims: map[string]interface{}{"tenant": "acme"}})
+	require.NoError(t, err)
+	assert.Equal(t, "https://acme.api.internal:8443/", u.String())
+
+	// Claims can't point the route elsewhere
+	for _, tenant := range []interface{}{"", nil, "evil.com/x?", "evil.com#", "a.b", "user@evil.com"} {
+		_, err := route.upstream(&headerTemplateData{Claims: map[string]interface{}{"tenant": tenant}})
+		assert.Error(t, err, tenant)
+	}
+
+	route, err = parseUpstreamRoute("/api/=http://backend.internal/{{.Claims.tenant}}")
+	require.NoError(t, err)
+	_, err = route.upstream(&headerTemplateData{Claims: map[string]interface{}{"tenant": "acme"}})
+	assert.Error(t, err)
+}
+
+func TestUpstreamRoutes(t *testing.T) {
+	backends := map[string]*url.URL{}
+	for _, tenant := range []string{"acme", "globex"} {
+		tenant := tenant
+		backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			rw.Write([]byte(tenant + " " + req.URL.Path))
+		}))
+		defer backend.Close()
+		u, err := url.Parse(backend.URL)
+		require.NoError(t, err)
+		backends[tenant] = u
+	}
+
+	pcTest := NewProcessCookieTestWithOptionsModifiers(func(opts *Options) {
+		opts.UpstreamRoutes = []string{"/api/=http://127.0.0.1:{{.Claims.port}}"}
+	})
+
+	request := func(claims string) *httptest.ResponseRecorder {
+		session := &sessionsapi.SessionState{
+			Email:   "jane@example.com",
+			IDToken: "e30." + base64.RawURLEncoding.EncodeToString([]byte(claims)) + ".sig",
+		}
+		req := httptest.NewRequest("GET", "/api/items", nil)
+		rw := httptest.NewRecorder()
+		require.NoError(t, pcTest.proxy.SaveSession(rw, req, session))
+		for _, c := range rw.Result().Cookies() {
+			req.AddCookie(c)
+		}
+		rw = httptest.NewRecorder()
+		pcTest.proxy.ServeHTTP(rw, req)
+		return rw
+	}
+
+	for tenant, u := range backends {
+		rw := request(`{"port": "` + u.Port() + `"}`)
+		assert.Equal(t, http.StatusOK, rw.Code)
+		assert.Equal(t, tenant+" /api/items", rw.Body.String())
+	}
+
+	rw := request(`{}`)
+	assert.Equal(t, http.StatusForbidden, rw.Code)
+}
+
+func TestUpstreamRouteOptions(t *testing.T) {
+	o := testOptions()
+	o.UpstreamRoutes = []string{"/=http://backend.internal", "/api/=backend"}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"upstream_route / is already the path of an upstream",
+		"upstream_route /api/ must start with an http or https scheme"})
+	assert.Equal(t, expected, err.Error())
+}
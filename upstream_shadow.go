@@ -0,0 +1,183 @@
+package oauth2proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/logger"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/middleware"
+)
+
+const (
+	// shadowTimeout bounds how long a shadow request may take
+	shadowTimeout = 30 * time.Second
+	// maxShadowsInFlight bounds the shadow requests in progress to each
+	// shadow upstream, so that a slow upstream can't pile them up. Requests
+	// that would go over it aren't shadowed.
+	maxShadowsInFlight = 100
+)
+
+var (
+	upstreamShadowRequests = expvar.NewInt("upstream_shadow_requests")
+	upstreamShadowErrors   = expvar.NewInt("upstream_shadow_errors")
+	upstreamShadowSkipped  = expvar.NewInt("upstream_shadow_skipped")
+)
+
+// upstreamShadow duplicates a percentage of the requests under a path to a
+// secondary upstream, eg. a canary, discarding its responses
+type upstreamShadow struct {
+	path     string
+	percent  float64
+	upstream *url.URL
+	client   *http.Client
+	inFlight chan struct{}
+}
+
+// parseUpstreamShadow parses a shadow of the form <path>=<percent>:<upstream>,
+// eg. /api/=10:http://canary.internal:8080
+func parseUpstreamShadow(s string, insecureSkipVerify bool) (*upstreamShadow, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || !strings.HasPrefix(parts[0], "/") {
+		return nil, fmt.Errorf("upstream_shadow (%s) must be of the form <path>=<percent>:<upstream>", s)
+	}
+	target := strings.SplitN(parts[1], ":", 2)
+	if len(target) != 2 {
+		return nil, fmt.Errorf("upstream_shadow (%s) must be of the form <path>=<percent>:<upstream>", s)
+	}
+	percent, err := strconv.ParseFloat(target[0], 64)
+	if err != nil || percent <= 0 || percent > 100 {
+		return nil, fmt.Errorf("upstream_shadow %s percent (%s) must be above 0 and at most 100", parts[0], target[0])
+	}
+	upstream, err := url.Parse(target[1])
+	if err != nil || (upstream.Scheme != httpScheme && upstream.Scheme != httpsScheme) || upstream.Host == "" {
+		return nil, fmt.Errorf("upstream_shadow %s upstream (%s) must be an http or https URL", parts[0], target[1])
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if insecureSkipVerify {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return &upstreamShadow{
+		path:     parts[0],
+		percent:  percent,
+		upstream: upstream,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   shadowTimeout,
+			// redirects are the upstream's response, which is discarded
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		inFlight: make(chan struct{}, maxShadowsInFlight),
+	}, nil
+}
+
+// matches checks whether the shadow applies to the path, as http.ServeMux
+// would route it: paths ending in / match the paths under them
+func (s *upstreamShadow) matches(path string) bool {
+	if strings.HasSuffix(s.path, "/") {
+		return strings.HasPrefix(path, s.path)
+	}
+	return path == s.path
+}
+
+// shadowRequests is the middleware that duplicates the authenticated requests
+// under each shadowed path to its shadow upstream, without waiting for the
+// shadow's response. Requests with bodies over the size limit, and
+// websockets, aren't shadowed.
+func (p *OAuthProxy) shadowRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		session := middleware.GetRequestScope(req).Session
+		if len(p.upstreamShadows) == 0 || session == nil || session.User == anonymousUser || isWebSocket(req) {
+			next.ServeHTTP(rw, req)
+			return
+		}
+		for _, shadow := range p.upstreamShadows {
+			if !shadow.matches(req.URL.Path) {
+				continue
+			}
+			if rand.Float64()*100 < shadow.percent {
+				p.shadow(shadow, req)
+			}
+			break
+		}
+		next.ServeHTTP(rw, req)
+	})
+}
+
+// shadow sends a copy of the request to the shadow upstream in the
+// background, buffering the request's body so that it can be sent twice
+func (p *OAuthProxy) shadow(shadow *upstreamShadow, req *http.Request) {
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.ContentLength > p.shadowMaxBodySize {
+			upstreamShadowSkipped.Add(1)
+			return
+		}
+		var err error
+		body, err = ioutil.ReadAll(io.LimitReader(req.Body, p.shadowMaxBodySize+1))
+		// the upstream is sent what was read followed by the rest, if any
+		req.Body = readCloser{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+		if err != nil || int64(len(body)) > p.shadowMaxBodySize {
+			upstreamShadowSkipped.Add(1)
+			return
+		}
+	}
+
+	select {
+	case shadow.inFlight <- struct{}{}:
+	default:
+		upstreamShadowSkipped.Add(1)
+		return
+	}
+
+	u := *shadow.upstream
+	u.Path = req.URL.Path
+	u.RawPath = req.URL.RawPath
+	u.RawQuery = req.URL.RawQuery
+	out, err := http.NewRequestWithContext(context.Background(), req.Method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		<-shadow.inFlight
+		upstreamShadowErrors.Add(1)
+		logger.Printf("Error creating shadow request to %s: %v", shadow.upstream.Host, err)
+		return
+	}
+	out.Header = req.Header.Clone()
+	out.Header.Set("X-Shadow-Request", "true")
+
+	upstreamShadowRequests.Add(1)
+	go func() {
+		defer func() { <-shadow.inFlight }()
+		resp, err := shadow.client.Do(out)
+		if err != nil {
+			upstreamShadowErrors.Add(1)
+			logger.Printf("Error sending shadow request to %s: %v", shadow.upstream.Host, err)
+			return
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+}
+
+// readCloser reads from one reader and closes another, eg. the original body
+// of a request whose start has been buffered
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// isWebSocket checks whether the request is a websocket upgrade
+func isWebSocket(req *http.Request) bool {
+	return strings.EqualFold(req.Header.Get("Connection"), "upgrade") && req.Header.Get("Upgrade") == "websocket"
+}
@@ -0,0 +1,89 @@
+package oauth2proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseUpstreamShadow(t *testing.T) {
+	shadow, err := parseUpstreamShadow("/api/=12.5:http://canary.internal:8080", false)
+	require.NoError(t, err)
+	assert.Equal(t, "/api/", shadow.path)
+	assert.Equal(t, 12.5, shadow.percent)
+	assert.Equal(t, "canary.internal:8080", shadow.upstream.Host)
+	assert.True(t, shadow.matches("/api/items"))
+	assert.False(t, shadow.matches("/apis"))
+
+	for _, s := range []string{
+		"api=10:http://canary.internal",
+		"/api/=http://canary.internal",
+		"/api/=0:http://canary.internal",
+		"/api/=101:http://canary.internal",
+		"/api/=10:canary.internal",
+		"/api/=10:file:///var/www",
+	} {
+		_, err := parseUpstreamShadow(s, false)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestShadowRequests(t *testing.T) {
+	type shadowed struct {
+		method, uri, body, email, shadow string
+	}
+	received := make(chan shadowed, 10)
+	backend := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		received <- shadowed{req.Method, req.URL.RequestURI(), string(body), req.Header.Get("X-Forwarded-Email"), req.Header.Get("X-Shadow-Request")}
+	}))
+	defer backend.Close()
+
+	pcTest := NewProcessCookieTestWithDefaults()
+	shadow, err := parseUpstreamShadow("/api/=100:"+backend.URL, false)
+	require.NoError(t, err)
+	pcTest.proxy.upstreamShadows = []*upstreamShadow{shadow}
+	pcTest.proxy.shadowMaxBodySize = 10
+	pcTest.proxy.serveMux = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		rw.Write(body)
+	})
+	pcTest.proxy.proxyHandler = pcTest.proxy.proxyChain.Then(pcTest.proxy.serveMux)
+	require.NoError(t, pcTest.SaveSession(&sessionsapi.SessionState{Email: "jane@example.com", CreatedAt: time.Now()}))
+	cookie, err := pcTest.req.Cookie(pcTest.opts.Cookie.Name)
+	require.NoError(t, err)
+
+	send := func(path, body string) string {
+		req := httptest.NewRequest("POST", path, strings.NewReader(body))
+		req.AddCookie(cookie)
+		rw := httptest.NewRecorder()
+		pcTest.proxy.ServeHTTP(rw, req)
+		require.Equal(t, http.StatusOK, rw.Code)
+		return rw.Body.String()
+	}
+
+	assert.Equal(t, "small", send("/api/items?page=2", "small"))
+	select {
+	case r := <-received:
+		assert.Equal(t, shadowed{"POST", "/api/items?page=2", "small", "jane@example.com", "true"}, r)
+	case <-time.After(time.Second):
+		t.Fatal("request wasn't shadowed")
+	}
+
+	// Bodies over the limit, and paths without a shadow, aren't shadowed,
+	// and are still proxied whole
+	assert.Equal(t, "a larger body", send("/api/items", "a larger body"))
+	assert.Equal(t, "small", send("/other", "small"))
+	select {
+	case r := <-received:
+		t.Fatalf("unexpected shadow request %v", r)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
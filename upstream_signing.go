@@ -0,0 +1,267 @@
+package oauth2proxy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mbland/hmacauth"
+)
+
+const (
+	sigV4Algorithm  = "AWS4-HMAC-SHA256"
+	sigV4TimeFormat = "20060102T150405Z"
+
+	// unsignedPayload is signed in place of the payload's hash for S3, which
+	// accepts it over TLS, so that uploads needn't be buffered
+	unsignedPayload = "UNSIGNED-PAYLOAD"
+)
+
+// sigV4Signer signs requests with AWS Signature Version 4, so that upstreams
+// such as API Gateway and S3 accept them on behalf of the proxy's IAM
+// credentials
+type sigV4Signer struct {
+	region          string
+	service         string
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+	maxBodySize     int64
+}
+
+// parseUpstreamSigning parses an upstream_signing entry, in the form
+// upstream=hmac:algorithm:secret or upstream=sigv4:region:service, returning
+// the upstream and either an HMAC signer or a SigV4 signer
+func parseUpstreamSigning(s string, aws sigV4Signer) (string, hmacauth.HmacAuth, *sigV4Signer, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", nil, nil, fmt.Errorf("upstream_signing (%s) must be in the form upstream=hmac:algorithm:secret or upstream=sigv4:region:service", s)
+	}
+	upstream, spec := parts[0], strings.SplitN(parts[1], ":", 3)
+	switch {
+	case spec[0] == "hmac" && len(spec) == 3 && spec[2] != "":
+		hash, err := hmacauth.DigestNameToCryptoHash(spec[1])
+		if err != nil {
+			return "", nil, nil, fmt.Errorf("upstream_signing for %s has an unsupported hmac algorithm %s", upstream, spec[1])
+		}
+		return upstream, hmacauth.NewHmacAuth(hash, []byte(spec[2]), SignatureHeader, SignatureHeaders), nil, nil
+	case spec[0] == "sigv4" && len(spec) == 3 && spec[1] != "" && spec[2] != "":
+		if aws.accessKeyID == "" || aws.secretAccessKey == "" {
+			return "", nil, nil, fmt.Errorf("upstream_signing for %s requires upstream_aws_access_key_id and upstream_aws_secret_access_key", upstream)
+		}
+		aws.region, aws.service = spec[1], spec[2]
+		return upstream, nil, &aws, nil
+	default:
+		return "", nil, nil, fmt.Errorf("upstream_signing for %s must be hmac:algorithm:secret or sigv4:region:service", upstream)
+	}
+}
+
+// sigV4Transport signs each request with SigV4 before sending it
+type sigV4Transport struct {
+	signer *sigV4Signer
+	next   http.RoundTripper
+}
+
+// setProxySigV4Signer signs the requests proxied to the upstream. This is
+// done by the transport, after the director, so that the request is signed
+// as sent.
+func setProxySigV4Signer(proxy *httputil.ReverseProxy, signer *sigV4Signer) {
+	next := proxy.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	proxy.Transport = &sigV4Transport{signer: signer, next: next}
+}
+
+func (t *sigV4Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	// AWS routes requests by their host so the host passed on by
+	// pass_host_header can't be signed
+	req.Host = req.URL.Host
+
+	payloadHash := unsignedPayload
+	if t.signer.service != "s3" {
+		body := []byte{}
+		if req.Body != nil {
+			if req.ContentLength > t.signer.maxBodySize {
+				req.Body.Close()
+				return bodyTooLarge(req), nil
+			}
+			var err error
+			body, err = ioutil.ReadAll(io.LimitReader(req.Body, t.signer.maxBodySize+1))
+			req.Body.Close()
+			if err != nil {
+				return nil, fmt.Errorf("error reading request body to sign: %v", err)
+			}
+			if int64(len(body)) > t.signer.maxBodySize {
+				return bodyTooLarge(req), nil
+			}
+			req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		}
+		payloadHash = sha256Hex(body)
+	}
+	t.signer.sign(req, payloadHash, time.Now())
+	return t.next.RoundTrip(req)
+}
+
+// bodyTooLarge refuses a request whose body is too large to be read into
+// memory and signed, without sending it to the upstream
+func bodyTooLarge(req *http.Request) *http.Response {
+	text := http.StatusText(http.StatusRequestEntityTooLarge) + "\n"
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", http.StatusRequestEntityTooLarge, http.StatusText(http.StatusRequestEntityTooLarge)),
+		StatusCode:    http.StatusRequestEntityTooLarge,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+		Body:          ioutil.NopCloser(strings.NewReader(text)),
+		ContentLength: int64(len(text)),
+		Request:       req,
+	}
+}
+
+// sign sets the X-Amz-* and Authorization headers of the request
+func (s *sigV4Signer) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format(sigV4TimeFormat)
+	date := amzDate[:8]
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if s.service == "s3" {
+		req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	}
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for _, name := range []string{"X-Amz-Date", "X-Amz-Content-Sha256", "X-Amz-Security-Token"} {
+		if value := req.Header.Get(name); value != "" {
+			headers[strings.ToLower(name)] = value
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + strings.TrimSpace(headers[name]) + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path, query := requestPathAndQuery(req.URL)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s.canonicalURI(path),
+		canonicalQuery(query),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := strings.Join([]string{date, s.region, s.service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{sigV4Algorithm, amzDate, scope, sha256Hex([]byte(canonicalRequest))}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.secretAccessKey), date)
+	for _, part := range []string{s.region, s.service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigV4Algorithm, s.accessKeyID, scope, signedHeaders, signature))
+}
+
+// requestPathAndQuery returns the escaped path and raw query the request
+// will be sent with. The director passes the request URI through as is in
+// the URL's Opaque.
+func requestPathAndQuery(u *url.URL) (string, string) {
+	if u.Opaque == "" {
+		return u.EscapedPath(), u.RawQuery
+	}
+	parts := strings.SplitN(u.Opaque, "?", 2)
+	if len(parts) == 2 {
+		return parts[0], parts[1]
+	}
+	return parts[0], u.RawQuery
+}
+
+// canonicalURI encodes the already escaped path again, as SigV4 requires
+// for every service but S3
+func (s *sigV4Signer) canonicalURI(path string) string {
+	if path == "" {
+		return "/"
+	}
+	if s.service == "s3" {
+		return path
+	}
+	return awsURIEncode(path, false)
+}
+
+// canonicalQuery sorts the query's parameters by name then value,
+// encoding them as SigV4 requires
+func canonicalQuery(query string) string {
+	values, _ := url.ParseQuery(query)
+	var params [][2]string
+	for name, vs := range values {
+		for _, v := range vs {
+			params = append(params, [2]string{awsURIEncode(name, true), awsURIEncode(v, true)})
+		}
+	}
+	sort.Slice(params, func(i, j int) bool {
+		if params[i][0] != params[j][0] {
+			return params[i][0] < params[j][0]
+		}
+		return params[i][1] < params[j][1]
+	})
+	encoded := make([]string, len(params))
+	for i, param := range params {
+		encoded[i] = param[0] + "=" + param[1]
+	}
+	return strings.Join(encoded, "&")
+}
+
+// awsURIEncode percent encodes every byte but the unreserved characters, and
+// slashes unless encodeSlash is set
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
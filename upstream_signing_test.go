@@ -0,0 +1,123 @@
+package oauth2proxy
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// The requests and signatures of the AWS Signature Version 4 test suite
+func TestSigV4Sign(t *testing.T) {
+	signer := &sigV4Signer{
+		region:          "us-east-1",
+		service:         "service",
+		accessKeyID:     "AKIDEXAMPLE",
+		secretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+	}
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+	emptyHash := sha256Hex(nil)
+
+	tests := map[string]string{
+		"/":                             "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		"/?Param2=value2&Param1=value1": "b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500",
+	}
+	for uri, signature := range tests {
+		req := httptest.NewRequest("GET", "http://example.amazonaws.com"+uri, nil)
+		signer.sign(req, emptyHash, now)
+		assert.Equal(t, "20150830T123600Z", req.Header.Get("X-Amz-Date"), uri)
+		assert.Equal(t, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, "+
+			"SignedHeaders=host;x-amz-date, Signature="+signature, req.Header.Get("Authorization"), uri)
+	}
+}
+
+func TestCanonicalQuery(t *testing.T) {
+	assert.Equal(t, "a=1&a=2&a-b=3&b=%20%2F", canonicalQuery("b=+/&a-b=3&a=2&a=1"))
+	assert.Equal(t, "", canonicalQuery(""))
+}
+
+func TestParseUpstreamSigning(t *testing.T) {
+	aws := sigV4Signer{accessKeyID: "AKIDEXAMPLE", secretAccessKey: "secret"}
+
+	upstream, auth, sigV4, err := parseUpstreamSigning("http://internal:8080/=hmac:sha256:my:secret", aws)
+	require.NoError(t, err)
+	assert.Equal(t, "http://internal:8080/", upstream)
+	assert.NotNil(t, auth)
+	assert.Nil(t, sigV4)
+
+	upstream, auth, sigV4, err = parseUpstreamSigning("https://abc.execute-api.eu-west-1.amazonaws.com/=sigv4:eu-west-1:execute-api", aws)
+	require.NoError(t, err)
+	assert.Equal(t, "https://abc.execute-api.eu-west-1.amazonaws.com/", upstream)
+	assert.Nil(t, auth)
+	require.NotNil(t, sigV4)
+	assert.Equal(t, "eu-west-1", sigV4.region)
+	assert.Equal(t, "execute-api", sigV4.service)
+	assert.Equal(t, "AKIDEXAMPLE", sigV4.accessKeyID)
+
+	for _, s := range []string{
+		"http://internal:8080/",
+		"http://internal:8080/=hmac:sha256",
+		"http://internal:8080/=hmac:md4:secret",
+		"http://internal:8080/=sigv4:eu-west-1",
+		"http://internal:8080/=basic:user:pass",
+	} {
+		_, _, _, err := parseUpstreamSigning(s, aws)
+		assert.Error(t, err, s)
+	}
+	_, _, _, err = parseUpstreamSigning("http://internal:8080/=sigv4:eu-west-1:s3", sigV4Signer{})
+	assert.Error(t, err)
+}
+
+func TestSigV4Upstream(t *testing.T) {
+	var received *http.Request
+	upstream := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		received = req
+	}))
+	defer upstream.Close()
+
+	u, err := url.Parse(upstream.URL)
+	require.NoError(t, err)
+	opts := NewOptions()
+	opts.upstreamSigV4 = map[string]*sigV4Signer{u.Host: {
+		region:          "eu-west-1",
+		service:         "execute-api",
+		accessKeyID:     "AKIDEXAMPLE",
+		secretAccessKey: "secret",
+		sessionToken:    "token",
+		maxBodySize:     32,
+	}}
+	proxy := NewWebSocketOrRestReverseProxy(u, opts, nil)
+
+	req := httptest.NewRequest("POST", "http://proxy.example.com/items?id=1", strings.NewReader(`{"name": "widget"}`))
+	req.RequestURI = "/items?id=1"
+	proxy.ServeHTTP(httptest.NewRecorder(), req)
+	require.NotNil(t, received)
+	assert.Equal(t, u.Host, received.Host)
+	assert.Equal(t, "/items?id=1", received.RequestURI)
+	assert.Equal(t, "token", received.Header.Get("X-Amz-Security-Token"))
+	assert.Contains(t, received.Header.Get("Authorization"), "SignedHeaders=host;x-amz-date;x-amz-security-token, Signature=")
+	assert.Contains(t, received.Header.Get("Authorization"), "/eu-west-1/execute-api/aws4_request")
+
+	// bodies too large to be signed aren't sent to the upstream
+	received = nil
+	req = httptest.NewRequest("POST", "http://proxy.example.com/items", strings.NewReader(strings.Repeat("x", 33)))
+	req.RequestURI = "/items"
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rw.Code)
+	assert.Nil(t, received)
+
+	// nor are those not saying how large they are
+	req = httptest.NewRequest("POST", "http://proxy.example.com/items", ioutil.NopCloser(strings.NewReader(strings.Repeat("x", 33))))
+	req.RequestURI = "/items"
+	rw = httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rw.Code)
+	assert.Nil(t, received)
+}
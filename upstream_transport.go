@@ -0,0 +1,82 @@
+package oauth2proxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// transportSettings tune the connection pool of the transport requests are
+// proxied to upstreams with
+type transportSettings struct {
+	maxIdleConns        int
+	maxIdleConnsPerHost int
+	idleConnTimeout     time.Duration
+	disableKeepAlives   bool
+}
+
+// newTransport returns a transport with the settings, otherwise configured
+// as http.DefaultTransport
+func (s transportSettings) newTransport(insecureSkipVerify bool) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxIdleConns = s.maxIdleConns
+	t.MaxIdleConnsPerHost = s.maxIdleConnsPerHost
+	t.IdleConnTimeout = s.idleConnTimeout
+	t.DisableKeepAlives = s.disableKeepAlives
+	if insecureSkipVerify {
+		t.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	return t
+}
+
+// parseUpstreamTransport parses the transport settings of an upstream, of the
+// form upstream=setting setting..., eg. http://backend:8080/=max-idle-conns-per-host:256
+// idle-conn-timeout:30s, overriding the defaults
+func parseUpstreamTransport(s string, defaults transportSettings) (string, transportSettings, error) {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || strings.TrimSpace(parts[1]) == "" {
+		return "", defaults, fmt.Errorf("upstream_transport (%s) must be in the form upstream=setting:value ...", s)
+	}
+	upstream, settings := parts[0], defaults
+	for _, setting := range strings.Fields(parts[1]) {
+		kv := strings.SplitN(setting, ":", 2)
+		value := ""
+		if len(kv) == 2 {
+			value = kv[1]
+		}
+		var err error
+		switch kv[0] {
+		case "max-idle-conns":
+			settings.maxIdleConns, err = parseConnCount(value)
+		case "max-idle-conns-per-host":
+			settings.maxIdleConnsPerHost, err = parseConnCount(value)
+		case "idle-conn-timeout":
+			settings.idleConnTimeout, err = time.ParseDuration(value)
+			if err == nil && settings.idleConnTimeout < 0 {
+				err = fmt.Errorf("must not be negative")
+			}
+		case "disable-keep-alives":
+			settings.disableKeepAlives = true
+			if value != "" {
+				settings.disableKeepAlives, err = strconv.ParseBool(value)
+			}
+		default:
+			return "", defaults, fmt.Errorf("upstream_transport for %s has an unknown setting %s", upstream, kv[0])
+		}
+		if err != nil {
+			return "", defaults, fmt.Errorf("upstream_transport for %s has an invalid %s (%s): %v", upstream, kv[0], value, err)
+		}
+	}
+	return upstream, settings, nil
+}
+
+func parseConnCount(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err == nil && n < 0 {
+		err = fmt.Errorf("must not be negative")
+	}
+	return n, err
+}
@@ -0,0 +1,54 @@
+package oauth2proxy
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseUpstreamTransport(t *testing.T) {
+	defaults := transportSettings{maxIdleConns: 100, maxIdleConnsPerHost: 2, idleConnTimeout: 90 * time.Second}
+	upstream, settings, err := parseUpstreamTransport("http://backend:8080/=max-idle-conns-per-host:256 idle-conn-timeout:30s", defaults)
+	require.NoError(t, err)
+	assert.Equal(t, "http://backend:8080/", upstream)
+	assert.Equal(t, transportSettings{maxIdleConns: 100, maxIdleConnsPerHost: 256, idleConnTimeout: 30 * time.Second}, settings)
+
+	_, settings, err = parseUpstreamTransport("http://backend:8080/=disable-keep-alives max-idle-conns:0", defaults)
+	require.NoError(t, err)
+	assert.True(t, settings.disableKeepAlives)
+	assert.Equal(t, 0, settings.maxIdleConns)
+
+	for _, s := range []string{
+		"http://backend:8080/",
+		"http://backend:8080/=",
+		"http://backend:8080/=max-idle-conns:-1",
+		"http://backend:8080/=idle-conn-timeout:soon",
+		"http://backend:8080/=keep-alive:true",
+	} {
+		_, _, err := parseUpstreamTransport(s, defaults)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestUpstreamTransportOptions(t *testing.T) {
+	o := testOptions()
+	o.Upstreams = []string{"http://backend:8080", "http://other:8080"}
+	o.UpstreamMaxIdleConnsPerHost = 32
+	o.UpstreamTransports = []string{"http://backend:8080=max-idle-conns-per-host:256", "http://unknown:8080/=disable-keep-alives"}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+
+	expected := errorMsg([]string{
+		"upstream_transport for http://unknown:8080/ must be for one of the http or https upstreams"})
+	assert.Equal(t, expected, err.Error())
+
+	backend := NewReverseProxy(&url.URL{Scheme: "http", Host: "backend:8080"}, o)
+	assert.Equal(t, 256, backend.Transport.(*http.Transport).MaxIdleConnsPerHost)
+	other := NewReverseProxy(&url.URL{Scheme: "http", Host: "other:8080"}, o)
+	assert.Equal(t, 32, other.Transport.(*http.Transport).MaxIdleConnsPerHost)
+	assert.Equal(t, 90*time.Second, other.Transport.(*http.Transport).IdleConnTimeout)
+}
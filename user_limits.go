@@ -0,0 +1,245 @@
+package oauth2proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/clock"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/logger"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/middleware"
+)
+
+// userRequestsTTL is how long the count of a user's requests in progress is
+// kept after it last changed, so that requests an instance of the proxy
+// never finished counting, eg. as it was stopped, don't count against the
+// user for ever
+const userRequestsTTL = time.Hour
+
+// userLimits limits the requests each user may have in progress and the
+// bytes they may transfer in each window, with counters shared by instances
+// of the proxy when they're kept in Redis
+type userLimits struct {
+	counters    sessionsapi.CounterStore
+	maxRequests int64
+	maxBytes    int64
+	window      time.Duration
+}
+
+// userLimitsKey identifies the user in counter keys, hashed so that keys
+// don't reveal who is using the proxy
+func userLimitsKey(user string) string {
+	sum := sha256.Sum256([]byte(user))
+	return hex.EncodeToString(sum[:])
+}
+
+func (l *userLimits) requestsKey(user string) string {
+	return "user-requests:" + userLimitsKey(user)
+}
+
+// bytesKey is the key of the bytes the user has transferred in the window
+// now falls in. Windows are aligned to the same times on every instance.
+func (l *userLimits) bytesKey(user string, now time.Time) string {
+	window := now.Truncate(l.window).Unix()
+	return "user-bytes:" + userLimitsKey(user) + ":" + strconv.FormatInt(window, 10)
+}
+
+// admit counts a request by the user in progress, unless they've used up
+// their bandwidth for the current window or already have as many requests
+// in progress as they may. Requests not admitted should be retried after
+// the returned duration. Admitted requests must be released.
+func (l *userLimits) admit(ctx context.Context, user string) (bool, time.Duration, error) {
+	now := clock.Now()
+	if l.maxBytes > 0 {
+		used, err := l.counters.IncrementCounter(ctx, l.bytesKey(user, now), 0, l.window)
+		if err != nil {
+			return false, 0, err
+		}
+		if used >= l.maxBytes {
+			return false, now.Truncate(l.window).Add(l.window).Sub(now), nil
+		}
+	}
+	if l.maxRequests > 0 {
+		n, err := l.counters.IncrementCounter(ctx, l.requestsKey(user), 1, userRequestsTTL)
+		if err != nil {
+			return false, 0, err
+		}
+		if n > l.maxRequests {
+			l.release(ctx, user)
+			return false, time.Second, nil
+		}
+	}
+	return true, 0, nil
+}
+
+// release counts an admitted request by the user as finished
+func (l *userLimits) release(ctx context.Context, user string) {
+	if l.maxRequests <= 0 {
+		return
+	}
+	if _, err := l.counters.IncrementCounter(ctx, l.requestsKey(user), -1, userRequestsTTL); err != nil {
+		logger.Printf("Error counting a finished user request: %v", err)
+	}
+}
+
+// record adds the bytes transferred by a request to the user's bandwidth
+// for the current window
+func (l *userLimits) record(ctx context.Context, user string, n int64) {
+	if l.maxBytes <= 0 || n <= 0 {
+		return
+	}
+	if _, err := l.counters.IncrementCounter(ctx, l.bytesKey(user, clock.Now()), n, l.window); err != nil {
+		logger.Printf("Error counting user bandwidth: %v", err)
+	}
+}
+
+// limitedUser returns the user whose limits apply to the session: its
+// username or else its email, or "" for anonymous users, who aren't limited
+func limitedUser(session *sessionsapi.SessionState) string {
+	if session == nil || session.User == anonymousUser {
+		return ""
+	}
+	if session.User != "" {
+		return session.User
+	}
+	return session.Email
+}
+
+// limitUser is the middleware that enforces the per-user limits, rejecting
+// requests with a 429 error when the user has too many in progress or has
+// used up their bandwidth, and counting the bytes of the request and response
+// bodies of the requests it admits
+func (p *OAuthProxy) limitUser(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		user := limitedUser(middleware.GetRequestScope(req).Session)
+		if p.userLimits == nil || user == "" {
+			next.ServeHTTP(rw, req)
+			return
+		}
+
+		admitted, retryAfter, err := p.userLimits.admit(req.Context(), user)
+		if err != nil {
+			// the limits can't be enforced, but the user shouldn't be
+			// refused for it
+			logger.Printf("Error checking user limits: %v", err)
+			next.ServeHTTP(rw, req)
+			return
+		}
+		if !admitted {
+			rw.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			if isAjax(req) {
+				p.ErrorJSON(rw, http.StatusTooManyRequests)
+				return
+			}
+			p.ErrorPage(rw, http.StatusTooManyRequests,
+				"Too Many Requests", "You have too many requests in progress or have transferred too much data, try again later")
+			return
+		}
+
+		// The request's context is done if the client goes away, but its
+		// counts must still be updated
+		ctx := context.Background()
+		defer p.userLimits.release(ctx, user)
+		body := &countingReader{ReadCloser: req.Body}
+		if req.Body != nil {
+			req.Body = body
+		}
+		counter := &countingResponseWriter{ResponseWriter: rw}
+		next.ServeHTTP(counter, req)
+		p.userLimits.record(ctx, user, body.n+counter.n)
+	})
+}
+
+// countingReader counts the bytes read from a request body
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.n += int64(n)
+	return n, err
+}
+
+// countingResponseWriter counts the bytes of a response body. The bytes
+// written to hijacked connections, eg. of websockets, aren't counted.
+type countingResponseWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (w *countingResponseWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.n += int64(n)
+	return n, err
+}
+
+// Flush supports streamed responses
+func (w *countingResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack supports websockets
+func (w *countingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if hj, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return hj.Hijack()
+	}
+	return nil, nil, errors.New("http.Hijacker is not available on writer")
+}
+
+// memoryCounterStore keeps counters in the process, for session stores that
+// can't keep them. Each instance of the proxy then enforces limits alone.
+type memoryCounterStore struct {
+	mu        sync.Mutex
+	counters  map[string]memoryCounter
+	nextPurge time.Time
+}
+
+type memoryCounter struct {
+	value   int64
+	expires time.Time
+}
+
+var _ sessionsapi.CounterStore = (*memoryCounterStore)(nil)
+
+func newMemoryCounterStore() *memoryCounterStore {
+	return &memoryCounterStore{counters: map[string]memoryCounter{}}
+}
+
+// IncrementCounter adds delta to a counter, resetting its TTL. Expired
+// counters are purged at most once a minute.
+func (s *memoryCounterStore) IncrementCounter(_ context.Context, key string, delta int64, ttl time.Duration) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := clock.Now()
+	if now.After(s.nextPurge) {
+		for k, c := range s.counters {
+			if !now.Before(c.expires) {
+				delete(s.counters, k)
+			}
+		}
+		s.nextPurge = now.Add(time.Minute)
+	}
+	c, ok := s.counters[key]
+	if !ok || !now.Before(c.expires) {
+		c = memoryCounter{}
+	}
+	c.value += delta
+	c.expires = now.Add(ttl)
+	s.counters[key] = c
+	return c.value, nil
+}
@@ -0,0 +1,100 @@
+package oauth2proxy
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/clock"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryCounterStore(t *testing.T) {
+	mock := clock.NewMock(time.Date(2020, 6, 1, 12, 0, 0, 0, time.UTC))
+	clock.Set(mock)
+	defer clock.Reset()
+
+	ctx := context.Background()
+	s := newMemoryCounterStore()
+	n, _ := s.IncrementCounter(ctx, "a", 2, time.Minute)
+	assert.Equal(t, int64(2), n)
+	n, _ = s.IncrementCounter(ctx, "a", -1, time.Minute)
+	assert.Equal(t, int64(1), n)
+	n, _ = s.IncrementCounter(ctx, "b", 5, time.Second)
+	assert.Equal(t, int64(5), n)
+
+	mock.Add(2 * time.Minute)
+	n, _ = s.IncrementCounter(ctx, "a", 0, time.Minute)
+	assert.Equal(t, int64(0), n)
+	// Expired counters are purged
+	assert.Len(t, s.counters, 1)
+}
+
+func TestUserLimits(t *testing.T) {
+	mock := clock.NewMock(time.Date(2020, 6, 1, 12, 0, 30, 0, time.UTC))
+	clock.Set(mock)
+	defer clock.Reset()
+
+	ctx := context.Background()
+	l := &userLimits{counters: newMemoryCounterStore(), maxRequests: 2, maxBytes: 100, window: time.Minute}
+	for i := 0; i < 2; i++ {
+		admitted, _, err := l.admit(ctx, "jane")
+		require.NoError(t, err)
+		assert.True(t, admitted)
+	}
+	admitted, retryAfter, err := l.admit(ctx, "jane")
+	require.NoError(t, err)
+	assert.False(t, admitted)
+	assert.Equal(t, time.Second, retryAfter)
+
+	// Other users have their own limits
+	admitted, _, _ = l.admit(ctx, "john")
+	assert.True(t, admitted)
+
+	l.release(ctx, "jane")
+	admitted, _, _ = l.admit(ctx, "jane")
+	assert.True(t, admitted)
+	l.release(ctx, "jane")
+
+	// Bandwidth is counted until the end of the window
+	l.record(ctx, "jane", 100)
+	admitted, retryAfter, _ = l.admit(ctx, "jane")
+	assert.False(t, admitted)
+	assert.Equal(t, 30*time.Second, retryAfter)
+
+	mock.Add(30 * time.Second)
+	admitted, _, _ = l.admit(ctx, "jane")
+	assert.True(t, admitted)
+}
+
+func TestLimitUser(t *testing.T) {
+	pcTest := NewProcessCookieTestWithDefaults()
+	pcTest.proxy.userLimits = &userLimits{counters: newMemoryCounterStore(), maxBytes: 10, window: time.Minute}
+	pcTest.proxy.serveMux = http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		rw.Write(body)
+	})
+	pcTest.proxy.proxyHandler = pcTest.proxy.proxyChain.Then(pcTest.proxy.serveMux)
+	require.NoError(t, pcTest.SaveSession(&sessionsapi.SessionState{Email: "jane@example.com", CreatedAt: time.Now()}))
+	cookie, err := pcTest.req.Cookie(pcTest.opts.Cookie.Name)
+	require.NoError(t, err)
+
+	send := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/upload", strings.NewReader("12345"))
+		req.AddCookie(cookie)
+		rw := httptest.NewRecorder()
+		pcTest.proxy.ServeHTTP(rw, req)
+		return rw
+	}
+	// The request and response bodies are both counted
+	assert.Equal(t, http.StatusOK, send().Code)
+	rw := send()
+	assert.Equal(t, http.StatusTooManyRequests, rw.Code)
+	assert.NotEmpty(t, rw.Header().Get("Retry-After"))
+}
@@ -0,0 +1,116 @@
+package oauth2proxy
+
+import (
+	"errors"
+	"net/http"
+
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/logger"
+)
+
+// UserSessions lets signed in users list (GET) their active sessions, as a
+// page or as JSON for AJAX requests, and revoke them (DELETE with an "id"
+// query parameter)
+func (p *OAuthProxy) UserSessions(rw http.ResponseWriter, req *http.Request) {
+	if p.userSessions == nil {
+		http.NotFound(rw, req)
+		return
+	}
+
+	session, err := p.getAuthenticatedSession(rw, req)
+	if errors.Is(err, sessionsapi.ErrBackendUnavailable) {
+		http.Error(rw, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
+		if req.Method == http.MethodGet && !isAjax(req) {
+			p.SignInPage(rw, req, http.StatusForbidden)
+			return
+		}
+		http.Error(rw, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	if session.IsImpersonated() {
+		http.Error(rw, "sessions can't be managed while impersonating a user", http.StatusForbidden)
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet:
+		p.listUserSessions(rw, req, session)
+	case http.MethodDelete:
+		p.revokeUserSession(rw, req, session)
+	default:
+		rw.Header().Set("Allow", "GET, DELETE")
+		http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func (p *OAuthProxy) listUserSessions(rw http.ResponseWriter, req *http.Request, session *sessionsapi.SessionState) {
+	list, err := p.userSessions.ListUserSessions(req.Context(), req, session)
+	if err != nil {
+		logger.Printf("Error listing sessions of %s: %v", session.Email, err)
+		if isAjax(req) {
+			http.Error(rw, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		} else {
+			p.ErrorPage(rw, http.StatusServiceUnavailable, "Service Unavailable", "Service Unavailable")
+		}
+		return
+	}
+
+	if isAjax(req) {
+		writeJSON(rw, http.StatusOK, list)
+		return
+	}
+	t := struct {
+		User     string
+		Sessions []*sessionsapi.UserSession
+		Path     string
+	}{
+		User:     session.Email,
+		Sessions: list,
+		Path:     p.UserSessionsPath,
+	}
+	if t.User == "" {
+		t.User = session.User
+	}
+	if err := p.templates.ExecuteTemplate(rw, "sessions.html", t); err != nil {
+		logger.Printf("Error rendering sessions template: %v", err)
+	}
+}
+
+// revokeUserSession removes one of the user's sessions, clearing the session
+// cookie too if it's the session the request was made with
+func (p *OAuthProxy) revokeUserSession(rw http.ResponseWriter, req *http.Request, session *sessionsapi.SessionState) {
+	id := req.URL.Query().Get("id")
+	list, err := p.userSessions.ListUserSessions(req.Context(), req, session)
+	if err != nil {
+		logger.Printf("Error listing sessions of %s: %v", session.Email, err)
+		http.Error(rw, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	var revoked *sessionsapi.UserSession
+	for _, s := range list {
+		if s.ID == id {
+			revoked = s
+		}
+	}
+	if revoked == nil {
+		http.NotFound(rw, req)
+		return
+	}
+
+	err = p.userSessions.RevokeUserSession(req.Context(), session, id)
+	if errors.Is(err, sessionsapi.ErrNotFound) {
+		http.NotFound(rw, req)
+		return
+	} else if err != nil {
+		logger.Printf("Error revoking session %s of %s: %v", id, session.Email, err)
+		http.Error(rw, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	logger.PrintAuthf(session.Email, req, logger.AuthSuccess, "Revoked session %s last seen from %s", id, revoked.IP)
+	if revoked.Current {
+		p.ClearSessionCookie(rw, req)
+	}
+	rw.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,102 @@
+package oauth2proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUserSessions(t *testing.T) {
+	o := redisTestOptions(t)
+	o.UserSessionsPage = true
+	require.NoError(t, o.Validate())
+	proxy, err := NewOAuthProxy(o, func(string) bool { return true })
+	require.NoError(t, err)
+
+	// signIn saves a session from a device, returning its cookies
+	signIn := func(userAgent string) []*http.Cookie {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("User-Agent", userAgent)
+		rw := httptest.NewRecorder()
+		session := &sessionsapi.SessionState{Email: "jane@example.com", CreatedAt: time.Now()}
+		require.NoError(t, proxy.SaveSession(rw, req, session))
+		return rw.Result().Cookies()
+	}
+	laptop := signIn("Laptop/1.0")
+	phone := signIn("Phone/2.0")
+
+	request := func(method, target string, cookies []*http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req.Header.Set("Accept", "application/json")
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		rw := httptest.NewRecorder()
+		proxy.ServeHTTP(rw, req)
+		return rw
+	}
+	list := func(cookies []*http.Cookie) []*sessionsapi.UserSession {
+		rw := request("GET", "/oauth2/sessions", cookies)
+		require.Equal(t, http.StatusOK, rw.Code)
+		var sessions []*sessionsapi.UserSession
+		require.NoError(t, json.Unmarshal(rw.Body.Bytes(), &sessions))
+		return sessions
+	}
+
+	sessions := list(laptop)
+	require.Len(t, sessions, 2)
+	byAgent := map[string]*sessionsapi.UserSession{}
+	for _, s := range sessions {
+		byAgent[s.UserAgent] = s
+	}
+	require.Contains(t, byAgent, "Phone/2.0")
+	assert.True(t, byAgent["Laptop/1.0"].Current)
+	assert.False(t, byAgent["Phone/2.0"].Current)
+	assert.NotEmpty(t, byAgent["Phone/2.0"].IP)
+
+	// The page lists the sessions too
+	req := httptest.NewRequest("GET", "/oauth2/sessions", nil)
+	for _, c := range laptop {
+		req.AddCookie(c)
+	}
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Contains(t, rw.Body.String(), "Phone/2.0")
+
+	// Revoking the phone's session signs it out
+	assert.Equal(t, http.StatusNotFound, request("DELETE", "/oauth2/sessions?id=unknown", laptop).Code)
+	assert.Equal(t, http.StatusNoContent, request("DELETE", "/oauth2/sessions?id="+byAgent["Phone/2.0"].ID, laptop).Code)
+	assert.Equal(t, http.StatusUnauthorized, request("GET", "/oauth2/sessions", phone).Code)
+	require.Len(t, list(laptop), 1)
+
+	// Revoking the current session clears its cookie
+	rw = request("DELETE", "/oauth2/sessions?id="+byAgent["Laptop/1.0"].ID, laptop)
+	assert.Equal(t, http.StatusNoContent, rw.Code)
+	require.NotEmpty(t, rw.Result().Cookies())
+	assert.Equal(t, "", rw.Result().Cookies()[0].Value)
+	assert.Equal(t, http.StatusUnauthorized, request("GET", "/oauth2/sessions", laptop).Code)
+}
+
+func TestUserSessionsOptions(t *testing.T) {
+	o := testOptions()
+	o.UserSessionsPage = true
+	err := o.Validate()
+	assert.Equal(t, errorMsg([]string{
+		"user_sessions_page requires session_store_type redis, as only Redis keeps an index of users' sessions"}), err.Error())
+
+	// Without the page, the endpoint isn't served
+	o = testOptions()
+	require.NoError(t, o.Validate())
+	proxy, err := NewOAuthProxy(o, func(string) bool { return true })
+	require.NoError(t, err)
+	rw := httptest.NewRecorder()
+	proxy.ServeHTTP(rw, httptest.NewRequest("GET", "/oauth2/sessions", nil))
+	assert.Equal(t, http.StatusNotFound, rw.Code)
+}
@@ -0,0 +1,89 @@
+package oauth2proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+)
+
+// sessionStorePingTimeout bounds how long the session store connectivity
+// check may take before it is reported as a failure
+const sessionStorePingTimeout = 5 * time.Second
+
+// ConfigCheck is the outcome of a single check made by CheckConfiguration
+type ConfigCheck struct {
+	Name string
+	Err  error
+}
+
+// CheckConfiguration fully validates the options, including the checks that
+// would otherwise only fail once the proxy starts serving: provider discovery,
+// reachability and credentials, session store connectivity and readability
+// of the files referenced by the configuration.
+func CheckConfiguration(ctx context.Context, opts *Options) []ConfigCheck {
+	checks := []ConfigCheck{{Name: "configuration", Err: opts.Validate()}}
+	if checks[0].Err != nil {
+		// The remaining checks rely on the values set by Validate
+		return checks
+	}
+
+	if opts.TLSCertFile != "" || opts.TLSKeyFile != "" {
+		_, err := tls.LoadX509KeyPair(opts.TLSCertFile, opts.TLSKeyFile)
+		checks = append(checks, ConfigCheck{Name: "tls certificate", Err: err})
+	}
+	if opts.HtpasswdFile != "" {
+		checks = append(checks, ConfigCheck{Name: "htpasswd file", Err: checkReadable(opts.HtpasswdFile)})
+	}
+	if opts.AuthenticatedEmailsFile != "" {
+		checks = append(checks, ConfigCheck{Name: "authenticated emails file", Err: checkReadable(opts.AuthenticatedEmailsFile)})
+	}
+	if opts.CustomTemplatesDir != "" {
+		checks = append(checks, ConfigCheck{Name: "custom templates dir", Err: checkDir(opts.CustomTemplatesDir)})
+	}
+	if pinger, ok := opts.sessionStore.(sessionsapi.Pinger); ok {
+		pingCtx, cancel := context.WithTimeout(ctx, sessionStorePingTimeout)
+		err := pinger.Ping(pingCtx)
+		cancel()
+		checks = append(checks, ConfigCheck{Name: "session store", Err: err})
+	}
+	return append(checks, checkProvider(ctx, opts)...)
+}
+
+// WriteConfigReport writes a line per check to w and reports whether all of
+// the checks passed
+func WriteConfigReport(w io.Writer, checks []ConfigCheck) bool {
+	ok := true
+	for _, check := range checks {
+		if check.Err != nil {
+			ok = false
+			fmt.Fprintf(w, "[FAIL] %s: %v\n", check.Name, check.Err)
+			continue
+		}
+		fmt.Fprintf(w, "[ OK ] %s\n", check.Name)
+	}
+	return ok
+}
+
+func checkReadable(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func checkDir(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", path)
+	}
+	return nil
+}
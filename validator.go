@@ -1,9 +1,10 @@
-package main
+package oauth2proxy
 
 import (
 	"encoding/csv"
 	"fmt"
 	"os"
+	"regexp"
 	"strings"
 	"sync/atomic"
 	"unsafe"
@@ -11,6 +12,17 @@ import (
 	"github.com/oauth2-proxy/oauth2-proxy/pkg/logger"
 )
 
+// groupPrefix marks the entries of the authenticated emails file that allow
+// the members of a group, eg. group:admins
+const groupPrefix = "group:"
+
+// allowlist is the parsed authenticated emails file
+type allowlist struct {
+	emails   map[string]bool
+	patterns []*regexp.Regexp
+	groups   map[string]bool
+}
+
 // UserMap holds information from the authenticated emails file
 type UserMap struct {
 	usersFile string
@@ -20,8 +32,7 @@ type UserMap struct {
 // NewUserMap parses the authenticated emails file into a new UserMap
 func NewUserMap(usersFile string, done <-chan bool, onUpdate func()) *UserMap {
 	um := &UserMap{usersFile: usersFile}
-	m := make(map[string]bool)
-	atomic.StorePointer(&um.m, unsafe.Pointer(&m))
+	atomic.StorePointer(&um.m, unsafe.Pointer(&allowlist{}))
 	if usersFile != "" {
 		logger.Printf("using authenticated emails file %s", usersFile)
 		WatchForUpdates(usersFile, done, func() {
@@ -33,15 +44,37 @@ func NewUserMap(usersFile string, done <-chan bool, onUpdate func()) *UserMap {
 	return um
 }
 
-// IsValid checks if an email is allowed
-func (um *UserMap) IsValid(email string) (result bool) {
-	m := *(*map[string]bool)(atomic.LoadPointer(&um.m))
-	_, result = m[email]
-	return
+// IsValid checks if an email is allowed, by being listed or matching one of
+// the wildcard or regex entries
+func (um *UserMap) IsValid(email string) bool {
+	l := (*allowlist)(atomic.LoadPointer(&um.m))
+	if l.emails[email] {
+		return true
+	}
+	for _, pattern := range l.patterns {
+		if pattern.MatchString(email) {
+			return true
+		}
+	}
+	return false
+}
+
+// IsValidGroup checks if any of a user's groups is allowed
+func (um *UserMap) IsValidGroup(groups []string) bool {
+	l := (*allowlist)(atomic.LoadPointer(&um.m))
+	for _, group := range groups {
+		if l.groups[group] {
+			return true
+		}
+	}
+	return false
 }
 
 // LoadAuthenticatedEmailsFile loads the authenticated emails file from disk
-// and parses the contents as CSV
+// and parses the contents as CSV. The first field of each record is an
+// email address, a wildcard such as *@example.com, a regex between slashes
+// such as /^ops-[0-9]+@example\.com$/, or a group reference such as
+// group:admins.
 func (um *UserMap) LoadAuthenticatedEmailsFile() {
 	r, err := os.Open(um.usersFile)
 	if err != nil {
@@ -57,18 +90,44 @@ func (um *UserMap) LoadAuthenticatedEmailsFile() {
 		logger.Printf("error reading authenticated-emails-file=%q, %s", um.usersFile, err)
 		return
 	}
-	updated := make(map[string]bool)
+	updated := &allowlist{emails: map[string]bool{}, groups: map[string]bool{}}
 	for _, r := range records {
-		address := strings.ToLower(strings.TrimSpace(r[0]))
-		updated[address] = true
+		entry := strings.TrimSpace(r[0])
+		switch {
+		case strings.HasPrefix(entry, groupPrefix):
+			updated.groups[strings.TrimPrefix(entry, groupPrefix)] = true
+		case len(entry) > 2 && strings.HasPrefix(entry, "/") && strings.HasSuffix(entry, "/"):
+			pattern, err := regexp.Compile("(?i)" + entry[1:len(entry)-1])
+			if err != nil {
+				logger.Printf("error compiling authenticated-emails-file=%q entry %q, skipping it: %s", um.usersFile, entry, err)
+				continue
+			}
+			updated.patterns = append(updated.patterns, pattern)
+		case strings.Contains(entry, "*"):
+			updated.patterns = append(updated.patterns, wildcardPattern(strings.ToLower(entry)))
+		default:
+			updated.emails[strings.ToLower(entry)] = true
+		}
 	}
-	atomic.StorePointer(&um.m, unsafe.Pointer(&updated))
+	atomic.StorePointer(&um.m, unsafe.Pointer(updated))
+}
+
+// wildcardPattern compiles a wildcard entry, in which * matches any
+// characters, eg. *@example.com
+func wildcardPattern(entry string) *regexp.Regexp {
+	parts := strings.Split(entry, "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	return regexp.MustCompile("^" + strings.Join(parts, ".*") + "$")
 }
 
 func newValidatorImpl(domains []string, usersFile string,
 	done <-chan bool, onUpdate func()) func(string) bool {
-	validUsers := NewUserMap(usersFile, done, onUpdate)
+	return newEmailValidator(domains, NewUserMap(usersFile, done, onUpdate))
+}
 
+func newEmailValidator(domains []string, validUsers *UserMap) func(string) bool {
 	var allowAll bool
 	for i, domain := range domains {
 		if domain == "*" {
@@ -97,7 +156,26 @@ func newValidatorImpl(domains []string, usersFile string,
 	return validator
 }
 
+// allowsAnyEmail checks whether the email domains include "*", allowing
+// every email address
+func allowsAnyEmail(domains []string) bool {
+	for _, domain := range domains {
+		if domain == "*" {
+			return true
+		}
+	}
+	return false
+}
+
 // NewValidator constructs a function to validate email addresses
 func NewValidator(domains []string, usersFile string) func(string) bool {
 	return newValidatorImpl(domains, usersFile, nil, func() {})
 }
+
+// NewValidators constructs the functions validating the email addresses and
+// the groups of users against the email domains and authenticated emails
+// file, which is only loaded and watched once
+func NewValidators(domains []string, usersFile string) (func(string) bool, func([]string) bool) {
+	validUsers := NewUserMap(usersFile, nil, func() {})
+	return newEmailValidator(domains, validUsers), validUsers.IsValidGroup
+}
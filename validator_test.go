@@ -1,10 +1,12 @@
-package main
+package oauth2proxy
 
 import (
 	"io/ioutil"
 	"os"
 	"strings"
 	"testing"
+
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
 )
 
 type ValidatorTest struct {
@@ -209,3 +211,81 @@ func TestValidatorOverwriteEmailListDirectly(t *testing.T) {
 		t.Error("email added to list should validate")
 	}
 }
+
+func TestValidatorWildcardsAndRegexes(t *testing.T) {
+	vt := NewValidatorTest(t)
+	defer vt.TearDown()
+
+	vt.WriteEmails(t, []string{
+		"*@Example.com",
+		"ops-*@corp.example.com",
+		`/^contractor\.[a-z]+@partner\.com$/`,
+		"/(unclosed/",
+	})
+	domains := []string(nil)
+	validator := vt.NewValidator(domains, nil)
+
+	if !validator("anyone@example.com") {
+		t.Error("email matching a wildcard should validate")
+	}
+	if validator("anyone@sub.example.com.evil.com") {
+		t.Error("wildcards should match the whole email")
+	}
+	if !validator("ops-jane@corp.example.com") {
+		t.Error("email matching a wildcard in the local part should validate")
+	}
+	if validator("dev-jane@corp.example.com") {
+		t.Error("email not matching a wildcard should not validate")
+	}
+	if !validator("Contractor.Bob@Partner.com") {
+		t.Error("email matching a regex should validate, ignoring case")
+	}
+	if validator("contractor.bob@partner.com.evil.com") {
+		t.Error("email not matching a regex should not validate")
+	}
+}
+
+func TestValidatorGroups(t *testing.T) {
+	vt := NewValidatorTest(t)
+	defer vt.TearDown()
+
+	vt.WriteEmails(t, []string{
+		"jane@example.com",
+		"group:admins",
+	})
+	um := NewUserMap(vt.authEmailFileName, vt.done, func() {})
+
+	if !um.IsValidGroup([]string{"users", "admins"}) {
+		t.Error("member of a listed group should validate")
+	}
+	if um.IsValidGroup([]string{"users"}) || um.IsValidGroup(nil) {
+		t.Error("user in no listed group should not validate")
+	}
+	if um.IsValid("group:admins") {
+		t.Error("group references should not validate as emails")
+	}
+	if !um.IsValid("jane@example.com") {
+		t.Error("email should validate")
+	}
+}
+
+func TestIsAllowedUser(t *testing.T) {
+	p := &OAuthProxy{Validator: func(email string) bool { return email == "jane@example.com" }}
+	jane := &sessionsapi.SessionState{Email: "jane@example.com"}
+	admin := &sessionsapi.SessionState{Email: "bob@example.com", Groups: []string{"admins"}}
+
+	if !p.isAllowedUser(jane) || p.isAllowedUser(admin) {
+		t.Error("users should be allowed by email only without a group validator")
+	}
+	p.GroupValidator = func(groups []string) bool {
+		for _, g := range groups {
+			if g == "admins" {
+				return true
+			}
+		}
+		return false
+	}
+	if !p.isAllowedUser(jane) || !p.isAllowedUser(admin) {
+		t.Error("users should be allowed by email or group")
+	}
+}
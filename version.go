@@ -1,4 +1,4 @@
-package main
+package oauth2proxy
 
 // VERSION contains version information
 var VERSION = "undefined"
@@ -1,6 +1,6 @@
 // +build !go1.3 plan9 solaris
 
-package main
+package oauth2proxy
 
 import "github.com/oauth2-proxy/oauth2-proxy/pkg/logger"
 
@@ -0,0 +1,392 @@
+package oauth2proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/encryption"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/logger"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/webauthn"
+)
+
+// webAuthnChallengeTTL is how long users have to complete a WebAuthn
+// registration or verification
+const webAuthnChallengeTTL = 5 * time.Minute
+
+// webAuthnReauthAge is how recently users must have signed in with the
+// provider to register their first credential
+const webAuthnReauthAge = 10 * time.Minute
+
+// maxWebAuthnRequestSize limits the size of the WebAuthn responses posted to
+// the proxy
+const maxWebAuthnRequestSize = 64 * 1024
+
+// webAuthnChallenge is kept in a signed cookie between the begin and finish
+// requests of a registration or verification
+type webAuthnChallenge struct {
+	User      string `json:"user"`
+	Challenge string `json:"challenge"`
+	Register  bool   `json:"register"`
+}
+
+// webAuthnOptions is the response to a begin request: the options to pass to
+// navigator.credentials.create() when Register is set, otherwise to
+// navigator.credentials.get(), with binary fields base64url encoded
+type webAuthnOptions struct {
+	Register  bool                   `json:"register"`
+	PublicKey map[string]interface{} `json:"publicKey"`
+}
+
+// webAuthnUser returns the user whose credentials verify the session.
+// Impersonated sessions are verified by the administrator's credentials.
+func webAuthnUser(session *sessionsapi.SessionState) string {
+	switch {
+	case session.IsImpersonated():
+		return session.Impersonator
+	case session.Email != "":
+		return session.Email
+	default:
+		return session.User
+	}
+}
+
+// requiresWebAuthn checks whether the session must be verified with a
+// WebAuthn credential before it can be used for the request
+func (p *OAuthProxy) requiresWebAuthn(req *http.Request, session *sessionsapi.SessionState) bool {
+	if p.webAuthn == nil || session.WebAuthnVerified {
+		return false
+	}
+	path := req.URL.Path
+	if path == p.AuthOnlyPath && req.Header.Get("X-Forwarded-Uri") != "" {
+		path = req.Header.Get("X-Forwarded-Uri")
+	}
+	if path == p.WebAuthnPath || strings.HasPrefix(path, p.WebAuthnPath+"/") {
+		return false
+	}
+	return p.requiresWebAuthnPath(path)
+}
+
+// requiresWebAuthnPath checks whether the step-up policy covers the path.
+// The proxy's own endpoints are always covered so that unverified sessions
+// can't be used to issue machine tokens or to impersonate users.
+func (p *OAuthProxy) requiresWebAuthnPath(path string) bool {
+	if len(p.webAuthnRoutes) == 0 || strings.HasPrefix(path, p.ProxyPrefix+"/") {
+		return true
+	}
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path = path[:i]
+	}
+	for _, route := range p.webAuthnRoutes {
+		if route.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// webAuthnRedirect sends users who have just signed in to verify their
+// session first when the page they are returning to requires it
+func (p *OAuthProxy) webAuthnRedirect(redirect string) string {
+	if p.webAuthn == nil {
+		return redirect
+	}
+	u, err := url.Parse(redirect)
+	if err != nil || !p.requiresWebAuthnPath(u.Path) {
+		return redirect
+	}
+	return p.WebAuthnPath + "?rd=" + url.QueryEscape(redirect)
+}
+
+// WebAuthn serves the page on which users verify their session with a
+// passkey, or register one if they have none, and the endpoints it calls to
+// begin and finish the ceremony
+func (p *OAuthProxy) WebAuthn(rw http.ResponseWriter, req *http.Request) {
+	if p.webAuthn == nil || p.webAuthnCredentials == nil {
+		http.NotFound(rw, req)
+		return
+	}
+
+	session, err := p.getAuthenticatedSession(rw, req)
+	if errors.Is(err, sessionsapi.ErrBackendUnavailable) {
+		http.Error(rw, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	} else if err != nil {
+		if req.URL.Path == p.WebAuthnPath && !isAjax(req) {
+			p.SignInPage(rw, req, http.StatusForbidden)
+			return
+		}
+		http.Error(rw, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	user := webAuthnUser(session)
+	if user == "" {
+		http.Error(rw, "passkeys can only be used by users signed in with a username or email", http.StatusForbidden)
+		return
+	}
+
+	switch path := req.URL.Path; {
+	case path == p.WebAuthnPath && req.Method == http.MethodGet:
+		p.webAuthnPage(rw, req, session, user)
+	case path == p.WebAuthnPath+"/begin" && req.Method == http.MethodPost:
+		p.beginWebAuthn(rw, req, session, user)
+	case path == p.WebAuthnPath+"/finish" && req.Method == http.MethodPost:
+		p.finishWebAuthn(rw, req, session, user)
+	case path == p.WebAuthnPath || path == p.WebAuthnPath+"/begin" || path == p.WebAuthnPath+"/finish":
+		http.Error(rw, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	default:
+		http.NotFound(rw, req)
+	}
+}
+
+// canRegisterWebAuthn checks whether the user may register a new credential.
+// The first credential can be registered by users who have just signed in
+// with the provider, so that a stolen session can't be used to register the
+// thief's passkey, and further ones only from a session verified with an
+// existing credential.
+func (p *OAuthProxy) canRegisterWebAuthn(req *http.Request, session *sessionsapi.SessionState, credentials []*sessionsapi.WebAuthnCredential) bool {
+	if len(credentials) == 0 {
+		return p.recentlySignedIn(session)
+	}
+	return session.WebAuthnVerified && req.URL.Query().Get("register") == "true"
+}
+
+// recentlySignedIn checks whether the user authenticated with the provider
+// for the session within the last webAuthnReauthAge
+func (p *OAuthProxy) recentlySignedIn(session *sessionsapi.SessionState) bool {
+	return !session.SignedInAt.IsZero() && p.now().Sub(session.SignedInAt) <= webAuthnReauthAge
+}
+
+// reauthLoginURL asks the provider to authenticate the user again, rather
+// than reuse their session with it, when the sign in was started to
+// re-authenticate them before they register their first passkey
+func reauthLoginURL(loginURL string, req *http.Request) string {
+	if req.Form.Get("reauth") != "true" {
+		return loginURL
+	}
+	u, err := url.Parse(loginURL)
+	if err != nil {
+		return loginURL
+	}
+	params := u.Query()
+	params.Set("max_age", "0")
+	u.RawQuery = params.Encode()
+	return u.String()
+}
+
+func (p *OAuthProxy) webAuthnPage(rw http.ResponseWriter, req *http.Request, session *sessionsapi.SessionState, user string) {
+	redirect, err := p.GetRedirect(req)
+	if err != nil {
+		logger.Printf("Error obtaining redirect: %s", err.Error())
+		p.ErrorPage(rw, http.StatusInternalServerError, "Internal Error", err.Error())
+		return
+	}
+	credentials, err := p.webAuthnCredentials.LoadWebAuthnCredentials(req.Context(), user)
+	if err != nil {
+		logger.Printf("Error loading passkeys for %s: %v", user, err)
+		p.ErrorPage(rw, http.StatusServiceUnavailable, "Service Unavailable", "Service Unavailable")
+		return
+	}
+	if len(credentials) == 0 && !p.recentlySignedIn(session) {
+		// sign in again, coming back here to register the passkey
+		query := url.Values{"rd": {p.WebAuthnPath + "?rd=" + url.QueryEscape(redirect)}, "reauth": {"true"}}
+		http.Redirect(rw, req, p.OAuthStartPath+"?"+query.Encode(), http.StatusFound)
+		return
+	}
+	register := p.canRegisterWebAuthn(req, session, credentials)
+	if session.WebAuthnVerified && !register {
+		http.Redirect(rw, req, redirect, http.StatusFound)
+		return
+	}
+
+	query := url.Values{"rd": {redirect}}
+	if register && len(credentials) > 0 {
+		query.Set("register", "true")
+	}
+	t := struct {
+		Register   bool
+		User       string
+		BeginPath  string
+		FinishPath string
+	}{
+		Register:   register,
+		User:       user,
+		BeginPath:  p.WebAuthnPath + "/begin?" + query.Encode(),
+		FinishPath: p.WebAuthnPath + "/finish?" + query.Encode(),
+	}
+	if err := p.templates.ExecuteTemplate(rw, "webauthn.html", t); err != nil {
+		logger.Printf("Error rendering webauthn template: %v", err)
+	}
+}
+
+func (p *OAuthProxy) beginWebAuthn(rw http.ResponseWriter, req *http.Request, session *sessionsapi.SessionState, user string) {
+	credentials, err := p.webAuthnCredentials.LoadWebAuthnCredentials(req.Context(), user)
+	if err != nil {
+		logger.Printf("Error loading passkeys for %s: %v", user, err)
+		http.Error(rw, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		logger.Printf("Error creating webauthn challenge: %v", err)
+		http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	state := webAuthnChallenge{
+		User:      user,
+		Challenge: challenge,
+		Register:  p.canRegisterWebAuthn(req, session, credentials),
+	}
+	value, err := json.Marshal(state)
+	if err != nil {
+		logger.Printf("Error encoding webauthn challenge: %v", err)
+		http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	now := p.now()
+	name := p.webAuthnCookieName()
+	http.SetCookie(rw, p.makeCookie(req, name, encryption.SignedValue(p.CookieSeed, name, string(value), now), webAuthnChallengeTTL, now))
+
+	descriptors := make([]map[string]string, 0, len(credentials))
+	for _, credential := range credentials {
+		descriptors = append(descriptors, map[string]string{
+			"type": "public-key",
+			"id":   base64.RawURLEncoding.EncodeToString(credential.ID),
+		})
+	}
+	options := webAuthnOptions{Register: state.Register}
+	if state.Register {
+		userID := sha256.Sum256([]byte(user))
+		options.PublicKey = map[string]interface{}{
+			"challenge": challenge,
+			"rp":        map[string]string{"id": p.webAuthn.ID, "name": p.webAuthn.ID},
+			"user": map[string]string{
+				"id":          base64.RawURLEncoding.EncodeToString(userID[:]),
+				"name":        user,
+				"displayName": user,
+			},
+			"pubKeyCredParams": []map[string]interface{}{
+				{"type": "public-key", "alg": webauthn.AlgorithmES256},
+				{"type": "public-key", "alg": webauthn.AlgorithmRS256},
+			},
+			"excludeCredentials": descriptors,
+			"attestation":        "none",
+			"timeout":            webAuthnChallengeTTL.Milliseconds(),
+		}
+	} else {
+		options.PublicKey = map[string]interface{}{
+			"challenge":        challenge,
+			"rpId":             p.webAuthn.ID,
+			"allowCredentials": descriptors,
+			"userVerification": "preferred",
+			"timeout":          webAuthnChallengeTTL.Milliseconds(),
+		}
+	}
+	writeJSON(rw, http.StatusOK, options)
+}
+
+func (p *OAuthProxy) finishWebAuthn(rw http.ResponseWriter, req *http.Request, session *sessionsapi.SessionState, user string) {
+	name := p.webAuthnCookieName()
+	cookie, err := req.Cookie(name)
+	if err != nil {
+		http.Error(rw, "no passkey challenge: start again", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(rw, p.makeCookie(req, name, "", time.Hour*-1, p.now()))
+	value, _, ok := encryption.ValidateAt(cookie, p.CookieSeed, webAuthnChallengeTTL, p.now())
+	var state webAuthnChallenge
+	if !ok || json.Unmarshal([]byte(value), &state) != nil || state.User != user {
+		http.Error(rw, "invalid or expired passkey challenge: start again", http.StatusBadRequest)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(rw, req.Body, maxWebAuthnRequestSize))
+	if err != nil {
+		http.Error(rw, "invalid request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	credentials, err := p.webAuthnCredentials.LoadWebAuthnCredentials(req.Context(), user)
+	if err != nil {
+		logger.Printf("Error loading passkeys for %s: %v", user, err)
+		http.Error(rw, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+
+	if state.Register {
+		credentials, err = p.registerWebAuthn(body, state.Challenge, credentials)
+	} else {
+		err = p.verifyWebAuthn(body, state.Challenge, credentials)
+	}
+	if err != nil {
+		logger.PrintAuthf(user, req, logger.AuthFailure, "Invalid passkey: %v", err)
+		http.Error(rw, "invalid passkey", http.StatusForbidden)
+		return
+	}
+
+	// The credentials are saved after a verification too, to keep the
+	// signature counter used to detect cloned authenticators
+	if err := p.webAuthnCredentials.SaveWebAuthnCredentials(req.Context(), user, credentials); err != nil {
+		logger.PrintAuthf(user, req, logger.AuthError, "Error saving passkeys: %v", err)
+		http.Error(rw, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+		return
+	}
+	session.WebAuthnVerified = true
+	if err := p.SaveSession(rw, req, session); err != nil {
+		logger.PrintAuthf(user, req, logger.AuthError, "Save session error %s", err)
+		http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	if state.Register {
+		logger.PrintAuthf(user, req, logger.AuthSuccess, "Registered passkey")
+	} else {
+		logger.PrintAuthf(user, req, logger.AuthSuccess, "Verified session with passkey")
+	}
+
+	redirect, err := p.GetRedirect(req)
+	if err != nil {
+		redirect = "/"
+	}
+	writeJSON(rw, http.StatusOK, map[string]string{"redirect": redirect})
+}
+
+// registerWebAuthn verifies a new credential, returning the user's
+// credentials with it added
+func (p *OAuthProxy) registerWebAuthn(body []byte, challenge string, credentials []*sessionsapi.WebAuthnCredential) ([]*sessionsapi.WebAuthnCredential, error) {
+	var registration webauthn.Registration
+	if err := json.Unmarshal(body, &registration); err != nil {
+		return nil, err
+	}
+	credential, err := p.webAuthn.VerifyRegistration(&registration, challenge)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range credentials {
+		if bytes.Equal(c.ID, credential.ID) {
+			return nil, errors.New("credential is already registered")
+		}
+	}
+	return append(credentials, credential), nil
+}
+
+// verifyWebAuthn checks the assertion was made by one of the credentials,
+// updating its signature counter
+func (p *OAuthProxy) verifyWebAuthn(body []byte, challenge string, credentials []*sessionsapi.WebAuthnCredential) error {
+	var assertion webauthn.Assertion
+	if err := json.Unmarshal(body, &assertion); err != nil {
+		return err
+	}
+	_, err := p.webAuthn.VerifyAssertion(&assertion, challenge, credentials)
+	return err
+}
+
+func (p *OAuthProxy) webAuthnCookieName() string {
+	return p.CookieName + "_webauthn"
+}
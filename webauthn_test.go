@@ -0,0 +1,216 @@
+package oauth2proxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/webauthn"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeWebAuthnCredentialStore keeps WebAuthn credentials in memory
+type fakeWebAuthnCredentialStore struct {
+	mu          sync.Mutex
+	credentials map[string][]*sessionsapi.WebAuthnCredential
+}
+
+func (s *fakeWebAuthnCredentialStore) LoadWebAuthnCredentials(_ context.Context, user string) ([]*sessionsapi.WebAuthnCredential, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*sessionsapi.WebAuthnCredential{}, s.credentials[user]...), nil
+}
+
+func (s *fakeWebAuthnCredentialStore) SaveWebAuthnCredentials(_ context.Context, user string, credentials []*sessionsapi.WebAuthnCredential) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.credentials[user] = credentials
+	return nil
+}
+
+func newWebAuthnTest(t *testing.T, session *sessionsapi.SessionState) (*ProcessCookieTest, *fakeWebAuthnCredentialStore, *http.Cookie) {
+	pcTest := NewProcessCookieTestWithDefaults()
+	store := &fakeWebAuthnCredentialStore{credentials: map[string][]*sessionsapi.WebAuthnCredential{}}
+	pcTest.proxy.webAuthn = &webauthn.RelyingParty{ID: "example.com", Origins: []string{"https://example.com"}}
+	pcTest.proxy.webAuthnCredentials = store
+	require.NoError(t, pcTest.SaveSession(session))
+	cookie, err := pcTest.req.Cookie(pcTest.opts.Cookie.Name)
+	require.NoError(t, err)
+	return pcTest, store, cookie
+}
+
+func TestWebAuthnRequired(t *testing.T) {
+	pcTest, _, cookie := newWebAuthnTest(t, &sessionsapi.SessionState{Email: "jane@example.com", CreatedAt: time.Now(), SignedInAt: time.Now()})
+
+	req := httptest.NewRequest("GET", "/private?a=b", nil)
+	req.AddCookie(cookie)
+	rw := httptest.NewRecorder()
+	pcTest.proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusFound, rw.Code)
+	assert.Equal(t, "/oauth2/webauthn?rd=%2Fprivate%3Fa%3Db", rw.Header().Get("Location"))
+
+	req = httptest.NewRequest("GET", "/private", nil)
+	req.AddCookie(cookie)
+	req.Header.Set("Accept", "application/json")
+	rw = httptest.NewRecorder()
+	pcTest.proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusUnauthorized, rw.Code)
+
+	// The proxy's endpoints can't be used by unverified sessions either
+	req = httptest.NewRequest("GET", pcTest.opts.ProxyPrefix+"/userinfo", nil)
+	req.AddCookie(cookie)
+	rw = httptest.NewRecorder()
+	pcTest.proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusUnauthorized, rw.Code)
+
+	req = httptest.NewRequest("GET", pcTest.opts.ProxyPrefix+"/webauthn?rd=/private", nil)
+	req.AddCookie(cookie)
+	rw = httptest.NewRecorder()
+	pcTest.proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusOK, rw.Code)
+	assert.Contains(t, rw.Body.String(), "Register a passkey")
+}
+
+func TestWebAuthnRoutes(t *testing.T) {
+	pcTest, _, cookie := newWebAuthnTest(t, &sessionsapi.SessionState{Email: "jane@example.com", CreatedAt: time.Now(), SignedInAt: time.Now()})
+	pcTest.proxy.webAuthnRoutes = []*regexp.Regexp{regexp.MustCompile("^/admin/")}
+
+	tests := map[string]int{
+		"/":             http.StatusAccepted,
+		"/admin/users":  http.StatusUnauthorized,
+		"/oauth2/start": http.StatusUnauthorized,
+	}
+	for uri, code := range tests {
+		req := httptest.NewRequest("GET", pcTest.opts.ProxyPrefix+"/auth", nil)
+		req.AddCookie(cookie)
+		req.Header.Set("X-Forwarded-Uri", uri)
+		rw := httptest.NewRecorder()
+		pcTest.proxy.ServeHTTP(rw, req)
+		assert.Equal(t, code, rw.Code, uri)
+	}
+
+	assert.Equal(t, "/", pcTest.proxy.webAuthnRedirect("/"))
+	assert.Equal(t, "/oauth2/webauthn?rd=%2Fadmin%2Fusers", pcTest.proxy.webAuthnRedirect("/admin/users"))
+}
+
+func TestWebAuthnVerifiedSession(t *testing.T) {
+	pcTest, _, cookie := newWebAuthnTest(t, &sessionsapi.SessionState{Email: "jane@example.com", WebAuthnVerified: true, CreatedAt: time.Now(), SignedInAt: time.Now()})
+
+	req := httptest.NewRequest("GET", pcTest.opts.ProxyPrefix+"/auth", nil)
+	req.AddCookie(cookie)
+	rw := httptest.NewRecorder()
+	pcTest.proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusAccepted, rw.Code)
+}
+
+func beginTestWebAuthn(t *testing.T, pcTest *ProcessCookieTest, cookie *http.Cookie, query string) (*webAuthnOptions, *http.Cookie) {
+	req := httptest.NewRequest("POST", pcTest.opts.ProxyPrefix+"/webauthn/begin"+query, nil)
+	req.AddCookie(cookie)
+	rw := httptest.NewRecorder()
+	pcTest.proxy.ServeHTTP(rw, req)
+	require.Equal(t, http.StatusOK, rw.Code, rw.Body.String())
+
+	var options webAuthnOptions
+	require.NoError(t, json.Unmarshal(rw.Body.Bytes(), &options))
+	var challenge *http.Cookie
+	for _, c := range rw.Result().Cookies() {
+		if c.Name == pcTest.proxy.webAuthnCookieName() {
+			challenge = c
+		}
+	}
+	require.NotNil(t, challenge)
+	return &options, challenge
+}
+
+func TestWebAuthnBegin(t *testing.T) {
+	session := &sessionsapi.SessionState{Email: "jane@example.com", CreatedAt: time.Now(), SignedInAt: time.Now()}
+	pcTest, store, cookie := newWebAuthnTest(t, session)
+
+	options, _ := beginTestWebAuthn(t, pcTest, cookie, "")
+	assert.True(t, options.Register)
+	assert.Equal(t, "jane@example.com", options.PublicKey["user"].(map[string]interface{})["name"])
+
+	// Once a passkey is registered, it must be used: another can't be added
+	// without verifying the session first
+	store.credentials["jane@example.com"] = []*sessionsapi.WebAuthnCredential{{ID: []byte("credential-1")}}
+	options, _ = beginTestWebAuthn(t, pcTest, cookie, "?register=true")
+	assert.False(t, options.Register)
+	assert.Equal(t, "example.com", options.PublicKey["rpId"])
+	assert.Len(t, options.PublicKey["allowCredentials"], 1)
+
+	session.WebAuthnVerified = true
+	rw := httptest.NewRecorder()
+	require.NoError(t, pcTest.proxy.SaveSession(rw, pcTest.req, session))
+	cookie = rw.Result().Cookies()[0]
+	options, _ = beginTestWebAuthn(t, pcTest, cookie, "?register=true")
+	assert.True(t, options.Register)
+	assert.Len(t, options.PublicKey["excludeCredentials"], 1)
+}
+
+func TestWebAuthnFinish(t *testing.T) {
+	pcTest, store, cookie := newWebAuthnTest(t, &sessionsapi.SessionState{Email: "jane@example.com", CreatedAt: time.Now(), SignedInAt: time.Now()})
+	_, challenge := beginTestWebAuthn(t, pcTest, cookie, "")
+
+	finish := func(body string, cookies ...*http.Cookie) int {
+		req := httptest.NewRequest("POST", pcTest.opts.ProxyPrefix+"/webauthn/finish", strings.NewReader(body))
+		for _, c := range cookies {
+			req.AddCookie(c)
+		}
+		rw := httptest.NewRecorder()
+		pcTest.proxy.ServeHTTP(rw, req)
+		return rw.Code
+	}
+
+	assert.Equal(t, http.StatusBadRequest, finish(`{}`, cookie))
+	assert.Equal(t, http.StatusForbidden, finish(`{"clientDataJSON": "e30", "attestationObject": "oA"}`, cookie, challenge))
+	assert.Empty(t, store.credentials["jane@example.com"])
+
+	// A challenge issued to another user can't be used
+	other, _, otherCookie := newWebAuthnTest(t, &sessionsapi.SessionState{Email: "john@example.com", CreatedAt: time.Now(), SignedInAt: time.Now()})
+	_, otherChallenge := beginTestWebAuthn(t, other, otherCookie, "")
+	assert.Equal(t, http.StatusBadRequest, finish(`{}`, cookie, otherChallenge))
+}
+
+func TestWebAuthnReauth(t *testing.T) {
+	pcTest, _, cookie := newWebAuthnTest(t, &sessionsapi.SessionState{Email: "jane@example.com", CreatedAt: time.Now(), SignedInAt: time.Now().Add(-time.Hour)})
+
+	// A passkey can't be registered from a session signed in long ago
+	options, _ := beginTestWebAuthn(t, pcTest, cookie, "")
+	assert.False(t, options.Register)
+
+	req := httptest.NewRequest("GET", pcTest.opts.ProxyPrefix+"/webauthn?rd=/private", nil)
+	req.AddCookie(cookie)
+	rw := httptest.NewRecorder()
+	pcTest.proxy.ServeHTTP(rw, req)
+	assert.Equal(t, http.StatusFound, rw.Code)
+	start, err := url.Parse(rw.Header().Get("Location"))
+	require.NoError(t, err)
+	assert.Equal(t, pcTest.opts.ProxyPrefix+"/start", start.Path)
+	assert.Equal(t, "true", start.Query().Get("reauth"))
+	assert.Equal(t, pcTest.opts.ProxyPrefix+"/webauthn?rd=%2Fprivate", start.Query().Get("rd"))
+
+}
+
+func TestReauthLoginURL(t *testing.T) {
+	loginURL := "https://idp.example.com/authorize?client_id=proxy"
+
+	req := httptest.NewRequest("GET", "/oauth2/start", nil)
+	require.NoError(t, req.ParseForm())
+	assert.Equal(t, loginURL, reauthLoginURL(loginURL, req))
+
+	req = httptest.NewRequest("GET", "/oauth2/start?reauth=true", nil)
+	require.NoError(t, req.ParseForm())
+	u, err := url.Parse(reauthLoginURL(loginURL, req))
+	require.NoError(t, err)
+	assert.Equal(t, "0", u.Query().Get("max_age"))
+	assert.Equal(t, "proxy", u.Query().Get("client_id"))
+}
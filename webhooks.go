@@ -0,0 +1,202 @@
+package oauth2proxy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	sessionsapi "github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/logger"
+)
+
+// The authentication events webhooks can be sent for
+const (
+	webhookSignIn         = "sign_in"
+	webhookSignOut        = "sign_out"
+	webhookRefreshFailure = "refresh_failure"
+)
+
+const (
+	// webhookQueueSize is the number of events that can wait to be sent
+	// before further events are dropped
+	webhookQueueSize = 1000
+
+	// webhookWorkers is the number of events sent at once
+	webhookWorkers = 4
+
+	// webhookTimeout bounds each attempt to send an event
+	webhookTimeout = 10 * time.Second
+)
+
+var webhookEvents = []string{webhookSignIn, webhookSignOut, webhookRefreshFailure}
+
+// webhookEvent is the JSON body of a webhook
+type webhookEvent struct {
+	Event    string    `json:"event"`
+	Time     time.Time `json:"time"`
+	User     string    `json:"user,omitempty"`
+	Email    string    `json:"email,omitempty"`
+	ClientIP string    `json:"client_ip,omitempty"`
+	Provider string    `json:"provider,omitempty"`
+	// Error is the reason a refresh failed
+	Error string `json:"error,omitempty"`
+}
+
+// webhookNotifier sends authentication events to the configured URLs in the
+// background, signing each with an HMAC of the secret and retrying failures
+type webhookNotifier struct {
+	urls       []string
+	secret     []byte
+	events     map[string]bool
+	maxRetries int
+	// backoff is the wait before the first retry, doubling for each one
+	backoff time.Duration
+	client  *http.Client
+	queue   chan *webhookEvent
+}
+
+// newWebhookNotifier returns a notifier for the events, which must be known,
+// sending them to the URLs
+func newWebhookNotifier(urls []string, secret string, events []string, maxRetries int) (*webhookNotifier, error) {
+	for _, u := range urls {
+		parsed, err := url.Parse(u)
+		if err != nil || (parsed.Scheme != httpScheme && parsed.Scheme != httpsScheme) || parsed.Host == "" {
+			return nil, fmt.Errorf("webhook_url (%s) must be an http or https URL", u)
+		}
+	}
+	w := &webhookNotifier{
+		urls:       urls,
+		secret:     []byte(secret),
+		events:     map[string]bool{},
+		maxRetries: maxRetries,
+		backoff:    time.Second,
+		client:     &http.Client{Timeout: webhookTimeout},
+		queue:      make(chan *webhookEvent, webhookQueueSize),
+	}
+	for _, event := range events {
+		known := false
+		for _, e := range webhookEvents {
+			known = known || e == event
+		}
+		if !known {
+			return nil, fmt.Errorf("webhook_event (%s) must be one of sign_in, sign_out or refresh_failure", event)
+		}
+		w.events[event] = true
+	}
+	return w, nil
+}
+
+// start starts the workers sending queued events
+func (w *webhookNotifier) start() {
+	for i := 0; i < webhookWorkers; i++ {
+		go func() {
+			for event := range w.queue {
+				w.send(event)
+			}
+		}()
+	}
+}
+
+// wants checks whether webhooks are sent for the event
+func (w *webhookNotifier) wants(event string) bool {
+	return w != nil && w.events[event]
+}
+
+// notifyWebhook sends a webhook for the event if webhooks are sent for it
+func (p *OAuthProxy) notifyWebhook(event string, req *http.Request, session *sessionsapi.SessionState, provider string, cause error) {
+	if !p.webhooks.wants(event) {
+		return
+	}
+	p.webhooks.notify(event, req, p.clientString(req), session, provider, cause)
+}
+
+// notify queues the event for the session's user to be sent, dropping it if
+// the queue is full rather than holding up the request
+func (w *webhookNotifier) notify(event string, req *http.Request, clientIP string, session *sessionsapi.SessionState, provider string, cause error) {
+	e := &webhookEvent{
+		Event:    event,
+		Time:     time.Now().UTC(),
+		ClientIP: clientIP,
+		Provider: provider,
+	}
+	if session != nil {
+		e.User = session.User
+		e.Email = session.Email
+	}
+	if cause != nil {
+		e.Error = cause.Error()
+	}
+	select {
+	case w.queue <- e:
+	default:
+		logger.PrintAuthf(e.Email, req, logger.AuthError, "Webhook queue full: dropped %s event", event)
+	}
+}
+
+// send sends the event to each URL, retrying failures
+func (w *webhookNotifier) send(event *webhookEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		logger.Printf("Error encoding %s webhook: %v", event.Event, err)
+		return
+	}
+	for _, u := range w.urls {
+		backoff := w.backoff
+		for attempt := 0; ; attempt++ {
+			retry, err := w.post(u, event.Event, body)
+			if err == nil {
+				break
+			}
+			if !retry || attempt >= w.maxRetries {
+				logger.Printf("Error sending %s webhook to %s: %v", event.Event, u, err)
+				break
+			}
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+}
+
+// post makes a single attempt to send the body, reporting whether a failure
+// is worth retrying
+func (w *webhookNotifier) post(u string, event string, body []byte) (bool, error) {
+	req, err := http.NewRequest("POST", u, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", applicationJSON)
+	req.Header.Set("X-OAuth2-Proxy-Event", event)
+	req.Header.Set("X-OAuth2-Proxy-Timestamp", timestamp)
+	req.Header.Set("X-OAuth2-Proxy-Signature", "sha256="+webhookSignature(w.secret, timestamp, body))
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("got %d", resp.StatusCode)
+	default:
+		return false, fmt.Errorf("got %d", resp.StatusCode)
+	}
+}
+
+// webhookSignature signs the timestamp along with the body so that receivers
+// can reject old webhooks being replayed
+func webhookSignature(secret []byte, timestamp string, body []byte) string {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(timestamp + "."))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,129 @@
+package oauth2proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oauth2-proxy/oauth2-proxy/pkg/apis/sessions"
+	"github.com/oauth2-proxy/oauth2-proxy/providers"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// webhookReceiver records the webhooks it receives, failing the first
+// failures requests
+type webhookReceiver struct {
+	server   *httptest.Server
+	failures int
+	received chan *http.Request
+	bodies   chan []byte
+}
+
+func newWebhookReceiver(failures int) *webhookReceiver {
+	r := &webhookReceiver{
+		failures: failures,
+		received: make(chan *http.Request, 10),
+		bodies:   make(chan []byte, 10),
+	}
+	r.server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		if r.failures > 0 {
+			r.failures--
+			rw.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		r.received <- req
+		r.bodies <- body
+		rw.WriteHeader(http.StatusNoContent)
+	}))
+	return r
+}
+
+func (r *webhookReceiver) next(t *testing.T) (*http.Request, *webhookEvent, []byte) {
+	select {
+	case req := <-r.received:
+		body := <-r.bodies
+		event := &webhookEvent{}
+		require.NoError(t, json.Unmarshal(body, event))
+		return req, event, body
+	case <-time.After(5 * time.Second):
+		t.Fatal("no webhook received")
+		return nil, nil, nil
+	}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	receiver := newWebhookReceiver(2)
+	defer receiver.server.Close()
+
+	w, err := newWebhookNotifier([]string{receiver.server.URL}, "secret", []string{webhookSignIn, webhookRefreshFailure}, 2)
+	require.NoError(t, err)
+	w.backoff = time.Millisecond
+	w.start()
+
+	assert.False(t, w.wants(webhookSignOut))
+	assert.False(t, (*webhookNotifier)(nil).wants(webhookSignIn))
+
+	session := &sessions.SessionState{User: "jane", Email: "jane@example.com"}
+	req := httptest.NewRequest("GET", "/", nil)
+	w.notify(webhookRefreshFailure, req, "10.0.0.1", session, "Google", errors.New("token revoked"))
+
+	// The event is retried until the receiver accepts it
+	received, event, body := receiver.next(t)
+	assert.Equal(t, webhookRefreshFailure, event.Event)
+	assert.Equal(t, "jane", event.User)
+	assert.Equal(t, "jane@example.com", event.Email)
+	assert.Equal(t, "10.0.0.1", event.ClientIP)
+	assert.Equal(t, "Google", event.Provider)
+	assert.Equal(t, "token revoked", event.Error)
+
+	assert.Equal(t, "application/json", received.Header.Get("Content-Type"))
+	assert.Equal(t, webhookRefreshFailure, received.Header.Get("X-OAuth2-Proxy-Event"))
+	timestamp := received.Header.Get("X-OAuth2-Proxy-Timestamp")
+	assert.Equal(t, "sha256="+webhookSignature([]byte("secret"), timestamp, body), received.Header.Get("X-OAuth2-Proxy-Signature"))
+	assert.NotEqual(t, webhookSignature([]byte("other"), timestamp, body), webhookSignature([]byte("secret"), timestamp, body))
+}
+
+func TestWebhookPasswordSignIn(t *testing.T) {
+	receiver := newWebhookReceiver(0)
+	defer receiver.server.Close()
+
+	pcTest := NewProcessCookieTestWithOptionsModifiers(func(opts *Options) {
+		opts.WebhookURLs = []string{receiver.server.URL}
+		opts.WebhookSecret = "secret"
+	})
+	pcTest.proxy.provider = &TestPasswordProvider{ProviderData: &providers.ProviderData{ProviderName: "LDAP"}}
+
+	form := url.Values{"username": {"jane"}, "password": {"secret"}}
+	req := httptest.NewRequest("POST", pcTest.opts.ProxyPrefix+"/sign_in", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rw := httptest.NewRecorder()
+	pcTest.proxy.ServeHTTP(rw, req)
+	require.Equal(t, http.StatusFound, rw.Code)
+
+	_, event, _ := receiver.next(t)
+	assert.Equal(t, webhookSignIn, event.Event)
+	assert.Equal(t, "jane@example.com", event.Email)
+	assert.Equal(t, "LDAP", event.Provider)
+	assert.NotEmpty(t, event.ClientIP)
+
+	// Signing out sends an event for the session being cleared
+	req = httptest.NewRequest("GET", pcTest.opts.ProxyPrefix+"/sign_out", nil)
+	for _, c := range rw.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	rw = httptest.NewRecorder()
+	pcTest.proxy.ServeHTTP(rw, req)
+	require.Equal(t, http.StatusFound, rw.Code)
+
+	_, event, _ = receiver.next(t)
+	assert.Equal(t, webhookSignOut, event.Event)
+	assert.Equal(t, "jane", event.User)
+}
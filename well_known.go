@@ -0,0 +1,43 @@
+package oauth2proxy
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// wellKnownPrefix is the path under which RFC 8615 well-known URIs are served
+const wellKnownPrefix = "/.well-known/"
+
+// parseWellKnownPaths returns the paths of the named well-known URIs, eg.
+// /.well-known/acme-challenge for acme-challenge. Empty names are ignored so
+// that the defaults can be turned off.
+func parseWellKnownPaths(names []string) ([]string, error) {
+	var paths []string
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		if strings.ContainsAny(name, `/\?#`) || name == "." || name == ".." {
+			return nil, fmt.Errorf("skip_auth_well_known (%s) must be the name of a well-known URI, eg. acme-challenge", name)
+		}
+		paths = append(paths, wellKnownPrefix+name)
+	}
+	return paths, nil
+}
+
+// matchWellKnownPath returns the well-known path that reqPath is or is
+// under, or "" if there's none. The request path is cleaned first, as the
+// proxy's mux redirects requests for unclean paths anyway.
+func matchWellKnownPath(paths []string, reqPath string) string {
+	if !strings.HasPrefix(reqPath, wellKnownPrefix) {
+		return ""
+	}
+	reqPath = path.Clean(reqPath)
+	for _, p := range paths {
+		if reqPath == p || strings.HasPrefix(reqPath, p+"/") {
+			return p
+		}
+	}
+	return ""
+}
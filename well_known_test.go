@@ -0,0 +1,48 @@
+package oauth2proxy
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSkipAuthWellKnown(t *testing.T) {
+	pcTest := NewProcessCookieTestWithOptionsModifiers(func(o *Options) {
+		o.SkipAuthWellKnown = []string{"acme-challenge", "pki-validation"}
+	})
+	tests := map[string]bool{
+		"/.well-known/acme-challenge/Xh8zq3": true,
+		"/.well-known/acme-challenge":        true,
+		"/.well-known/pki-validation/a.txt":  true,
+		"/.well-known/acme-challenges/token": false,
+		"/.well-known/acme-challenge/../../": false,
+		"/.well-known/security.txt":          false,
+		"/acme-challenge/token":              false,
+	}
+	for path, whitelisted := range tests {
+		assert.Equal(t, whitelisted, pcTest.proxy.IsWhitelistedRequest(httptest.NewRequest("GET", path, nil)), path)
+	}
+
+	decision := pcTest.proxy.SimulateAuthorization(httptest.NewRequest("GET", "/.well-known/acme-challenge/Xh8zq3", nil), "")
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, "skip-auth-well-known /.well-known/acme-challenge", decision.Rule)
+}
+
+func TestSkipAuthWellKnownOptions(t *testing.T) {
+	o := testOptions()
+	assert.NoError(t, o.Validate())
+	assert.Equal(t, []string{"/.well-known/acme-challenge"}, o.wellKnownPaths)
+
+	o = testOptions()
+	o.SkipAuthWellKnown = []string{""}
+	assert.NoError(t, o.Validate())
+	assert.Empty(t, o.wellKnownPaths)
+
+	o = testOptions()
+	o.SkipAuthWellKnown = []string{"/.well-known/acme-challenge"}
+	err := o.Validate()
+	assert.NotEqual(t, nil, err)
+	assert.Equal(t, errorMsg([]string{
+		"skip_auth_well_known (/.well-known/acme-challenge) must be the name of a well-known URI, eg. acme-challenge"}), err.Error())
+}